@@ -22,10 +22,15 @@ extern crate aead;
 extern crate bip39;
 extern crate chacha20poly1305;
 extern crate ed25519_dalek;
+extern crate hkdf;
 extern crate itertools;
+extern crate miniz_oxide;
 extern crate nom;
+extern crate qrcode;
 extern crate rand;
 extern crate serde;
+extern crate sha2;
+extern crate unicode_normalization;
 extern crate unsigned_varint;
 extern crate zbase32;
 
@@ -38,6 +43,12 @@ extern crate quickcheck_macros;
 /// Implementation of Shamir Secret Sharing.
 mod shamir;
 
+/// Library and wire format version compatibility information.
+pub mod version;
+
+/// Encoding of arbitrary data as words from the BIP-39 wordlist.
+pub mod mnemonic;
+
 /// Initial version of paperback wire format types.
 ///
 /// This module also includes all of the necessary code to serialise and
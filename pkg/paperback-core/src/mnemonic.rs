@@ -0,0 +1,985 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use bip39::{Language, Mnemonic, Seed};
+use sha2::{Digest, Sha256};
+use unicode_normalization::UnicodeNormalization;
+use unsigned_varint::{decode as varuint_decode, encode as varuint_encode};
+
+/// Encoding of data using the PGP word list.
+pub mod pgp;
+
+/// Diceware wordlists and dice roll helpers.
+pub mod diceware;
+
+/// Encoding of data using the bech32 character set and checksum.
+pub mod bech32;
+
+/// Encoding of data as numbered groups of words with per-group checksums.
+pub mod group;
+
+/// SLIP-39 wordlist and RS1024 checksum encoding.
+pub mod slip39;
+
+/// Numbered layouts of mnemonics for printing.
+pub mod paper;
+
+/// User-supplied wordlists.
+pub mod custom;
+
+/// Error-correcting mnemonics using Reed-Solomon parity words.
+pub mod parity;
+
+/// Encoding of fixed-size keys as mnemonics.
+pub mod key;
+
+/// Detection of easily-confused words in mnemonics.
+pub mod confusable;
+
+/// Accent-insensitive lookups in non-English wordlists.
+pub mod accent;
+
+/// Incremental encoding and decoding of byte streams.
+pub mod stream;
+
+/// Language of the wordlist used for all mnemonics.
+const LANGUAGE: Language = Language::English;
+
+/// Number of bits encoded by each word in the wordlist.
+const WORD_BITS: u32 = 11;
+
+/// Maximum edit distance of suggestions returned by [`suggest_words`].
+pub const MAX_SUGGESTION_DISTANCE: usize = 2;
+
+/// Number of checksum words appended by [`encode_framed`].
+pub const FRAME_CHECKSUM_WORDS: usize = 2;
+
+/// Number of words in the wordlist.
+pub const WORDLIST_LENGTH: usize = 1 << WORD_BITS;
+
+/// Maximum number of words in a wordlist used with [`encode_with`].
+pub const MAX_WORDLIST_LENGTH: usize = 1 << 16;
+
+#[derive(Debug, thiserror::Error)]
+pub enum Error {
+    #[error("word {} ({:?}) is not in the wordlist", .index, .word)]
+    UnknownWord { index: usize, word: String },
+
+    #[error("word {} ({:?}) is from the wrong wordlist for its position", .index, .word)]
+    WrongParity { index: usize, word: String },
+
+    #[error("word {} ({:?}) is a prefix of several words in the bip39 wordlist", .index, .word)]
+    AmbiguousWord { index: usize, word: String },
+
+    #[error("mnemonic has invalid trailing padding")]
+    InvalidPadding,
+
+    #[error("mnemonic is too short to contain a checksum")]
+    MissingChecksum,
+
+    #[error("mnemonic checksum mismatch -- some words are incorrect")]
+    ChecksumMismatch,
+
+    #[error("mnemonic length prefix is invalid: {}", .0)]
+    InvalidLength(String),
+
+    #[error("error in word group {}: {}", .group, .reason)]
+    InvalidGroup { group: usize, reason: String },
+
+    #[error("invalid bip39 mnemonic: {}", .0)]
+    InvalidMnemonic(String),
+
+    #[error("invalid numbered mnemonic: {}", .0)]
+    InvalidLayout(String),
+
+    #[error("error in words {} to {}: {}", .first, .last, .reason)]
+    ChecksumWindow {
+        first: usize,
+        last: usize,
+        reason: String,
+    },
+
+    #[error("invalid key mnemonic: {}", .0)]
+    InvalidKey(String),
+
+    #[error("mnemonic has too many incorrect or missing words to be corrected")]
+    TooManyErrors,
+
+    #[error("invalid bech32 string: {}", .0)]
+    InvalidBech32(String),
+
+    #[error("invalid dice rolls: {}", .0)]
+    InvalidDiceRolls(String),
+
+    #[error("invalid wordlist: {}", .0)]
+    InvalidWordlist(String),
+}
+
+/// A list of words, each of which encodes the value of its index.
+pub trait Wordlist {
+    /// Returns the number of words in the wordlist.
+    fn len(&self) -> usize;
+
+    /// Returns whether the wordlist has no words.
+    fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+
+    /// Returns the word which encodes `index`, if there is one.
+    fn word(&self, index: usize) -> Option<&str>;
+
+    /// Returns the value encoded by `word`, if it is in the wordlist.
+    fn index(&self, word: &str) -> Option<usize>;
+
+    /// Returns all of the words in the wordlist which start with `prefix`, for
+    /// completing words as a user types them. The prefix is normalised in the
+    /// same way as [`normalize_phrase`]. If no words are returned, the user has
+    /// already made a mistake.
+    fn complete(&self, prefix: &str) -> Vec<&str> {
+        let prefix = normalize_prefix(prefix);
+        (0..self.len())
+            .filter_map(|index| self.word(index))
+            .filter(|word| word.starts_with(&prefix))
+            .collect()
+    }
+}
+
+fn normalize_prefix(prefix: &str) -> String {
+    prefix.trim().nfkd().collect::<String>().to_lowercase()
+}
+
+/// The BIP-39 wordlist used by [`encode`] and [`decode`].
+#[derive(Clone, Copy, Debug, Default)]
+pub struct Bip39Wordlist;
+
+impl Wordlist for Bip39Wordlist {
+    fn len(&self) -> usize {
+        WORDLIST_LENGTH
+    }
+
+    fn word(&self, index: usize) -> Option<&str> {
+        wordlist().get(index).copied()
+    }
+
+    fn index(&self, word: &str) -> Option<usize> {
+        word_index(word).map(usize::from)
+    }
+
+    fn complete(&self, prefix: &str) -> Vec<&str> {
+        complete(prefix)
+    }
+}
+
+/// SHA-256 digest of the upstream BIP-39 English wordlist file
+/// (`bip-0039/english.txt` in <https://github.com/bitcoin/bips>).
+const BIP39_ENGLISH_SHA256: [u8; 32] = [
+    0x2f, 0x5e, 0xed, 0x53, 0xa4, 0x72, 0x7b, 0x4b, 0xf8, 0x88, 0x0d, 0x8f, 0x3f, 0x19, 0x9e, 0xfc,
+    0x90, 0xe5, 0x85, 0x03, 0x64, 0x6d, 0x9f, 0xf8, 0xef, 0xf3, 0xa2, 0xed, 0x3b, 0x24, 0xdb, 0xda,
+];
+
+/// Check that the SHA-256 digest of `words` (formatted as a wordlist file, with
+/// one word per line) matches `expected`.
+fn verify_digest<S: AsRef<str>>(name: &str, words: &[S], expected: &[u8; 32]) -> Result<(), Error> {
+    let mut hasher = Sha256::new();
+    for word in words {
+        hasher.update(word.as_ref());
+        hasher.update("\n");
+    }
+    if hasher.finalize().as_slice() != &expected[..] {
+        return Err(Error::InvalidWordlist(format!(
+            "{} wordlist does not match the upstream wordlist",
+            name
+        )));
+    }
+    Ok(())
+}
+
+/// Verify that the BIP-39 wordlist built into this binary is identical to the
+/// upstream wordlist, by comparing its SHA-256 digest to that of the upstream
+/// wordlist file.
+pub fn verify_wordlist() -> Result<(), Error> {
+    verify_digest("bip39", wordlist(), &BIP39_ENGLISH_SHA256)
+}
+
+/// Returns the BIP-39 wordlist, ordered by the value each word encodes.
+pub fn wordlist() -> &'static [&'static str] {
+    // Every word in the wordlist starts with the empty prefix.
+    let words = LANGUAGE.wordlist().get_words_by_prefix("");
+    assert_eq!(words.len(), WORDLIST_LENGTH, "bip39 wordlist is incomplete");
+    words
+}
+
+/// Returns the value encoded by `word`, if it is in the wordlist.
+pub fn word_index(word: &str) -> Option<u16> {
+    // The English wordlist is sorted, so we don't need a reverse map.
+    wordlist()
+        .binary_search_by(|probe| (*probe).cmp(word))
+        .ok()
+        .map(|index| index as u16)
+}
+
+/// Returns all words in the wordlist which start with `prefix`.
+pub fn words_with_prefix(prefix: &str) -> &'static [&'static str] {
+    LANGUAGE.wordlist().get_words_by_prefix(prefix)
+}
+
+/// Returns all words in the wordlist which could complete the partially-typed
+/// `prefix` (see [`Wordlist::complete`]).
+pub fn complete(prefix: &str) -> Vec<&'static str> {
+    words_with_prefix(&normalize_prefix(prefix)).to_vec()
+}
+
+/// Expand a (possibly abbreviated) `word` to the word in the wordlist it
+/// refers to.
+///
+/// An exact match is always preferred (some words are prefixes of other words,
+/// such as "act" and "action"), otherwise `word` must be a prefix of exactly
+/// one word. BIP-39 words are unique in their first four letters, so any
+/// four-letter abbreviation can be expanded.
+pub fn expand_word(word: &str) -> Option<&'static str> {
+    match words_with_prefix(word) {
+        [first, ..] if *first == word => Some(*first),
+        [only] => Some(*only),
+        _ => None,
+    }
+}
+
+/// Returns the edit distance between `a` and `b`, counting insertions,
+/// deletions, substitutions and transpositions of adjacent characters (the
+/// "optimal string alignment" distance).
+fn edit_distance(a: &str, b: &str) -> usize {
+    let (a, b) = (a.chars().collect::<Vec<_>>(), b.chars().collect::<Vec<_>>());
+
+    // dist[i][j] is the distance between a[..i] and b[..j].
+    let mut dist = vec![vec![0; b.len() + 1]; a.len() + 1];
+    for (i, row) in dist.iter_mut().enumerate() {
+        row[0] = i;
+    }
+    for (j, cell) in dist[0].iter_mut().enumerate() {
+        *cell = j;
+    }
+    for i in 1..=a.len() {
+        for j in 1..=b.len() {
+            let cost = if a[i - 1] == b[j - 1] { 0 } else { 1 };
+            dist[i][j] = (dist[i - 1][j] + 1)
+                .min(dist[i][j - 1] + 1)
+                .min(dist[i - 1][j - 1] + cost);
+            if i > 1 && j > 1 && a[i - 1] == b[j - 2] && a[i - 2] == b[j - 1] {
+                dist[i][j] = dist[i][j].min(dist[i - 2][j - 2] + 1);
+            }
+        }
+    }
+    dist[a.len()][b.len()]
+}
+
+/// Returns the words in the wordlist closest to `input`, for suggesting
+/// corrections to a mistyped word ("did you mean ...?").
+///
+/// Only words within [`MAX_SUGGESTION_DISTANCE`] edits of `input` are
+/// returned, ordered by their distance from `input` (and then by their order in
+/// the wordlist). If `input` is already in the wordlist, it is the only
+/// suggestion.
+pub fn suggest_words(input: &str) -> Vec<&'static str> {
+    if let Some(index) = word_index(input) {
+        return vec![wordlist()[index as usize]];
+    }
+
+    let mut suggestions = wordlist()
+        .iter()
+        .map(|word| (edit_distance(input, word), *word))
+        .filter(|(distance, _)| *distance <= MAX_SUGGESTION_DISTANCE)
+        .collect::<Vec<_>>();
+    // The sort is stable, so equally-close words stay in wordlist order.
+    suggestions.sort_by_key(|(distance, _)| *distance);
+    suggestions.into_iter().map(|(_, word)| word).collect()
+}
+
+/// Split a phrase typed or copied by a user into normalised words.
+///
+/// As required by BIP-39, the phrase is converted to Unicode NFKD. The phrase
+/// is also lower-cased, and any amount of whitespace (including leading and
+/// trailing whitespace) separates words.
+pub fn normalize_phrase(phrase: &str) -> Vec<String> {
+    phrase
+        .nfkd()
+        .collect::<String>()
+        .to_lowercase()
+        .split_whitespace()
+        .map(String::from)
+        .collect()
+}
+
+/// Decode a phrase containing the words produced by [`encode`], after
+/// normalising it with [`normalize_phrase`].
+pub fn decode_phrase(phrase: &str) -> Result<Vec<u8>, Error> {
+    decode(&normalize_phrase(phrase))
+}
+
+/// Derive the 512-bit BIP-39 seed for a standard BIP-39 `phrase` (which must
+/// have a valid checksum) and `passphrase`.
+///
+/// The phrase is normalised with [`normalize_phrase`] and the seed is derived
+/// using PBKDF2-HMAC-SHA512, as specified by BIP-39. The seed can be used
+/// directly as the input to BIP-32 wallet key derivation.
+pub fn mnemonic_to_seed(phrase: &str, passphrase: &str) -> Result<Vec<u8>, Error> {
+    let phrase = normalize_phrase(phrase).join(" ");
+    let mnemonic = Mnemonic::from_phrase(&phrase, LANGUAGE)
+        .map_err(|err| Error::InvalidMnemonic(err.to_string()))?;
+    let passphrase = passphrase.nfkd().collect::<String>();
+    Ok(Seed::new(&mnemonic, &passphrase).as_bytes().to_vec())
+}
+
+/// Encode arbitrary `data` as a sequence of words from the BIP-39 wordlist.
+///
+/// Unlike BIP-39 mnemonics, any amount of data can be encoded (there is no
+/// checksum). The data is packed big-endian into 11-bit words, and is
+/// terminated by a single set bit followed by enough unset bits to fill the
+/// final word, so that the original length can always be recovered.
+pub fn encode<B: AsRef<[u8]>>(data: B) -> Vec<String> {
+    encode_with(&Bip39Wordlist, data)
+}
+
+/// Returns the number of bits encoded by each word of `wordlist`.
+fn wordlist_bits<W: Wordlist + ?Sized>(wordlist: &W) -> u32 {
+    let len = wordlist.len();
+    assert!(
+        len.is_power_of_two() && (2..=MAX_WORDLIST_LENGTH).contains(&len),
+        "wordlist length must be a power of two between 2 and {}",
+        MAX_WORDLIST_LENGTH
+    );
+    len.trailing_zeros()
+}
+
+/// Encode arbitrary `data` as a sequence of words from `wordlist`, in the same
+/// way as [`encode`]. The length of `wordlist` must be a power of two.
+pub fn encode_with<W: Wordlist + ?Sized, B: AsRef<[u8]>>(wordlist: &W, data: B) -> Vec<String> {
+    let data = data.as_ref();
+    let word_bits = wordlist_bits(wordlist);
+    let word = |bits: u32| {
+        wordlist
+            .word((bits & ((1 << word_bits) - 1)) as usize)
+            .expect("wordlist must contain all indices")
+            .to_string()
+    };
+
+    let mut words = Vec::with_capacity((data.len() * 8) / word_bits as usize + 1);
+    let (mut acc, mut acc_bits) = (0u32, 0u32);
+    for byte in data {
+        acc = (acc << 8) | *byte as u32;
+        acc_bits += 8;
+        while acc_bits >= word_bits {
+            acc_bits -= word_bits;
+            words.push(word(acc >> acc_bits));
+        }
+    }
+
+    // Terminate the data and pad it to a whole word.
+    acc = (acc << 1) | 1;
+    acc_bits += 1;
+    words.push(word(acc << (word_bits - acc_bits)));
+
+    words
+}
+
+/// Decode a sequence of words produced by [`encode`].
+pub fn decode<S: AsRef<str>>(words: &[S]) -> Result<Vec<u8>, Error> {
+    decode_with(&Bip39Wordlist, words)
+}
+
+/// Decode a sequence of words produced by [`encode_with`] using the same
+/// `wordlist`.
+pub fn decode_with<W: Wordlist + ?Sized, S: AsRef<str>>(
+    wordlist: &W,
+    words: &[S],
+) -> Result<Vec<u8>, Error> {
+    decode_indices(words, wordlist_bits(wordlist), |index, word| {
+        wordlist
+            .index(word)
+            .map(|value| value as u16)
+            .ok_or_else(|| Error::UnknownWord {
+                index,
+                word: word.to_string(),
+            })
+    })
+}
+
+/// Expand the (possibly abbreviated) `word` at position `index`, returning an
+/// error describing why it could not be expanded.
+fn expand_abbreviated(index: usize, word: &str) -> Result<&'static str, Error> {
+    let word = word.to_string();
+    match words_with_prefix(&word).len() {
+        0 => Err(Error::UnknownWord { index, word }),
+        _ => expand_word(&word).ok_or(Error::AmbiguousWord { index, word }),
+    }
+}
+
+/// Expand each of the (possibly abbreviated, see [`expand_word`]) `words` to
+/// the word in the wordlist it refers to.
+///
+/// The words are checked in order, so the error refers to the first word
+/// which is not in the wordlist (or is ambiguous). This allows words to be
+/// checked as they are typed, rather than only finding out about a typo from a
+/// checksum mismatch once every word has been entered.
+pub fn expand_words<S: AsRef<str>>(words: &[S]) -> Result<Vec<&'static str>, Error> {
+    words
+        .iter()
+        .enumerate()
+        .map(|(index, word)| expand_abbreviated(index, word.as_ref()))
+        .collect()
+}
+
+/// Returns the words of a BIP-39 `wordlist` (such as
+/// [`CodewordLanguage::words`]) which start with the normalised `prefix`. The
+/// words are compared in their normalised form, since the accented words of
+/// some wordlists can be typed in several ways.
+///
+/// [`CodewordLanguage::words`]: crate::v0::CodewordLanguage::words
+fn words_with_prefix_in(wordlist: &'static [&'static str], prefix: &str) -> Vec<&'static str> {
+    wordlist
+        .iter()
+        .copied()
+        .filter(|word| normalize_prefix(word).starts_with(prefix))
+        .collect()
+}
+
+/// Like [`word_index`], but for any BIP-39 `wordlist`. `word` is normalised
+/// (see [`normalize_phrase`]) before it is looked up.
+pub fn word_index_in(wordlist: &'static [&'static str], word: &str) -> Option<usize> {
+    let word = normalize_prefix(word);
+    wordlist
+        .iter()
+        .position(|candidate| normalize_prefix(candidate) == word)
+}
+
+/// Like [`complete`], but for any BIP-39 `wordlist`.
+pub fn complete_in(wordlist: &'static [&'static str], prefix: &str) -> Vec<&'static str> {
+    words_with_prefix_in(wordlist, &normalize_prefix(prefix))
+}
+
+/// Like [`suggest_words`], but for any BIP-39 `wordlist`.
+pub fn suggest_words_in(wordlist: &'static [&'static str], input: &str) -> Vec<&'static str> {
+    if let Some(index) = word_index_in(wordlist, input) {
+        return vec![wordlist[index]];
+    }
+
+    let input = normalize_prefix(input);
+    let mut suggestions = wordlist
+        .iter()
+        .map(|word| (edit_distance(&input, &normalize_prefix(word)), *word))
+        .filter(|(distance, _)| *distance <= MAX_SUGGESTION_DISTANCE)
+        .collect::<Vec<_>>();
+    // The sort is stable, so equally-close words stay in wordlist order.
+    suggestions.sort_by_key(|(distance, _)| *distance);
+    suggestions.into_iter().map(|(_, word)| word).collect()
+}
+
+/// Like [`expand_words`], but for any BIP-39 `wordlist`. Each word is
+/// normalised (see [`normalize_phrase`]) and expanded to the word as it is
+/// written in the wordlist.
+pub fn expand_words_in<S: AsRef<str>>(
+    wordlist: &'static [&'static str],
+    words: &[S],
+) -> Result<Vec<&'static str>, Error> {
+    words
+        .iter()
+        .enumerate()
+        .map(|(index, word)| {
+            if let Some(exact) = word_index_in(wordlist, word.as_ref()) {
+                return Ok(wordlist[exact]);
+            }
+            let word = word.as_ref().to_string();
+            match complete_in(wordlist, &word)[..] {
+                [] => Err(Error::UnknownWord { index, word }),
+                [only] => Ok(only),
+                _ => Err(Error::AmbiguousWord { index, word }),
+            }
+        })
+        .collect()
+}
+
+/// Decode a sequence of words produced by [`encode`], where each word may have
+/// been abbreviated to a unique prefix (see [`expand_word`]).
+pub fn decode_abbreviated<S: AsRef<str>>(words: &[S]) -> Result<Vec<u8>, Error> {
+    decode_indices(words, WORD_BITS, |index, word| {
+        expand_abbreviated(index, word)
+            .map(|word| word_index(word).expect("expanded words must be in the wordlist"))
+    })
+}
+
+/// Decode a sequence of words produced by [`encode`], where any word may
+/// instead be given as its (zero-based) decimal index in the wordlist.
+///
+/// This allows the data to be recovered using a copy of the wordlist in
+/// another language (or from OCR output of the indices), since the index of a
+/// word is the same in every BIP-39 wordlist. Note that the line numbers of the
+/// upstream wordlist files are one-based, and so are one greater than the
+/// index of each word.
+pub fn decode_indexed<S: AsRef<str>>(words: &[S]) -> Result<Vec<u8>, Error> {
+    decode_indices(words, WORD_BITS, |index, word| {
+        let value = match word.parse::<usize>() {
+            Ok(value) if value < WORDLIST_LENGTH => Some(value as u16),
+            Ok(_) => None,
+            Err(_) => word_index(word),
+        };
+        value.ok_or_else(|| Error::UnknownWord {
+            index,
+            word: word.to_string(),
+        })
+    })
+}
+
+fn decode_indices<S, F>(words: &[S], word_bits: u32, lookup: F) -> Result<Vec<u8>, Error>
+where
+    S: AsRef<str>,
+    F: Fn(usize, &str) -> Result<u16, Error>,
+{
+    let mut data = Vec::with_capacity((words.len() * word_bits as usize) / 8);
+    let (mut acc, mut acc_bits) = (0u32, 0u32);
+    for (index, word) in words.iter().enumerate() {
+        let bits = lookup(index, word.as_ref())? as u32;
+        acc = (acc << word_bits) | bits;
+        acc_bits += word_bits;
+
+        // Strip the terminating bit and padding from the final word.
+        if index == words.len() - 1 {
+            let padding = bits.trailing_zeros() + 1;
+            if padding > word_bits {
+                return Err(Error::InvalidPadding);
+            }
+            acc >>= padding;
+            acc_bits -= padding;
+        }
+
+        while acc_bits >= 8 {
+            acc_bits -= 8;
+            data.push((acc >> acc_bits) as u8);
+        }
+        acc &= (1 << acc_bits) - 1;
+    }
+
+    // There must be no leftover bits (and there must have been a final word).
+    if words.is_empty() || acc_bits != 0 {
+        return Err(Error::InvalidPadding);
+    }
+    Ok(data)
+}
+
+/// Returns the checksum words for a framed payload.
+fn frame_checksum(framed: &[u8]) -> Vec<&'static str> {
+    let hash = Sha256::digest(framed);
+    // Take the leading bits of the hash, one word at a time.
+    let bits = u32::from_be_bytes([hash[0], hash[1], hash[2], hash[3]]);
+    (0..FRAME_CHECKSUM_WORDS)
+        .map(|idx| (bits >> (32 - WORD_BITS * (idx as u32 + 1))) as usize)
+        .map(|value| wordlist()[value & (WORDLIST_LENGTH - 1)])
+        .collect()
+}
+
+/// Encode arbitrary `data` as a self-checking sequence of words.
+///
+/// The data is prefixed with its length (as an unsigned varint) and encoded
+/// with [`encode`], followed by [`FRAME_CHECKSUM_WORDS`] words derived from the
+/// SHA-256 hash of the length-prefixed data. This allows payloads of any size
+/// (such as an entire key shard) to be written down as words, while still
+/// detecting transcription errors and truncation.
+pub fn encode_framed<B: AsRef<[u8]>>(data: B) -> Vec<String> {
+    let data = data.as_ref();
+    let framed = varuint_encode::usize(data.len(), &mut varuint_encode::usize_buffer())
+        .iter()
+        .chain(data)
+        .copied()
+        .collect::<Vec<_>>();
+
+    let mut words = encode(&framed);
+    words.extend(frame_checksum(&framed).into_iter().map(String::from));
+    words
+}
+
+/// Decode a sequence of words produced by [`encode_framed`], verifying the
+/// checksum and length prefix.
+pub fn decode_framed<S: AsRef<str>>(words: &[S]) -> Result<Vec<u8>, Error> {
+    if words.len() <= FRAME_CHECKSUM_WORDS {
+        return Err(Error::MissingChecksum);
+    }
+    let (words, checksum) = words.split_at(words.len() - FRAME_CHECKSUM_WORDS);
+
+    let framed = decode(words)?;
+    if !checksum
+        .iter()
+        .map(|word| word.as_ref())
+        .eq(frame_checksum(&framed).into_iter())
+    {
+        return Err(Error::ChecksumMismatch);
+    }
+
+    let (length, data) =
+        varuint_decode::usize(&framed).map_err(|err| Error::InvalidLength(err.to_string()))?;
+    if length != data.len() {
+        return Err(Error::InvalidLength(format!(
+            "expected {} bytes but found {}",
+            length,
+            data.len()
+        )));
+    }
+    Ok(data.into())
+}
+
+/// Returns the number of words [`encode`] produces for `len` bytes of data.
+pub fn encoded_words(len: usize) -> usize {
+    // Every complete word of data, followed by a final word containing the
+    // leftover bits and the terminating bit.
+    (len * 8) / WORD_BITS as usize + 1
+}
+
+/// Returns the number of words [`encode_framed`] produces for `len` bytes of
+/// data.
+pub fn framed_words(len: usize) -> usize {
+    let prefix_len = varuint_encode::usize(len, &mut varuint_encode::usize_buffer()).len();
+    encoded_words(prefix_len + len) + FRAME_CHECKSUM_WORDS
+}
+
+/// Returns the number of bits of entropy carried by `num_words` words chosen
+/// uniformly at random from the wordlist.
+pub fn entropy_bits(num_words: usize) -> usize {
+    num_words * WORD_BITS as usize
+}
+
+/// Returns the largest number of bytes which [`encode`] can encode in at most
+/// `num_words` words.
+///
+/// Returns `None` if `num_words` is zero, since [`encode`] always produces at
+/// least one word.
+pub fn max_data_len(num_words: usize) -> Option<usize> {
+    // One bit of the final word is always used by the terminating bit.
+    entropy_bits(num_words).checked_sub(1).map(|bits| bits / 8)
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn wordlist_digest() {
+        verify_wordlist().unwrap();
+
+        let mut words = wordlist().to_vec();
+        words.swap(0, 1);
+        verify_digest("bip39", &words, &BIP39_ENGLISH_SHA256).unwrap_err();
+    }
+
+    #[test]
+    fn wordlist_sorted() {
+        let words = wordlist();
+        assert!(words.windows(2).all(|pair| pair[0] < pair[1]));
+        assert_eq!(word_index("abandon"), Some(0));
+        assert_eq!(word_index("zoo"), Some(2047));
+        assert_eq!(word_index("paperback"), None);
+    }
+
+    #[test]
+    fn encode_known() {
+        let words = wordlist();
+        assert_eq!(encode(b""), vec![words[0b100_0000_0000]]);
+        assert_eq!(encode(b"\x00"), vec!["above"]);
+        assert_eq!(
+            encode(b"\xa5\x5a"),
+            vec![words[0b101_0010_1010], words[0b110_1010_0000]]
+        );
+        // Eleven bytes fill eight words exactly, so the terminating bit needs a
+        // word of its own.
+        let mut expected = vec!["zoo"; 8];
+        expected.push(words[0b100_0000_0000]);
+        assert_eq!(encode([0xffu8; 11]), expected);
+    }
+
+    #[test]
+    fn decode_invalid() {
+        assert!(matches!(
+            decode::<&str>(&[]).unwrap_err(),
+            Error::InvalidPadding
+        ));
+        // No terminating bit.
+        assert!(matches!(
+            decode(&["abandon"]).unwrap_err(),
+            Error::InvalidPadding
+        ));
+        // Terminating bit leaves a partial byte.
+        assert!(matches!(
+            decode(&["zoo"]).unwrap_err(),
+            Error::InvalidPadding
+        ));
+        assert!(matches!(
+            decode(&["abuse", "paperback"]).unwrap_err(),
+            Error::UnknownWord { index: 1, .. }
+        ));
+    }
+
+    #[test]
+    fn expand_known() {
+        assert_eq!(expand_word("abandon"), Some("abandon"));
+        assert_eq!(expand_word("aban"), Some("abandon"));
+        assert_eq!(expand_word("zon"), Some("zone"));
+        // Exact matches win over longer words.
+        assert_eq!(expand_word("act"), Some("act"));
+        assert_eq!(expand_word("acti"), Some("action"));
+        // Ambiguous or unknown.
+        assert_eq!(expand_word("ab"), None);
+        assert_eq!(expand_word("paperback"), None);
+    }
+
+    #[test]
+    fn complete_known() {
+        assert_eq!(complete("zo"), vec!["zone", "zoo"]);
+        assert_eq!(complete(" ZO "), vec!["zone", "zoo"]);
+        assert_eq!(complete("zoo"), vec!["zoo"]);
+        assert_eq!(complete("").len(), WORDLIST_LENGTH);
+        assert!(complete("zq").is_empty());
+        assert_eq!(Bip39Wordlist.complete("zo"), vec!["zone", "zoo"]);
+    }
+
+    #[test]
+    fn decode_abbreviated_invalid() {
+        assert!(matches!(
+            decode_abbreviated(&["ab"]).unwrap_err(),
+            Error::AmbiguousWord { index: 0, .. }
+        ));
+        assert!(matches!(
+            decode_abbreviated(&["abov", "paperback"]).unwrap_err(),
+            Error::UnknownWord { index: 1, .. }
+        ));
+    }
+
+    #[test]
+    fn wordlist_in_english() {
+        let words = wordlist();
+        assert_eq!(word_index_in(words, " ZOO "), Some(WORDLIST_LENGTH - 1));
+        assert_eq!(complete_in(words, "zo"), complete("zo"));
+        assert_eq!(suggest_words_in(words, "zoop"), suggest_words("zoop"));
+        assert_eq!(
+            expand_words_in(words, &["abov", "zoo", "zon"]).unwrap(),
+            expand_words(&["abov", "zoo", "zon"]).unwrap()
+        );
+        assert!(matches!(
+            expand_words_in(words, &["zoo", "zo"]).unwrap_err(),
+            Error::AmbiguousWord { index: 1, .. }
+        ));
+        assert!(matches!(
+            expand_words_in(words, &["paperback"]).unwrap_err(),
+            Error::UnknownWord { index: 0, .. }
+        ));
+    }
+
+    #[test]
+    fn wordlist_in_accented() {
+        for language in &[Language::French, Language::Spanish] {
+            let words = language.wordlist().get_words_by_prefix("");
+            for (index, word) in words.iter().enumerate().step_by(97) {
+                // The words must be found no matter how they are composed.
+                let composed = word.nfc().collect::<String>();
+                let decomposed = word.nfkd().collect::<String>().to_uppercase();
+                assert_eq!(word_index_in(words, &composed), Some(index));
+                assert_eq!(word_index_in(words, &decomposed), Some(index));
+                assert_eq!(
+                    expand_words_in(words, &[composed, decomposed]).unwrap(),
+                    vec![*word, *word]
+                );
+            }
+        }
+    }
+
+    #[test]
+    fn expand_words_known() {
+        assert_eq!(
+            expand_words(&["abov", "zoo", "zon"]).unwrap(),
+            vec!["above", "zoo", "zone"]
+        );
+        assert!(expand_words::<&str>(&[]).unwrap().is_empty());
+        assert!(matches!(
+            expand_words(&["above", "zo"]).unwrap_err(),
+            Error::AmbiguousWord { index: 1, .. }
+        ));
+        assert!(matches!(
+            expand_words(&["abov", "paperback", "zq"]).unwrap_err(),
+            Error::UnknownWord { index: 1, .. }
+        ));
+    }
+
+    #[quickcheck]
+    fn abbreviated_roundtrip(data: Vec<u8>) -> bool {
+        let words = encode(&data)
+            .into_iter()
+            .map(|word| word.chars().take(4).collect::<String>())
+            .collect::<Vec<_>>();
+        decode_abbreviated(&words).unwrap() == data
+    }
+
+    #[test]
+    fn decode_indexed_known() {
+        assert_eq!(decode_indexed(&["4"]).unwrap(), b"\x00");
+        assert_eq!(decode_indexed(&["above"]).unwrap(), b"\x00");
+        assert_eq!(decode_indexed(&["0004"]).unwrap(), b"\x00");
+        assert!(matches!(
+            decode_indexed(&["1322", "2048"]).unwrap_err(),
+            Error::UnknownWord { index: 1, .. }
+        ));
+        assert!(matches!(
+            decode_indexed(&["-1"]).unwrap_err(),
+            Error::UnknownWord { index: 0, .. }
+        ));
+    }
+
+    #[quickcheck]
+    fn indexed_roundtrip(data: Vec<u8>, numbered: Vec<bool>) -> bool {
+        let words = encode(&data)
+            .into_iter()
+            .zip(numbered.into_iter().chain(std::iter::repeat(true)))
+            .map(|(word, numbered)| {
+                if numbered {
+                    word_index(&word).unwrap().to_string()
+                } else {
+                    word
+                }
+            })
+            .collect::<Vec<_>>();
+        decode_indexed(&words).unwrap() == data
+    }
+
+    #[test]
+    fn edit_distance_known() {
+        assert_eq!(edit_distance("", ""), 0);
+        assert_eq!(edit_distance("", "zoo"), 3);
+        assert_eq!(edit_distance("ability", "ability"), 0);
+        assert_eq!(edit_distance("abilty", "ability"), 1);
+        assert_eq!(edit_distance("abiltiy", "ability"), 1);
+        assert_eq!(edit_distance("kitten", "sitting"), 3);
+    }
+
+    #[test]
+    fn suggest_known() {
+        assert_eq!(suggest_words("ability"), vec!["ability"]);
+        assert_eq!(suggest_words("abilty").first(), Some(&"ability"));
+        assert_eq!(suggest_words("zooo").first(), Some(&"zoo"));
+        assert!(suggest_words("paperback").is_empty());
+    }
+
+    #[test]
+    fn normalize_known() {
+        assert_eq!(
+            normalize_phrase("  Abandon\tABILITY \n\n able\u{a0}"),
+            vec!["abandon", "ability", "able"]
+        );
+        // Full-width letters are compatibility-equivalent to ASCII.
+        assert_eq!(normalize_phrase("\u{ff5a}\u{ff4f}\u{ff4f}"), vec!["zoo"]);
+        // Composed characters are decomposed.
+        assert_eq!(normalize_phrase("\u{e9}"), vec!["e\u{301}"]);
+        assert!(normalize_phrase(" \t\n").is_empty());
+    }
+
+    #[quickcheck]
+    fn phrase_roundtrip(data: Vec<u8>) -> bool {
+        let phrase = encode(&data)
+            .iter()
+            .map(|word| format!("  {}\n", word.to_uppercase()))
+            .collect::<String>();
+        decode_phrase(&phrase).unwrap() == data
+    }
+
+    #[test]
+    fn decode_framed_invalid() {
+        let mut words = encode_framed(b"key shard");
+        assert_eq!(decode_framed(&words).unwrap(), b"key shard");
+
+        assert!(matches!(
+            decode_framed(&words[..FRAME_CHECKSUM_WORDS]).unwrap_err(),
+            Error::MissingChecksum
+        ));
+
+        // Change one word.
+        words[1] = if words[1] == "zoo" { "abandon" } else { "zoo" }.to_string();
+        assert!(matches!(
+            decode_framed(&words).unwrap_err(),
+            Error::ChecksumMismatch
+        ));
+
+        // A valid checksum but incorrect length prefix.
+        let framed = [4u8, b'a', b'b'];
+        let mut words = encode(&framed);
+        words.extend(frame_checksum(&framed).into_iter().map(String::from));
+        assert!(matches!(
+            decode_framed(&words).unwrap_err(),
+            Error::InvalidLength(_)
+        ));
+    }
+
+    #[quickcheck]
+    fn framed_roundtrip(data: Vec<u8>) -> bool {
+        decode_framed(&encode_framed(&data)).unwrap() == data
+    }
+
+    #[test]
+    fn capacity_known() {
+        assert_eq!(encoded_words(0), 1);
+        assert_eq!(encoded_words(1), 1);
+        assert_eq!(encoded_words(11), 9);
+        assert_eq!(encoded_words(32), 24);
+        assert_eq!(entropy_bits(24), 264);
+        assert_eq!(max_data_len(0), None);
+        assert_eq!(max_data_len(1), Some(1));
+        assert_eq!(max_data_len(8), Some(10));
+        assert_eq!(max_data_len(9), Some(12));
+    }
+
+    #[quickcheck]
+    fn capacity_matches_encode(data: Vec<u8>) -> bool {
+        let words = encode(&data).len();
+        words == encoded_words(data.len())
+            && encode_framed(&data).len() == framed_words(data.len())
+            && max_data_len(words).unwrap() >= data.len()
+            && encoded_words(max_data_len(words).unwrap()) == words
+            && encoded_words(max_data_len(words).unwrap() + 1) > words
+    }
+
+    #[test]
+    fn seed_known() {
+        // Test vectors from BIP-39.
+        let phrase = "abandon abandon abandon abandon abandon abandon abandon abandon abandon \
+                      abandon abandon about";
+        assert_eq!(
+            mnemonic_to_seed(phrase, "TREZOR").unwrap(),
+            vec![
+                0xc5, 0x52, 0x57, 0xc3, 0x60, 0xc0, 0x7c, 0x72, 0x02, 0x9a, 0xeb, 0xc1, 0xb5, 0x3c,
+                0x05, 0xed, 0x03, 0x62, 0xad, 0xa3, 0x8e, 0xad, 0x3e, 0x3e, 0x9e, 0xfa, 0x37, 0x08,
+                0xe5, 0x34, 0x95, 0x53, 0x1f, 0x09, 0xa6, 0x98, 0x75, 0x99, 0xd1, 0x82, 0x64, 0xc1,
+                0xe1, 0xc9, 0x2f, 0x2c, 0xf1, 0x41, 0x63, 0x0c, 0x7a, 0x3c, 0x4a, 0xb7, 0xc8, 0x1b,
+                0x2f, 0x00, 0x16, 0x98, 0xe7, 0x46, 0x3b, 0x04,
+            ]
+        );
+        // Normalisation is applied to the phrase.
+        assert_eq!(
+            mnemonic_to_seed(&format!("  {}\n", phrase.to_uppercase()), "TREZOR").unwrap(),
+            mnemonic_to_seed(phrase, "TREZOR").unwrap()
+        );
+        // Invalid checksum.
+        mnemonic_to_seed(&phrase.replace("about", "abandon"), "").unwrap_err();
+    }
+
+    #[quickcheck]
+    fn encode_decode_roundtrip(data: Vec<u8>) -> bool {
+        decode(&encode(&data)).unwrap() == data
+    }
+}
@@ -0,0 +1,125 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! Several of the BIP-39 wordlists contain accented words, which users
+//! frequently type without their accents (such as "etre" for "être"). The
+//! French and Spanish wordlists were constructed such that no two words differ
+//! only in their accents, so words can be matched on their unaccented
+//! "skeleton" form.
+//!
+//! The bip39 crate does not include the Czech wordlist, so only French and
+//! Spanish are supported.
+
+use crate::mnemonic::{Error, WORDLIST_LENGTH};
+
+use bip39::Language;
+use unicode_normalization::{char::is_combining_mark, UnicodeNormalization};
+
+/// Returns the skeleton form of `word`: lower-cased, with all diacritics
+/// removed.
+pub fn skeleton(word: &str) -> String {
+    word.trim()
+        .nfkd()
+        .filter(|ch| !is_combining_mark(*ch))
+        .collect::<String>()
+        .to_lowercase()
+}
+
+/// Returns the wordlist for `language`, if it is supported for
+/// accent-insensitive lookups.
+fn accented_wordlist(language: Language) -> Result<&'static [&'static str], Error> {
+    match language {
+        Language::French | Language::Spanish => {
+            // Every word in the wordlist starts with the empty prefix.
+            let words = language.wordlist().get_words_by_prefix("");
+            assert_eq!(words.len(), WORDLIST_LENGTH, "bip39 wordlist is incomplete");
+            Ok(words)
+        }
+        _ => Err(Error::InvalidWordlist(format!(
+            "accent-insensitive lookups are not supported for {:?}",
+            language
+        ))),
+    }
+}
+
+/// Find the word in the `language` wordlist whose skeleton matches the
+/// skeleton of `word`, returning the canonical (accented) word and its index.
+///
+/// Returns `Ok(None)` if no word matches.
+pub fn lookup(language: Language, word: &str) -> Result<Option<(&'static str, u16)>, Error> {
+    let word = skeleton(word);
+    Ok(accented_wordlist(language)?
+        .iter()
+        .enumerate()
+        .find(|(_, candidate)| skeleton(candidate) == word)
+        .map(|(index, candidate)| (*candidate, index as u16)))
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use std::collections::HashSet;
+
+    #[test]
+    fn skeleton_known() {
+        assert_eq!(skeleton("être"), "etre");
+        assert_eq!(skeleton("Académie"), "academie");
+        assert_eq!(skeleton("niño"), "nino");
+        assert_eq!(skeleton(" pingüino "), "pinguino");
+        assert_eq!(skeleton("zoo"), "zoo");
+    }
+
+    #[test]
+    fn unsupported_language() {
+        assert!(matches!(
+            lookup(Language::English, "zoo").unwrap_err(),
+            Error::InvalidWordlist(_)
+        ));
+    }
+
+    #[test]
+    fn skeletons_unique() {
+        for language in &[Language::French, Language::Spanish] {
+            let words = accented_wordlist(*language).unwrap();
+            let skeletons = words
+                .iter()
+                .map(|word| skeleton(word))
+                .collect::<HashSet<_>>();
+            assert_eq!(skeletons.len(), WORDLIST_LENGTH);
+        }
+    }
+
+    #[test]
+    fn lookup_known() {
+        for language in &[Language::French, Language::Spanish] {
+            let words = accented_wordlist(*language).unwrap();
+            for index in (0..WORDLIST_LENGTH).step_by(97) {
+                let word = words[index];
+                let expected = Some((word, index as u16));
+                assert_eq!(lookup(*language, word).unwrap(), expected);
+                assert_eq!(lookup(*language, &skeleton(word)).unwrap(), expected);
+                assert_eq!(
+                    lookup(*language, &skeleton(word).to_uppercase()).unwrap(),
+                    expected
+                );
+            }
+            assert_eq!(lookup(*language, "paperback").unwrap(), None);
+        }
+    }
+}
@@ -0,0 +1,245 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! Rather than words, payloads are encoded using the 32-character [bech32]
+//! alphabet (which avoids visually similar characters) followed by a 6
+//! character BCH checksum, using the bech32m checksum constant from [BIP-350].
+//! For strings of up to 90 characters, any error affecting at most 4
+//! characters is guaranteed to be detected (and longer strings still detect
+//! errors with overwhelming probability). This makes for much shorter strings
+//! to copy by hand than word-based encodings.
+//!
+//! [bech32]: https://github.com/bitcoin/bips/blob/master/bip-0173.mediawiki
+//! [BIP-350]: https://github.com/bitcoin/bips/blob/master/bip-0350.mediawiki
+
+use crate::mnemonic::Error;
+
+/// The bech32 character set, ordered by the 5-bit value of each character.
+pub const CHARSET: &[u8; 32] = b"qpzry9x8gf2tvdw0s3jn54khce6mua7l";
+
+/// Separator between the human-readable part and the data.
+pub const SEPARATOR: char = '1';
+
+/// Number of checksum characters.
+pub const CHECKSUM_LENGTH: usize = 6;
+
+/// Human-readable part used for paperback payloads.
+pub const PAPERBACK_HRP: &str = "pb";
+
+const BECH32M_CONST: u32 = 0x2bc8_30a3;
+
+fn polymod(values: &[u8]) -> u32 {
+    const GENERATOR: [u32; 5] = [
+        0x3b6a_57b2,
+        0x2650_8e6d,
+        0x1ea1_19fa,
+        0x3d42_33dd,
+        0x2a14_62b3,
+    ];
+    values.iter().fold(1u32, |chk, value| {
+        let top = chk >> 25;
+        let chk = (chk & 0x01ff_ffff) << 5 ^ *value as u32;
+        GENERATOR
+            .iter()
+            .enumerate()
+            .filter(|(idx, _)| (top >> idx) & 1 == 1)
+            .fold(chk, |chk, (_, gen)| chk ^ gen)
+    })
+}
+
+fn hrp_expand(hrp: &str) -> Vec<u8> {
+    hrp.bytes()
+        .map(|b| b >> 5)
+        .chain(Some(0))
+        .chain(hrp.bytes().map(|b| b & 31))
+        .collect()
+}
+
+fn checksum(hrp: &str, data: &[u8]) -> Vec<u8> {
+    let mut values = hrp_expand(hrp);
+    values.extend_from_slice(data);
+    values.extend_from_slice(&[0; CHECKSUM_LENGTH]);
+    let polymod = polymod(&values) ^ BECH32M_CONST;
+    (0..CHECKSUM_LENGTH)
+        .map(|idx| ((polymod >> (5 * (5 - idx))) & 31) as u8)
+        .collect()
+}
+
+/// Regroup `data` from `from`-bit values to `to`-bit values. If `pad` is not
+/// set, the data must not have any non-zero leftover bits.
+fn convert_bits(data: &[u8], from: u32, to: u32, pad: bool) -> Result<Vec<u8>, Error> {
+    let (mut acc, mut acc_bits) = (0u32, 0u32);
+    let mut output = Vec::with_capacity(data.len() * from as usize / to as usize + 1);
+    for value in data {
+        acc = (acc << from) | *value as u32;
+        acc_bits += from;
+        while acc_bits >= to {
+            acc_bits -= to;
+            output.push(((acc >> acc_bits) & ((1 << to) - 1)) as u8);
+        }
+        acc &= (1 << acc_bits) - 1;
+    }
+    if pad {
+        if acc_bits > 0 {
+            output.push(((acc << (to - acc_bits)) & ((1 << to) - 1)) as u8);
+        }
+    } else if acc_bits >= from || acc != 0 {
+        return Err(Error::InvalidPadding);
+    }
+    Ok(output)
+}
+
+/// Encode `data` as a bech32m string with the human-readable part `hrp` (which
+/// should be lower-case).
+pub fn encode<B: AsRef<[u8]>>(hrp: &str, data: B) -> String {
+    let data = convert_bits(data.as_ref(), 8, 5, true).expect("padded conversion cannot fail");
+    let checksum = checksum(hrp, &data);
+
+    let mut output = String::with_capacity(hrp.len() + 1 + data.len() + CHECKSUM_LENGTH);
+    output.push_str(hrp);
+    output.push(SEPARATOR);
+    output.extend(
+        data.iter()
+            .chain(&checksum)
+            .map(|value| CHARSET[*value as usize] as char),
+    );
+    output
+}
+
+/// Returns the length of the string [`encode`] produces for `len` bytes of data
+/// with the human-readable part `hrp`.
+pub fn encoded_len(hrp: &str, len: usize) -> usize {
+    hrp.len() + 1 + (len * 8 + 4) / 5 + CHECKSUM_LENGTH
+}
+
+/// Decode a bech32m string produced by [`encode`], returning the
+/// human-readable part (in lower-case) and the data. Strings may be entirely
+/// upper-case or entirely lower-case.
+pub fn decode(string: &str) -> Result<(String, Vec<u8>), Error> {
+    let invalid = |msg: &str| Error::InvalidBech32(msg.to_string());
+
+    if string.chars().any(|ch| !(33..=126).contains(&(ch as u32))) {
+        return Err(invalid("contains invalid characters"));
+    }
+    let lower = string.to_ascii_lowercase();
+    if lower != string && string.to_ascii_uppercase() != string {
+        return Err(invalid("mixed-case string"));
+    }
+
+    let separator = lower
+        .rfind(SEPARATOR)
+        .ok_or_else(|| invalid("missing separator"))?;
+    let (hrp, data) = (&lower[..separator], &lower[separator + 1..]);
+    if hrp.is_empty() || data.len() < CHECKSUM_LENGTH {
+        return Err(invalid("too short"));
+    }
+
+    let values = data
+        .bytes()
+        .enumerate()
+        .map(|(index, ch)| {
+            CHARSET
+                .iter()
+                .position(|c| *c == ch)
+                .map(|value| value as u8)
+                .ok_or_else(|| {
+                    Error::InvalidBech32(format!(
+                        "invalid character {:?} at position {}",
+                        ch as char,
+                        separator + 1 + index
+                    ))
+                })
+        })
+        .collect::<Result<Vec<_>, Error>>()?;
+
+    let mut check = hrp_expand(hrp);
+    check.extend_from_slice(&values);
+    if polymod(&check) != BECH32M_CONST {
+        return Err(Error::ChecksumMismatch);
+    }
+
+    let data = convert_bits(&values[..values.len() - CHECKSUM_LENGTH], 5, 8, false)?;
+    Ok((hrp.to_string(), data))
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn decode_known() {
+        // Test vectors from BIP-350.
+        for valid in &[
+            "A1LQFN3A",
+            "a1lqfn3a",
+            "abcdef1l7aum6echk45nj3s0wdvt2fg8x9yrzpqzd3ryx",
+            "split1checkupstagehandshakeupstreamerranterredcaperredlc445v",
+            "?1v759aa",
+        ] {
+            let (hrp, data) = decode(valid).unwrap();
+            assert_eq!(encode(&hrp, &data), valid.to_ascii_lowercase());
+        }
+        assert_eq!(decode("a1lqfn3a").unwrap(), ("a".to_string(), vec![]));
+    }
+
+    #[test]
+    fn decode_invalid() {
+        // Test vectors from BIP-350.
+        for invalid in &[
+            "\x201xj0phk",
+            "\x7f1g6xzxy",
+            "qyrz8wqd2c9m",
+            "1qyrz8wqd2c9m",
+            "y1b0jsk6g",
+            "lt1igcx5c0",
+            "in1muywd",
+            "mm1crxm3i",
+            "au1s5cgom",
+            "M1VUXWEZ",
+            "16plkw9",
+            "1p2gdwpf",
+        ] {
+            decode(invalid).unwrap_err();
+        }
+        // Mixed case.
+        decode("A1lqfn3a").unwrap_err();
+        // Bech32 (rather than bech32m) checksum.
+        decode("a12uel5l").unwrap_err();
+    }
+
+    #[test]
+    fn single_error_detected() {
+        let encoded = encode(PAPERBACK_HRP, b"key shard");
+        for idx in PAPERBACK_HRP.len() + 1..encoded.len() {
+            let mut corrupted = encoded.clone().into_bytes();
+            corrupted[idx] = if corrupted[idx] == b'q' { b'p' } else { b'q' };
+            let corrupted = String::from_utf8(corrupted).unwrap();
+            assert!(matches!(
+                decode(&corrupted).unwrap_err(),
+                Error::ChecksumMismatch
+            ));
+        }
+    }
+
+    #[quickcheck]
+    fn encode_decode_roundtrip(data: Vec<u8>) -> bool {
+        let encoded = encode(PAPERBACK_HRP, &data);
+        encoded.len() == encoded_len(PAPERBACK_HRP, data.len())
+            && decode(&encoded).unwrap() == (PAPERBACK_HRP.to_string(), data)
+    }
+}
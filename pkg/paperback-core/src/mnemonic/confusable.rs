@@ -0,0 +1,233 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! Even if every word in a wordlist is distinct, some pairs of words are easy
+//! to mix up when handwritten (words which differ by a single letter) or when
+//! read aloud (words which sound the same). Words in a mnemonic are only
+//! checked against each other, so a confusion between two words which both
+//! appear in the same mnemonic is far more likely to go unnoticed.
+
+use crate::mnemonic::edit_distance;
+
+/// Maximum edit distance between two words for them to be considered
+/// [`Confusion::Spelling`] confusable.
+pub const MAX_CONFUSABLE_DISTANCE: usize = 1;
+
+/// The reason two words are considered confusable.
+#[derive(Clone, Copy, Debug, Eq, PartialEq, Hash)]
+pub enum Confusion {
+    /// The words differ by only a single letter (or a transposition of two
+    /// adjacent letters), and so are easily misread when handwritten.
+    Spelling,
+    /// The words are (approximately) pronounced the same, and so are easily
+    /// misheard when read aloud.
+    Sound,
+}
+
+/// A pair of confusable words in a mnemonic.
+#[derive(Clone, Debug, Eq, PartialEq, Hash)]
+pub struct ConfusablePair {
+    /// Position of the first word in the mnemonic.
+    pub first: usize,
+    /// Position of the second word in the mnemonic.
+    pub second: usize,
+    /// Why the words are confusable.
+    pub confusion: Confusion,
+}
+
+/// Returns a rough phonetic key for `word`, such that words which are likely
+/// to sound the same have the same key.
+///
+/// This is a far simpler scheme than Soundex or Metaphone, since it only needs
+/// to catch English homophones (Soundex would consider most short words in the
+/// wordlist to be homophones).
+fn phonetic_key(word: &str) -> String {
+    let mut word = word.to_lowercase();
+    for (from, to) in &[
+        ("wr", "r"),
+        ("kn", "n"),
+        ("ph", "f"),
+        ("gh", ""),
+        ("ck", "k"),
+        ("ea", "e"),
+        ("ee", "e"),
+        ("ie", "e"),
+        ("ou", "o"),
+        ("ai", "a"),
+        ("ei", "a"),
+    ] {
+        word = word.replace(from, to);
+    }
+
+    let mut key = String::with_capacity(word.len());
+    for ch in word.chars() {
+        let ch = match ch {
+            'c' | 'q' => 'k',
+            'z' => 's',
+            'y' => 'i',
+            ch => ch,
+        };
+        // Doubled letters are pronounced the same as a single letter.
+        if !key.ends_with(ch) {
+            key.push(ch);
+        }
+    }
+    // A trailing "e" is usually silent.
+    if key.len() > 2 && key.ends_with('e') {
+        key.pop();
+    }
+    key
+}
+
+/// Returns whether (and why) `a` and `b` are easily confused.
+pub fn confusable(a: &str, b: &str) -> Option<Confusion> {
+    if a == b {
+        None
+    } else if edit_distance(a, b) <= MAX_CONFUSABLE_DISTANCE {
+        Some(Confusion::Spelling)
+    } else if phonetic_key(a) == phonetic_key(b) {
+        Some(Confusion::Sound)
+    } else {
+        None
+    }
+}
+
+/// Returns every pair of distinct words in `words` which are easily confused
+/// with each other.
+///
+/// Repeated words are not reported, since swapping two identical words cannot
+/// change the decoded data.
+pub fn confusable_pairs<S: AsRef<str>>(words: &[S]) -> Vec<ConfusablePair> {
+    let mut pairs = vec![];
+    for (first, a) in words.iter().enumerate() {
+        for (second, b) in words.iter().enumerate().skip(first + 1) {
+            if let Some(confusion) = confusable(a.as_ref(), b.as_ref()) {
+                pairs.push(ConfusablePair {
+                    first,
+                    second,
+                    confusion,
+                });
+            }
+        }
+    }
+    pairs
+}
+
+/// Generate up to `attempts` candidate mnemonics with `generate` and return the
+/// first one which contains no confusable words (or, failing that, the
+/// candidate with the fewest confusable pairs).
+///
+/// This is only useful for encodings which have some freedom in the choice of
+/// words, such as randomly-generated passphrases (see
+/// [`DicewareWordlist::passphrase`](crate::mnemonic::diceware::DicewareWordlist::passphrase)).
+/// The encodings in [`mnemonic`](crate::mnemonic) are deterministic, so
+/// re-generating them will always produce the same words.
+pub fn reroll_confusable<F: FnMut() -> Vec<String>>(
+    attempts: usize,
+    mut generate: F,
+) -> Vec<String> {
+    assert!(attempts > 0, "must make at least one attempt");
+    let mut best: Option<(usize, Vec<String>)> = None;
+    for _ in 0..attempts {
+        let words = generate();
+        let num_pairs = confusable_pairs(&words).len();
+        if num_pairs == 0 {
+            return words;
+        }
+        if best
+            .as_ref()
+            .map_or(true, |(best_pairs, _)| num_pairs < *best_pairs)
+        {
+            best = Some((num_pairs, words));
+        }
+    }
+    best.expect("at least one attempt was made").1
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn confusable_words() {
+        assert_eq!(confusable("sun", "son"), Some(Confusion::Spelling));
+        assert_eq!(confusable("form", "from"), Some(Confusion::Spelling));
+        assert_eq!(confusable("cat", "cart"), Some(Confusion::Spelling));
+        assert_eq!(confusable("right", "write"), Some(Confusion::Sound));
+        assert_eq!(confusable("night", "knight"), Some(Confusion::Spelling));
+        assert_eq!(confusable("piece", "peace"), Some(Confusion::Sound));
+        assert_eq!(confusable("phase", "faze"), Some(Confusion::Sound));
+        assert_eq!(confusable("sun", "sun"), None);
+        assert_eq!(confusable("abandon", "zoo"), None);
+        assert_eq!(confusable("cable", "table"), Some(Confusion::Spelling));
+        assert_eq!(confusable("cable", "kettle"), None);
+    }
+
+    #[test]
+    fn pairs() {
+        let words = ["right", "abandon", "sun", "write", "zoo", "son", "sun"];
+        assert_eq!(
+            confusable_pairs(&words),
+            vec![
+                ConfusablePair {
+                    first: 0,
+                    second: 3,
+                    confusion: Confusion::Sound
+                },
+                ConfusablePair {
+                    first: 2,
+                    second: 5,
+                    confusion: Confusion::Spelling
+                },
+                ConfusablePair {
+                    first: 5,
+                    second: 6,
+                    confusion: Confusion::Spelling
+                },
+            ]
+        );
+    }
+
+    #[test]
+    fn reroll() {
+        let candidates = vec![
+            vec!["sun", "son", "night", "knight"],
+            vec!["sun", "son", "abandon", "zoo"],
+            vec!["sun", "zoo", "abandon", "night"],
+            vec!["sun", "son", "sun", "son"],
+        ];
+        let mut iter = candidates.iter().map(|words| {
+            words
+                .iter()
+                .map(|word| word.to_string())
+                .collect::<Vec<_>>()
+        });
+
+        // The first candidate without confusable words is chosen.
+        assert_eq!(reroll_confusable(4, || iter.next().unwrap()), candidates[2]);
+
+        // Otherwise the candidate with the fewest pairs is chosen.
+        let mut iter = candidates.iter().map(|words| {
+            words
+                .iter()
+                .map(|word| word.to_string())
+                .collect::<Vec<_>>()
+        });
+        assert_eq!(reroll_confusable(2, || iter.next().unwrap()), candidates[1]);
+    }
+}
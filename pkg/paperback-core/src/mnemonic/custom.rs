@@ -0,0 +1,168 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! Organisations may want to use their own vetted (or localised) wordlists
+//! rather than the BIP-39 wordlist. A [`CustomWordlist`] can be used anywhere
+//! a [`Wordlist`] is accepted, such as [`encode_with`] and [`decode_with`].
+//!
+//! [`encode_with`]: crate::mnemonic::encode_with
+//! [`decode_with`]: crate::mnemonic::decode_with
+
+use crate::mnemonic::{normalize_phrase, Error, Wordlist, MAX_WORDLIST_LENGTH};
+
+use std::io::Read;
+
+/// Number of leading characters in which every word of a wordlist must be
+/// unique (as with the BIP-39 wordlists), so that words can be abbreviated.
+pub const UNIQUE_PREFIX_LENGTH: usize = 4;
+
+/// A wordlist supplied by the user.
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub struct CustomWordlist {
+    words: Vec<String>,
+    // Indices of words, sorted by the word they refer to (for binary search).
+    sorted: Vec<usize>,
+}
+
+impl CustomWordlist {
+    /// Load a wordlist from `reader`, with one word per line (blank lines are
+    /// ignored). See [`CustomWordlist::from_words`] for the requirements a
+    /// wordlist must meet.
+    pub fn load<R: Read>(mut reader: R) -> Result<Self, Error> {
+        let mut text = String::new();
+        reader
+            .read_to_string(&mut text)
+            .map_err(|err| Error::InvalidWordlist(format!("failed to read wordlist: {}", err)))?;
+        Self::from_words(
+            text.lines()
+                .map(str::trim)
+                .filter(|line| !line.is_empty())
+                .map(String::from)
+                .collect(),
+        )
+    }
+
+    /// Construct a wordlist from `words`, where each word encodes the value of
+    /// its index. The wordlist is validated to ensure that:
+    ///
+    ///  * The number of words is a power of two (from 2 up to
+    ///    [`MAX_WORDLIST_LENGTH`]), so each word encodes a whole number of
+    ///    bits.
+    ///  * Each word is already normalised (see
+    ///    [`normalize_phrase`](crate::mnemonic::normalize_phrase)), so words
+    ///    typed by a user can be matched.
+    ///  * Each word is unique in its first [`UNIQUE_PREFIX_LENGTH`] characters.
+    pub fn from_words(words: Vec<String>) -> Result<Self, Error> {
+        let len = words.len();
+        if !len.is_power_of_two() || !(2..=MAX_WORDLIST_LENGTH).contains(&len) {
+            return Err(Error::InvalidWordlist(format!(
+                "wordlist has {} words, which is not a power of two between 2 and {}",
+                len, MAX_WORDLIST_LENGTH
+            )));
+        }
+
+        if let Some(word) = words
+            .iter()
+            .find(|word| normalize_phrase(word) != [word.as_str()])
+        {
+            return Err(Error::InvalidWordlist(format!(
+                "word {:?} is not normalised",
+                word
+            )));
+        }
+
+        let prefix = |word: &str| word.chars().take(UNIQUE_PREFIX_LENGTH).collect::<String>();
+        let mut sorted = (0..len).collect::<Vec<_>>();
+        sorted.sort_by(|a, b| words[*a].cmp(&words[*b]));
+        let mut prefixes = words.iter().map(|word| prefix(word)).collect::<Vec<_>>();
+        prefixes.sort();
+        if let Some(pair) = prefixes.windows(2).find(|pair| pair[0] == pair[1]) {
+            return Err(Error::InvalidWordlist(format!(
+                "several words start with {:?}",
+                pair[0]
+            )));
+        }
+
+        Ok(Self { words, sorted })
+    }
+}
+
+impl Wordlist for CustomWordlist {
+    fn len(&self) -> usize {
+        self.words.len()
+    }
+
+    fn word(&self, index: usize) -> Option<&str> {
+        self.words.get(index).map(String::as_str)
+    }
+
+    fn index(&self, word: &str) -> Option<usize> {
+        self.sorted
+            .binary_search_by(|index| self.words[*index].as_str().cmp(word))
+            .ok()
+            .map(|idx| self.sorted[idx])
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::mnemonic::{decode_with, encode_with};
+
+    fn numbered_words(len: usize) -> Vec<String> {
+        (0..len).map(|idx| format!("{:04}x", idx)).collect()
+    }
+
+    #[test]
+    fn load_wordlist() {
+        let text = "  delta\nbravo\n\ncharlie\nalpha  \n";
+        let wordlist = CustomWordlist::load(text.as_bytes()).unwrap();
+        assert_eq!(wordlist.len(), 4);
+        assert_eq!(wordlist.word(0), Some("delta"));
+        assert_eq!(wordlist.index("alpha"), Some(3));
+        assert_eq!(wordlist.index("echo"), None);
+
+        let words = encode_with(&wordlist, b"\x1b");
+        // Each word encodes two bits.
+        assert_eq!(words, vec!["delta", "bravo", "charlie", "alpha", "charlie"]);
+        assert_eq!(decode_with(&wordlist, &words).unwrap(), b"\x1b");
+    }
+
+    #[test]
+    fn invalid_wordlists() {
+        // Not a power of two.
+        CustomWordlist::from_words(numbered_words(3)).unwrap_err();
+        CustomWordlist::from_words(numbered_words(1)).unwrap_err();
+        CustomWordlist::from_words(vec![]).unwrap_err();
+        // Duplicate words and prefixes.
+        CustomWordlist::from_words(vec!["alpha".into(), "alpha".into()]).unwrap_err();
+        CustomWordlist::from_words(vec!["alpha".into(), "alphabet".into()]).unwrap_err();
+        // Not normalised.
+        CustomWordlist::from_words(vec!["Alpha".into(), "bravo".into()]).unwrap_err();
+        CustomWordlist::from_words(vec!["al pha".into(), "bravo".into()]).unwrap_err();
+        CustomWordlist::from_words(vec!["caf\u{e9}".into(), "bravo".into()]).unwrap_err();
+        CustomWordlist::from_words(vec!["cafe\u{301}".into(), "bravo".into()]).unwrap();
+    }
+
+    #[quickcheck]
+    fn custom_roundtrip(data: Vec<u8>, bits: u8) -> bool {
+        let wordlist = CustomWordlist::from_words(numbered_words(1 << (bits % 12 + 1))).unwrap();
+        decode_with(&wordlist, &encode_with(&wordlist, &data)).unwrap() == data
+    }
+}
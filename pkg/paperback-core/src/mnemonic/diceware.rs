@@ -0,0 +1,299 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! Diceware wordlists map the results of rolling several six-sided dice to a
+//! word, which allows passphrases (or other secrets) to be generated by hand
+//! using physical dice. Wordlists are parsed from the format published by the
+//! EFF, such as the [large wordlist][eff-large] (five rolls per word) and the
+//! [short wordlist][eff-short] (four rolls per word).
+//!
+//! [eff-large]: https://www.eff.org/files/2016/07/18/eff_large_wordlist.txt
+//! [eff-short]: https://www.eff.org/files/2016/09/08/eff_short_wordlist_1.txt
+
+use crate::mnemonic::{Error, Wordlist};
+
+use rand::{CryptoRng, Rng};
+
+/// Number of sides on each die.
+pub const DICE_SIDES: u8 = 6;
+
+/// Number of dice rolled for each word of the EFF large wordlist.
+pub const EFF_LARGE_ROLLS: usize = 5;
+
+/// Number of dice rolled for each word of the EFF short wordlist.
+pub const EFF_SHORT_ROLLS: usize = 4;
+
+/// Convert a sequence of dice `rolls` (each from `1` to [`DICE_SIDES`]) to the
+/// index they select in a diceware wordlist.
+pub fn rolls_to_index(rolls: &[u8]) -> Result<usize, Error> {
+    rolls
+        .iter()
+        .copied()
+        .try_fold(0usize, |index, roll| match roll {
+            1..=DICE_SIDES => Ok(index * DICE_SIDES as usize + (roll - 1) as usize),
+            _ => Err(Error::InvalidDiceRolls(format!(
+                "{} is not a valid roll of a {}-sided die",
+                roll, DICE_SIDES
+            ))),
+        })
+}
+
+/// Convert an `index` in a diceware wordlist to the `num_rolls` dice rolls
+/// which select it.
+pub fn index_to_rolls(mut index: usize, num_rolls: usize) -> Vec<u8> {
+    let mut rolls = vec![0; num_rolls];
+    for roll in rolls.iter_mut().rev() {
+        *roll = (index % DICE_SIDES as usize) as u8 + 1;
+        index /= DICE_SIDES as usize;
+    }
+    rolls
+}
+
+/// Parse a sequence of dice rolls written as digits (such as `"16655"`).
+pub fn parse_rolls(rolls: &str) -> Result<Vec<u8>, Error> {
+    rolls
+        .chars()
+        .map(|ch| match ch.to_digit(10) {
+            Some(roll @ 1..=6) => Ok(roll as u8),
+            _ => Err(Error::InvalidDiceRolls(format!(
+                "{:?} is not a valid roll of a {}-sided die",
+                ch, DICE_SIDES
+            ))),
+        })
+        .collect()
+}
+
+/// A diceware wordlist, where each word is selected by a fixed number of dice
+/// rolls.
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub struct DicewareWordlist {
+    num_rolls: usize,
+    words: Vec<String>,
+    // Indices of words, sorted by the word they refer to (for binary search).
+    sorted: Vec<usize>,
+}
+
+impl DicewareWordlist {
+    /// Parse a wordlist in the format published by the EFF -- one word per
+    /// line, each preceded by the dice rolls which select it (as digits) and
+    /// whitespace. Every possible sequence of rolls must be present, in order.
+    pub fn parse(text: &str) -> Result<Self, Error> {
+        let entries = text
+            .lines()
+            .map(str::trim)
+            .filter(|line| !line.is_empty())
+            .map(|line| {
+                let mut fields = line.split_whitespace();
+                match (fields.next(), fields.next(), fields.next()) {
+                    (Some(rolls), Some(word), None) => Ok((rolls, word)),
+                    _ => Err(Error::InvalidWordlist(format!(
+                        "malformed wordlist entry {:?}",
+                        line
+                    ))),
+                }
+            })
+            .collect::<Result<Vec<_>, Error>>()?;
+
+        let num_rolls = entries.first().map_or(0, |(rolls, _)| rolls.len());
+        let expected_len = (DICE_SIDES as usize).checked_pow(num_rolls as u32);
+        if num_rolls == 0 || expected_len != Some(entries.len()) {
+            return Err(Error::InvalidWordlist(format!(
+                "wordlist with {} rolls per word has {} words",
+                num_rolls,
+                entries.len()
+            )));
+        }
+
+        let mut words = Vec::with_capacity(entries.len());
+        for (index, (rolls, word)) in entries.into_iter().enumerate() {
+            if parse_rolls(rolls)? != index_to_rolls(index, num_rolls) {
+                return Err(Error::InvalidWordlist(format!(
+                    "wordlist entry {} has unexpected dice rolls {}",
+                    index, rolls
+                )));
+            }
+            words.push(word.to_string());
+        }
+
+        let mut sorted = (0..words.len()).collect::<Vec<_>>();
+        sorted.sort_by(|a, b| words[*a].cmp(&words[*b]));
+        if let Some(pair) = sorted
+            .windows(2)
+            .find(|pair| words[pair[0]] == words[pair[1]])
+        {
+            return Err(Error::InvalidWordlist(format!(
+                "word {:?} appears more than once",
+                words[pair[0]]
+            )));
+        }
+
+        Ok(Self {
+            num_rolls,
+            words,
+            sorted,
+        })
+    }
+
+    /// Returns the number of dice rolled to select each word.
+    pub fn rolls_per_word(&self) -> usize {
+        self.num_rolls
+    }
+
+    /// Returns the word selected by the given dice `rolls`.
+    pub fn word_for_rolls(&self, rolls: &[u8]) -> Result<&str, Error> {
+        if rolls.len() != self.num_rolls {
+            return Err(Error::InvalidDiceRolls(format!(
+                "expected {} rolls per word but got {}",
+                self.num_rolls,
+                rolls.len()
+            )));
+        }
+        Ok(&self.words[rolls_to_index(rolls)?])
+    }
+
+    /// Returns the dice rolls which select `word`, if it is in the wordlist.
+    pub fn rolls_for_word(&self, word: &str) -> Option<Vec<u8>> {
+        self.index(word)
+            .map(|index| index_to_rolls(index, self.num_rolls))
+    }
+
+    /// Generate a passphrase of `num_words` words chosen uniformly at random
+    /// (the equivalent of rolling the dice with `rng`).
+    pub fn passphrase<R: Rng + CryptoRng>(&self, num_words: usize, rng: &mut R) -> Vec<&str> {
+        (0..num_words)
+            .map(|_| self.words[rng.gen_range(0, self.words.len())].as_str())
+            .collect()
+    }
+}
+
+impl Wordlist for DicewareWordlist {
+    fn len(&self) -> usize {
+        self.words.len()
+    }
+
+    fn word(&self, index: usize) -> Option<&str> {
+        self.words.get(index).map(String::as_str)
+    }
+
+    fn index(&self, word: &str) -> Option<usize> {
+        self.sorted
+            .binary_search_by(|index| self.words[*index].as_str().cmp(word))
+            .ok()
+            .map(|idx| self.sorted[idx])
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    /// A two-roll wordlist ("w11" through "w66").
+    fn test_wordlist() -> String {
+        (0..36)
+            .map(|index| {
+                let rolls = index_to_rolls(index, 2)
+                    .iter()
+                    .map(|roll| roll.to_string())
+                    .collect::<String>();
+                format!("{}\tw{}\n", rolls, rolls)
+            })
+            .collect()
+    }
+
+    #[test]
+    fn rolls_known() {
+        assert_eq!(rolls_to_index(&[1, 1, 1, 1, 1]).unwrap(), 0);
+        assert_eq!(rolls_to_index(&[6, 6, 6, 6, 6]).unwrap(), 7775);
+        assert_eq!(rolls_to_index(&[2, 1]).unwrap(), 6);
+        assert_eq!(index_to_rolls(7775, EFF_LARGE_ROLLS), vec![6; 5]);
+        assert_eq!(index_to_rolls(6, 2), vec![2, 1]);
+        assert_eq!(parse_rolls("16655").unwrap(), vec![1, 6, 6, 5, 5]);
+
+        rolls_to_index(&[1, 7]).unwrap_err();
+        rolls_to_index(&[0]).unwrap_err();
+        parse_rolls("1607").unwrap_err();
+    }
+
+    #[test]
+    fn wordlist_lookup() {
+        let wordlist = DicewareWordlist::parse(&test_wordlist()).unwrap();
+        assert_eq!(wordlist.rolls_per_word(), 2);
+        assert_eq!(wordlist.len(), 36);
+        assert_eq!(wordlist.word_for_rolls(&[3, 4]).unwrap(), "w34");
+        assert_eq!(wordlist.rolls_for_word("w34"), Some(vec![3, 4]));
+        assert_eq!(wordlist.index("w21"), Some(6));
+        assert_eq!(wordlist.word(35), Some("w66"));
+        assert_eq!(wordlist.rolls_for_word("paperback"), None);
+        assert_eq!(wordlist.complete("W3").len(), 6);
+        assert_eq!(wordlist.complete("w34"), vec!["w34"]);
+        assert!(wordlist.complete("x").is_empty());
+        wordlist.word_for_rolls(&[3]).unwrap_err();
+
+        let passphrase = wordlist.passphrase(6, &mut rand::rngs::OsRng);
+        assert_eq!(passphrase.len(), 6);
+        assert!(passphrase.iter().all(|word| wordlist.index(word).is_some()));
+    }
+
+    #[test]
+    fn wordlist_unsorted() {
+        // Words need not be in alphabetical order.
+        let text = [
+            "1 foxtrot",
+            "2 echo",
+            "3 delta",
+            "4 charlie",
+            "5 bravo",
+            "6 alpha",
+        ]
+        .join("\n");
+        let wordlist = DicewareWordlist::parse(&text).unwrap();
+        for (index, word) in ["foxtrot", "echo", "delta", "charlie", "bravo", "alpha"]
+            .iter()
+            .enumerate()
+        {
+            assert_eq!(wordlist.index(word), Some(index));
+        }
+        assert_eq!(wordlist.index("golf"), None);
+    }
+
+    #[test]
+    fn wordlist_invalid() {
+        let text = test_wordlist();
+        let lines = text.lines().collect::<Vec<_>>();
+
+        // Missing entry.
+        DicewareWordlist::parse(&lines[1..].join("\n")).unwrap_err();
+        // Out of order.
+        let mut swapped = lines.clone();
+        swapped.swap(3, 4);
+        DicewareWordlist::parse(&swapped.join("\n")).unwrap_err();
+        // Duplicate word.
+        let mut duplicate = lines.clone();
+        duplicate[4] = "15\tw14";
+        DicewareWordlist::parse(&duplicate.join("\n")).unwrap_err();
+        // Malformed entry.
+        DicewareWordlist::parse("1\tone\n2\ttwo words").unwrap_err();
+        DicewareWordlist::parse("").unwrap_err();
+    }
+
+    #[quickcheck]
+    fn rolls_roundtrip(index: u16) -> bool {
+        let index = index as usize % 7776;
+        rolls_to_index(&index_to_rolls(index, EFF_LARGE_ROLLS)).unwrap() == index
+    }
+}
@@ -0,0 +1,402 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! Long mnemonics are hard to transcribe without making mistakes, and a single
+//! checksum for the whole mnemonic can only say that *some* word is wrong. The
+//! encoder in this module splits the words produced by
+//! [`encode`](crate::mnemonic::encode) into numbered groups (one per line) and
+//! appends a checksum word to each group, so that the decoder can say exactly
+//! which line contains an error.
+//!
+//! Each group is written as a line of the form
+//!
+//! ```text
+//! 01: word word word word word word checksum
+//! ```
+
+use crate::mnemonic::{self, normalize_phrase, word_index, wordlist, Error, WORDLIST_LENGTH};
+
+use std::{fmt, str::FromStr, vec};
+
+use sha2::{Digest, Sha256};
+
+/// Default number of words in each group (not including the checksum word).
+pub const DEFAULT_GROUP_SIZE: usize = 6;
+
+/// A numbered group of words, followed by a checksum word.
+///
+/// The checksum covers the group number, whether it is the final group, and
+/// the words in the group. This means that re-ordered, duplicated or missing
+/// lines are detected as well as incorrect words.
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub struct WordGroup {
+    number: usize,
+    is_last: bool,
+    words: Vec<String>,
+    checksum: String,
+}
+
+fn group_checksum<S: AsRef<str>>(
+    number: usize,
+    is_last: bool,
+    words: &[S],
+) -> Option<&'static str> {
+    let mut hasher = Sha256::new();
+    hasher.update((number as u64).to_be_bytes());
+    hasher.update([is_last as u8]);
+    for word in words {
+        hasher.update(word_index(word.as_ref())?.to_be_bytes());
+    }
+    let hash = hasher.finalize();
+    let value = u16::from_be_bytes([hash[0], hash[1]]) as usize;
+    Some(wordlist()[value % WORDLIST_LENGTH])
+}
+
+impl WordGroup {
+    /// Returns the number of the group (starting from `1`).
+    pub fn number(&self) -> usize {
+        self.number
+    }
+
+    /// Returns the words in the group (not including the checksum word).
+    pub fn words(&self) -> &[String] {
+        &self.words
+    }
+
+    /// Returns the checksum word of the group.
+    pub fn checksum(&self) -> &str {
+        &self.checksum
+    }
+
+    fn verify(&self, is_last: bool) -> bool {
+        group_checksum(self.number, is_last, &self.words) == Some(self.checksum.as_str())
+    }
+}
+
+impl fmt::Display for WordGroup {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{:02}:", self.number)?;
+        for word in self.words.iter().chain(Some(&self.checksum)) {
+            write!(f, " {}", word)?;
+        }
+        Ok(())
+    }
+}
+
+impl FromStr for WordGroup {
+    type Err = Error;
+
+    /// Parse a line written in the format produced by the `Display` impl. The
+    /// words are normalised with
+    /// [`normalize_phrase`](crate::mnemonic::normalize_phrase).
+    fn from_str(line: &str) -> Result<Self, Self::Err> {
+        let mut parts = line.splitn(2, ':');
+        let (number, words) = match (parts.next(), parts.next()) {
+            (Some(number), Some(words)) => (number, words),
+            _ => {
+                return Err(Error::InvalidGroup {
+                    group: 0,
+                    reason: format!("missing group number in line {:?}", line),
+                })
+            }
+        };
+        let number = number.trim().parse().map_err(|err| Error::InvalidGroup {
+            group: 0,
+            reason: format!("invalid group number {:?}: {}", number.trim(), err),
+        })?;
+
+        let mut words = normalize_phrase(words);
+        let checksum = words.pop().ok_or_else(|| Error::InvalidGroup {
+            group: number,
+            reason: "group has no words".to_string(),
+        })?;
+        Ok(Self {
+            number,
+            // We don't know until decoding whether this is the last group.
+            is_last: false,
+            words,
+            checksum,
+        })
+    }
+}
+
+/// Iterator over the [`WordGroup`]s encoding some data, returned by
+/// [`encode_grouped`].
+#[derive(Debug)]
+pub struct GroupedEncoder {
+    words: vec::IntoIter<String>,
+    group_size: usize,
+    next_number: usize,
+}
+
+impl Iterator for GroupedEncoder {
+    type Item = WordGroup;
+
+    fn next(&mut self) -> Option<Self::Item> {
+        let words = self
+            .words
+            .by_ref()
+            .take(self.group_size)
+            .collect::<Vec<_>>();
+        if words.is_empty() {
+            return None;
+        }
+        let number = self.next_number;
+        let is_last = self.words.as_slice().is_empty();
+        self.next_number += 1;
+
+        let checksum = group_checksum(number, is_last, &words)
+            .expect("encoded words must be in the wordlist")
+            .to_string();
+        Some(WordGroup {
+            number,
+            is_last,
+            words,
+            checksum,
+        })
+    }
+}
+
+/// Encode `data` (using [`encode`](crate::mnemonic::encode)) as a sequence of
+/// numbered groups of `group_size` words, each with a checksum word. The final
+/// group may be shorter than `group_size`.
+pub fn encode_grouped<B: AsRef<[u8]>>(data: B, group_size: usize) -> GroupedEncoder {
+    assert!(group_size > 0, "word groups must contain at least one word");
+    GroupedEncoder {
+        words: mnemonic::encode(data).into_iter(),
+        group_size,
+        next_number: 1,
+    }
+}
+
+/// Decode a sequence of [`WordGroup`]s produced by [`encode_grouped`].
+///
+/// Each group's checksum is verified before the data is decoded, and if a
+/// group is incorrect an [`Error::InvalidGroup`] identifying that group is
+/// returned.
+pub fn decode_grouped<I>(groups: I) -> Result<Vec<u8>, Error>
+where
+    I: IntoIterator<Item = WordGroup>,
+{
+    let mut groups = groups.into_iter().peekable();
+    let mut words = vec![];
+    let mut expected_number = 1;
+    while let Some(group) = groups.next() {
+        let is_last = groups.peek().is_none();
+        if group.number != expected_number {
+            return Err(Error::InvalidGroup {
+                group: group.number,
+                reason: format!("expected group {} in this position", expected_number),
+            });
+        }
+        if !group.verify(is_last) {
+            let reason = if is_last && group.verify(false) {
+                "groups following this group are missing"
+            } else {
+                "checksum mismatch -- one of the words is incorrect"
+            };
+            return Err(Error::InvalidGroup {
+                group: group.number,
+                reason: reason.to_string(),
+            });
+        }
+        expected_number += 1;
+        words.extend(group.words);
+    }
+    mnemonic::decode(&words)
+}
+
+/// Encode `data` (using [`encode`](crate::mnemonic::encode)) as a flat
+/// sequence of words, with a checksum word inserted after every `window`
+/// payload words (and after the final, possibly shorter, window).
+///
+/// This is the same as [`encode_grouped`] without the group numbers, so a
+/// mistyped word can be localised to a window of `window + 1` words.
+pub fn encode_interleaved<B: AsRef<[u8]>>(data: B, window: usize) -> Vec<String> {
+    encode_grouped(data, window)
+        .flat_map(|group| group.words.into_iter().chain(Some(group.checksum)))
+        .collect()
+}
+
+/// Decode a sequence of words produced by [`encode_interleaved`] with the same
+/// `window`.
+///
+/// If a window's checksum is incorrect, an [`Error::ChecksumWindow`] giving
+/// the range of words (including the checksum word) containing the error is
+/// returned.
+pub fn decode_interleaved<S: AsRef<str>>(words: &[S], window: usize) -> Result<Vec<u8>, Error> {
+    assert!(
+        window > 0,
+        "checksum windows must contain at least one word"
+    );
+    let windows = words
+        .chunks(window + 1)
+        .enumerate()
+        .map(|(idx, chunk)| {
+            let (checksum, words) = chunk.split_last().expect("chunks are never empty");
+            WordGroup {
+                number: idx + 1,
+                is_last: false,
+                words: words.iter().map(|word| word.as_ref().to_string()).collect(),
+                checksum: checksum.as_ref().to_string(),
+            }
+        })
+        .collect::<Vec<_>>();
+
+    decode_grouped(windows).map_err(|err| match err {
+        Error::InvalidGroup { group, reason } => {
+            let first = (group - 1) * (window + 1);
+            Error::ChecksumWindow {
+                first,
+                last: (first + window).min(words.len() - 1),
+                reason,
+            }
+        }
+        err => err,
+    })
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    fn encode_lines(data: &[u8]) -> Vec<String> {
+        encode_grouped(data, DEFAULT_GROUP_SIZE)
+            .map(|group| group.to_string())
+            .collect()
+    }
+
+    fn decode_lines<S: AsRef<str>>(lines: &[S]) -> Result<Vec<u8>, Error> {
+        decode_grouped(
+            lines
+                .iter()
+                .map(|line| line.as_ref().parse())
+                .collect::<Result<Vec<WordGroup>, _>>()?,
+        )
+    }
+
+    fn error_group(err: Error) -> usize {
+        match err {
+            Error::InvalidGroup { group, .. } => group,
+            err => panic!("unexpected error {:?}", err),
+        }
+    }
+
+    #[test]
+    fn grouped_format() {
+        let data = [0x5au8; 20];
+        let lines = encode_lines(&data);
+        // 20 bytes need 15 words (including the terminating bit).
+        assert_eq!(lines.len(), 3);
+        assert!(lines[0].starts_with("01: "));
+        assert_eq!(
+            lines[0].split_whitespace().count(),
+            1 + DEFAULT_GROUP_SIZE + 1
+        );
+        assert_eq!(lines[2].split_whitespace().count(), 1 + 3 + 1);
+        assert_eq!(decode_lines(&lines).unwrap(), data);
+    }
+
+    #[test]
+    fn grouped_errors() {
+        let data = (0..64).collect::<Vec<u8>>();
+        let lines = encode_lines(&data);
+
+        // Incorrect word.
+        let mut wrong = lines.clone();
+        let mut words = wrong[3].split_whitespace().collect::<Vec<_>>();
+        words[2] = if words[2] == "zoo" { "abandon" } else { "zoo" };
+        wrong[3] = words.join(" ");
+        assert_eq!(error_group(decode_lines(&wrong).unwrap_err()), 4);
+
+        // Re-ordered lines.
+        let mut swapped = lines.clone();
+        swapped.swap(1, 2);
+        assert_eq!(error_group(decode_lines(&swapped).unwrap_err()), 3);
+
+        // Missing final line.
+        let truncated = &lines[..lines.len() - 1];
+        assert_eq!(
+            error_group(decode_lines(truncated).unwrap_err()),
+            lines.len() - 1
+        );
+
+        // Unknown words are also attributed to their group.
+        let mut unknown = lines.clone();
+        unknown[1].push_str(" paperback");
+        assert_eq!(error_group(decode_lines(&unknown).unwrap_err()), 2);
+    }
+
+    #[test]
+    fn parse_lenient() {
+        let data = b"paperback";
+        let lines = encode_lines(data)
+            .into_iter()
+            .map(|line| format!("  {}  \n", line.to_uppercase().replace(' ', "   ")))
+            .collect::<Vec<_>>();
+        assert_eq!(decode_lines(&lines).unwrap(), data);
+    }
+
+    #[test]
+    fn interleaved_errors() {
+        let data = (0..64).collect::<Vec<u8>>();
+        let words = encode_interleaved(&data, 4);
+        // 64 bytes need 47 words, so there are 12 windows.
+        assert_eq!(words.len(), 47 + 12);
+        assert_eq!(decode_interleaved(&words, 4).unwrap(), data);
+
+        for idx in 0..words.len() {
+            let mut wrong = words.clone();
+            wrong[idx] = if wrong[idx] == "zoo" {
+                "abandon"
+            } else {
+                "zoo"
+            }
+            .to_string();
+            match decode_interleaved(&wrong, 4) {
+                Err(Error::ChecksumWindow { first, last, .. }) => {
+                    assert!(first <= idx && idx <= last);
+                    assert_eq!(first, idx / 5 * 5);
+                    assert!(last - first <= 4);
+                }
+                // A single checksum word has a 1 in 2048 chance of missing an
+                // error, but the original data can never be decoded.
+                result => assert_ne!(result.ok(), Some(data.clone())),
+            }
+        }
+
+        // Missing words at the end are detected.
+        let truncated = &words[..words.len() - 3];
+        assert!(matches!(
+            decode_interleaved(truncated, 4).unwrap_err(),
+            Error::ChecksumWindow { .. }
+        ));
+    }
+
+    #[quickcheck]
+    fn interleaved_roundtrip(data: Vec<u8>, window: u8) -> bool {
+        let window = window as usize % 12 + 1;
+        decode_interleaved(&encode_interleaved(&data, window), window).unwrap() == data
+    }
+
+    #[quickcheck]
+    fn grouped_roundtrip(data: Vec<u8>, group_size: u8) -> bool {
+        let group_size = group_size as usize % 12 + 1;
+        decode_grouped(encode_grouped(&data, group_size)).unwrap() == data
+    }
+}
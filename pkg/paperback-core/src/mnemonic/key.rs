@@ -0,0 +1,181 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! Fixed-size (256-bit) keys are encoded as 25 words: the first 24 words
+//! encode a one-byte tag identifying the type of key followed by the key
+//! itself, and the final word is a checksum (the first 11 bits of the SHA-256
+//! hash of the tag and key).
+
+use crate::mnemonic::{self, Error, WORDLIST_LENGTH};
+
+use std::convert::TryFrom;
+
+use sha2::{Digest, Sha256};
+
+/// Length of the keys that can be encoded.
+pub const KEY_LENGTH: usize = 32;
+
+/// Number of words in the mnemonic for a key.
+pub const KEY_MNEMONIC_WORDS: usize = 25;
+
+/// Type of key encoded in a key mnemonic.
+#[derive(Clone, Copy, Debug, Eq, PartialEq, Hash)]
+pub enum KeyType {
+    /// ChaCha20-Poly1305 symmetric key.
+    ChaCha20Poly1305,
+    /// Ed25519 secret key.
+    Ed25519Secret,
+    /// Ed25519 public key.
+    Ed25519Public,
+}
+
+impl KeyType {
+    fn tag(self) -> u8 {
+        match self {
+            KeyType::ChaCha20Poly1305 => 1,
+            KeyType::Ed25519Secret => 2,
+            KeyType::Ed25519Public => 3,
+        }
+    }
+
+    fn from_tag(tag: u8) -> Option<Self> {
+        match tag {
+            1 => Some(KeyType::ChaCha20Poly1305),
+            2 => Some(KeyType::Ed25519Secret),
+            3 => Some(KeyType::Ed25519Public),
+            _ => None,
+        }
+    }
+}
+
+fn checksum(tagged: &[u8]) -> String {
+    let hash = Sha256::digest(tagged);
+    let value = u16::from_be_bytes([hash[0], hash[1]]) >> 5;
+    mnemonic::wordlist()[value as usize].to_string()
+}
+
+/// Encode a `key` of type `key_type` as a mnemonic of
+/// [`KEY_MNEMONIC_WORDS`] words.
+pub fn key_to_mnemonic(key_type: KeyType, key: &[u8; KEY_LENGTH]) -> Vec<String> {
+    let tagged = Some(key_type.tag())
+        .iter()
+        .chain(key)
+        .copied()
+        .collect::<Vec<_>>();
+
+    // The tagged key is exactly 24 words long, so the final word produced by
+    // mnemonic::encode only contains the terminating bit (and can be replaced
+    // by the checksum).
+    let mut words = mnemonic::encode(&tagged);
+    assert_eq!(words.len(), KEY_MNEMONIC_WORDS);
+    words[KEY_MNEMONIC_WORDS - 1] = checksum(&tagged);
+    words
+}
+
+/// Decode a mnemonic produced by [`key_to_mnemonic`], returning the type of
+/// key and the key.
+pub fn mnemonic_to_key<S: AsRef<str>>(words: &[S]) -> Result<(KeyType, [u8; KEY_LENGTH]), Error> {
+    if words.len() != KEY_MNEMONIC_WORDS {
+        return Err(Error::InvalidKey(format!(
+            "key mnemonics have {} words but got {}",
+            KEY_MNEMONIC_WORDS,
+            words.len()
+        )));
+    }
+    let (checksum_word, words) = words.split_last().expect("mnemonic is not empty");
+
+    // Replace the checksum with the terminating word mnemonic::encode uses.
+    let mut words = words.iter().map(|word| word.as_ref()).collect::<Vec<_>>();
+    words.push(mnemonic::wordlist()[WORDLIST_LENGTH / 2]);
+    let tagged = mnemonic::decode(&words)?;
+
+    if checksum(&tagged) != checksum_word.as_ref() {
+        return Err(Error::ChecksumMismatch);
+    }
+    let (tag, key) = tagged.split_first().expect("tagged key is not empty");
+    let key_type = KeyType::from_tag(*tag)
+        .ok_or_else(|| Error::InvalidKey(format!("unknown key type tag {}", tag)))?;
+    let key = <[u8; KEY_LENGTH]>::try_from(key)
+        .map_err(|_| Error::InvalidKey(format!("key has invalid length {}", key.len())))?;
+    Ok((key_type, key))
+}
+
+/// Decode a mnemonic produced by [`key_to_mnemonic`], checking that the key
+/// is of type `key_type`.
+pub fn mnemonic_to_typed_key<S: AsRef<str>>(
+    key_type: KeyType,
+    words: &[S],
+) -> Result<[u8; KEY_LENGTH], Error> {
+    match mnemonic_to_key(words)? {
+        (actual, key) if actual == key_type => Ok(key),
+        (actual, _) => Err(Error::InvalidKey(format!(
+            "expected {:?} key but mnemonic contains {:?} key",
+            key_type, actual
+        ))),
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn key_mnemonic_errors() {
+        let key = [0xa5; KEY_LENGTH];
+        let words = key_to_mnemonic(KeyType::Ed25519Secret, &key);
+        assert_eq!(words.len(), KEY_MNEMONIC_WORDS);
+        assert_eq!(
+            mnemonic_to_key(&words).unwrap(),
+            (KeyType::Ed25519Secret, key)
+        );
+        assert_eq!(
+            mnemonic_to_typed_key(KeyType::Ed25519Secret, &words).unwrap(),
+            key
+        );
+        mnemonic_to_typed_key(KeyType::Ed25519Public, &words).unwrap_err();
+
+        mnemonic_to_key(&words[1..]).unwrap_err();
+
+        let mut wrong = words.clone();
+        wrong[KEY_MNEMONIC_WORDS - 1] = if wrong[KEY_MNEMONIC_WORDS - 1] == "zoo" {
+            "abandon"
+        } else {
+            "zoo"
+        }
+        .to_string();
+        assert!(matches!(
+            mnemonic_to_key(&wrong).unwrap_err(),
+            Error::ChecksumMismatch
+        ));
+    }
+
+    #[quickcheck]
+    fn key_mnemonic_roundtrip(key: Vec<u8>, ed25519: bool) -> bool {
+        let mut key_bytes = [0u8; KEY_LENGTH];
+        key_bytes
+            .iter_mut()
+            .zip(key)
+            .for_each(|(byte, value)| *byte = value);
+        let key_type = if ed25519 {
+            KeyType::Ed25519Public
+        } else {
+            KeyType::ChaCha20Poly1305
+        };
+        mnemonic_to_key(&key_to_mnemonic(key_type, &key_bytes)).unwrap() == (key_type, key_bytes)
+    }
+}
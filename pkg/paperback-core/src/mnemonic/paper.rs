@@ -0,0 +1,211 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! When a mnemonic is printed (or written down), each word is numbered so that
+//! words are less likely to be skipped or transcribed in the wrong order. The
+//! layout is configurable with [`PaperLayout`], and [`parse_numbered`] accepts
+//! the numbered format back (regardless of how it was laid out).
+
+use crate::mnemonic::{normalize_phrase, Error};
+
+/// Layout of a numbered mnemonic on paper.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub struct PaperLayout {
+    columns: usize,
+    group_rows: Option<usize>,
+    column_major: bool,
+}
+
+impl Default for PaperLayout {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl PaperLayout {
+    /// Construct a new `PaperLayout`, with three columns of words (numbered
+    /// down each column) and no grouping of rows.
+    pub fn new() -> Self {
+        Self {
+            columns: 3,
+            group_rows: None,
+            column_major: true,
+        }
+    }
+
+    /// Lay words out in `columns` columns.
+    pub fn columns(mut self, columns: usize) -> Self {
+        assert!(columns > 0, "layout must have at least one column");
+        self.columns = columns;
+        self
+    }
+
+    /// Separate every `rows` rows with a blank line. Passing `0` disables
+    /// grouping.
+    pub fn group_rows(mut self, rows: usize) -> Self {
+        self.group_rows = if rows > 0 { Some(rows) } else { None };
+        self
+    }
+
+    /// Number words across each row rather than down each column.
+    pub fn row_major(mut self, row_major: bool) -> Self {
+        self.column_major = !row_major;
+        self
+    }
+
+    /// Format `words` as numbered entries (such as `13. ability`) in rows and
+    /// columns.
+    pub fn format<S: AsRef<str>>(&self, words: &[S]) -> String {
+        let rows = (words.len() + self.columns - 1) / self.columns;
+        let number_width = words.len().to_string().len();
+        let word_width = words
+            .iter()
+            .map(|word| word.as_ref().chars().count())
+            .max()
+            .unwrap_or(0);
+
+        let mut output = String::new();
+        for row in 0..rows {
+            if row > 0 && self.group_rows.map_or(false, |group| row % group == 0) {
+                output.push('\n');
+            }
+            let entries = (0..self.columns)
+                .map(|column| {
+                    if self.column_major {
+                        column * rows + row
+                    } else {
+                        row * self.columns + column
+                    }
+                })
+                .filter(|index| *index < words.len())
+                .map(|index| {
+                    format!(
+                        "{:>nw$}. {:<ww$}",
+                        index + 1,
+                        words[index].as_ref(),
+                        nw = number_width,
+                        ww = word_width
+                    )
+                })
+                .collect::<Vec<_>>();
+            output.push_str(entries.join("   ").trim_end());
+            output.push('\n');
+        }
+        output
+    }
+}
+
+/// Parse numbered words (such as those produced by [`PaperLayout::format`])
+/// back into the mnemonic, ordered by their numbers.
+///
+/// Each word must be preceded by its number (followed by a `.`), but the
+/// entries may be laid out in any way. Every number from `1` to the number of
+/// words must be present exactly once.
+pub fn parse_numbered(text: &str) -> Result<Vec<String>, Error> {
+    let tokens = normalize_phrase(text);
+    let mut words: Vec<Option<String>> = vec![None; tokens.len() / 2];
+    let mut tokens = tokens.into_iter();
+    while let Some(number) = tokens.next() {
+        let index = number
+            .strip_suffix('.')
+            .and_then(|number| number.parse::<usize>().ok())
+            .filter(|number| *number > 0)
+            .ok_or_else(|| {
+                Error::InvalidLayout(format!("expected a word number but found {:?}", number))
+            })?
+            - 1;
+        let word = tokens
+            .next()
+            .ok_or_else(|| Error::InvalidLayout(format!("missing word number {}", index + 1)))?;
+        match words.get_mut(index) {
+            Some(slot @ None) => *slot = Some(word),
+            Some(Some(_)) => {
+                return Err(Error::InvalidLayout(format!(
+                    "duplicate word number {}",
+                    index + 1
+                )))
+            }
+            None => {
+                return Err(Error::InvalidLayout(format!(
+                    "word number {} is larger than the number of words",
+                    index + 1
+                )))
+            }
+        }
+    }
+
+    words
+        .into_iter()
+        .enumerate()
+        .map(|(index, word)| {
+            word.ok_or_else(|| Error::InvalidLayout(format!("missing word number {}", index + 1)))
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::mnemonic::encode;
+
+    #[test]
+    fn format_known() {
+        let words = [
+            "alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf",
+        ];
+        assert_eq!(
+            PaperLayout::new().format(&words),
+            "1. alpha     4. delta     7. golf\n\
+             2. bravo     5. echo\n\
+             3. charlie   6. foxtrot\n"
+        );
+        assert_eq!(
+            PaperLayout::new()
+                .columns(2)
+                .row_major(true)
+                .group_rows(2)
+                .format(&words),
+            "1. alpha     2. bravo\n\
+             3. charlie   4. delta\n\
+             \n\
+             5. echo      6. foxtrot\n\
+             7. golf\n"
+        );
+    }
+
+    #[test]
+    fn parse_invalid() {
+        parse_numbered("1. alpha 3. charlie").unwrap_err();
+        parse_numbered("1. alpha 1. alpha").unwrap_err();
+        parse_numbered("1. alpha 2.").unwrap_err();
+        parse_numbered("alpha bravo").unwrap_err();
+        parse_numbered("0. alpha 1. bravo").unwrap_err();
+        assert!(parse_numbered("").unwrap().is_empty());
+    }
+
+    #[quickcheck]
+    fn format_parse_roundtrip(data: Vec<u8>, columns: u8, group_rows: u8, row_major: bool) -> bool {
+        let words = encode(&data);
+        let layout = PaperLayout::new()
+            .columns(columns as usize % 6 + 1)
+            .group_rows(group_rows as usize % 4)
+            .row_major(row_major);
+        parse_numbered(&layout.format(&words)).unwrap() == words
+    }
+}
@@ -0,0 +1,302 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! Checksums can only detect transcription errors. If a mnemonic has
+//! Reed-Solomon parity words appended, a bounded number of incorrect or
+//! missing words can instead be corrected automatically.
+//!
+//! Each word index is treated as an element of `GF(2^11)`. The words produced
+//! by [`encode`](crate::mnemonic::encode) are the evaluations of a polynomial
+//! at `0, 1, ..., k-1`, and each parity word is the evaluation of the same
+//! polynomial at the next point. With `p` parity words, any combination of `e`
+//! incorrect words and `s` missing words can be corrected as long as
+//! `2e + s <= p`. Words which are not in the wordlist (such as `?` written in
+//! place of an illegible word) are treated as missing.
+
+use crate::mnemonic::{self, word_index, wordlist, Error, WORDLIST_LENGTH};
+
+/// Maximum number of parity words supported by [`encode_with_parity`].
+///
+/// Correcting errors requires searching over the possible locations of the
+/// errors, so the number of parity words is limited to keep decoding fast.
+pub const MAX_PARITY_WORDS: usize = 8;
+
+/// Arithmetic in `GF(2^11)`, with characteristic polynomial `x^11 + x^2 + 1`.
+struct Field {
+    exp: Vec<u16>,
+    log: Vec<u16>,
+}
+
+impl Field {
+    const POLYNOMIAL: u32 = 0b1000_0000_0101;
+    const ORDER: usize = WORDLIST_LENGTH - 1;
+
+    fn new() -> Self {
+        let mut exp = vec![0; 2 * Self::ORDER];
+        let mut log = vec![0; WORDLIST_LENGTH];
+        let mut value = 1u32;
+        for power in 0..Self::ORDER {
+            exp[power] = value as u16;
+            exp[power + Self::ORDER] = value as u16;
+            log[value as usize] = power as u16;
+            value <<= 1;
+            if value & WORDLIST_LENGTH as u32 != 0 {
+                value ^= Self::POLYNOMIAL;
+            }
+        }
+        Self { exp, log }
+    }
+
+    fn mul(&self, a: u16, b: u16) -> u16 {
+        if a == 0 || b == 0 {
+            return 0;
+        }
+        self.exp[self.log[a as usize] as usize + self.log[b as usize] as usize]
+    }
+
+    fn div(&self, a: u16, b: u16) -> u16 {
+        assert_ne!(b, 0, "division by zero in GF(2^11)");
+        if a == 0 {
+            return 0;
+        }
+        self.exp[self.log[a as usize] as usize + Self::ORDER - self.log[b as usize] as usize]
+    }
+
+    /// Evaluate the polynomial (of degree less than `points.len()`) through
+    /// `points` at `x`, using Lagrange interpolation.
+    fn interpolate(&self, points: &[(u16, u16)], x: u16) -> u16 {
+        points.iter().fold(0, |sum, (xj, yj)| {
+            let basis = points
+                .iter()
+                .filter(|(xm, _)| xm != xj)
+                .fold(1, |basis, (xm, _)| {
+                    self.mul(basis, self.div(x ^ xm, xj ^ xm))
+                });
+            sum ^ self.mul(*yj, basis)
+        })
+    }
+}
+
+/// Encode `data` using [`encode`](crate::mnemonic::encode), followed by
+/// `parity` Reed-Solomon parity words.
+pub fn encode_with_parity<B: AsRef<[u8]>>(data: B, parity: usize) -> Result<Vec<String>, Error> {
+    let mut words = mnemonic::encode(data);
+    if parity > MAX_PARITY_WORDS || words.len() + parity > WORDLIST_LENGTH {
+        return Err(Error::InvalidLength(format!(
+            "cannot add {} parity words to {} words",
+            parity,
+            words.len()
+        )));
+    }
+
+    let field = Field::new();
+    let points = words
+        .iter()
+        .enumerate()
+        .map(|(x, word)| (x as u16, word_index(word).expect("encoded words are valid")))
+        .collect::<Vec<_>>();
+    let parity_words = (points.len()..points.len() + parity)
+        .map(|x| wordlist()[field.interpolate(&points, x as u16) as usize].to_string())
+        .collect::<Vec<_>>();
+    words.extend(parity_words);
+    Ok(words)
+}
+
+/// Returns the number of words [`encode_with_parity`] produces for `len` bytes
+/// of data with `parity` parity words.
+pub fn parity_encoded_words(len: usize, parity: usize) -> usize {
+    mnemonic::encoded_words(len) + parity
+}
+
+/// Calls `f` with every subset of `items` of size `size`, stopping when `f`
+/// returns `Some`.
+fn find_subset<T: Copy, R, F: FnMut(&[T]) -> Option<R>>(
+    items: &[T],
+    size: usize,
+    mut f: F,
+) -> Option<R> {
+    fn recurse<T: Copy, R, F: FnMut(&[T]) -> Option<R>>(
+        items: &[T],
+        size: usize,
+        chosen: &mut Vec<T>,
+        f: &mut F,
+    ) -> Option<R> {
+        if chosen.len() == size {
+            return f(chosen);
+        }
+        for (idx, item) in items.iter().enumerate() {
+            if items.len() - idx < size - chosen.len() {
+                break;
+            }
+            chosen.push(*item);
+            let result = recurse(&items[idx + 1..], size, chosen, f);
+            chosen.pop();
+            if result.is_some() {
+                return result;
+            }
+        }
+        None
+    }
+    recurse(items, size, &mut Vec::with_capacity(size), &mut f)
+}
+
+/// Decode a sequence of words produced by [`encode_with_parity`] with the same
+/// number of `parity` words, correcting incorrect and missing words where
+/// possible.
+///
+/// Returns the decoded data and the positions of the words which were
+/// corrected.
+pub fn decode_with_parity<S: AsRef<str>>(
+    words: &[S],
+    parity: usize,
+) -> Result<(Vec<u8>, Vec<usize>), Error> {
+    if parity > MAX_PARITY_WORDS || words.len() <= parity || words.len() > WORDLIST_LENGTH {
+        return Err(Error::InvalidLength(format!(
+            "{} words cannot contain {} parity words",
+            words.len(),
+            parity
+        )));
+    }
+    let num_data = words.len() - parity;
+
+    // Words which are not in the wordlist are missing.
+    let known = words
+        .iter()
+        .enumerate()
+        .filter_map(|(x, word)| word_index(word.as_ref()).map(|y| (x as u16, y)))
+        .collect::<Vec<_>>();
+    let missing = words.len() - known.len();
+    if missing > parity {
+        return Err(Error::TooManyErrors);
+    }
+
+    // Find the smallest set of incorrect words such that all other known words
+    // are consistent with a single polynomial of degree less than num_data.
+    let field = Field::new();
+    let consistent = |errors: &[(u16, u16)]| {
+        let trusted = known
+            .iter()
+            .filter(|point| !errors.contains(point))
+            .copied()
+            .collect::<Vec<_>>();
+        let (basis, rest) = trusted.split_at(num_data);
+        if rest.iter().all(|(x, y)| field.interpolate(basis, *x) == *y) {
+            Some(basis.to_vec())
+        } else {
+            None
+        }
+    };
+    let basis = (0..=(parity - missing) / 2)
+        .find_map(|num_errors| find_subset(&known, num_errors, &consistent))
+        .ok_or(Error::TooManyErrors)?;
+
+    let mut corrected = vec![];
+    let data_words = (0..num_data)
+        .map(|x| {
+            let value = field.interpolate(&basis, x as u16);
+            let word = wordlist()[value as usize];
+            if words[x].as_ref() != word {
+                corrected.push(x);
+            }
+            word
+        })
+        .collect::<Vec<_>>();
+    corrected.extend(
+        (num_data..words.len()).filter(|x| {
+            word_index(words[*x].as_ref()) != Some(field.interpolate(&basis, *x as u16))
+        }),
+    );
+
+    Ok((mnemonic::decode(&data_words)?, corrected))
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn field_inverse() {
+        let field = Field::new();
+        for a in 1..WORDLIST_LENGTH as u16 {
+            assert_eq!(field.mul(a, field.div(1, a)), 1);
+        }
+    }
+
+    #[test]
+    fn correct_errors() {
+        let data = b"correct horse battery staple";
+        let words = encode_with_parity(data, 4).unwrap();
+        assert_eq!(
+            decode_with_parity(&words, 4).unwrap(),
+            (data.to_vec(), vec![])
+        );
+
+        // Two incorrect words.
+        let mut wrong = words.clone();
+        for idx in &[3, 17] {
+            wrong[*idx] = if wrong[*idx] == "zoo" {
+                "abandon"
+            } else {
+                "zoo"
+            }
+            .to_string();
+        }
+        assert_eq!(
+            decode_with_parity(&wrong, 4).unwrap(),
+            (data.to_vec(), vec![3, 17])
+        );
+
+        // Four missing words (including a parity word).
+        let mut missing = words.clone();
+        for idx in &[0, 5, 6, words.len() - 1] {
+            missing[*idx] = "?".to_string();
+        }
+        assert_eq!(
+            decode_with_parity(&missing, 4).unwrap(),
+            (data.to_vec(), vec![0, 5, 6, words.len() - 1])
+        );
+
+        // One incorrect and two missing words.
+        let mut mixed = words.clone();
+        mixed[1] = "?".to_string();
+        mixed[2] = "".to_string();
+        mixed[10] = if mixed[10] == "zoo" { "abandon" } else { "zoo" }.to_string();
+        assert_eq!(
+            decode_with_parity(&mixed, 4).unwrap(),
+            (data.to_vec(), vec![1, 2, 10])
+        );
+
+        // Too many missing words.
+        let mut too_many = missing;
+        too_many[1] = "?".to_string();
+        assert!(matches!(
+            decode_with_parity(&too_many, 4).unwrap_err(),
+            Error::TooManyErrors
+        ));
+    }
+
+    #[quickcheck]
+    fn parity_roundtrip(data: Vec<u8>, parity: u8, error: usize) -> bool {
+        let parity = parity as usize % (MAX_PARITY_WORDS - 1) + 2;
+        let mut words = encode_with_parity(&data, parity).unwrap();
+        assert_eq!(words.len(), parity_encoded_words(data.len(), parity));
+        let error = error % words.len();
+        words[error] = "?".to_string();
+        decode_with_parity(&words, parity).unwrap() == (data, vec![error])
+    }
+}
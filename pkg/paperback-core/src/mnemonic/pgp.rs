@@ -0,0 +1,674 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! The PGP word list consists of two lists of 256 words, one of two-syllable
+//! words (used for bytes at even positions) and one of three-syllable words
+//! (used for bytes at odd positions). Since consecutive words alternate between
+//! the lists, swapped, repeated or skipped words are detected. The words were
+//! also chosen to be phonetically distinct, which makes the encoding well
+//! suited to reading keys aloud (such as over the phone).
+
+use crate::mnemonic::{verify_digest, Error};
+
+/// Words used for bytes at even positions (starting from zero).
+pub const EVEN_WORDS: [&str; 256] = [
+    "aardvark",
+    "absurd",
+    "accrue",
+    "acme",
+    "adrift",
+    "adult",
+    "afflict",
+    "ahead",
+    "aimless",
+    "Algol",
+    "allow",
+    "alone",
+    "ammo",
+    "ancient",
+    "apple",
+    "artist",
+    "assume",
+    "Athens",
+    "atlas",
+    "Aztec",
+    "baboon",
+    "backfield",
+    "backward",
+    "banjo",
+    "beaming",
+    "bedlamp",
+    "beehive",
+    "beeswax",
+    "befriend",
+    "Belfast",
+    "berserk",
+    "billiard",
+    "bison",
+    "blackjack",
+    "blockade",
+    "blowtorch",
+    "bluebird",
+    "bombast",
+    "bookshelf",
+    "brackish",
+    "breadline",
+    "breakup",
+    "brickyard",
+    "briefcase",
+    "Burbank",
+    "button",
+    "buzzard",
+    "cement",
+    "chairlift",
+    "chatter",
+    "checkup",
+    "chisel",
+    "choking",
+    "chopper",
+    "Christmas",
+    "clamshell",
+    "classic",
+    "classroom",
+    "cleanup",
+    "clockwork",
+    "cobra",
+    "commence",
+    "concert",
+    "cowbell",
+    "crackdown",
+    "cranky",
+    "crowfoot",
+    "crucial",
+    "crumpled",
+    "crusade",
+    "cubic",
+    "dashboard",
+    "deadbolt",
+    "deckhand",
+    "dogsled",
+    "dragnet",
+    "drainage",
+    "dreadful",
+    "drifter",
+    "dropper",
+    "drumbeat",
+    "drunken",
+    "Dupont",
+    "dwelling",
+    "eating",
+    "edict",
+    "egghead",
+    "eightball",
+    "endorse",
+    "endow",
+    "enlist",
+    "erase",
+    "escape",
+    "exceed",
+    "eyeglass",
+    "eyetooth",
+    "facial",
+    "fallout",
+    "flagpole",
+    "flatfoot",
+    "flytrap",
+    "fracture",
+    "framework",
+    "freedom",
+    "frighten",
+    "gazelle",
+    "Geiger",
+    "glitter",
+    "glucose",
+    "goggles",
+    "goldfish",
+    "gremlin",
+    "guidance",
+    "hamlet",
+    "highchair",
+    "hockey",
+    "indoors",
+    "indulge",
+    "inverse",
+    "involve",
+    "island",
+    "jawbone",
+    "keyboard",
+    "kickoff",
+    "kiwi",
+    "klaxon",
+    "locale",
+    "lockup",
+    "merit",
+    "minnow",
+    "miser",
+    "Mohawk",
+    "mural",
+    "music",
+    "necklace",
+    "Neptune",
+    "newborn",
+    "nightbird",
+    "Oakland",
+    "obtuse",
+    "offload",
+    "optic",
+    "orca",
+    "payday",
+    "peachy",
+    "pheasant",
+    "physique",
+    "playhouse",
+    "Pluto",
+    "preclude",
+    "prefer",
+    "preshrunk",
+    "printer",
+    "prowler",
+    "pupil",
+    "puppy",
+    "python",
+    "quadrant",
+    "quiver",
+    "quota",
+    "ragtime",
+    "ratchet",
+    "rebirth",
+    "reform",
+    "regain",
+    "reindeer",
+    "rematch",
+    "repay",
+    "retouch",
+    "revenge",
+    "reward",
+    "rhythm",
+    "ribcage",
+    "ringbolt",
+    "robust",
+    "rocker",
+    "ruffled",
+    "sailboat",
+    "sawdust",
+    "scallion",
+    "scenic",
+    "scorecard",
+    "Scotland",
+    "seabird",
+    "select",
+    "sentence",
+    "shadow",
+    "shamrock",
+    "showgirl",
+    "skullcap",
+    "skydive",
+    "slingshot",
+    "slowdown",
+    "snapline",
+    "snapshot",
+    "snowcap",
+    "snowslide",
+    "solo",
+    "southward",
+    "soybean",
+    "spaniel",
+    "spearhead",
+    "spellbind",
+    "spheroid",
+    "spigot",
+    "spindle",
+    "spyglass",
+    "stagehand",
+    "stagnate",
+    "stairway",
+    "standard",
+    "stapler",
+    "steamship",
+    "sterling",
+    "stockman",
+    "stopwatch",
+    "stormy",
+    "sugar",
+    "surmount",
+    "suspense",
+    "sweatband",
+    "swelter",
+    "tactics",
+    "talon",
+    "tapeworm",
+    "tempest",
+    "tiger",
+    "tissue",
+    "tonic",
+    "topmost",
+    "tracker",
+    "transit",
+    "trauma",
+    "treadmill",
+    "Trojan",
+    "trouble",
+    "tumor",
+    "tunnel",
+    "tycoon",
+    "uncut",
+    "unearth",
+    "unwind",
+    "uproot",
+    "upset",
+    "upshot",
+    "vapor",
+    "village",
+    "virus",
+    "Vulcan",
+    "waffle",
+    "wallet",
+    "watchword",
+    "wayside",
+    "willow",
+    "woodlark",
+    "Zulu",
+];
+
+/// Words used for bytes at odd positions (starting from zero).
+pub const ODD_WORDS: [&str; 256] = [
+    "adroitness",
+    "adviser",
+    "aftermath",
+    "aggregate",
+    "alkali",
+    "almighty",
+    "amulet",
+    "amusement",
+    "antenna",
+    "applicant",
+    "Apollo",
+    "armistice",
+    "article",
+    "asteroid",
+    "Atlantic",
+    "atmosphere",
+    "autopsy",
+    "Babylon",
+    "backwater",
+    "barbecue",
+    "belowground",
+    "bifocals",
+    "bodyguard",
+    "bookseller",
+    "borderline",
+    "bottomless",
+    "Bradbury",
+    "bravado",
+    "Brazilian",
+    "breakaway",
+    "Burlington",
+    "businessman",
+    "butterfat",
+    "Camelot",
+    "candidate",
+    "cannonball",
+    "Capricorn",
+    "caravan",
+    "caretaker",
+    "celebrate",
+    "cellulose",
+    "certify",
+    "chambermaid",
+    "Cherokee",
+    "Chicago",
+    "clergyman",
+    "coherence",
+    "combustion",
+    "commando",
+    "company",
+    "component",
+    "concurrent",
+    "confidence",
+    "conformist",
+    "congregate",
+    "consensus",
+    "consulting",
+    "corporate",
+    "corrosion",
+    "councilman",
+    "crossover",
+    "crucifix",
+    "cumbersome",
+    "customer",
+    "Dakota",
+    "decadence",
+    "December",
+    "decimal",
+    "designing",
+    "detector",
+    "detergent",
+    "determine",
+    "dictator",
+    "dinosaur",
+    "direction",
+    "disable",
+    "disbelief",
+    "disruptive",
+    "distortion",
+    "document",
+    "embezzle",
+    "enchanting",
+    "enrollment",
+    "enterprise",
+    "equation",
+    "equipment",
+    "escapade",
+    "Eskimo",
+    "everyday",
+    "examine",
+    "existence",
+    "exodus",
+    "fascinate",
+    "filament",
+    "finicky",
+    "forever",
+    "fortitude",
+    "frequency",
+    "gadgetry",
+    "Galveston",
+    "getaway",
+    "glossary",
+    "gossamer",
+    "graduate",
+    "gravity",
+    "guitarist",
+    "hamburger",
+    "Hamilton",
+    "handiwork",
+    "hazardous",
+    "headwaters",
+    "hemisphere",
+    "hesitate",
+    "hideaway",
+    "holiness",
+    "hurricane",
+    "hydraulic",
+    "impartial",
+    "impetus",
+    "inception",
+    "indigo",
+    "inertia",
+    "infancy",
+    "inferno",
+    "informant",
+    "insincere",
+    "insurgent",
+    "integrate",
+    "intention",
+    "inventive",
+    "Istanbul",
+    "Jamaica",
+    "Jupiter",
+    "leprosy",
+    "letterhead",
+    "liberty",
+    "maritime",
+    "matchmaker",
+    "maverick",
+    "Medusa",
+    "megaton",
+    "microscope",
+    "microwave",
+    "midsummer",
+    "millionaire",
+    "miracle",
+    "misnomer",
+    "molasses",
+    "molecule",
+    "Montana",
+    "monument",
+    "mosquito",
+    "narrative",
+    "nebula",
+    "newsletter",
+    "Norwegian",
+    "October",
+    "Ohio",
+    "onlooker",
+    "opulent",
+    "Orlando",
+    "outfielder",
+    "Pacific",
+    "pandemic",
+    "Pandora",
+    "paperweight",
+    "paragon",
+    "paragraph",
+    "paramount",
+    "passenger",
+    "pedigree",
+    "Pegasus",
+    "penetrate",
+    "perceptive",
+    "performance",
+    "pharmacy",
+    "phonetic",
+    "photograph",
+    "pioneer",
+    "pocketful",
+    "politeness",
+    "positive",
+    "potato",
+    "processor",
+    "provincial",
+    "proximate",
+    "puberty",
+    "publisher",
+    "pyramid",
+    "quantity",
+    "racketeer",
+    "rebellion",
+    "recipe",
+    "recover",
+    "repellent",
+    "replica",
+    "reproduce",
+    "resistor",
+    "responsive",
+    "retraction",
+    "retrieval",
+    "retrospect",
+    "revenue",
+    "revival",
+    "revolver",
+    "sandalwood",
+    "sardonic",
+    "Saturday",
+    "savagery",
+    "scavenger",
+    "sensation",
+    "sociable",
+    "souvenir",
+    "specialist",
+    "speculate",
+    "stethoscope",
+    "stupendous",
+    "supportive",
+    "surrender",
+    "suspicious",
+    "sympathy",
+    "tambourine",
+    "telephone",
+    "therapist",
+    "tobacco",
+    "tolerance",
+    "tomorrow",
+    "torpedo",
+    "tradition",
+    "travesty",
+    "trombonist",
+    "truncated",
+    "typewriter",
+    "ultimate",
+    "undaunted",
+    "underfoot",
+    "unicorn",
+    "unify",
+    "universe",
+    "unravel",
+    "upcoming",
+    "vacancy",
+    "vagabond",
+    "vertigo",
+    "Virginia",
+    "visitor",
+    "vocalist",
+    "voyager",
+    "warranty",
+    "Waterloo",
+    "whimsical",
+    "Wichita",
+    "Wilmington",
+    "Wyoming",
+    "yesteryear",
+    "Yucatan",
+];
+
+/// SHA-256 digest of [`EVEN_WORDS`] (one word per line).
+const EVEN_WORDS_SHA256: [u8; 32] = [
+    0x37, 0xa6, 0x5f, 0x88, 0x51, 0x24, 0x67, 0xed, 0xd1, 0x2a, 0x1a, 0xb3, 0xee, 0xb5, 0xf4, 0x32,
+    0x82, 0x30, 0xe8, 0x67, 0x11, 0xa8, 0xef, 0xde, 0x63, 0x33, 0x36, 0x1c, 0xe1, 0x0f, 0x4f, 0xcf,
+];
+
+/// SHA-256 digest of [`ODD_WORDS`] (one word per line).
+const ODD_WORDS_SHA256: [u8; 32] = [
+    0xc2, 0xf2, 0x3c, 0x22, 0x33, 0xd4, 0xd7, 0x29, 0x11, 0x07, 0xe8, 0xf7, 0x96, 0xc3, 0x74, 0xd0,
+    0xcb, 0x1f, 0xb3, 0x0c, 0x13, 0x91, 0xbc, 0xb4, 0xf6, 0x48, 0x02, 0x43, 0xde, 0x8e, 0xbf, 0x5a,
+];
+
+/// Verify that the PGP word lists built into this binary have not been
+/// modified, by comparing their SHA-256 digests to known-good values.
+pub fn verify_wordlists() -> Result<(), Error> {
+    verify_digest("pgp even", &EVEN_WORDS, &EVEN_WORDS_SHA256)?;
+    verify_digest("pgp odd", &ODD_WORDS, &ODD_WORDS_SHA256)
+}
+
+fn wordlist_for(index: usize) -> &'static [&'static str; 256] {
+    if index % 2 == 0 {
+        &EVEN_WORDS
+    } else {
+        &ODD_WORDS
+    }
+}
+
+fn find(words: &[&str; 256], word: &str) -> Option<u8> {
+    words
+        .iter()
+        .position(|candidate| candidate.eq_ignore_ascii_case(word))
+        .map(|value| value as u8)
+}
+
+/// Encode `data` as a sequence of words from the PGP word list, one word per
+/// byte.
+pub fn encode<B: AsRef<[u8]>>(data: B) -> Vec<String> {
+    data.as_ref()
+        .iter()
+        .enumerate()
+        .map(|(index, byte)| wordlist_for(index)[*byte as usize].to_string())
+        .collect()
+}
+
+/// Decode a sequence of words produced by [`encode`]. Words are matched
+/// case-insensitively.
+///
+/// If a word is from the wrong list for its position, an
+/// [`Error::WrongParity`] is returned. This usually means that a word was
+/// swapped with its neighbour, repeated, or skipped.
+pub fn decode<S: AsRef<str>>(words: &[S]) -> Result<Vec<u8>, Error> {
+    words
+        .iter()
+        .enumerate()
+        .map(|(index, word)| {
+            let word = word.as_ref();
+            find(wordlist_for(index), word).ok_or_else(|| {
+                if find(wordlist_for(index + 1), word).is_some() {
+                    Error::WrongParity {
+                        index,
+                        word: word.to_string(),
+                    }
+                } else {
+                    Error::UnknownWord {
+                        index,
+                        word: word.to_string(),
+                    }
+                }
+            })
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn encode_known() {
+        // Example from <https://en.wikipedia.org/wiki/PGP_word_list>.
+        let data = [
+            0xe5, 0x82, 0x94, 0xf2, 0xe9, 0xa2, 0x27, 0x48, 0x6e, 0x8b, 0x06, 0x1b, 0x31, 0xcc,
+            0x52, 0x8f, 0xd7, 0xfa, 0x3f, 0x19,
+        ];
+        let words = "topmost Istanbul Pluto vagabond treadmill Pacific brackish dictator \
+                     goldfish Medusa afflict bravado chatter revolver Dupont midsummer \
+                     stopwatch whimsical cowbell bottomless"
+            .split_whitespace()
+            .collect::<Vec<_>>();
+
+        assert_eq!(encode(data), words);
+        assert_eq!(decode(&words).unwrap(), data);
+    }
+
+    #[test]
+    fn wordlist_digests() {
+        verify_wordlists().unwrap();
+    }
+
+    #[test]
+    fn decode_case_insensitive() {
+        assert_eq!(decode(&["TOPMOST", "istanbul"]).unwrap(), vec![0xe5, 0x82]);
+    }
+
+    #[test]
+    fn decode_invalid() {
+        // Swapped words.
+        assert!(matches!(
+            decode(&["Istanbul", "topmost"]).unwrap_err(),
+            Error::WrongParity { index: 0, .. }
+        ));
+        // Skipped word.
+        assert!(matches!(
+            decode(&["topmost", "Pluto"]).unwrap_err(),
+            Error::WrongParity { index: 1, .. }
+        ));
+        assert!(matches!(
+            decode(&["topmost", "paperback"]).unwrap_err(),
+            Error::UnknownWord { index: 1, .. }
+        ));
+    }
+
+    #[quickcheck]
+    fn encode_decode_roundtrip(data: Vec<u8>) -> bool {
+        decode(&encode(&data)).unwrap() == data
+    }
+}
@@ -0,0 +1,255 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! [SLIP-39] shares are written as words from a 1024-word wordlist (so each
+//! word encodes 10 bits), terminated by three checksum words computed using
+//! the RS1024 Reed-Solomon code. The RS1024 code guarantees that any error
+//! affecting at most three words is detected.
+//!
+//! This module provides the word-level encoding. The wordlist is parsed from
+//! the file published alongside the specification (one word per line).
+//!
+//! [SLIP-39]: https://github.com/satoshilabs/slips/blob/master/slip-0039.md
+
+use crate::mnemonic::{Error, Wordlist};
+
+/// Number of words in the SLIP-39 wordlist.
+pub const WORDLIST_LENGTH: usize = 1024;
+
+/// Number of bits encoded by each word.
+pub const WORD_BITS: u32 = 10;
+
+/// Number of checksum words at the end of each mnemonic.
+pub const CHECKSUM_WORDS: usize = 3;
+
+/// RS1024 customisation string for (non-extendable) SLIP-39 shares.
+pub const CUSTOMIZATION_STRING: &str = "shamir";
+
+fn rs1024_polymod<I: IntoIterator<Item = u32>>(values: I) -> u32 {
+    const GENERATOR: [u32; 10] = [
+        0x00e0_e040,
+        0x01c1_c080,
+        0x0383_8100,
+        0x0707_0200,
+        0x0e0e_0009,
+        0x1c0c_2412,
+        0x3808_6c24,
+        0x3090_fc48,
+        0x21b1_f890,
+        0x03f3_f120,
+    ];
+    values.into_iter().fold(1u32, |chk, value| {
+        let top = chk >> 20;
+        let chk = (chk & 0x000f_ffff) << 10 ^ value;
+        GENERATOR
+            .iter()
+            .enumerate()
+            .filter(|(idx, _)| (top >> idx) & 1 == 1)
+            .fold(chk, |chk, (_, gen)| chk ^ gen)
+    })
+}
+
+fn customized<'a>(customization: &'a str, values: &'a [u16]) -> impl Iterator<Item = u32> + 'a {
+    customization
+        .bytes()
+        .map(u32::from)
+        .chain(values.iter().copied().map(u32::from))
+}
+
+/// Compute the RS1024 checksum of the 10-bit `values`, using the given
+/// `customization` string.
+pub fn rs1024_checksum(customization: &str, values: &[u16]) -> [u16; CHECKSUM_WORDS] {
+    let polymod =
+        rs1024_polymod(customized(customization, values).chain(vec![0; CHECKSUM_WORDS])) ^ 1;
+    let mut checksum = [0; CHECKSUM_WORDS];
+    for (idx, value) in checksum.iter_mut().enumerate() {
+        *value = ((polymod >> (WORD_BITS * (CHECKSUM_WORDS - 1 - idx) as u32)) & 1023) as u16;
+    }
+    checksum
+}
+
+/// Verify the RS1024 checksum at the end of the 10-bit `values`, using the
+/// given `customization` string.
+pub fn rs1024_verify(customization: &str, values: &[u16]) -> bool {
+    values.len() >= CHECKSUM_WORDS && rs1024_polymod(customized(customization, values)) == 1
+}
+
+/// The SLIP-39 wordlist.
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub struct Slip39Wordlist {
+    words: Vec<String>,
+}
+
+impl Slip39Wordlist {
+    /// Parse the SLIP-39 wordlist from the published `wordlist.txt` (one word
+    /// per line). The wordlist must have 1024 words in sorted order, and each
+    /// word must be unique in its first four letters.
+    pub fn parse(text: &str) -> Result<Self, Error> {
+        let words = text
+            .lines()
+            .map(str::trim)
+            .filter(|line| !line.is_empty())
+            .map(String::from)
+            .collect::<Vec<_>>();
+
+        if words.len() != WORDLIST_LENGTH {
+            return Err(Error::InvalidWordlist(format!(
+                "slip39 wordlist must have {} words but has {}",
+                WORDLIST_LENGTH,
+                words.len()
+            )));
+        }
+        let prefix = |word: &str| word.chars().take(4).collect::<String>();
+        if let Some(pair) = words
+            .windows(2)
+            .find(|pair| pair[0] >= pair[1] || prefix(&pair[0]) == prefix(&pair[1]))
+        {
+            return Err(Error::InvalidWordlist(format!(
+                "slip39 wordlist words {:?} and {:?} are out of order or share a prefix",
+                pair[0], pair[1]
+            )));
+        }
+
+        Ok(Self { words })
+    }
+
+    /// Encode the 10-bit `values` as words, followed by their RS1024
+    /// checksum.
+    pub fn encode(&self, values: &[u16]) -> Vec<String> {
+        let checksum = rs1024_checksum(CUSTOMIZATION_STRING, values);
+        values
+            .iter()
+            .chain(&checksum)
+            .map(|value| self.words[*value as usize % WORDLIST_LENGTH].clone())
+            .collect()
+    }
+
+    /// Decode words produced by [`Slip39Wordlist::encode`], verifying and
+    /// removing the RS1024 checksum.
+    pub fn decode<S: AsRef<str>>(&self, words: &[S]) -> Result<Vec<u16>, Error> {
+        let mut values = words
+            .iter()
+            .enumerate()
+            .map(|(index, word)| {
+                self.index(word.as_ref())
+                    .map(|value| value as u16)
+                    .ok_or_else(|| Error::UnknownWord {
+                        index,
+                        word: word.as_ref().to_string(),
+                    })
+            })
+            .collect::<Result<Vec<_>, Error>>()?;
+
+        if values.len() < CHECKSUM_WORDS {
+            return Err(Error::MissingChecksum);
+        }
+        if !rs1024_verify(CUSTOMIZATION_STRING, &values) {
+            return Err(Error::ChecksumMismatch);
+        }
+        values.truncate(values.len() - CHECKSUM_WORDS);
+        Ok(values)
+    }
+}
+
+impl Wordlist for Slip39Wordlist {
+    fn len(&self) -> usize {
+        self.words.len()
+    }
+
+    fn word(&self, index: usize) -> Option<&str> {
+        self.words.get(index).map(String::as_str)
+    }
+
+    fn index(&self, word: &str) -> Option<usize> {
+        self.words
+            .binary_search_by(|probe| probe.as_str().cmp(word))
+            .ok()
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    fn test_wordlist() -> Slip39Wordlist {
+        let text = (0..WORDLIST_LENGTH)
+            .map(|idx| format!("{:04}w\n", idx))
+            .collect::<String>();
+        Slip39Wordlist::parse(&text).unwrap()
+    }
+
+    #[test]
+    fn wordlist_invalid() {
+        let words = (0..WORDLIST_LENGTH)
+            .map(|idx| format!("{:04}w", idx))
+            .collect::<Vec<_>>();
+
+        Slip39Wordlist::parse(&words[1..].join("\n")).unwrap_err();
+        let mut unsorted = words.clone();
+        unsorted.swap(10, 11);
+        Slip39Wordlist::parse(&unsorted.join("\n")).unwrap_err();
+        let mut prefix = words.clone();
+        prefix[11] = "0010x".to_string();
+        Slip39Wordlist::parse(&prefix.join("\n")).unwrap_err();
+    }
+
+    #[test]
+    fn checksum_errors_detected() {
+        let wordlist = test_wordlist();
+        let values = (0..20).map(|v| v * 37 % 1024).collect::<Vec<u16>>();
+        let words = wordlist.encode(&values);
+        assert_eq!(words.len(), values.len() + CHECKSUM_WORDS);
+        assert_eq!(wordlist.decode(&words).unwrap(), values);
+
+        // Any single incorrect word is detected.
+        for idx in 0..words.len() {
+            let mut wrong = words.clone();
+            let value = wordlist.index(&wrong[idx]).unwrap();
+            wrong[idx] = wordlist
+                .word((value + 1) % WORDLIST_LENGTH)
+                .unwrap()
+                .to_string();
+            assert!(matches!(
+                wordlist.decode(&wrong).unwrap_err(),
+                Error::ChecksumMismatch
+            ));
+        }
+
+        // Swapped words are detected.
+        let mut swapped = words.clone();
+        swapped.swap(0, 1);
+        assert!(matches!(
+            wordlist.decode(&swapped).unwrap_err(),
+            Error::ChecksumMismatch
+        ));
+
+        // The customisation string is part of the checksum.
+        let checksum = rs1024_checksum("shamir_extendable", &values);
+        let mut values = values;
+        values.extend_from_slice(&checksum);
+        assert!(rs1024_verify("shamir_extendable", &values));
+        assert!(!rs1024_verify(CUSTOMIZATION_STRING, &values));
+    }
+
+    #[quickcheck]
+    fn encode_decode_roundtrip(values: Vec<u16>) -> bool {
+        let wordlist = test_wordlist();
+        let values = values.into_iter().map(|v| v % 1024).collect::<Vec<_>>();
+        wordlist.decode(&wordlist.encode(&values)).unwrap() == values
+    }
+}
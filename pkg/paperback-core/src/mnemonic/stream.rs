@@ -0,0 +1,275 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! [`encode`](crate::mnemonic::encode) and [`decode`](crate::mnemonic::decode)
+//! operate on the entire payload at once. For very large payloads,
+//! [`WordWriter`] and [`WordReader`] instead convert between bytes and words
+//! incrementally, producing identical output.
+
+use crate::mnemonic::{word_index, wordlist, Error, WORD_BITS};
+
+use std::{
+    collections::VecDeque,
+    io::{self, BufRead, Read, Write},
+};
+
+fn invalid_data(err: Error) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, err)
+}
+
+/// Adapter which encodes the bytes written to it as space-separated words,
+/// written to the inner writer.
+///
+/// [`WordWriter::finish`] must be called once all data has been written, in
+/// order to write the final (terminating) word.
+#[derive(Debug)]
+pub struct WordWriter<W: Write> {
+    inner: W,
+    acc: u32,
+    acc_bits: u32,
+    num_words: usize,
+}
+
+impl<W: Write> WordWriter<W> {
+    /// Create a new `WordWriter` which writes words to `inner`.
+    pub fn new(inner: W) -> Self {
+        Self {
+            inner,
+            acc: 0,
+            acc_bits: 0,
+            num_words: 0,
+        }
+    }
+
+    /// Returns the number of words written so far.
+    pub fn num_words(&self) -> usize {
+        self.num_words
+    }
+
+    fn write_word(&mut self, bits: u32) -> io::Result<()> {
+        if self.num_words > 0 {
+            self.inner.write_all(b" ")?;
+        }
+        let word = wordlist()[(bits & ((1 << WORD_BITS) - 1)) as usize];
+        self.inner.write_all(word.as_bytes())?;
+        self.num_words += 1;
+        Ok(())
+    }
+
+    /// Terminate the data and write the final word, returning the inner
+    /// writer.
+    pub fn finish(mut self) -> io::Result<W> {
+        self.acc = (self.acc << 1) | 1;
+        self.acc_bits += 1;
+        self.write_word(self.acc << (WORD_BITS - self.acc_bits))?;
+        self.inner.flush()?;
+        Ok(self.inner)
+    }
+}
+
+impl<W: Write> Write for WordWriter<W> {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        for byte in buf {
+            self.acc = (self.acc << 8) | *byte as u32;
+            self.acc_bits += 8;
+            while self.acc_bits >= WORD_BITS {
+                self.acc_bits -= WORD_BITS;
+                self.write_word(self.acc >> self.acc_bits)?;
+            }
+            self.acc &= (1 << self.acc_bits) - 1;
+        }
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.inner.flush()
+    }
+}
+
+/// Adapter which decodes whitespace-separated words read from the inner
+/// reader, in the format produced by [`WordWriter`].
+///
+/// Reading returns an error of kind [`io::ErrorKind::InvalidData`] (wrapping a
+/// [`mnemonic::Error`](crate::mnemonic::Error)) if the words are not valid.
+#[derive(Debug)]
+pub struct WordReader<R: BufRead> {
+    inner: R,
+    acc: u32,
+    acc_bits: u32,
+    num_words: usize,
+    // The final word must be handled specially, so each word is only decoded
+    // once the next word (or the end of the input) has been read.
+    pending: Option<u16>,
+    decoded: VecDeque<u8>,
+    done: bool,
+}
+
+impl<R: BufRead> WordReader<R> {
+    /// Create a new `WordReader` which reads words from `inner`.
+    pub fn new(inner: R) -> Self {
+        Self {
+            inner,
+            acc: 0,
+            acc_bits: 0,
+            num_words: 0,
+            pending: None,
+            decoded: VecDeque::new(),
+            done: false,
+        }
+    }
+
+    /// Read the next whitespace-separated word, or `None` at the end of the
+    /// input.
+    fn next_word(&mut self) -> io::Result<Option<String>> {
+        let mut word = vec![];
+        loop {
+            let buf = self.inner.fill_buf()?;
+            if buf.is_empty() {
+                break;
+            }
+            let mut used = 0;
+            for byte in buf {
+                used += 1;
+                if byte.is_ascii_whitespace() {
+                    if !word.is_empty() {
+                        break;
+                    }
+                } else {
+                    word.push(*byte);
+                }
+            }
+            let finished = used < buf.len() || buf[used - 1].is_ascii_whitespace();
+            self.inner.consume(used);
+            if finished && !word.is_empty() {
+                break;
+            }
+        }
+        if word.is_empty() {
+            return Ok(None);
+        }
+        String::from_utf8(word)
+            .map(Some)
+            .map_err(|err| io::Error::new(io::ErrorKind::InvalidData, err))
+    }
+
+    fn push_bits(&mut self, bits: u16, bit_len: u32) {
+        self.acc = (self.acc << bit_len) | bits as u32;
+        self.acc_bits += bit_len;
+        while self.acc_bits >= 8 {
+            self.acc_bits -= 8;
+            self.decoded.push_back((self.acc >> self.acc_bits) as u8);
+        }
+        self.acc &= (1 << self.acc_bits) - 1;
+    }
+
+    /// Decode the next word from the input, or finish decoding at the end of
+    /// the input.
+    fn decode_next(&mut self) -> io::Result<()> {
+        match self.next_word()? {
+            Some(word) => {
+                let index = self.num_words;
+                let bits = word_index(&word)
+                    .ok_or_else(|| invalid_data(Error::UnknownWord { index, word }))?;
+                self.num_words += 1;
+                if let Some(pending) = self.pending.replace(bits) {
+                    self.push_bits(pending, WORD_BITS);
+                }
+            }
+            None => {
+                // Strip the terminating bit and padding from the final word.
+                let last = self
+                    .pending
+                    .take()
+                    .ok_or_else(|| invalid_data(Error::InvalidPadding))?;
+                let padding = last.trailing_zeros() + 1;
+                if padding > WORD_BITS {
+                    return Err(invalid_data(Error::InvalidPadding));
+                }
+                self.push_bits(last >> padding, WORD_BITS - padding);
+                if self.acc_bits != 0 {
+                    return Err(invalid_data(Error::InvalidPadding));
+                }
+                self.done = true;
+            }
+        }
+        Ok(())
+    }
+}
+
+impl<R: BufRead> Read for WordReader<R> {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        while self.decoded.is_empty() && !self.done {
+            self.decode_next()?;
+        }
+        let len = buf.len().min(self.decoded.len());
+        for (dst, src) in buf.iter_mut().zip(self.decoded.drain(..len)) {
+            *dst = src;
+        }
+        Ok(len)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::mnemonic;
+
+    #[test]
+    fn reader_invalid() {
+        let read = |text: &str| {
+            let mut data = vec![];
+            WordReader::new(text.as_bytes())
+                .read_to_end(&mut data)
+                .map(|_| data)
+        };
+
+        assert_eq!(read("above").unwrap(), b"\x00");
+        assert_eq!(read("  above\n\n").unwrap(), b"\x00");
+        for text in &["", "  \n", "abandon", "zoo", "abuse paperback"] {
+            assert_eq!(read(text).unwrap_err().kind(), io::ErrorKind::InvalidData);
+        }
+    }
+
+    #[quickcheck]
+    fn writer_matches_encode(data: Vec<u8>, chunk_size: usize) -> bool {
+        let mut writer = WordWriter::new(vec![]);
+        for chunk in data.chunks(chunk_size % 17 + 1) {
+            writer.write_all(chunk).unwrap();
+        }
+        let text = String::from_utf8(writer.finish().unwrap()).unwrap();
+        text == mnemonic::encode(&data).join(" ")
+    }
+
+    #[quickcheck]
+    fn stream_roundtrip(data: Vec<u8>, chunk_size: usize) -> bool {
+        let text = mnemonic::encode(&data).join("\n");
+        // Use a tiny buffer to exercise words split across reads.
+        let inner = io::BufReader::with_capacity(chunk_size % 7 + 1, text.as_bytes());
+        let mut reader = WordReader::new(inner);
+        let mut decoded = vec![];
+        let mut buf = [0u8; 3];
+        loop {
+            match reader.read(&mut buf).unwrap() {
+                0 => break,
+                n => decoded.extend_from_slice(&buf[..n]),
+            }
+        }
+        decoded == data
+    }
+}
@@ -18,7 +18,7 @@
 
 use crate::{
     shamir::gf::{GfElem, GfElemPrimitive},
-    v0::{FromWire, ToWire},
+    v0::{FromWire, ToWire, WireError},
 };
 
 use unsigned_varint::{encode as varuint_encode, nom as varuint_nom};
@@ -51,6 +51,15 @@ impl Shard {
     pub fn threshold(&self) -> u32 {
         self.threshold
     }
+
+    /// Returns whether `other` could be a sister `Shard` of this one (that is,
+    /// whether the two can be passed together to `recover_secret` without
+    /// violating its consistency requirements).
+    pub fn is_sister(&self, other: &Shard) -> bool {
+        self.threshold == other.threshold
+            && self.secret_len == other.secret_len
+            && self.ys.len() == other.ys.len()
+    }
 }
 
 impl ToWire for Shard {
@@ -86,50 +95,69 @@ impl ToWire for Shard {
 }
 
 impl FromWire for Shard {
-    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), String> {
-        use nom::{combinator::complete, multi::many_m_n, IResult};
-
-        fn parse(input: &[u8]) -> IResult<&[u8], Shard> {
-            let (input, x) = varuint_nom::u32(input)?;
-            let x = GfElem::from_inner(x);
-
-            let (input, ys_length) = varuint_nom::usize(input)?;
-            let (input, ys) = many_m_n(ys_length, ys_length, varuint_nom::u32)(input)?;
-            let ys = ys
-                .iter()
-                .copied()
-                .map(GfElem::from_inner)
-                .collect::<Vec<_>>();
-
-            let (input, threshold) = varuint_nom::u32(input)?;
-            let (input, secret_len) = varuint_nom::usize(input)?;
-
-            Ok((
-                input,
-                Shard {
-                    x,
-                    ys,
-                    secret_len,
-                    threshold,
-                },
-            ))
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use nom::{combinator::complete, multi::many_m_n};
+
+        fn field_err<E: std::fmt::Debug>(field: &'static str) -> impl Fn(E) -> WireError {
+            move |err| WireError::nom("Shard", err).field(field)
+        }
+
+        let (input, x) = complete(varuint_nom::u32)(input).map_err(field_err("x"))?;
+        let x = GfElem::from_inner(x);
+
+        let (input, ys_length) = complete(varuint_nom::usize)(input).map_err(field_err("ys"))?;
+        // Each y-value takes up at least one byte, so we can reject absurd
+        // lengths before allocating anything.
+        if ys_length > input.len() {
+            return Err(WireError::new("Shard", "too many y-values for input length").field("ys"));
         }
-        let mut parse = complete(parse);
+        let (input, ys) = complete(many_m_n(ys_length, ys_length, varuint_nom::u32))(input)
+            .map_err(field_err("ys"))?;
+        let ys = ys
+            .iter()
+            .copied()
+            .map(GfElem::from_inner)
+            .collect::<Vec<_>>();
 
-        let (remain, shard) = parse(input).map_err(|err| format!("{:?}", err))?;
+        let (input, threshold) =
+            complete(varuint_nom::u32)(input).map_err(field_err("threshold"))?;
+        let (remain, secret_len) =
+            complete(varuint_nom::usize)(input).map_err(field_err("secret_len"))?;
 
-        Ok((shard, remain))
+        if threshold == 0 {
+            return Err(WireError::new("Shard", "threshold must be non-zero").field("threshold"));
+        }
+        if secret_len > ys.len() * std::mem::size_of::<GfElemPrimitive>() {
+            return Err(
+                WireError::new("Shard", "secret length is larger than the y-values")
+                    .field("secret_len"),
+            );
+        }
+
+        Ok((
+            Shard {
+                x,
+                ys,
+                secret_len,
+                threshold,
+            },
+            remain,
+        ))
     }
 }
 
 #[cfg(test)]
 impl quickcheck::Arbitrary for Shard {
     fn arbitrary(g: &mut quickcheck::Gen) -> Self {
+        let ys = (0..g.size())
+            .map(|_| GfElem::arbitrary(g))
+            .collect::<Vec<_>>();
+        let max_secret_len = ys.len() * std::mem::size_of::<GfElemPrimitive>();
         Self {
             x: GfElem::arbitrary(g),
-            ys: (0..g.size()).map(|_| GfElem::arbitrary(g)).collect(),
-            secret_len: usize::arbitrary(g),
-            threshold: u32::arbitrary(g),
+            ys,
+            secret_len: usize::arbitrary(g) % (max_secret_len + 1),
+            threshold: u32::arbitrary(g).max(1),
         }
     }
 }
@@ -143,4 +171,15 @@ mod test {
         let shard2 = Shard::from_wire(&shard.to_wire()).unwrap();
         assert_eq!(shard, shard2);
     }
+
+    #[test]
+    fn shard_hostile_ys_length() {
+        let mut bytes = vec![0x01];
+        varuint_encode::usize(u32::MAX as usize, &mut varuint_encode::usize_buffer())
+            .iter()
+            .for_each(|b| bytes.push(*b));
+
+        let err = Shard::from_wire(bytes).unwrap_err();
+        assert_eq!(err.path(), "ys");
+    }
 }
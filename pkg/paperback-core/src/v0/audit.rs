@@ -0,0 +1,230 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{Error, KeyShard, MainDocument, ShardId};
+
+use ed25519_dalek::{Keypair, PublicKey, SecretKey, Signature, Signer};
+use multihash::Multihash;
+use rand::{rngs::OsRng, RngCore};
+
+const AUDIT_BINDING_CONTEXT: &[u8] = b"paperback-v0-audit-binding";
+const AUDIT_CHALLENGE_CONTEXT: &[u8] = b"paperback-v0-audit-challenge";
+
+fn audit_binding_bytes(
+    doc_chksum: &Multihash,
+    shard_id: &str,
+    audit_public_key: &PublicKey,
+) -> Vec<u8> {
+    let mut bytes = AUDIT_BINDING_CONTEXT.to_vec();
+    bytes.extend_from_slice(&doc_chksum.to_bytes());
+    bytes.extend_from_slice(shard_id.as_bytes());
+    bytes.extend_from_slice(audit_public_key.as_bytes());
+    bytes
+}
+
+fn audit_challenge_bytes(doc_chksum: &Multihash, shard_id: &str, challenge: &[u8]) -> Vec<u8> {
+    let mut bytes = AUDIT_CHALLENGE_CONTEXT.to_vec();
+    bytes.extend_from_slice(&doc_chksum.to_bytes());
+    bytes.extend_from_slice(shard_id.as_bytes());
+    bytes.extend_from_slice(challenge);
+    bytes
+}
+
+/// Per-shard audit key, stored inside each (encrypted) key shard.
+///
+/// The audit key is independent of the shard data, so a shardholder can use
+/// it to answer audit challenges without revealing anything about the secret.
+/// The binding signature (made with the document's identity key) ties the
+/// audit public key to a particular shard of a particular document.
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub(crate) struct ShardAudit {
+    pub(crate) audit_seed: [u8; ed25519_dalek::SECRET_KEY_LENGTH],
+    pub(crate) binding_signature: Signature,
+}
+
+impl ShardAudit {
+    pub(crate) fn generate(id_keypair: &Keypair, doc_chksum: &Multihash, shard_id: &str) -> Self {
+        let mut audit_seed = [0u8; ed25519_dalek::SECRET_KEY_LENGTH];
+        OsRng.fill_bytes(&mut audit_seed);
+
+        let audit_keypair = Self::keypair_from_seed(&audit_seed);
+        let binding_signature = id_keypair.sign(&audit_binding_bytes(
+            doc_chksum,
+            shard_id,
+            &audit_keypair.public,
+        ));
+
+        Self {
+            audit_seed,
+            binding_signature,
+        }
+    }
+
+    fn keypair_from_seed(seed: &[u8; ed25519_dalek::SECRET_KEY_LENGTH]) -> Keypair {
+        let secret = SecretKey::from_bytes(&seed[..])
+            .expect("ed25519 secret key from fixed-length seed must never fail");
+        let public = PublicKey::from(&secret);
+        Keypair { secret, public }
+    }
+
+    fn keypair(&self) -> Keypair {
+        Self::keypair_from_seed(&self.audit_seed)
+    }
+}
+
+#[cfg(test)]
+impl quickcheck::Arbitrary for ShardAudit {
+    fn arbitrary(g: &mut quickcheck::Gen) -> Self {
+        use multihash::MultihashDigest;
+
+        let id_keypair = Keypair::generate(&mut rand::thread_rng());
+        let bytes = Vec::<u8>::arbitrary(g);
+        let doc_chksum = crate::v0::CHECKSUM_ALGORITHM.digest(&bytes);
+        Self::generate(&id_keypair, &doc_chksum, &String::arbitrary(g))
+    }
+}
+
+/// Proof from a shardholder that they hold an intact and genuine key shard.
+///
+/// An `AuditResponse` is produced by [`KeyShard::audit`] in response to a
+/// challenge chosen by the document owner, and can be checked against the
+/// main document with [`AuditResponse::verify`]. It contains no information
+/// about the shard's share of the secret, so shardholders can answer audits
+/// without needing to assemble a quorum.
+#[derive(Clone, Debug)]
+#[cfg_attr(test, derive(PartialEq, Eq))]
+pub struct AuditResponse {
+    pub(crate) doc_chksum: Multihash,
+    pub(crate) shard_id: ShardId,
+    pub(crate) audit_public_key: PublicKey,
+    pub(crate) binding_signature: Signature,
+    pub(crate) challenge_signature: Signature,
+}
+
+impl AuditResponse {
+    /// Returns the identifier of the audited shard.
+    pub fn shard_id(&self) -> ShardId {
+        self.shard_id.clone()
+    }
+
+    /// Verify that the response is a valid answer to `challenge` by a
+    /// shardholder of a genuine key shard belonging to `main_document`.
+    pub fn verify<C: AsRef<[u8]>>(
+        &self,
+        main_document: &MainDocument,
+        challenge: C,
+    ) -> Result<(), Error> {
+        if self.doc_chksum != main_document.checksum() {
+            return Err(Error::AuditVerification(
+                "shard does not belong to this main document",
+            ));
+        }
+
+        // The audit key must have been bound to this shard by the document's
+        // identity key.
+        let id_public_key = main_document.identity.id_public_key;
+        id_public_key
+            .verify_strict(
+                &audit_binding_bytes(&self.doc_chksum, &self.shard_id, &self.audit_public_key),
+                &self.binding_signature,
+            )
+            .map_err(|_| {
+                Error::AuditVerification("audit key was not issued by the document identity")
+            })?;
+
+        // The challenge must have been signed by the audit key.
+        self.audit_public_key
+            .verify_strict(
+                &audit_challenge_bytes(&self.doc_chksum, &self.shard_id, challenge.as_ref()),
+                &self.challenge_signature,
+            )
+            .map_err(|_| Error::AuditVerification("challenge signature is invalid"))
+    }
+}
+
+impl KeyShard {
+    /// Generate a response to an audit `challenge` chosen by the document
+    /// owner, proving that this shard is intact and genuine without revealing
+    /// its share of the secret.
+    pub fn audit<C: AsRef<[u8]>>(&self, challenge: C) -> Result<AuditResponse, Error> {
+        let audit = self.inner.audit.as_ref().ok_or(Error::MissingCapability(
+            "key shard was created without an audit key",
+        ))?;
+
+        let doc_chksum = self.document_checksum();
+        let shard_id = self.id();
+        let audit_keypair = audit.keypair();
+        let challenge_signature = audit_keypair.sign(&audit_challenge_bytes(
+            &doc_chksum,
+            &shard_id,
+            challenge.as_ref(),
+        ));
+
+        Ok(AuditResponse {
+            doc_chksum,
+            shard_id,
+            audit_public_key: audit_keypair.public,
+            binding_signature: audit.binding_signature,
+            challenge_signature,
+        })
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{Backup, FromWire, ToWire};
+
+    #[quickcheck]
+    fn audit_roundtrip(challenge: Vec<u8>) {
+        let backup = Backup::new(3, b"secret data").unwrap();
+        let main_document = backup.main_document();
+        let shard = backup.next_shard().unwrap();
+
+        let response = shard.audit(&challenge).unwrap();
+        let response = AuditResponse::from_wire(response.to_wire()).unwrap();
+        assert_eq!(response.shard_id(), shard.id());
+        response.verify(main_document, &challenge).unwrap();
+    }
+
+    #[quickcheck]
+    fn audit_wrong_challenge(challenge: Vec<u8>) {
+        let backup = Backup::new(3, b"secret data").unwrap();
+        let shard = backup.next_shard().unwrap();
+
+        let response = shard.audit(&challenge).unwrap();
+        let mut wrong_challenge = challenge.clone();
+        wrong_challenge.push(0xff);
+        response
+            .verify(backup.main_document(), &wrong_challenge)
+            .unwrap_err();
+    }
+
+    #[test]
+    fn audit_wrong_document() {
+        let backup = Backup::new(3, b"secret data").unwrap();
+        let other_backup = Backup::new(3, b"secret data").unwrap();
+        let shard = backup.next_shard().unwrap();
+
+        let response = shard.audit(b"challenge").unwrap();
+        response
+            .verify(other_backup.main_document(), b"challenge")
+            .unwrap_err();
+    }
+}
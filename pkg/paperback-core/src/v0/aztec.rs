@@ -0,0 +1,583 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{qr::document_payloads, Error, Framed};
+
+/// Number of modules of blank space left around an Aztec code. Aztec codes do
+/// not require a quiet zone (the finder pattern is in the centre of the
+/// symbol), but a single module keeps adjacent symbols from touching.
+pub(crate) const AZTEC_QUIET_ZONE: usize = 1;
+
+/// Largest number of bytes which are guaranteed to fit in a single (151x151)
+/// Aztec code. Depending on the data, slightly more may fit (see
+/// [`stuff_bits`]).
+pub const AZTEC_MAX_BYTES: usize = 1752;
+
+/// Minimum percentage of the symbol used for error correction.
+const MIN_ECC_PERCENT: usize = 33;
+
+/// Largest number of layers in a compact and full-range symbol.
+const MAX_COMPACT_LAYERS: usize = 4;
+const MAX_LAYERS: usize = 32;
+
+/// Code (in upper mode) which switches to binary mode.
+const BINARY_SHIFT: usize = 31;
+
+/// Largest number of bytes which can follow a single binary shift.
+const MAX_BINARY_SHIFT: usize = 31 + (1 << 11) - 1;
+
+/// Returns the size (in bits) of each codeword of a symbol with `layers`
+/// layers.
+fn word_size(layers: usize) -> usize {
+    match layers {
+        1..=2 => 6,
+        3..=8 => 8,
+        9..=22 => 10,
+        _ => 12,
+    }
+}
+
+/// Returns the number of bits which fit in the data layers of a symbol.
+fn total_bits(layers: usize, compact: bool) -> usize {
+    (if compact { 88 } else { 112 } + 16 * layers) * layers
+}
+
+/// Arithmetic in GF(2^n) with the Aztec prime polynomial for `n`-bit
+/// codewords.
+struct Galois {
+    exp: Vec<u16>,
+    log: Vec<u16>,
+}
+
+impl Galois {
+    fn new(word_size: usize) -> Self {
+        let poly = match word_size {
+            4 => 0x13,
+            6 => 0x43,
+            8 => 0x12d,
+            10 => 0x409,
+            12 => 0x1069,
+            _ => unreachable!("invalid aztec word size {}", word_size),
+        };
+        let order = (1 << word_size) - 1;
+        let mut exp = vec![0u16; 2 * order];
+        let mut log = vec![0u16; order + 1];
+        let mut x = 1u32;
+        for i in 0..order {
+            exp[i] = x as u16;
+            exp[i + order] = x as u16;
+            log[x as usize] = i as u16;
+            x <<= 1;
+            if x >> word_size != 0 {
+                x ^= poly;
+            }
+        }
+        Self { exp, log }
+    }
+
+    fn mul(&self, a: u16, b: u16) -> u16 {
+        if a == 0 || b == 0 {
+            return 0;
+        }
+        self.exp[self.log[a as usize] as usize + self.log[b as usize] as usize]
+    }
+
+    /// Returns the `num_ecc` Reed-Solomon error correction codewords for
+    /// `data`, using the generator polynomial with roots a^1 to a^num_ecc.
+    fn reed_solomon(&self, data: &[u16], num_ecc: usize) -> Vec<u16> {
+        // Coefficients of the generator polynomial, highest degree first.
+        let mut generator = vec![1u16];
+        for i in 1..=num_ecc {
+            let mut next = generator.clone();
+            next.push(0);
+            for (j, coeff) in generator.iter().enumerate() {
+                next[j + 1] ^= self.mul(*coeff, self.exp[i]);
+            }
+            generator = next;
+        }
+
+        let mut ecc = vec![0u16; num_ecc];
+        for word in data {
+            let factor = word ^ ecc[0];
+            ecc.rotate_left(1);
+            ecc[num_ecc - 1] = 0;
+            for (j, coeff) in generator[1..].iter().enumerate() {
+                ecc[j] ^= self.mul(*coeff, factor);
+            }
+        }
+        ecc
+    }
+}
+
+/// Append the lowest `count` bits of `value` to `bits`, most significant bit
+/// first.
+fn push_bits(bits: &mut Vec<bool>, value: usize, count: usize) {
+    bits.extend((0..count).rev().map(|i| (value >> i) & 1 == 1));
+}
+
+/// Encode `data` as a sequence of binary shifts from the (initial) upper mode.
+fn encode_binary(data: &[u8]) -> Vec<bool> {
+    let mut bits = vec![];
+    for chunk in data.chunks(MAX_BINARY_SHIFT) {
+        push_bits(&mut bits, BINARY_SHIFT, 5);
+        if chunk.len() <= 31 {
+            push_bits(&mut bits, chunk.len(), 5);
+        } else {
+            // A zero length is followed by a longer 11-bit length.
+            push_bits(&mut bits, 0, 5);
+            push_bits(&mut bits, chunk.len() - 31, 11);
+        }
+        for byte in chunk {
+            push_bits(&mut bits, *byte as usize, 8);
+        }
+    }
+    bits
+}
+
+/// Split `bits` into codewords of `word_size` bits. Codewords which would be
+/// all zeroes or all ones are not permitted, so a complementary bit is
+/// "stuffed" after the first `word_size - 1` bits of such codewords (which is
+/// why the capacity of a symbol depends slightly on the data). The final
+/// codeword is padded with ones.
+fn stuff_bits(bits: &[bool], word_size: usize) -> Vec<u16> {
+    let mask = (1 << word_size) - 2;
+    let mut words = vec![];
+    let mut idx = 0;
+    while idx < bits.len() {
+        let word = (0..word_size).fold(0u16, |word, j| {
+            (word << 1) | (*bits.get(idx + j).unwrap_or(&true) as u16)
+        });
+        if word & mask == mask {
+            words.push(word & mask);
+            idx += word_size - 1;
+        } else if word & mask == 0 {
+            words.push(word | 1);
+            idx += word_size - 1;
+        } else {
+            words.push(word);
+            idx += word_size;
+        }
+    }
+    if words.is_empty() {
+        // An empty message still needs a (padding) codeword.
+        words.push(mask);
+    }
+    words
+}
+
+/// Append Reed-Solomon error correction to `words` so that they fill
+/// `total_bits` bits, returning the resulting bits. Any bits left over from
+/// the final (partial) codeword are placed at the start.
+fn check_words(words: &[u16], total_bits: usize, word_size: usize) -> Vec<bool> {
+    let total_words = total_bits / word_size;
+    let ecc = Galois::new(word_size).reed_solomon(words, total_words - words.len());
+    let mut bits = vec![false; total_bits % word_size];
+    for word in words.iter().chain(&ecc) {
+        push_bits(&mut bits, *word as usize, word_size);
+    }
+    bits
+}
+
+/// An Aztec code.
+///
+/// Aztec codes are an alternative to QR codes which have their finder pattern
+/// in the centre of the symbol and do not need a quiet zone, so they are more
+/// likely to survive scans which crop the edges of the symbol (such as when a
+/// document has been stored folded).
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub struct AztecCode {
+    width: usize,
+    compact: bool,
+    modules: Vec<bool>,
+}
+
+impl AztecCode {
+    fn new(width: usize, compact: bool) -> Self {
+        Self {
+            width,
+            compact,
+            modules: vec![false; width * width],
+        }
+    }
+
+    fn set(&mut self, x: usize, y: usize) {
+        self.modules[y * self.width + x] = true;
+    }
+
+    /// Draw the concentric squares (and orientation marks) of the finder
+    /// pattern.
+    fn draw_bullseye(&mut self, center: usize, size: usize) {
+        for i in (0..size).step_by(2) {
+            for j in center - i..=center + i {
+                self.set(j, center - i);
+                self.set(j, center + i);
+                self.set(center - i, j);
+                self.set(center + i, j);
+            }
+        }
+        self.set(center - size, center - size);
+        self.set(center - size + 1, center - size);
+        self.set(center - size, center - size + 1);
+        self.set(center + size, center - size);
+        self.set(center + size, center - size + 1);
+        self.set(center + size, center + size - 1);
+    }
+
+    /// Draw the mode message (describing the size of the symbol) around the
+    /// finder pattern.
+    fn draw_mode_message(&mut self, mode_message: &[bool]) {
+        let center = self.width / 2;
+        if self.compact {
+            for i in 0..7 {
+                let offset = center - 3 + i;
+                if mode_message[i] {
+                    self.set(offset, center - 5);
+                }
+                if mode_message[i + 7] {
+                    self.set(center + 5, offset);
+                }
+                if mode_message[20 - i] {
+                    self.set(offset, center + 5);
+                }
+                if mode_message[27 - i] {
+                    self.set(center - 5, offset);
+                }
+            }
+        } else {
+            for i in 0..10 {
+                let offset = center - 5 + i + i / 5;
+                if mode_message[i] {
+                    self.set(offset, center - 7);
+                }
+                if mode_message[i + 10] {
+                    self.set(center + 7, offset);
+                }
+                if mode_message[29 - i] {
+                    self.set(offset, center + 7);
+                }
+                if mode_message[39 - i] {
+                    self.set(center - 7, offset);
+                }
+            }
+        }
+    }
+
+    /// Returns whether this is a compact Aztec code (with at most four layers
+    /// and no reference grid).
+    pub fn is_compact(&self) -> bool {
+        self.compact
+    }
+
+    /// Returns the width (and height) of the symbol in modules, not including
+    /// the quiet zone.
+    pub fn width(&self) -> usize {
+        self.width
+    }
+
+    /// Returns whether the module at (`x`, `y`) is dark, with the origin at the
+    /// top-left of the symbol.
+    pub fn is_dark(&self, x: usize, y: usize) -> bool {
+        self.modules[y * self.width + x]
+    }
+
+    /// Returns the (x, y) coordinates of every dark module, with the origin
+    /// at the top-left of the symbol (not including the quiet zone).
+    pub(crate) fn dark_modules(&self) -> impl Iterator<Item = (usize, usize)> + '_ {
+        let width = self.width;
+        self.modules
+            .iter()
+            .enumerate()
+            .filter(|(_, dark)| **dark)
+            .map(move |(idx, _)| (idx % width, idx / width))
+    }
+}
+
+/// Generate an Aztec code containing `data` in binary mode, using the smallest
+/// symbol which can hold the data with at least 33% error correction.
+pub fn binary_aztec<B: AsRef<[u8]>>(data: B) -> Result<AztecCode, Error> {
+    let data = data.as_ref();
+    let bits = encode_binary(data);
+    let ecc_bits = bits.len() * MIN_ECC_PERCENT / 100 + 11;
+
+    // Find the smallest symbol which fits the data. Full-range symbols with
+    // fewer layers than the largest compact symbol are never smaller, so are
+    // skipped.
+    let mut stuffed = vec![];
+    let mut stuffed_size = 0;
+    let (compact, layers) = (1..=MAX_COMPACT_LAYERS)
+        .map(|layers| (true, layers))
+        .chain((MAX_COMPACT_LAYERS..=MAX_LAYERS).map(|layers| (false, layers)))
+        .find(|&(compact, layers)| {
+            let total_bits = total_bits(layers, compact);
+            if bits.len() + ecc_bits > total_bits {
+                return false;
+            }
+            let word_size = word_size(layers);
+            if stuffed_size != word_size {
+                stuffed = stuff_bits(&bits, word_size);
+                stuffed_size = word_size;
+            }
+            // Compact symbols can only hold 64 data codewords.
+            if compact && stuffed.len() > 64 {
+                return false;
+            }
+            stuffed.len() * word_size + ecc_bits <= total_bits - total_bits % word_size
+        })
+        .ok_or_else(|| {
+            Error::Other(format!(
+                "{} bytes is too large for a single aztec code",
+                data.len()
+            ))
+        })?;
+
+    let word_size = word_size(layers);
+    let message = check_words(&stuffed, total_bits(layers, compact), word_size);
+
+    // The mode message contains the number of layers and data codewords, with
+    // its own error correction.
+    let mut mode = vec![];
+    let mode_message = if compact {
+        push_bits(&mut mode, layers - 1, 2);
+        push_bits(&mut mode, stuffed.len() - 1, 6);
+        check_words(&mode_message_words(&mode), 28, 4)
+    } else {
+        push_bits(&mut mode, layers - 1, 5);
+        push_bits(&mut mode, stuffed.len() - 1, 11);
+        check_words(&mode_message_words(&mode), 40, 4)
+    };
+
+    // Full-range symbols have a reference grid every 16 modules from the
+    // centre, which the data layers skip over.
+    let base_size = if compact { 11 } else { 14 } + 4 * layers;
+    let (width, alignment) = if compact {
+        (base_size, (0..base_size).collect::<Vec<_>>())
+    } else {
+        let width = base_size + 1 + 2 * ((base_size / 2 - 1) / 15);
+        let (base_center, center) = (base_size / 2, width / 2);
+        let mut alignment = vec![0; base_size];
+        for i in 0..base_center {
+            let offset = i + i / 15;
+            alignment[base_center - i - 1] = center - offset - 1;
+            alignment[base_center + i] = center + offset + 1;
+        }
+        (width, alignment)
+    };
+    let mut symbol = AztecCode::new(width, compact);
+
+    // Each layer is two modules thick, and is filled (in pairs of bits)
+    // anticlockwise from the top-left, starting with the outermost layer.
+    let last = base_size - 1;
+    let mut row_offset = 0;
+    for i in 0..layers {
+        let row_size = 4 * (layers - i) + if compact { 9 } else { 12 };
+        for j in 0..row_size {
+            let column_offset = 2 * j;
+            for k in 0..2 {
+                let bit =
+                    |side: usize| message[row_offset + side * 2 * row_size + column_offset + k];
+                if bit(0) {
+                    symbol.set(alignment[2 * i + k], alignment[2 * i + j]);
+                }
+                if bit(1) {
+                    symbol.set(alignment[2 * i + j], alignment[last - 2 * i - k]);
+                }
+                if bit(2) {
+                    symbol.set(alignment[last - 2 * i - k], alignment[last - 2 * i - j]);
+                }
+                if bit(3) {
+                    symbol.set(alignment[last - 2 * i - j], alignment[2 * i + k]);
+                }
+            }
+        }
+        row_offset += 8 * row_size;
+    }
+    symbol.draw_mode_message(&mode_message);
+
+    let center = width / 2;
+    if compact {
+        symbol.draw_bullseye(center, 5);
+    } else {
+        symbol.draw_bullseye(center, 7);
+        for offset in (0..=center).step_by(16) {
+            for k in ((center & 1)..width).step_by(2) {
+                symbol.set(center - offset, k);
+                symbol.set(center + offset, k);
+                symbol.set(k, center - offset);
+                symbol.set(k, center + offset);
+            }
+        }
+    }
+    Ok(symbol)
+}
+
+/// Split the bits of a mode message into 4-bit codewords.
+fn mode_message_words(bits: &[bool]) -> Vec<u16> {
+    bits.chunks(4)
+        .map(|chunk| chunk.iter().fold(0, |word, bit| (word << 1) | *bit as u16))
+        .collect()
+}
+
+/// Generate the Aztec codes for `document`, splitting it into
+/// [`Page`](crate::v0::Page)s in the same way as
+/// [`document_qr_codes`](crate::v0::document_qr_codes) if it does not fit in
+/// a single symbol.
+pub fn document_aztec_codes<T: Framed>(document: &T) -> Result<Vec<AztecCode>, Error> {
+    document_payloads(document, AZTEC_MAX_BYTES)
+        .iter()
+        .map(binary_aztec)
+        .collect()
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{Backup, FrameEncoding, MainDocument, QrAssembler};
+
+    #[test]
+    fn reed_solomon_roots() {
+        // A codeword (data followed by error correction) is a multiple of the
+        // generator polynomial, so it must evaluate to zero at every root.
+        for &word_size in &[4, 6, 8, 10, 12] {
+            let galois = Galois::new(word_size);
+            let data = (1..20u16)
+                .map(|i| (i * 37) & ((1 << word_size) - 1))
+                .collect::<Vec<_>>();
+            let num_ecc = 7;
+            let codeword = data
+                .iter()
+                .copied()
+                .chain(galois.reed_solomon(&data, num_ecc))
+                .collect::<Vec<_>>();
+            for root in 1..=num_ecc {
+                let value = codeword.iter().fold(0, |value, coeff| {
+                    galois.mul(value, galois.exp[root]) ^ coeff
+                });
+                assert_eq!(value, 0, "GF(2^{}) root a^{}", word_size, root);
+            }
+        }
+    }
+
+    #[test]
+    fn bit_stuffing() {
+        let bits = |s: &str| s.chars().map(|c| c == '1').collect::<Vec<_>>();
+        assert_eq!(stuff_bits(&bits("101010"), 6), vec![0b101010]);
+        // All-zero and all-one codewords are stuffed.
+        assert_eq!(
+            stuff_bits(&bits("000000111111"), 6),
+            vec![0b000001, 0b011111, 0b111110]
+        );
+        // The final codeword is padded with ones.
+        assert_eq!(stuff_bits(&bits("1010"), 6), vec![0b101011]);
+        assert_eq!(stuff_bits(&[], 6), vec![0b111110]);
+    }
+
+    #[test]
+    fn binary_aztec_sizing() {
+        let code = binary_aztec(b"").unwrap();
+        assert_eq!((code.width(), code.is_compact()), (15, true));
+        let code = binary_aztec([0xa5; 32]).unwrap();
+        assert_eq!((code.width(), code.is_compact()), (23, true));
+        let code = binary_aztec([0xa5; 62]).unwrap();
+        assert_eq!((code.width(), code.is_compact()), (31, false));
+        // Bit stuffing is worst for runs of zeroes (or ones).
+        for &byte in &[0x00, 0xff] {
+            let code = binary_aztec(vec![byte; AZTEC_MAX_BYTES]).unwrap();
+            assert_eq!((code.width(), code.is_compact()), (151, false));
+            binary_aztec(vec![byte; AZTEC_MAX_BYTES + 1]).unwrap_err();
+        }
+    }
+
+    #[test]
+    fn finder_pattern() {
+        for len in &[0, 40, 300, 1000] {
+            let code = binary_aztec(vec![0x5a; *len]).unwrap();
+            let center = code.width() / 2;
+            let size = if code.is_compact() { 5 } else { 7 };
+            // Alternating concentric squares around the centre.
+            for ring in 0..size {
+                for i in center - ring..=center + ring {
+                    let dark = ring % 2 == 0;
+                    assert_eq!(code.is_dark(i, center - ring), dark);
+                    assert_eq!(code.is_dark(i, center + ring), dark);
+                    assert_eq!(code.is_dark(center - ring, i), dark);
+                    assert_eq!(code.is_dark(center + ring, i), dark);
+                }
+            }
+            // Orientation marks in the corners of the mode message.
+            assert!(code.is_dark(center - size, center - size));
+            assert!(code.is_dark(center - size + 1, center - size));
+            assert!(code.is_dark(center + size, center - size));
+            assert!(!code.is_dark(center - size, center + size));
+            assert!(!code.is_dark(center + size, center + size));
+            assert_eq!(
+                code.dark_modules().count(),
+                code.modules.iter().filter(|dark| **dark).count()
+            );
+        }
+    }
+
+    #[test]
+    fn reference_grid() {
+        // Symbols with 12 and 27 layers have reference grid lines right up
+        // against their edges.
+        for &(len, width) in &[(300, 67), (1300, 131)] {
+            let code = binary_aztec(vec![0x5a; len]).unwrap();
+            assert_eq!(code.width(), width);
+            let center = width / 2;
+            for offset in (0..=center).step_by(16) {
+                for k in 0..width {
+                    if (center as isize - k as isize).abs() <= 7 {
+                        continue;
+                    }
+                    let dark = (k + center) % 2 == 0;
+                    assert_eq!(code.is_dark(center - offset, k), dark);
+                    assert_eq!(code.is_dark(center + offset, k), dark);
+                    assert_eq!(code.is_dark(k, center - offset), dark);
+                    assert_eq!(code.is_dark(k, center + offset), dark);
+                }
+            }
+        }
+    }
+
+    #[test]
+    fn chunked_document() {
+        let secret = (0..4000).map(|i| (i * 7) as u8).collect::<Vec<_>>();
+        let backup = Backup::new(2, &secret).unwrap();
+        let main = backup.main_document();
+
+        let payloads = document_payloads(main, AZTEC_MAX_BYTES);
+        assert!(payloads.len() > 1);
+        let codes = document_aztec_codes(main).unwrap();
+        assert_eq!(codes.len(), payloads.len());
+        assert!(codes.iter().all(|code| code.width() <= 151));
+
+        // The contents are the same pages as used for qr codes.
+        let mut assembler = QrAssembler::new();
+        for payload in payloads {
+            assembler.push(payload).unwrap();
+        }
+        assert_eq!(&assembler.assemble::<MainDocument>().unwrap(), main);
+
+        let backup = Backup::new(2, b"secret data").unwrap();
+        assert_eq!(
+            document_payloads(backup.main_document(), AZTEC_MAX_BYTES),
+            vec![backup.main_document().to_framed(FrameEncoding::Raw)]
+        );
+    }
+}
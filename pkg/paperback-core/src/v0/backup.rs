@@ -17,27 +17,242 @@
  */
 
 use crate::{
-    shamir::Dealer,
+    shamir::{Dealer, Shard},
     v0::{
-        ChaChaPolyKey, ChaChaPolyNonce, Error, KeyShard, KeyShardBuilder, MainDocument,
-        MainDocumentBuilder, MainDocumentMeta, ShardSecret, ToWire,
+        ChaChaPolyKey, ChaChaPolyNonce, CodewordLanguage, Compression, DocumentDates, Error,
+        EscrowKey, EscrowRecipients, Identity, KeyShard, KeyShardBuilder, MainDocument,
+        MainDocumentBuilder, MainDocumentMeta, RosterEntry, ShardAudit, ShardCommitment, ShardId,
+        ShardIssuance, ShardRevocation, ShardRoster, ShardSecret, Timestamper, ToWire,
+        CHACHAPOLY_TAG_LENGTH, CHECKSUM_ALGORITHM,
     },
 };
 
+use std::{
+    cell::Cell,
+    time::{SystemTime, UNIX_EPOCH},
+};
+
 use aead::{Aead, NewAead, Payload};
 use chacha20poly1305::ChaCha20Poly1305;
 use ed25519_dalek::{Keypair, SecretKey};
+use multihash::MultihashDigest;
 use rand::{rngs::OsRng, RngCore};
 
-pub struct Backup {
-    main_document: MainDocument,
-    dealer: Dealer,
-    id_keypair: Keypair,
+/// Configuration for a new [`Backup`].
+#[derive(Clone, Debug)]
+pub struct BackupBuilder {
+    quorum_size: u32,
+    sealed: bool,
+    created_at: Option<SystemTime>,
+    review_by: Option<SystemTime>,
+    commit_shards: Option<u32>,
+    roster: Option<Vec<String>>,
+    compression: Option<Compression>,
+    revocation: Option<ShardRevocation>,
+    language: Option<CodewordLanguage>,
+    escrow: Vec<age::x25519::Recipient>,
 }
 
-impl Backup {
-    // XXX: This internal API is a bit ugly...
-    fn inner_new(quorum_size: u32, secret: &[u8], sealed: bool) -> Result<Self, Error> {
+impl BackupBuilder {
+    /// Construct a new `BackupBuilder` for a backup which requires
+    /// `quorum_size` shards to be recovered.
+    pub fn new(quorum_size: u32) -> Self {
+        Self {
+            quorum_size,
+            sealed: false,
+            created_at: None,
+            review_by: None,
+            commit_shards: None,
+            roster: None,
+            compression: None,
+            revocation: None,
+            language: None,
+            escrow: vec![],
+        }
+    }
+
+    /// Set whether the backup is sealed. Sealed backups cannot have new shards
+    /// created after the initial backup.
+    pub fn sealed(mut self, sealed: bool) -> Self {
+        self.sealed = sealed;
+        self
+    }
+
+    /// Record the time at which the backup was created.
+    pub fn created_at(mut self, created_at: SystemTime) -> Self {
+        self.created_at = Some(created_at);
+        self
+    }
+
+    /// Record the time by which the backup should be re-verified.
+    pub fn review_by(mut self, review_by: SystemTime) -> Self {
+        self.review_by = Some(review_by);
+        self
+    }
+
+    /// Issue exactly `num_shards` key shards, and store a commitment to that
+    /// set of shards in the main document. Recoverers can then detect shards
+    /// which were not part of the original set (such as forgeries made using a
+    /// quorum of shards, or shards made through expansion).
+    pub fn commit_shards(mut self, num_shards: u32) -> Self {
+        self.commit_shards = Some(num_shards);
+        self
+    }
+
+    /// Issue exactly one key shard for each of the given `holders`, and include
+    /// a roster of all of the issued shards (with the corresponding holder
+    /// hints) in every key shard. If used with
+    /// [`commit_shards`](Self::commit_shards), the number of shards must
+    /// match.
+    pub fn roster(mut self, holders: Vec<String>) -> Self {
+        self.roster = Some(holders);
+        self
+    }
+
+    /// Compress the secret data with `compression` before encrypting it.
+    pub fn compression(mut self, compression: Compression) -> Self {
+        self.compression = Some(compression);
+        self
+    }
+
+    /// Use the `language` wordlist for the codewords of the key shards. The
+    /// language is recorded in every key shard, so recoverers do not need to
+    /// know which wordlist was used.
+    pub fn language(mut self, language: CodewordLanguage) -> Self {
+        // English is the default, and is not recorded.
+        self.language = Some(language).filter(|l| *l != CodewordLanguage::English);
+        self
+    }
+
+    /// Additionally wrap the key of the main document to each of the age
+    /// `recipients`, so that a digital escrow copy of the key (see
+    /// [`Backup::escrow`]) exists alongside the key shards. The recipients are
+    /// listed in the authenticated metadata of the main document.
+    pub fn escrow(mut self, recipients: Vec<age::x25519::Recipient>) -> Self {
+        self.escrow = recipients;
+        self
+    }
+
+    /// Mark this backup as a replacement for the backup with main document
+    /// `replaces`, whose key shards (with ids `shard_ids`) are revoked. The
+    /// revocation record is included in every key shard.
+    pub fn revokes(mut self, replaces: &MainDocument, shard_ids: Vec<ShardId>) -> Self {
+        self.revocation = Some(ShardRevocation {
+            doc_chksum: replaces.checksum(),
+            shard_ids,
+        });
+        self
+    }
+
+    fn unix_secs(time: Option<SystemTime>) -> Result<Option<u64>, Error> {
+        time.map(|time| {
+            time.duration_since(UNIX_EPOCH)
+                .map(|d| d.as_secs())
+                .map_err(|_| Error::Other("document dates cannot predate the UNIX epoch".into()))
+        })
+        .transpose()
+    }
+
+    /// Create the backup of `secret`.
+    ///
+    /// The limits enforced when decoding documents (see [`limits`]) are
+    /// checked before any key material is generated, so that a backup which
+    /// could never be recovered is never created.
+    ///
+    /// [`limits`]: crate::v0::limits
+    pub fn build<B: AsRef<[u8]>>(self, secret: B) -> Result<Backup, Error> {
+        use crate::v0::limits::{
+            MAX_DECOMPRESSED_LENGTH, MAX_ESCROW_RECIPIENTS, MAX_ROSTER_ENTRIES, MAX_WIRE_LENGTH,
+        };
+
+        let secret = secret.as_ref();
+        if self.escrow.len() > MAX_ESCROW_RECIPIENTS {
+            return Err(Error::Other(format!(
+                "the document key cannot be escrowed to more than {} recipients",
+                MAX_ESCROW_RECIPIENTS
+            )));
+        }
+        if let Some(ref holders) = self.roster {
+            if holders.len() > MAX_ROSTER_ENTRIES {
+                return Err(Error::Other(format!(
+                    "a shard roster cannot list more than {} holders",
+                    MAX_ROSTER_ENTRIES
+                )));
+            }
+        }
+        if let Some(ref revocation) = self.revocation {
+            if revocation.shard_ids.len() > MAX_ROSTER_ENTRIES {
+                return Err(Error::Other(format!(
+                    "cannot revoke more than {} shards",
+                    MAX_ROSTER_ENTRIES
+                )));
+            }
+        }
+        if self.compression.is_some() && secret.len() > MAX_DECOMPRESSED_LENGTH {
+            return Err(Error::Other(format!(
+                "compressed secret data cannot be larger than {} bytes",
+                MAX_DECOMPRESSED_LENGTH
+            )));
+        }
+        let dates = DocumentDates {
+            created_at: Self::unix_secs(self.created_at)?,
+            review_by: Self::unix_secs(self.review_by)?,
+        };
+
+        // Work out how many of the shards are fixed up-front (if requested).
+        let num_fixed_shards = match (self.commit_shards, &self.roster) {
+            (Some(num_shards), Some(holders)) if num_shards as usize != holders.len() => {
+                return Err(Error::Other(format!(
+                    "roster has {} holders but {} shards are to be committed",
+                    holders.len(),
+                    num_shards
+                )))
+            }
+            (Some(num_shards), _) => num_shards,
+            (None, Some(holders)) => holders.len() as u32,
+            (None, None) => 0,
+        };
+        let committed = self.commit_shards.is_some() && num_fixed_shards > 0;
+
+        // The shard Merkle root is filled in once the shards exist.
+        let mut main_document_meta = MainDocumentMeta {
+            version: 0u32,
+            quorum_size: self.quorum_size,
+            dates,
+            shard_root: None,
+            compression: self.compression,
+            escrow: Some(EscrowRecipients {
+                recipients: self.escrow.iter().map(|r| r.to_string()).collect(),
+            })
+            .filter(|escrow| !escrow.recipients.is_empty()),
+        };
+
+        // Compress the contents (if requested).
+        let compressed_secret;
+        let secret = match self.compression {
+            Some(compression) => {
+                compressed_secret = compression.compress(secret);
+                &compressed_secret[..]
+            }
+            None => secret,
+        };
+
+        // The main document must not be larger than the decoder accepts. The
+        // placeholder root has the same length as the real one.
+        let main_document_length = main_document_wire_length(
+            MainDocumentMeta {
+                shard_root: Some(CHECKSUM_ALGORITHM.digest(&[])).filter(|_| committed),
+                ..main_document_meta.clone()
+            },
+            secret.len(),
+        );
+        if main_document_length > MAX_WIRE_LENGTH {
+            return Err(Error::Other(format!(
+                "secret data is too large: the main document would be {} bytes (more than the maximum of {} bytes)",
+                main_document_length, MAX_WIRE_LENGTH
+            )));
+        }
+
         // Generate identity keypair.
         let id_keypair = Keypair::generate(&mut OsRng);
 
@@ -53,7 +268,7 @@ impl Backup {
                 .expect("round-trip of ed25519 key to get around non-Copy must never fail");
             ShardSecret {
                 doc_key,
-                id_private_key: match sealed {
+                id_private_key: match self.sealed {
                     false => Some(id_private_key),
                     true => None,
                 },
@@ -61,11 +276,31 @@ impl Backup {
             .to_wire()
         };
 
-        // Construct the MainDocument.
-        let main_document_meta = MainDocumentMeta {
-            version: 0u32,
-            quorum_size,
+        // Construct SSS dealer.
+        let dealer = Dealer::new(self.quorum_size, shard_secret);
+
+        // Pre-generate the fixed set of shards (if requested).
+        let fixed_shards = (0..num_fixed_shards)
+            .map(|_| dealer.next_shard())
+            .collect::<Vec<_>>();
+        let commitments = match committed {
+            true => {
+                let (shard_root, commitments) = ShardCommitment::generate(&fixed_shards);
+                main_document_meta.shard_root = Some(shard_root);
+                commitments.into_iter().map(Some).collect()
+            }
+            false => vec![None; fixed_shards.len()],
         };
+        let roster = self.roster.map(|holders| ShardRoster {
+            entries: fixed_shards
+                .iter()
+                .zip(holders)
+                .map(|(shard, holder)| RosterEntry {
+                    shard_id: shard.id(),
+                    holder,
+                })
+                .collect(),
+        });
 
         // Encrypt the contents.
         let aead = ChaCha20Poly1305::new(&doc_key);
@@ -85,38 +320,258 @@ impl Backup {
         }
         .sign(&id_keypair);
 
-        // Construct SSS dealer.
-        let dealer = Dealer::new(quorum_size, shard_secret);
+        // Wrap the document key for the escrow recipients (if requested).
+        let escrow = match self.escrow.is_empty() {
+            true => None,
+            false => Some(
+                EscrowKey {
+                    doc_chksum: main_document.checksum(),
+                    doc_key,
+                }
+                .wrap(&self.escrow)?,
+            ),
+        };
 
         Ok(Backup {
             main_document,
             dealer,
             id_keypair,
+            fixed_shards: fixed_shards.into_iter().zip(commitments).collect(),
+            roster,
+            revocation: self.revocation,
+            language: self.language,
+            shards_issued: Cell::new(0),
+            timestamp_token: None,
+            escrow,
         })
     }
+}
 
-    // TODO: Implement this as a BackupBuilder rather than two builder init
-    //       functions.
+/// Returns the length of the wire representation of a main document with
+/// `meta` and `secret_len` bytes of (compressed) secret data. The length does
+/// not depend on any of the key material.
+fn main_document_wire_length(meta: MainDocumentMeta, secret_len: usize) -> usize {
+    let inner = MainDocumentBuilder {
+        meta,
+        nonce: ChaChaPolyNonce::default(),
+        ciphertext: vec![0; secret_len + CHACHAPOLY_TAG_LENGTH],
+    };
+    inner.to_wire().len() + Identity::wire_length()
+}
+
+pub struct Backup {
+    main_document: MainDocument,
+    dealer: Dealer,
+    id_keypair: Keypair,
+    fixed_shards: Vec<(Shard, Option<ShardCommitment>)>,
+    roster: Option<ShardRoster>,
+    revocation: Option<ShardRevocation>,
+    language: Option<CodewordLanguage>,
+    shards_issued: Cell<u32>,
+    timestamp_token: Option<Vec<u8>>,
+    escrow: Option<Vec<u8>>,
+}
+
+/// Per-shard metadata for a key shard issued by [`Backup::next_shard_with`].
+///
+/// All of the metadata is included in the signed portion of the key shard.
+#[derive(Clone, Debug, Default)]
+pub struct ShardOptions {
+    pub(crate) label: Option<String>,
+    pub(crate) holder: Option<String>,
+    pub(crate) contact: Option<String>,
+    pub(crate) note: Option<String>,
+}
+
+impl ShardOptions {
+    /// Construct an empty set of `ShardOptions`. Issuing a key shard with
+    /// these options is equivalent to [`Backup::next_shard`].
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Attach a free-form label to the key shard.
+    pub fn label<S: Into<String>>(mut self, label: S) -> Self {
+        self.label = Some(label.into());
+        self
+    }
+
+    /// Attach a hint about who will hold the key shard.
+    pub fn holder<S: Into<String>>(mut self, holder: S) -> Self {
+        self.holder = Some(holder.into());
+        self
+    }
+
+    /// Attach contact details for the holder of the key shard.
+    pub fn contact<S: Into<String>>(mut self, contact: S) -> Self {
+        self.contact = Some(contact.into());
+        self
+    }
+
+    /// Attach a free-form note to the key shard (such as where it is to be
+    /// stored).
+    pub fn note<S: Into<String>>(mut self, note: S) -> Self {
+        self.note = Some(note.into());
+        self
+    }
+}
 
+impl Backup {
     pub fn new<B: AsRef<[u8]>>(quorum_size: u32, secret: B) -> Result<Self, Error> {
-        Self::inner_new(quorum_size, secret.as_ref(), false)
+        BackupBuilder::new(quorum_size).build(secret)
     }
 
     pub fn new_sealed<B: AsRef<[u8]>>(quorum_size: u32, secret: B) -> Result<Self, Error> {
-        Self::inner_new(quorum_size, secret.as_ref(), true)
+        BackupBuilder::new(quorum_size).sealed(true).build(secret)
     }
 
     pub fn main_document(&self) -> &MainDocument {
         &self.main_document
     }
 
+    /// Returns the digital escrow copy of the key of the main document, as an
+    /// ASCII-armored age file encrypted to the recipients given to
+    /// [`BackupBuilder::escrow`] (if any). It can be used with
+    /// [`MainDocument::recover_with_escrow`] to recover the secret data without
+    /// the key shards.
+    pub fn escrow(&self) -> Option<&[u8]> {
+        self.escrow.as_deref()
+    }
+
     pub fn next_shard(&self) -> Result<KeyShard, Error> {
+        self.next_shard_with(ShardOptions::new())
+    }
+
+    /// Issue a new key shard with the per-shard metadata in `options`.
+    pub fn next_shard_with(&self, options: ShardOptions) -> Result<KeyShard, Error> {
+        let doc_chksum = self.main_document.checksum();
+        let issued = self.shards_issued.get();
+        let (shard, commitment) = if self.fixed_shards.is_empty() {
+            (self.dealer.next_shard(), None)
+        } else {
+            // Only the fixed set of shards may be issued.
+            self.fixed_shards
+                .get(issued as usize)
+                .cloned()
+                .ok_or(Error::MissingCapability(
+                    "all key shards in the fixed shard set have already been issued",
+                ))?
+        };
+        let audit = ShardAudit::generate(&self.id_keypair, &doc_chksum, &shard.id());
+        self.shards_issued.set(issued + 1);
+
         // Extend new shard.
         Ok(KeyShardBuilder {
             version: self.main_document.inner.meta.version,
-            doc_chksum: self.main_document.checksum(),
-            shard: self.dealer.next_shard(),
+            doc_chksum,
+            shard,
+            dates: self.main_document.inner.meta.dates,
+            audit: Some(audit),
+            commitment,
+            timestamp_token: self.timestamp_token.clone(),
+            roster: self.roster.clone(),
+            label: options.label,
+            holder: options.holder,
+            issuance: Some(ShardIssuance {
+                generation: 0,
+                serial: issued + 1,
+            }),
+            revocation: self.revocation.clone(),
+            contact: options.contact,
+            note: options.note,
+            language: self.language,
         }
         .sign(&self.id_keypair))
     }
+
+    /// Obtain a trusted timestamp over the main document, which will be
+    /// included in every key shard issued from this backup. This must be done
+    /// before any key shards are issued.
+    pub fn timestamp<T: Timestamper + ?Sized>(&mut self, timestamper: &T) -> Result<(), Error> {
+        if self.shards_issued.get() > 0 {
+            return Err(Error::InvariantViolation(
+                "cannot timestamp a backup after key shards have been issued",
+            ));
+        }
+        let token = timestamper.timestamp(&self.main_document.to_wire())?;
+        self.timestamp_token = Some(token);
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{
+        limits::{MAX_DECOMPRESSED_LENGTH, MAX_ROSTER_ENTRIES, MAX_WIRE_LENGTH},
+        FromWire, UntrustedQuorum,
+    };
+
+    fn recover(backup: &Backup) -> Vec<u8> {
+        let mut quorum = UntrustedQuorum::new();
+        quorum.main_document(MainDocument::from_wire(backup.main_document().to_wire()).unwrap());
+        for _ in 0..2 {
+            quorum.push_shard(backup.next_shard().unwrap());
+        }
+        quorum.validate().unwrap().recover_document().unwrap()
+    }
+
+    #[test]
+    fn backup_wire_length_limit() {
+        // Secrets of both lengths have the same main document overhead (the
+        // ciphertext length is encoded in a varuint of the same length).
+        let probe = MAX_WIRE_LENGTH / 2;
+        let backup = BackupBuilder::new(2).build(vec![0u8; probe]).unwrap();
+        let overhead = backup.main_document().to_wire().len() - probe;
+
+        let secret = vec![0u8; MAX_WIRE_LENGTH - overhead];
+        let backup = BackupBuilder::new(2).build(&secret).unwrap();
+        assert_eq!(backup.main_document().to_wire().len(), MAX_WIRE_LENGTH);
+        assert_eq!(recover(&backup), secret);
+
+        BackupBuilder::new(2)
+            .build(vec![0u8; secret.len() + 1])
+            .unwrap_err();
+    }
+
+    #[test]
+    fn backup_decompressed_length_limit() {
+        let secret = vec![0u8; MAX_DECOMPRESSED_LENGTH];
+        let backup = BackupBuilder::new(2)
+            .compression(Compression::Deflate)
+            .build(&secret)
+            .unwrap();
+        assert_eq!(recover(&backup), secret);
+
+        BackupBuilder::new(2)
+            .compression(Compression::Deflate)
+            .build(vec![0u8; MAX_DECOMPRESSED_LENGTH + 1])
+            .unwrap_err();
+    }
+
+    #[test]
+    fn backup_roster_limit() {
+        let holders = (0..MAX_ROSTER_ENTRIES)
+            .map(|idx| format!("holder {}", idx))
+            .collect::<Vec<_>>();
+        let backup = BackupBuilder::new(2)
+            .roster(holders.clone())
+            .build(b"secret data")
+            .unwrap();
+        let shard = backup.next_shard().unwrap();
+        let shard = KeyShard::from_wire(shard.to_wire()).unwrap();
+        assert_eq!(
+            shard.roster().map(|roster| roster.entries().len()),
+            Some(MAX_ROSTER_ENTRIES)
+        );
+        assert_eq!(recover(&backup), b"secret data");
+
+        let mut holders = holders;
+        holders.push("one too many".into());
+        BackupBuilder::new(2)
+            .roster(holders)
+            .build(b"secret data")
+            .unwrap_err();
+    }
 }
@@ -0,0 +1,239 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::{
+    shamir::Shard,
+    v0::{Error, KeyShard, MainDocument, ToWire, CHECKSUM_ALGORITHM},
+};
+
+use multihash::{Multihash, MultihashDigest};
+
+// Domain separation between leaves and interior nodes, as in RFC 6962.
+const MERKLE_LEAF_PREFIX: u8 = 0x00;
+const MERKLE_NODE_PREFIX: u8 = 0x01;
+
+fn leaf_hash(shard: &Shard) -> Multihash {
+    let mut bytes = vec![MERKLE_LEAF_PREFIX];
+    bytes.append(&mut shard.to_wire());
+    CHECKSUM_ALGORITHM.digest(&bytes)
+}
+
+fn node_hash(left: &Multihash, right: &Multihash) -> Multihash {
+    let mut bytes = vec![MERKLE_NODE_PREFIX];
+    bytes.extend_from_slice(left.digest());
+    bytes.extend_from_slice(right.digest());
+    CHECKSUM_ALGORITHM.digest(&bytes)
+}
+
+fn next_level(level: &[Multihash]) -> Vec<Multihash> {
+    level
+        .chunks(2)
+        .map(|pair| match pair {
+            [left, right] => node_hash(left, right),
+            // Nodes without a sibling are promoted to the next level as-is.
+            [node] => *node,
+            _ => unreachable!("chunks(2) must return one or two elements"),
+        })
+        .collect()
+}
+
+/// Proof that a key shard was part of the set of shards committed to in the
+/// main document of a backup.
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub(crate) struct ShardCommitment {
+    pub(crate) index: u32,
+    pub(crate) count: u32,
+    pub(crate) path: Vec<Multihash>,
+}
+
+impl ShardCommitment {
+    /// Compute the Merkle root over `shards`, as well as the inclusion proof
+    /// for each shard (in the same order as `shards`).
+    pub(crate) fn generate(shards: &[Shard]) -> (Multihash, Vec<ShardCommitment>) {
+        assert!(!shards.is_empty(), "must commit to at least one shard");
+
+        let mut levels = vec![shards.iter().map(leaf_hash).collect::<Vec<_>>()];
+        while levels.last().unwrap().len() > 1 {
+            let level = next_level(levels.last().unwrap());
+            levels.push(level);
+        }
+        let root = levels.last().unwrap()[0];
+
+        let commitments = (0..shards.len())
+            .map(|index| {
+                let mut idx = index;
+                let mut path = vec![];
+                for level in &levels[..levels.len() - 1] {
+                    if let Some(sibling) = level.get(idx ^ 1) {
+                        path.push(*sibling);
+                    }
+                    idx /= 2;
+                }
+                ShardCommitment {
+                    index: index as u32,
+                    count: shards.len() as u32,
+                    path,
+                }
+            })
+            .collect::<Vec<_>>();
+
+        (root, commitments)
+    }
+
+    /// Verify that `shard` is included in the set of shards with Merkle root
+    /// `root`.
+    pub(crate) fn verify(&self, shard: &Shard, root: &Multihash) -> bool {
+        if self.index >= self.count {
+            return false;
+        }
+
+        let mut hash = leaf_hash(shard);
+        let mut path = self.path.iter();
+        let (mut idx, mut count) = (self.index, self.count);
+        while count > 1 {
+            if (idx ^ 1) < count {
+                let sibling = match path.next() {
+                    Some(sibling) => sibling,
+                    None => return false,
+                };
+                hash = match idx % 2 {
+                    0 => node_hash(&hash, sibling),
+                    _ => node_hash(sibling, &hash),
+                };
+            }
+            idx /= 2;
+            count = (count + 1) / 2;
+        }
+
+        path.next().is_none() && hash == *root
+    }
+}
+
+#[cfg(test)]
+impl quickcheck::Arbitrary for ShardCommitment {
+    fn arbitrary(g: &mut quickcheck::Gen) -> Self {
+        let count = u32::arbitrary(g).saturating_add(1);
+        Self {
+            index: u32::arbitrary(g) % count,
+            count,
+            path: (0..u8::arbitrary(g) % 8)
+                .map(|_| CHECKSUM_ALGORITHM.digest(&Vec::<u8>::arbitrary(g)))
+                .collect(),
+        }
+    }
+}
+
+impl MainDocument {
+    /// Returns whether the main document contains a commitment to the set of
+    /// key shards issued when the backup was created.
+    pub fn has_shard_commitment(&self) -> bool {
+        self.inner.meta.shard_root.is_some()
+    }
+
+    /// Verify that `shard` is one of the key shards issued when the backup was
+    /// created. Shards created later through expansion were not part of the
+    /// original set and thus will not pass this check.
+    pub fn verify_shard_commitment(&self, shard: &KeyShard) -> Result<(), Error> {
+        let root = self
+            .inner
+            .meta
+            .shard_root
+            .as_ref()
+            .ok_or(Error::MissingCapability(
+                "main document does not contain a shard commitment",
+            ))?;
+        if shard.document_checksum() != self.checksum() {
+            return Err(Error::InvariantViolation(
+                "key shard does not belong to this main document",
+            ));
+        }
+        match shard.inner.commitment {
+            Some(ref commitment) if commitment.verify(&shard.inner.shard, root) => Ok(()),
+            _ => Err(Error::InvariantViolation(
+                "key shard is not part of the committed shard set",
+            )),
+        }
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::{
+        shamir::Dealer,
+        v0::{BackupBuilder, FromWire},
+    };
+
+    use quickcheck::TestResult;
+
+    #[quickcheck]
+    fn merkle_proof_roundtrip(n: u8, secret: Vec<u8>) -> TestResult {
+        if n < 1 || n > 32 {
+            return TestResult::discard();
+        }
+
+        let dealer = Dealer::new(2, secret);
+        let shards = (0..n).map(|_| dealer.next_shard()).collect::<Vec<_>>();
+        let (root, commitments) = ShardCommitment::generate(&shards);
+
+        let other_shard = dealer.next_shard();
+        TestResult::from_bool(
+            shards
+                .iter()
+                .zip(commitments.iter())
+                .all(|(shard, commitment)| commitment.verify(shard, &root))
+                && commitments
+                    .iter()
+                    .all(|commitment| !commitment.verify(&other_shard, &root)),
+        )
+    }
+
+    #[test]
+    fn backup_shard_commitment() {
+        let backup = BackupBuilder::new(2)
+            .commit_shards(3)
+            .build(b"secret data")
+            .unwrap();
+        let main_document = MainDocument::from_wire(backup.main_document().to_wire()).unwrap();
+        assert!(main_document.has_shard_commitment());
+
+        let shards = (0..3)
+            .map(|_| backup.next_shard().unwrap())
+            .map(|shard| KeyShard::from_wire(shard.to_wire()).unwrap())
+            .collect::<Vec<_>>();
+        for shard in &shards {
+            main_document.verify_shard_commitment(shard).unwrap();
+        }
+
+        // All committed shards have been issued.
+        backup.next_shard().unwrap_err();
+
+        // Expanded shards are not part of the committed set.
+        let mut quorum = crate::v0::UntrustedQuorum::new();
+        quorum.main_document(main_document.clone());
+        shards.iter().take(2).cloned().for_each(|shard| {
+            quorum.push_shard(shard);
+        });
+        let quorum = quorum.validate().unwrap();
+        assert_eq!(quorum.uncommitted_shards(), Some(vec![]));
+        for shard in quorum.extend_shards(2).unwrap() {
+            main_document.verify_shard_commitment(&shard).unwrap_err();
+        }
+    }
+}
@@ -0,0 +1,112 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{limits::MAX_DECOMPRESSED_LENGTH, Error};
+
+/// Compression algorithm applied to the secret data before encryption.
+///
+/// The algorithm used is recorded in the authenticated metadata of the main
+/// document, so it cannot be changed without detection.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub enum Compression {
+    /// Raw DEFLATE, as defined in [RFC 1951][rfc1951].
+    ///
+    /// [rfc1951]: https://tools.ietf.org/html/rfc1951
+    Deflate,
+}
+
+impl Compression {
+    // Maximum compression level supported by miniz_oxide.
+    const DEFLATE_LEVEL: u8 = 10;
+
+    pub(crate) fn id(self) -> u32 {
+        match self {
+            Self::Deflate => 1,
+        }
+    }
+
+    pub(crate) fn from_id(id: u32) -> Option<Self> {
+        match id {
+            1 => Some(Self::Deflate),
+            _ => None,
+        }
+    }
+
+    pub(crate) fn compress(self, data: &[u8]) -> Vec<u8> {
+        match self {
+            Self::Deflate => miniz_oxide::deflate::compress_to_vec(data, Self::DEFLATE_LEVEL),
+        }
+    }
+
+    pub(crate) fn decompress(self, data: &[u8]) -> Result<Vec<u8>, Error> {
+        match self {
+            // Limit the output size to protect against decompression bombs.
+            Self::Deflate => {
+                miniz_oxide::inflate::decompress_to_vec_with_limit(data, MAX_DECOMPRESSED_LENGTH)
+                    .map_err(|err| Error::Decompression(format!("{:?}", err)))
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+impl quickcheck::Arbitrary for Compression {
+    fn arbitrary(_: &mut quickcheck::Gen) -> Self {
+        Self::Deflate
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{BackupBuilder, FromWire, MainDocument, ToWire, UntrustedQuorum};
+
+    #[quickcheck]
+    fn compression_roundtrip(compression: Compression, data: Vec<u8>) {
+        let compressed = compression.compress(&data);
+        assert_eq!(compression.decompress(&compressed).unwrap(), data);
+    }
+
+    #[test]
+    fn decompression_bomb() {
+        let data = vec![0u8; MAX_DECOMPRESSED_LENGTH + 1];
+        let compressed = Compression::Deflate.compress(&data);
+        Compression::Deflate.decompress(&compressed).unwrap_err();
+    }
+
+    #[test]
+    fn compressed_backup_roundtrip() {
+        let secret = b"very repetitive secret data ".repeat(64);
+        let backup = BackupBuilder::new(2)
+            .compression(Compression::Deflate)
+            .build(&secret)
+            .unwrap();
+        let main_document = MainDocument::from_wire(backup.main_document().to_wire()).unwrap();
+        assert_eq!(main_document.compression(), Some(Compression::Deflate));
+        assert!(main_document.inner.ciphertext.len() < secret.len());
+
+        let mut quorum = UntrustedQuorum::new();
+        quorum.main_document(main_document);
+        for _ in 0..2 {
+            quorum.push_shard(backup.next_shard().unwrap());
+        }
+        let quorum = quorum.validate().unwrap();
+        assert_eq!(quorum.recover_document().unwrap(), secret);
+    }
+}
@@ -0,0 +1,610 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{qr::document_payloads, Error, Framed};
+
+/// Number of modules of blank space required around a Data Matrix symbol.
+pub(crate) const DATAMATRIX_QUIET_ZONE: usize = 1;
+
+/// Largest number of bytes which fit in a single (144x144) Data Matrix symbol.
+pub const DATAMATRIX_MAX_BYTES: usize = 1555;
+
+/// Codeword which switches from ASCII to Base 256 encodation.
+const LATCH_BASE256: u8 = 231;
+
+/// Codeword used to pad the data to the capacity of the symbol.
+const PAD: u8 = 129;
+
+/// Parameters of one of the square ECC 200 symbol sizes.
+struct SymbolSize {
+    /// Width (and height) of the symbol in modules.
+    size: usize,
+    /// Number of data codewords.
+    data: usize,
+    /// Number of error correction codewords.
+    ecc: usize,
+    /// Number of data regions along each side of the symbol.
+    regions: usize,
+    /// Number of interleaved Reed-Solomon blocks.
+    blocks: usize,
+}
+
+const fn symbol(size: usize, data: usize, ecc: usize, regions: usize, blocks: usize) -> SymbolSize {
+    SymbolSize {
+        size,
+        data,
+        ecc,
+        regions,
+        blocks,
+    }
+}
+
+/// All square ECC 200 symbol sizes, from ISO/IEC 16022 table 7.
+const SYMBOL_SIZES: &[SymbolSize] = &[
+    symbol(10, 3, 5, 1, 1),
+    symbol(12, 5, 7, 1, 1),
+    symbol(14, 8, 10, 1, 1),
+    symbol(16, 12, 12, 1, 1),
+    symbol(18, 18, 14, 1, 1),
+    symbol(20, 22, 18, 1, 1),
+    symbol(22, 30, 20, 1, 1),
+    symbol(24, 36, 24, 1, 1),
+    symbol(26, 44, 28, 1, 1),
+    symbol(32, 62, 36, 2, 1),
+    symbol(36, 86, 42, 2, 1),
+    symbol(40, 114, 48, 2, 1),
+    symbol(44, 144, 56, 2, 1),
+    symbol(48, 174, 68, 2, 1),
+    symbol(52, 204, 84, 2, 2),
+    symbol(64, 280, 112, 4, 2),
+    symbol(72, 368, 144, 4, 4),
+    symbol(80, 456, 192, 4, 4),
+    symbol(88, 576, 224, 4, 4),
+    symbol(96, 696, 272, 4, 4),
+    symbol(104, 816, 336, 4, 6),
+    symbol(120, 1050, 408, 6, 6),
+    symbol(132, 1304, 496, 6, 8),
+    symbol(144, 1558, 620, 6, 10),
+];
+
+impl SymbolSize {
+    /// Returns the width of each data region in modules.
+    fn region_size(&self) -> usize {
+        (self.size - 2 * self.regions) / self.regions
+    }
+}
+
+/// Arithmetic in GF(256) with the Data Matrix prime polynomial
+/// (x^8 + x^5 + x^3 + x^2 + 1).
+struct Galois {
+    exp: [u8; 510],
+    log: [u8; 256],
+}
+
+impl Galois {
+    fn new() -> Self {
+        let mut exp = [0u8; 510];
+        let mut log = [0u8; 256];
+        let mut x = 1u16;
+        for i in 0..255 {
+            exp[i] = x as u8;
+            exp[i + 255] = x as u8;
+            log[x as usize] = i as u8;
+            x <<= 1;
+            if x & 0x100 != 0 {
+                x ^= 0x12d;
+            }
+        }
+        Self { exp, log }
+    }
+
+    fn mul(&self, a: u8, b: u8) -> u8 {
+        if a == 0 || b == 0 {
+            return 0;
+        }
+        self.exp[self.log[a as usize] as usize + self.log[b as usize] as usize]
+    }
+
+    /// Returns the `num_ecc` Reed-Solomon error correction codewords for
+    /// `data`, using the generator polynomial with roots a^1 to a^num_ecc.
+    fn reed_solomon(&self, data: &[u8], num_ecc: usize) -> Vec<u8> {
+        // Coefficients of the generator polynomial, highest degree first.
+        let mut generator = vec![1u8];
+        for i in 1..=num_ecc {
+            let mut next = generator.clone();
+            next.push(0);
+            for (j, coeff) in generator.iter().enumerate() {
+                next[j + 1] ^= self.mul(*coeff, self.exp[i]);
+            }
+            generator = next;
+        }
+
+        let mut ecc = vec![0u8; num_ecc];
+        for byte in data {
+            let factor = byte ^ ecc[0];
+            ecc.rotate_left(1);
+            ecc[num_ecc - 1] = 0;
+            for (j, coeff) in generator[1..].iter().enumerate() {
+                ecc[j] ^= self.mul(*coeff, factor);
+            }
+        }
+        ecc
+    }
+}
+
+/// Applies the 255-state randomising algorithm to a Base 256 codeword at the
+/// (one-indexed) `position` in the data codewords.
+fn randomise_255(value: u8, position: usize) -> u8 {
+    let pseudo_random = (149 * position) % 255 + 1;
+    ((value as usize + pseudo_random) % 256) as u8
+}
+
+/// Applies the 253-state randomising algorithm to a pad codeword at the
+/// (one-indexed) `position` in the data codewords.
+fn randomise_253(value: u8, position: usize) -> u8 {
+    let pseudo_random = (149 * position) % 253 + 1;
+    let randomised = value as usize + pseudo_random;
+    (if randomised <= 254 {
+        randomised
+    } else {
+        randomised - 254
+    }) as u8
+}
+
+/// Returns the data codewords encoding `data` in Base 256 mode (with an
+/// explicit length), without padding.
+fn encode_base256(data: &[u8]) -> Vec<u8> {
+    let mut field = vec![];
+    if data.len() <= 249 {
+        field.push(data.len() as u8);
+    } else {
+        field.push((data.len() / 250 + 249) as u8);
+        field.push((data.len() % 250) as u8);
+    }
+    field.extend_from_slice(data);
+
+    std::iter::once(LATCH_BASE256)
+        .chain(
+            field
+                .into_iter()
+                .enumerate()
+                // The latch is the first codeword.
+                .map(|(idx, value)| randomise_255(value, idx + 2)),
+        )
+        .collect()
+}
+
+/// Contents of a module in the mapping matrix.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+enum Module {
+    /// The (one-indexed) bit of the (one-indexed) codeword, where bit 1 is
+    /// the most significant bit.
+    Bit(usize, u8),
+    /// Part of the fixed pattern used when a corner is left unfilled.
+    Fixed(bool),
+}
+
+/// Mapping matrix being filled by the ECC 200 placement algorithm
+/// (ISO/IEC 16022 annex F).
+struct Placement {
+    size: isize,
+    matrix: Vec<Option<Module>>,
+}
+
+impl Placement {
+    fn module(&mut self, mut row: isize, mut col: isize, chr: usize, bit: u8) {
+        if row < 0 {
+            row += self.size;
+            col += 4 - ((self.size + 4) % 8);
+        }
+        if col < 0 {
+            col += self.size;
+            row += 4 - ((self.size + 4) % 8);
+        }
+        self.matrix[(row * self.size + col) as usize] = Some(Module::Bit(chr, bit));
+    }
+
+    fn is_set(&self, row: isize, col: isize) -> bool {
+        self.matrix[(row * self.size + col) as usize].is_some()
+    }
+
+    /// Place the standard (L-shaped) arrangement of a codeword, whose last bit
+    /// is at (`row`, `col`).
+    fn utah(&mut self, row: isize, col: isize, chr: usize) {
+        let offsets = [
+            (-2, -2),
+            (-2, -1),
+            (-1, -2),
+            (-1, -1),
+            (-1, 0),
+            (0, -2),
+            (0, -1),
+            (0, 0),
+        ];
+        for (bit, (drow, dcol)) in offsets.iter().enumerate() {
+            self.module(row + drow, col + dcol, chr, bit as u8 + 1);
+        }
+    }
+
+    /// Place a codeword which is split across the corners of the matrix.
+    fn corner(&mut self, positions: [(isize, isize); 8], chr: usize) {
+        for (bit, (row, col)) in positions.iter().enumerate() {
+            self.module(*row, *col, chr, bit as u8 + 1);
+        }
+    }
+
+    /// Returns the contents of each module of the `size` by `size` mapping
+    /// matrix, in row-major order.
+    fn fill(size: usize) -> Vec<Module> {
+        let mut placement = Self {
+            size: size as isize,
+            matrix: vec![None; size * size],
+        };
+        let n = size as isize;
+
+        let (mut chr, mut row, mut col) = (1, 4, 0);
+        loop {
+            // Check for the special corner cases.
+            if row == n && col == 0 {
+                let positions = [
+                    (n - 1, 0),
+                    (n - 1, 1),
+                    (n - 1, 2),
+                    (0, n - 2),
+                    (0, n - 1),
+                    (1, n - 1),
+                    (2, n - 1),
+                    (3, n - 1),
+                ];
+                placement.corner(positions, chr);
+                chr += 1;
+            }
+            if row == n - 2 && col == 0 && n % 4 != 0 {
+                let positions = [
+                    (n - 3, 0),
+                    (n - 2, 0),
+                    (n - 1, 0),
+                    (0, n - 4),
+                    (0, n - 3),
+                    (0, n - 2),
+                    (0, n - 1),
+                    (1, n - 1),
+                ];
+                placement.corner(positions, chr);
+                chr += 1;
+            }
+            if row == n - 2 && col == 0 && n % 8 == 4 {
+                let positions = [
+                    (n - 3, 0),
+                    (n - 2, 0),
+                    (n - 1, 0),
+                    (0, n - 2),
+                    (0, n - 1),
+                    (1, n - 1),
+                    (2, n - 1),
+                    (3, n - 1),
+                ];
+                placement.corner(positions, chr);
+                chr += 1;
+            }
+            if row == n + 4 && col == 2 && n % 8 == 0 {
+                let positions = [
+                    (n - 1, 0),
+                    (n - 1, n - 1),
+                    (0, n - 3),
+                    (0, n - 2),
+                    (0, n - 1),
+                    (1, n - 3),
+                    (1, n - 2),
+                    (1, n - 1),
+                ];
+                placement.corner(positions, chr);
+                chr += 1;
+            }
+
+            // Sweep upwards diagonally.
+            loop {
+                if row < n && col >= 0 && !placement.is_set(row, col) {
+                    placement.utah(row, col, chr);
+                    chr += 1;
+                }
+                row -= 2;
+                col += 2;
+                if row < 0 || col >= n {
+                    break;
+                }
+            }
+            row += 1;
+            col += 3;
+
+            // Then sweep downwards diagonally.
+            loop {
+                if row >= 0 && col < n && !placement.is_set(row, col) {
+                    placement.utah(row, col, chr);
+                    chr += 1;
+                }
+                row += 2;
+                col -= 2;
+                if row >= n || col < 0 {
+                    break;
+                }
+            }
+            row += 3;
+            col += 1;
+
+            if row >= n && col >= n {
+                break;
+            }
+        }
+
+        // Some sizes leave the bottom-right corner unfilled, in which case it
+        // has a fixed pattern (with dark modules on the diagonal).
+        let last = size * size - 1;
+        if placement.matrix[last].is_none() {
+            placement.matrix[last] = Some(Module::Fixed(true));
+            placement.matrix[last - 1] = Some(Module::Fixed(false));
+            placement.matrix[last - size] = Some(Module::Fixed(false));
+            placement.matrix[last - size - 1] = Some(Module::Fixed(true));
+        }
+        placement
+            .matrix
+            .into_iter()
+            .map(|module| module.expect("every module must be filled"))
+            .collect()
+    }
+}
+
+/// A Data Matrix (ECC 200) symbol.
+///
+/// Data Matrix is an alternative to QR codes which is denser at small sizes
+/// (and so is better suited to some label printers), and tolerates different
+/// patterns of damage. Unlike QR codes, the amount of error correction is
+/// fixed by the size of the symbol.
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub struct DataMatrix {
+    width: usize,
+    modules: Vec<bool>,
+}
+
+impl DataMatrix {
+    /// Returns the width (and height) of the symbol in modules, not including
+    /// the quiet zone.
+    pub fn width(&self) -> usize {
+        self.width
+    }
+
+    /// Returns whether the module at (`x`, `y`) is dark, with the origin at the
+    /// top-left of the symbol.
+    pub fn is_dark(&self, x: usize, y: usize) -> bool {
+        self.modules[y * self.width + x]
+    }
+
+    /// Returns the (x, y) coordinates of every dark module, with the origin
+    /// at the top-left of the symbol (not including the quiet zone).
+    pub(crate) fn dark_modules(&self) -> impl Iterator<Item = (usize, usize)> + '_ {
+        let width = self.width;
+        self.modules
+            .iter()
+            .enumerate()
+            .filter(|(_, dark)| **dark)
+            .map(move |(idx, _)| (idx % width, idx / width))
+    }
+}
+
+/// Generate a Data Matrix symbol containing `data` in Base 256 mode, using the
+/// smallest square symbol size which can hold the data.
+pub fn binary_datamatrix<B: AsRef<[u8]>>(data: B) -> Result<DataMatrix, Error> {
+    let data = data.as_ref();
+    let mut codewords = encode_base256(data);
+    let symbol = SYMBOL_SIZES
+        .iter()
+        .find(|symbol| symbol.data >= codewords.len())
+        .ok_or_else(|| {
+            Error::Other(format!(
+                "{} bytes is too large for a single data matrix symbol",
+                data.len()
+            ))
+        })?;
+
+    // Pad the data to the capacity of the symbol.
+    if codewords.len() < symbol.data {
+        codewords.push(PAD);
+    }
+    while codewords.len() < symbol.data {
+        let position = codewords.len() + 1;
+        codewords.push(randomise_253(PAD, position));
+    }
+
+    // Compute the error correction of each (interleaved) block.
+    let galois = Galois::new();
+    let block_ecc = symbol.ecc / symbol.blocks;
+    codewords.resize(symbol.data + symbol.ecc, 0);
+    for block in 0..symbol.blocks {
+        let block_data = codewords[..symbol.data]
+            .iter()
+            .skip(block)
+            .step_by(symbol.blocks)
+            .cloned()
+            .collect::<Vec<_>>();
+        for (idx, ecc) in galois
+            .reed_solomon(&block_data, block_ecc)
+            .into_iter()
+            .enumerate()
+        {
+            codewords[symbol.data + idx * symbol.blocks + block] = ecc;
+        }
+    }
+
+    // Lay out the codewords in the data regions, surrounded by the finder and
+    // timing patterns of each region.
+    let region_size = symbol.region_size();
+    let mapping_size = symbol.regions * region_size;
+    let mapping = Placement::fill(mapping_size);
+    let mut modules = vec![false; symbol.size * symbol.size];
+    for region_row in 0..symbol.regions {
+        for region_col in 0..symbol.regions {
+            let top = region_row * (region_size + 2);
+            let left = region_col * (region_size + 2);
+            for offset in 0..region_size + 2 {
+                // Solid finder pattern along the left and bottom edges.
+                modules[(top + offset) * symbol.size + left] = true;
+                modules[(top + region_size + 1) * symbol.size + left + offset] = true;
+                // Alternating timing pattern along the top and right edges.
+                if offset % 2 == 0 {
+                    modules[top * symbol.size + left + offset] = true;
+                } else {
+                    modules[(top + offset) * symbol.size + left + region_size + 1] = true;
+                }
+            }
+        }
+    }
+    for (idx, module) in mapping.into_iter().enumerate() {
+        let (row, col) = (idx / mapping_size, idx % mapping_size);
+        let dark = match module {
+            Module::Bit(chr, bit) => codewords[chr - 1] & (0x80 >> (bit - 1)) != 0,
+            Module::Fixed(dark) => dark,
+        };
+        let row = (row / region_size) * (region_size + 2) + 1 + row % region_size;
+        let col = (col / region_size) * (region_size + 2) + 1 + col % region_size;
+        modules[row * symbol.size + col] = dark;
+    }
+
+    Ok(DataMatrix {
+        width: symbol.size,
+        modules,
+    })
+}
+
+/// Generate the Data Matrix symbols for `document`, splitting it into
+/// [`Page`](crate::v0::Page)s in the same way as
+/// [`document_qr_codes`](crate::v0::document_qr_codes) if it does not fit in
+/// a single symbol.
+pub fn document_datamatrix_codes<T: Framed>(document: &T) -> Result<Vec<DataMatrix>, Error> {
+    document_payloads(document, DATAMATRIX_MAX_BYTES)
+        .iter()
+        .map(binary_datamatrix)
+        .collect()
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{Backup, FrameEncoding, MainDocument, QrAssembler};
+
+    #[test]
+    fn reed_solomon_known() {
+        // Worked example from ISO/IEC 16022 annex O ("123456" in a 10x10
+        // symbol).
+        let ecc = Galois::new().reed_solomon(&[142, 164, 186], 5);
+        assert_eq!(ecc, vec![114, 25, 5, 88, 102]);
+    }
+
+    #[test]
+    fn placement_complete() {
+        for symbol in SYMBOL_SIZES {
+            let mapping = Placement::fill(symbol.regions * symbol.region_size());
+            let mut bits = mapping
+                .iter()
+                .filter_map(|module| match module {
+                    Module::Bit(chr, bit) => Some((*chr, *bit)),
+                    Module::Fixed(_) => None,
+                })
+                .collect::<Vec<_>>();
+            bits.sort_unstable();
+            bits.dedup();
+
+            // Every bit of every codeword is placed exactly once.
+            let num_codewords = symbol.data + symbol.ecc;
+            assert_eq!(
+                bits.len(),
+                8 * num_codewords,
+                "{}x{}",
+                symbol.size,
+                symbol.size
+            );
+            assert!(bits
+                .iter()
+                .all(|(chr, _)| (1..=num_codewords).contains(chr)));
+            assert!(mapping.len() - bits.len() <= 4);
+        }
+    }
+
+    #[test]
+    fn base256_length() {
+        assert_eq!(encode_base256(&[0xa5; 249]).len(), 1 + 1 + 249);
+        assert_eq!(encode_base256(&[0xa5; 250]).len(), 1 + 2 + 250);
+        assert_eq!(encode_base256(&[])[0], LATCH_BASE256);
+        assert_ne!(&encode_base256(&[0xa5; 4])[2..], &[0xa5; 4][..]);
+    }
+
+    #[test]
+    fn binary_datamatrix_sizing() {
+        assert_eq!(binary_datamatrix(b"").unwrap().width(), 10);
+        assert_eq!(binary_datamatrix([0xa5]).unwrap().width(), 10);
+        assert_eq!(binary_datamatrix([0xa5; 2]).unwrap().width(), 12);
+        assert_eq!(binary_datamatrix(vec![0xa5; 1555]).unwrap().width(), 144);
+        binary_datamatrix(vec![0xa5; DATAMATRIX_MAX_BYTES + 1]).unwrap_err();
+    }
+
+    #[test]
+    fn finder_pattern() {
+        for len in &[0, 40, 300, 1000] {
+            let symbol = binary_datamatrix(vec![0x5a; *len]).unwrap();
+            let width = symbol.width();
+            for i in 0..width {
+                // Solid left and bottom edges.
+                assert!(symbol.is_dark(0, i));
+                assert!(symbol.is_dark(i, width - 1));
+                // Alternating top and right edges.
+                assert_eq!(symbol.is_dark(i, 0), i % 2 == 0);
+                assert_eq!(symbol.is_dark(width - 1, i), i % 2 == 1);
+            }
+            assert_eq!(
+                symbol.dark_modules().count(),
+                symbol.modules.iter().filter(|dark| **dark).count()
+            );
+        }
+    }
+
+    #[test]
+    fn chunked_document() {
+        let secret = (0..4000).map(|i| (i * 7) as u8).collect::<Vec<_>>();
+        let backup = Backup::new(2, &secret).unwrap();
+        let main = backup.main_document();
+
+        let payloads = document_payloads(main, DATAMATRIX_MAX_BYTES);
+        assert!(payloads.len() > 1);
+        let codes = document_datamatrix_codes(main).unwrap();
+        assert_eq!(codes.len(), payloads.len());
+        assert!(codes.iter().all(|code| code.width() <= 144));
+
+        // The contents are the same pages as used for qr codes.
+        let mut assembler = QrAssembler::new();
+        for payload in payloads {
+            assembler.push(payload).unwrap();
+        }
+        assert_eq!(&assembler.assemble::<MainDocument>().unwrap(), main);
+
+        let backup = Backup::new(2, b"secret data").unwrap();
+        assert_eq!(
+            document_payloads(backup.main_document(), DATAMATRIX_MAX_BYTES),
+            vec![backup.main_document().to_framed(FrameEncoding::Raw)]
+        );
+    }
+}
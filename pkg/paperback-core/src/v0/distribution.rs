@@ -0,0 +1,544 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{
+    multihash_short_id, wire::to_multibase_zbase32, DocumentId, Error, Identity, ShardId,
+    CHECKSUM_ALGORITHM,
+};
+
+use std::{
+    fmt,
+    str::FromStr,
+    time::{Duration, SystemTime, UNIX_EPOCH},
+};
+
+use ed25519_dalek::{Keypair, PublicKey, SecretKey, Signature, Signer};
+use multihash::{Multihash, MultihashDigest};
+use signature::Signature as SignatureTrait;
+
+const DISTRIBUTION_LOG_CONTEXT: &[u8] = b"paperback-v0-distribution-log";
+
+/// First word of the header line of a distribution log.
+const DISTRIBUTION_LOG_HEADER: &str = "paperback-distribution-log-v0";
+
+fn log_error<S: Into<String>>(msg: S) -> Error {
+    Error::DistributionLog(msg.into())
+}
+
+fn decode_zbase32(field: &str, data: &str) -> Result<Vec<u8>, Error> {
+    zbase32::decode_full_bytes_str(data)
+        .map_err(|err| log_error(format!("invalid {}: {}", field, err)))
+}
+
+/// Kind of change to the distribution of key shards recorded in a
+/// [`DistributionLog`].
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Hash)]
+pub enum DistributionEvent {
+    /// Key shards were issued when the backup was created.
+    Issued,
+    /// Key shards were added to an existing backup.
+    Expanded,
+    /// A key shard (or its codewords) was printed again.
+    Reprinted,
+    /// Key shards were revoked by replacing the backup.
+    Revoked,
+}
+
+impl DistributionEvent {
+    /// Returns the name of the event, as stored in the log.
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::Issued => "issued",
+            Self::Expanded => "expanded",
+            Self::Reprinted => "reprinted",
+            Self::Revoked => "revoked",
+        }
+    }
+}
+
+impl fmt::Display for DistributionEvent {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.name())
+    }
+}
+
+impl FromStr for DistributionEvent {
+    type Err = Error;
+
+    fn from_str(name: &str) -> Result<Self, Error> {
+        [Self::Issued, Self::Expanded, Self::Reprinted, Self::Revoked]
+            .iter()
+            .copied()
+            .find(|event| event.name() == name)
+            .ok_or_else(|| log_error(format!("unknown event '{}'", name)))
+    }
+}
+
+/// Key used to sign the entries of a [`DistributionLog`].
+///
+/// The key is independent of the identity key of any backup (which is not
+/// available once a backup is sealed, or when a key shard is reprinted), so a
+/// single log can record the history of many backups. The key should be kept
+/// separately from the log -- anyone holding it can rewrite the log.
+pub struct DistributionLogKey {
+    keypair: Keypair,
+}
+
+impl DistributionLogKey {
+    /// Generate a new log key.
+    pub fn generate() -> Self {
+        Self {
+            keypair: Keypair::generate(&mut rand::thread_rng()),
+        }
+    }
+
+    /// Returns the public half of the key, which must be used to verify the
+    /// log.
+    pub fn public_key(&self) -> PublicKey {
+        self.keypair.public
+    }
+
+    /// Encode the secret key as a zbase32 string, to be stored in a key file.
+    pub fn to_zbase32(&self) -> String {
+        zbase32::encode_full_bytes(self.keypair.secret.as_bytes())
+    }
+
+    /// Decode a secret key encoded with [`to_zbase32`](Self::to_zbase32).
+    pub fn from_zbase32(data: &str) -> Result<Self, Error> {
+        let secret = SecretKey::from_bytes(&decode_zbase32("log key", data.trim())?)
+            .map_err(|err| log_error(format!("invalid log key: {}", err)))?;
+        let public = PublicKey::from(&secret);
+        Ok(Self {
+            keypair: Keypair { secret, public },
+        })
+    }
+}
+
+/// Single signed entry in a [`DistributionLog`].
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct DistributionEntry {
+    seq: u64,
+    time: u64,
+    event: DistributionEvent,
+    document_id: DocumentId,
+    shard_ids: Vec<ShardId>,
+    note: String,
+    prev: Multihash,
+    signature: Signature,
+}
+
+impl DistributionEntry {
+    /// Returns the position of the entry in the log (starting at 0).
+    pub fn seq(&self) -> u64 {
+        self.seq
+    }
+
+    /// Returns the time at which the entry was recorded.
+    pub fn time(&self) -> SystemTime {
+        UNIX_EPOCH + Duration::from_secs(self.time)
+    }
+
+    pub fn event(&self) -> DistributionEvent {
+        self.event
+    }
+
+    /// Returns the id of the main document of the backup the entry is about.
+    pub fn document_id(&self) -> &str {
+        &self.document_id
+    }
+
+    /// Returns the ids of the key shards the entry is about.
+    pub fn shard_ids(&self) -> &[ShardId] {
+        &self.shard_ids
+    }
+
+    /// Returns the free-form note attached to the entry (such as who was given
+    /// the key shards), if any.
+    pub fn note(&self) -> Option<&str> {
+        Some(self.note.as_str()).filter(|note| !note.is_empty())
+    }
+
+    /// Returns the fields of the entry as stored in the log, excluding the
+    /// signature.
+    fn unsigned_line(&self) -> String {
+        format!(
+            "{}\t{}\t{}\t{}\t{}\t{}\t{}",
+            self.seq,
+            self.time,
+            self.event,
+            self.document_id,
+            self.shard_ids.join(","),
+            self.note,
+            zbase32::encode_full_bytes(&self.prev.to_bytes()),
+        )
+    }
+
+    fn signable_bytes(&self, public_key: &PublicKey) -> Vec<u8> {
+        let mut bytes = DISTRIBUTION_LOG_CONTEXT.to_vec();
+        bytes.extend_from_slice(public_key.as_bytes());
+        bytes.extend_from_slice(self.unsigned_line().as_bytes());
+        bytes
+    }
+
+    fn to_line(&self) -> String {
+        format!(
+            "{}\t{}",
+            self.unsigned_line(),
+            zbase32::encode_full_bytes(&self.signature.to_bytes())
+        )
+    }
+
+    /// Returns the hash of the entry, which the next entry in the log refers
+    /// to.
+    fn checksum(&self) -> Multihash {
+        CHECKSUM_ALGORITHM.digest(self.to_line().as_bytes())
+    }
+
+    fn from_line(line: &str) -> Result<Self, Error> {
+        let fields = line.split('\t').collect::<Vec<_>>();
+        if fields.len() != 8 {
+            return Err(log_error(format!(
+                "entry has {} fields rather than 8",
+                fields.len()
+            )));
+        }
+        let prev = Multihash::from_bytes(&decode_zbase32("previous entry hash", fields[6])?)
+            .map_err(|err| log_error(format!("invalid previous entry hash: {}", err)))?;
+        let signature = Signature::from_bytes(&decode_zbase32("signature", fields[7])?)
+            .map_err(|err| log_error(format!("invalid signature: {}", err)))?;
+        Ok(Self {
+            seq: fields[0]
+                .parse()
+                .map_err(|err| log_error(format!("invalid sequence number: {}", err)))?,
+            time: fields[1]
+                .parse()
+                .map_err(|err| log_error(format!("invalid time: {}", err)))?,
+            event: fields[2].parse()?,
+            document_id: fields[3].into(),
+            shard_ids: fields[4]
+                .split(',')
+                .filter(|id| !id.is_empty())
+                .map(Into::into)
+                .collect(),
+            note: fields[5].into(),
+            prev,
+            signature,
+        })
+    }
+}
+
+/// Tamper-evident record of when the key shards of backups were issued,
+/// expanded, reprinted or revoked, giving the owner a history of who should
+/// hold which key shards.
+///
+/// Every entry is signed with a [`DistributionLogKey`] and includes the hash of
+/// the previous entry, so entries cannot be modified, reordered or removed from
+/// the middle of the log without the log failing to [`verify`](Self::verify).
+/// Removing entries from the end of the log can only be detected by comparing
+/// the [`head`](Self::head) of the log against a previously recorded value.
+///
+/// The log is stored as text: a header line with the public log key, followed
+/// by one tab-separated line per entry.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct DistributionLog {
+    public_key: PublicKey,
+    entries: Vec<DistributionEntry>,
+}
+
+impl DistributionLog {
+    /// Create an empty log whose entries are signed by `public_key`.
+    pub fn new(public_key: PublicKey) -> Self {
+        Self {
+            public_key,
+            entries: vec![],
+        }
+    }
+
+    /// Returns the public key which the entries of the log are signed with.
+    pub fn public_key(&self) -> PublicKey {
+        self.public_key
+    }
+
+    /// Returns a short fingerprint of the public log key, which can be recorded
+    /// elsewhere to detect the log being replaced wholesale.
+    pub fn fingerprint(&self) -> String {
+        multihash_short_id(
+            CHECKSUM_ALGORITHM.digest(self.public_key.as_bytes()),
+            Identity::FINGERPRINT_LENGTH,
+        )
+    }
+
+    pub fn entries(&self) -> &[DistributionEntry] {
+        &self.entries
+    }
+
+    /// Returns the hash the next entry in the log must refer to. For an empty
+    /// log, this is derived from the public log key.
+    fn head_checksum(&self) -> Multihash {
+        match self.entries.last() {
+            Some(entry) => entry.checksum(),
+            None => {
+                let mut bytes = DISTRIBUTION_LOG_CONTEXT.to_vec();
+                bytes.extend_from_slice(self.public_key.as_bytes());
+                CHECKSUM_ALGORITHM.digest(&bytes)
+            }
+        }
+    }
+
+    /// Returns the hash of the newest entry of the log. Recording it (such as
+    /// on a reprinted key shard) makes it possible to later detect entries
+    /// being removed from the end of the log.
+    pub fn head(&self) -> String {
+        to_multibase_zbase32(self.head_checksum().to_bytes())
+    }
+
+    /// Returns whether `head` (as returned by [`head`](Self::head)) is the
+    /// head of the log, or was the head of the log before some of its entries
+    /// were appended. If not, entries were removed from (or modified in) the
+    /// log since `head` was recorded.
+    pub fn contains_head(&self, head: &str) -> bool {
+        let mut log = Self::new(self.public_key);
+        for entry in &self.entries {
+            if log.head() == head {
+                return true;
+            }
+            log.entries.push(entry.clone());
+        }
+        log.head() == head
+    }
+
+    /// Append a new entry signed with `key`, which must be the key the log was
+    /// created with.
+    pub fn append(
+        &mut self,
+        key: &DistributionLogKey,
+        time: SystemTime,
+        event: DistributionEvent,
+        document_id: &str,
+        shard_ids: &[ShardId],
+        note: Option<&str>,
+    ) -> Result<&DistributionEntry, Error> {
+        if key.public_key() != self.public_key {
+            return Err(log_error("log key does not match the key of the log"));
+        }
+        let note = note.unwrap_or_default();
+        let fields = std::iter::once(document_id)
+            .chain(shard_ids.iter().map(String::as_str))
+            .chain(std::iter::once(note));
+        for field in fields {
+            if field.contains(&['\t', '\n', '\r'][..]) {
+                return Err(log_error(
+                    "log entries cannot contain tabs or line breaks",
+                ));
+            }
+        }
+        if std::iter::once(document_id)
+            .chain(shard_ids.iter().map(String::as_str))
+            .any(|id| id.is_empty() || id.contains(','))
+        {
+            return Err(log_error("document and shard ids cannot be empty or contain commas"));
+        }
+        let time = time
+            .duration_since(UNIX_EPOCH)
+            .map_err(|_| log_error("log entries cannot predate the UNIX epoch"))?
+            .as_secs();
+
+        let mut entry = DistributionEntry {
+            seq: self.entries.len() as u64,
+            time,
+            event,
+            document_id: document_id.into(),
+            shard_ids: shard_ids.to_vec(),
+            note: note.into(),
+            prev: self.head_checksum(),
+            // Placeholder, replaced with the real signature below.
+            signature: Signature::from_bytes(&[0; ed25519_dalek::SIGNATURE_LENGTH])
+                .expect("all-zero ed25519 signature must be well-formed"),
+        };
+        entry.signature = key.keypair.sign(&entry.signable_bytes(&self.public_key));
+        self.entries.push(entry);
+        Ok(self.entries.last().unwrap())
+    }
+
+    /// Verify the signature of every entry and the hash chain linking the
+    /// entries together. Returns an error describing the first entry which
+    /// fails to verify.
+    pub fn verify(&self) -> Result<(), Error> {
+        let mut log = Self::new(self.public_key);
+        for (idx, entry) in self.entries.iter().enumerate() {
+            if entry.seq != idx as u64 {
+                return Err(log_error(format!(
+                    "entry {} has sequence number {} -- entries were removed or reordered",
+                    idx, entry.seq
+                )));
+            }
+            if entry.prev != log.head_checksum() {
+                return Err(log_error(format!(
+                    "entry {} does not follow the previous entry -- the log was modified",
+                    idx
+                )));
+            }
+            self.public_key
+                .verify_strict(&entry.signable_bytes(&self.public_key), &entry.signature)
+                .map_err(|err| {
+                    log_error(format!("entry {} has an invalid signature: {}", idx, err))
+                })?;
+            if let Some(prev) = log.entries.last() {
+                if entry.time < prev.time {
+                    return Err(log_error(format!(
+                        "entry {} is older than the previous entry",
+                        idx
+                    )));
+                }
+            }
+            log.entries.push(entry.clone());
+        }
+        Ok(())
+    }
+
+    /// Encode the log as text, as parsed by [`from_text`](Self::from_text).
+    pub fn to_text(&self) -> String {
+        let mut text = format!(
+            "{} {}\n",
+            DISTRIBUTION_LOG_HEADER,
+            zbase32::encode_full_bytes(self.public_key.as_bytes())
+        );
+        for entry in &self.entries {
+            text.push_str(&entry.to_line());
+            text.push('\n');
+        }
+        text
+    }
+
+    /// Parse a log encoded with [`to_text`](Self::to_text). The log is not
+    /// verified -- use [`verify`](Self::verify) to check it.
+    pub fn from_text(text: &str) -> Result<Self, Error> {
+        let mut lines = text.lines().filter(|line| !line.trim().is_empty());
+        let header = lines
+            .next()
+            .ok_or_else(|| log_error("log is empty"))?
+            .split_whitespace()
+            .collect::<Vec<_>>();
+        let public_key = match header[..] {
+            [DISTRIBUTION_LOG_HEADER, public_key] => {
+                PublicKey::from_bytes(&decode_zbase32("log public key", public_key)?)
+                    .map_err(|err| log_error(format!("invalid log public key: {}", err)))?
+            }
+            _ => return Err(log_error("missing distribution log header")),
+        };
+        let entries = lines
+            .enumerate()
+            .map(|(idx, line)| {
+                DistributionEntry::from_line(line).map_err(|err| {
+                    log_error(format!("failed to parse entry {}: {}", idx, err))
+                })
+            })
+            .collect::<Result<Vec<_>, Error>>()?;
+        Ok(Self {
+            public_key,
+            entries,
+        })
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    fn example_log(key: &DistributionLogKey) -> DistributionLog {
+        let mut log = DistributionLog::new(key.public_key());
+        let time = UNIX_EPOCH + Duration::from_secs(1_600_000_000);
+        log.append(
+            key,
+            time,
+            DistributionEvent::Issued,
+            "docid123",
+            &["aaaa-bbbb".into(), "cccc-dddd".into()],
+            Some("alice, bob"),
+        )
+        .unwrap();
+        log.append(
+            key,
+            time + Duration::from_secs(60),
+            DistributionEvent::Reprinted,
+            "docid123",
+            &["aaaa-bbbb".into()],
+            None,
+        )
+        .unwrap();
+        log
+    }
+
+    #[test]
+    fn distribution_log_roundtrip() {
+        let key = DistributionLogKey::generate();
+        let log = example_log(&key);
+        log.verify().unwrap();
+
+        let log2 = DistributionLog::from_text(&log.to_text()).unwrap();
+        assert_eq!(log, log2);
+        log2.verify().unwrap();
+        assert_eq!(log.head(), log2.head());
+        assert_eq!(log2.entries()[0].note(), Some("alice, bob"));
+        assert_eq!(log2.entries()[1].note(), None);
+        assert_eq!(log2.entries()[1].event(), DistributionEvent::Reprinted);
+
+        let key2 = DistributionLogKey::from_zbase32(&key.to_zbase32()).unwrap();
+        assert_eq!(key.public_key(), key2.public_key());
+    }
+
+    #[test]
+    fn distribution_log_tampered() {
+        let key = DistributionLogKey::generate();
+        let text = example_log(&key).to_text();
+
+        // Modify an entry.
+        let modified = text.replace("alice, bob", "mallory");
+        let log = DistributionLog::from_text(&modified).unwrap();
+        log.verify().unwrap_err();
+
+        // Remove an entry from the middle.
+        let mut log = DistributionLog::from_text(&text).unwrap();
+        log.entries.remove(0);
+        log.verify().unwrap_err();
+
+        // Removing the newest entry verifies, but changes the head.
+        let full = DistributionLog::from_text(&text).unwrap();
+        let mut log = full.clone();
+        log.entries.pop();
+        log.verify().unwrap();
+        assert_ne!(log.head(), full.head());
+        assert!(full.contains_head(&log.head()));
+        assert!(!log.contains_head(&full.head()));
+    }
+
+    #[test]
+    fn distribution_log_wrong_key() {
+        let key = DistributionLogKey::generate();
+        let mut log = example_log(&key);
+        log.append(
+            &DistributionLogKey::generate(),
+            SystemTime::now(),
+            DistributionEvent::Revoked,
+            "docid123",
+            &[],
+            None,
+        )
+        .unwrap_err();
+    }
+}
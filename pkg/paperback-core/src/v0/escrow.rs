@@ -0,0 +1,231 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{ChaChaPolyKey, Error, FromWire, MainDocument, ToWire};
+
+use std::io::{Read, Write};
+
+use age::armor::{ArmoredReader, ArmoredWriter, Format};
+use multihash::Multihash;
+
+/// List of the [age] recipients (X25519 public keys, such as `age1...`) to
+/// which the key of a main document was wrapped when the backup was created.
+///
+/// The list is stored in the metadata of the main document, so it is covered
+/// by both the encryption of the secret data and the signature of the main
+/// document. Recoverers can therefore trust that a digital escrow copy of the
+/// key exists for exactly these recipients (though not that the escrow copy
+/// has not been lost).
+///
+/// [age]: https://age-encryption.org/
+#[derive(Clone, Debug, Default, Eq, PartialEq)]
+pub struct EscrowRecipients {
+    pub(crate) recipients: Vec<String>,
+}
+
+impl EscrowRecipients {
+    /// Returns the recipients, in the order they were given.
+    pub fn recipients(&self) -> &[String] {
+        &self.recipients
+    }
+}
+
+#[cfg(test)]
+impl quickcheck::Arbitrary for EscrowRecipients {
+    fn arbitrary(g: &mut quickcheck::Gen) -> Self {
+        Self {
+            recipients: Vec::<String>::arbitrary(g),
+        }
+    }
+}
+
+/// Contents of a digital escrow copy of the key of a main document, before it
+/// is encrypted to the escrow recipients.
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub(crate) struct EscrowKey {
+    pub(crate) doc_chksum: Multihash,
+    pub(crate) doc_key: ChaChaPolyKey,
+}
+
+#[cfg(test)]
+impl quickcheck::Arbitrary for EscrowKey {
+    fn arbitrary(g: &mut quickcheck::Gen) -> Self {
+        use crate::v0::CHECKSUM_ALGORITHM;
+        use multihash::MultihashDigest;
+
+        let bytes = Vec::<u8>::arbitrary(g);
+        let mut doc_key = ChaChaPolyKey::default();
+        crate::v0::arbitrary_fill_slice(g, &mut doc_key);
+        Self {
+            doc_chksum: CHECKSUM_ALGORITHM.digest(&bytes[..]),
+            doc_key,
+        }
+    }
+}
+
+fn escrow_error<E: std::fmt::Display>(err: E) -> Error {
+    Error::Escrow(err.to_string())
+}
+
+impl EscrowKey {
+    /// Encrypt the escrow key to all of the `recipients`, as an ASCII-armored
+    /// age file.
+    pub(crate) fn wrap(&self, recipients: &[age::x25519::Recipient]) -> Result<Vec<u8>, Error> {
+        let recipients = recipients
+            .iter()
+            .cloned()
+            .map(|recipient| Box::new(recipient) as Box<dyn age::Recipient>)
+            .collect();
+
+        let mut escrow = vec![];
+        let armor =
+            ArmoredWriter::wrap_output(&mut escrow, Format::AsciiArmor).map_err(escrow_error)?;
+        let mut writer = age::Encryptor::with_recipients(recipients)
+            .wrap_output(armor)
+            .map_err(escrow_error)?;
+        writer.write_all(&self.to_wire()).map_err(escrow_error)?;
+        writer
+            .finish()
+            .and_then(|armor| armor.finish())
+            .map_err(escrow_error)?;
+        Ok(escrow)
+    }
+
+    /// Decrypt an escrow file (ASCII-armored or binary) produced by
+    /// [`wrap`](Self::wrap) with `identity`.
+    pub(crate) fn unwrap(escrow: &[u8], identity: &age::x25519::Identity) -> Result<Self, Error> {
+        let decryptor =
+            match age::Decryptor::new(ArmoredReader::new(escrow)).map_err(escrow_error)? {
+                age::Decryptor::Recipients(decryptor) => decryptor,
+                _ => {
+                    return Err(Error::Escrow(
+                        "escrow file is passphrase-encrypted rather than encrypted to recipients"
+                            .into(),
+                    ))
+                }
+            };
+        let mut reader = decryptor
+            .decrypt(std::iter::once(identity as &dyn age::Identity))
+            .map_err(escrow_error)?;
+        let mut bytes = vec![];
+        reader.read_to_end(&mut bytes).map_err(escrow_error)?;
+        Ok(Self::from_wire(bytes)?)
+    }
+}
+
+impl MainDocument {
+    /// Returns the age recipients to which the key of this document was
+    /// wrapped when the backup was created, if any.
+    pub fn escrow_recipients(&self) -> Option<&EscrowRecipients> {
+        self.inner.meta.escrow.as_ref()
+    }
+
+    /// Recover the secret data of this document using a digital escrow copy of
+    /// its key (see [`Backup::escrow`]) instead of a quorum of key shards. The
+    /// escrow copy is decrypted with the age `identity` of one of the
+    /// [`escrow_recipients`](Self::escrow_recipients).
+    ///
+    /// [`Backup::escrow`]: crate::v0::Backup::escrow
+    pub fn recover_with_escrow(
+        &self,
+        escrow: &[u8],
+        identity: &age::x25519::Identity,
+    ) -> Result<Vec<u8>, Error> {
+        if self.escrow_recipients().is_none() {
+            return Err(Error::MissingCapability(
+                "main document does not have any escrow recipients",
+            ));
+        }
+        self.verify_signature()?;
+
+        let key = EscrowKey::unwrap(escrow, identity)?;
+        if key.doc_chksum != self.checksum() {
+            return Err(Error::Escrow(
+                "escrow file belongs to a different main document".into(),
+            ));
+        }
+        self.decrypt_contents(&key.doc_key)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{Backup, BackupBuilder};
+
+    use age::x25519::Identity;
+
+    #[test]
+    fn escrow_recover() {
+        let identities = vec![Identity::generate(), Identity::generate()];
+        let recipients = identities
+            .iter()
+            .map(|identity| identity.to_public())
+            .collect::<Vec<_>>();
+        let backup = BackupBuilder::new(2)
+            .escrow(recipients.clone())
+            .build(b"secret data")
+            .unwrap();
+        let main = backup.main_document();
+        let escrow = backup.escrow().unwrap();
+
+        assert_eq!(
+            main.escrow_recipients().unwrap().recipients(),
+            &recipients
+                .iter()
+                .map(|recipient| recipient.to_string())
+                .collect::<Vec<_>>()[..]
+        );
+        assert!(escrow.starts_with(b"-----BEGIN AGE ENCRYPTED FILE-----"));
+        for identity in &identities {
+            assert_eq!(
+                main.recover_with_escrow(escrow, identity).unwrap(),
+                b"secret data"
+            );
+        }
+        main.recover_with_escrow(escrow, &Identity::generate())
+            .unwrap_err();
+    }
+
+    #[test]
+    fn escrow_wrong_document() {
+        let identity = Identity::generate();
+        let backup = BackupBuilder::new(2)
+            .escrow(vec![identity.to_public()])
+            .build(b"secret data")
+            .unwrap();
+        let other = BackupBuilder::new(2)
+            .escrow(vec![identity.to_public()])
+            .build(b"secret data")
+            .unwrap();
+
+        let err = other
+            .main_document()
+            .recover_with_escrow(backup.escrow().unwrap(), &identity)
+            .unwrap_err();
+        assert!(err.to_string().contains("different main document"));
+    }
+
+    #[test]
+    fn escrow_none() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        assert!(backup.escrow().is_none());
+        assert!(backup.main_document().escrow_recipients().is_none());
+    }
+}
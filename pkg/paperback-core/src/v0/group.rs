@@ -0,0 +1,227 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{recover::group_by_backup, DocumentId, KeyShard, MainDocument, ShardId, Type};
+
+use std::collections::BTreeSet;
+
+/// Documents which belong to the same backup, as grouped by [`group_documents`].
+#[derive(Clone, Debug)]
+pub struct DocumentGroup {
+    documents: Vec<Type>,
+}
+
+impl DocumentGroup {
+    fn first(&self) -> &Type {
+        self.documents
+            .first()
+            .expect("document groups must not be empty")
+    }
+
+    /// Returns the documents in the group, in the order they were given.
+    pub fn documents(&self) -> &[Type] {
+        &self.documents
+    }
+
+    /// Returns the ID of the main document of the backup.
+    pub fn document_id(&self) -> DocumentId {
+        match self.first() {
+            Type::MainDocument(main) | Type::ForgedMainDocument(main) => main.id(),
+            Type::KeyShard(shard) | Type::ForgedKeyShard(shard) => shard.document_id(),
+        }
+    }
+
+    /// Returns the fingerprint of the identity key of the backup.
+    pub fn id_fingerprint(&self) -> String {
+        match self.first() {
+            Type::MainDocument(main) | Type::ForgedMainDocument(main) => main.id_fingerprint(),
+            Type::KeyShard(shard) | Type::ForgedKeyShard(shard) => shard.id_fingerprint(),
+        }
+    }
+
+    /// Returns the number of key shards needed to recover the backup.
+    pub fn quorum_size(&self) -> u32 {
+        match self.first() {
+            Type::MainDocument(main) | Type::ForgedMainDocument(main) => main.quorum_size(),
+            Type::KeyShard(shard) | Type::ForgedKeyShard(shard) => shard.quorum_size(),
+        }
+    }
+
+    fn main_documents(&self) -> impl Iterator<Item = &MainDocument> {
+        self.documents.iter().filter_map(|document| match document {
+            Type::MainDocument(main) => Some(main),
+            _ => None,
+        })
+    }
+
+    fn shards(&self) -> impl Iterator<Item = &KeyShard> {
+        self.documents.iter().filter_map(|document| match document {
+            Type::KeyShard(shard) => Some(shard),
+            _ => None,
+        })
+    }
+
+    /// Returns whether the group contains a (genuine) main document.
+    pub fn has_main_document(&self) -> bool {
+        self.main_documents().next().is_some()
+    }
+
+    /// Returns the IDs of the distinct (genuine) key shards in the group, in
+    /// sorted order.
+    pub fn shard_ids(&self) -> Vec<ShardId> {
+        self.shards()
+            .map(KeyShard::id)
+            .collect::<BTreeSet<_>>()
+            .into_iter()
+            .collect()
+    }
+
+    /// Returns the number of documents which are copies of another document in
+    /// the group (another main document, or a key shard with the same ID).
+    pub fn duplicates(&self) -> usize {
+        let main_documents = self.main_documents().count();
+        let shards = self.shards().count();
+        main_documents.saturating_sub(1) + shards - self.shard_ids().len()
+    }
+
+    /// Returns the number of documents in the group which have an invalid
+    /// signature. Forged documents are never counted towards the quorum.
+    pub fn forged(&self) -> usize {
+        self.documents
+            .iter()
+            .filter(|document| {
+                matches!(
+                    document,
+                    Type::ForgedMainDocument(_) | Type::ForgedKeyShard(_)
+                )
+            })
+            .count()
+    }
+
+    /// Returns the number of additional key shards needed to reach the quorum.
+    pub fn shards_needed(&self) -> u32 {
+        self.quorum_size()
+            .saturating_sub(self.shard_ids().len() as u32)
+    }
+
+    /// Returns whether the group contains enough distinct key shards to reach
+    /// the quorum.
+    pub fn has_quorum(&self) -> bool {
+        self.shards_needed() == 0
+    }
+
+    /// Returns whether the secret can be recovered from the group, which needs
+    /// both the main document and a quorum of key shards.
+    pub fn is_recoverable(&self) -> bool {
+        self.has_main_document() && self.has_quorum()
+    }
+}
+
+/// Group main documents and (decrypted) key shards from any number of backups
+/// by the backup they belong to, so that it is possible to tell which backups
+/// can be recovered from a mixed pile of documents.
+///
+/// Documents are grouped the same way that an
+/// [`UntrustedQuorum`](crate::v0::UntrustedQuorum) checks its documents are
+/// consistent. Encrypted key shards carry no information about their backup,
+/// so they must be decrypted first. The groups are sorted by document ID.
+pub fn group_documents<I, T>(documents: I) -> Vec<DocumentGroup>
+where
+    I: IntoIterator<Item = T>,
+    T: Into<Type>,
+{
+    let mut groups = group_by_backup(documents.into_iter().map(Into::into))
+        .into_iter()
+        .map(|documents| DocumentGroup { documents })
+        .collect::<Vec<_>>();
+    groups.sort_by_cached_key(|group| (group.document_id(), group.id_fingerprint()));
+    groups
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::Backup;
+
+    #[test]
+    fn group_mixed_backups() {
+        let backup1 = Backup::new(2, b"first secret").unwrap();
+        let backup2 = Backup::new(3, b"second secret").unwrap();
+        let shards1 = (0..3)
+            .map(|_| backup1.next_shard().unwrap())
+            .collect::<Vec<_>>();
+        let shards2 = (0..2)
+            .map(|_| backup2.next_shard().unwrap())
+            .collect::<Vec<_>>();
+
+        let documents = vec![
+            Type::from(shards2[0].clone()),
+            Type::from(shards1[0].clone()),
+            Type::from(backup2.main_document().clone()),
+            Type::from(shards1[2].clone()),
+            Type::from(shards2[1].clone()),
+            Type::from(shards1[0].clone()),
+        ];
+        let groups = group_documents(documents);
+        assert_eq!(groups.len(), 2);
+
+        let group1 = groups
+            .iter()
+            .find(|group| group.document_id() == backup1.main_document().id())
+            .expect("first backup should have a group");
+        assert_eq!(group1.documents().len(), 3);
+        assert_eq!(group1.quorum_size(), 2);
+        assert!(!group1.has_main_document());
+        assert_eq!(group1.shard_ids().len(), 2);
+        assert_eq!(group1.duplicates(), 1);
+        assert_eq!(group1.forged(), 0);
+        assert!(group1.has_quorum());
+        assert!(!group1.is_recoverable());
+
+        let group2 = groups
+            .iter()
+            .find(|group| group.document_id() == backup2.main_document().id())
+            .expect("second backup should have a group");
+        assert_eq!(
+            group2.id_fingerprint(),
+            backup2.main_document().id_fingerprint()
+        );
+        assert_eq!(group2.quorum_size(), 3);
+        assert!(group2.has_main_document());
+        assert_eq!(group2.shard_ids().len(), 2);
+        assert_eq!(group2.duplicates(), 0);
+        assert_eq!(group2.shards_needed(), 1);
+        assert!(!group2.has_quorum());
+        assert!(!group2.is_recoverable());
+    }
+
+    #[test]
+    fn group_recoverable_backup() {
+        let backup = Backup::new(2, b"secret").unwrap();
+        let documents = vec![
+            Type::from(backup.main_document().clone()),
+            Type::from(backup.next_shard().unwrap()),
+            Type::from(backup.next_shard().unwrap()),
+        ];
+        let groups = group_documents(documents);
+        assert_eq!(groups.len(), 1);
+        assert!(groups[0].is_recoverable());
+        assert!(group_documents(Vec::<Type>::new()).is_empty());
+    }
+}
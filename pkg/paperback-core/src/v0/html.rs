@@ -0,0 +1,211 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{
+    render::{escape_markup, qr_grid_columns},
+    svg::qr_path_data,
+    PageLayout, PaperSize, Sheet,
+};
+
+/// Stylesheet for the printed documents, with `{size}`, `{margin}`,
+/// `{qr_size}` and `{content_width}` replaced by the CSS page size and the
+/// dimensions of the layout (in millimetres).
+const STYLESHEET: &str = r#"
+    @page { size: {size}; margin: {margin}mm; }
+    body { font-family: sans-serif; font-size: 10pt; margin: 0; }
+    .sheet { page-break-after: always; break-after: page; }
+    .sheet:last-child { page-break-after: auto; break-after: auto; }
+    h1 { font-size: 18pt; }
+    .spotcheck { float: right; font-family: monospace; margin: 0; }
+    .qr-grid { width: {qr_size}mm; margin: 0 auto; font-size: 0; }
+    .qr { display: inline-block; }
+    .details, .codewords, .text-lines { font-family: monospace; list-style: none; padding: 0; }
+    .cut { margin-top: 10mm; padding-top: 2mm; border-top: 0.3mm dashed black; font-size: 8pt; }
+    .blank { min-height: 1mm; }
+    @media screen {
+        body { background: #ccc; }
+        .sheet { background: white; margin: 10mm auto; padding: {margin}mm; max-width: {content_width}mm; }
+        .blank { display: none; }
+    }
+"#;
+
+/// Render `sheets` as a single self-contained HTML document, with each sheet
+/// printed on its own page (followed by a blank page if `layout` is for duplex
+/// printing). The QR codes are embedded as inline SVG, so no external
+/// resources are needed and the file can be printed from any browser.
+pub fn sheets_to_html(title: &str, sheets: &[Sheet], layout: &PageLayout) -> String {
+    let page_size = match layout.paper {
+        PaperSize::A4 => "A4",
+        PaperSize::Letter => "letter",
+        PaperSize::A5 => "A5",
+    };
+    let qr_size = layout.grid_size_mm();
+
+    let mut html = String::new();
+    let mut write = |line: String| {
+        html.push_str(&line);
+        html.push('\n');
+    };
+    write("<!DOCTYPE html>".to_string());
+    write(r#"<html lang="en">"#.to_string());
+    write("<head>".to_string());
+    write(r#"<meta charset="utf-8">"#.to_string());
+    write(format!("<title>{}</title>", escape_markup(title)));
+    write(format!(
+        "<style>{}</style>",
+        STYLESHEET
+            .replace("{size}", page_size)
+            .replace("{margin}", &layout.margin_mm.to_string())
+            .replace("{qr_size}", &format!("{:.2}", qr_size))
+            .replace("{content_width}", &layout.content_width_mm().to_string())
+    ));
+    write("</head>".to_string());
+    write("<body>".to_string());
+
+    for sheet in sheets {
+        write(r#"<section class="sheet">"#.to_string());
+        if let Some(spotcheck) = sheet.spotcheck() {
+            write(format!(
+                r#"<p class="spotcheck">Spot-Check: {}</p>"#,
+                escape_markup(spotcheck)
+            ));
+        }
+        write(format!("<h1>{}</h1>", escape_markup(sheet.title())));
+
+        let codes = sheet.codes();
+        let size = qr_size / qr_grid_columns(codes.len()) as f64;
+        write(r#"<div class="qr-grid">"#.to_string());
+        for code in codes {
+            let modules = code.width() + 2 * code.quiet_zone();
+            write(format!(
+                r#"<svg class="qr" xmlns="http://www.w3.org/2000/svg" width="{size:.2}mm" height="{size:.2}mm" viewBox="0 0 {modules} {modules}" shape-rendering="crispEdges"><path fill="black" d="{path}"/></svg>"#,
+                size = size,
+                modules = modules,
+                path = qr_path_data(code),
+            ));
+        }
+        write("</div>".to_string());
+
+        if !sheet.text_lines().is_empty() {
+            write(r#"<ul class="text-lines">"#.to_string());
+            for line in sheet.text_lines() {
+                write(format!("<li>{}</li>", escape_markup(line)));
+            }
+            write("</ul>".to_string());
+        }
+
+        if layout.show_details {
+            write(r#"<ul class="details">"#.to_string());
+            for (name, value) in sheet.details() {
+                write(format!(
+                    "<li>{}: {}</li>",
+                    escape_markup(name),
+                    escape_markup(value)
+                ));
+            }
+            write("</ul>".to_string());
+        }
+        if layout.show_instructions {
+            for paragraph in sheet.instructions().split("\n\n") {
+                write(format!("<p>{}</p>", escape_markup(paragraph)));
+            }
+        }
+
+        if let Some(codewords) = sheet.codewords().filter(|_| layout.show_codewords) {
+            write(r#"<div class="cut">"#.to_string());
+            write("<p>Cut here to store the codewords separately.</p>".to_string());
+            write(r#"<ul class="codewords">"#.to_string());
+            for (name, value) in sheet.details().iter().take(2) {
+                write(format!(
+                    "<li>{}: {}</li>",
+                    escape_markup(name),
+                    escape_markup(value)
+                ));
+            }
+            for words in codewords.chunks(6) {
+                write(format!("<li>{}</li>", escape_markup(&words.join(" "))));
+            }
+            if let Some(checksum) = sheet.codewords_checksum() {
+                write(format!("<li>Codeword-Checksum: #{}</li>", checksum));
+            }
+            write("</ul>".to_string());
+            write("</div>".to_string());
+        }
+        write("</section>".to_string());
+        if layout.duplex {
+            write(r#"<section class="sheet blank"></section>"#.to_string());
+        }
+    }
+
+    write("</body>".to_string());
+    write("</html>".to_string());
+    html
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{codewords_checksum, Backup, QrErrorCorrection, SheetEncoding};
+
+    #[test]
+    fn backup_html() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let (shard, codewords) = backup.next_shard().unwrap().encrypt().unwrap();
+        let level = QrErrorCorrection::default();
+        let sheets = vec![
+            Sheet::main_document(backup.main_document(), level).unwrap(),
+            Sheet::key_shard(&shard, &codewords, level).unwrap(),
+        ];
+
+        let html = sheets_to_html(
+            "paperback <backup>",
+            &sheets,
+            &PageLayout::new(PaperSize::Letter),
+        );
+        assert!(html.starts_with("<!DOCTYPE html>"));
+        assert!(html.contains("<title>paperback &lt;backup&gt;</title>"));
+        assert!(html.contains("size: letter;"));
+        assert_eq!(html.matches(r#"<section class="sheet">"#).count(), 2);
+        assert_eq!(html.matches("<svg ").count(), 2);
+        assert!(html.contains(&backup.main_document().checksum_string()));
+        assert_eq!(html.matches(r#"<p class="spotcheck">"#).count(), 2);
+        assert!(html.contains(&codewords[..6].join(" ")));
+        assert!(html.contains(&format!("#{}", codewords_checksum(&codewords))));
+        // Nothing is loaded from outside the file.
+        assert!(!html.contains("src="));
+        assert!(!html.contains("<link"));
+        assert!(!html.contains("text-lines\">"));
+
+        let layout = PageLayout::new(PaperSize::A5)
+            .margin_mm(10.0)
+            .qr_size_mm(100.0)
+            .duplex(true)
+            .show_codewords(false);
+        let html = sheets_to_html("paperback", &sheets, &layout);
+        assert!(html.contains("size: A5; margin: 10mm;"));
+        assert!(html.contains("width: 100.00mm;"));
+        assert_eq!(html.matches(r#"<section class="sheet blank">"#).count(), 2);
+        assert!(!html.contains(&codewords[..6].join(" ")));
+
+        let sheets = vec![sheets[0].clone().encoding(SheetEncoding::Text)];
+        let html = sheets_to_html("paperback", &sheets, &PageLayout::default());
+        assert_eq!(html.matches("<svg ").count(), 0);
+        assert!(html.contains(&sheets[0].text_lines()[0]));
+    }
+}
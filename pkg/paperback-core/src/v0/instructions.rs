@@ -0,0 +1,421 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{CodewordLanguage, MainDocument, Sheet, SheetEncoding, Symbology};
+
+/// Details of a backup which are filled into the recovery instructions.
+struct BackupDetails<'a> {
+    id: &'a str,
+    quorum_size: u32,
+    num_shards: u32,
+    language: &'a str,
+    compressed: bool,
+}
+
+const REPOSITORY: &str = "https://github.com/cyphar/paperback";
+
+fn english(backup: &BackupDetails) -> (String, Vec<String>) {
+    let (id, k, n) = (backup.id, backup.quorum_size, backup.num_shards);
+    (
+        format!("Recovery Instructions {}", id),
+        vec![
+            format!(
+                "This page explains how to recover the secret data stored in the \
+                 paperback backup {}. No technical knowledge is needed to follow \
+                 the steps below, only a computer.",
+                id
+            ),
+            format!(
+                "The backup consists of one main document and {} key shards, \
+                 which are usually stored in different places or given to \
+                 different people. The main document together with any {} of \
+                 the key shards is enough to recover the secret data, while \
+                 fewer than {} key shards reveal nothing about it.",
+                n, k, k
+            ),
+            format!(
+                "1. Gather the main document (titled \"Main Document {}\") and at \
+                 least {} key shards (titled \"Key Shard\"). Every key shard must \
+                 have the Document-ID {}, and the main document must have the \
+                 Checksum listed above.",
+                id, k, id
+            ),
+            "2. Find the codewords of each key shard. They are printed at the \
+             bottom of the key shard, unless they were cut off to be stored \
+             separately, in which case the Document-ID and Shard-ID printed with \
+             them show which key shard they belong to."
+                .to_string(),
+            format!(
+                "3. On a computer which is not connected to the internet, install \
+                 paperback ({}) and run \"paperback raw recover OUTPUT\". It asks \
+                 for the main document and then for each key shard: scan their QR \
+                 codes, or type in their lines of text. It then asks for the \
+                 codewords of each key shard.",
+                REPOSITORY
+            ),
+            "4. The secret data is written to the file OUTPUT. Keep it safe, and \
+             destroy any copies which are no longer needed."
+                .to_string(),
+            format!(
+                "Technical details, in case paperback is no longer available: the \
+                 secret data{} is encrypted with ChaCha20-Poly1305 (RFC 8439). Its \
+                 key is split into the key shards with Shamir Secret Sharing in \
+                 GF(2^32), with a quorum of {}. Each key shard is encrypted with \
+                 ChaCha20-Poly1305, keyed by the entropy of its codewords (a BIP-39 \
+                 mnemonic, {} wordlist). Documents are signed with Ed25519, \
+                 checksummed with BLAKE2b-256, and written in z-base-32 as text. \
+                 The format is described in full in DESIGN.md, in the source code \
+                 of paperback.",
+                if backup.compressed {
+                    " (compressed with DEFLATE, RFC 1951)"
+                } else {
+                    ""
+                },
+                k,
+                backup.language
+            ),
+        ],
+    )
+}
+
+fn french(backup: &BackupDetails) -> (String, Vec<String>) {
+    let (id, k, n) = (backup.id, backup.quorum_size, backup.num_shards);
+    (
+        format!("Instructions de récupération {}", id),
+        vec![
+            format!(
+                "Cette page explique comment récupérer les données secrètes \
+                 conservées dans la sauvegarde paperback {}. Aucune connaissance \
+                 technique n'est nécessaire pour suivre les étapes ci-dessous, \
+                 seulement un ordinateur.",
+                id
+            ),
+            format!(
+                "La sauvegarde se compose d'un document principal et de {} \
+                 fragments de clé, généralement conservés dans des lieux \
+                 différents ou confiés à des personnes différentes. Le document \
+                 principal et {} fragments de clé quelconques suffisent pour \
+                 récupérer les données secrètes, tandis que moins de {} fragments \
+                 de clé ne révèlent rien à leur sujet.",
+                n, k, k
+            ),
+            format!(
+                "1. Rassemblez le document principal (intitulé « Main Document {} ») \
+                 et au moins {} fragments de clé (intitulés « Key Shard »). Chaque \
+                 fragment de clé doit porter le Document-ID {}, et le document \
+                 principal doit porter la somme de contrôle (Checksum) indiquée \
+                 ci-dessus.",
+                id, k, id
+            ),
+            "2. Retrouvez les mots de code (codewords) de chaque fragment de clé. \
+             Ils sont imprimés en bas du fragment de clé, sauf s'ils ont été \
+             découpés pour être conservés séparément ; dans ce cas, le \
+             Document-ID et le Shard-ID imprimés avec eux indiquent à quel \
+             fragment de clé ils appartiennent."
+                .to_string(),
+            format!(
+                "3. Sur un ordinateur qui n'est pas connecté à Internet, installez \
+                 paperback ({}) et exécutez « paperback raw recover SORTIE ». Le \
+                 programme demande le document principal, puis chaque fragment de \
+                 clé : scannez leurs codes QR ou saisissez leurs lignes de texte. \
+                 Il demande ensuite les mots de code de chaque fragment de clé.",
+                REPOSITORY
+            ),
+            "4. Les données secrètes sont écrites dans le fichier SORTIE. \
+             Conservez-les en lieu sûr et détruisez toute copie devenue inutile."
+                .to_string(),
+            format!(
+                "Détails techniques, au cas où paperback ne serait plus disponible : \
+                 les données secrètes{} sont chiffrées avec ChaCha20-Poly1305 \
+                 (RFC 8439). Leur clé est répartie entre les fragments de clé par \
+                 le partage de secret de Shamir dans GF(2^32), avec un quorum de \
+                 {}. Chaque fragment de clé est chiffré avec ChaCha20-Poly1305, \
+                 avec pour clé l'entropie de ses mots de code (une phrase \
+                 mnémonique BIP-39, liste de mots {}). Les documents sont signés \
+                 avec Ed25519, ont une somme de contrôle BLAKE2b-256 et sont écrits \
+                 en z-base-32 sous forme de texte. Le format est décrit en détail \
+                 dans DESIGN.md, dans le code source de paperback.",
+                if backup.compressed {
+                    " (compressées avec DEFLATE, RFC 1951)"
+                } else {
+                    ""
+                },
+                k,
+                backup.language
+            ),
+        ],
+    )
+}
+
+fn italian(backup: &BackupDetails) -> (String, Vec<String>) {
+    let (id, k, n) = (backup.id, backup.quorum_size, backup.num_shards);
+    (
+        format!("Istruzioni di recupero {}", id),
+        vec![
+            format!(
+                "Questa pagina spiega come recuperare i dati segreti conservati nel \
+                 backup paperback {}. Per seguire i passaggi qui sotto non servono \
+                 conoscenze tecniche, solo un computer.",
+                id
+            ),
+            format!(
+                "Il backup è composto da un documento principale e da {} frammenti \
+                 di chiave, di solito conservati in luoghi diversi o affidati a \
+                 persone diverse. Il documento principale insieme a {} frammenti di \
+                 chiave qualsiasi è sufficiente per recuperare i dati segreti, \
+                 mentre meno di {} frammenti di chiave non rivelano nulla su di \
+                 essi.",
+                n, k, k
+            ),
+            format!(
+                "1. Raccogliete il documento principale (intitolato \"Main Document \
+                 {}\") e almeno {} frammenti di chiave (intitolati \"Key Shard\"). \
+                 Ogni frammento di chiave deve riportare il Document-ID {}, e il \
+                 documento principale deve riportare il codice di controllo \
+                 (Checksum) indicato sopra.",
+                id, k, id
+            ),
+            "2. Trovate le parole chiave (codewords) di ogni frammento di chiave. \
+             Sono stampate in fondo al frammento di chiave, a meno che non siano \
+             state ritagliate per essere conservate separatamente; in tal caso, il \
+             Document-ID e lo Shard-ID stampati insieme a esse indicano a quale \
+             frammento di chiave appartengono."
+                .to_string(),
+            format!(
+                "3. Su un computer non connesso a Internet, installate paperback \
+                 ({}) ed eseguite \"paperback raw recover OUTPUT\". Il programma \
+                 chiede il documento principale e poi ogni frammento di chiave: \
+                 scansionatene i codici QR oppure digitatene le righe di testo. \
+                 Chiede poi le parole chiave di ogni frammento di chiave.",
+                REPOSITORY
+            ),
+            "4. I dati segreti vengono scritti nel file OUTPUT. Conservateli al \
+             sicuro e distruggete le copie non più necessarie."
+                .to_string(),
+            format!(
+                "Dettagli tecnici, nel caso in cui paperback non fosse più \
+                 disponibile: i dati segreti{} sono cifrati con ChaCha20-Poly1305 \
+                 (RFC 8439). La loro chiave è suddivisa tra i frammenti di chiave \
+                 con la condivisione di segreti di Shamir in GF(2^32), con un \
+                 quorum di {}. Ogni frammento di chiave è cifrato con \
+                 ChaCha20-Poly1305, usando come chiave l'entropia delle sue parole \
+                 chiave (una frase mnemonica BIP-39, lista di parole {}). I \
+                 documenti sono firmati con Ed25519, hanno un codice di controllo \
+                 BLAKE2b-256 e sono scritti in z-base-32 in forma testuale. Il \
+                 formato è descritto in dettaglio in DESIGN.md, nel codice \
+                 sorgente di paperback.",
+                if backup.compressed {
+                    " (compressi con DEFLATE, RFC 1951)"
+                } else {
+                    ""
+                },
+                k,
+                backup.language
+            ),
+        ],
+    )
+}
+
+fn spanish(backup: &BackupDetails) -> (String, Vec<String>) {
+    let (id, k, n) = (backup.id, backup.quorum_size, backup.num_shards);
+    (
+        format!("Instrucciones de recuperación {}", id),
+        vec![
+            format!(
+                "Esta página explica cómo recuperar los datos secretos guardados en \
+                 la copia de seguridad paperback {}. Para seguir los pasos \
+                 siguientes no se necesitan conocimientos técnicos, solo un \
+                 ordenador.",
+                id
+            ),
+            format!(
+                "La copia de seguridad consta de un documento principal y {} \
+                 fragmentos de clave, que normalmente se guardan en lugares \
+                 distintos o se entregan a personas distintas. El documento \
+                 principal junto con {} fragmentos de clave cualesquiera basta para \
+                 recuperar los datos secretos, mientras que menos de {} fragmentos \
+                 de clave no revelan nada sobre ellos.",
+                n, k, k
+            ),
+            format!(
+                "1. Reúna el documento principal (titulado «Main Document {}») y al \
+                 menos {} fragmentos de clave (titulados «Key Shard»). Todos los \
+                 fragmentos de clave deben llevar el Document-ID {}, y el documento \
+                 principal debe llevar la suma de verificación (Checksum) indicada \
+                 arriba.",
+                id, k, id
+            ),
+            "2. Busque las palabras clave (codewords) de cada fragmento de clave. \
+             Están impresas en la parte inferior del fragmento de clave, salvo que \
+             se hayan recortado para guardarlas por separado; en ese caso, el \
+             Document-ID y el Shard-ID impresos junto a ellas indican a qué \
+             fragmento de clave pertenecen."
+                .to_string(),
+            format!(
+                "3. En un ordenador que no esté conectado a Internet, instale \
+                 paperback ({}) y ejecute «paperback raw recover SALIDA». El \
+                 programa pide el documento principal y después cada fragmento de \
+                 clave: escanee sus códigos QR o escriba sus líneas de texto. \
+                 Después pide las palabras clave de cada fragmento de clave.",
+                REPOSITORY
+            ),
+            "4. Los datos secretos se escriben en el archivo SALIDA. Guárdelos en \
+             un lugar seguro y destruya las copias que ya no necesite."
+                .to_string(),
+            format!(
+                "Detalles técnicos, por si paperback ya no estuviera disponible: los \
+                 datos secretos{} están cifrados con ChaCha20-Poly1305 (RFC 8439). \
+                 Su clave se reparte entre los fragmentos de clave mediante el \
+                 esquema de compartición de secretos de Shamir en GF(2^32), con un \
+                 quórum de {}. Cada fragmento de clave está cifrado con \
+                 ChaCha20-Poly1305, usando como clave la entropía de sus palabras \
+                 clave (una frase mnemotécnica BIP-39, lista de palabras {}). Los \
+                 documentos están firmados con Ed25519, tienen una suma de \
+                 verificación BLAKE2b-256 y se escriben en z-base-32 como texto. \
+                 El formato se describe en detalle en DESIGN.md, en el código \
+                 fuente de paperback.",
+                if backup.compressed {
+                    " (comprimidos con DEFLATE, RFC 1951)"
+                } else {
+                    ""
+                },
+                k,
+                backup.language
+            ),
+        ],
+    )
+}
+
+impl Sheet {
+    /// Create a standalone page of recovery instructions for the backup of
+    /// `main`, which is printed alongside its `num_shards` key shards so that
+    /// whoever recovers the backup (possibly decades later) knows what to do.
+    ///
+    /// The instructions are written in the `language` of the codewords if they
+    /// have been translated into it (English, French, Italian and Spanish are
+    /// available) and in English otherwise, because the fonts used for PDF
+    /// output only cover Latin scripts. The page has no barcodes.
+    pub fn recovery_instructions(
+        main: &MainDocument,
+        num_shards: u32,
+        language: CodewordLanguage,
+    ) -> Self {
+        let id = main.id();
+        let backup = BackupDetails {
+            id: &id,
+            quorum_size: main.quorum_size(),
+            num_shards,
+            language: language.name(),
+            compressed: main.compression().is_some(),
+        };
+        let (title, paragraphs) = match language {
+            CodewordLanguage::French => french(&backup),
+            CodewordLanguage::Italian => italian(&backup),
+            CodewordLanguage::Spanish => spanish(&backup),
+            _ => english(&backup),
+        };
+        Self {
+            title,
+            encoding: SheetEncoding::default(),
+            symbology: Symbology::default(),
+            qr_codes: vec![],
+            datamatrix_codes: vec![],
+            aztec_codes: vec![],
+            text_lines: vec![],
+            details: vec![
+                ("Document-ID", main.id()),
+                ("Checksum", main.checksum_string()),
+                ("Quorum-Size", main.quorum_size().to_string()),
+                ("Key-Shards", num_shards.to_string()),
+                ("Key-Fingerprint", main.id_fingerprint()),
+            ],
+            codewords: None,
+            instructions: paragraphs.join("\n\n"),
+            spotcheck: None,
+        }
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{BackupBuilder, Compression, PageLayout};
+
+    #[test]
+    fn recovery_instructions() {
+        let backup = BackupBuilder::new(3).build(b"secret data").unwrap();
+        let main = backup.main_document();
+
+        let sheet = Sheet::recovery_instructions(main, 5, CodewordLanguage::English);
+        assert_eq!(
+            sheet.title(),
+            format!("Recovery Instructions {}", main.id())
+        );
+        assert!(sheet.codes().is_empty());
+        assert!(sheet.text_lines().is_empty());
+        assert!(sheet.codewords().is_none());
+        assert!(sheet.spotcheck().is_none());
+        assert!(sheet.details().contains(&("Key-Shards", "5".to_string())));
+        assert!(sheet
+            .details()
+            .contains(&("Checksum", main.checksum_string())));
+        let instructions = sheet.instructions();
+        assert!(instructions.contains("any 3 of the key shards"));
+        assert!(instructions.contains("paperback raw recover"));
+        assert!(instructions.contains("english wordlist"));
+        assert!(!instructions.contains("DEFLATE"));
+        assert_eq!(instructions.split("\n\n").count(), 7);
+
+        // Translated languages use the same layout.
+        for language in &[
+            CodewordLanguage::French,
+            CodewordLanguage::Italian,
+            CodewordLanguage::Spanish,
+        ] {
+            let translated = Sheet::recovery_instructions(main, 5, *language);
+            assert_ne!(translated.title(), sheet.title());
+            assert!(translated.title().contains(&main.id()));
+            assert_eq!(translated.details(), sheet.details());
+            assert_eq!(translated.instructions().split("\n\n").count(), 7);
+            assert!(translated.instructions().contains("paperback raw recover"));
+            assert!(translated.instructions().contains(language.name()));
+        }
+        // Other languages fall back to English.
+        let fallback = Sheet::recovery_instructions(main, 5, CodewordLanguage::Japanese);
+        assert_eq!(fallback.title(), sheet.title());
+        assert!(fallback.instructions().contains("japanese wordlist"));
+
+        let backup = BackupBuilder::new(2)
+            .compression(Compression::Deflate)
+            .build(b"secret data")
+            .unwrap();
+        let sheet =
+            Sheet::recovery_instructions(backup.main_document(), 2, CodewordLanguage::English);
+        assert!(sheet.instructions().contains("DEFLATE"));
+
+        // The page can be rendered in every format.
+        let sheets = vec![sheet];
+        let layout = PageLayout::default();
+        crate::v0::sheets_to_pdf("paperback", &sheets, &layout).unwrap();
+        let html = crate::v0::sheets_to_html("paperback", &sheets, &layout);
+        assert_eq!(html.matches("<p>").count(), 7);
+        crate::v0::sheets_to_latex("paperback", &sheets, &layout);
+        crate::v0::sheet_to_svg(&sheets[0], &layout);
+    }
+}
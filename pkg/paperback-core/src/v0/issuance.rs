@@ -0,0 +1,129 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::KeyShard;
+
+/// Signed record of when a key shard was issued.
+///
+/// Every key shard issued by a backup (or minted later by extending a quorum)
+/// carries an issuance record in its signed metadata. The generation counts
+/// how many times the set of key shards has been expanded (the shards issued
+/// when the backup was created are generation `0`), and the serial is the
+/// running count of key shards issued at the time this shard was created.
+///
+/// Since shards minted by expanding a quorum are only aware of the shards in
+/// that quorum, the records of a recovered quorum give a lower bound on the
+/// number of shards ever issued. This allows owners to detect that extra
+/// shards were minted without their knowledge.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub struct ShardIssuance {
+    pub(crate) generation: u32,
+    pub(crate) serial: u32,
+}
+
+impl ShardIssuance {
+    /// Returns the number of times the key shards had been expanded when this
+    /// shard was issued (`0` for shards issued with the original backup).
+    pub fn generation(&self) -> u32 {
+        self.generation
+    }
+
+    /// Returns the number of key shards that had been issued (including this
+    /// one) when this shard was issued.
+    pub fn serial(&self) -> u32 {
+        self.serial
+    }
+
+    /// Returns whether this shard was minted by expanding a quorum, rather
+    /// than being issued with the original backup.
+    pub fn is_expansion(&self) -> bool {
+        self.generation > 0
+    }
+}
+
+#[cfg(test)]
+impl quickcheck::Arbitrary for ShardIssuance {
+    fn arbitrary(g: &mut quickcheck::Gen) -> Self {
+        Self {
+            generation: u32::arbitrary(g),
+            serial: u32::arbitrary(g),
+        }
+    }
+}
+
+impl KeyShard {
+    /// Returns the issuance record of this key shard. Shards issued by older
+    /// versions of paperback do not have one.
+    pub fn issuance(&self) -> Option<ShardIssuance> {
+        self.inner.issuance
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{Backup, FromWire, ToWire, UntrustedQuorum};
+
+    #[test]
+    fn backup_issuance() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let shards = (0..3)
+            .map(|_| backup.next_shard().unwrap())
+            .map(|shard| KeyShard::from_wire(shard.to_wire()).unwrap())
+            .collect::<Vec<_>>();
+
+        for (idx, shard) in shards.iter().enumerate() {
+            let issuance = shard.issuance().unwrap();
+            assert_eq!(issuance.generation(), 0);
+            assert_eq!(issuance.serial(), idx as u32 + 1);
+            assert!(!issuance.is_expansion());
+        }
+    }
+
+    #[test]
+    fn extend_issuance() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let shards = (0..3)
+            .map(|_| backup.next_shard().unwrap())
+            .collect::<Vec<_>>();
+
+        let mut quorum = UntrustedQuorum::new();
+        quorum.push_shard(shards[0].clone());
+        quorum.push_shard(shards[2].clone());
+        let quorum = quorum.validate().unwrap();
+        assert_eq!(quorum.expansions(), Some(0));
+        assert_eq!(quorum.shards_issued(), Some(3));
+
+        let extra = quorum.extend_shards(2).unwrap();
+        for (idx, shard) in extra.iter().enumerate() {
+            let issuance = shard.issuance().unwrap();
+            assert_eq!(issuance.generation(), 1);
+            assert_eq!(issuance.serial(), 4 + idx as u32);
+            assert!(issuance.is_expansion());
+        }
+
+        // A quorum including an expanded shard reveals the expansion.
+        let mut quorum = UntrustedQuorum::new();
+        quorum.push_shard(shards[1].clone());
+        quorum.push_shard(extra[1].clone());
+        let quorum = quorum.validate().unwrap();
+        assert_eq!(quorum.expansions(), Some(1));
+        assert_eq!(quorum.shards_issued(), Some(5));
+    }
+}
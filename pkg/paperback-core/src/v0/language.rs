@@ -0,0 +1,252 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use bip39::Language;
+
+/// Language of the BIP-39 wordlist used for the codewords of key shards.
+///
+/// The language is recorded in each key shard (and in the unencrypted portion
+/// of each encrypted key shard), so that the codewords can be decoded without
+/// the recoverer needing to know which wordlist was used. English is the
+/// default, and is never recorded so that English shards are identical to
+/// those made by older versions of paperback.
+#[derive(Clone, Copy, Debug, Eq, PartialEq, Hash)]
+pub enum CodewordLanguage {
+    English,
+    ChineseSimplified,
+    ChineseTraditional,
+    French,
+    Italian,
+    Japanese,
+    Korean,
+    Spanish,
+}
+
+impl Default for CodewordLanguage {
+    fn default() -> Self {
+        Self::English
+    }
+}
+
+impl CodewordLanguage {
+    /// All supported languages.
+    pub const ALL: [CodewordLanguage; 8] = [
+        Self::English,
+        Self::ChineseSimplified,
+        Self::ChineseTraditional,
+        Self::French,
+        Self::Italian,
+        Self::Japanese,
+        Self::Korean,
+        Self::Spanish,
+    ];
+
+    pub(crate) fn id(self) -> u32 {
+        match self {
+            Self::English => 1,
+            Self::ChineseSimplified => 2,
+            Self::ChineseTraditional => 3,
+            Self::French => 4,
+            Self::Italian => 5,
+            Self::Japanese => 6,
+            Self::Korean => 7,
+            Self::Spanish => 8,
+        }
+    }
+
+    pub(crate) fn from_id(id: u32) -> Option<Self> {
+        Self::ALL
+            .iter()
+            .copied()
+            .find(|language| language.id() == id)
+    }
+
+    /// Returns the name of the language, as accepted by
+    /// [`from_name`](Self::from_name).
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::English => "english",
+            Self::ChineseSimplified => "chinese-simplified",
+            Self::ChineseTraditional => "chinese-traditional",
+            Self::French => "french",
+            Self::Italian => "italian",
+            Self::Japanese => "japanese",
+            Self::Korean => "korean",
+            Self::Spanish => "spanish",
+        }
+    }
+
+    /// Returns the language with the given `name` (case-insensitive), if it is
+    /// supported.
+    pub fn from_name(name: &str) -> Option<Self> {
+        let name = name.to_lowercase();
+        Self::ALL
+            .iter()
+            .copied()
+            .find(|language| language.name() == name)
+    }
+
+    /// Returns the words of the language's wordlist, ordered by the value each
+    /// word encodes (for use with [`mnemonic::expand_words_in`] and friends).
+    ///
+    /// [`mnemonic::expand_words_in`]: crate::mnemonic::expand_words_in
+    pub fn words(self) -> &'static [&'static str] {
+        // Every word in the wordlist starts with the empty prefix.
+        self.wordlist().wordlist().get_words_by_prefix("")
+    }
+
+    pub(crate) fn wordlist(self) -> Language {
+        match self {
+            Self::English => Language::English,
+            Self::ChineseSimplified => Language::ChineseSimplified,
+            Self::ChineseTraditional => Language::ChineseTraditional,
+            Self::French => Language::French,
+            Self::Italian => Language::Italian,
+            Self::Japanese => Language::Japanese,
+            Self::Korean => Language::Korean,
+            Self::Spanish => Language::Spanish,
+        }
+    }
+}
+
+#[cfg(test)]
+impl quickcheck::Arbitrary for CodewordLanguage {
+    fn arbitrary(g: &mut quickcheck::Gen) -> Self {
+        *g.choose(&Self::ALL).unwrap()
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{
+        Backup, BackupBuilder, EncryptedKeyShard, Error, FromWire, ToWire, UntrustedQuorum,
+    };
+
+    #[quickcheck]
+    fn language_id_roundtrip(language: CodewordLanguage) {
+        assert_eq!(CodewordLanguage::from_id(language.id()), Some(language));
+    }
+
+    #[quickcheck]
+    fn language_name_roundtrip(language: CodewordLanguage) {
+        assert_eq!(CodewordLanguage::from_name(language.name()), Some(language));
+    }
+
+    #[test]
+    fn unknown_language() {
+        assert_eq!(CodewordLanguage::from_id(0), None);
+        assert_eq!(CodewordLanguage::from_name("klingon"), None);
+        assert_eq!(
+            CodewordLanguage::from_name("French"),
+            Some(CodewordLanguage::French)
+        );
+    }
+
+    #[test]
+    fn language_backup_roundtrip() {
+        for language in &CodewordLanguage::ALL {
+            let backup = BackupBuilder::new(2)
+                .language(*language)
+                .build(b"secret data")
+                .unwrap();
+            let shard = backup.next_shard().unwrap();
+            assert_eq!(shard.language(), *language);
+
+            let (encrypted, codewords) = shard.encrypt().unwrap();
+            let encrypted = EncryptedKeyShard::from_wire(encrypted.to_wire()).unwrap();
+            assert_eq!(encrypted.language(), *language);
+            assert_eq!(encrypted.decrypt(&codewords).unwrap(), shard);
+        }
+    }
+
+    #[test]
+    fn english_not_recorded() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let shard = backup.next_shard().unwrap();
+        let english = BackupBuilder::new(2)
+            .language(CodewordLanguage::English)
+            .build(b"secret data")
+            .unwrap()
+            .next_shard()
+            .unwrap();
+        assert_eq!(shard.inner.language, None);
+        assert_eq!(english.inner.language, None);
+    }
+
+    #[test]
+    fn wrong_language_codewords() {
+        let backup = BackupBuilder::new(2)
+            .language(CodewordLanguage::Spanish)
+            .build(b"secret data")
+            .unwrap();
+        let (encrypted, codewords) = backup.next_shard().unwrap().encrypt().unwrap();
+        let english = Backup::new(2, b"secret data").unwrap();
+        let (_, english_codewords) = english.next_shard().unwrap().encrypt().unwrap();
+
+        assert!(encrypted.decrypt(&codewords).is_ok());
+        assert!(matches!(
+            encrypted.decrypt(&english_codewords),
+            Err(Error::WrongCodewords(_))
+        ));
+    }
+
+    #[test]
+    fn accented_codewords_normalised() {
+        use unicode_normalization::UnicodeNormalization;
+
+        for language in &[CodewordLanguage::French, CodewordLanguage::Spanish] {
+            let backup = BackupBuilder::new(2)
+                .language(*language)
+                .build(b"secret data")
+                .unwrap();
+            let shard = backup.next_shard().unwrap();
+            let (encrypted, codewords) = shard.encrypt().unwrap();
+
+            // Accented words can be typed composed or decomposed, in any case.
+            let composed = codewords
+                .iter()
+                .map(|word| word.nfc().collect::<String>().to_uppercase())
+                .collect::<Vec<_>>();
+            let decomposed = codewords
+                .iter()
+                .map(|word| word.nfkd().collect::<String>())
+                .collect::<Vec<_>>();
+            assert_eq!(encrypted.decrypt(&composed).unwrap(), shard);
+            assert_eq!(encrypted.decrypt(&decomposed).unwrap(), shard);
+        }
+    }
+
+    #[test]
+    fn expanded_shards_keep_language() {
+        let backup = BackupBuilder::new(2)
+            .language(CodewordLanguage::Japanese)
+            .build(b"secret data")
+            .unwrap();
+        let mut quorum = UntrustedQuorum::new();
+        quorum.push_shard(backup.next_shard().unwrap());
+        quorum.push_shard(backup.next_shard().unwrap());
+
+        for shard in quorum.validate().unwrap().extend_shards(2).unwrap() {
+            assert_eq!(shard.language(), CodewordLanguage::Japanese);
+            let (encrypted, codewords) = shard.encrypt().unwrap();
+            assert_eq!(encrypted.decrypt(&codewords).unwrap(), shard);
+        }
+    }
+}
@@ -0,0 +1,226 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{render::qr_grid_columns, PageLayout, PaperSize, Sheet};
+
+/// Escape `text` for inclusion in LaTeX source as ordinary text.
+fn escape_latex(text: &str) -> String {
+    let mut escaped = String::with_capacity(text.len());
+    for ch in text.chars() {
+        match ch {
+            '\\' => escaped.push_str(r"\textbackslash{}"),
+            '~' => escaped.push_str(r"\textasciitilde{}"),
+            '^' => escaped.push_str(r"\textasciicircum{}"),
+            '&' | '%' | '$' | '#' | '_' | '{' | '}' => {
+                escaped.push('\\');
+                escaped.push(ch);
+            }
+            ch => escaped.push(ch),
+        }
+    }
+    escaped
+}
+
+/// Render `sheets` as the source of a LaTeX document (requiring only the
+/// `geometry` and `tikz` packages), with each sheet on its own page (followed
+/// by a blank page if `layout` is for duplex printing).
+///
+/// The QR codes are drawn with TikZ, so the document can be compiled with any
+/// LaTeX engine and the fonts, paper and layout can be freely adjusted before
+/// printing.
+pub fn sheets_to_latex(title: &str, sheets: &[Sheet], layout: &PageLayout) -> String {
+    let paper = match layout.paper {
+        PaperSize::A4 => "a4paper",
+        PaperSize::Letter => "letterpaper",
+        PaperSize::A5 => "a5paper",
+    };
+
+    let mut latex = String::new();
+    let mut write = |line: String| {
+        latex.push_str(&line);
+        latex.push('\n');
+    };
+    write(format!(r"\documentclass[{},10pt]{{article}}", paper));
+    write(format!(
+        r"\usepackage[margin={}mm]{{geometry}}",
+        layout.margin_mm
+    ));
+    write(r"\usepackage{tikz}".to_string());
+    write(r"\pagestyle{empty}".to_string());
+    write(r"\setlength{\parindent}{0pt}".to_string());
+    write(format!(r"\title{{{}}}", escape_latex(title)));
+    write(r"\begin{document}".to_string());
+
+    for (idx, sheet) in sheets.iter().enumerate() {
+        if idx > 0 {
+            write(r"\newpage".to_string());
+            if layout.duplex {
+                write(r"\mbox{}".to_string());
+                write(r"\newpage".to_string());
+            }
+        }
+        match sheet.spotcheck() {
+            Some(spotcheck) => write(format!(
+                r"\section*{{{}\hfill\normalsize\texttt{{Spot-Check: {}}}}}",
+                escape_latex(sheet.title()),
+                escape_latex(spotcheck)
+            )),
+            None => write(format!(r"\section*{{{}}}", escape_latex(sheet.title()))),
+        }
+
+        // QR codes (or Data Matrix symbols), in a grid. Each module is a unit
+        // square, scaled to the size of the code.
+        let codes = sheet.codes();
+        let columns = qr_grid_columns(codes.len());
+        let cell_size = layout.grid_size_mm() / columns as f64;
+        write(r"\begin{center}".to_string());
+        for (idx, code) in codes.iter().enumerate() {
+            if idx > 0 && idx % columns == 0 {
+                write(r"\\".to_string());
+            }
+            let quiet_zone = code.quiet_zone();
+            let modules = code.width() + 2 * quiet_zone;
+            write(format!(
+                r"\begin{{tikzpicture}}[x={size:.4}mm,y=-{size:.4}mm]",
+                size = cell_size / modules as f64
+            ));
+            write(format!(
+                r"\path[use as bounding box] (0,0) rectangle ({m},{m});",
+                m = modules
+            ));
+            for (x, y) in code.dark_modules() {
+                write(format!(
+                    r"\fill ({},{}) rectangle +(1,1);",
+                    x + quiet_zone,
+                    y + quiet_zone
+                ));
+            }
+            // Avoid any space between the codes in a row.
+            write(r"\end{tikzpicture}%".to_string());
+        }
+        write(r"\end{center}".to_string());
+
+        for line in sheet.text_lines() {
+            write(format!(r"\texttt{{{}}}\\", escape_latex(line)));
+        }
+        if !sheet.text_lines().is_empty() {
+            write(String::new());
+        }
+
+        if layout.show_details {
+            for (name, value) in sheet.details() {
+                write(format!(
+                    r"\texttt{{{}: {}}}\\",
+                    escape_latex(name),
+                    escape_latex(value)
+                ));
+            }
+            write(String::new());
+        }
+        if layout.show_instructions {
+            write(escape_latex(sheet.instructions()));
+            write(String::new());
+        }
+
+        if let Some(codewords) = sheet.codewords().filter(|_| layout.show_codewords) {
+            write(r"\vfill".to_string());
+            write(r"\tikz\draw[dashed] (0,0) -- (\linewidth,0);\\".to_string());
+            write(
+                r"{\footnotesize Cut here to store the codewords separately.}\\[2mm]".to_string(),
+            );
+            for (name, value) in sheet.details().iter().take(2) {
+                write(format!(
+                    r"\texttt{{{}: {}}}\\",
+                    escape_latex(name),
+                    escape_latex(value)
+                ));
+            }
+            for words in codewords.chunks(6) {
+                write(format!(r"\texttt{{{}}}\\", escape_latex(&words.join(" "))));
+            }
+            if let Some(checksum) = sheet.codewords_checksum() {
+                write(format!(
+                    r"\texttt{{Codeword-Checksum: {}}}\\",
+                    escape_latex(&format!("#{}", checksum))
+                ));
+            }
+        }
+    }
+
+    if layout.duplex && !sheets.is_empty() {
+        write(r"\newpage".to_string());
+        write(r"\mbox{}".to_string());
+    }
+    write(r"\end{document}".to_string());
+    latex
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{codewords_checksum, Backup, QrErrorCorrection, SheetEncoding};
+
+    #[test]
+    fn escape_known() {
+        assert_eq!(escape_latex("paperback"), "paperback");
+        assert_eq!(
+            escape_latex(r"50% of $x_1 & {y} #2 ~^\"),
+            r"50\% of \$x\_1 \& \{y\} \#2 \textasciitilde{}\textasciicircum{}\textbackslash{}"
+        );
+    }
+
+    #[test]
+    fn backup_latex() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let (shard, codewords) = backup.next_shard().unwrap().encrypt().unwrap();
+        let level = QrErrorCorrection::default();
+        let sheets = vec![
+            Sheet::main_document(backup.main_document(), level).unwrap(),
+            Sheet::key_shard(&shard, &codewords, level).unwrap(),
+        ];
+
+        let latex = sheets_to_latex("paperback", &sheets, &PageLayout::default());
+        assert!(latex.starts_with(r"\documentclass[a4paper,10pt]{article}"));
+        assert!(latex.trim_end().ends_with(r"\end{document}"));
+        assert_eq!(latex.matches(r"\begin{tikzpicture}").count(), 2);
+        assert_eq!(latex.matches(r"\newpage").count(), 1);
+        assert!(latex.contains(&codewords[..6].join(" ")));
+        assert!(latex.contains(&format!(
+            r"\texttt{{Spot-Check: {}}}",
+            sheets[1].spotcheck().unwrap()
+        )));
+        assert!(latex.contains(&format!(r"\#{}", codewords_checksum(&codewords))));
+        // Nothing in the sheets needs escaping, so the braces are balanced.
+        assert_eq!(latex.matches('{').count(), latex.matches('}').count());
+
+        let layout = PageLayout::new(PaperSize::A5).margin_mm(12.5).duplex(true);
+        let latex = sheets_to_latex("paperback", &sheets, &layout);
+        assert!(latex.starts_with(r"\documentclass[a5paper,10pt]{article}"));
+        assert!(latex.contains(r"\usepackage[margin=12.5mm]{geometry}"));
+        assert_eq!(latex.matches(r"\newpage").count(), 3);
+        assert_eq!(latex.matches(r"\mbox{}").count(), 2);
+
+        let sheets = vec![sheets[1].clone().encoding(SheetEncoding::QrAndText)];
+        let latex = sheets_to_latex("paperback", &sheets, &PageLayout::default());
+        assert_eq!(latex.matches(r"\begin{tikzpicture}").count(), 1);
+        for line in sheets[0].text_lines() {
+            assert!(latex.contains(&format!(r"\texttt{{{}}}", line)));
+        }
+    }
+}
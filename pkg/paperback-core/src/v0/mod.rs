@@ -17,16 +17,21 @@
  */
 
 use crate::{
+    mnemonic,
     shamir::{Error as ShamirError, Shard},
     v0::wire::prefixes::*,
 };
 
-use aead::{generic_array::GenericArray, Aead, AeadCore, NewAead};
-use bip39::{Language, Mnemonic};
+use aead::{generic_array::GenericArray, Aead, AeadCore, NewAead, Payload};
+use bip39::Mnemonic;
 use chacha20poly1305::ChaCha20Poly1305;
 use ed25519_dalek::{Keypair, PublicKey, Signature, Signer};
+use hkdf::Hkdf;
 use multihash::{Code, Multihash, MultihashDigest};
 use rand::RngCore;
+use sha2::Sha256;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+use subtle::ConstantTimeEq;
 use unsigned_varint::encode as varuint_encode;
 
 pub type ShardId = String;
@@ -38,6 +43,23 @@ const CHACHAPOLY_KEY_LENGTH: usize = 32usize;
 type ChaChaPolyNonce = GenericArray<u8, <ChaCha20Poly1305 as AeadCore>::NonceSize>;
 const CHACHAPOLY_NONCE_LENGTH: usize = 12usize;
 
+const CHACHAPOLY_TAG_LENGTH: usize = 16usize;
+
+/// Short value derived from a key shard's key, which is used to tell whether
+/// the user entered the wrong codewords (as opposed to the key shard being
+/// corrupted).
+type KeyCheck = [u8; KEY_CHECK_LENGTH];
+const KEY_CHECK_LENGTH: usize = 8usize;
+const KEY_CHECK_CONTEXT: &[u8] = b"paperback-v0-key-check";
+
+fn key_check(shard_key: &ChaChaPolyKey) -> KeyCheck {
+    let mut key_check = KeyCheck::default();
+    Hkdf::<Sha256>::new(None, shard_key)
+        .expand(KEY_CHECK_CONTEXT, &mut key_check)
+        .expect("key check length must be valid for HKDF-SHA256");
+    key_check
+}
+
 #[cfg(test)]
 #[test]
 fn check_length_consts() {
@@ -45,6 +67,10 @@ fn check_length_consts() {
     // in a test...
     assert_eq!(CHACHAPOLY_KEY_LENGTH, ChaChaPolyKey::default().len());
     assert_eq!(CHACHAPOLY_NONCE_LENGTH, ChaChaPolyNonce::default().len());
+    assert_eq!(
+        CHACHAPOLY_TAG_LENGTH,
+        GenericArray::<u8, <ChaCha20Poly1305 as AeadCore>::TagSize>::default().len()
+    );
 }
 
 const CHECKSUM_ALGORITHM: Code = Code::Blake2b256;
@@ -63,15 +89,48 @@ pub enum Error {
     #[error("aead decryption cryptographic error: {}", .0)]
     AeadDecryption(aead::Error),
 
+    #[error("incorrect key shard codewords: {}", .0)]
+    WrongCodewords(String),
+
+    #[error("key shard is corrupted: {}", .0)]
+    CorruptedShard(&'static str),
+
     #[error("shamir algorithm operation: {}", .0)]
     Shamir(#[from] ShamirError),
 
     #[error("failed to decode shard secret: {}", .0)]
-    ShardSecretDecode(String),
+    ShardSecretDecode(WireError),
+
+    #[error("failed to decode document: {}", .0)]
+    WireDecode(#[from] WireError),
+
+    #[error("shard audit verification failed: {}", .0)]
+    AuditVerification(&'static str),
+
+    #[error("failed to decompress secret data: {}", .0)]
+    Decompression(String),
+
+    #[error("failed to reassemble pages: {}", .0)]
+    PageAssembly(String),
+
+    #[error("failed to generate qr code: {}", .0)]
+    QrEncode(qrcode::types::QrError),
+
+    #[error("failed to decode text lines: {}", .0)]
+    TextDecode(String),
+
+    #[error("signature verification failed: {}", .0)]
+    SignatureVerification(String),
 
     #[error("bip39 phrase failure: {}", .0)]
     Bip39(bip39::ErrorKind),
 
+    #[error("digital escrow failure: {}", .0)]
+    Escrow(String),
+
+    #[error("distribution log failure: {}", .0)]
+    DistributionLog(String),
+
     #[error("other error: {}", .0)]
     Other(String),
 }
@@ -91,6 +150,26 @@ struct Identity {
     id_signature: Signature,
 }
 
+impl Identity {
+    const FINGERPRINT_LENGTH: usize = 16;
+
+    /// Returns a short fingerprint of the identity public key, which is shared
+    /// by every document of a backup.
+    fn fingerprint(&self) -> String {
+        multihash_short_id(
+            CHECKSUM_ALGORITHM.digest(self.id_public_key.as_bytes()),
+            Self::FINGERPRINT_LENGTH,
+        )
+    }
+
+    /// Verify that `bytes` were signed by this identity.
+    fn verify(&self, bytes: &[u8]) -> Result<(), Error> {
+        self.id_public_key
+            .verify_strict(bytes, &self.id_signature)
+            .map_err(|err| Error::SignatureVerification(err.to_string()))
+    }
+}
+
 #[cfg(test)]
 impl quickcheck::Arbitrary for Identity {
     fn arbitrary(g: &mut quickcheck::Gen) -> Self {
@@ -116,6 +195,47 @@ where
     slice.as_mut().fill_with(|| T::arbitrary(g))
 }
 
+/// Optional creation and review dates attached to a document.
+///
+/// Both timestamps are stored as seconds since the UNIX epoch, and are included
+/// in the authenticated portion of each document.
+#[derive(Clone, Copy, Debug, Default, Eq, PartialEq)]
+struct DocumentDates {
+    created_at: Option<u64>,
+    review_by: Option<u64>,
+}
+
+impl DocumentDates {
+    fn to_system_time(secs: Option<u64>) -> Option<SystemTime> {
+        secs.and_then(|secs| UNIX_EPOCH.checked_add(Duration::from_secs(secs)))
+    }
+
+    fn created_at(&self) -> Option<SystemTime> {
+        Self::to_system_time(self.created_at)
+    }
+
+    fn review_by(&self) -> Option<SystemTime> {
+        Self::to_system_time(self.review_by)
+    }
+
+    fn review_due(&self, now: SystemTime) -> bool {
+        match self.review_by() {
+            Some(review_by) => now >= review_by,
+            None => false,
+        }
+    }
+}
+
+#[cfg(test)]
+impl quickcheck::Arbitrary for DocumentDates {
+    fn arbitrary(g: &mut quickcheck::Gen) -> Self {
+        Self {
+            created_at: Option::<u64>::arbitrary(g),
+            review_by: Option::<u64>::arbitrary(g),
+        }
+    }
+}
+
 #[derive(Debug)]
 struct ShardSecret {
     doc_key: ChaChaPolyKey,
@@ -127,6 +247,18 @@ struct KeyShardBuilder {
     version: u32, // must be 0 for this version
     doc_chksum: Multihash,
     shard: Shard,
+    dates: DocumentDates,
+    audit: Option<ShardAudit>,
+    commitment: Option<ShardCommitment>,
+    timestamp_token: Option<Vec<u8>>,
+    roster: Option<ShardRoster>,
+    label: Option<String>,
+    holder: Option<String>,
+    issuance: Option<ShardIssuance>,
+    revocation: Option<ShardRevocation>,
+    contact: Option<String>,
+    note: Option<String>,
+    language: Option<CodewordLanguage>,
 }
 
 impl KeyShardBuilder {
@@ -161,13 +293,40 @@ impl quickcheck::Arbitrary for KeyShardBuilder {
             version: 0,
             doc_chksum: CHECKSUM_ALGORITHM.digest(&bytes[..]),
             shard: Shard::arbitrary(g),
+            dates: DocumentDates::arbitrary(g),
+            audit: Option::<ShardAudit>::arbitrary(g),
+            commitment: Option::<ShardCommitment>::arbitrary(g),
+            timestamp_token: Option::<Vec<u8>>::arbitrary(g),
+            roster: Option::<ShardRoster>::arbitrary(g),
+            label: Option::<String>::arbitrary(g),
+            holder: Option::<String>::arbitrary(g),
+            issuance: Option::<ShardIssuance>::arbitrary(g),
+            revocation: Option::<ShardRevocation>::arbitrary(g),
+            contact: Option::<String>::arbitrary(g),
+            note: Option::<String>::arbitrary(g),
+            language: Option::<CodewordLanguage>::arbitrary(g),
         }
     }
 }
 
-const CODEWORD_LANGUAGE: Language = Language::English;
 pub type KeyShardCodewords = Vec<String>;
 
+/// Length of the checksum printed alongside the codewords of a key shard.
+pub const CODEWORDS_CHECKSUM_LENGTH: usize = 4;
+
+/// Compute the short checksum of a set of key shard codewords. It is printed
+/// on the detachable codeword section so that the codewords can be checked on
+/// their own (such as after being copied, or when the section has been stored
+/// away from its key shard), without needing to decrypt the shard.
+pub fn codewords_checksum<A: AsRef<[String]>>(codewords: A) -> String {
+    // Case does not matter, just like when decrypting.
+    let phrase = codewords.as_ref().join(" ").to_lowercase();
+    multihash_short_id(
+        CHECKSUM_ALGORITHM.digest(phrase.as_bytes()),
+        CODEWORDS_CHECKSUM_LENGTH,
+    )
+}
+
 #[derive(Clone, Debug)]
 #[cfg_attr(test, derive(PartialEq, Eq))]
 pub struct KeyShard {
@@ -198,6 +357,84 @@ impl KeyShard {
         multihash_short_id(self.document_checksum(), MainDocument::ID_LENGTH)
     }
 
+    /// Returns the checksum of the main document this key shard belongs to, in
+    /// the same format as [`MainDocument::checksum_string`].
+    pub fn document_checksum_string(&self) -> String {
+        to_multibase_zbase32(self.document_checksum().to_bytes())
+    }
+
+    /// Returns the schema version of the key shard.
+    pub fn version(&self) -> u32 {
+        self.inner.version
+    }
+
+    /// Returns the number of key shards needed to recover the document.
+    pub fn quorum_size(&self) -> u32 {
+        self.inner.shard.threshold()
+    }
+
+    /// Returns the fingerprint of the identity key which signed the key shard
+    /// (which is the same for every document of a backup).
+    pub fn id_fingerprint(&self) -> String {
+        self.identity.fingerprint()
+    }
+
+    /// Returns the time at which the backup was created, if it was recorded.
+    pub fn created_at(&self) -> Option<SystemTime> {
+        self.inner.dates.created_at()
+    }
+
+    /// Returns the time by which the backup should be re-verified, if the
+    /// creator requested one.
+    pub fn review_by(&self) -> Option<SystemTime> {
+        self.inner.dates.review_by()
+    }
+
+    /// Returns whether the review date of the backup has passed as of `now`.
+    /// Documents without a review date never need review.
+    pub fn review_due(&self, now: SystemTime) -> bool {
+        self.inner.dates.review_due(now)
+    }
+
+    /// Verify the signature of the key shard.
+    ///
+    /// This only shows that the shard was signed by the identity key embedded
+    /// in it -- to detect forged shards, the identity key must also match the
+    /// other shards and the main document (as checked when recovering).
+    pub fn verify_signature(&self) -> Result<(), Error> {
+        self.identity
+            .verify(&self.inner.signable_bytes(&self.identity.id_public_key))
+    }
+
+    /// Returns the label given to this key shard when it was issued, if any.
+    pub fn label(&self) -> Option<&str> {
+        self.inner.label.as_deref()
+    }
+
+    /// Returns the hint about who holds this key shard given when it was
+    /// issued, if any.
+    pub fn holder(&self) -> Option<&str> {
+        self.inner.holder.as_deref()
+    }
+
+    /// Returns the contact details of the holder of this key shard given when
+    /// it was issued, if any.
+    pub fn contact(&self) -> Option<&str> {
+        self.inner.contact.as_deref()
+    }
+
+    /// Returns the free-form note attached to this key shard when it was
+    /// issued, if any.
+    pub fn note(&self) -> Option<&str> {
+        self.inner.note.as_deref()
+    }
+
+    /// Returns the language of the wordlist used for the codewords of this key
+    /// shard when it is encrypted.
+    pub fn language(&self) -> CodewordLanguage {
+        self.inner.language.unwrap_or_default()
+    }
+
     pub fn encrypt(&self) -> Result<(EncryptedKeyShard, KeyShardCodewords), Error> {
         // Serialise.
         let wire_shard = self.to_wire();
@@ -208,14 +445,28 @@ impl KeyShard {
         let mut shard_nonce = ChaChaPolyNonce::default();
         rand::thread_rng().fill_bytes(&mut shard_nonce);
 
-        // Encrypt the contents.
+        // Create wrapper shard (without the ciphertext).
+        let mut shard = EncryptedKeyShard {
+            nonce: shard_nonce,
+            ciphertext: vec![],
+            key_check: Some(key_check(&shard_key)),
+            language: self.inner.language,
+        };
+
+        // Encrypt the contents. The key check and codeword language are
+        // authenticated as associated data, so they cannot be modified without
+        // detection.
         let aead = ChaCha20Poly1305::new(&shard_key);
+        let payload = Payload {
+            msg: &wire_shard,
+            aad: &shard.aad(),
+        };
         let wire_shard = aead
-            .encrypt(&shard_nonce, wire_shard.as_slice())
+            .encrypt(&shard_nonce, payload)
             .map_err(Error::AeadEncryption)?;
 
         // Convert key to a BIP-39 mnemonic.
-        let phrase = Mnemonic::from_entropy(&shard_key, CODEWORD_LANGUAGE)
+        let phrase = Mnemonic::from_entropy(&shard_key, self.language().wordlist())
             .map_err(Error::from)? // XXX: Ugly, fix this.
             .into_phrase();
         let codewords = phrase
@@ -223,12 +474,7 @@ impl KeyShard {
             .map(|s| s.to_owned())
             .collect::<Vec<_>>();
 
-        // Create wrapper shard.
-        let shard = EncryptedKeyShard {
-            nonce: shard_nonce,
-            ciphertext: wire_shard,
-        };
-
+        shard.ciphertext = wire_shard;
         Ok((shard, codewords))
     }
 }
@@ -238,26 +484,113 @@ impl KeyShard {
 pub struct EncryptedKeyShard {
     nonce: ChaChaPolyNonce,
     ciphertext: Vec<u8>,
+    key_check: Option<KeyCheck>,
+    language: Option<CodewordLanguage>,
 }
 
 impl EncryptedKeyShard {
-    pub fn decrypt<A: AsRef<[String]>>(&self, codewords: A) -> Result<KeyShard, String> {
-        // Convert BIP-39 mnemonic to a key.
-        let phrase = codewords.as_ref().join(" ").to_lowercase();
-        let mnemonic =
-            Mnemonic::from_phrase(&phrase, CODEWORD_LANGUAGE).map_err(|e| format!("{:?}", e))?; // XXX: Ugly, fix this.
+    fn aad(&self) -> Vec<u8> {
+        self.aad_with(self.key_check)
+    }
+
+    /// Returns the associated data of the shard, with `key_check` in place of
+    /// the key check value stored in the shard.
+    fn aad_with(&self, key_check: Option<KeyCheck>) -> Vec<u8> {
+        let mut bytes = key_check.map(|c| c.to_vec()).unwrap_or_default();
+
+        // The language is only included if it was recorded, so that the
+        // associated data of older shards is unchanged.
+        if let Some(language) = self.language {
+            varuint_encode::u64(PREFIX_CODEWORD_LANGUAGE, &mut varuint_encode::u64_buffer())
+                .iter()
+                .chain(varuint_encode::u32(
+                    language.id(),
+                    &mut varuint_encode::u32_buffer(),
+                ))
+                .for_each(|b| bytes.push(*b));
+        }
+        bytes
+    }
+
+    /// Returns the language of the wordlist used for the codewords of this key
+    /// shard.
+    pub fn language(&self) -> CodewordLanguage {
+        self.language.unwrap_or_default()
+    }
+
+    /// Decrypt the key shard using the given `codewords`.
+    ///
+    /// If the shard has a key check value (all shards created by this version
+    /// of paperback do), mistyped codewords result in
+    /// [`Error::WrongCodewords`] while damaged shard data results in
+    /// [`Error::CorruptedShard`]. A damaged key check value on its own does not
+    /// stop the correct codewords from decrypting the shard.
+    pub fn decrypt<A: AsRef<[String]>>(&self, codewords: A) -> Result<KeyShard, Error> {
+        // Convert BIP-39 mnemonic to a key. Invalid words or an invalid BIP-39
+        // checksum can only be caused by mistyped codewords. The words are
+        // normalised and looked up in the wordlist first, so that accented
+        // words match no matter how they were typed.
+        let wordlist = self.language().words();
+        let words = mnemonic::normalize_phrase(&codewords.as_ref().join(" "))
+            .iter()
+            .enumerate()
+            .map(|(index, word)| {
+                mnemonic::word_index_in(wordlist, word)
+                    .map(|word_index| wordlist[word_index])
+                    .ok_or_else(|| {
+                        Error::WrongCodewords(format!(
+                            "word {} ({:?}) is not in the {} wordlist",
+                            index + 1,
+                            word,
+                            self.language().name()
+                        ))
+                    })
+            })
+            .collect::<Result<Vec<_>, _>>()?;
+        let mnemonic = Mnemonic::from_phrase(&words.join(" "), self.language().wordlist())
+            .map_err(|err| Error::WrongCodewords(err.to_string()))?;
 
         let mut shard_key = ChaChaPolyKey::default();
+        if mnemonic.entropy().len() != shard_key.len() {
+            return Err(Error::WrongCodewords(format!(
+                "expected {} codewords",
+                shard_key.len() * 3 / 4
+            )));
+        }
         shard_key.copy_from_slice(mnemonic.entropy());
 
+        // The key check value is not authenticated on its own, so a mismatch
+        // could also mean that it was damaged. Since it is part of the
+        // associated data, decrypting with the key check derived from the
+        // codewords only succeeds if the codewords are correct.
+        let derived_key_check = key_check(&shard_key);
+        let key_check_matches = self
+            .key_check
+            .map(|expected| bool::from(derived_key_check[..].ct_eq(&expected[..])));
+        let aad = match key_check_matches {
+            Some(false) => self.aad_with(Some(derived_key_check)),
+            _ => self.aad(),
+        };
+
         // Decrypt the contents.
         let aead = ChaCha20Poly1305::new(&shard_key);
-        let wire_shard = aead
-            .decrypt(&self.nonce, self.ciphertext.as_slice())
-            .map_err(|err| format!("{:?}", err))?; // XXX: Ugly, fix this.
+        let payload = Payload {
+            msg: &self.ciphertext,
+            aad: &aad,
+        };
+        let wire_shard =
+            aead.decrypt(&self.nonce, payload)
+                .map_err(|err| match key_check_matches {
+                    // The codewords were correct, so the shard must be damaged.
+                    Some(true) => Error::CorruptedShard("key shard data failed authentication"),
+                    Some(false) => {
+                        Error::WrongCodewords("codewords do not match this key shard".into())
+                    }
+                    None => Error::AeadDecryption(err),
+                })?;
 
         // Deserialise.
-        KeyShard::from_wire(wire_shard)
+        KeyShard::from_wire(wire_shard).map_err(Error::from)
     }
 }
 
@@ -267,7 +600,20 @@ impl quickcheck::Arbitrary for EncryptedKeyShard {
         let mut nonce = ChaChaPolyNonce::default();
         arbitrary_fill_slice(g, &mut nonce);
         let ciphertext = Vec::<u8>::arbitrary(g);
-        Self { nonce, ciphertext }
+        let key_check = match bool::arbitrary(g) {
+            true => {
+                let mut key_check = KeyCheck::default();
+                arbitrary_fill_slice(g, &mut key_check);
+                Some(key_check)
+            }
+            false => None,
+        };
+        Self {
+            nonce,
+            ciphertext,
+            key_check,
+            language: Option::<CodewordLanguage>::arbitrary(g),
+        }
     }
 }
 
@@ -275,6 +621,10 @@ impl quickcheck::Arbitrary for EncryptedKeyShard {
 struct MainDocumentMeta {
     version: u32, // must be 0 for this version
     quorum_size: u32,
+    dates: DocumentDates,
+    shard_root: Option<Multihash>,
+    compression: Option<Compression>,
+    escrow: Option<EscrowRecipients>,
 }
 
 impl MainDocumentMeta {
@@ -296,6 +646,13 @@ impl quickcheck::Arbitrary for MainDocumentMeta {
         Self {
             version: 0,
             quorum_size: u32::arbitrary(g),
+            dates: DocumentDates::arbitrary(g),
+            shard_root: match bool::arbitrary(g) {
+                true => Some(CHECKSUM_ALGORITHM.digest(&Vec::<u8>::arbitrary(g))),
+                false => None,
+            },
+            compression: Option::<Compression>::arbitrary(g),
+            escrow: Option::<EscrowRecipients>::arbitrary(g),
         }
     }
 }
@@ -379,6 +736,70 @@ impl MainDocument {
     pub fn quorum_size(&self) -> u32 {
         self.inner.meta.quorum_size
     }
+
+    /// Returns the schema version of the main document.
+    pub fn version(&self) -> u32 {
+        self.inner.meta.version
+    }
+
+    /// Returns the fingerprint of the identity key which signed the main
+    /// document (which is the same for every document of a backup).
+    pub fn id_fingerprint(&self) -> String {
+        self.identity.fingerprint()
+    }
+
+    /// Returns the time at which the backup was created, if it was recorded.
+    pub fn created_at(&self) -> Option<SystemTime> {
+        self.inner.meta.dates.created_at()
+    }
+
+    /// Returns the time by which the backup should be re-verified, if the
+    /// creator requested one.
+    pub fn review_by(&self) -> Option<SystemTime> {
+        self.inner.meta.dates.review_by()
+    }
+
+    /// Returns whether the review date of the backup has passed as of `now`.
+    /// Documents without a review date never need review.
+    pub fn review_due(&self, now: SystemTime) -> bool {
+        self.inner.meta.dates.review_due(now)
+    }
+
+    /// Verify the signature of the main document.
+    ///
+    /// This only shows that the document was signed by the identity key
+    /// embedded in it -- to detect forged documents, the identity key must
+    /// also match the key shards (as checked when recovering).
+    pub fn verify_signature(&self) -> Result<(), Error> {
+        self.identity
+            .verify(&self.inner.signable_bytes(&self.identity.id_public_key))
+    }
+
+    /// Returns the compression algorithm applied to the secret data before it
+    /// was encrypted, if any.
+    pub fn compression(&self) -> Option<Compression> {
+        self.inner.meta.compression
+    }
+
+    /// Decrypt (and decompress) the secret data using the document key. The
+    /// caller must have already checked that the identity of the document is
+    /// trusted.
+    fn decrypt_contents(&self, doc_key: &ChaChaPolyKey) -> Result<Vec<u8>, Error> {
+        let aead = ChaCha20Poly1305::new(doc_key);
+        let payload = Payload {
+            msg: &self.inner.ciphertext,
+            aad: &self.inner.meta.aad(&self.identity.id_public_key),
+        };
+        let plaintext = aead
+            .decrypt(&self.inner.nonce, payload)
+            .map_err(Error::AeadDecryption)?;
+
+        // Decompress the contents (if necessary).
+        match self.compression() {
+            Some(compression) => compression.decompress(&plaintext),
+            None => Ok(plaintext),
+        }
+    }
 }
 
 #[cfg(test)]
@@ -398,6 +819,101 @@ pub use recover::*;
 mod backup;
 pub use backup::*;
 
+mod audit;
+pub use audit::AuditResponse;
+use audit::ShardAudit;
+
+mod commitment;
+use commitment::ShardCommitment;
+
+mod timestamp;
+pub use timestamp::Timestamper;
+
+mod compression;
+pub use compression::Compression;
+
+mod language;
+pub use language::CodewordLanguage;
+
+mod roster;
+pub use roster::{RosterEntry, ShardRoster};
+
+mod escrow;
+use escrow::EscrowKey;
+pub use escrow::EscrowRecipients;
+
+mod distribution;
+pub use distribution::{DistributionEntry, DistributionEvent, DistributionLog, DistributionLogKey};
+
+mod package;
+pub use package::WorkPackage;
+
+mod plumbing;
+pub use plumbing::{combine_secret, new_packet_key, open_packet, seal_packet, split_secret};
+
+mod session;
+pub use session::RecoverySession;
+
+mod page;
+pub use page::{paginate, Page, PageSet};
+
+mod issuance;
+pub use issuance::ShardIssuance;
+
+mod revocation;
+pub use revocation::ShardRevocation;
+
+mod qr;
+pub use qr::{binary_qr, document_qr, document_qr_codes, QrAssembler, QrErrorCorrection};
+
+mod datamatrix;
+pub use datamatrix::{
+    binary_datamatrix, document_datamatrix_codes, DataMatrix, DATAMATRIX_MAX_BYTES,
+};
+
+mod aztec;
+pub use aztec::{binary_aztec, document_aztec_codes, AztecCode, AZTEC_MAX_BYTES};
+
+mod ocrfont;
+
+mod render;
+pub use render::{Barcode, PageLayout, PaperSize, Sheet, SheetEncoding, Symbology};
+
+// Only adds Sheet::recovery_instructions.
+mod instructions;
+
+mod group;
+pub use group::{group_documents, DocumentGroup};
+
+mod scan;
+pub use scan::{ScanSession, ScanStatus, ScanTally};
+
+mod text;
+pub use text::{document_text_lines, parse_text_document, parse_text_lines, text_lines};
+
+mod selftest;
+pub use selftest::selftest;
+
+mod simulate;
+pub use simulate::{recommend, simulate, HolderRisk, Recommendation, SimulationResult};
+
+mod verify;
+pub use verify::{
+    spotcheck_digits, spotcheck_matches, AnyDocument, CheckResult, Verification, SPOTCHECK_DIGITS,
+};
+
+mod pdf;
+pub use pdf::{pdf_supports_language, sheets_to_pdf, sheets_to_pdf_dated};
+
+mod svg;
+pub use svg::sheet_to_svg;
+
+mod html;
+pub use html::sheets_to_html;
+
+mod latex;
+pub use latex::sheets_to_latex;
+
 #[cfg(test)]
 mod test {
     use super::*;
@@ -453,6 +969,55 @@ mod test {
         TestResult::from_bool(recovered_secret == secret)
     }
 
+    #[quickcheck]
+    fn paperback_recovered_checksum(secret: Vec<u8>) {
+        let backup = Backup::new(2, &secret).unwrap();
+        let mut quorum = UntrustedQuorum::new();
+        quorum.main_document(backup.main_document().clone());
+        for _ in 0..2 {
+            quorum.push_shard(backup.next_shard().unwrap());
+        }
+        let quorum = quorum.validate().unwrap();
+
+        assert_eq!(
+            quorum.recovered_checksum().unwrap(),
+            CHECKSUM_ALGORITHM.digest(&secret)
+        );
+    }
+
+    #[test]
+    fn paperback_duplicate_shard() {
+        let backup = Backup::new(3, b"secret data").unwrap();
+        let shard = backup.next_shard().unwrap();
+        // A second copy of the same shard, encrypted with different codewords
+        // (as if it had been reprinted).
+        let (encrypted_copy, codewords) = shard.encrypt().unwrap();
+        let copy = encrypted_copy.decrypt(codewords).unwrap();
+
+        let mut quorum = UntrustedQuorum::new();
+        quorum.main_document(backup.main_document().clone());
+        quorum.push_shard(shard);
+        assert!(quorum.contains_shard(&copy));
+        assert!(!quorum.contains_shard(&backup.next_shard().unwrap()));
+
+        quorum.push_shard(copy);
+        quorum.push_shard(backup.next_shard().unwrap());
+        let err = quorum.validate().unwrap_err();
+        assert!(err.message().contains("copies"));
+    }
+
+    #[quickcheck]
+    fn key_shard_document_checksum(secret: Vec<u8>) {
+        let backup = Backup::new(2, &secret).unwrap();
+        let main_document = backup.main_document();
+        let shard = backup.next_shard().unwrap();
+
+        assert_eq!(
+            shard.document_checksum_string(),
+            main_document.checksum_string()
+        );
+    }
+
     fn inner_paperback_expand_smoke<S: AsRef<[u8]>>(quorum_size: u32, secret: S) -> bool {
         // Construct a backup.
         let backup = Backup::new(quorum_size.into(), secret.as_ref()).unwrap();
@@ -554,5 +1119,148 @@ mod test {
         assert_eq!(shard, shard2);
     }
 
+    #[quickcheck]
+    fn key_shard_decryption_errors(shard: KeyShard) {
+        use quickcheck::Arbitrary;
+
+        let (enc_shard, codewords) = shard.encrypt().unwrap();
+
+        // Codewords for a different key.
+        let (_, other_codewords) = KeyShard::arbitrary(&mut quickcheck::Gen::new(8))
+            .encrypt()
+            .unwrap();
+        match enc_shard.decrypt(&other_codewords) {
+            Err(Error::WrongCodewords(_)) => (),
+            other => panic!("expected WrongCodewords error, got {:?}", other),
+        }
+
+        // Invalid BIP-39 phrase.
+        let mut bad_codewords = codewords.clone();
+        bad_codewords.swap(0, 1);
+        bad_codewords[2] = "notaword".into();
+        match enc_shard.decrypt(&bad_codewords) {
+            Err(Error::WrongCodewords(_)) => (),
+            other => panic!("expected WrongCodewords error, got {:?}", other),
+        }
+
+        // Damaged ciphertext.
+        let mut damaged_shard = enc_shard.clone();
+        damaged_shard.ciphertext[0] ^= 0xff;
+        match damaged_shard.decrypt(&codewords) {
+            Err(Error::CorruptedShard(_)) => (),
+            other => panic!("expected CorruptedShard error, got {:?}", other),
+        }
+
+        // Damaged key check value -- the correct codewords still work.
+        let mut damaged_shard = enc_shard.clone();
+        damaged_shard.key_check.as_mut().unwrap()[0] ^= 0xff;
+        assert_eq!(damaged_shard.decrypt(&codewords).unwrap(), shard);
+        match damaged_shard.decrypt(&other_codewords) {
+            Err(Error::WrongCodewords(_)) => (),
+            other => panic!("expected WrongCodewords error, got {:?}", other),
+        }
+    }
+
+    #[quickcheck]
+    fn key_shard_codewords_checksum(shard: KeyShard) {
+        let (_, codewords) = shard.encrypt().unwrap();
+        let checksum = codewords_checksum(&codewords);
+        assert_eq!(checksum.len(), CODEWORDS_CHECKSUM_LENGTH);
+
+        // Case does not matter, just like when decrypting.
+        let upper = codewords
+            .iter()
+            .map(|word| word.to_uppercase())
+            .collect::<Vec<_>>();
+        assert_eq!(codewords_checksum(&upper), checksum);
+
+        // Swapped codewords are detected.
+        let mut swapped = codewords.clone();
+        swapped.swap(0, 1);
+        if swapped != codewords {
+            assert_ne!(codewords_checksum(&swapped), checksum);
+        }
+    }
+
+    #[test]
+    fn paperback_review_dates() {
+        use std::time::Duration;
+
+        let created_at = UNIX_EPOCH + Duration::from_secs(1_600_000_000);
+        let review_by = created_at + Duration::from_secs(365 * 24 * 60 * 60);
+
+        let backup = BackupBuilder::new(2)
+            .created_at(created_at)
+            .review_by(review_by)
+            .build(b"secret data")
+            .unwrap();
+
+        // Go through a round-trip through serialisation.
+        let main_document = {
+            let zbase32_bytes = backup.main_document().to_wire_zbase32();
+            MainDocument::from_wire_zbase32(zbase32_bytes).unwrap()
+        };
+        assert_eq!(main_document.created_at(), Some(created_at));
+        assert_eq!(main_document.review_by(), Some(review_by));
+        assert!(!main_document.review_due(created_at));
+        assert!(main_document.review_due(review_by));
+
+        let shard = backup.next_shard().unwrap();
+        assert_eq!(shard.created_at(), Some(created_at));
+        assert_eq!(shard.review_by(), Some(review_by));
+        assert!(shard.review_due(review_by + Duration::from_secs(1)));
+
+        // Documents without dates never need review.
+        let backup = Backup::new(2, b"secret data").unwrap();
+        assert_eq!(backup.main_document().review_by(), None);
+        assert!(!backup.main_document().review_due(SystemTime::now()));
+    }
+
+    #[test]
+    fn paperback_shard_options() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+
+        let shard = backup
+            .next_shard_with(
+                ShardOptions::new()
+                    .label("safe deposit box")
+                    .holder("Alice")
+                    .contact("alice@example.com")
+                    .note("second drawer"),
+            )
+            .unwrap();
+        let shard = KeyShard::from_wire(shard.to_wire()).unwrap();
+        assert_eq!(shard.label(), Some("safe deposit box"));
+        assert_eq!(shard.holder(), Some("Alice"));
+        assert_eq!(shard.contact(), Some("alice@example.com"));
+        assert_eq!(shard.note(), Some("second drawer"));
+
+        // No options is the same as next_shard().
+        let shard = backup.next_shard_with(ShardOptions::new()).unwrap();
+        let shard = KeyShard::from_wire(shard.to_wire()).unwrap();
+        assert_eq!(shard.label(), None);
+        assert_eq!(shard.holder(), None);
+        assert_eq!(shard.contact(), None);
+        assert_eq!(shard.note(), None);
+    }
+
+    #[test]
+    fn paperback_metadata() {
+        let backup = Backup::new(3, b"secret data").unwrap();
+        let main_document = backup.main_document();
+        let shard = backup.next_shard().unwrap();
+        assert_eq!(main_document.version(), 0);
+        assert_eq!(shard.version(), 0);
+        assert_eq!(shard.quorum_size(), 3);
+        assert_eq!(main_document.id_fingerprint(), shard.id_fingerprint());
+        assert_eq!(main_document.id_fingerprint().len(), 16);
+
+        let other = Backup::new(3, b"secret data").unwrap();
+        assert_ne!(
+            main_document.id_fingerprint(),
+            other.main_document().id_fingerprint()
+        );
+    }
+
     // TODO: Add many more tests...
 }
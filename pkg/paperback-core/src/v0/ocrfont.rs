@@ -0,0 +1,502 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! A stroked monospace font for the plain-text fallback lines of printed
+//! documents, drawn so that the characters are easy to tell apart both for
+//! people copying the lines by hand and for OCR software.
+//!
+//! The glyphs are loosely based on OCR-B, but only cover the characters which
+//! appear in the text lines (digits, lowercase letters, "/" and space). The
+//! easily confused characters are disambiguated: zero is slashed and twice the
+//! height of "o", "1" has a flag and a foot, "l" has a curved tail, and "i"
+//! has a dot and serifs.
+//!
+//! Glyphs are described in glyph space, with 1000 units to the em. Each glyph
+//! is 600 units wide (the same as Courier), digits and ascenders are 700 units
+//! high, the x-height is 500 units and descenders reach down to -200 units.
+
+use std::fmt::Write;
+
+/// Advance width of every glyph.
+pub(crate) const GLYPH_WIDTH: u32 = 600;
+
+/// Width of the strokes of every glyph.
+const STROKE_WIDTH: u32 = 70;
+
+/// Bounding box of all glyphs (including the stroke width).
+pub(crate) const FONT_BBOX: [i32; 4] = [0, -300, 650, 800];
+
+/// A single stroke of a glyph.
+#[derive(Clone, Copy, Debug)]
+enum Stroke {
+    /// Straight lines through each of the points.
+    Line(&'static [(i32, i32)]),
+    /// Part of the ellipse with centre `(cx, cy)` and radii `(rx, ry)`, from
+    /// the angle `from` to `to` (in degrees, anticlockwise from the x-axis).
+    Arc {
+        cx: i32,
+        cy: i32,
+        rx: i32,
+        ry: i32,
+        from: i32,
+        to: i32,
+    },
+}
+
+use Stroke::{Arc, Line};
+
+/// A full ellipse.
+const fn ellipse(cx: i32, cy: i32, rx: i32, ry: i32) -> Stroke {
+    Arc {
+        cx,
+        cy,
+        rx,
+        ry,
+        from: 0,
+        to: 360,
+    }
+}
+
+/// Part of an ellipse.
+const fn arc(cx: i32, cy: i32, rx: i32, ry: i32, from: i32, to: i32) -> Stroke {
+    Arc {
+        cx,
+        cy,
+        rx,
+        ry,
+        from,
+        to,
+    }
+}
+
+/// A glyph of the font, with the PDF glyph name of its character.
+#[derive(Clone, Copy, Debug)]
+pub(crate) struct Glyph {
+    pub(crate) ch: char,
+    pub(crate) name: &'static str,
+    strokes: &'static [Stroke],
+}
+
+impl Glyph {
+    /// Returns the PDF content stream which draws the glyph (for use as a
+    /// Type 3 glyph procedure).
+    pub(crate) fn procedure(&self) -> String {
+        let [llx, lly, urx, ury] = FONT_BBOX;
+        let mut procedure = format!(
+            "{} 0 {} {} {} {} d1\n{} w 1 J 1 j\n",
+            GLYPH_WIDTH, llx, lly, urx, ury, STROKE_WIDTH
+        );
+        if self.strokes.is_empty() {
+            return procedure;
+        }
+        for stroke in self.strokes {
+            for (idx, (x, y)) in stroke.points().into_iter().enumerate() {
+                let op = if idx == 0 { "m" } else { "l" };
+                writeln!(procedure, "{} {} {}", x, y, op).unwrap();
+            }
+        }
+        procedure.push_str("S\n");
+        procedure
+    }
+}
+
+impl Stroke {
+    /// Returns the points the stroke passes through, with arcs approximated
+    /// by straight lines (at most 15 degrees apart).
+    fn points(&self) -> Vec<(i32, i32)> {
+        match *self {
+            Line(points) => points.to_vec(),
+            Arc {
+                cx,
+                cy,
+                rx,
+                ry,
+                from,
+                to,
+            } => {
+                let segments = ((to - from).abs() + 14) / 15;
+                (0..=segments)
+                    .map(|idx| {
+                        let angle = f64::from(from + (to - from) * idx / segments).to_radians();
+                        (
+                            cx + (f64::from(rx) * angle.cos()).round() as i32,
+                            cy + (f64::from(ry) * angle.sin()).round() as i32,
+                        )
+                    })
+                    .collect()
+            }
+        }
+    }
+}
+
+/// All glyphs of the font, in the order of their characters.
+pub(crate) const GLYPHS: &[Glyph] = &[
+    Glyph {
+        ch: ' ',
+        name: "space",
+        strokes: &[],
+    },
+    Glyph {
+        ch: '/',
+        name: "slash",
+        strokes: &[Line(&[(130, -60), (470, 760)])],
+    },
+    Glyph {
+        ch: '0',
+        name: "zero",
+        strokes: &[ellipse(300, 350, 190, 350), Line(&[(170, 130), (430, 570)])],
+    },
+    Glyph {
+        ch: '1',
+        name: "one",
+        strokes: &[
+            Line(&[(160, 560), (320, 700), (320, 0)]),
+            Line(&[(160, 0), (480, 0)]),
+        ],
+    },
+    Glyph {
+        ch: '2',
+        name: "two",
+        strokes: &[
+            arc(300, 520, 180, 180, 160, -40),
+            Line(&[(438, 404), (110, 0), (490, 0)]),
+        ],
+    },
+    Glyph {
+        ch: '3',
+        name: "three",
+        strokes: &[
+            arc(300, 535, 165, 165, 150, -90),
+            arc(300, 185, 185, 185, 90, -150),
+        ],
+    },
+    Glyph {
+        ch: '4',
+        name: "four",
+        strokes: &[Line(&[(400, 0), (400, 700), (100, 220), (500, 220)])],
+    },
+    Glyph {
+        ch: '5',
+        name: "five",
+        strokes: &[
+            Line(&[(470, 700), (150, 700), (160, 406)]),
+            arc(290, 230, 200, 230, 130, -140),
+        ],
+    },
+    Glyph {
+        ch: '6',
+        name: "six",
+        strokes: &[ellipse(300, 210, 190, 210), Line(&[(118, 260), (380, 700)])],
+    },
+    Glyph {
+        ch: '7',
+        name: "seven",
+        strokes: &[Line(&[(100, 700), (500, 700), (220, 0)])],
+    },
+    Glyph {
+        ch: '8',
+        name: "eight",
+        strokes: &[ellipse(300, 530, 160, 170), ellipse(300, 190, 190, 190)],
+    },
+    Glyph {
+        ch: '9',
+        name: "nine",
+        strokes: &[ellipse(300, 490, 190, 210), Line(&[(482, 440), (220, 0)])],
+    },
+    Glyph {
+        ch: 'a',
+        name: "a",
+        strokes: &[ellipse(280, 250, 180, 250), Line(&[(460, 500), (460, 0)])],
+    },
+    Glyph {
+        ch: 'b',
+        name: "b",
+        strokes: &[Line(&[(120, 700), (120, 0)]), ellipse(310, 250, 190, 250)],
+    },
+    Glyph {
+        ch: 'c',
+        name: "c",
+        strokes: &[arc(310, 250, 200, 250, 45, 315)],
+    },
+    Glyph {
+        ch: 'd',
+        name: "d",
+        strokes: &[ellipse(290, 250, 190, 250), Line(&[(480, 700), (480, 0)])],
+    },
+    Glyph {
+        ch: 'e',
+        name: "e",
+        strokes: &[
+            Line(&[(110, 250), (500, 250)]),
+            arc(305, 250, 195, 250, 0, 320),
+        ],
+    },
+    Glyph {
+        ch: 'f',
+        name: "f",
+        strokes: &[
+            Line(&[(280, 0), (280, 580)]),
+            arc(400, 580, 120, 120, 180, 20),
+            Line(&[(140, 480), (440, 480)]),
+        ],
+    },
+    Glyph {
+        ch: 'g',
+        name: "g",
+        strokes: &[
+            ellipse(290, 270, 180, 230),
+            Line(&[(470, 500), (470, -60)]),
+            arc(300, -60, 170, 140, 0, -150),
+        ],
+    },
+    Glyph {
+        ch: 'h',
+        name: "h",
+        strokes: &[
+            Line(&[(120, 700), (120, 0)]),
+            arc(300, 330, 180, 170, 180, 0),
+            Line(&[(480, 330), (480, 0)]),
+        ],
+    },
+    Glyph {
+        ch: 'i',
+        name: "i",
+        strokes: &[
+            Line(&[(180, 500), (300, 500), (300, 0)]),
+            Line(&[(150, 0), (450, 0)]),
+            Line(&[(300, 640), (300, 660)]),
+        ],
+    },
+    Glyph {
+        ch: 'j',
+        name: "j",
+        strokes: &[
+            Line(&[(210, 500), (330, 500), (330, -80)]),
+            arc(200, -80, 130, 120, 0, -160),
+            Line(&[(330, 640), (330, 660)]),
+        ],
+    },
+    Glyph {
+        ch: 'k',
+        name: "k",
+        strokes: &[
+            Line(&[(120, 700), (120, 0)]),
+            Line(&[(470, 500), (120, 180)]),
+            Line(&[(250, 300), (480, 0)]),
+        ],
+    },
+    Glyph {
+        ch: 'l',
+        name: "l",
+        strokes: &[
+            Line(&[(200, 700), (300, 700), (300, 80)]),
+            arc(400, 80, 100, 80, 180, 270),
+            Line(&[(400, 0), (480, 0)]),
+        ],
+    },
+    Glyph {
+        ch: 'm',
+        name: "m",
+        strokes: &[
+            Line(&[(90, 500), (90, 0)]),
+            arc(195, 380, 105, 120, 180, 0),
+            Line(&[(300, 380), (300, 0)]),
+            arc(405, 380, 105, 120, 180, 0),
+            Line(&[(510, 380), (510, 0)]),
+        ],
+    },
+    Glyph {
+        ch: 'n',
+        name: "n",
+        strokes: &[
+            Line(&[(120, 500), (120, 0)]),
+            arc(300, 330, 180, 170, 180, 0),
+            Line(&[(480, 330), (480, 0)]),
+        ],
+    },
+    Glyph {
+        ch: 'o',
+        name: "o",
+        strokes: &[ellipse(300, 250, 190, 250)],
+    },
+    Glyph {
+        ch: 'p',
+        name: "p",
+        strokes: &[
+            Line(&[(120, 500), (120, -200)]),
+            ellipse(310, 250, 190, 250),
+        ],
+    },
+    Glyph {
+        ch: 'q',
+        name: "q",
+        strokes: &[
+            ellipse(290, 250, 190, 250),
+            Line(&[(480, 500), (480, -200)]),
+        ],
+    },
+    Glyph {
+        ch: 'r',
+        name: "r",
+        strokes: &[
+            Line(&[(140, 500), (140, 0)]),
+            arc(330, 300, 190, 190, 180, 60),
+        ],
+    },
+    Glyph {
+        ch: 's',
+        name: "s",
+        strokes: &[
+            arc(300, 375, 170, 125, 20, 270),
+            arc(300, 125, 180, 125, 90, -160),
+        ],
+    },
+    Glyph {
+        ch: 't',
+        name: "t",
+        strokes: &[
+            Line(&[(260, 650), (260, 100)]),
+            arc(380, 100, 120, 100, 180, 300),
+            Line(&[(120, 500), (440, 500)]),
+        ],
+    },
+    Glyph {
+        ch: 'u',
+        name: "u",
+        strokes: &[
+            Line(&[(120, 500), (120, 170)]),
+            arc(300, 170, 180, 170, 180, 360),
+            Line(&[(480, 500), (480, 0)]),
+        ],
+    },
+    Glyph {
+        ch: 'v',
+        name: "v",
+        strokes: &[Line(&[(100, 500), (300, 0), (500, 500)])],
+    },
+    Glyph {
+        ch: 'w',
+        name: "w",
+        strokes: &[Line(&[
+            (70, 500),
+            (180, 0),
+            (300, 350),
+            (420, 0),
+            (530, 500),
+        ])],
+    },
+    Glyph {
+        ch: 'x',
+        name: "x",
+        strokes: &[Line(&[(110, 500), (490, 0)]), Line(&[(490, 500), (110, 0)])],
+    },
+    Glyph {
+        ch: 'y',
+        name: "y",
+        strokes: &[
+            Line(&[(110, 500), (322, 30)]),
+            Line(&[(490, 500), (240, -200), (150, -200)]),
+        ],
+    },
+    Glyph {
+        ch: 'z',
+        name: "z",
+        strokes: &[Line(&[(110, 500), (490, 500), (110, 0), (490, 0)])],
+    },
+];
+
+/// Returns the glyph for `ch`, if the font has one.
+pub(crate) fn glyph(ch: char) -> Option<&'static Glyph> {
+    GLYPHS.iter().find(|glyph| glyph.ch == ch)
+}
+
+/// Returns whether every character of `text` has a glyph in the font.
+pub(crate) fn covers(text: &str) -> bool {
+    text.chars().all(|ch| glyph(ch).is_some())
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::text_lines;
+
+    use std::collections::HashSet;
+
+    #[test]
+    fn glyphs_unique() {
+        let chars = GLYPHS.iter().map(|glyph| glyph.ch).collect::<HashSet<_>>();
+        let names = GLYPHS
+            .iter()
+            .map(|glyph| glyph.name)
+            .collect::<HashSet<_>>();
+        assert_eq!(chars.len(), GLYPHS.len());
+        assert_eq!(names.len(), GLYPHS.len());
+        // Glyphs are in the order of their characters.
+        assert!(GLYPHS.windows(2).all(|pair| pair[0].ch < pair[1].ch));
+    }
+
+    #[test]
+    fn glyphs_in_bbox() {
+        let [llx, lly, urx, ury] = FONT_BBOX;
+        let margin = STROKE_WIDTH as i32 / 2;
+        for glyph in GLYPHS {
+            for stroke in glyph.strokes {
+                for (x, y) in stroke.points() {
+                    assert!(
+                        x - margin >= llx && x + margin <= urx,
+                        "glyph {:?} is too wide",
+                        glyph.ch
+                    );
+                    assert!(
+                        y - margin >= lly && y + margin <= ury,
+                        "glyph {:?} is too tall",
+                        glyph.ch
+                    );
+                }
+            }
+        }
+    }
+
+    #[test]
+    fn glyph_procedure() {
+        assert_eq!(
+            glyph('/').unwrap().procedure(),
+            "600 0 0 -300 650 800 d1\n70 w 1 J 1 j\n130 -60 m\n470 760 l\nS\n"
+        );
+        assert!(!glyph(' ').unwrap().procedure().contains(" m\n"));
+        let zero = glyph('0').unwrap().procedure();
+        assert_eq!(zero.matches(" m\n").count(), 2);
+        assert_eq!(zero.matches(" l\n").count(), 24 + 1);
+    }
+
+    #[quickcheck]
+    fn covers_text_lines(data: Vec<u8>) {
+        for line in text_lines(data) {
+            assert!(covers(&line), "line {:?} is not covered", line);
+        }
+    }
+
+    #[test]
+    fn covers_known() {
+        assert!(covers("01/03 ybndrfg8 ejkmcpqx ot1uwisz a345h769 ehro"));
+        assert!(covers("abcdefghijklmnopqrstuvwxyz 0123456789/"));
+        assert!(!covers("Document-ID"));
+        assert!(!covers("l\u{e9}"));
+    }
+}
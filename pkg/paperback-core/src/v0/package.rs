@@ -0,0 +1,183 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! Work packages carry the parameters of an operation from a
+//! network-connected machine (where they are prepared) to an air-gapped
+//! machine (where the operation is carried out), so that secret data and key
+//! material never exist on the network-connected machine.
+
+use crate::v0::{multihash_short_id, wire::to_multibase_zbase32, Error, CHECKSUM_ALGORITHM};
+
+use multihash::{Multihash, MultihashDigest};
+
+/// First line of a work package.
+const WORK_PACKAGE_HEADER: &str = "paperback-work-package-v0";
+
+fn package_error<S: Into<String>>(msg: S) -> Error {
+    Error::Other(format!("invalid work package: {}", msg.into()))
+}
+
+/// Parameters of an operation (a command and its arguments), prepared on one
+/// machine to be carried out on another.
+///
+/// A work package is stored as text, ending with a checksum of its contents.
+/// The checksum only detects accidental corruption -- since anyone can
+/// compute it, the package is authenticated by comparing its
+/// [`code`](Self::code) (shown on the machine which prepared it) when it is
+/// opened with [`from_text`](Self::from_text).
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct WorkPackage {
+    command: String,
+    args: Vec<String>,
+}
+
+impl WorkPackage {
+    /// Length of the code used to authenticate a work package.
+    pub const CODE_LENGTH: usize = 16;
+
+    /// Create a work package for running `command` with `args`. None of them
+    /// may contain line breaks.
+    pub fn new<S: Into<String>>(command: S, args: Vec<String>) -> Result<Self, Error> {
+        let command = command.into();
+        if std::iter::once(&command)
+            .chain(&args)
+            .any(|arg| arg.contains(&['\n', '\r'][..]))
+        {
+            return Err(package_error("arguments cannot contain line breaks"));
+        }
+        Ok(Self { command, args })
+    }
+
+    pub fn command(&self) -> &str {
+        &self.command
+    }
+
+    pub fn args(&self) -> &[String] {
+        &self.args
+    }
+
+    /// Returns the contents of the package covered by its checksum.
+    fn body(&self) -> String {
+        let mut body = format!("{}\ncommand {}\n", WORK_PACKAGE_HEADER, self.command);
+        for arg in &self.args {
+            body.push_str("arg ");
+            body.push_str(arg);
+            body.push('\n');
+        }
+        body
+    }
+
+    fn checksum(&self) -> Multihash {
+        CHECKSUM_ALGORITHM.digest(self.body().as_bytes())
+    }
+
+    /// Returns the code which authenticates the package, which has to be
+    /// carried over to the machine the package is opened on by hand (such as
+    /// by reading it off the screen).
+    pub fn code(&self) -> String {
+        multihash_short_id(self.checksum(), Self::CODE_LENGTH)
+    }
+
+    /// Encode the package as text, as parsed by [`from_text`](Self::from_text).
+    pub fn to_text(&self) -> String {
+        format!(
+            "{}checksum {}\n",
+            self.body(),
+            to_multibase_zbase32(self.checksum().to_bytes())
+        )
+    }
+
+    /// Parse a package encoded with [`to_text`](Self::to_text), and check
+    /// that it matches `code` (as returned by [`code`](Self::code) on the
+    /// machine which prepared the package).
+    pub fn from_text(text: &str, code: &str) -> Result<Self, Error> {
+        let mut lines = text.lines();
+        if lines.next() != Some(WORK_PACKAGE_HEADER) {
+            return Err(package_error("missing work package header"));
+        }
+
+        let mut command = None;
+        let mut args = vec![];
+        let mut checksum = None;
+        for line in lines {
+            if checksum.is_some() {
+                return Err(package_error("trailing data after checksum"));
+            }
+            let (key, value) = line.split_at(line.find(' ').unwrap_or(line.len()));
+            let value = value.strip_prefix(' ').unwrap_or(value);
+            match (key, &command) {
+                ("command", None) => command = Some(value.to_string()),
+                ("arg", Some(_)) => args.push(value.to_string()),
+                ("checksum", Some(_)) => checksum = Some(value.to_string()),
+                _ => return Err(package_error(format!("unexpected line '{}'", key))),
+            }
+        }
+        let package = Self {
+            command: command.ok_or_else(|| package_error("missing command"))?,
+            args,
+        };
+
+        let expected = to_multibase_zbase32(package.checksum().to_bytes());
+        if checksum.as_deref() != Some(expected.as_str()) {
+            return Err(package_error("checksum mismatch -- the package is corrupted"));
+        }
+        if code.trim() != package.code() {
+            return Err(package_error(
+                "code does not match -- the package was modified or replaced",
+            ));
+        }
+        Ok(package)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    fn example_package() -> WorkPackage {
+        WorkPackage::new(
+            "backup",
+            vec!["--quorum-size".into(), "2".into(), "--note".into(), "in the safe".into()],
+        )
+        .unwrap()
+    }
+
+    #[test]
+    fn work_package_roundtrip() {
+        let package = example_package();
+        let package2 = WorkPackage::from_text(&package.to_text(), &package.code()).unwrap();
+        assert_eq!(package, package2);
+        assert_eq!(package2.args()[3], "in the safe");
+    }
+
+    #[test]
+    fn work_package_tampered() {
+        let package = example_package();
+        let text = package.to_text();
+
+        // Changing the contents breaks the checksum.
+        let modified = text.replace("arg 2\n", "arg 1\n");
+        WorkPackage::from_text(&modified, &package.code()).unwrap_err();
+
+        // A package which is entirely replaced has a different code.
+        let other = WorkPackage::new("backup", vec!["--quorum-size".into(), "1".into()]).unwrap();
+        WorkPackage::from_text(&other.to_text(), &package.code()).unwrap_err();
+
+        WorkPackage::new("backup", vec!["a\nb".into()]).unwrap_err();
+    }
+}
@@ -0,0 +1,284 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{Error, CHECKSUM_ALGORITHM};
+
+use std::collections::BTreeMap;
+
+use multihash::{Multihash, MultihashDigest};
+
+/// One page of a document which has been split across several printed pages.
+///
+/// Each page records its position in the document, as well as a checksum of
+/// its own contents and a checksum of the whole document (which ties all of
+/// the pages of a document together).
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub struct Page {
+    pub(crate) content_chksum: Multihash,
+    pub(crate) number: u32,
+    pub(crate) total: u32,
+    pub(crate) page_chksum: Multihash,
+    pub(crate) data: Vec<u8>,
+}
+
+impl Page {
+    /// Returns the (one-indexed) page number.
+    pub fn number(&self) -> u32 {
+        self.number
+    }
+
+    /// Returns the total number of pages in the document.
+    pub fn total(&self) -> u32 {
+        self.total
+    }
+
+    /// Returns the checksum of the whole document this page is part of.
+    pub fn content_checksum(&self) -> Multihash {
+        self.content_chksum
+    }
+
+    /// Returns the data stored on this page.
+    pub fn data(&self) -> &[u8] {
+        &self.data
+    }
+
+    /// Returns whether the page contents match the page checksum.
+    pub fn is_intact(&self) -> bool {
+        CHECKSUM_ALGORITHM.digest(&self.data) == self.page_chksum
+    }
+}
+
+#[cfg(test)]
+impl quickcheck::Arbitrary for Page {
+    fn arbitrary(g: &mut quickcheck::Gen) -> Self {
+        let data = Vec::<u8>::arbitrary(g);
+        let total = u32::arbitrary(g).saturating_add(1);
+        Self {
+            content_chksum: CHECKSUM_ALGORITHM.digest(&Vec::<u8>::arbitrary(g)),
+            number: u32::arbitrary(g) % total + 1,
+            total,
+            page_chksum: CHECKSUM_ALGORITHM.digest(&data),
+            data,
+        }
+    }
+}
+
+/// Split `data` into pages containing at most `page_size` bytes each.
+pub fn paginate<B: AsRef<[u8]>>(data: B, page_size: usize) -> Vec<Page> {
+    assert!(page_size > 0, "page size must be non-zero");
+
+    let data = data.as_ref();
+    let content_chksum = CHECKSUM_ALGORITHM.digest(data);
+    let mut chunks = data.chunks(page_size).collect::<Vec<_>>();
+    if chunks.is_empty() {
+        chunks.push(&[]);
+    }
+    let total = chunks.len() as u32;
+
+    chunks
+        .into_iter()
+        .enumerate()
+        .map(|(idx, chunk)| Page {
+            content_chksum,
+            number: idx as u32 + 1,
+            total,
+            page_chksum: CHECKSUM_ALGORITHM.digest(chunk),
+            data: chunk.to_vec(),
+        })
+        .collect()
+}
+
+/// Collection of the pages of a document, which keeps track of which pages
+/// are missing and which were scanned out of order.
+#[derive(Clone, Debug, Default)]
+pub struct PageSet {
+    content_chksum: Option<Multihash>,
+    total: u32,
+    pages: BTreeMap<u32, Vec<u8>>,
+    scan_order: Vec<u32>,
+}
+
+impl PageSet {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Add a scanned page to the set.
+    ///
+    /// Pages which are corrupted, belong to a different document, or conflict
+    /// with a previously added page are rejected. Adding the same page twice is
+    /// permitted.
+    pub fn push(&mut self, page: Page) -> Result<(), Error> {
+        if !page.is_intact() {
+            return Err(Error::PageAssembly(format!(
+                "page {} does not match its checksum (it may be damaged)",
+                page.number
+            )));
+        }
+        if page.number == 0 || page.number > page.total {
+            return Err(Error::PageAssembly(format!(
+                "page number {} is outside of the document's {} pages",
+                page.number, page.total
+            )));
+        }
+        match self.content_chksum {
+            Some(content_chksum) if content_chksum != page.content_chksum => {
+                return Err(Error::PageAssembly(format!(
+                    "page {} is from a different document",
+                    page.number
+                )))
+            }
+            Some(_) if self.total != page.total => {
+                return Err(Error::PageAssembly(format!(
+                    "page {} has inconsistent page count ({} not {})",
+                    page.number, page.total, self.total
+                )))
+            }
+            Some(_) => (),
+            None => {
+                self.content_chksum = Some(page.content_chksum);
+                self.total = page.total;
+            }
+        }
+
+        match self.pages.get(&page.number) {
+            Some(data) if *data != page.data => Err(Error::PageAssembly(format!(
+                "page {} conflicts with a previously scanned copy",
+                page.number
+            ))),
+            Some(_) => Ok(()),
+            None => {
+                self.scan_order.push(page.number);
+                self.pages.insert(page.number, page.data);
+                Ok(())
+            }
+        }
+    }
+
+    /// Returns the total number of pages in the document, if any pages have
+    /// been added.
+    pub fn total(&self) -> Option<u32> {
+        self.content_chksum.map(|_| self.total)
+    }
+
+    /// Returns the numbers of the pages which have not been added yet.
+    pub fn missing(&self) -> Vec<u32> {
+        (1..=self.total)
+            .filter(|number| !self.pages.contains_key(number))
+            .collect()
+    }
+
+    /// Returns the numbers of the pages which were added after a
+    /// higher-numbered page.
+    pub fn out_of_order(&self) -> Vec<u32> {
+        let mut highest = 0;
+        self.scan_order
+            .iter()
+            .copied()
+            .filter(|&number| {
+                let out_of_order = number < highest;
+                highest = highest.max(number);
+                out_of_order
+            })
+            .collect()
+    }
+
+    /// Reassemble the document from all of its pages.
+    pub fn assemble(&self) -> Result<Vec<u8>, Error> {
+        let content_chksum = self
+            .content_chksum
+            .ok_or_else(|| Error::PageAssembly("no pages have been added".into()))?;
+        let missing = self.missing();
+        if !missing.is_empty() {
+            return Err(Error::PageAssembly(format!(
+                "missing pages {:?} of {}",
+                missing, self.total
+            )));
+        }
+
+        let data = self.pages.values().flatten().copied().collect::<Vec<_>>();
+        if CHECKSUM_ALGORITHM.digest(&data) != content_chksum {
+            return Err(Error::PageAssembly(
+                "reassembled document does not match its checksum".into(),
+            ));
+        }
+        Ok(data)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use quickcheck::TestResult;
+
+    #[quickcheck]
+    fn paginate_roundtrip(data: Vec<u8>, page_size: usize) -> TestResult {
+        if page_size == 0 {
+            return TestResult::discard();
+        }
+
+        let pages = paginate(&data, page_size);
+        let mut set = PageSet::new();
+        // Add the pages in reverse order.
+        for page in pages.iter().rev() {
+            set.push(page.clone()).unwrap();
+        }
+        assert_eq!(set.total(), Some(pages.len() as u32));
+        assert!(set.missing().is_empty());
+        assert_eq!(set.assemble().unwrap(), data);
+
+        TestResult::passed()
+    }
+
+    #[test]
+    fn page_set_missing_and_out_of_order() {
+        let pages = paginate(b"the quick brown fox jumps over the lazy dog", 8);
+        assert_eq!(pages.len(), 6);
+
+        let mut set = PageSet::new();
+        for idx in &[0, 2, 1, 5, 4] {
+            set.push(pages[*idx].clone()).unwrap();
+        }
+        assert_eq!(set.missing(), vec![4]);
+        assert_eq!(set.out_of_order(), vec![2, 5]);
+        set.assemble().unwrap_err();
+
+        set.push(pages[3].clone()).unwrap();
+        assert!(set.missing().is_empty());
+        assert_eq!(
+            set.assemble().unwrap(),
+            &b"the quick brown fox jumps over the lazy dog"[..]
+        );
+    }
+
+    #[test]
+    fn page_set_rejects_bad_pages() {
+        let pages = paginate(b"some document data", 4);
+        let other_pages = paginate(b"other document data", 4);
+
+        let mut set = PageSet::new();
+        set.push(pages[0].clone()).unwrap();
+        set.push(other_pages[1].clone()).unwrap_err();
+
+        let mut damaged = pages[1].clone();
+        damaged.data[0] ^= 0xff;
+        assert!(!damaged.is_intact());
+        set.push(damaged).unwrap_err();
+    }
+}
@@ -0,0 +1,751 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! A minimal PDF writer, which only supports the handful of features needed to
+//! print sheets (filled rectangles, and text in the standard fonts or in the
+//! embedded font used for the plain-text fallback, see [`ocrfont`]).
+//!
+//! The objects of the document are always written in the same order and
+//! nothing random is included, so the same sheets always produce the same PDF
+//! byte-for-byte. This allows the output of independently built copies of
+//! paperback to be compared before any secrets are printed.
+
+use crate::v0::{
+    ocrfont::{self, GLYPHS, GLYPH_WIDTH},
+    render::{qr_grid_columns, wrap_text},
+    CodewordLanguage, Error, PageLayout, Sheet,
+};
+
+use std::{
+    fmt::Write,
+    time::{SystemTime, UNIX_EPOCH},
+};
+
+const TITLE_FONT_SIZE: f64 = 18.0;
+const TEXT_FONT_SIZE: f64 = 10.0;
+const LINE_HEIGHT_MM: f64 = 5.0;
+
+/// Approximate width of a character in the (proportional) text font, used for
+/// wrapping the instructions.
+const TEXT_CHAR_WIDTH_MM: f64 = 1.9;
+
+/// Width of a character in the monospace font (whose glyphs are all 0.6 times
+/// the font size wide).
+const MONO_CHAR_WIDTH_MM: f64 = 0.6 * TEXT_FONT_SIZE / POINTS_PER_MM;
+
+/// Number of PDF points (the default PDF unit) in a millimetre.
+const POINTS_PER_MM: f64 = 72.0 / 25.4;
+
+/// Fonts used in the PDF. Apart from the font for the plain-text fallback
+/// (which is embedded as a Type 3 font drawn from strokes), only the standard
+/// fonts (which every PDF reader has) are used.
+#[derive(Clone, Copy, Debug)]
+enum Font {
+    Title,
+    Text,
+    Mono,
+    Ocr,
+}
+
+impl Font {
+    /// All fonts, in the order their objects are written.
+    const ALL: [Font; 4] = [Font::Title, Font::Text, Font::Mono, Font::Ocr];
+
+    fn resource_name(self) -> &'static str {
+        match self {
+            Self::Title => "F1",
+            Self::Text => "F2",
+            Self::Mono => "F3",
+            Self::Ocr => "F4",
+        }
+    }
+
+    /// Returns the name of the standard font, unless the font is embedded.
+    fn base_font(self) -> Option<&'static str> {
+        match self {
+            Self::Title => Some("Helvetica-Bold"),
+            Self::Text => Some("Helvetica"),
+            Self::Mono => Some("Courier"),
+            Self::Ocr => None,
+        }
+    }
+}
+
+/// Returns the font dictionary of the embedded font for the plain-text
+/// fallback, whose glyph procedures are the objects starting from
+/// `first_glyph` (in the order of [`GLYPHS`]).
+fn ocr_font(first_glyph: usize) -> String {
+    let [llx, lly, urx, ury] = ocrfont::FONT_BBOX;
+    let char_procs = GLYPHS
+        .iter()
+        .enumerate()
+        .map(|(idx, glyph)| format!("/{} {} 0 R", glyph.name, first_glyph + idx))
+        .collect::<Vec<_>>()
+        .join(" ");
+    let differences = GLYPHS
+        .iter()
+        .map(|glyph| format!("{} /{}", glyph.ch as u32, glyph.name))
+        .collect::<Vec<_>>()
+        .join(" ");
+    let (first_char, last_char) = (GLYPHS[0].ch as u32, GLYPHS[GLYPHS.len() - 1].ch as u32);
+    let widths = vec![GLYPH_WIDTH.to_string(); (last_char - first_char + 1) as usize].join(" ");
+    format!(
+        "<< /Type /Font /Subtype /Type3 /FontBBox [{} {} {} {}] /FontMatrix [0.001 0 0 0.001 0 0] \
+         /CharProcs << {} >> /Encoding << /Type /Encoding /Differences [{}] >> \
+         /FirstChar {} /LastChar {} /Widths [{}] /Resources << >> >>",
+        llx, lly, urx, ury, char_procs, differences, first_char, last_char, widths
+    )
+}
+
+/// Format a length in millimetres as PDF points.
+fn points(mm: f64) -> String {
+    format!("{:.3}", mm * POINTS_PER_MM)
+}
+
+/// Returns the byte encoding `ch` in WinAnsiEncoding (the encoding of the
+/// standard fonts), if it can be represented.
+fn win_ansi_byte(ch: char) -> Option<u8> {
+    // The characters of WinAnsiEncoding from 0x80 to 0x9f which differ from
+    // ISO 8859-1 (which has only control characters there).
+    const WIN_ANSI_EXTRA: &[(char, u8)] = &[
+        ('\u{20ac}', 0x80),
+        ('\u{201a}', 0x82),
+        ('\u{0192}', 0x83),
+        ('\u{201e}', 0x84),
+        ('\u{2026}', 0x85),
+        ('\u{2020}', 0x86),
+        ('\u{2021}', 0x87),
+        ('\u{02c6}', 0x88),
+        ('\u{2030}', 0x89),
+        ('\u{0160}', 0x8a),
+        ('\u{2039}', 0x8b),
+        ('\u{0152}', 0x8c),
+        ('\u{017d}', 0x8e),
+        ('\u{2018}', 0x91),
+        ('\u{2019}', 0x92),
+        ('\u{201c}', 0x93),
+        ('\u{201d}', 0x94),
+        ('\u{2022}', 0x95),
+        ('\u{2013}', 0x96),
+        ('\u{2014}', 0x97),
+        ('\u{02dc}', 0x98),
+        ('\u{2122}', 0x99),
+        ('\u{0161}', 0x9a),
+        ('\u{203a}', 0x9b),
+        ('\u{0153}', 0x9c),
+        ('\u{017e}', 0x9e),
+        ('\u{0178}', 0x9f),
+    ];
+
+    match ch {
+        ' '..='~' | '\u{a0}'..='\u{ff}' => Some(ch as u8),
+        _ => WIN_ANSI_EXTRA
+            .iter()
+            .find(|(extra, _)| *extra == ch)
+            .map(|(_, byte)| *byte),
+    }
+}
+
+/// Returns whether `text` can be printed with the standard fonts.
+fn is_printable(text: &str) -> bool {
+    text.chars().all(|ch| win_ansi_byte(ch).is_some())
+}
+
+/// Returns whether every codeword of `language` can be printed in a PDF. The
+/// PDF output only uses the standard fonts, so codewords in non-Latin scripts
+/// (such as Chinese, Japanese and Korean) cannot be printed.
+pub fn pdf_supports_language(language: CodewordLanguage) -> bool {
+    language
+        .wordlist()
+        .wordlist()
+        .get_words_by_prefix("")
+        .iter()
+        .all(|word| is_printable(word))
+}
+
+/// Encode `text` as a PDF literal string in WinAnsiEncoding. Characters which
+/// cannot be represented (which includes all non-Latin scripts) are replaced
+/// with "?", so text which must be printed exactly (such as codewords) has to
+/// be checked with [`is_printable`] first.
+fn literal_string(text: &str) -> String {
+    let mut string = String::from("(");
+    for ch in text.chars() {
+        let byte = win_ansi_byte(ch).unwrap_or(b'?');
+        match byte {
+            b'(' | b')' | b'\\' => {
+                string.push('\\');
+                string.push(byte as char);
+            }
+            // Keep the file ASCII, so that it is easy to inspect and compare.
+            0x80..=0xff => write!(string, "\\{:03o}", byte).unwrap(),
+            _ => string.push(byte as char),
+        }
+    }
+    string.push(')');
+    string
+}
+
+/// Encode `text` as a PDF text string (used for document metadata), which can
+/// hold any Unicode text as UTF-16BE.
+fn text_string(text: &str) -> String {
+    if text.chars().all(|ch| (' '..='~').contains(&ch)) {
+        return literal_string(text);
+    }
+    let mut string = String::from("<FEFF");
+    for unit in text.encode_utf16() {
+        write!(string, "{:04X}", unit).unwrap();
+    }
+    string.push('>');
+    string
+}
+
+/// Format `time` as a PDF date (in UTC).
+fn pdf_date(time: SystemTime) -> String {
+    let secs = time
+        .duration_since(UNIX_EPOCH)
+        .map(|duration| duration.as_secs())
+        .unwrap_or(0);
+    let (days, secs) = (secs / 86400, secs % 86400);
+
+    // Convert days since the epoch to a civil date, using the algorithm from
+    // <http://howardhinnant.github.io/date_algorithms.html#civil_from_days>.
+    let z = days + 719_468;
+    let era = z / 146_097;
+    let doe = z - era * 146_097;
+    let yoe = (doe - doe / 1460 + doe / 36524 - doe / 146_096) / 365;
+    let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+    let mp = (5 * doy + 2) / 153;
+    let day = doy - (153 * mp + 2) / 5 + 1;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 };
+    let year = yoe + era * 400 + if month <= 2 { 1 } else { 0 };
+
+    format!(
+        "D:{:04}{:02}{:02}{:02}{:02}{:02}Z",
+        year,
+        month,
+        day,
+        secs / 3600,
+        secs / 60 % 60,
+        secs % 60
+    )
+}
+
+/// Content stream of a single page. All positions are given in millimetres
+/// from the bottom-left corner of the page.
+#[derive(Debug, Default)]
+struct PageContent(String);
+
+impl PageContent {
+    fn rectangle(&mut self, x: f64, y: f64, width: f64, height: f64) {
+        writeln!(
+            self.0,
+            "{} {} {} {} re f",
+            points(x),
+            points(y),
+            points(width),
+            points(height)
+        )
+        .unwrap();
+    }
+
+    fn text<S: AsRef<str>>(&mut self, text: S, size: f64, x: f64, y: f64, font: Font) {
+        writeln!(
+            self.0,
+            "BT /{} {} Tf {} {} Td {} Tj ET",
+            font.resource_name(),
+            size,
+            points(x),
+            points(y),
+            literal_string(text.as_ref())
+        )
+        .unwrap();
+    }
+}
+
+/// Writes the objects of a PDF file, keeping track of their offsets for the
+/// cross-reference table.
+struct PdfWriter {
+    output: Vec<u8>,
+    offsets: Vec<usize>,
+}
+
+impl PdfWriter {
+    fn new() -> Self {
+        Self {
+            // The comment of non-ASCII bytes marks the file as binary.
+            output: b"%PDF-1.4\n%\xe2\xe3\xcf\xd3\n".to_vec(),
+            offsets: vec![],
+        }
+    }
+
+    /// Write the next object, returning its object number. Objects are
+    /// numbered from 1 in the order they are written.
+    fn object<B: AsRef<[u8]>>(&mut self, body: B) -> usize {
+        self.offsets.push(self.output.len());
+        let number = self.offsets.len();
+        self.output
+            .extend_from_slice(format!("{} 0 obj\n", number).as_bytes());
+        self.output.extend_from_slice(body.as_ref());
+        self.output.extend_from_slice(b"\nendobj\n");
+        number
+    }
+
+    /// Write the next object as a stream containing `data`.
+    fn stream(&mut self, data: &[u8]) -> usize {
+        let mut body = format!("<< /Length {} >>\nstream\n", data.len()).into_bytes();
+        body.extend_from_slice(data);
+        body.extend_from_slice(b"\nendstream");
+        self.object(body)
+    }
+
+    /// Write the cross-reference table and trailer, using the objects `root`
+    /// and `info` as the document catalog and information dictionary.
+    fn finish(mut self, root: usize, info: usize) -> Vec<u8> {
+        let xref_offset = self.output.len();
+        let mut xref = format!("xref\n0 {}\n0000000000 65535 f \n", self.offsets.len() + 1);
+        for offset in &self.offsets {
+            write!(xref, "{:010} 00000 n \n", offset).unwrap();
+        }
+        write!(
+            xref,
+            "trailer\n<< /Size {} /Root {} 0 R /Info {} 0 R >>\nstartxref\n{}\n%%EOF\n",
+            self.offsets.len() + 1,
+            root,
+            info,
+            xref_offset
+        )
+        .unwrap();
+        self.output.extend_from_slice(xref.as_bytes());
+        self.output
+    }
+}
+
+/// Lay out `sheet` on a single page.
+fn render_sheet(page: &mut PageContent, sheet: &Sheet, layout: &PageLayout) {
+    let (width, height) = layout.paper.dimensions_mm();
+    let margin = layout.margin_mm;
+    let text_width = layout.content_width_mm();
+    let mut y = height - margin;
+
+    // Title, with the spot-check digits in the top-right corner.
+    y -= LINE_HEIGHT_MM;
+    page.text(sheet.title(), TITLE_FONT_SIZE, margin, y, Font::Title);
+    if let Some(spotcheck) = sheet.spotcheck() {
+        let spotcheck = format!("Spot-Check: {}", spotcheck);
+        let x = width - margin - spotcheck.len() as f64 * MONO_CHAR_WIDTH_MM;
+        page.text(spotcheck, TEXT_FONT_SIZE, x, y, Font::Mono);
+    }
+    y -= LINE_HEIGHT_MM;
+
+    // QR codes (or Data Matrix symbols), in a grid centred horizontally.
+    let codes = sheet.codes();
+    let columns = qr_grid_columns(codes.len());
+    let rows = (codes.len() + columns - 1) / columns;
+    let qr_size = layout.grid_size_mm();
+    let cell_size = qr_size / columns as f64;
+    for (idx, code) in codes.iter().enumerate() {
+        let quiet_zone = code.quiet_zone();
+        let modules = code.width() + 2 * quiet_zone;
+        let module_size = cell_size / modules as f64;
+        let qr_left = (width - qr_size) / 2.0
+            + (idx % columns) as f64 * cell_size
+            + quiet_zone as f64 * module_size;
+        let qr_top = y - (idx / columns) as f64 * cell_size - quiet_zone as f64 * module_size;
+        for (x, row) in code.dark_modules() {
+            page.rectangle(
+                qr_left + x as f64 * module_size,
+                qr_top - (row + 1) as f64 * module_size,
+                module_size,
+                module_size,
+            );
+        }
+    }
+    y -= rows as f64 * cell_size + LINE_HEIGHT_MM;
+
+    // Plain-text fallback, in the embedded font (which has the same metrics as
+    // the standard monospace font) if it has all of the characters.
+    for line in sheet.text_lines() {
+        let font = if ocrfont::covers(line) {
+            Font::Ocr
+        } else {
+            Font::Mono
+        };
+        page.text(line, TEXT_FONT_SIZE, margin, y, font);
+        y -= LINE_HEIGHT_MM;
+    }
+    if !sheet.text_lines().is_empty() {
+        y -= LINE_HEIGHT_MM;
+    }
+
+    // Human-readable details.
+    if layout.show_details {
+        for (name, value) in sheet.details() {
+            page.text(
+                format!("{}: {}", name, value),
+                TEXT_FONT_SIZE,
+                margin,
+                y,
+                Font::Mono,
+            );
+            y -= LINE_HEIGHT_MM;
+        }
+        y -= LINE_HEIGHT_MM;
+    }
+
+    // Instructions.
+    if layout.show_instructions {
+        let wrap_width = (text_width / TEXT_CHAR_WIDTH_MM) as usize;
+        for line in wrap_text(sheet.instructions(), wrap_width) {
+            page.text(line, TEXT_FONT_SIZE, margin, y, Font::Text);
+            y -= LINE_HEIGHT_MM;
+        }
+    }
+
+    // Detachable codeword section, at the bottom of the page.
+    if let Some(codewords) = sheet.codewords().filter(|_| layout.show_codewords) {
+        let mut y = margin + 7.0 * LINE_HEIGHT_MM;
+        page.rectangle(margin, y + LINE_HEIGHT_MM, text_width, 0.3);
+        page.text(
+            "Cut here to store the codewords separately.",
+            TEXT_FONT_SIZE - 2.0,
+            margin,
+            y + LINE_HEIGHT_MM + 1.5,
+            Font::Text,
+        );
+        // Identify which shard the codewords belong to.
+        for (name, value) in sheet.details().iter().take(2) {
+            y -= LINE_HEIGHT_MM;
+            page.text(
+                format!("{}: {}", name, value),
+                TEXT_FONT_SIZE,
+                margin,
+                y,
+                Font::Mono,
+            );
+        }
+        y -= LINE_HEIGHT_MM;
+        for words in codewords.chunks(6) {
+            y -= LINE_HEIGHT_MM;
+            page.text(words.join(" "), TEXT_FONT_SIZE, margin, y, Font::Mono);
+        }
+        if let Some(checksum) = sheet.codewords_checksum() {
+            y -= LINE_HEIGHT_MM;
+            page.text(
+                format!("Codeword-Checksum: #{}", checksum),
+                TEXT_FONT_SIZE,
+                margin,
+                y,
+                Font::Mono,
+            );
+        }
+    }
+}
+
+/// Render `sheets` as a PDF document with one page per sheet (followed by a
+/// blank page if `layout` is for duplex printing).
+///
+/// The document does not record when it was created, so the same `sheets`
+/// always produce exactly the same PDF (see also [`sheets_to_pdf_dated`]).
+pub fn sheets_to_pdf(title: &str, sheets: &[Sheet], layout: &PageLayout) -> Result<Vec<u8>, Error> {
+    write_pdf(title, None, sheets, layout)
+}
+
+/// Render `sheets` as a PDF document, as with [`sheets_to_pdf`], recording
+/// `created_at` as the creation date of the document. Using a fixed date (such
+/// as the creation date of the backup) keeps the output reproducible.
+pub fn sheets_to_pdf_dated(
+    title: &str,
+    sheets: &[Sheet],
+    layout: &PageLayout,
+    created_at: SystemTime,
+) -> Result<Vec<u8>, Error> {
+    write_pdf(title, Some(created_at), sheets, layout)
+}
+
+fn write_pdf(
+    title: &str,
+    created_at: Option<SystemTime>,
+    sheets: &[Sheet],
+    layout: &PageLayout,
+) -> Result<Vec<u8>, Error> {
+    layout.validate()?;
+    let (width, height) = layout.paper.dimensions_mm();
+
+    // The codewords are not written anywhere else, so printing them garbled
+    // would make the shard unrecoverable.
+    if let Some(word) = sheets
+        .iter()
+        .filter_map(Sheet::codewords)
+        .flatten()
+        .find(|word| !is_printable(word))
+    {
+        return Err(Error::Other(format!(
+            "codeword '{}' cannot be printed in a PDF (which only supports the Latin alphabet) -- use the HTML or SVG output, or a codeword language written in the Latin alphabet",
+            word
+        )));
+    }
+
+    let mut pages = vec![];
+    for sheet in sheets {
+        let mut page = PageContent::default();
+        render_sheet(&mut page, sheet, layout);
+        pages.push(page);
+        if layout.duplex {
+            pages.push(PageContent::default());
+        }
+    }
+
+    // The object numbers are fixed by the order the objects are written: the
+    // catalog, the page tree, the document information, the fonts, the glyph
+    // procedures of the embedded font and then each page followed by its
+    // contents.
+    const CATALOG: usize = 1;
+    const PAGE_TREE: usize = 2;
+    const FIRST_FONT: usize = 4;
+    let first_glyph = FIRST_FONT + Font::ALL.len();
+    let first_page = first_glyph + GLYPHS.len();
+    let page_object = |idx: usize| first_page + 2 * idx;
+
+    let mut pdf = PdfWriter::new();
+    pdf.object(format!("<< /Type /Catalog /Pages {} 0 R >>", PAGE_TREE));
+    pdf.object(format!(
+        "<< /Type /Pages /Kids [{}] /Count {} >>",
+        (0..pages.len())
+            .map(|idx| format!("{} 0 R", page_object(idx)))
+            .collect::<Vec<_>>()
+            .join(" "),
+        pages.len()
+    ));
+    let mut info = format!("<< /Title {} /Producer (paperback)", text_string(title));
+    if let Some(created_at) = created_at {
+        write!(info, " /CreationDate ({})", pdf_date(created_at)).unwrap();
+    }
+    info.push_str(" >>");
+    let info = pdf.object(info);
+    for font in &Font::ALL {
+        match font.base_font() {
+            Some(base_font) => pdf.object(format!(
+                "<< /Type /Font /Subtype /Type1 /BaseFont /{} /Encoding /WinAnsiEncoding >>",
+                base_font
+            )),
+            None => pdf.object(ocr_font(first_glyph)),
+        };
+    }
+    for glyph in GLYPHS {
+        pdf.stream(glyph.procedure().as_bytes());
+    }
+
+    let fonts = Font::ALL
+        .iter()
+        .enumerate()
+        .map(|(idx, font)| format!("/{} {} 0 R", font.resource_name(), FIRST_FONT + idx))
+        .collect::<Vec<_>>()
+        .join(" ");
+    for (idx, page) in pages.iter().enumerate() {
+        let number = pdf.object(format!(
+            "<< /Type /Page /Parent {} 0 R /MediaBox [0 0 {} {}] /Resources << /Font << {} >> >> /Contents {} 0 R >>",
+            PAGE_TREE,
+            points(width),
+            points(height),
+            fonts,
+            page_object(idx) + 1
+        ));
+        debug_assert_eq!(number, page_object(idx));
+        pdf.stream(page.0.as_bytes());
+    }
+
+    Ok(pdf.finish(CATALOG, info))
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{
+        codewords_checksum, Backup, BackupBuilder, PaperSize, QrErrorCorrection, SheetEncoding,
+        Symbology,
+    };
+
+    use std::time::Duration;
+
+    fn contains(haystack: &[u8], needle: &[u8]) -> bool {
+        haystack
+            .windows(needle.len())
+            .any(|window| window == needle)
+    }
+
+    #[test]
+    fn backup_pdf() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let (shard, codewords) = backup.next_shard().unwrap().encrypt().unwrap();
+        let level = QrErrorCorrection::default();
+        let sheets = vec![
+            Sheet::main_document(backup.main_document(), level).unwrap(),
+            Sheet::key_shard(&shard, &codewords, level)
+                .unwrap()
+                .encoding(SheetEncoding::QrAndText),
+            Sheet::key_shard(&shard, &codewords, level)
+                .unwrap()
+                .symbology(Symbology::DataMatrix),
+        ];
+
+        for paper in &[PaperSize::A4, PaperSize::Letter, PaperSize::A5] {
+            let pdf = sheets_to_pdf("paperback", &sheets, &PageLayout::new(*paper)).unwrap();
+            assert!(pdf.starts_with(b"%PDF-"));
+        }
+
+        let pdf = sheets_to_pdf("paperback", &sheets, &PageLayout::default()).unwrap();
+        let checksum = format!("(Codeword-Checksum: #{})", codewords_checksum(&codewords));
+        assert!(contains(&pdf, checksum.as_bytes()));
+        let spotcheck = format!("(Spot-Check: {})", sheets[0].spotcheck().unwrap());
+        assert!(contains(&pdf, spotcheck.as_bytes()));
+
+        // The plain-text fallback is printed in the embedded font.
+        assert!(contains(&pdf, b"/Subtype /Type3"));
+        assert!(contains(&pdf, b"/F4 10 Tf"));
+        let line = format!("{} Tj", literal_string(&sheets[1].text_lines()[0]));
+        assert!(contains(&pdf, line.as_bytes()));
+
+        let layout = PageLayout::new(PaperSize::A5)
+            .margin_mm(10.0)
+            .qr_size_mm(80.0)
+            .duplex(true)
+            .show_instructions(false)
+            .show_codewords(false);
+        let pdf = sheets_to_pdf("paperback", &sheets, &layout).unwrap();
+        assert!(pdf.starts_with(b"%PDF-"));
+        assert!(!contains(&pdf, checksum.as_bytes()));
+    }
+
+    #[test]
+    fn reproducible_pdf() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let sheets =
+            vec![
+                Sheet::main_document(backup.main_document(), QrErrorCorrection::default()).unwrap(),
+            ];
+        let layout = PageLayout::new(PaperSize::A4).duplex(true);
+
+        let pdf = sheets_to_pdf("paperback", &sheets, &layout).unwrap();
+        assert_eq!(
+            pdf,
+            sheets_to_pdf("paperback", &sheets, &layout).unwrap(),
+            "rendering the same sheets should give the same pdf"
+        );
+        assert!(!contains(&pdf, b"/CreationDate"));
+
+        let created_at = UNIX_EPOCH + Duration::from_secs(1_600_000_000);
+        let dated = sheets_to_pdf_dated("paperback", &sheets, &layout, created_at).unwrap();
+        assert_eq!(
+            dated,
+            sheets_to_pdf_dated("paperback", &sheets, &layout, created_at).unwrap(),
+            "rendering the same sheets should give the same pdf"
+        );
+        assert!(contains(&dated, b"/CreationDate (D:20200913122640Z)"));
+    }
+
+    #[test]
+    fn pdf_xref_offsets() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let sheets =
+            vec![
+                Sheet::main_document(backup.main_document(), QrErrorCorrection::default()).unwrap(),
+            ];
+        let pdf = sheets_to_pdf("paperback", &sheets, &PageLayout::new(PaperSize::A4)).unwrap();
+        // Replace the binary marker in the header, keeping the byte offsets.
+        let text = pdf
+            .iter()
+            .map(|&byte| if byte.is_ascii() { byte as char } else { '?' })
+            .collect::<String>();
+
+        let startxref = text.rfind("startxref\n").unwrap();
+        let xref_offset: usize = text[startxref..].lines().nth(1).unwrap().parse().unwrap();
+        assert!(text[xref_offset..].starts_with("xref\n"));
+
+        // Skip the "xref", subsection and free entry lines.
+        let entries = text[xref_offset..]
+            .lines()
+            .skip(3)
+            .take_while(|line| !line.starts_with("trailer"));
+        for (idx, entry) in entries.enumerate() {
+            assert_eq!(entry.len(), 19, "xref entries must be 20 bytes long");
+            let offset: usize = entry[..10].parse().unwrap();
+            assert!(
+                text[offset..].starts_with(&format!("{} 0 obj\n", idx + 1)),
+                "xref entry {} should point to its object",
+                idx + 1
+            );
+        }
+    }
+
+    #[test]
+    fn pdf_strings() {
+        assert_eq!(literal_string("plain text"), "(plain text)");
+        assert_eq!(literal_string(r"(a\b)"), r"(\(a\\b\))");
+        assert_eq!(literal_string("caf\u{e9} \u{2014}"), r"(caf\351 \227)");
+        assert_eq!(literal_string("\u{4e2d}\u{6587}"), "(??)");
+
+        assert_eq!(text_string("paperback"), "(paperback)");
+        assert_eq!(text_string("\u{4e2d}\u{6587}"), "<FEFF4E2D6587>");
+    }
+
+    #[test]
+    fn pdf_codeword_languages() {
+        for language in &CodewordLanguage::ALL {
+            let words = language.wordlist().wordlist().get_words_by_prefix("");
+            let supported = pdf_supports_language(*language);
+            for word in words {
+                // None of the wordlists contain "?", so any "?" in the output
+                // is a character which could not be encoded.
+                assert_eq!(
+                    !literal_string(word).contains('?'),
+                    supported,
+                    "{} codeword '{}'",
+                    language.name(),
+                    word
+                );
+            }
+
+            let backup = BackupBuilder::new(2)
+                .language(*language)
+                .build(b"secret data")
+                .unwrap();
+            let (shard, codewords) = backup.next_shard().unwrap().encrypt().unwrap();
+            let sheets =
+                vec![Sheet::key_shard(&shard, &codewords, QrErrorCorrection::default()).unwrap()];
+            let pdf = sheets_to_pdf("paperback", &sheets, &PageLayout::default());
+            if supported {
+                let pdf = pdf.unwrap();
+                for words in codewords.chunks(6) {
+                    let line = format!("{} Tj", literal_string(&words.join(" ")));
+                    assert!(contains(&pdf, line.as_bytes()));
+                }
+            } else {
+                pdf.unwrap_err();
+            }
+        }
+        for language in &[
+            CodewordLanguage::English,
+            CodewordLanguage::French,
+            CodewordLanguage::Italian,
+            CodewordLanguage::Spanish,
+        ] {
+            assert!(pdf_supports_language(*language));
+        }
+    }
+}
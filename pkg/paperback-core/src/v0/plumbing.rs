@@ -0,0 +1,197 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! Low-level primitives used to build a backup, exposed individually so that
+//! each stage of the pipeline can be exercised (and scripted) on its own.
+//!
+//! None of these functions provide the authentication which a complete
+//! backup does -- they are building blocks, and should not be used in place of
+//! [`Backup`](crate::v0::Backup) and [`UntrustedQuorum`](crate::v0::UntrustedQuorum).
+
+use crate::{
+    shamir::{self, Dealer, Shard},
+    v0::{
+        ChaChaPolyKey, ChaChaPolyNonce, Error, FromWire, ToWire, CHACHAPOLY_KEY_LENGTH,
+        CHACHAPOLY_NONCE_LENGTH,
+    },
+};
+
+use aead::{Aead, NewAead, Payload};
+use chacha20poly1305::ChaCha20Poly1305;
+use rand::{rngs::OsRng, RngCore};
+
+/// Split `secret` into `shards` Shamir shards, any `quorum_size` of which can
+/// be combined with [`combine_secret`] to recover it. The shards are returned
+/// in their wire encoding.
+pub fn split_secret(quorum_size: u32, shards: u32, secret: &[u8]) -> Result<Vec<Vec<u8>>, Error> {
+    if quorum_size == 0 || quorum_size > shards {
+        return Err(Error::Other(format!(
+            "quorum size {} is invalid for {} shards",
+            quorum_size, shards
+        )));
+    }
+    let dealer = Dealer::new(quorum_size, secret);
+    let mut ids = vec![];
+    let mut split = vec![];
+    while split.len() < shards as usize {
+        let shard = dealer.next_shard();
+        // Shards with the same x-value cannot be combined, so skip any repeats.
+        if ids.contains(&shard.id()) {
+            continue;
+        }
+        ids.push(shard.id());
+        split.push(shard.to_wire());
+    }
+    Ok(split)
+}
+
+/// Recover the secret from (wire-encoded) Shamir shards produced by
+/// [`split_secret`]. Repeated shards are ignored, and any shards beyond the
+/// quorum size are not used.
+pub fn combine_secret<B: AsRef<[u8]>>(shards: &[B]) -> Result<Vec<u8>, Error> {
+    let mut unique: Vec<Shard> = vec![];
+    for bytes in shards {
+        let shard = Shard::from_wire(bytes.as_ref())?;
+        if let Some(first) = unique.first() {
+            if !first.is_sister(&shard) {
+                return Err(Error::Other(
+                    "shards were not split from the same secret".into(),
+                ));
+            }
+        }
+        if !unique.iter().any(|other| other.id() == shard.id()) {
+            unique.push(shard);
+        }
+    }
+    let quorum_size = match unique.first() {
+        Some(shard) => shard.threshold() as usize,
+        None => return Err(Error::Other("no shards given".into())),
+    };
+    if unique.len() < quorum_size {
+        return Err(Error::Other(format!(
+            "{} unique shards are needed, but only {} were given",
+            quorum_size,
+            unique.len()
+        )));
+    }
+    unique.truncate(quorum_size);
+    Ok(shamir::recover_secret(unique)?)
+}
+
+/// Generate a new random key for [`seal_packet`].
+pub fn new_packet_key() -> Vec<u8> {
+    let mut key = ChaChaPolyKey::default();
+    OsRng.fill_bytes(&mut key);
+    key.to_vec()
+}
+
+fn packet_key(key: &[u8]) -> Result<&ChaChaPolyKey, Error> {
+    if key.len() != CHACHAPOLY_KEY_LENGTH {
+        return Err(Error::Other(format!(
+            "packet key must be {} bytes long (not {})",
+            CHACHAPOLY_KEY_LENGTH,
+            key.len()
+        )));
+    }
+    Ok(ChaChaPolyKey::from_slice(key))
+}
+
+/// Encrypt `plaintext` (and authenticate `aad`) with ChaCha20-Poly1305 under
+/// `key` -- the same construction used for the contents of a main document.
+/// Returns the randomly-generated nonce and the ciphertext.
+pub fn seal_packet(key: &[u8], aad: &[u8], plaintext: &[u8]) -> Result<(Vec<u8>, Vec<u8>), Error> {
+    let aead = ChaCha20Poly1305::new(packet_key(key)?);
+    let mut nonce = ChaChaPolyNonce::default();
+    OsRng.fill_bytes(&mut nonce);
+    let ciphertext = aead
+        .encrypt(
+            &nonce,
+            Payload {
+                msg: plaintext,
+                aad,
+            },
+        )
+        .map_err(Error::AeadEncryption)?;
+    Ok((nonce.to_vec(), ciphertext))
+}
+
+/// Decrypt a packet sealed with [`seal_packet`].
+pub fn open_packet(
+    key: &[u8],
+    nonce: &[u8],
+    aad: &[u8],
+    ciphertext: &[u8],
+) -> Result<Vec<u8>, Error> {
+    let aead = ChaCha20Poly1305::new(packet_key(key)?);
+    if nonce.len() != CHACHAPOLY_NONCE_LENGTH {
+        return Err(Error::Other(format!(
+            "packet nonce must be {} bytes long (not {})",
+            CHACHAPOLY_NONCE_LENGTH,
+            nonce.len()
+        )));
+    }
+    aead.decrypt(
+        ChaChaPolyNonce::from_slice(nonce),
+        Payload {
+            msg: ciphertext,
+            aad,
+        },
+    )
+    .map_err(Error::AeadDecryption)
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[quickcheck]
+    fn split_combine_roundtrip(secret: Vec<u8>) {
+        let shards = split_secret(3, 5, &secret).unwrap();
+        assert_eq!(shards.len(), 5);
+        assert_eq!(combine_secret(&shards[1..4]).unwrap(), secret);
+        assert_eq!(combine_secret(&shards).unwrap(), secret);
+
+        // Repeated shards do not count towards the quorum.
+        let repeated = vec![shards[0].clone(), shards[0].clone(), shards[1].clone()];
+        combine_secret(&repeated).unwrap_err();
+    }
+
+    #[test]
+    fn combine_mismatched() {
+        let a = split_secret(2, 2, b"secret one").unwrap();
+        let b = split_secret(3, 3, b"secret two").unwrap();
+        combine_secret(&[a[0].clone(), b[0].clone()]).unwrap_err();
+        combine_secret::<Vec<u8>>(&[]).unwrap_err();
+        split_secret(3, 2, b"secret").unwrap_err();
+    }
+
+    #[quickcheck]
+    fn packet_roundtrip(aad: Vec<u8>, plaintext: Vec<u8>) {
+        let key = new_packet_key();
+        let (nonce, ciphertext) = seal_packet(&key, &aad, &plaintext).unwrap();
+        assert_eq!(
+            open_packet(&key, &nonce, &aad, &ciphertext).unwrap(),
+            plaintext
+        );
+
+        let mut bad_aad = aad.clone();
+        bad_aad.push(0);
+        open_packet(&key, &nonce, &bad_aad, &ciphertext).unwrap_err();
+        open_packet(&new_packet_key(), &nonce, &aad, &ciphertext).unwrap_err();
+    }
+}
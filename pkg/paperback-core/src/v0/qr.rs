@@ -0,0 +1,321 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{paginate, DocumentKind, Error, FrameEncoding, FrameHeader, Framed, Page, PageSet};
+
+use qrcode::{bits::Bits, EcLevel, QrCode, Version};
+
+/// Largest (non-micro) QR code version.
+const MAX_QR_VERSION: i16 = 40;
+
+/// Error correction level of a QR code, which determines what fraction of the
+/// code can be damaged while still being readable.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub enum QrErrorCorrection {
+    /// Roughly 7% of the code can be restored.
+    Low,
+    /// Roughly 15% of the code can be restored.
+    Medium,
+    /// Roughly 25% of the code can be restored.
+    Quartile,
+    /// Roughly 30% of the code can be restored.
+    High,
+}
+
+impl Default for QrErrorCorrection {
+    fn default() -> Self {
+        // Paper documents are expected to be damaged over time.
+        Self::High
+    }
+}
+
+impl QrErrorCorrection {
+    /// Returns the number of bytes which fit in the largest QR code version
+    /// with this level of error correction (in binary mode).
+    pub fn max_bytes(self) -> usize {
+        match self {
+            Self::Low => 2953,
+            Self::Medium => 2331,
+            Self::Quartile => 1663,
+            Self::High => 1273,
+        }
+    }
+}
+
+impl From<QrErrorCorrection> for EcLevel {
+    fn from(level: QrErrorCorrection) -> Self {
+        match level {
+            QrErrorCorrection::Low => EcLevel::L,
+            QrErrorCorrection::Medium => EcLevel::M,
+            QrErrorCorrection::Quartile => EcLevel::Q,
+            QrErrorCorrection::High => EcLevel::H,
+        }
+    }
+}
+
+/// Generate a QR code containing `data` in binary (byte) mode, using the
+/// smallest QR code version which can hold the data.
+pub fn binary_qr<B: AsRef<[u8]>>(data: B, level: QrErrorCorrection) -> Result<QrCode, Error> {
+    let data = data.as_ref();
+    let ec_level = level.into();
+    for version in 1..=MAX_QR_VERSION {
+        let mut bits = Bits::new(Version::Normal(version));
+        // Too much data for this version, so try the next one.
+        if bits.push_byte_data(data).is_err() || bits.push_terminator(ec_level).is_err() {
+            continue;
+        }
+        return QrCode::with_bits(bits, ec_level).map_err(Error::QrEncode);
+    }
+    Err(Error::Other(format!(
+        "{} bytes is too large for a single qr code with {:?} error correction",
+        data.len(),
+        level
+    )))
+}
+
+/// Generate a QR code containing the raw framed representation of `document`,
+/// so that the type of document can be identified when it is scanned.
+pub fn document_qr<T: Framed>(document: &T, level: QrErrorCorrection) -> Result<QrCode, Error> {
+    binary_qr(document.to_framed(FrameEncoding::Raw), level)
+}
+
+/// Generate the QR codes for `document`.
+///
+/// If the framed document fits in a single QR code, only one QR code is
+/// generated (as with [`document_qr`]). Otherwise the framed document is split
+/// into [`Page`]s, each of which identifies the document it belongs to (by its
+/// checksum), its position and the total number of pages, and has its own
+/// checksum. The pages can be scanned in any order and reassembled with a
+/// [`QrAssembler`].
+pub fn document_qr_codes<T: Framed>(
+    document: &T,
+    level: QrErrorCorrection,
+) -> Result<Vec<QrCode>, Error> {
+    document_payloads(document, level.max_bytes())
+        .iter()
+        .map(|payload| binary_qr(payload, level))
+        .collect()
+}
+
+/// Returns the contents of each code needed to hold `document`, where each code
+/// can hold at most `max_bytes`: either the raw framed document, or the raw
+/// framed [`Page`]s it is split into.
+pub(crate) fn document_payloads<T: Framed>(document: &T, max_bytes: usize) -> Vec<Vec<u8>> {
+    let framed = document.to_framed(FrameEncoding::Raw);
+    if framed.len() <= max_bytes {
+        return vec![framed];
+    }
+
+    // Work out how much of each code is taken up by the page header, using a
+    // page that is as large as possible (so the length prefix is as large as
+    // it can be).
+    let overhead = paginate(vec![0; max_bytes], max_bytes)[0]
+        .to_framed(FrameEncoding::Raw)
+        .len()
+        - max_bytes;
+    paginate(framed, max_bytes - overhead)
+        .iter()
+        .map(|page| page.to_framed(FrameEncoding::Raw))
+        .collect()
+}
+
+/// Reassembles a document from the scanned contents of the QR codes produced
+/// by [`document_qr_codes`], which may be scanned in any order (and may be
+/// scanned more than once). The Data Matrix symbols and Aztec codes produced
+/// by [`document_datamatrix_codes`](crate::v0::document_datamatrix_codes) and
+/// [`document_aztec_codes`](crate::v0::document_aztec_codes) contain the same
+/// framed documents and pages, so their scanned contents can be added in
+/// exactly the same way.
+#[derive(Clone, Debug, Default)]
+pub struct QrAssembler {
+    document: Option<Vec<u8>>,
+    pages: PageSet,
+}
+
+impl QrAssembler {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Add the contents of a scanned QR code.
+    pub fn push<B: AsRef<[u8]>>(&mut self, scanned: B) -> Result<(), Error> {
+        let scanned = scanned.as_ref();
+        let (header, _) = FrameHeader::parse(scanned)?;
+        if header.kind() == DocumentKind::Page {
+            return self.pages.push(Page::from_framed(scanned)?);
+        }
+
+        // The whole document was in a single QR code.
+        match self.document {
+            Some(ref document) if document != scanned => Err(Error::PageAssembly(
+                "qr code contains a different document".into(),
+            )),
+            _ => {
+                self.document = Some(scanned.to_vec());
+                Ok(())
+            }
+        }
+    }
+
+    /// Returns the total number of QR codes the document was split into, if
+    /// any have been scanned.
+    pub fn total(&self) -> Option<u32> {
+        match self.document {
+            Some(_) => Some(1),
+            None => self.pages.total(),
+        }
+    }
+
+    /// Returns the (one-indexed) numbers of the QR codes which have not been
+    /// scanned yet.
+    pub fn missing(&self) -> Vec<u32> {
+        match self.document {
+            Some(_) => vec![],
+            None => self.pages.missing(),
+        }
+    }
+
+    /// Returns whether every QR code of the document has been scanned.
+    pub fn is_complete(&self) -> bool {
+        self.total().is_some() && self.missing().is_empty()
+    }
+
+    /// Reassemble and decode the document.
+    pub fn assemble<T: Framed>(&self) -> Result<T, Error> {
+        let framed = match self.document {
+            Some(ref document) => document.clone(),
+            None => self.pages.assemble()?,
+        };
+        Ok(T::from_framed(framed)?)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{Backup, MainDocument};
+
+    fn version_number(code: &QrCode) -> i16 {
+        match code.version() {
+            Version::Normal(version) => version,
+            Version::Micro(_) => panic!("micro qr codes are never generated"),
+        }
+    }
+
+    #[test]
+    fn binary_qr_sizing() {
+        // A version 1 code with low error correction holds 17 bytes.
+        let code = binary_qr([0xa5; 17], QrErrorCorrection::Low).unwrap();
+        assert_eq!(version_number(&code), 1);
+        assert_eq!(code.width(), 21);
+        assert_eq!(code.error_correction_level(), EcLevel::L);
+
+        let code = binary_qr([0xa5; 18], QrErrorCorrection::Low).unwrap();
+        assert_eq!(version_number(&code), 2);
+
+        // A version 40 code with high error correction holds 1273 bytes.
+        let code = binary_qr(vec![0xa5; 1273], QrErrorCorrection::High).unwrap();
+        assert_eq!(version_number(&code), 40);
+        binary_qr(vec![0xa5; 1274], QrErrorCorrection::High).unwrap_err();
+    }
+
+    #[quickcheck]
+    fn document_qr_smallest(main: MainDocument) -> bool {
+        let level = QrErrorCorrection::default();
+        let code = document_qr(&main, level).unwrap();
+        let version = version_number(&code);
+
+        // The code must not fit in a smaller version.
+        let mut bits = Bits::new(Version::Normal(version - 1));
+        version == 1
+            || bits
+                .push_byte_data(&main.to_framed(FrameEncoding::Raw))
+                .and_then(|_| bits.push_terminator(level.into()))
+                .is_err()
+    }
+
+    #[test]
+    fn max_bytes_known() {
+        for level in &[
+            QrErrorCorrection::Low,
+            QrErrorCorrection::Medium,
+            QrErrorCorrection::Quartile,
+            QrErrorCorrection::High,
+        ] {
+            binary_qr(vec![0; level.max_bytes()], *level).unwrap();
+            binary_qr(vec![0; level.max_bytes() + 1], *level).unwrap_err();
+        }
+    }
+
+    #[test]
+    fn chunked_document() {
+        // The secret is too large for a single qr code.
+        let level = QrErrorCorrection::High;
+        let secret = (0..4000).map(|i| (i * 7) as u8).collect::<Vec<_>>();
+        let backup = Backup::new(2, &secret).unwrap();
+        let main = backup.main_document();
+        let framed = main.to_framed(FrameEncoding::Raw);
+        assert!(framed.len() > level.max_bytes());
+
+        let codes = document_qr_codes(main, level).unwrap();
+        assert!(codes.len() > 1);
+
+        // Scan the pages out of order (and one of them twice).
+        let pages = paginate(&framed, level.max_bytes() - 100);
+        let mut assembler = QrAssembler::new();
+        assert_eq!(assembler.total(), None);
+        assert!(!assembler.is_complete());
+        for page in pages.iter().rev().skip(1) {
+            assembler.push(page.to_framed(FrameEncoding::Raw)).unwrap();
+        }
+        assembler
+            .push(pages[1].to_framed(FrameEncoding::Raw))
+            .unwrap();
+        assert_eq!(assembler.total(), Some(pages.len() as u32));
+        assert_eq!(assembler.missing(), vec![pages.len() as u32]);
+        assembler.assemble::<MainDocument>().unwrap_err();
+
+        assembler
+            .push(pages.last().unwrap().to_framed(FrameEncoding::Raw))
+            .unwrap();
+        assert!(assembler.is_complete());
+        assert_eq!(&assembler.assemble::<MainDocument>().unwrap(), main);
+
+        // A page from a different document is rejected.
+        let other = Backup::new(2, &secret).unwrap();
+        let other_pages = paginate(other.main_document().to_framed(FrameEncoding::Raw), 1000);
+        assembler
+            .push(other_pages[0].to_framed(FrameEncoding::Raw))
+            .unwrap_err();
+    }
+
+    #[test]
+    fn single_document() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let main = backup.main_document();
+        let codes = document_qr_codes(main, QrErrorCorrection::default()).unwrap();
+        assert_eq!(codes.len(), 1);
+
+        let mut assembler = QrAssembler::new();
+        assembler.push(main.to_framed(FrameEncoding::Raw)).unwrap();
+        assert!(assembler.is_complete());
+        assert_eq!(assembler.total(), Some(1));
+        assert_eq!(&assembler.assemble::<MainDocument>().unwrap(), main);
+    }
+}
@@ -18,18 +18,20 @@
 
 use crate::{
     shamir::{self, Dealer},
-    v0::{Error, FromWire, KeyShard, KeyShardBuilder, MainDocument, ShardSecret},
+    v0::{
+        DocumentDates, Error, FromWire, KeyShard, KeyShardBuilder, MainDocument, RosterEntry,
+        ShardAudit, ShardId, ShardIssuance, ShardOptions, ShardRevocation, ShardRoster,
+        ShardSecret, CHECKSUM_ALGORITHM,
+    },
 };
 
 use std::{
-    collections::HashMap,
+    collections::{HashMap, HashSet},
     hash::{Hash, Hasher},
 };
 
-use aead::{Aead, NewAead, Payload};
-use chacha20poly1305::ChaCha20Poly1305;
 use ed25519_dalek::{Keypair, PublicKey};
-use multihash::Multihash;
+use multihash::{Multihash, MultihashDigest};
 
 #[derive(Debug, Clone)]
 pub enum Type {
@@ -57,11 +59,7 @@ impl Type {
 
 impl From<MainDocument> for Type {
     fn from(main: MainDocument) -> Self {
-        let id_public_key = main.identity.id_public_key;
-        match id_public_key.verify_strict(
-            &main.inner.signable_bytes(&id_public_key),
-            &main.identity.id_signature,
-        ) {
+        match main.verify_signature() {
             Ok(_) => Type::MainDocument(main),
             Err(_) => Type::ForgedMainDocument(main),
         }
@@ -70,11 +68,7 @@ impl From<MainDocument> for Type {
 
 impl From<KeyShard> for Type {
     fn from(shard: KeyShard) -> Self {
-        let id_public_key = shard.identity.id_public_key;
-        match id_public_key.verify_strict(
-            &shard.inner.signable_bytes(&id_public_key),
-            &shard.identity.id_signature,
-        ) {
+        match shard.verify_signature() {
             Ok(_) => Type::KeyShard(shard),
             Err(_) => Type::ForgedKeyShard(shard),
         }
@@ -121,11 +115,55 @@ pub struct InconsistentQuorumError {
 }
 
 impl InconsistentQuorumError {
+    pub fn message(&self) -> &str {
+        &self.message
+    }
+
     pub fn as_groups(&self) -> &Grouping {
         &self.groups
     }
 }
 
+/// Split `documents` into groups of documents which agree on everything that
+/// identifies the backup they belong to. The groups are in no particular order.
+pub(crate) fn group_by_backup<I: IntoIterator<Item = Type>>(documents: I) -> Vec<Vec<Type>> {
+    #[derive(Clone, Debug, Eq, Hash, PartialEq)]
+    struct GroupId {
+        // All documents must agree on the paperback version. This could be
+        // faked by an attacker but this is just a sanity-check.
+        version: u32,
+        // All documents must agree on the document checksum.
+        doc_chksum: Multihash,
+        // All documents must agree on quorum size.
+        quorum_size: u32,
+        // All documents must use the same public key for their identity.
+        id_public_key: HashablePublicKey,
+    }
+
+    let mut groups: HashMap<GroupId, Vec<Type>> = HashMap::new();
+    for document in documents {
+        let group_id = match &document {
+            Type::MainDocument(main) | Type::ForgedMainDocument(main) => GroupId {
+                version: main.inner.meta.version,
+                doc_chksum: main.checksum(),
+                quorum_size: main.quorum_size(),
+                id_public_key: HashablePublicKey(main.identity.id_public_key),
+            },
+            Type::KeyShard(shard) | Type::ForgedKeyShard(shard) => GroupId {
+                version: shard.inner.version,
+                doc_chksum: shard.document_checksum(),
+                quorum_size: shard.inner.shard.threshold(),
+                id_public_key: HashablePublicKey(shard.identity.id_public_key),
+            },
+        };
+        groups
+            .entry(group_id)
+            .or_insert_with(Vec::new)
+            .push(document);
+    }
+    groups.into_iter().map(|(_, group)| group).collect()
+}
+
 impl UntrustedQuorum {
     pub fn new() -> Self {
         Default::default()
@@ -136,55 +174,29 @@ impl UntrustedQuorum {
         self
     }
 
+    /// Returns whether a copy of `shard` (a key shard with the same x value
+    /// from the same backup, such as a photocopy or a second scan of the same
+    /// page) has already been added. Copies of a shard do not count towards
+    /// the quorum, and make [`validate`](Self::validate) fail.
+    pub fn contains_shard(&self, shard: &KeyShard) -> bool {
+        self.untrusted_shards.iter().any(|other| {
+            other.id() == shard.id() && other.identity.id_public_key == shard.identity.id_public_key
+        })
+    }
+
     pub fn main_document(&mut self, main: MainDocument) -> &mut Self {
         self.untrusted_main_document = Some(main);
         self
     }
 
     fn group(&self) -> Vec<Vec<Type>> {
-        let documents = self
-            .untrusted_main_document
-            .iter()
-            .cloned()
-            .map(Type::from)
-            .chain(self.untrusted_shards.iter().cloned().map(Type::from))
-            .collect::<Vec<_>>();
-
-        #[derive(Clone, Debug, Eq, Hash, PartialEq)]
-        struct GroupId {
-            // All documents must agree on the paperback version. This could be
-            // faked by an attacker but this is just a sanity-check.
-            version: u32,
-            // All documents must agree on the document checksum.
-            doc_chksum: Multihash,
-            // All documents must agree on quorum size.
-            quorum_size: u32,
-            // All documents must use the same public key for their identity.
-            id_public_key: HashablePublicKey,
-        }
-
-        let mut groups: HashMap<GroupId, Vec<Type>> = HashMap::new();
-        for document in documents {
-            let group_id = match &document {
-                Type::MainDocument(main) | Type::ForgedMainDocument(main) => GroupId {
-                    version: main.inner.meta.version,
-                    doc_chksum: main.checksum(),
-                    quorum_size: main.quorum_size(),
-                    id_public_key: HashablePublicKey(main.identity.id_public_key),
-                },
-                Type::KeyShard(shard) | Type::ForgedKeyShard(shard) => GroupId {
-                    version: shard.inner.version,
-                    doc_chksum: shard.document_checksum(),
-                    quorum_size: shard.inner.shard.threshold(),
-                    id_public_key: HashablePublicKey(shard.identity.id_public_key),
-                },
-            };
-            groups
-                .entry(group_id)
-                .or_insert_with(Vec::new)
-                .push(document);
-        }
-        groups.values().cloned().collect::<Vec<_>>()
+        group_by_backup(
+            self.untrusted_main_document
+                .iter()
+                .cloned()
+                .map(Type::from)
+                .chain(self.untrusted_shards.iter().cloned().map(Type::from)),
+        )
     }
 
     pub fn validate(self) -> Result<Quorum, InconsistentQuorumError> {
@@ -246,27 +258,60 @@ impl UntrustedQuorum {
         // Collect the Quorum's id_public_key and doc_chksum, then double-check
         // the values match everything else. If we have no main document, just
         // use the first shard's values.
-        let (version, id_public_key, doc_chksum) = if let Some(ref main_document) = main_document {
-            (
-                main_document.inner.meta.version,
-                main_document.identity.id_public_key,
-                main_document.checksum(),
-            )
-        } else if let Some(shard) = shards.iter().next() {
-            (
-                shard.inner.version,
-                shard.identity.id_public_key,
-                shard.document_checksum(),
-            )
-        } else {
+        let (version, id_public_key, doc_chksum, dates) =
+            if let Some(ref main_document) = main_document {
+                (
+                    main_document.inner.meta.version,
+                    main_document.identity.id_public_key,
+                    main_document.checksum(),
+                    main_document.inner.meta.dates,
+                )
+            } else if let Some(shard) = shards.iter().next() {
+                (
+                    shard.inner.version,
+                    shard.identity.id_public_key,
+                    shard.document_checksum(),
+                    shard.inner.dates,
+                )
+            } else {
+                return Err(InconsistentQuorumError {
+                    message: "[internal error] no main documents or shards present in quorum"
+                        .to_string(),
+                    groups: Grouping(groups),
+                });
+            };
+
+        // Only key shards carry a timestamp token or roster, so use the first
+        // shard's.
+        let timestamp_token = shards
+            .first()
+            .and_then(|shard| shard.inner.timestamp_token.clone());
+        // Expanded shards carry a roster which has been extended with the new
+        // shards, so the rosters are merged rather than compared. Either all
+        // shards or none of them must have a roster.
+        let roster = shards.first().and_then(|shard| shard.inner.roster.clone());
+        let roster = roster.map(|roster| {
+            shards
+                .iter()
+                .filter_map(|shard| shard.inner.roster.as_ref())
+                .fold(roster, |merged, roster| merged.merge(roster))
+        });
+
+        assert_eq!(shards.len(), self.untrusted_shards.len());
+
+        // Copies of the same shard would otherwise only be caught when the
+        // shamir layer fails to interpolate the secret, so report them here.
+        let unique_shards = shards.iter().map(KeyShard::id).collect::<HashSet<_>>();
+        if unique_shards.len() != shards.len() {
             return Err(InconsistentQuorumError {
-                message: "[internal error] no main documents or shards present in quorum"
-                    .to_string(),
+                message: format!(
+                    "{} key shard(s) are copies of another shard, and do not count towards the quorum",
+                    shards.len() - unique_shards.len()
+                ),
                 groups: Grouping(groups),
             });
-        };
+        }
 
-        assert_eq!(shards.len(), self.untrusted_shards.len());
         // TODO: Maybe make a trait for this -- QuorumVerifiable?
         if let Some(ref main_document) = main_document {
             // XXX: Should probably support having more shards than needed, and have
@@ -296,6 +341,9 @@ impl UntrustedQuorum {
             if shard.document_checksum() != doc_chksum
                 || shard.identity.id_public_key != id_public_key
                 || shard.inner.version != version
+                || shard.inner.dates != dates
+                || shard.inner.timestamp_token != timestamp_token
+                || shard.inner.roster.is_some() != roster.is_some()
             {
                 return Err(InconsistentQuorumError {
                     message: "shard has inconsistent identity".to_string(),
@@ -312,6 +360,9 @@ impl UntrustedQuorum {
             version,
             id_public_key,
             doc_chksum,
+            dates,
+            timestamp_token,
+            roster,
         })
     }
 }
@@ -324,6 +375,9 @@ pub struct Quorum {
     version: u32,
     id_public_key: PublicKey,
     doc_chksum: Multihash,
+    dates: DocumentDates,
+    timestamp_token: Option<Vec<u8>>,
+    roster: Option<ShardRoster>,
 }
 
 impl Quorum {
@@ -353,17 +407,71 @@ impl Quorum {
             }
         }
 
-        // Decrypt the contents.
-        let aead = ChaCha20Poly1305::new(&secret.doc_key);
-        let payload = Payload {
-            msg: &main_document.inner.ciphertext,
-            aad: &main_document.inner.meta.aad(&self.id_public_key),
-        };
-        aead.decrypt(&main_document.inner.nonce, payload)
-            .map_err(Error::AeadDecryption)
+        // Decrypt the contents. The main document was checked to have the
+        // quorum's public key when the quorum was validated.
+        main_document.decrypt_contents(&secret.doc_key)
+    }
+
+    /// Conduct a complete recovery (as with [`recover_document`]) but only
+    /// return the Blake2b-256 checksum of the recovered secret data, so that
+    /// recovery can be rehearsed without exposing the secret data.
+    ///
+    /// [`recover_document`]: Self::recover_document
+    pub fn recovered_checksum(&self) -> Result<Multihash, Error> {
+        let secret = self.recover_document()?;
+        Ok(CHECKSUM_ALGORITHM.digest(&secret))
+    }
+
+    /// Returns the ids of all shards in the quorum which were not part of the
+    /// set of shards committed to by the main document. If the quorum has no
+    /// main document, or the main document has no shard commitment, no shards
+    /// can be checked and `None` is returned.
+    pub fn uncommitted_shards(&self) -> Option<Vec<ShardId>> {
+        let main_document = self.main_document.as_ref()?;
+        if !main_document.has_shard_commitment() {
+            return None;
+        }
+        Some(
+            self.shards
+                .iter()
+                .filter(|shard| main_document.verify_shard_commitment(shard).is_err())
+                .map(KeyShard::id)
+                .collect(),
+        )
+    }
+
+    /// Returns the number of times the set of key shards has been expanded,
+    /// as recorded by the shards in the quorum. Any value other than `0` means
+    /// that some of the shards were minted after the backup was created. If
+    /// none of the shards have an issuance record, `None` is returned.
+    pub fn expansions(&self) -> Option<u32> {
+        self.shards
+            .iter()
+            .filter_map(KeyShard::issuance)
+            .map(|issuance| issuance.generation)
+            .max()
+    }
+
+    /// Returns the number of key shards known to have been issued, based on
+    /// the issuance records of the shards in the quorum. Shards minted by
+    /// other quorums are not visible, so this is only a lower bound. If none of
+    /// the shards have an issuance record, `None` is returned.
+    pub fn shards_issued(&self) -> Option<u32> {
+        self.shards
+            .iter()
+            .filter_map(KeyShard::issuance)
+            .map(|issuance| issuance.serial)
+            .max()
     }
 
     pub fn extend_shards(&self, n: u32) -> Result<Vec<KeyShard>, Error> {
+        self.extend_shards_with(vec![ShardOptions::new(); n as usize])
+    }
+
+    /// Create a new key shard for each of `options`, with the per-shard
+    /// metadata in those options.
+    pub fn extend_shards_with(&self, options: Vec<ShardOptions>) -> Result<Vec<KeyShard>, Error> {
+        let n = options.len() as u32;
         let shards = self
             .shards
             .iter()
@@ -394,13 +502,66 @@ impl Quorum {
             public: id_public_key,
         };
 
+        // New shards are a new generation, and continue on from the highest
+        // serial we know of. Older shards have no issuance record, in which
+        // case the best guess is the size of the roster (if there is one).
+        let generation = self.expansions().map_or(1, |gen| gen + 1);
+        let serial_base = self
+            .shards_issued()
+            .or_else(|| self.roster.as_ref().map(ShardRoster::total))
+            .unwrap_or(0);
+
+        // If there is a roster, the new shards are added to it (along with
+        // their holder hints, if any) so that the new shards list every shard
+        // we know of.
+        let new_shards = (0..n).map(|_| dealer.next_shard()).collect::<Vec<_>>();
+        let roster = self.roster.as_ref().map(|roster| ShardRoster {
+            entries: roster
+                .entries
+                .iter()
+                .cloned()
+                .chain(
+                    new_shards
+                        .iter()
+                        .zip(&options)
+                        .map(|(shard, options)| RosterEntry {
+                            shard_id: shard.id(),
+                            holder: options.holder.clone().unwrap_or_default(),
+                        }),
+                )
+                .collect(),
+        });
+        // Any revocation record (from re-sharding) is carried over as-is.
+        let revocation = self.shards.iter().find_map(KeyShard::revocation).cloned();
+        // New shards use the same codeword language as the existing shards.
+        let language = self.shards.iter().find_map(|shard| shard.inner.language);
+
         // Extend new shards.
         Ok((0..n)
-            .map(|_| {
+            .zip(new_shards)
+            .zip(options)
+            .map(|((idx, shard), options)| {
+                let audit = ShardAudit::generate(&id_keypair, &self.doc_chksum, &shard.id());
                 KeyShardBuilder {
                     version: self.version,
                     doc_chksum: self.doc_chksum,
-                    shard: dealer.next_shard(),
+                    shard,
+                    dates: self.dates,
+                    audit: Some(audit),
+                    // Expanded shards were not part of the committed shard set.
+                    commitment: None,
+                    timestamp_token: self.timestamp_token.clone(),
+                    roster: roster.clone(),
+                    label: options.label,
+                    holder: options.holder,
+                    issuance: Some(ShardIssuance {
+                        generation,
+                        serial: serial_base + idx + 1,
+                    }),
+                    revocation: revocation.clone(),
+                    contact: options.contact,
+                    note: options.note,
+                    language,
                 }
                 .sign(&id_keypair)
             })
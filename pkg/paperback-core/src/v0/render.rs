@@ -0,0 +1,772 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{
+    aztec::AZTEC_QUIET_ZONE, codewords_checksum, datamatrix::DATAMATRIX_QUIET_ZONE,
+    document_aztec_codes, document_datamatrix_codes, document_qr_codes, document_text_lines,
+    spotcheck_digits, AztecCode, CodewordLanguage, DataMatrix, EncryptedKeyShard, Error, Framed,
+    KeyShardCodewords, MainDocument, QrErrorCorrection,
+};
+
+use qrcode::{Color, QrCode};
+
+/// Size of the paper documents are laid out on.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub enum PaperSize {
+    /// ISO 216 A4 (210mm by 297mm).
+    A4,
+    /// US Letter (8.5in by 11in).
+    Letter,
+    /// ISO 216 A5 (148mm by 210mm).
+    A5,
+}
+
+impl Default for PaperSize {
+    fn default() -> Self {
+        Self::A4
+    }
+}
+
+impl PaperSize {
+    /// Returns the (width, height) of the paper in millimetres.
+    pub fn dimensions_mm(self) -> (f64, f64) {
+        match self {
+            Self::A4 => (210.0, 297.0),
+            Self::Letter => (215.9, 279.4),
+            Self::A5 => (148.0, 210.0),
+        }
+    }
+}
+
+/// Default margin around the edge of each page.
+pub(crate) const DEFAULT_MARGIN_MM: f64 = 20.0;
+
+/// Default (and largest) size of the QR code grid on each page.
+pub(crate) const DEFAULT_QR_SIZE_MM: f64 = 130.0;
+
+/// Smallest width left for the contents of a page once the margins are
+/// removed.
+const MIN_CONTENT_WIDTH_MM: f64 = 80.0;
+
+/// Smallest size of the QR code grid which is still reliably scannable.
+const MIN_QR_SIZE_MM: f64 = 30.0;
+
+/// Page layout used when rendering [`Sheet`]s, shared by all of the output
+/// formats.
+///
+/// By default, documents are laid out single-sided on A4 paper with 20mm
+/// margins and a 130mm QR code, with all elements of each sheet shown.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub struct PageLayout {
+    pub(crate) paper: PaperSize,
+    pub(crate) margin_mm: f64,
+    pub(crate) qr_size_mm: f64,
+    pub(crate) duplex: bool,
+    pub(crate) show_details: bool,
+    pub(crate) show_instructions: bool,
+    pub(crate) show_codewords: bool,
+}
+
+impl Default for PageLayout {
+    fn default() -> Self {
+        Self::new(PaperSize::default())
+    }
+}
+
+impl From<PaperSize> for PageLayout {
+    fn from(paper: PaperSize) -> Self {
+        Self::new(paper)
+    }
+}
+
+impl PageLayout {
+    /// Construct the default layout for `paper`.
+    pub fn new(paper: PaperSize) -> Self {
+        Self {
+            paper,
+            margin_mm: DEFAULT_MARGIN_MM,
+            qr_size_mm: DEFAULT_QR_SIZE_MM,
+            duplex: false,
+            show_details: true,
+            show_instructions: true,
+            show_codewords: true,
+        }
+    }
+
+    /// Set the margin around the edge of each page, in millimetres.
+    pub fn margin_mm(mut self, margin_mm: f64) -> Self {
+        self.margin_mm = margin_mm;
+        self
+    }
+
+    /// Set the size of the QR code grid on each page, in millimetres. The
+    /// grid is shrunk to fit between the margins if necessary.
+    pub fn qr_size_mm(mut self, qr_size_mm: f64) -> Self {
+        self.qr_size_mm = qr_size_mm;
+        self
+    }
+
+    /// Set whether the documents will be printed double-sided. If so, each
+    /// sheet is followed by a blank page so that every document is printed on
+    /// its own piece of paper (and the key shards can be handed out, or have
+    /// their codewords cut off, without affecting any other document).
+    pub fn duplex(mut self, duplex: bool) -> Self {
+        self.duplex = duplex;
+        self
+    }
+
+    /// Set whether the human-readable details (such as the document and shard
+    /// identifiers) are shown.
+    pub fn show_details(mut self, show: bool) -> Self {
+        self.show_details = show;
+        self
+    }
+
+    /// Set whether the recovery instructions are shown.
+    pub fn show_instructions(mut self, show: bool) -> Self {
+        self.show_instructions = show;
+        self
+    }
+
+    /// Set whether the detachable codeword section of key shards is shown.
+    /// If it is hidden, the codewords must be stored some other way.
+    pub fn show_codewords(mut self, show: bool) -> Self {
+        self.show_codewords = show;
+        self
+    }
+
+    /// Returns the paper size.
+    pub fn paper(&self) -> PaperSize {
+        self.paper
+    }
+
+    /// Check that the documents can be laid out with this layout, namely that
+    /// the margins leave enough room for the contents and that the QR codes
+    /// are not too small to be scanned.
+    pub fn validate(&self) -> Result<(), Error> {
+        let (width, height) = self.paper.dimensions_mm();
+        if !(self.margin_mm >= 0.0)
+            || width.min(height) - 2.0 * self.margin_mm < MIN_CONTENT_WIDTH_MM
+        {
+            return Err(Error::Other(format!(
+                "page margin of {}mm leaves less than {}mm for the contents of a {:?} page",
+                self.margin_mm, MIN_CONTENT_WIDTH_MM, self.paper
+            )));
+        }
+        if !(self.qr_size_mm >= MIN_QR_SIZE_MM) {
+            return Err(Error::Other(format!(
+                "qr code size of {}mm is smaller than the minimum of {}mm",
+                self.qr_size_mm, MIN_QR_SIZE_MM
+            )));
+        }
+        Ok(())
+    }
+
+    /// Returns the width of the contents of each page (the paper width without
+    /// the margins).
+    pub(crate) fn content_width_mm(&self) -> f64 {
+        self.paper.dimensions_mm().0 - 2.0 * self.margin_mm
+    }
+
+    /// Returns the size of the QR code grid, shrunk to fit between the margins
+    /// if necessary.
+    pub(crate) fn grid_size_mm(&self) -> f64 {
+        self.content_width_mm().min(self.qr_size_mm)
+    }
+}
+
+/// How the contents of a document are printed on a [`Sheet`].
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub enum SheetEncoding {
+    /// Only print the QR codes.
+    Qr,
+    /// Print the QR codes, with the plain-text fallback (see
+    /// [`document_text_lines`](crate::v0::document_text_lines)) beneath them.
+    QrAndText,
+    /// Only print the plain-text fallback.
+    Text,
+}
+
+impl Default for SheetEncoding {
+    fn default() -> Self {
+        Self::Qr
+    }
+}
+
+/// Which kind of 2D barcode documents are printed as.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub enum Symbology {
+    /// QR codes (see [`document_qr_codes`](crate::v0::document_qr_codes)).
+    Qr,
+    /// Data Matrix symbols (see
+    /// [`document_datamatrix_codes`](crate::v0::document_datamatrix_codes)).
+    DataMatrix,
+    /// Aztec codes (see
+    /// [`document_aztec_codes`](crate::v0::document_aztec_codes)).
+    Aztec,
+}
+
+impl Default for Symbology {
+    fn default() -> Self {
+        Self::Qr
+    }
+}
+
+/// A 2D barcode containing (part of) a document, of any [`Symbology`].
+#[derive(Clone, Debug)]
+pub enum Barcode {
+    Qr(QrCode),
+    DataMatrix(DataMatrix),
+    Aztec(AztecCode),
+}
+
+impl Barcode {
+    /// Returns the symbology of the barcode.
+    pub fn symbology(&self) -> Symbology {
+        match self {
+            Self::Qr(_) => Symbology::Qr,
+            Self::DataMatrix(_) => Symbology::DataMatrix,
+            Self::Aztec(_) => Symbology::Aztec,
+        }
+    }
+
+    /// Returns the width (and height) of the barcode in modules, not including
+    /// the quiet zone.
+    pub fn width(&self) -> usize {
+        match self {
+            Self::Qr(code) => code.width(),
+            Self::DataMatrix(code) => code.width(),
+            Self::Aztec(code) => code.width(),
+        }
+    }
+
+    /// Returns the number of modules of blank space required around the
+    /// barcode.
+    pub fn quiet_zone(&self) -> usize {
+        match self {
+            Self::Qr(_) => QR_QUIET_ZONE,
+            Self::DataMatrix(_) => DATAMATRIX_QUIET_ZONE,
+            Self::Aztec(_) => AZTEC_QUIET_ZONE,
+        }
+    }
+
+    /// Returns the (x, y) coordinates of every dark module, with the origin at
+    /// the top-left of the barcode (not including the quiet zone).
+    pub(crate) fn dark_modules(&self) -> Box<dyn Iterator<Item = (usize, usize)> + '_> {
+        match self {
+            Self::Qr(code) => Box::new(dark_modules(code)),
+            Self::DataMatrix(code) => Box::new(code.dark_modules()),
+            Self::Aztec(code) => Box::new(code.dark_modules()),
+        }
+    }
+}
+
+/// Number of modules of blank space required around a QR code.
+pub(crate) const QR_QUIET_ZONE: usize = 4;
+
+/// Returns the (x, y) coordinates of every dark module in `code`, with the
+/// origin at the top-left of the code (not including the quiet zone).
+pub(crate) fn dark_modules(code: &QrCode) -> impl Iterator<Item = (usize, usize)> {
+    let width = code.width();
+    code.to_colors()
+        .into_iter()
+        .enumerate()
+        .filter(|(_, color)| *color == Color::Dark)
+        .map(move |(idx, _)| (idx % width, idx / width))
+}
+
+/// Split `text` into lines of at most `width` characters (unless a single
+/// word is longer than `width`). Paragraphs (separated by a blank line) are
+/// wrapped separately, with an empty line between them.
+pub(crate) fn wrap_text(text: &str, width: usize) -> Vec<String> {
+    let mut lines = vec![];
+    for paragraph in text.split("\n\n") {
+        let mut paragraph_lines = vec![];
+        let mut line = String::new();
+        for word in paragraph.split_whitespace() {
+            let line_width = line.chars().count();
+            if line_width > 0 && line_width + 1 + word.chars().count() > width {
+                paragraph_lines.push(std::mem::take(&mut line));
+            }
+            if !line.is_empty() {
+                line.push(' ');
+            }
+            line.push_str(word);
+        }
+        if !line.is_empty() {
+            paragraph_lines.push(line);
+        }
+        if !paragraph_lines.is_empty() && !lines.is_empty() {
+            lines.push(String::new());
+        }
+        lines.extend(paragraph_lines);
+    }
+    lines
+}
+
+/// Returns the number of columns used to lay out `num_codes` QR codes in a
+/// square grid (the number of rows is never larger than the number of
+/// columns).
+pub(crate) fn qr_grid_columns(num_codes: usize) -> usize {
+    let mut columns = 1;
+    while columns * columns < num_codes {
+        columns += 1;
+    }
+    columns
+}
+
+/// Escape `text` for inclusion in XML or HTML (as text or an attribute value).
+pub(crate) fn escape_markup(text: &str) -> String {
+    let mut escaped = String::with_capacity(text.len());
+    for ch in text.chars() {
+        match ch {
+            '&' => escaped.push_str("&amp;"),
+            '<' => escaped.push_str("&lt;"),
+            '>' => escaped.push_str("&gt;"),
+            '"' => escaped.push_str("&quot;"),
+            '\'' => escaped.push_str("&#39;"),
+            ch => escaped.push(ch),
+        }
+    }
+    escaped
+}
+
+/// Contents of a single printed document, independent of the output format.
+///
+/// Following the layout in the design document, each sheet has a title, the
+/// QR code (or other barcode, see [`Symbology`]) containing the document
+/// (and optionally a plain-text fallback, see [`SheetEncoding`]),
+/// human-readable details, and instructions. The spot-check digits of the
+/// document (see [`spotcheck_digits`]) are printed in the top-right corner.
+/// Key shards also have a detachable section containing the shard codewords
+/// (along with the document and shard identifiers, so that the section can be
+/// matched up with the shard if it is stored separately).
+#[derive(Clone, Debug)]
+pub struct Sheet {
+    pub(crate) title: String,
+    pub(crate) encoding: SheetEncoding,
+    pub(crate) symbology: Symbology,
+    pub(crate) qr_codes: Vec<Barcode>,
+    pub(crate) datamatrix_codes: Vec<Barcode>,
+    pub(crate) aztec_codes: Vec<Barcode>,
+    pub(crate) text_lines: Vec<String>,
+    pub(crate) details: Vec<(&'static str, String)>,
+    pub(crate) codewords: Option<KeyShardCodewords>,
+    pub(crate) instructions: String,
+    pub(crate) spotcheck: Option<String>,
+}
+
+/// Returns the QR codes, Data Matrix symbols and Aztec codes for `document`.
+fn document_barcodes<T: Framed>(
+    document: &T,
+    level: QrErrorCorrection,
+) -> Result<(Vec<Barcode>, Vec<Barcode>, Vec<Barcode>), Error> {
+    Ok((
+        document_qr_codes(document, level)?
+            .into_iter()
+            .map(Barcode::Qr)
+            .collect(),
+        document_datamatrix_codes(document)?
+            .into_iter()
+            .map(Barcode::DataMatrix)
+            .collect(),
+        document_aztec_codes(document)?
+            .into_iter()
+            .map(Barcode::Aztec)
+            .collect(),
+    ))
+}
+
+impl Sheet {
+    /// Create the sheet for a main document. The `level` of error correction
+    /// only applies to QR codes.
+    pub fn main_document(main: &MainDocument, level: QrErrorCorrection) -> Result<Self, Error> {
+        let (qr_codes, datamatrix_codes, aztec_codes) = document_barcodes(main, level)?;
+        Ok(Self {
+            title: format!("Main Document {}", main.id()),
+            encoding: SheetEncoding::default(),
+            symbology: Symbology::default(),
+            qr_codes,
+            datamatrix_codes,
+            aztec_codes,
+            text_lines: document_text_lines(main),
+            details: vec![
+                ("Document-ID", main.id()),
+                ("Checksum", main.checksum_string()),
+                ("Quorum-Size", main.quorum_size().to_string()),
+            ],
+            codewords: None,
+            instructions: format!(
+                "This is the main document of a paperback backup. It contains \
+                 the encrypted secret data, which can only be recovered by \
+                 combining it with {} of the key shards for this document. \
+                 Before recovering, check that the checksum above matches the \
+                 checksum stored in each key shard.",
+                main.quorum_size()
+            ),
+            spotcheck: Some(spotcheck_digits(main)),
+        })
+    }
+
+    /// Create the sheet for a key shard, including its `codewords`. The `level`
+    /// of error correction only applies to QR codes.
+    pub fn key_shard(
+        shard: &EncryptedKeyShard,
+        codewords: &KeyShardCodewords,
+        level: QrErrorCorrection,
+    ) -> Result<Self, Error> {
+        let decrypted = shard.decrypt(codewords)?;
+        let mut details = vec![
+            ("Document-ID", decrypted.document_id()),
+            ("Shard-ID", decrypted.id()),
+        ];
+        if let Some(label) = decrypted.label() {
+            details.push(("Label", label.to_string()));
+        }
+        if let Some(holder) = decrypted.holder() {
+            details.push(("Holder", holder.to_string()));
+        }
+        if let Some(contact) = decrypted.contact() {
+            details.push(("Contact", contact.to_string()));
+        }
+        if let Some(note) = decrypted.note() {
+            details.push(("Note", note.to_string()));
+        }
+        // English codewords are the default, and are not worth pointing out.
+        if decrypted.language() != CodewordLanguage::English {
+            details.push(("Codeword-Language", decrypted.language().name().to_string()));
+        }
+        let (qr_codes, datamatrix_codes, aztec_codes) = document_barcodes(shard, level)?;
+        Ok(Self {
+            title: format!("Key Shard {}", decrypted.id()),
+            encoding: SheetEncoding::default(),
+            symbology: Symbology::default(),
+            qr_codes,
+            datamatrix_codes,
+            aztec_codes,
+            text_lines: document_text_lines(shard),
+            details,
+            codewords: Some(codewords.clone()),
+            instructions: "This is one of the key shards of a paperback backup. \
+                           Together with the main document and enough other key \
+                           shards, it can be used to recover the secret data. The \
+                           codewords below are needed to decrypt this shard, and \
+                           may be cut off and stored separately. The codeword \
+                           checksum can be entered after the codewords to check \
+                           that they were typed correctly."
+                .to_string(),
+            spotcheck: Some(spotcheck_digits(shard)),
+        })
+    }
+
+    /// Create a sheet containing only the codewords of a key shard (such as to
+    /// replace a lost codeword section), with the same detachable section as
+    /// [`key_shard`](Self::key_shard) sheets but without the shard itself.
+    pub fn key_shard_codewords(
+        shard: &EncryptedKeyShard,
+        codewords: &KeyShardCodewords,
+    ) -> Result<Self, Error> {
+        let decrypted = shard.decrypt(codewords)?;
+        let mut details = vec![
+            ("Document-ID", decrypted.document_id()),
+            ("Shard-ID", decrypted.id()),
+        ];
+        if decrypted.language() != CodewordLanguage::English {
+            details.push(("Codeword-Language", decrypted.language().name().to_string()));
+        }
+        Ok(Self {
+            title: format!("Codewords for Key Shard {}", decrypted.id()),
+            encoding: SheetEncoding::default(),
+            symbology: Symbology::default(),
+            qr_codes: vec![],
+            datamatrix_codes: vec![],
+            aztec_codes: vec![],
+            text_lines: vec![],
+            details,
+            codewords: Some(codewords.clone()),
+            instructions: "These are the codewords needed to decrypt one of the key \
+                           shards of a paperback backup, replacing its original \
+                           codeword section. Like the original, they may be cut off \
+                           and stored separately from the key shard. The codeword \
+                           checksum can be entered after the codewords to check \
+                           that they were typed correctly."
+                .to_string(),
+            spotcheck: None,
+        })
+    }
+
+    /// Print the checksum of the main document on a key shard sheet. This is
+    /// meant for backups whose main document is only stored as a digital file,
+    /// so that whoever recovers the backup can check that they found the right
+    /// file. Every key shard records the checksum, so it can also be checked
+    /// by software when recovering.
+    pub fn document_checksum(mut self, checksum: String) -> Self {
+        // Keep the checksum next to the document ID it is derived from.
+        let index = self
+            .details
+            .iter()
+            .position(|(name, _)| *name == "Document-ID")
+            .map(|index| index + 1)
+            .unwrap_or(0);
+        self.details.insert(index, ("Document-Checksum", checksum));
+        self.instructions.push_str(
+            " The main document of this backup is stored as a digital file \
+             rather than on paper. Check that its checksum matches the \
+             document checksum above before recovering.",
+        );
+        self
+    }
+
+    /// Set how the contents of the document are printed on the sheet.
+    pub fn encoding(mut self, encoding: SheetEncoding) -> Self {
+        self.encoding = encoding;
+        self
+    }
+
+    /// Set which kind of barcode the document is printed as.
+    pub fn symbology(mut self, symbology: Symbology) -> Self {
+        self.symbology = symbology;
+        self
+    }
+
+    /// Returns the title of the sheet.
+    pub fn title(&self) -> &str {
+        &self.title
+    }
+
+    /// Returns the barcodes containing the document, of the sheet's
+    /// [`Symbology`], if they are printed on this sheet.
+    pub fn codes(&self) -> &[Barcode] {
+        match (self.encoding, self.symbology) {
+            (SheetEncoding::Text, _) => &[],
+            (_, Symbology::Qr) => &self.qr_codes,
+            (_, Symbology::DataMatrix) => &self.datamatrix_codes,
+            (_, Symbology::Aztec) => &self.aztec_codes,
+        }
+    }
+
+    /// Returns the plain-text fallback lines containing the document (see
+    /// [`document_text_lines`](crate::v0::document_text_lines)), if they are
+    /// printed on this sheet.
+    pub fn text_lines(&self) -> &[String] {
+        match self.encoding {
+            SheetEncoding::QrAndText | SheetEncoding::Text => &self.text_lines,
+            SheetEncoding::Qr => &[],
+        }
+    }
+
+    /// Returns the human-readable details of the document, as (name, value)
+    /// pairs.
+    pub fn details(&self) -> &[(&'static str, String)] {
+        &self.details
+    }
+
+    /// Returns the shard codewords, if this is a key shard.
+    pub fn codewords(&self) -> Option<&[String]> {
+        self.codewords.as_deref()
+    }
+
+    /// Returns the checksum of the shard codewords (see [`codewords_checksum`]),
+    /// printed on the detachable codeword section of key shards.
+    pub fn codewords_checksum(&self) -> Option<String> {
+        self.codewords.as_ref().map(codewords_checksum)
+    }
+
+    /// Returns the spot-check digits of the document (see
+    /// [`spotcheck_digits`]), unless the sheet does not contain a document.
+    pub fn spotcheck(&self) -> Option<&str> {
+        self.spotcheck.as_deref()
+    }
+
+    /// Returns the recovery instructions for the document.
+    pub fn instructions(&self) -> &str {
+        &self.instructions
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::Backup;
+
+    #[test]
+    fn backup_sheets() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let main = backup.main_document().clone();
+        let (shard, codewords) = backup.next_shard().unwrap().encrypt().unwrap();
+
+        let sheet = Sheet::main_document(&main, QrErrorCorrection::default()).unwrap();
+        assert!(sheet.title().contains(&main.id()));
+        assert!(sheet.codewords().is_none());
+        assert!(sheet.codewords_checksum().is_none());
+        assert_eq!(sheet.spotcheck(), Some(&spotcheck_digits(&main)[..]));
+        assert!(sheet.text_lines().is_empty());
+        assert!(sheet
+            .details()
+            .contains(&("Checksum", main.checksum_string())));
+
+        let sheet = Sheet::key_shard(&shard, &codewords, QrErrorCorrection::default()).unwrap();
+        assert_eq!(sheet.codewords(), Some(&codewords[..]));
+        assert_eq!(
+            sheet.codewords_checksum(),
+            Some(codewords_checksum(&codewords))
+        );
+        assert!(sheet.details().contains(&("Document-ID", main.id())));
+        assert_eq!(sheet.spotcheck(), Some(&spotcheck_digits(&shard)[..]));
+        assert!(sheet
+            .details()
+            .iter()
+            .all(|(name, _)| *name != "Document-Checksum"));
+
+        let digital = sheet.clone().document_checksum(main.checksum_string());
+        assert_eq!(
+            digital.details()[1],
+            ("Document-Checksum", main.checksum_string())
+        );
+        assert!(digital.instructions().starts_with(sheet.instructions()));
+        assert!(digital.instructions().contains("digital file"));
+
+        assert!(sheet
+            .codes()
+            .iter()
+            .all(|code| code.symbology() == Symbology::Qr));
+
+        let sheet = sheet.encoding(SheetEncoding::QrAndText);
+        assert!(!sheet.codes().is_empty());
+        assert_eq!(sheet.text_lines(), &document_text_lines(&shard)[..]);
+        let sheet = sheet.encoding(SheetEncoding::Text);
+        assert!(sheet.codes().is_empty());
+        assert!(!sheet.text_lines().is_empty());
+
+        let sheet = sheet
+            .encoding(SheetEncoding::Qr)
+            .symbology(Symbology::DataMatrix);
+        assert!(!sheet.codes().is_empty());
+        assert!(sheet.codes().iter().all(|code| {
+            code.symbology() == Symbology::DataMatrix && code.quiet_zone() == DATAMATRIX_QUIET_ZONE
+        }));
+        let sheet = sheet.symbology(Symbology::Aztec);
+        assert!(!sheet.codes().is_empty());
+        assert!(sheet
+            .codes()
+            .iter()
+            .all(|code| code.symbology() == Symbology::Aztec));
+
+        // The codewords must be correct.
+        let mut wrong = codewords.clone();
+        wrong[0] = if wrong[0] == "zoo" { "abandon" } else { "zoo" }.to_string();
+        Sheet::key_shard(&shard, &wrong, QrErrorCorrection::default()).unwrap_err();
+        Sheet::key_shard_codewords(&shard, &wrong).unwrap_err();
+
+        // Codeword sheets only contain the detachable section.
+        let sheet = Sheet::key_shard_codewords(&shard, &codewords).unwrap();
+        assert!(sheet
+            .title()
+            .contains(&shard.decrypt(&codewords).unwrap().id()));
+        assert!(sheet.codes().is_empty());
+        assert_eq!(sheet.codewords(), Some(&codewords[..]));
+        let shard_sheet =
+            Sheet::key_shard(&shard, &codewords, QrErrorCorrection::default()).unwrap();
+        assert_eq!(sheet.details()[..2], shard_sheet.details()[..2]);
+        assert!(sheet.spotcheck().is_none());
+        assert!(sheet.encoding(SheetEncoding::Text).text_lines().is_empty());
+    }
+
+    #[test]
+    fn page_layout() {
+        let layout = PageLayout::default();
+        assert_eq!(layout, PageLayout::new(PaperSize::A4));
+        assert_eq!(layout, PaperSize::A4.into());
+        layout.validate().unwrap();
+        assert_eq!(layout.content_width_mm(), 170.0);
+        assert_eq!(layout.grid_size_mm(), DEFAULT_QR_SIZE_MM);
+
+        // The QR codes are shrunk to fit on smaller paper.
+        let layout = PageLayout::new(PaperSize::A5).margin_mm(10.0);
+        layout.validate().unwrap();
+        assert_eq!(layout.grid_size_mm(), 128.0);
+        assert_eq!(layout.qr_size_mm(60.0).grid_size_mm(), 60.0);
+
+        PageLayout::new(PaperSize::A5)
+            .margin_mm(40.0)
+            .validate()
+            .unwrap_err();
+        PageLayout::default()
+            .margin_mm(-1.0)
+            .validate()
+            .unwrap_err();
+        PageLayout::default()
+            .qr_size_mm(10.0)
+            .validate()
+            .unwrap_err();
+        PageLayout::default()
+            .qr_size_mm(f64::NAN)
+            .validate()
+            .unwrap_err();
+    }
+
+    #[test]
+    fn wrap_known() {
+        assert_eq!(
+            wrap_text("the quick brown fox jumps", 10),
+            vec!["the quick", "brown fox", "jumps"]
+        );
+        assert_eq!(wrap_text("  ", 10), Vec::<String>::new());
+        assert_eq!(wrap_text("paperbacking up", 5), vec!["paperbacking", "up"]);
+        assert_eq!(
+            wrap_text("the quick\n\nbrown fox jumps\n\n\n\n", 10),
+            vec!["the quick", "", "brown fox", "jumps"]
+        );
+        assert_eq!(
+            wrap_text("récupérer données", 9),
+            vec!["récupérer", "données"]
+        );
+    }
+
+    #[test]
+    fn escape_known() {
+        assert_eq!(escape_markup("paperback"), "paperback");
+        assert_eq!(
+            escape_markup(r#"<a href="x">'&'</a>"#),
+            "&lt;a href=&quot;x&quot;&gt;&#39;&amp;&#39;&lt;/a&gt;"
+        );
+    }
+
+    #[test]
+    fn qr_grid_known() {
+        assert_eq!(qr_grid_columns(1), 1);
+        assert_eq!(qr_grid_columns(2), 2);
+        assert_eq!(qr_grid_columns(4), 2);
+        assert_eq!(qr_grid_columns(5), 3);
+        assert_eq!(qr_grid_columns(10), 4);
+    }
+
+    #[test]
+    fn qr_dark_modules() {
+        let code = QrCode::new(b"paperback").unwrap();
+        let dark = dark_modules(&code).collect::<Vec<_>>();
+        // The top-left finder pattern is dark at its corners.
+        assert!(dark.contains(&(0, 0)));
+        assert!(dark.contains(&(6, 6)));
+        assert!(!dark.contains(&(7, 7)));
+        assert!(dark
+            .iter()
+            .all(|(x, y)| *x < code.width() && *y < code.width()));
+    }
+}
@@ -0,0 +1,133 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{to_multibase_zbase32, KeyShard, ShardId};
+
+use multihash::Multihash;
+
+/// Signed record of the key shards replaced by a re-sharded backup.
+///
+/// When a backup is re-sharded (recovered and backed up again with a new
+/// quorum size and identity), the key shards of the new backup list the old
+/// backup's main document and the ids of its key shards. The old shards
+/// cannot be combined with the new main document (they belong to a different
+/// document), but the revocation record lets holders of the new shards know
+/// which old shards are obsolete and can be destroyed.
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub struct ShardRevocation {
+    pub(crate) doc_chksum: Multihash,
+    pub(crate) shard_ids: Vec<ShardId>,
+}
+
+impl ShardRevocation {
+    /// Returns the checksum of the main document which was replaced.
+    pub fn document_checksum(&self) -> Multihash {
+        self.doc_chksum
+    }
+
+    /// Returns the checksum of the main document which was replaced, in the
+    /// same format as [`MainDocument::checksum_string`].
+    ///
+    /// [`MainDocument::checksum_string`]: crate::v0::MainDocument::checksum_string
+    pub fn document_checksum_string(&self) -> String {
+        to_multibase_zbase32(self.doc_chksum.to_bytes())
+    }
+
+    /// Returns the ids of the key shards of the replaced backup which are now
+    /// revoked. May be empty if the ids of the old shards were not known.
+    pub fn shard_ids(&self) -> &[ShardId] {
+        &self.shard_ids
+    }
+
+    /// Returns whether the key shard with id `shard_id` has been revoked.
+    pub fn revokes<S: AsRef<str>>(&self, shard_id: S) -> bool {
+        self.shard_ids.iter().any(|id| id == shard_id.as_ref())
+    }
+}
+
+#[cfg(test)]
+impl quickcheck::Arbitrary for ShardRevocation {
+    fn arbitrary(g: &mut quickcheck::Gen) -> Self {
+        use crate::v0::CHECKSUM_ALGORITHM;
+        use multihash::MultihashDigest;
+
+        let bytes = Vec::<u8>::arbitrary(g);
+        Self {
+            doc_chksum: CHECKSUM_ALGORITHM.digest(&bytes[..]),
+            shard_ids: Vec::<String>::arbitrary(g),
+        }
+    }
+}
+
+impl KeyShard {
+    /// Returns the record of the key shards this shard's backup replaced, if
+    /// the backup was created by re-sharding an older backup.
+    pub fn revocation(&self) -> Option<&ShardRevocation> {
+        self.inner.revocation.as_ref()
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{Backup, BackupBuilder, FromWire, ToWire, UntrustedQuorum};
+
+    #[test]
+    fn backup_revocation() {
+        let old = Backup::new(2, b"secret data").unwrap();
+        let old_shards = (0..3)
+            .map(|_| old.next_shard().unwrap())
+            .collect::<Vec<_>>();
+        let old_ids = old_shards.iter().map(KeyShard::id).collect::<Vec<_>>();
+
+        let new = BackupBuilder::new(3)
+            .revokes(old.main_document(), old_ids.clone())
+            .build(b"secret data")
+            .unwrap();
+        let new_shards = (0..4)
+            .map(|_| new.next_shard().unwrap())
+            .map(|shard| KeyShard::from_wire(shard.to_wire()).unwrap())
+            .collect::<Vec<_>>();
+
+        for shard in &new_shards {
+            let revocation = shard.revocation().unwrap();
+            assert_eq!(
+                revocation.document_checksum(),
+                old.main_document().checksum()
+            );
+            assert_eq!(
+                revocation.document_checksum_string(),
+                old.main_document().checksum_string()
+            );
+            assert_eq!(revocation.shard_ids(), &old_ids[..]);
+            assert!(old_ids.iter().all(|id| revocation.revokes(id)));
+            assert!(!revocation.revokes(shard.id()));
+        }
+        assert!(old_shards.iter().all(|shard| shard.revocation().is_none()));
+
+        // Shards minted by expanding the new backup keep the revocation.
+        let mut quorum = UntrustedQuorum::new();
+        new_shards[..3]
+            .iter()
+            .for_each(|shard| quorum.push_shard(shard.clone()));
+        let quorum = quorum.validate().unwrap();
+        let extra = quorum.extend_shards(1).unwrap();
+        assert_eq!(extra[0].revocation(), new_shards[0].revocation());
+    }
+}
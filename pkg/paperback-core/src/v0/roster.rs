@@ -0,0 +1,251 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{KeyShard, ShardId};
+
+/// Entry in a [`ShardRoster`] describing one of the key shards of a backup.
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub struct RosterEntry {
+    pub(crate) shard_id: ShardId,
+    pub(crate) holder: String,
+}
+
+impl RosterEntry {
+    /// Returns the identifier of the key shard.
+    pub fn shard_id(&self) -> &str {
+        &self.shard_id
+    }
+
+    /// Returns the hint about who holds the key shard (as provided by the
+    /// creator of the backup). May be empty.
+    pub fn holder(&self) -> &str {
+        &self.holder
+    }
+}
+
+/// List of all of the key shards issued when a backup was created.
+///
+/// A roster is (optionally) included in the signed metadata of each key shard,
+/// so that someone trying to recover a backup with only one shard can know
+/// what other shards exist and who they might ask for them. Shards minted by
+/// expanding a backup carry a roster which also lists the new shards.
+#[derive(Clone, Debug, Default, Eq, PartialEq)]
+pub struct ShardRoster {
+    pub(crate) entries: Vec<RosterEntry>,
+}
+
+impl ShardRoster {
+    /// Returns the total number of key shards listed in the roster (those
+    /// issued when the backup was created, plus any known expansions).
+    pub fn total(&self) -> u32 {
+        self.entries.len() as u32
+    }
+
+    /// Returns all of the entries in the roster.
+    pub fn entries(&self) -> &[RosterEntry] {
+        &self.entries
+    }
+
+    /// Returns the union of `self` and `other`, with the entries of `other`
+    /// which are not in `self` appended in order.
+    pub(crate) fn merge(mut self, other: &ShardRoster) -> Self {
+        for entry in &other.entries {
+            if !self
+                .entries
+                .iter()
+                .any(|known| known.shard_id == entry.shard_id)
+            {
+                self.entries.push(entry.clone());
+            }
+        }
+        self
+    }
+
+    /// Returns the roster entries for all shards not in `present`.
+    pub fn missing<S: AsRef<str>>(&self, present: &[S]) -> Vec<&RosterEntry> {
+        self.entries
+            .iter()
+            .filter(|entry| !present.iter().any(|id| id.as_ref() == entry.shard_id))
+            .collect()
+    }
+}
+
+#[cfg(test)]
+impl quickcheck::Arbitrary for ShardRoster {
+    fn arbitrary(g: &mut quickcheck::Gen) -> Self {
+        Self {
+            entries: Vec::<(String, String)>::arbitrary(g)
+                .into_iter()
+                .map(|(shard_id, holder)| RosterEntry { shard_id, holder })
+                .collect(),
+        }
+    }
+}
+
+impl KeyShard {
+    /// Returns the roster of key shards issued when the backup was created, if
+    /// the creator chose to include one.
+    pub fn roster(&self) -> Option<&ShardRoster> {
+        self.inner.roster.as_ref()
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{BackupBuilder, FromWire, ShardOptions, ToWire, UntrustedQuorum};
+
+    #[test]
+    fn backup_roster() {
+        let holders = vec!["Alice".to_string(), "Bob".to_string(), "".to_string()];
+        let backup = BackupBuilder::new(2)
+            .roster(holders.clone())
+            .build(b"secret data")
+            .unwrap();
+
+        let shards = (0..3)
+            .map(|_| backup.next_shard().unwrap())
+            .map(|shard| KeyShard::from_wire(shard.to_wire()).unwrap())
+            .collect::<Vec<_>>();
+        // The roster fixes the set of shards.
+        backup.next_shard().unwrap_err();
+
+        for shard in &shards {
+            let roster = shard.roster().unwrap();
+            assert_eq!(roster.total(), 3);
+            assert_eq!(
+                roster
+                    .entries()
+                    .iter()
+                    .map(RosterEntry::holder)
+                    .collect::<Vec<_>>(),
+                holders
+            );
+            assert_eq!(
+                roster
+                    .entries()
+                    .iter()
+                    .map(RosterEntry::shard_id)
+                    .collect::<Vec<_>>(),
+                shards.iter().map(KeyShard::id).collect::<Vec<_>>()
+            );
+        }
+
+        let roster = shards[0].roster().unwrap();
+        let missing = roster.missing(&[shards[0].id(), shards[2].id()]);
+        assert_eq!(missing.len(), 1);
+        assert_eq!(missing[0].holder(), "Bob");
+    }
+
+    #[test]
+    fn extend_roster() {
+        let holders = vec!["Alice".to_string(), "Bob".to_string(), "Carol".to_string()];
+        let backup = BackupBuilder::new(2)
+            .roster(holders)
+            .build(b"secret data")
+            .unwrap();
+        let shards = (0..3)
+            .map(|_| backup.next_shard().unwrap())
+            .collect::<Vec<_>>();
+        let original = shards[0].roster().unwrap().clone();
+
+        let mut quorum = UntrustedQuorum::new();
+        quorum.push_shard(shards[0].clone());
+        quorum.push_shard(shards[1].clone());
+        let first = quorum.validate().unwrap().extend_shards(2).unwrap();
+
+        for shard in &first {
+            let roster = shard.roster().unwrap();
+            assert_eq!(roster.total(), 5);
+            assert_eq!(&roster.entries()[..3], original.entries());
+            assert_eq!(
+                roster.entries()[3..]
+                    .iter()
+                    .map(RosterEntry::shard_id)
+                    .collect::<Vec<_>>(),
+                first.iter().map(KeyShard::id).collect::<Vec<_>>()
+            );
+            assert_eq!(roster.entries()[3].holder(), "");
+        }
+
+        // Original and expanded shards can be mixed in a quorum, and a second
+        // expansion lists every shard known to the quorum.
+        let mut quorum = UntrustedQuorum::new();
+        quorum.push_shard(shards[2].clone());
+        quorum.push_shard(first[0].clone());
+        let second = quorum.validate().unwrap().extend_shards(1).unwrap();
+        let roster = second[0].roster().unwrap();
+        assert_eq!(roster.total(), 6);
+        assert_eq!(&roster.entries()[..5], first[0].roster().unwrap().entries());
+        assert_eq!(roster.entries()[5].shard_id(), second[0].id());
+
+        // Shards from separate expansions can also be mixed.
+        let mut quorum = UntrustedQuorum::new();
+        quorum.push_shard(first[1].clone());
+        quorum.push_shard(second[0].clone());
+        quorum.validate().unwrap();
+    }
+
+    #[test]
+    fn extend_roster_with_holders() {
+        let backup = BackupBuilder::new(2)
+            .roster(vec!["Alice".into(), "Bob".into()])
+            .build(b"secret data")
+            .unwrap();
+        let mut quorum = UntrustedQuorum::new();
+        quorum.push_shard(backup.next_shard().unwrap());
+        quorum.push_shard(backup.next_shard().unwrap());
+
+        let new = quorum
+            .validate()
+            .unwrap()
+            .extend_shards_with(vec![
+                ShardOptions::new()
+                    .holder("Carol")
+                    .contact("carol@example.com"),
+                ShardOptions::new().note("spare"),
+            ])
+            .unwrap();
+        assert_eq!(new.len(), 2);
+        assert_eq!(new[0].holder(), Some("Carol"));
+        assert_eq!(new[0].contact(), Some("carol@example.com"));
+        assert_eq!(new[1].holder(), None);
+        assert_eq!(new[1].note(), Some("spare"));
+
+        // The holder hints are also added to the roster.
+        let roster = new[1].roster().unwrap();
+        assert_eq!(
+            roster
+                .entries()
+                .iter()
+                .map(RosterEntry::holder)
+                .collect::<Vec<_>>(),
+            vec!["Alice", "Bob", "Carol", ""]
+        );
+    }
+
+    #[test]
+    fn backup_roster_commit_mismatch() {
+        BackupBuilder::new(2)
+            .commit_shards(3)
+            .roster(vec!["Alice".into(), "Bob".into()])
+            .build(b"secret data")
+            .unwrap_err();
+    }
+}
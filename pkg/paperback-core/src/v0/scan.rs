@@ -0,0 +1,273 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{
+    group_documents, DocumentGroup, DocumentKind, EncryptedKeyShard, Error, FrameHeader, Framed,
+    KeyShard, MainDocument, Page, QrAssembler, Type, CHECKSUM_ALGORITHM,
+};
+
+use std::collections::{BTreeMap, HashSet};
+
+use multihash::MultihashDigest;
+
+/// Result of adding a scanned QR code to a [`ScanSession`].
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub enum ScanStatus {
+    /// The QR code had not been scanned before.
+    New,
+    /// The QR code had already been scanned, and was ignored.
+    Duplicate,
+}
+
+/// Summary of what has been scanned in a [`ScanSession`], and what is still
+/// needed to recover the document.
+#[derive(Clone, Debug, Default, Eq, PartialEq)]
+pub struct ScanTally {
+    main_document: bool,
+    quorum_size: Option<u32>,
+    shards: u32,
+    incomplete: Vec<Vec<u32>>,
+}
+
+impl ScanTally {
+    /// Returns whether the main document has been completely scanned.
+    pub fn has_main_document(&self) -> bool {
+        self.main_document
+    }
+
+    /// Returns the number of distinct key shards which have been completely
+    /// scanned.
+    pub fn shards(&self) -> u32 {
+        self.shards
+    }
+
+    /// Returns the number of key shards still needed, if it is known (the
+    /// quorum size is only known once the main document has been scanned).
+    pub fn shards_needed(&self) -> Option<u32> {
+        self.quorum_size
+            .map(|quorum_size| quorum_size.saturating_sub(self.shards))
+    }
+
+    /// Returns the (one-indexed) numbers of the missing QR codes of each
+    /// partially-scanned document.
+    pub fn incomplete(&self) -> &[Vec<u32>] {
+        &self.incomplete
+    }
+
+    /// Returns whether enough has been scanned to recover the document.
+    pub fn is_complete(&self) -> bool {
+        self.main_document && self.shards_needed() == Some(0)
+    }
+}
+
+/// State of an interactive scanning session, which accepts the contents of QR
+/// codes (from any of the documents of a backup, in any order) as they are
+/// scanned.
+///
+/// This only handles the contents of the QR codes, so that it can be driven by
+/// any source of scanned QR codes (such as a camera or an image file). Data
+/// Matrix symbols and Aztec codes hold the same contents, so they can be
+/// scanned (and mixed with QR codes) in the same session. Repeated scans of
+/// the same QR code are detected and ignored, which is necessary when
+/// continuously scanning from a camera.
+#[derive(Clone, Debug, Default)]
+pub struct ScanSession {
+    seen: HashSet<Vec<u8>>,
+    // Documents are keyed by the checksum of their framed representation (the
+    // same checksum that pages use to identify their document).
+    documents: BTreeMap<Vec<u8>, QrAssembler>,
+}
+
+impl ScanSession {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Add the contents of a scanned QR code to the session.
+    pub fn push<B: AsRef<[u8]>>(&mut self, scanned: B) -> Result<ScanStatus, Error> {
+        let scanned = scanned.as_ref();
+        if self.seen.contains(scanned) {
+            return Ok(ScanStatus::Duplicate);
+        }
+
+        let (header, _) = FrameHeader::parse(scanned)?;
+        let key = match header.kind() {
+            DocumentKind::Page => Page::from_framed(scanned)?.content_checksum(),
+            _ => CHECKSUM_ALGORITHM.digest(scanned),
+        }
+        .to_bytes();
+        self.documents
+            .entry(key)
+            .or_insert_with(QrAssembler::new)
+            .push(scanned)?;
+        self.seen.insert(scanned.to_vec());
+        Ok(ScanStatus::New)
+    }
+
+    /// Returns the main document, if it has been completely scanned.
+    pub fn main_document(&self) -> Option<MainDocument> {
+        self.documents
+            .values()
+            .filter(|assembler| assembler.is_complete())
+            .find_map(|assembler| assembler.assemble().ok())
+    }
+
+    /// Returns every main document which has been completely scanned, for
+    /// sessions which contain the documents of several backups.
+    pub fn main_documents(&self) -> Vec<MainDocument> {
+        self.documents
+            .values()
+            .filter(|assembler| assembler.is_complete())
+            .filter_map(|assembler| assembler.assemble().ok())
+            .collect()
+    }
+
+    /// Group the main documents which have been completely scanned together
+    /// with `shards` (the decrypted key shards of the session) by the backup
+    /// they belong to. See [`group_documents`].
+    pub fn group<I: IntoIterator<Item = KeyShard>>(&self, shards: I) -> Vec<DocumentGroup> {
+        group_documents(
+            self.main_documents()
+                .into_iter()
+                .map(Type::from)
+                .chain(shards.into_iter().map(Type::from)),
+        )
+    }
+
+    /// Returns every key shard which has been completely scanned.
+    pub fn encrypted_shards(&self) -> Vec<EncryptedKeyShard> {
+        self.documents
+            .values()
+            .filter(|assembler| assembler.is_complete())
+            .filter_map(|assembler| assembler.assemble().ok())
+            .collect()
+    }
+
+    /// Returns a summary of what has been scanned so far.
+    pub fn tally(&self) -> ScanTally {
+        let main_document = self.main_document();
+        ScanTally {
+            main_document: main_document.is_some(),
+            quorum_size: main_document.map(|main| main.quorum_size()),
+            shards: self.encrypted_shards().len() as u32,
+            incomplete: self
+                .documents
+                .values()
+                .filter(|assembler| !assembler.is_complete())
+                .map(QrAssembler::missing)
+                .collect(),
+        }
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{paginate, Backup, FrameEncoding};
+
+    #[test]
+    fn scan_backup() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let main = backup.main_document().to_framed(FrameEncoding::Raw);
+        let shards = (0..3)
+            .map(|_| backup.next_shard().unwrap().encrypt().unwrap().0)
+            .map(|shard| shard.to_framed(FrameEncoding::Raw))
+            .collect::<Vec<_>>();
+        // Pretend the first shard was split across several QR codes.
+        let shard_pages = paginate(&shards[0], 64)
+            .iter()
+            .map(|page| page.to_framed(FrameEncoding::Raw))
+            .collect::<Vec<_>>();
+        assert!(shard_pages.len() > 2);
+
+        let mut session = ScanSession::new();
+        assert_eq!(session.tally(), ScanTally::default());
+
+        assert_eq!(session.push(&shard_pages[1]).unwrap(), ScanStatus::New);
+        assert_eq!(
+            session.push(&shard_pages[1]).unwrap(),
+            ScanStatus::Duplicate
+        );
+        let tally = session.tally();
+        assert_eq!(tally.shards(), 0);
+        assert_eq!(tally.shards_needed(), None);
+        assert_eq!(tally.incomplete().len(), 1);
+
+        assert_eq!(session.push(&shards[1]).unwrap(), ScanStatus::New);
+        assert_eq!(session.push(&main).unwrap(), ScanStatus::New);
+        assert_eq!(session.push(&main).unwrap(), ScanStatus::Duplicate);
+        let tally = session.tally();
+        assert!(tally.has_main_document());
+        assert_eq!(tally.shards(), 1);
+        assert_eq!(tally.shards_needed(), Some(1));
+        assert!(!tally.is_complete());
+
+        for page in &shard_pages {
+            session.push(page).unwrap();
+        }
+        let tally = session.tally();
+        assert_eq!(tally.shards(), 2);
+        assert_eq!(tally.shards_needed(), Some(0));
+        assert!(tally.incomplete().is_empty());
+        assert!(tally.is_complete());
+
+        session.push(b"not a qr code").unwrap_err();
+    }
+
+    #[test]
+    fn scan_mixed_backups() {
+        let backups = vec![
+            Backup::new(2, b"first secret").unwrap(),
+            Backup::new(2, b"second secret").unwrap(),
+        ];
+
+        let mut session = ScanSession::new();
+        let mut all_codewords = vec![];
+        for backup in &backups {
+            session
+                .push(backup.main_document().to_framed(FrameEncoding::Raw))
+                .unwrap();
+            let (shard, codewords) = backup.next_shard().unwrap().encrypt().unwrap();
+            session.push(shard.to_framed(FrameEncoding::Raw)).unwrap();
+            all_codewords.push(codewords);
+        }
+        assert_eq!(session.main_documents().len(), 2);
+
+        // Encrypted shards say nothing about their backup, so they can only be
+        // grouped once decrypted.
+        let decrypted = session
+            .encrypted_shards()
+            .iter()
+            .filter_map(|shard| {
+                all_codewords
+                    .iter()
+                    .find_map(|codewords| shard.decrypt(codewords).ok())
+            })
+            .collect::<Vec<_>>();
+        assert_eq!(decrypted.len(), 2);
+
+        let groups = session.group(decrypted);
+        assert_eq!(groups.len(), 2);
+        for group in &groups {
+            assert!(group.has_main_document());
+            assert_eq!(group.shard_ids().len(), 1);
+            assert_eq!(group.shards_needed(), 1);
+        }
+    }
+}
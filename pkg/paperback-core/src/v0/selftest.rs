@@ -0,0 +1,265 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! Checks that this build of paperback works, before it is trusted with any
+//! real secrets (for instance, after copying it to an air-gapped machine).
+
+use crate::{
+    mnemonic,
+    v0::{
+        binary_aztec, binary_datamatrix, binary_qr, qr::document_payloads, Backup, BackupBuilder,
+        CheckResult, Compression, EncryptedKeyShard, Error, FromWire, MainDocument, QrAssembler,
+        QrErrorCorrection, ToWire, UntrustedQuorum, AZTEC_MAX_BYTES, DATAMATRIX_MAX_BYTES,
+    },
+};
+
+use rand::{rngs::OsRng, RngCore};
+
+/// Number of bytes drawn from each random number generator. 20000 bits is the
+/// sample size used by the FIPS 140-2 statistical tests.
+const RNG_SAMPLE_BYTES: usize = 2500;
+
+/// Acceptable range for the number of set bits in [`RNG_SAMPLE_BYTES`] of
+/// random data (the FIPS 140-2 monobit test).
+const RNG_MONOBIT_RANGE: (u32, u32) = (9725, 10275);
+
+/// Run every self-test check, returning the name and outcome of each.
+///
+/// The checks are basic sanity checks of the random number generators, a
+/// comparison of the built-in wordlists against their known digests, an
+/// end-to-end backup and recovery of random data (entirely in memory), and a
+/// round-trip of a multi-page document through the payloads of every barcode
+/// symbology. There is no barcode image decoder in paperback, so the barcodes
+/// are only checked to be generated correctly, and their payloads are
+/// reassembled directly.
+pub fn selftest() -> Vec<(&'static str, CheckResult)> {
+    let checks: [(&'static str, fn() -> Result<(), Error>); 4] = [
+        ("rng", check_rng),
+        ("wordlists", check_wordlists),
+        ("backup-roundtrip", check_backup_roundtrip),
+        ("barcode-roundtrip", check_barcode_roundtrip),
+    ];
+    checks
+        .iter()
+        .map(|(name, check)| (*name, check().into()))
+        .collect()
+}
+
+/// Check that `rng` does not return the same data twice, and that its output
+/// passes the FIPS 140-2 monobit test. This can only catch badly broken
+/// generators (such as one which is stuck).
+fn check_rng_sample<R: RngCore>(name: &str, rng: &mut R) -> Result<(), Error> {
+    let mut first = vec![0u8; RNG_SAMPLE_BYTES];
+    let mut second = vec![0u8; RNG_SAMPLE_BYTES];
+    rng.fill_bytes(&mut first);
+    rng.fill_bytes(&mut second);
+
+    if first == second {
+        return Err(Error::Other(format!(
+            "{} returned the same data twice",
+            name
+        )));
+    }
+    for sample in &[first, second] {
+        let ones = sample.iter().map(|b| b.count_ones()).sum::<u32>();
+        if ones < RNG_MONOBIT_RANGE.0 || ones > RNG_MONOBIT_RANGE.1 {
+            return Err(Error::Other(format!(
+                "{} failed monobit test ({} of {} bits set)",
+                name,
+                ones,
+                RNG_SAMPLE_BYTES * 8
+            )));
+        }
+    }
+    Ok(())
+}
+
+fn check_rng() -> Result<(), Error> {
+    // Both generators are used when creating backups.
+    check_rng_sample("OsRng", &mut OsRng)?;
+    check_rng_sample("thread_rng", &mut rand::thread_rng())
+}
+
+fn check_wordlists() -> Result<(), Error> {
+    mnemonic::verify_wordlist()
+        .and_then(|_| mnemonic::pgp::verify_wordlists())
+        .map_err(|err| Error::Other(err.to_string()))
+}
+
+/// Returns some random secret data, large enough that the main document is
+/// split across several pages in every barcode symbology.
+fn random_secret() -> Vec<u8> {
+    let mut secret = vec![0u8; 4096];
+    OsRng.fill_bytes(&mut secret);
+    secret
+}
+
+fn check_backup_roundtrip() -> Result<(), Error> {
+    let secret = random_secret();
+    let backup = BackupBuilder::new(2)
+        .compression(Compression::Deflate)
+        .build(&secret)?;
+    let main_document = MainDocument::from_wire(backup.main_document().to_wire())?;
+    let shards = (0..3)
+        .map(|_| {
+            let (shard, codewords) = backup.next_shard()?.encrypt()?;
+            Ok((EncryptedKeyShard::from_wire(shard.to_wire())?, codewords))
+        })
+        .collect::<Result<Vec<_>, Error>>()?;
+
+    // Every pair of shards must be able to recover the secret.
+    for (a, b) in &[(0, 1), (0, 2), (1, 2)] {
+        let mut quorum = UntrustedQuorum::new();
+        quorum.main_document(main_document.clone());
+        for idx in &[*a, *b] {
+            let (ref shard, ref codewords) = shards[*idx];
+            quorum.push_shard(shard.decrypt(codewords)?);
+        }
+        let quorum = quorum.validate().map_err(|err| {
+            Error::Other(format!("quorum failed to validate: {:?}", err.as_groups()))
+        })?;
+        if quorum.recover_document()? != secret {
+            return Err(Error::InvariantViolation(
+                "recovered secret does not match the original",
+            ));
+        }
+    }
+    Ok(())
+}
+
+fn check_barcode_roundtrip() -> Result<(), Error> {
+    let backup = Backup::new(2, random_secret())?;
+    let main_document = backup.main_document();
+    let expected = main_document.to_wire();
+
+    let level = QrErrorCorrection::default();
+    let symbologies: [(&str, usize, &dyn Fn(&[u8]) -> Result<(), Error>); 3] = [
+        ("qr", level.max_bytes(), &|payload| {
+            binary_qr(payload, level).map(drop)
+        }),
+        ("datamatrix", DATAMATRIX_MAX_BYTES, &|payload| {
+            binary_datamatrix(payload).map(drop)
+        }),
+        ("aztec", AZTEC_MAX_BYTES, &|payload| {
+            binary_aztec(payload).map(drop)
+        }),
+    ];
+    for (name, max_bytes, encode) in &symbologies {
+        let payloads = document_payloads(main_document, *max_bytes);
+        if payloads.len() < 2 {
+            return Err(Error::InvariantViolation(
+                "self-test document was not split into several pages",
+            ));
+        }
+
+        // Scan the codes in reverse order, to make sure the order of the pages
+        // does not matter.
+        let mut assembler = QrAssembler::new();
+        for payload in payloads.iter().rev() {
+            encode(payload)?;
+            assembler.push(payload)?;
+        }
+        let assembled = assembler.assemble::<MainDocument>()?;
+        if assembled.to_wire() != expected {
+            return Err(Error::Other(format!(
+                "{} payloads did not reassemble into the original document",
+                name
+            )));
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn selftest_passes() {
+        let checks = selftest();
+        assert_eq!(checks.len(), 4);
+        for check in checks {
+            assert!(
+                check.passed(),
+                "{} failed: {:?}",
+                check.name(),
+                check.error()
+            );
+        }
+    }
+
+    /// Generator which returns the same byte forever.
+    struct StuckRng(u8);
+
+    impl RngCore for StuckRng {
+        fn next_u32(&mut self) -> u32 {
+            u32::from_ne_bytes([self.0; 4])
+        }
+
+        fn next_u64(&mut self) -> u64 {
+            u64::from_ne_bytes([self.0; 8])
+        }
+
+        fn fill_bytes(&mut self, dest: &mut [u8]) {
+            dest.iter_mut().for_each(|b| *b = self.0);
+        }
+
+        fn try_fill_bytes(&mut self, dest: &mut [u8]) -> Result<(), rand::Error> {
+            self.fill_bytes(dest);
+            Ok(())
+        }
+    }
+
+    /// Generator which counts upwards, so never repeats itself (over a short
+    /// period) but has a biased output.
+    struct CountingRng(u8);
+
+    impl RngCore for CountingRng {
+        fn next_u32(&mut self) -> u32 {
+            let mut bytes = [0u8; 4];
+            self.fill_bytes(&mut bytes);
+            u32::from_ne_bytes(bytes)
+        }
+
+        fn next_u64(&mut self) -> u64 {
+            let mut bytes = [0u8; 8];
+            self.fill_bytes(&mut bytes);
+            u64::from_ne_bytes(bytes)
+        }
+
+        fn fill_bytes(&mut self, dest: &mut [u8]) {
+            for b in dest {
+                // Only ever set the low nibble.
+                self.0 = self.0.wrapping_add(1);
+                *b = self.0 & 0x0f;
+            }
+        }
+
+        fn try_fill_bytes(&mut self, dest: &mut [u8]) -> Result<(), rand::Error> {
+            self.fill_bytes(dest);
+            Ok(())
+        }
+    }
+
+    #[test]
+    fn rng_failures() {
+        check_rng().unwrap();
+        check_rng_sample("stuck", &mut StuckRng(0x5a)).unwrap_err();
+        check_rng_sample("biased", &mut CountingRng(0)).unwrap_err();
+    }
+}
@@ -0,0 +1,198 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! Recovery sessions record the documents which have been entered so far, so
+//! that a recovery which takes a long time (such as when shards arrive by mail
+//! over several weeks) can be stopped and resumed later.
+
+use crate::v0::{Error, FromWire, KeyShard, MainDocument, ToWire, UntrustedQuorum};
+
+use std::io::{Read, Write};
+
+use age::{
+    armor::{ArmoredReader, ArmoredWriter, Format},
+    secrecy::Secret,
+};
+
+/// First line of the (decrypted) contents of a recovery session.
+const RECOVERY_SESSION_HEADER: &str = "paperback-recovery-session-v0";
+
+fn session_error<E: std::fmt::Display>(err: E) -> Error {
+    Error::Other(format!("recovery session: {}", err))
+}
+
+/// Documents entered so far during a recovery.
+///
+/// Since the session holds decrypted key shards, it is only ever stored
+/// encrypted with a passphrase (see [`seal`](Self::seal)). Anyone with both
+/// the session and its passphrase holds every shard in it, so the passphrase
+/// should be chosen with as much care as the hiding place of a shard.
+#[derive(Clone, Debug, Default)]
+pub struct RecoverySession {
+    main_document: Option<MainDocument>,
+    shards: Vec<KeyShard>,
+}
+
+impl RecoverySession {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn main_document(&self) -> Option<&MainDocument> {
+        self.main_document.as_ref()
+    }
+
+    pub fn set_main_document(&mut self, main: MainDocument) {
+        self.main_document = Some(main);
+    }
+
+    /// Returns the key shards entered so far, in the order they were added.
+    pub fn shards(&self) -> &[KeyShard] {
+        &self.shards
+    }
+
+    /// Add a key shard to the session. Returns `false` (and ignores the shard)
+    /// if a copy of the shard is already in the session.
+    pub fn push_shard(&mut self, shard: KeyShard) -> bool {
+        if self.to_quorum().contains_shard(&shard) {
+            return false;
+        }
+        self.shards.push(shard);
+        true
+    }
+
+    /// Returns a quorum of the documents in the session, to be validated once
+    /// enough shards have been entered.
+    pub fn to_quorum(&self) -> UntrustedQuorum {
+        let mut quorum = UntrustedQuorum::new();
+        if let Some(main) = &self.main_document {
+            quorum.main_document(main.clone());
+        }
+        for shard in &self.shards {
+            quorum.push_shard(shard.clone());
+        }
+        quorum
+    }
+
+    fn to_text(&self) -> String {
+        let mut text = format!("{}\n", RECOVERY_SESSION_HEADER);
+        if let Some(main) = &self.main_document {
+            text.push_str(&format!("main {}\n", main.to_wire_zbase32()));
+        }
+        for shard in &self.shards {
+            text.push_str(&format!("shard {}\n", shard.to_wire_zbase32()));
+        }
+        text
+    }
+
+    fn from_text(text: &str) -> Result<Self, Error> {
+        let mut lines = text.lines();
+        if lines.next() != Some(RECOVERY_SESSION_HEADER) {
+            return Err(session_error("missing recovery session header"));
+        }
+
+        let mut session = Self::new();
+        for line in lines {
+            match line.split_once(' ') {
+                Some(("main", data)) if session.main_document.is_none() => {
+                    session.main_document = Some(MainDocument::from_wire_zbase32(data)?)
+                }
+                Some(("shard", data)) => session.shards.push(KeyShard::from_wire_zbase32(data)?),
+                _ => return Err(session_error(format!("unexpected line '{}'", line))),
+            }
+        }
+        Ok(session)
+    }
+
+    /// Encrypt the session with `passphrase`, as an ASCII-armored age file.
+    pub fn seal(&self, passphrase: &str) -> Result<Vec<u8>, Error> {
+        let mut sealed = vec![];
+        let armor =
+            ArmoredWriter::wrap_output(&mut sealed, Format::AsciiArmor).map_err(session_error)?;
+        let mut writer = age::Encryptor::with_user_passphrase(Secret::new(passphrase.to_string()))
+            .wrap_output(armor)
+            .map_err(session_error)?;
+        writer
+            .write_all(self.to_text().as_bytes())
+            .map_err(session_error)?;
+        writer
+            .finish()
+            .and_then(|armor| armor.finish())
+            .map_err(session_error)?;
+        Ok(sealed)
+    }
+
+    /// Decrypt a session produced by [`seal`](Self::seal) with `passphrase`.
+    pub fn open(sealed: &[u8], passphrase: &str) -> Result<Self, Error> {
+        let decryptor =
+            match age::Decryptor::new(ArmoredReader::new(sealed)).map_err(session_error)? {
+                age::Decryptor::Passphrase(decryptor) => decryptor,
+                _ => return Err(session_error("file is not passphrase-encrypted")),
+            };
+        let mut reader = decryptor
+            .decrypt(&Secret::new(passphrase.to_string()), None)
+            .map_err(session_error)?;
+        let mut text = String::new();
+        reader.read_to_string(&mut text).map_err(session_error)?;
+        Self::from_text(&text)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::Backup;
+
+    #[test]
+    fn recovery_session_resume() {
+        let backup = Backup::new(3, b"secret data").unwrap();
+        let shard = backup.next_shard().unwrap();
+
+        let mut session = RecoverySession::new();
+        session.set_main_document(backup.main_document().clone());
+        assert!(session.push_shard(shard.clone()));
+        assert!(!session.push_shard(shard));
+        assert!(session.push_shard(backup.next_shard().unwrap()));
+
+        let sealed = session.seal("correct horse battery staple").unwrap();
+        RecoverySession::open(&sealed, "wrong passphrase").unwrap_err();
+
+        let mut resumed = RecoverySession::open(&sealed, "correct horse battery staple").unwrap();
+        assert_eq!(
+            resumed.main_document().map(MainDocument::id),
+            Some(backup.main_document().id())
+        );
+        assert_eq!(
+            resumed
+                .shards()
+                .iter()
+                .map(KeyShard::id)
+                .collect::<Vec<_>>(),
+            session
+                .shards()
+                .iter()
+                .map(KeyShard::id)
+                .collect::<Vec<_>>()
+        );
+
+        assert!(resumed.push_shard(backup.next_shard().unwrap()));
+        let quorum = resumed.to_quorum().validate().unwrap();
+        assert_eq!(quorum.recover_document().unwrap(), b"secret data");
+    }
+}
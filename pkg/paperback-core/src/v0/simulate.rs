@@ -0,0 +1,269 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! Monte Carlo simulation of what happens to the shards of a backup over its
+//! lifetime, to help choose the quorum size and number of shards.
+
+use crate::v0::Error;
+
+use rand::Rng;
+
+/// Chance of a single shardholder losing their shard, or having it fall into
+/// the hands of an attacker, over the lifetime of the backup.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub struct HolderRisk {
+    /// Probability that the shard is lost (destroyed, forgotten, or its
+    /// holder is unreachable) when it is needed for recovery.
+    pub loss: f64,
+    /// Probability that an attacker obtains the shard (and its codewords).
+    pub compromise: f64,
+}
+
+impl HolderRisk {
+    pub fn new(loss: f64, compromise: f64) -> Result<Self, Error> {
+        for (name, p) in &[("loss", loss), ("compromise", compromise)] {
+            if !(0.0..=1.0).contains(p) {
+                return Err(Error::Other(format!(
+                    "{} probability {} is not between 0 and 1",
+                    name, p
+                )));
+            }
+        }
+        Ok(Self { loss, compromise })
+    }
+}
+
+/// Outcome of simulating a backup with a particular quorum size and number of
+/// shards.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub struct SimulationResult {
+    pub quorum_size: u32,
+    pub shards: u32,
+    /// Number of simulated lifetimes.
+    pub trials: u32,
+    /// Number of trials in which fewer than `quorum_size` shards survived, so
+    /// the secret could not be recovered.
+    pub lost: u32,
+    /// Number of trials in which an attacker obtained at least `quorum_size`
+    /// shards, and so could recover the secret.
+    pub compromised: u32,
+}
+
+impl SimulationResult {
+    /// Estimated probability of the secret being lost.
+    pub fn loss_probability(&self) -> f64 {
+        self.lost as f64 / self.trials as f64
+    }
+
+    /// Estimated probability of an attacker reaching quorum.
+    pub fn compromise_probability(&self) -> f64 {
+        self.compromised as f64 / self.trials as f64
+    }
+}
+
+/// Simulate `trials` lifetimes of a backup for each `(quorum_size, shards)`
+/// pair in `candidates`, where shard `i` is given to the holder with risk
+/// `holders[i]`. Losing and compromising a shard are treated as independent
+/// events, so a shard can be both stolen and (later) lost.
+///
+/// Every candidate is evaluated against the same simulated lifetimes, so that
+/// the differences between the candidates are not swamped by sampling noise.
+pub fn simulate<R: Rng>(
+    rng: &mut R,
+    holders: &[HolderRisk],
+    candidates: &[(u32, u32)],
+    trials: u32,
+) -> Result<Vec<SimulationResult>, Error> {
+    if trials == 0 {
+        return Err(Error::Other("at least one trial must be simulated".into()));
+    }
+    for &(quorum_size, shards) in candidates {
+        if quorum_size == 0 || quorum_size > shards {
+            return Err(Error::Other(format!(
+                "quorum size {} is invalid for {} shards",
+                quorum_size, shards
+            )));
+        }
+        if shards as usize > holders.len() {
+            return Err(Error::Other(format!(
+                "{} shards need {} holders, but only {} were given",
+                shards,
+                shards,
+                holders.len()
+            )));
+        }
+    }
+
+    let mut results = candidates
+        .iter()
+        .map(|&(quorum_size, shards)| SimulationResult {
+            quorum_size,
+            shards,
+            trials,
+            lost: 0,
+            compromised: 0,
+        })
+        .collect::<Vec<_>>();
+
+    // Running counts of surviving and compromised shards among the first i
+    // holders, for each i.
+    let mut survived = vec![0u32; holders.len() + 1];
+    let mut compromised = vec![0u32; holders.len() + 1];
+    for _ in 0..trials {
+        for (i, holder) in holders.iter().enumerate() {
+            let lost = rng.gen::<f64>() < holder.loss;
+            let stolen = rng.gen::<f64>() < holder.compromise;
+            survived[i + 1] = survived[i] + (!lost) as u32;
+            compromised[i + 1] = compromised[i] + stolen as u32;
+        }
+        for result in results.iter_mut() {
+            let shards = result.shards as usize;
+            if survived[shards] < result.quorum_size {
+                result.lost += 1;
+            }
+            if compromised[shards] >= result.quorum_size {
+                result.compromised += 1;
+            }
+        }
+    }
+    Ok(results)
+}
+
+/// Threshold recommended by [`recommend`].
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub struct Recommendation {
+    /// Simulated outcome of the recommended quorum size and number of shards.
+    pub result: SimulationResult,
+    /// Number of groups of holders the shards should be spread evenly across.
+    /// If this is larger than 1, the quorum size is large enough that the
+    /// holders in any one group cannot recover the secret on their own.
+    pub groups: u32,
+}
+
+impl Recommendation {
+    /// Returns the largest number of shards given to the holders in any one
+    /// group, if the shards are spread evenly across the groups.
+    pub fn shards_per_group(&self) -> u32 {
+        (self.result.shards + self.groups - 1) / self.groups
+    }
+}
+
+/// Recommend a quorum size and number of shards for handing shards out to
+/// (some of) `holders`, which minimises the combined probability of the
+/// secret being lost or an attacker reaching quorum (as estimated by
+/// [`simulate`]). Ties are broken in favour of fewer shards.
+///
+/// The quorum size is always larger than `max_colluding` (the largest number
+/// of holders who might work together against the owner). If `groups` is
+/// larger than 1, the holders are assumed to be split into that many groups
+/// (such as family and colleagues), and the quorum size must also be larger
+/// than the number of shards any one group holds, so that recovery requires
+/// more than one group to take part. Returns `None` if no threshold satisfies
+/// these constraints.
+pub fn recommend<R: Rng>(
+    rng: &mut R,
+    holders: &[HolderRisk],
+    max_colluding: u32,
+    groups: u32,
+    trials: u32,
+) -> Result<Option<Recommendation>, Error> {
+    let groups = groups.max(1);
+    let candidates = (1..=holders.len() as u32)
+        .filter(|n| *n >= groups)
+        .flat_map(|n| (1..=n).map(move |k| (k, n)))
+        .filter(|&(k, n)| k > max_colluding && (groups == 1 || k > (n + groups - 1) / groups))
+        .collect::<Vec<_>>();
+    if candidates.is_empty() {
+        return Ok(None);
+    }
+
+    let results = simulate(rng, holders, &candidates, trials)?;
+    let score = |result: &SimulationResult| result.lost + result.compromised;
+    Ok(results
+        .into_iter()
+        .min_by(|a, b| {
+            score(a)
+                .cmp(&score(b))
+                .then(a.shards.cmp(&b.shards))
+                .then(b.quorum_size.cmp(&a.quorum_size))
+        })
+        .map(|result| Recommendation { result, groups }))
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use rand::{rngs::StdRng, SeedableRng};
+
+    #[test]
+    fn simulate_extremes() {
+        let mut rng = StdRng::seed_from_u64(0);
+        let safe = vec![HolderRisk::new(0.0, 0.0).unwrap(); 3];
+        let results = simulate(&mut rng, &safe, &[(2, 3)], 100).unwrap();
+        assert_eq!(results[0].lost, 0);
+        assert_eq!(results[0].compromised, 0);
+
+        let doomed = vec![HolderRisk::new(1.0, 1.0).unwrap(); 3];
+        let results = simulate(&mut rng, &doomed, &[(2, 3)], 100).unwrap();
+        assert_eq!(results[0].lost, 100);
+        assert_eq!(results[0].compromised, 100);
+    }
+
+    #[test]
+    fn simulate_estimate() {
+        // With 2-of-3 and independent 10% loss, the secret is lost with
+        // probability 3*0.1^2*0.9 + 0.1^3 = 0.028.
+        let mut rng = StdRng::seed_from_u64(1);
+        let holders = vec![HolderRisk::new(0.1, 0.0).unwrap(); 3];
+        let results = simulate(&mut rng, &holders, &[(2, 3), (1, 1)], 100_000).unwrap();
+        assert!((results[0].loss_probability() - 0.028).abs() < 0.005);
+        assert!((results[1].loss_probability() - 0.1).abs() < 0.01);
+    }
+
+    #[test]
+    fn simulate_invalid() {
+        let mut rng = StdRng::seed_from_u64(0);
+        let holders = vec![HolderRisk::new(0.1, 0.1).unwrap(); 2];
+        simulate(&mut rng, &holders, &[(2, 3)], 10).unwrap_err();
+        simulate(&mut rng, &holders, &[(3, 2)], 10).unwrap_err();
+        simulate(&mut rng, &holders, &[(1, 2)], 0).unwrap_err();
+        HolderRisk::new(1.5, 0.0).unwrap_err();
+    }
+
+    #[test]
+    fn recommend_constraints() {
+        let mut rng = StdRng::seed_from_u64(2);
+        let holders = vec![HolderRisk::new(0.05, 0.02).unwrap(); 6];
+
+        let recommendation = recommend(&mut rng, &holders, 2, 1, 10_000)
+            .unwrap()
+            .unwrap();
+        assert!(recommendation.result.quorum_size > 2);
+        assert!(recommendation.result.quorum_size <= recommendation.result.shards);
+
+        let recommendation = recommend(&mut rng, &holders, 0, 3, 10_000)
+            .unwrap()
+            .unwrap();
+        assert!(recommendation.result.shards >= 3);
+        assert!(recommendation.result.quorum_size > recommendation.shards_per_group());
+
+        // Nobody can be trusted.
+        assert_eq!(recommend(&mut rng, &holders, 6, 1, 100).unwrap(), None);
+    }
+}
@@ -0,0 +1,241 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{
+    render::{escape_markup, qr_grid_columns, wrap_text},
+    Barcode, PageLayout, Sheet,
+};
+
+use std::fmt::Write;
+
+const TITLE_FONT_SIZE_MM: f64 = 6.0;
+const TEXT_FONT_SIZE_MM: f64 = 3.5;
+const LINE_HEIGHT_MM: f64 = 5.0;
+
+/// Approximate width of a character in the (proportional) text font, used for
+/// wrapping the instructions.
+const TEXT_CHAR_WIDTH_MM: f64 = 1.9;
+
+/// Returns the SVG path data drawing every dark module of `code` as a unit
+/// square, offset by the quiet zone (so the whole code is `width + 2 *
+/// quiet_zone` units wide).
+pub(crate) fn qr_path_data(code: &Barcode) -> String {
+    let quiet_zone = code.quiet_zone();
+    code.dark_modules()
+        .map(|(x, y)| format!("M{},{}h1v1h-1z", x + quiet_zone, y + quiet_zone))
+        .collect()
+}
+
+fn text(svg: &mut String, x: f64, y: f64, class: &str, content: &str) {
+    writeln!(
+        svg,
+        r#"  <text x="{:.2}" y="{:.2}" class="{}">{}</text>"#,
+        x,
+        y,
+        class,
+        escape_markup(content)
+    )
+    .expect("writing to a string cannot fail");
+}
+
+/// Render `sheet` as a standalone SVG image of a single page.
+///
+/// All dimensions are in millimetres, and the QR code is drawn as a single
+/// vector path so that it can be printed at any scale. Since each image is a
+/// single page, the duplex setting of `layout` has no effect.
+pub fn sheet_to_svg(sheet: &Sheet, layout: &PageLayout) -> String {
+    let (width, height) = layout.paper.dimensions_mm();
+    let margin = layout.margin_mm;
+    let text_width = layout.content_width_mm();
+
+    let mut svg = String::new();
+    writeln!(
+        svg,
+        r#"<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" width="{w}mm" height="{h}mm" viewBox="0 0 {w} {h}">
+  <title>{title}</title>
+  <style>
+    text {{ fill: black; font-size: {text}px; font-family: sans-serif; }}
+    .title {{ font-size: {title_size}px; font-weight: bold; }}
+    .mono {{ font-family: monospace; }}
+  </style>
+  <rect width="100%" height="100%" fill="white"/>"#,
+        w = width,
+        h = height,
+        title = escape_markup(sheet.title()),
+        text = TEXT_FONT_SIZE_MM,
+        title_size = TITLE_FONT_SIZE_MM,
+    )
+    .expect("writing to a string cannot fail");
+
+    let mut y = margin + LINE_HEIGHT_MM;
+    text(&mut svg, margin, y, "title", sheet.title());
+    if let Some(spotcheck) = sheet.spotcheck() {
+        writeln!(
+            svg,
+            r#"  <text x="{:.2}" y="{:.2}" class="mono" text-anchor="end">Spot-Check: {}</text>"#,
+            width - margin,
+            y,
+            escape_markup(spotcheck)
+        )
+        .expect("writing to a string cannot fail");
+    }
+    y += LINE_HEIGHT_MM;
+
+    // QR codes (or Data Matrix symbols), in a grid centred horizontally. Each
+    // module is a unit square, scaled to the size of the code.
+    let codes = sheet.codes();
+    let columns = qr_grid_columns(codes.len());
+    let rows = (codes.len() + columns - 1) / columns;
+    let qr_size = layout.grid_size_mm();
+    let cell_size = qr_size / columns as f64;
+    for (idx, code) in codes.iter().enumerate() {
+        let modules = code.width() + 2 * code.quiet_zone();
+        writeln!(
+            svg,
+            r#"  <path transform="translate({:.2},{:.2}) scale({:.4})" fill="black" shape-rendering="crispEdges" d="{}"/>"#,
+            (width - qr_size) / 2.0 + (idx % columns) as f64 * cell_size,
+            y + (idx / columns) as f64 * cell_size,
+            cell_size / modules as f64,
+            qr_path_data(code)
+        )
+        .expect("writing to a string cannot fail");
+    }
+    y += rows as f64 * cell_size + LINE_HEIGHT_MM;
+
+    for line in sheet.text_lines() {
+        text(&mut svg, margin, y, "mono", line);
+        y += LINE_HEIGHT_MM;
+    }
+    if !sheet.text_lines().is_empty() {
+        y += LINE_HEIGHT_MM;
+    }
+
+    if layout.show_details {
+        for (name, value) in sheet.details() {
+            text(&mut svg, margin, y, "mono", &format!("{}: {}", name, value));
+            y += LINE_HEIGHT_MM;
+        }
+        y += LINE_HEIGHT_MM;
+    }
+
+    if layout.show_instructions {
+        let wrap_width = (text_width / TEXT_CHAR_WIDTH_MM) as usize;
+        for line in wrap_text(sheet.instructions(), wrap_width) {
+            text(&mut svg, margin, y, "text", &line);
+            y += LINE_HEIGHT_MM;
+        }
+    }
+
+    // Detachable codeword section, at the bottom of the page.
+    if let Some(codewords) = sheet.codewords().filter(|_| layout.show_codewords) {
+        let mut y = height - margin - 8.0 * LINE_HEIGHT_MM;
+        writeln!(
+            svg,
+            r#"  <line x1="{:.2}" y1="{:.2}" x2="{:.2}" y2="{:.2}" stroke="black" stroke-width="0.3" stroke-dasharray="2,1"/>"#,
+            margin,
+            y,
+            width - margin,
+            y
+        )
+        .expect("writing to a string cannot fail");
+        text(
+            &mut svg,
+            margin,
+            y - 1.5,
+            "text",
+            "Cut here to store the codewords separately.",
+        );
+        for (name, value) in sheet.details().iter().take(2) {
+            y += LINE_HEIGHT_MM;
+            text(&mut svg, margin, y, "mono", &format!("{}: {}", name, value));
+        }
+        y += LINE_HEIGHT_MM;
+        for words in codewords.chunks(6) {
+            y += LINE_HEIGHT_MM;
+            text(&mut svg, margin, y, "mono", &words.join(" "));
+        }
+        if let Some(checksum) = sheet.codewords_checksum() {
+            y += LINE_HEIGHT_MM;
+            text(
+                &mut svg,
+                margin,
+                y,
+                "mono",
+                &format!("Codeword-Checksum: #{}", checksum),
+            );
+        }
+    }
+
+    svg.push_str("</svg>\n");
+    svg
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{
+        codewords_checksum, spotcheck_digits, Backup, PaperSize, QrErrorCorrection, SheetEncoding,
+        Symbology,
+    };
+
+    #[test]
+    fn backup_svg() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let (shard, codewords) = backup.next_shard().unwrap().encrypt().unwrap();
+        let level = QrErrorCorrection::default();
+
+        let sheet = Sheet::main_document(backup.main_document(), level).unwrap();
+        let svg = sheet_to_svg(&sheet, &PageLayout::new(PaperSize::A4));
+        assert!(svg.starts_with("<?xml"));
+        assert!(svg.contains(r#"viewBox="0 0 210 297""#));
+        assert!(svg.contains(&backup.main_document().checksum_string()));
+        assert!(svg.contains(&format!(
+            "Spot-Check: {}",
+            spotcheck_digits(backup.main_document())
+        )));
+        assert!(svg.trim_end().ends_with("</svg>"));
+
+        let sheet = Sheet::key_shard(&shard, &codewords, level).unwrap();
+        let svg = sheet_to_svg(&sheet, &PageLayout::new(PaperSize::Letter));
+        assert!(svg.contains(r#"viewBox="0 0 215.9 279.4""#));
+        assert!(svg.contains(&codewords[..6].join(" ")));
+        assert!(svg.contains(&format!("#{}", codewords_checksum(&codewords))));
+
+        let layout = PageLayout::new(PaperSize::A5)
+            .show_details(false)
+            .show_instructions(false)
+            .show_codewords(false);
+        let svg = sheet_to_svg(&sheet, &layout);
+        assert!(svg.contains(r#"viewBox="0 0 148 210""#));
+        assert!(!svg.contains(&codewords[..6].join(" ")));
+        assert!(!svg.contains("Shard-ID"));
+        assert!(!svg.contains("This is one of the key shards"));
+
+        let datamatrix = sheet.clone().symbology(Symbology::DataMatrix);
+        let svg = sheet_to_svg(&datamatrix, &PageLayout::default());
+        assert_eq!(svg.matches("<path").count(), datamatrix.codes().len());
+        assert!(svg.contains(&qr_path_data(&datamatrix.codes()[0])));
+
+        let sheet = sheet.encoding(SheetEncoding::Text);
+        let svg = sheet_to_svg(&sheet, &PageLayout::default());
+        assert!(!svg.contains("<path"));
+        assert!(svg.contains(&sheet.text_lines()[0]));
+    }
+}
@@ -0,0 +1,255 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! Plain-text fallback encoding of documents, for printing alongside (or
+//! instead of) the QR codes so that a document can still be recovered by
+//! typing it in by hand if no QR scanner is available.
+//!
+//! The framed document is split into numbered lines of zbase32, each with a
+//! short checksum so that a mistyped line can be pointed out (and corrected)
+//! without needing to retype the entire document. For example:
+//!
+//! ```text
+//! 01/03 ybndrfg8 ejkmcpqx ot1uwisz a345h769 ehro
+//! ```
+
+use crate::v0::{Error, FrameEncoding, Framed, CHECKSUM_ALGORITHM};
+
+use std::collections::BTreeMap;
+
+use multihash::MultihashDigest;
+
+/// Number of bytes of the document in each line (which is encoded as exactly
+/// 32 zbase32 characters).
+const TEXT_LINE_BYTES: usize = 20;
+
+/// Number of characters in each space-separated group of a line.
+const TEXT_GROUP_CHARS: usize = 8;
+
+/// Number of checksum bytes at the end of each line.
+const TEXT_CHECKSUM_BYTES: usize = 2;
+
+/// Returns the checksum of line `number` (of `total`) containing `data`. The
+/// line number and total are included so that lines cannot be swapped or
+/// mixed up with lines of other documents.
+fn line_checksum(number: u32, total: u32, data: &[u8]) -> String {
+    let mut bytes = Vec::with_capacity(8 + data.len());
+    bytes.extend_from_slice(&number.to_be_bytes());
+    bytes.extend_from_slice(&total.to_be_bytes());
+    bytes.extend_from_slice(data);
+    let chksum = CHECKSUM_ALGORITHM.digest(&bytes);
+    zbase32::encode_full_bytes(&chksum.digest()[..TEXT_CHECKSUM_BYTES])
+}
+
+/// Encode `data` as numbered and checksummed lines of text.
+pub fn text_lines<B: AsRef<[u8]>>(data: B) -> Vec<String> {
+    let chunks = data.as_ref().chunks(TEXT_LINE_BYTES).collect::<Vec<_>>();
+    let total = chunks.len() as u32;
+    let number_width = total.to_string().len().max(2);
+    chunks
+        .iter()
+        .zip(1..)
+        .map(|(chunk, number)| {
+            let encoded = zbase32::encode_full_bytes(chunk);
+            let groups = encoded
+                .as_bytes()
+                .chunks(TEXT_GROUP_CHARS)
+                .map(|group| std::str::from_utf8(group).expect("zbase32 is always ascii"))
+                .collect::<Vec<_>>();
+            format!(
+                "{:0width$}/{:0width$} {} {}",
+                number,
+                total,
+                groups.join(" "),
+                line_checksum(number, total, chunk),
+                width = number_width,
+            )
+        })
+        .collect()
+}
+
+/// Encode `document` (in its framed representation) as numbered and
+/// checksummed lines of text.
+pub fn document_text_lines<T: Framed>(document: &T) -> Vec<String> {
+    text_lines(document.to_framed(FrameEncoding::Raw))
+}
+
+/// Parse the numbered line prefix ("NN/MM") of a text line.
+fn parse_line_number(prefix: &str) -> Option<(u32, u32)> {
+    let mut parts = prefix.splitn(2, '/');
+    let number = parts.next()?.parse().ok()?;
+    let total = parts.next()?.parse().ok()?;
+    Some((number, total))
+}
+
+/// Decode a single text line, returning its line number, the total number of
+/// lines, and the data it contains.
+fn parse_line(line: &str) -> Result<(u32, u32, Vec<u8>), Error> {
+    let fields = line.split_whitespace().collect::<Vec<_>>();
+    if fields.len() < 3 {
+        return Err(Error::TextDecode(format!("line '{}' is too short", line)));
+    }
+    let (number, total) = parse_line_number(fields[0])
+        .filter(|(number, total)| *number >= 1 && number <= total)
+        .ok_or_else(|| Error::TextDecode(format!("line '{}' has an invalid line number", line)))?;
+
+    let encoded = fields[1..fields.len() - 1].concat().to_lowercase();
+    let chksum = fields[fields.len() - 1].to_lowercase();
+    let data = zbase32::decode_full_bytes_str(&encoded).map_err(|err| {
+        Error::TextDecode(format!("line {} is not valid zbase32: {}", number, err))
+    })?;
+    if line_checksum(number, total, &data) != chksum {
+        return Err(Error::TextDecode(format!(
+            "line {} has an incorrect checksum (it may have been mistyped)",
+            number
+        )));
+    }
+    Ok((number, total, data))
+}
+
+/// Decode the data from text lines produced by [`text_lines`].
+///
+/// The lines may be given in any order, and blank lines are ignored. Each line
+/// is checked individually, so the error identifies which line (if any) was
+/// mistyped or is missing.
+pub fn parse_text_lines<S: AsRef<str>>(lines: &[S]) -> Result<Vec<u8>, Error> {
+    let mut total = None;
+    let mut chunks = BTreeMap::new();
+    for line in lines.iter().map(AsRef::as_ref) {
+        if line.trim().is_empty() {
+            continue;
+        }
+        let (number, line_total, data) = parse_line(line)?;
+        if *total.get_or_insert(line_total) != line_total {
+            return Err(Error::TextDecode(format!(
+                "line {} belongs to a different document",
+                number
+            )));
+        }
+        if chunks.get(&number).map_or(false, |other| other != &data) {
+            return Err(Error::TextDecode(format!(
+                "line {} was given twice with different contents",
+                number
+            )));
+        }
+        chunks.insert(number, data);
+    }
+
+    let total = total.ok_or_else(|| Error::TextDecode("no lines given".into()))?;
+    let missing = (1..=total)
+        .filter(|number| !chunks.contains_key(number))
+        .map(|number| number.to_string())
+        .collect::<Vec<_>>();
+    if !missing.is_empty() {
+        return Err(Error::TextDecode(format!(
+            "missing lines {}",
+            missing.join(", ")
+        )));
+    }
+    Ok(chunks.into_iter().flat_map(|(_, data)| data).collect())
+}
+
+/// Decode a document from the text produced by [`document_text_lines`].
+pub fn parse_text_document<T: Framed>(text: &str) -> Result<T, Error> {
+    let lines = text.lines().collect::<Vec<_>>();
+    Ok(T::from_framed(parse_text_lines(&lines)?)?)
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{Backup, MainDocument};
+
+    #[quickcheck]
+    fn text_lines_roundtrip(data: Vec<u8>) -> bool {
+        let lines = text_lines(&data);
+        data.is_empty() || parse_text_lines(&lines).unwrap() == data
+    }
+
+    #[quickcheck]
+    fn text_lines_unordered(data: Vec<u8>) -> bool {
+        let mut lines = text_lines(&data);
+        lines.reverse();
+        lines.insert(0, String::new());
+        data.is_empty() || parse_text_lines(&lines).unwrap() == data
+    }
+
+    #[test]
+    fn text_line_format() {
+        let lines = text_lines([0xa5; 45]);
+        assert_eq!(lines.len(), 3);
+        for (line, number) in lines.iter().zip(1..) {
+            let fields = line.split_whitespace().collect::<Vec<_>>();
+            assert_eq!(fields[0], format!("0{}/03", number));
+            assert_eq!(fields.last().unwrap().len(), 4);
+        }
+        // Full lines have 4 groups of 8 characters.
+        assert_eq!(lines[0].split_whitespace().count(), 6);
+        assert_eq!(lines[2].split_whitespace().count(), 3);
+
+        // Case and spacing are not significant.
+        let sloppy = lines
+            .iter()
+            .map(|line| line.to_uppercase().replacen(' ', "   ", 2))
+            .collect::<Vec<_>>();
+        assert_eq!(parse_text_lines(&sloppy).unwrap(), vec![0xa5; 45]);
+    }
+
+    #[test]
+    fn text_line_errors() {
+        let lines = text_lines((0..100).collect::<Vec<u8>>());
+        assert_eq!(lines.len(), 5);
+
+        // Mistyped line.
+        let mut typo = lines.clone();
+        let replacement = if typo[2].as_bytes()[6] == b'y' {
+            "b"
+        } else {
+            "y"
+        };
+        typo[2].replace_range(6..7, replacement);
+        let err = parse_text_lines(&typo).unwrap_err().to_string();
+        assert!(err.contains("line 3"), "unexpected error: {}", err);
+
+        // Missing lines.
+        let err = parse_text_lines(&lines[1..4]).unwrap_err().to_string();
+        assert!(
+            err.contains("missing lines 1, 5"),
+            "unexpected error: {}",
+            err
+        );
+
+        // Lines from another document.
+        let mut mixed = lines.clone();
+        mixed[4] = text_lines(vec![0; 20]).remove(0);
+        parse_text_lines(&mixed).unwrap_err();
+
+        parse_text_lines(&["garbage"]).unwrap_err();
+        parse_text_lines(&["00/01 yyyyyyyy yyyy"]).unwrap_err();
+        parse_text_lines::<&str>(&[]).unwrap_err();
+    }
+
+    #[test]
+    fn text_document() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let main = backup.main_document();
+        let text = document_text_lines(main).join("\n");
+        assert_eq!(&parse_text_document::<MainDocument>(&text).unwrap(), main);
+    }
+}
@@ -0,0 +1,79 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{Error, KeyShard};
+
+/// Source of trusted timestamps, such as an [RFC 3161][rfc3161] time-stamping
+/// authority.
+///
+/// The timestamp token is requested over the wire encoding of the main
+/// document (as returned by `ToWire::to_wire`), and is stored in each key shard
+/// issued afterwards. paperback treats the token as opaque bytes -- it is
+/// up to the user to verify it with the relevant authority's tooling (such as
+/// `openssl ts -verify`).
+///
+/// [rfc3161]: https://tools.ietf.org/html/rfc3161
+pub trait Timestamper {
+    /// Obtain a timestamp token over `data`.
+    fn timestamp(&self, data: &[u8]) -> Result<Vec<u8>, Error>;
+}
+
+impl<F> Timestamper for F
+where
+    F: Fn(&[u8]) -> Result<Vec<u8>, Error>,
+{
+    fn timestamp(&self, data: &[u8]) -> Result<Vec<u8>, Error> {
+        self(data)
+    }
+}
+
+impl KeyShard {
+    /// Returns the trusted timestamp token over the main document, if one was
+    /// obtained when the backup was created.
+    pub fn timestamp_token(&self) -> Option<&[u8]> {
+        self.inner.timestamp_token.as_deref()
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{Backup, FromWire, MainDocument, ToWire};
+
+    #[test]
+    fn timestamp_token_roundtrip() {
+        let mut backup = Backup::new(2, b"secret data").unwrap();
+        let main_document = backup.main_document().clone();
+
+        // A fake "authority" which just echoes back the document.
+        backup
+            .timestamp(&|data: &[u8]| Ok::<_, Error>(data.to_vec()))
+            .unwrap();
+
+        let shard = backup.next_shard().unwrap();
+        let shard = KeyShard::from_wire(shard.to_wire()).unwrap();
+        let token = shard.timestamp_token().unwrap();
+        assert_eq!(MainDocument::from_wire(token).unwrap(), main_document);
+
+        // Timestamping after issuing shards is not permitted.
+        backup
+            .timestamp(&|_: &[u8]| Ok::<_, Error>(vec![]))
+            .unwrap_err();
+    }
+}
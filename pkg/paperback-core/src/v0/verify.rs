@@ -0,0 +1,417 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+//! Offline checks of individual documents, which need neither a quorum nor any
+//! codewords (and so are suitable for periodically checking that a stored
+//! document is still readable).
+
+use crate::v0::{
+    from_armor, parse_text_lines, to_multibase_zbase32, AuditResponse, DocumentKind,
+    EncryptedKeyShard, Error, FrameEncoding, FrameHeader, Framed, FromWire, KeyShard, MainDocument,
+    Page, CHECKSUM_ALGORITHM,
+};
+
+use multihash::MultihashDigest;
+
+/// Number of spot-check digits (see [`spotcheck_digits`]).
+pub const SPOTCHECK_DIGITS: usize = 8;
+
+/// Returns the spot-check digits of `document`, a short sequence of decimal
+/// digits derived from the checksum of the framed document (the data in its
+/// QR codes and text lines), formatted as "1234-5678".
+///
+/// The digits are printed on every sheet, so that a copy of a printed document
+/// can be checked against the original by comparing the digits printed on the
+/// original with those of the scanned copy, without comparing the whole
+/// document.
+pub fn spotcheck_digits<T: Framed>(document: &T) -> String {
+    let chksum = CHECKSUM_ALGORITHM.digest(&document.to_framed(FrameEncoding::Raw));
+    let mut value = [0u8; 8];
+    value.copy_from_slice(&chksum.digest()[..8]);
+    let digits = format!(
+        "{:0width$}",
+        u64::from_be_bytes(value) % 10u64.pow(SPOTCHECK_DIGITS as u32),
+        width = SPOTCHECK_DIGITS
+    );
+    let (first, second) = digits.split_at(SPOTCHECK_DIGITS / 2);
+    format!("{}-{}", first, second)
+}
+
+/// Returns whether `digits` (as typed in by a user, with any separators) are
+/// the spot-check digits `expected`.
+pub fn spotcheck_matches(digits: &str, expected: &str) -> bool {
+    let only_digits = |text: &str| {
+        text.chars()
+            .filter(char::is_ascii_digit)
+            .collect::<String>()
+    };
+    only_digits(digits) == only_digits(expected)
+}
+
+/// A decoded document of any kind.
+#[derive(Clone, Debug)]
+pub enum AnyDocument {
+    MainDocument(MainDocument),
+    EncryptedKeyShard(EncryptedKeyShard),
+    KeyShard(KeyShard),
+    AuditResponse(AuditResponse),
+    Page(Page),
+}
+
+impl AnyDocument {
+    /// Decode a framed document of any kind (see [`Framed`]).
+    pub fn from_framed<B: AsRef<[u8]>>(input: B) -> Result<Self, Error> {
+        let input = input.as_ref();
+        let (header, _) = FrameHeader::parse(input)?;
+        Ok(match header.kind() {
+            DocumentKind::MainDocument => Self::MainDocument(Framed::from_framed(input)?),
+            DocumentKind::EncryptedKeyShard => Self::EncryptedKeyShard(Framed::from_framed(input)?),
+            DocumentKind::KeyShard => Self::KeyShard(Framed::from_framed(input)?),
+            DocumentKind::AuditResponse => Self::AuditResponse(Framed::from_framed(input)?),
+            DocumentKind::Page => Self::Page(Framed::from_framed(input)?),
+        })
+    }
+
+    /// Decode a document of any kind given as armored text (see
+    /// [`to_armor`](crate::v0::to_armor)), plain-text fallback lines (see
+    /// [`text_lines`](crate::v0::text_lines)) or zbase32.
+    ///
+    /// Unlike the other formats, zbase32 does not record what kind of document
+    /// it contains, so each kind is tried in the order of
+    /// [`DocumentKind::all`].
+    pub fn from_text(text: &str) -> Result<Self, Error> {
+        let text = text.trim();
+        if text.starts_with("-----BEGIN PAPERBACK ") {
+            let kind = DocumentKind::all()
+                .iter()
+                .copied()
+                .find(|kind| {
+                    text.starts_with(&format!("-----BEGIN PAPERBACK {}-----", kind.name()))
+                })
+                .ok_or_else(|| Error::Other("unknown kind of armored document".into()))?;
+            Ok(match kind {
+                DocumentKind::MainDocument => Self::MainDocument(from_armor(text)?),
+                DocumentKind::EncryptedKeyShard => Self::EncryptedKeyShard(from_armor(text)?),
+                DocumentKind::KeyShard => Self::KeyShard(from_armor(text)?),
+                DocumentKind::AuditResponse => Self::AuditResponse(from_armor(text)?),
+                DocumentKind::Page => Self::Page(from_armor(text)?),
+            })
+        } else if text.lines().count() > 1 || text.contains('/') {
+            let lines = text.lines().collect::<Vec<_>>();
+            Self::from_framed(parse_text_lines(&lines)?)
+        } else {
+            MainDocument::from_wire_zbase32(text)
+                .map(Self::MainDocument)
+                .or_else(|_| {
+                    EncryptedKeyShard::from_wire_zbase32(text).map(Self::EncryptedKeyShard)
+                })
+                .or_else(|_| KeyShard::from_wire_zbase32(text).map(Self::KeyShard))
+                .or_else(|_| AuditResponse::from_wire_zbase32(text).map(Self::AuditResponse))
+                .or_else(|_| Page::from_wire_zbase32(text).map(Self::Page))
+                .map_err(|_| Error::Other("not a valid zbase32 document of any kind".into()))
+        }
+    }
+
+    /// Returns what kind of document this is.
+    pub fn kind(&self) -> DocumentKind {
+        match self {
+            Self::MainDocument(_) => DocumentKind::MainDocument,
+            Self::EncryptedKeyShard(_) => DocumentKind::EncryptedKeyShard,
+            Self::KeyShard(_) => DocumentKind::KeyShard,
+            Self::AuditResponse(_) => DocumentKind::AuditResponse,
+            Self::Page(_) => DocumentKind::Page,
+        }
+    }
+
+    /// Returns the framed representation of the document (see [`Framed`]).
+    pub fn to_framed(&self, encoding: FrameEncoding) -> Vec<u8> {
+        match self {
+            Self::MainDocument(main) => main.to_framed(encoding),
+            Self::EncryptedKeyShard(shard) => shard.to_framed(encoding),
+            Self::KeyShard(shard) => shard.to_framed(encoding),
+            Self::AuditResponse(response) => response.to_framed(encoding),
+            Self::Page(page) => page.to_framed(encoding),
+        }
+    }
+
+    /// Returns whether `other` is exactly the same document, byte for byte
+    /// (such as when `other` was scanned from a freshly printed copy of this
+    /// document).
+    pub fn is_identical(&self, other: &Self) -> bool {
+        self.to_framed(FrameEncoding::Raw) == other.to_framed(FrameEncoding::Raw)
+    }
+
+    /// Returns the spot-check digits of the document (see
+    /// [`spotcheck_digits`]).
+    pub fn spotcheck(&self) -> String {
+        match self {
+            Self::MainDocument(main) => spotcheck_digits(main),
+            Self::EncryptedKeyShard(shard) => spotcheck_digits(shard),
+            Self::KeyShard(shard) => spotcheck_digits(shard),
+            Self::AuditResponse(response) => spotcheck_digits(response),
+            Self::Page(page) => spotcheck_digits(page),
+        }
+    }
+
+    /// Check the document as far as is possible without a quorum or any
+    /// codewords.
+    ///
+    /// The document has already been decoded, so it is well-formed and has a
+    /// supported schema version. If `expected_checksum` is given (such as the
+    /// checksum printed on the main document, or stored in a key shard), it is
+    /// compared to the checksum of the main document this document belongs to.
+    pub fn verify(&self, expected_checksum: Option<&str>) -> Verification {
+        let mut checks = vec![("well-formed", CheckResult::Passed)];
+
+        let signature = match self {
+            Self::MainDocument(main) => main.verify_signature().into(),
+            Self::KeyShard(shard) => shard.verify_signature().into(),
+            Self::EncryptedKeyShard(_) => {
+                CheckResult::Skipped("the key shard must be decrypted first")
+            }
+            Self::AuditResponse(_) => {
+                CheckResult::Skipped("audit responses are verified against a challenge")
+            }
+            Self::Page(_) => CheckResult::Skipped("pages are not signed"),
+        };
+        checks.push(("signature", signature));
+
+        if let Self::Page(page) = self {
+            let intact = if page.is_intact() {
+                CheckResult::Passed
+            } else {
+                CheckResult::Failed("page contents do not match the page checksum".into())
+            };
+            checks.push(("page-checksum", intact));
+        }
+
+        let checksum = match self {
+            Self::MainDocument(main) => Some(main.checksum()),
+            Self::KeyShard(shard) => Some(shard.document_checksum()),
+            Self::AuditResponse(response) => Some(response.doc_chksum),
+            Self::EncryptedKeyShard(_) | Self::Page(_) => None,
+        }
+        .map(|checksum| to_multibase_zbase32(checksum.to_bytes()));
+        let checksum = match (checksum, expected_checksum) {
+            (None, _) => CheckResult::Skipped("the document does not identify its main document"),
+            (Some(_), None) => CheckResult::Skipped("no expected checksum given"),
+            (Some(checksum), Some(expected)) if checksum == expected.trim() => CheckResult::Passed,
+            (Some(checksum), Some(expected)) => CheckResult::Failed(format!(
+                "main document checksum {} does not match expected checksum {}",
+                checksum, expected
+            )),
+        };
+        checks.push(("checksum", checksum));
+
+        Verification {
+            kind: self.kind(),
+            checks,
+        }
+    }
+}
+
+/// Outcome of a single check performed by [`AnyDocument::verify`] or
+/// [`selftest`](crate::v0::selftest).
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub enum CheckResult {
+    Passed,
+    Failed(String),
+    /// The check does not apply to this document (for the given reason).
+    Skipped(&'static str),
+}
+
+impl From<Result<(), Error>> for CheckResult {
+    fn from(result: Result<(), Error>) -> Self {
+        match result {
+            Ok(_) => Self::Passed,
+            Err(err) => Self::Failed(err.to_string()),
+        }
+    }
+}
+
+/// Results of [`AnyDocument::verify`].
+#[derive(Clone, Debug)]
+pub struct Verification {
+    kind: DocumentKind,
+    checks: Vec<(&'static str, CheckResult)>,
+}
+
+impl Verification {
+    /// Returns the kind of document which was checked.
+    pub fn kind(&self) -> DocumentKind {
+        self.kind
+    }
+
+    /// Returns the name and outcome of each check, in the order they were
+    /// performed.
+    pub fn checks(&self) -> &[(&'static str, CheckResult)] {
+        &self.checks
+    }
+
+    /// Returns whether none of the checks failed.
+    pub fn is_ok(&self) -> bool {
+        self.checks
+            .iter()
+            .all(|(_, result)| !matches!(result, CheckResult::Failed(_)))
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{paginate, text_lines, to_armor, Backup, FrameEncoding, ToWire};
+
+    fn check<'a>(verification: &'a Verification, name: &str) -> &'a CheckResult {
+        &verification
+            .checks()
+            .iter()
+            .find(|(check, _)| *check == name)
+            .unwrap()
+            .1
+    }
+
+    #[test]
+    fn verify_main_document() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let main = backup.main_document();
+        let document = AnyDocument::MainDocument(main.clone());
+
+        let verification = document.verify(None);
+        assert_eq!(verification.kind(), DocumentKind::MainDocument);
+        assert!(verification.is_ok());
+        assert_eq!(check(&verification, "signature"), &CheckResult::Passed);
+        assert!(matches!(
+            check(&verification, "checksum"),
+            CheckResult::Skipped(_)
+        ));
+
+        let verification = document.verify(Some(&main.checksum_string()));
+        assert_eq!(check(&verification, "checksum"), &CheckResult::Passed);
+        let other = Backup::new(2, b"secret data").unwrap();
+        let verification = document.verify(Some(&other.main_document().checksum_string()));
+        assert!(!verification.is_ok());
+
+        // Swap in the identity of another document.
+        let mut forged = main.clone();
+        forged.identity = other.main_document().identity.clone();
+        let verification = AnyDocument::MainDocument(forged).verify(None);
+        assert!(matches!(
+            check(&verification, "signature"),
+            CheckResult::Failed(_)
+        ));
+    }
+
+    #[test]
+    fn verify_key_shard() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let checksum = backup.main_document().checksum_string();
+        let shard = backup.next_shard().unwrap();
+        let (encrypted, _) = shard.encrypt().unwrap();
+
+        let verification = AnyDocument::KeyShard(shard).verify(Some(&checksum));
+        assert!(verification.is_ok());
+        assert_eq!(check(&verification, "signature"), &CheckResult::Passed);
+        assert_eq!(check(&verification, "checksum"), &CheckResult::Passed);
+
+        let verification = AnyDocument::EncryptedKeyShard(encrypted).verify(Some(&checksum));
+        assert!(verification.is_ok());
+        assert!(matches!(
+            check(&verification, "signature"),
+            CheckResult::Skipped(_)
+        ));
+    }
+
+    #[test]
+    fn verify_page() {
+        let pages = paginate(b"some document data", 4);
+        let verification = AnyDocument::Page(pages[0].clone()).verify(None);
+        assert!(verification.is_ok());
+        assert_eq!(check(&verification, "page-checksum"), &CheckResult::Passed);
+    }
+
+    #[test]
+    fn any_document_from_text() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let main = backup.main_document();
+        let (shard, _) = backup.next_shard().unwrap().encrypt().unwrap();
+
+        for text in &[
+            to_armor(main),
+            main.to_wire_zbase32(),
+            text_lines(main.to_framed(FrameEncoding::Raw)).join("\n"),
+        ] {
+            let document = AnyDocument::from_text(text).unwrap();
+            assert_eq!(document.kind(), DocumentKind::MainDocument);
+        }
+        for text in &[
+            to_armor(&shard),
+            shard.to_wire_zbase32(),
+            text_lines(shard.to_framed(FrameEncoding::Raw)).join("\n"),
+        ] {
+            let document = AnyDocument::from_text(text).unwrap();
+            assert_eq!(document.kind(), DocumentKind::EncryptedKeyShard);
+        }
+
+        AnyDocument::from_text("hyyyy").unwrap_err();
+        AnyDocument::from_text("-----BEGIN PAPERBACK Nothing-----").unwrap_err();
+    }
+
+    #[test]
+    fn any_document_identical() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let main = backup.main_document();
+        let (shard, _) = backup.next_shard().unwrap().encrypt().unwrap();
+
+        let original = AnyDocument::MainDocument(main.clone());
+        let scanned =
+            AnyDocument::from_text(&text_lines(main.to_framed(FrameEncoding::Raw)).join("\n"))
+                .unwrap();
+        assert!(original.is_identical(&scanned));
+        assert!(!original.is_identical(&AnyDocument::EncryptedKeyShard(shard)));
+        let other = Backup::new(2, b"secret data").unwrap();
+        assert!(!original.is_identical(&AnyDocument::MainDocument(other.main_document().clone())));
+    }
+
+    #[test]
+    fn spotcheck() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let main = backup.main_document();
+        let (shard, _) = backup.next_shard().unwrap().encrypt().unwrap();
+
+        let digits = spotcheck_digits(main);
+        assert_eq!(digits.len(), SPOTCHECK_DIGITS + 1);
+        assert_eq!(digits.chars().nth(SPOTCHECK_DIGITS / 2), Some('-'));
+        assert!(digits
+            .chars()
+            .filter(|&ch| ch != '-')
+            .all(|ch| ch.is_ascii_digit()));
+
+        // The digits do not depend on how the document was read.
+        let document = AnyDocument::from_text(&to_armor(main)).unwrap();
+        assert_eq!(document.spotcheck(), digits);
+        let document = AnyDocument::from_text(&shard.to_wire_zbase32()).unwrap();
+        assert_eq!(document.spotcheck(), spotcheck_digits(&shard));
+        assert_ne!(document.spotcheck(), digits);
+
+        assert!(spotcheck_matches(&digits, &digits));
+        assert!(spotcheck_matches(&digits.replace('-', " "), &digits));
+        assert!(!spotcheck_matches(&spotcheck_digits(&shard), &digits));
+        assert!(!spotcheck_matches("", &digits));
+    }
+}
@@ -0,0 +1,250 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{
+    wire::{to_multibase_zbase32, FrameEncoding, Framed, WireError},
+    CHECKSUM_ALGORITHM,
+};
+
+use multihash::{Multihash, MultihashDigest};
+
+const ARMOR_DOCUMENT: &str = "Armor";
+const ARMOR_HASH_HEADER: &str = "Content-Hash";
+const ARMOR_GROUP_LENGTH: usize = 4;
+const ARMOR_GROUPS_PER_LINE: usize = 8;
+
+/// Returns the canonical content hash of a document, which is the checksum of
+/// its wire representation.
+pub fn content_hash<T: Framed>(document: &T) -> Multihash {
+    CHECKSUM_ALGORITHM.digest(&document.to_wire())
+}
+
+/// Encode a document as armored text, suitable for manual entry.
+///
+/// The armored text contains the zbase32 representation of the document split
+/// into short groups, surrounded by `BEGIN` and `END` lines naming the type of
+/// document, with a header containing the canonical content hash.
+pub fn to_armor<T: Framed>(document: &T) -> String {
+    let name = T::KIND.name();
+    let body = document.to_wire_zbase32();
+
+    let mut text = format!("-----BEGIN PAPERBACK {}-----\n", name);
+    text.push_str(&format!(
+        "{}: {}\n\n",
+        ARMOR_HASH_HEADER,
+        to_multibase_zbase32(content_hash(document).to_bytes())
+    ));
+    for line in body
+        .as_bytes()
+        .chunks(ARMOR_GROUP_LENGTH * ARMOR_GROUPS_PER_LINE)
+    {
+        let groups = line
+            .chunks(ARMOR_GROUP_LENGTH)
+            .map(|group| std::str::from_utf8(group).expect("zbase32 must be ascii"))
+            .collect::<Vec<_>>();
+        text.push_str(&groups.join(" "));
+        text.push('\n');
+    }
+    text.push_str(&format!("-----END PAPERBACK {}-----\n", name));
+    text
+}
+
+/// Decode a document from armored text (as produced by [`to_armor`]).
+///
+/// Whitespace inside the body is ignored. If the armor contains a content hash
+/// header, the decoded document must match it.
+pub fn from_armor<T: Framed>(text: &str) -> Result<T, WireError> {
+    let name = T::KIND.name();
+    let err = |field, message: String| WireError::new(ARMOR_DOCUMENT, message).field(field);
+
+    let mut lines = text
+        .lines()
+        .map(str::trim)
+        .skip_while(|line| line.is_empty());
+
+    let begin = format!("-----BEGIN PAPERBACK {}-----", name);
+    if lines.next() != Some(begin.as_str()) {
+        return Err(err("begin", format!("missing '{}' line", begin)));
+    }
+
+    // Headers are terminated by an empty line.
+    let mut expected_hash = None;
+    for line in lines.by_ref().take_while(|line| !line.is_empty()) {
+        let mut parts = line.splitn(2, ':');
+        match (parts.next(), parts.next()) {
+            (Some(key), Some(value)) if key.trim() == ARMOR_HASH_HEADER => {
+                expected_hash = Some(value.trim().to_string())
+            }
+            // Ignore unknown headers.
+            (Some(_), Some(_)) => (),
+            _ => return Err(err("headers", format!("invalid header line '{}'", line))),
+        }
+    }
+
+    let end = format!("-----END PAPERBACK {}-----", name);
+    let mut body = String::new();
+    let mut found_end = false;
+    for line in lines.by_ref() {
+        if line == end {
+            found_end = true;
+            break;
+        }
+        body.extend(line.chars().filter(|c| !c.is_whitespace()));
+    }
+    if !found_end {
+        return Err(err("end", format!("missing '{}' line", end)));
+    }
+
+    let document = T::from_wire_zbase32(&body).map_err(|err| err.within(ARMOR_DOCUMENT, "body"))?;
+    if let Some(expected_hash) = expected_hash {
+        let hash = to_multibase_zbase32(content_hash(&document).to_bytes());
+        if hash != expected_hash {
+            return Err(err(
+                "content_hash",
+                format!(
+                    "document content hash {} does not match armor header {}",
+                    hash, expected_hash
+                ),
+            ));
+        }
+    }
+    Ok(document)
+}
+
+/// A document encoded as both a compact machine-readable payload (suitable for
+/// QR codes) and armored text (suitable for manual entry), bound together by
+/// the canonical content hash of the document.
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub struct DualRepresentation {
+    content_hash: Multihash,
+    machine: Vec<u8>,
+    text: String,
+}
+
+impl DualRepresentation {
+    pub fn new<T: Framed>(document: &T) -> Self {
+        Self {
+            content_hash: content_hash(document),
+            machine: document.to_framed(FrameEncoding::Raw),
+            text: to_armor(document),
+        }
+    }
+
+    /// Construct a `DualRepresentation` from previously-produced payloads
+    /// (such as when they have been scanned and typed in). Use
+    /// [`verify`](Self::verify) to check that they are consistent.
+    pub fn from_parts(content_hash: Multihash, machine: Vec<u8>, text: String) -> Self {
+        Self {
+            content_hash,
+            machine,
+            text,
+        }
+    }
+
+    /// Returns the canonical content hash of the document.
+    pub fn content_hash(&self) -> Multihash {
+        self.content_hash
+    }
+
+    /// Returns the compact (framed) machine-readable payload.
+    pub fn machine(&self) -> &[u8] {
+        &self.machine
+    }
+
+    /// Returns the armored text payload.
+    pub fn text(&self) -> &str {
+        &self.text
+    }
+
+    /// Decode both representations, and check that they decode to identical
+    /// documents which match the content hash.
+    pub fn verify<T: Framed>(&self) -> Result<T, WireError> {
+        let machine_document = T::from_framed(&self.machine)
+            .map_err(|err| err.within("DualRepresentation", "machine"))?;
+        let text_document =
+            from_armor::<T>(&self.text).map_err(|err| err.within("DualRepresentation", "text"))?;
+
+        let machine_bytes = machine_document.to_wire();
+        if machine_bytes != text_document.to_wire() {
+            return Err(WireError::new(
+                "DualRepresentation",
+                "machine and text payloads contain different documents",
+            ));
+        }
+        if CHECKSUM_ALGORITHM.digest(&machine_bytes) != self.content_hash {
+            return Err(WireError::new(
+                "DualRepresentation",
+                "payloads do not match the content hash",
+            )
+            .field("content_hash"));
+        }
+        Ok(machine_document)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{EncryptedKeyShard, MainDocument};
+
+    #[quickcheck]
+    fn armor_roundtrip(shard: EncryptedKeyShard) {
+        let text = to_armor(&shard);
+        assert!(text.starts_with("-----BEGIN PAPERBACK EncryptedKeyShard-----\n"));
+
+        let shard2 = from_armor::<EncryptedKeyShard>(&text).unwrap();
+        assert_eq!(shard, shard2);
+
+        // The wrong document type must be rejected.
+        from_armor::<MainDocument>(&text).unwrap_err();
+    }
+
+    #[quickcheck]
+    fn dual_representation_roundtrip(main: MainDocument) {
+        let dual = DualRepresentation::new(&main);
+        assert_eq!(dual.content_hash(), content_hash(&main));
+
+        let main2 = dual.verify::<MainDocument>().unwrap();
+        assert_eq!(main, main2);
+    }
+
+    #[quickcheck]
+    fn dual_representation_mismatch(main: MainDocument, other: MainDocument) {
+        let dual = DualRepresentation::new(&main);
+        let other_dual = DualRepresentation::new(&other);
+
+        let mixed = DualRepresentation::from_parts(
+            dual.content_hash(),
+            dual.machine().to_vec(),
+            other_dual.text().to_string(),
+        );
+        if main != other {
+            mixed.verify::<MainDocument>().unwrap_err();
+        }
+
+        let wrong_hash = DualRepresentation::from_parts(
+            other_dual.content_hash(),
+            dual.machine().to_vec(),
+            dual.text().to_string(),
+        );
+        if main != other {
+            wrong_hash.verify::<MainDocument>().unwrap_err();
+        }
+    }
+}
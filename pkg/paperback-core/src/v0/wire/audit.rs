@@ -0,0 +1,95 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{
+    wire::{prefixes::*, FromWire, ToWire, WireError},
+    AuditResponse,
+};
+
+use unsigned_varint::{encode as varuint_encode, nom as varuint_nom};
+
+impl ToWire for AuditResponse {
+    fn to_wire(&self) -> Vec<u8> {
+        let mut buffer = varuint_encode::u32_buffer();
+        let mut bytes = vec![];
+
+        // Encode multihash checksum.
+        self.doc_chksum
+            .to_bytes()
+            .iter()
+            .for_each(|b| bytes.push(*b));
+
+        // Encode shard id (length-prefixed).
+        varuint_encode::usize(self.shard_id.len(), &mut varuint_encode::usize_buffer())
+            .iter()
+            .chain(self.shard_id.as_bytes())
+            .for_each(|b| bytes.push(*b));
+
+        // Encode ed25519 audit public key (with multicodec prefix).
+        varuint_encode::u32(PREFIX_ED25519_PUB, &mut buffer)
+            .iter()
+            .chain(self.audit_public_key.as_bytes())
+            .for_each(|b| bytes.push(*b));
+
+        // Encode ed25519 signatures (with multicodec prefix).
+        for signature in &[self.binding_signature, self.challenge_signature] {
+            varuint_encode::u32(PREFIX_ED25519_SIG, &mut buffer)
+                .iter()
+                .chain(&signature.to_bytes()[..])
+                .for_each(|b| bytes.push(*b));
+        }
+
+        bytes
+    }
+}
+
+impl FromWire for AuditResponse {
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use crate::v0::wire::helpers::{
+            multihash, parse_field, take_ed25519_pub, take_ed25519_sig,
+        };
+        use nom::multi::length_data;
+
+        const DOCUMENT: &str = "AuditResponse";
+
+        let (input, doc_chksum) = parse_field(DOCUMENT, "doc_chksum", multihash, input)?;
+        let (input, shard_id) =
+            parse_field(DOCUMENT, "shard_id", length_data(varuint_nom::usize), input)?;
+        let (input, audit_public_key) =
+            parse_field(DOCUMENT, "audit_public_key", take_ed25519_pub, input)?;
+        let (input, binding_signature) =
+            parse_field(DOCUMENT, "binding_signature", take_ed25519_sig, input)?;
+        let (remain, challenge_signature) =
+            parse_field(DOCUMENT, "challenge_signature", take_ed25519_sig, input)?;
+
+        Ok((
+            AuditResponse {
+                doc_chksum,
+                shard_id: String::from_utf8(shard_id.into())
+                    .map_err(|err| WireError::nom(DOCUMENT, err).field("shard_id"))?,
+                audit_public_key: audit_public_key
+                    .map_err(|err| WireError::nom(DOCUMENT, err).field("audit_public_key"))?,
+                binding_signature: binding_signature
+                    .map_err(|err| WireError::nom(DOCUMENT, err).field("binding_signature"))?,
+                challenge_signature: challenge_signature
+                    .map_err(|err| WireError::nom(DOCUMENT, err).field("challenge_signature"))?,
+            },
+            remain,
+        ))
+    }
+}
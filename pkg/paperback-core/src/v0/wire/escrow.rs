@@ -0,0 +1,169 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{
+    wire::{prefixes::*, FromWire, ToWire, WireError},
+    EscrowKey, EscrowRecipients,
+};
+
+use unsigned_varint::{encode as varuint_encode, nom as varuint_nom};
+
+impl ToWire for EscrowRecipients {
+    fn to_wire(&self) -> Vec<u8> {
+        let mut bytes = vec![];
+
+        // Encode prefix.
+        varuint_encode::u64(PREFIX_ESCROW_RECIPIENTS, &mut varuint_encode::u64_buffer())
+            .iter()
+            .for_each(|b| bytes.push(*b));
+
+        // Encode recipients (length-prefixed).
+        varuint_encode::usize(self.recipients.len(), &mut varuint_encode::usize_buffer())
+            .iter()
+            .for_each(|b| bytes.push(*b));
+        for recipient in &self.recipients {
+            varuint_encode::usize(recipient.len(), &mut varuint_encode::usize_buffer())
+                .iter()
+                .chain(recipient.as_bytes())
+                .for_each(|b| bytes.push(*b));
+        }
+
+        bytes
+    }
+}
+
+impl FromWire for EscrowRecipients {
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use crate::v0::wire::{
+            helpers::{parse_field, take_count},
+            limits::MAX_ESCROW_RECIPIENTS,
+        };
+        use nom::{
+            combinator::verify,
+            multi::{length_data, many_m_n},
+        };
+
+        const DOCUMENT: &str = "EscrowRecipients";
+
+        let (input, _) = parse_field(
+            DOCUMENT,
+            "prefix",
+            verify(varuint_nom::u64, |x| *x == PREFIX_ESCROW_RECIPIENTS),
+            input,
+        )?;
+        let (input, length) = parse_field(
+            DOCUMENT,
+            "recipients",
+            |input| take_count(input, MAX_ESCROW_RECIPIENTS),
+            input,
+        )?;
+        let (remain, recipients) = parse_field(
+            DOCUMENT,
+            "recipients",
+            many_m_n(length, length, length_data(varuint_nom::usize)),
+            input,
+        )?;
+
+        let recipients = recipients
+            .into_iter()
+            .map(|recipient| {
+                String::from_utf8(recipient.into())
+                    .map_err(|err| WireError::nom(DOCUMENT, err).field("recipients"))
+            })
+            .collect::<Result<Vec<_>, WireError>>()?;
+
+        Ok((EscrowRecipients { recipients }, remain))
+    }
+}
+
+// Internal only -- users can't see EscrowKey.
+#[doc(hidden)]
+impl ToWire for EscrowKey {
+    fn to_wire(&self) -> Vec<u8> {
+        let mut buffer = varuint_encode::u64_buffer();
+        let mut bytes = vec![];
+
+        // Encode multihash checksum of the main document.
+        self.doc_chksum
+            .to_bytes()
+            .iter()
+            .for_each(|b| bytes.push(*b));
+
+        // Encode ChaCha20-Poly1305 key.
+        varuint_encode::u64(PREFIX_CHACHA20POLY1305_KEY, &mut buffer)
+            .iter()
+            .chain(&self.doc_key)
+            .for_each(|b| bytes.push(*b));
+
+        bytes
+    }
+}
+
+// Internal only -- users can't see EscrowKey.
+#[doc(hidden)]
+impl FromWire for EscrowKey {
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use crate::v0::wire::helpers::{multihash, parse_field, take_chachapoly_key};
+
+        const DOCUMENT: &str = "EscrowKey";
+
+        let (input, doc_chksum) = parse_field(DOCUMENT, "doc_chksum", multihash, input)?;
+        let (remain, doc_key) = parse_field(DOCUMENT, "doc_key", take_chachapoly_key, input)?;
+
+        Ok((
+            EscrowKey {
+                doc_chksum,
+                doc_key,
+            },
+            remain,
+        ))
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[quickcheck]
+    fn escrow_recipients_roundtrip(recipients: EscrowRecipients) {
+        let recipients2 = EscrowRecipients::from_wire(recipients.to_wire()).unwrap();
+        assert_eq!(recipients, recipients2);
+    }
+
+    #[quickcheck]
+    fn escrow_key_roundtrip(key: EscrowKey) {
+        let key2 = EscrowKey::from_wire(key.to_wire()).unwrap();
+        assert_eq!(key, key2);
+    }
+
+    #[test]
+    fn escrow_recipients_hostile_length() {
+        let mut bytes = vec![];
+        varuint_encode::u64(PREFIX_ESCROW_RECIPIENTS, &mut varuint_encode::u64_buffer())
+            .iter()
+            .chain(varuint_encode::usize(
+                u32::MAX as usize,
+                &mut varuint_encode::usize_buffer(),
+            ))
+            .chain(&[0u8; 16])
+            .for_each(|b| bytes.push(*b));
+
+        let err = EscrowRecipients::from_wire(bytes).unwrap_err();
+        assert_eq!(err.path(), "recipients");
+    }
+}
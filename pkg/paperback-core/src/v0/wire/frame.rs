@@ -0,0 +1,243 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{
+    wire::{to_multibase_zbase32, DocumentKind, FromWire, ToWire, WireError},
+    AuditResponse, EncryptedKeyShard, KeyShard, MainDocument, Page,
+};
+
+use unsigned_varint::{encode as varuint_encode, nom as varuint_nom};
+
+/// Magic bytes at the start of every framed document. The leading non-ASCII
+/// byte stops framed documents from being mistaken for text.
+pub const FRAME_MAGIC: &[u8; 4] = b"\x8fPBK";
+
+/// Version of the frame header format.
+const FRAME_VERSION: u32 = 0;
+
+/// Encoding of the payload of a framed document.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub enum FrameEncoding {
+    /// The raw wire representation of the document.
+    Raw,
+    /// The multibase zbase32 representation of the document (as produced by
+    /// [`ToWire::to_wire_zbase32`]).
+    Zbase32,
+}
+
+impl FrameEncoding {
+    fn id(self) -> u32 {
+        match self {
+            Self::Raw => 0,
+            Self::Zbase32 => 1,
+        }
+    }
+
+    fn from_id(id: u32) -> Option<Self> {
+        match id {
+            0 => Some(Self::Raw),
+            1 => Some(Self::Zbase32),
+            _ => None,
+        }
+    }
+}
+
+impl DocumentKind {
+    fn id(self) -> u32 {
+        match self {
+            Self::MainDocument => 1,
+            Self::EncryptedKeyShard => 2,
+            Self::KeyShard => 3,
+            Self::AuditResponse => 4,
+            Self::Page => 5,
+        }
+    }
+
+    fn from_id(id: u32) -> Option<Self> {
+        Self::all().iter().copied().find(|kind| kind.id() == id)
+    }
+}
+
+/// Header of a framed document, identifying what kind of document it contains
+/// and how the document was encoded.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub struct FrameHeader {
+    kind: DocumentKind,
+    encoding: FrameEncoding,
+}
+
+impl FrameHeader {
+    /// Returns the kind of document contained in the frame.
+    pub fn kind(&self) -> DocumentKind {
+        self.kind
+    }
+
+    /// Returns the encoding of the document contained in the frame.
+    pub fn encoding(&self) -> FrameEncoding {
+        self.encoding
+    }
+
+    /// Parse the header of a framed document, returning the header and the
+    /// (still encoded) payload. This allows callers to figure out how to
+    /// handle a blob without needing to guess.
+    pub fn parse(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use crate::v0::wire::helpers::parse_field;
+        use nom::bytes::complete::tag;
+
+        const DOCUMENT: &str = "Frame";
+
+        let (input, _) = parse_field(DOCUMENT, "magic", tag(&FRAME_MAGIC[..]), input)?;
+        let (input, version) = parse_field(DOCUMENT, "version", varuint_nom::u32, input)?;
+        if version != FRAME_VERSION {
+            return Err(WireError::new(
+                DOCUMENT,
+                format!("unsupported frame version '{}'", version),
+            )
+            .field("version"));
+        }
+        let (input, kind) = parse_field(DOCUMENT, "kind", varuint_nom::u32, input)?;
+        let kind = DocumentKind::from_id(kind).ok_or_else(|| {
+            WireError::new(DOCUMENT, format!("unknown document kind '{}'", kind)).field("kind")
+        })?;
+        let (payload, encoding) = parse_field(DOCUMENT, "encoding", varuint_nom::u32, input)?;
+        let encoding = FrameEncoding::from_id(encoding).ok_or_else(|| {
+            WireError::new(DOCUMENT, format!("unknown encoding '{}'", encoding)).field("encoding")
+        })?;
+
+        Ok((FrameHeader { kind, encoding }, payload))
+    }
+
+    fn to_wire(self) -> Vec<u8> {
+        let mut buffer = varuint_encode::u32_buffer();
+        let mut bytes = FRAME_MAGIC.to_vec();
+
+        for value in &[FRAME_VERSION, self.kind.id(), self.encoding.id()] {
+            varuint_encode::u32(*value, &mut buffer)
+                .iter()
+                .for_each(|b| bytes.push(*b));
+        }
+
+        bytes
+    }
+}
+
+/// Documents which can be wrapped in a self-identifying frame.
+///
+/// Framed documents start with [`FRAME_MAGIC`] followed by a [`FrameHeader`],
+/// so that files on disk (or scanned blobs) can be recognised without needing
+/// to guess what they contain.
+pub trait Framed: ToWire + FromWire {
+    /// Kind of document stored in the frame.
+    const KIND: DocumentKind;
+
+    /// Encode the document inside a frame, using `encoding` for the payload.
+    fn to_framed(&self, encoding: FrameEncoding) -> Vec<u8> {
+        let mut bytes = FrameHeader {
+            kind: Self::KIND,
+            encoding,
+        }
+        .to_wire();
+        match encoding {
+            FrameEncoding::Raw => bytes.append(&mut self.to_wire()),
+            FrameEncoding::Zbase32 => bytes.extend(to_multibase_zbase32(self.to_wire()).bytes()),
+        }
+        bytes
+    }
+
+    /// Decode a framed document, checking that the frame contains this kind of
+    /// document.
+    fn from_framed<B: AsRef<[u8]>>(input: B) -> Result<Self, WireError> {
+        let (header, payload) = FrameHeader::parse(input.as_ref())?;
+        if header.kind != Self::KIND {
+            return Err(WireError::new(
+                "Frame",
+                format!(
+                    "frame contains {} not {}",
+                    header.kind.name(),
+                    Self::KIND.name()
+                ),
+            )
+            .field("kind"));
+        }
+        match header.encoding {
+            FrameEncoding::Raw => Self::from_wire(payload),
+            FrameEncoding::Zbase32 => {
+                let payload = std::str::from_utf8(payload)
+                    .map_err(|err| WireError::nom("Frame", err).field("payload"))?;
+                Self::from_wire_zbase32(payload)
+            }
+        }
+    }
+}
+
+impl Framed for MainDocument {
+    const KIND: DocumentKind = DocumentKind::MainDocument;
+}
+
+impl Framed for EncryptedKeyShard {
+    const KIND: DocumentKind = DocumentKind::EncryptedKeyShard;
+}
+
+impl Framed for KeyShard {
+    const KIND: DocumentKind = DocumentKind::KeyShard;
+}
+
+impl Framed for AuditResponse {
+    const KIND: DocumentKind = DocumentKind::AuditResponse;
+}
+
+impl Framed for Page {
+    const KIND: DocumentKind = DocumentKind::Page;
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[quickcheck]
+    fn encrypted_key_shard_framed_roundtrip(shard: EncryptedKeyShard) {
+        for encoding in &[FrameEncoding::Raw, FrameEncoding::Zbase32] {
+            let framed = shard.to_framed(*encoding);
+            assert!(framed.starts_with(FRAME_MAGIC));
+
+            let (header, _) = FrameHeader::parse(&framed).unwrap();
+            assert_eq!(header.kind(), DocumentKind::EncryptedKeyShard);
+            assert_eq!(header.encoding(), *encoding);
+
+            let shard2 = EncryptedKeyShard::from_framed(&framed).unwrap();
+            assert_eq!(shard, shard2);
+        }
+    }
+
+    #[quickcheck]
+    fn main_document_framed_roundtrip(main: MainDocument) {
+        let framed = main.to_framed(FrameEncoding::Raw);
+        let main2 = MainDocument::from_framed(&framed).unwrap();
+        assert_eq!(main, main2);
+
+        // The wrong document kind must be rejected.
+        let err = EncryptedKeyShard::from_framed(&framed).unwrap_err();
+        assert_eq!(err.path(), "kind");
+    }
+
+    #[test]
+    fn frame_bad_magic() {
+        let err = FrameHeader::parse(b"PBK\x00\x00\x01\x00").unwrap_err();
+        assert_eq!(err.path(), "magic");
+    }
+}
@@ -17,8 +17,9 @@
  */
 
 use crate::v0::{
-    wire::prefixes::*, ChaChaPolyKey, ChaChaPolyNonce, CHACHAPOLY_KEY_LENGTH,
-    CHACHAPOLY_NONCE_LENGTH,
+    wire::{prefixes::*, FromWire, WireError},
+    ChaChaPolyKey, ChaChaPolyNonce, CodewordLanguage, Compression, KeyCheck, CHACHAPOLY_KEY_LENGTH,
+    CHACHAPOLY_NONCE_LENGTH, KEY_CHECK_LENGTH,
 };
 
 use ed25519_dalek::{PublicKey, SecretKey, Signature, SignatureError};
@@ -26,14 +27,81 @@ use multihash::Multihash;
 use nom::{
     branch::alt,
     bytes::streaming::{tag, take},
-    combinator::{map, verify},
+    combinator::{complete, map, verify},
     error::{Error as NomError, ErrorKind},
     sequence::tuple,
-    Err as NomErr, IResult, Needed,
+    Err as NomErr, IResult,
 };
 use signature::Signature as SignatureTrait;
 use unsigned_varint::nom as varuint_nom;
 
+/// Run `parser` over `input` to decode the `field` of a `document`, converting
+/// any parsing errors into a [`WireError`] describing the failing field.
+pub(super) fn parse_field<'a, O, P>(
+    document: &'static str,
+    field: &'static str,
+    parser: P,
+    input: &'a [u8],
+) -> Result<(&'a [u8], O), WireError>
+where
+    P: FnMut(&'a [u8]) -> IResult<&'a [u8], O>,
+{
+    complete(parser)(input).map_err(|err| WireError::nom(document, err).field(field))
+}
+
+/// Parse an optional sub-structure stored as the `field` of a `document`,
+/// which starts with the varuint `prefix`. The field is only treated as absent
+/// if `input` does not start with `prefix` -- once the prefix matches, any
+/// error in the rest of the field is returned (rather than leaving the field
+/// to be reported as trailing bytes).
+pub(super) fn parse_optional<'a, T: FromWire>(
+    document: &'static str,
+    field: &'static str,
+    prefix: u64,
+    input: &'a [u8],
+) -> Result<(Option<T>, &'a [u8]), WireError> {
+    let field_prefix: IResult<&[u8], u64> = varuint_nom::u64(input);
+    match field_prefix {
+        Ok((_, value)) if value == prefix => T::from_wire_partial(input)
+            .map(|(value, remain)| (Some(value), remain))
+            .map_err(|err| err.within(document, field)),
+        _ => Ok((None, input)),
+    }
+}
+
+/// Like [`parse_field`], but for an optional `field` of a `document` which
+/// starts with the varuint `prefix`. As with [`parse_optional`], the field is
+/// only treated as absent if `input` does not start with `prefix`.
+pub(super) fn parse_optional_field<'a, O, P>(
+    document: &'static str,
+    field: &'static str,
+    prefix: u64,
+    parser: P,
+    input: &'a [u8],
+) -> Result<(&'a [u8], Option<O>), WireError>
+where
+    P: FnMut(&'a [u8]) -> IResult<&'a [u8], O>,
+{
+    let field_prefix: IResult<&[u8], u64> = varuint_nom::u64(input);
+    match field_prefix {
+        Ok((_, value)) if value == prefix => {
+            parse_field(document, field, parser, input).map(|(remain, value)| (remain, Some(value)))
+        }
+        _ => Ok((input, None)),
+    }
+}
+
+/// Parse a varuint count of elements, rejecting counts larger than `max` or
+/// larger than the number of remaining bytes (every element takes up at least
+/// one byte). This stops hostile documents from causing huge allocations.
+pub(super) fn take_count(input: &[u8], max: usize) -> IResult<&[u8], usize> {
+    let (remain, count) = varuint_nom::usize(input)?;
+    if count > max || count > remain.len() {
+        return Err(NomErr::Error(NomError::new(input, ErrorKind::TooLarge)));
+    }
+    Ok((remain, count))
+}
+
 pub(super) fn multihash(input: &[u8]) -> IResult<&[u8], Multihash> {
     use nom::sequence::pair;
 
@@ -42,12 +110,13 @@ pub(super) fn multihash(input: &[u8]) -> IResult<&[u8], Multihash> {
     let (partial, (_, length)) = pair(varuint_nom::u64, varuint_nom::usize)(input)?;
 
     // The length doesn't include the (type, length) prefix, so calculate that
-    // based on the partially-parsed input. We return an Incomplete if there
-    // isn't enough bytes for the hash (split_at would panic otherwise).
-    let length = length + (input.len() - partial.len());
-    if length > input.len() {
-        return Err(NomErr::Incomplete(Needed::new(length - input.len())));
-    }
+    // based on the partially-parsed input. Lengths longer than the remaining
+    // input are rejected (like in take_count), which also stops a hostile
+    // length from overflowing (split_at would panic otherwise).
+    let length = Some(length)
+        .filter(|length| *length <= partial.len())
+        .and_then(|length| length.checked_add(input.len() - partial.len()))
+        .ok_or_else(|| NomErr::Error(NomError::new(input, ErrorKind::TooLarge)))?;
     let (hash, input) = input.split_at(length);
 
     // All errors are just treated as format ("tag") errors. Sadly we can't
@@ -115,6 +184,97 @@ pub(super) fn take_chachapoly_nonce(input: &[u8]) -> IResult<&[u8], ChaChaPolyNo
     }))
 }
 
+pub(super) fn take_key_check(input: &[u8]) -> IResult<&[u8], KeyCheck> {
+    let (input, _) = verify(varuint_nom::u64, |x| *x == PREFIX_KEY_CHECK)(input)?;
+    let (input, key_check) = take(KEY_CHECK_LENGTH)(input)?;
+
+    Ok((input, {
+        let mut buffer = KeyCheck::default();
+        buffer.copy_from_slice(key_check);
+        buffer
+    }))
+}
+
+pub(super) fn take_ed25519_audit_sec(
+    input: &[u8],
+) -> IResult<&[u8], [u8; ed25519_dalek::SECRET_KEY_LENGTH]> {
+    let (input, _) = verify(varuint_nom::u64, |x| *x == PREFIX_ED25519_AUDIT_SECRET)(input)?;
+    let (input, seed) = take(ed25519_dalek::SECRET_KEY_LENGTH)(input)?;
+
+    Ok((input, {
+        let mut buffer = [0u8; ed25519_dalek::SECRET_KEY_LENGTH];
+        buffer.copy_from_slice(seed);
+        buffer
+    }))
+}
+
+pub(super) fn take_shard_merkle_root(input: &[u8]) -> IResult<&[u8], Multihash> {
+    let (input, _) = verify(varuint_nom::u64, |x| *x == PREFIX_SHARD_MERKLE_ROOT)(input)?;
+
+    multihash(input)
+}
+
+fn take_prefixed_bytes(input: &[u8], prefix: u64) -> IResult<&[u8], &[u8]> {
+    let (input, _) = verify(varuint_nom::u64, |x| *x == prefix)(input)?;
+    let (input, length) = varuint_nom::usize(input)?;
+
+    take(length)(input)
+}
+
+pub(super) fn take_timestamp_token(input: &[u8]) -> IResult<&[u8], &[u8]> {
+    take_prefixed_bytes(input, PREFIX_TIMESTAMP_TOKEN)
+}
+
+pub(super) fn take_shard_label(input: &[u8]) -> IResult<&[u8], &[u8]> {
+    take_prefixed_bytes(input, PREFIX_SHARD_LABEL)
+}
+
+pub(super) fn take_shard_holder(input: &[u8]) -> IResult<&[u8], &[u8]> {
+    take_prefixed_bytes(input, PREFIX_SHARD_HOLDER)
+}
+
+pub(super) fn take_shard_contact(input: &[u8]) -> IResult<&[u8], &[u8]> {
+    take_prefixed_bytes(input, PREFIX_SHARD_CONTACT)
+}
+
+pub(super) fn take_shard_note(input: &[u8]) -> IResult<&[u8], &[u8]> {
+    take_prefixed_bytes(input, PREFIX_SHARD_NOTE)
+}
+
+pub(super) fn take_compression(input: &[u8]) -> IResult<&[u8], Compression> {
+    let (input, _) = verify(varuint_nom::u64, |x| *x == PREFIX_COMPRESSION)(input)?;
+    let (remain, id) = varuint_nom::u32(input)?;
+
+    // Unknown algorithms are format errors.
+    let compression = Compression::from_id(id)
+        .ok_or_else(|| NomErr::Error(NomError::new(input, ErrorKind::Tag)))?;
+    Ok((remain, compression))
+}
+
+pub(super) fn take_codeword_language(input: &[u8]) -> IResult<&[u8], CodewordLanguage> {
+    let (input, _) = verify(varuint_nom::u64, |x| *x == PREFIX_CODEWORD_LANGUAGE)(input)?;
+    let (remain, id) = varuint_nom::u32(input)?;
+
+    // Unknown languages are format errors.
+    let language = CodewordLanguage::from_id(id)
+        .ok_or_else(|| NomErr::Error(NomError::new(input, ErrorKind::Tag)))?;
+    Ok((remain, language))
+}
+
+fn take_prefixed_varuint(input: &[u8], prefix: u64) -> IResult<&[u8], u64> {
+    let (input, _) = verify(varuint_nom::u64, |x| *x == prefix)(input)?;
+
+    varuint_nom::u64(input)
+}
+
+pub(super) fn take_date_created(input: &[u8]) -> IResult<&[u8], u64> {
+    take_prefixed_varuint(input, PREFIX_DATE_CREATED)
+}
+
+pub(super) fn take_date_review_by(input: &[u8]) -> IResult<&[u8], u64> {
+    take_prefixed_varuint(input, PREFIX_DATE_REVIEW_BY)
+}
+
 pub(super) fn take_chachapoly_ciphertext(input: &[u8]) -> IResult<&[u8], &[u8]> {
     let (input, _) = verify(varuint_nom::u64, |x| {
         *x == PREFIX_CHACHA20POLY1305_CIPHERTEXT
@@ -123,3 +283,40 @@ pub(super) fn take_chachapoly_ciphertext(input: &[u8]) -> IResult<&[u8], &[u8]>
 
     take(length)(input)
 }
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use unsigned_varint::encode as varuint_encode;
+
+    fn multihash_header(code: u64, length: usize) -> Vec<u8> {
+        let mut bytes = varuint_encode::u64(code, &mut varuint_encode::u64_buffer()).to_vec();
+        bytes.extend_from_slice(varuint_encode::usize(
+            length,
+            &mut varuint_encode::usize_buffer(),
+        ));
+        bytes
+    }
+
+    #[test]
+    fn multihash_hostile_length() {
+        // Blake2b-256.
+        const CODE: u64 = 0xb220;
+
+        for length in &[usize::MAX, usize::MAX - 1, 33] {
+            let mut input = multihash_header(CODE, *length);
+            input.extend_from_slice(&[0u8; 32]);
+            match multihash(&input) {
+                Err(NomErr::Error(err)) => assert_eq!(err.code, ErrorKind::TooLarge),
+                result => panic!("unexpected result {:?}", result),
+            }
+        }
+
+        let mut input = multihash_header(CODE, 32);
+        input.extend_from_slice(&[0u8; 32]);
+        let (remain, hash) = multihash(&input).unwrap();
+        assert!(remain.is_empty());
+        assert_eq!(hash.digest(), &[0u8; 32][..]);
+    }
+}
@@ -17,11 +17,10 @@
  */
 
 use crate::v0::{
-    wire::{prefixes::*, FromWire, ToWire},
-    ChaChaPolyKey, Identity, ShardSecret,
+    wire::{prefixes::*, FromWire, ToWire, WireError},
+    ChaChaPolyKey, DocumentDates, Identity, ShardAudit, ShardCommitment, ShardSecret,
 };
 
-use ed25519_dalek::{PublicKey, SecretKey, Signature, SignatureError};
 use unsigned_varint::encode as varuint_encode;
 
 // TODO: Completely rewrite this code. This is a very quick-and-dirty
@@ -52,37 +51,208 @@ impl ToWire for Identity {
     }
 }
 
-type IdentityParseResult = (
-    Result<PublicKey, SignatureError>,
-    Result<Signature, SignatureError>,
-);
+impl Identity {
+    /// Length of the wire representation of an identity, which does not
+    /// depend on the keypair (so it is known before one is generated).
+    pub(crate) fn wire_length() -> usize {
+        use ed25519_dalek::{PUBLIC_KEY_LENGTH, SIGNATURE_LENGTH};
+
+        let mut buffer = varuint_encode::u32_buffer();
+        varuint_encode::u32(PREFIX_ED25519_PUB, &mut buffer).len()
+            + PUBLIC_KEY_LENGTH
+            + varuint_encode::u32(PREFIX_ED25519_SIG, &mut buffer).len()
+            + SIGNATURE_LENGTH
+    }
+}
 
 // Internal only -- users can't see Identity.
 impl FromWire for Identity {
-    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), String> {
-        use crate::v0::wire::helpers::{take_ed25519_pub, take_ed25519_sig};
-        use nom::{combinator::complete, IResult};
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use crate::v0::wire::helpers::{parse_field, take_ed25519_pub, take_ed25519_sig};
 
-        fn parse(input: &[u8]) -> IResult<&[u8], IdentityParseResult> {
-            let (input, public_key) = take_ed25519_pub(input)?;
-            let (input, signature) = take_ed25519_sig(input)?;
+        let (input, public_key) =
+            parse_field("Identity", "id_public_key", take_ed25519_pub, input)?;
+        let (remain, signature) = parse_field("Identity", "id_signature", take_ed25519_sig, input)?;
 
-            Ok((input, (public_key, signature)))
+        Ok((
+            Identity {
+                id_public_key: public_key
+                    .map_err(|err| WireError::nom("Identity", err).field("id_public_key"))?,
+                id_signature: signature
+                    .map_err(|err| WireError::nom("Identity", err).field("id_signature"))?,
+            },
+            remain,
+        ))
+    }
+}
+
+// Internal only -- users can't see DocumentDates.
+impl ToWire for DocumentDates {
+    fn to_wire(&self) -> Vec<u8> {
+        let mut buffer = varuint_encode::u64_buffer();
+        let mut bytes = vec![];
+
+        // Both dates are optional, so we only include them if they are set.
+        for (prefix, date) in &[
+            (PREFIX_DATE_CREATED, self.created_at),
+            (PREFIX_DATE_REVIEW_BY, self.review_by),
+        ] {
+            if let Some(date) = date {
+                varuint_encode::u64(*prefix, &mut buffer)
+                    .iter()
+                    .for_each(|b| bytes.push(*b));
+                varuint_encode::u64(*date, &mut buffer)
+                    .iter()
+                    .for_each(|b| bytes.push(*b));
+            }
         }
-        let mut parse = complete(parse);
 
-        let (remain, (public_key, signature)) = parse(input).map_err(|err| format!("{:?}", err))?;
+        bytes
+    }
+}
+
+// Internal only -- users can't see DocumentDates.
+impl FromWire for DocumentDates {
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use crate::v0::wire::helpers::{
+            parse_optional_field, take_date_created, take_date_review_by,
+        };
+
+        let (input, created_at) = parse_optional_field(
+            "DocumentDates",
+            "created_at",
+            PREFIX_DATE_CREATED,
+            take_date_created,
+            input,
+        )?;
+        let (remain, review_by) = parse_optional_field(
+            "DocumentDates",
+            "review_by",
+            PREFIX_DATE_REVIEW_BY,
+            take_date_review_by,
+            input,
+        )?;
 
         Ok((
-            Identity {
-                id_public_key: public_key.map_err(|err| format!("{:?}", err))?,
-                id_signature: signature.map_err(|err| format!("{:?}", err))?,
+            DocumentDates {
+                created_at,
+                review_by,
+            },
+            remain,
+        ))
+    }
+}
+
+// Internal only -- users can't see ShardAudit.
+impl ToWire for ShardAudit {
+    fn to_wire(&self) -> Vec<u8> {
+        let mut bytes = vec![];
+
+        // Encode ed25519 audit private key.
+        // NOTE: Not actually upstream.
+        varuint_encode::u64(
+            PREFIX_ED25519_AUDIT_SECRET,
+            &mut varuint_encode::u64_buffer(),
+        )
+        .iter()
+        .chain(&self.audit_seed[..])
+        .for_each(|b| bytes.push(*b));
+
+        // Encode ed25519 binding signature (with multicodec prefix).
+        varuint_encode::u32(PREFIX_ED25519_SIG, &mut varuint_encode::u32_buffer())
+            .iter()
+            .chain(&self.binding_signature.to_bytes()[..])
+            .for_each(|b| bytes.push(*b));
+
+        bytes
+    }
+}
+
+// Internal only -- users can't see ShardAudit.
+impl FromWire for ShardAudit {
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use crate::v0::wire::helpers::{parse_field, take_ed25519_audit_sec, take_ed25519_sig};
+
+        let (input, audit_seed) =
+            parse_field("ShardAudit", "audit_seed", take_ed25519_audit_sec, input)?;
+        let (remain, binding_signature) =
+            parse_field("ShardAudit", "binding_signature", take_ed25519_sig, input)?;
+
+        Ok((
+            ShardAudit {
+                audit_seed,
+                binding_signature: binding_signature
+                    .map_err(|err| WireError::nom("ShardAudit", err).field("binding_signature"))?,
             },
             remain,
         ))
     }
 }
 
+// Internal only -- users can't see ShardCommitment.
+impl ToWire for ShardCommitment {
+    fn to_wire(&self) -> Vec<u8> {
+        let mut buffer = varuint_encode::u64_buffer();
+        let mut bytes = vec![];
+
+        // Encode prefix.
+        varuint_encode::u64(PREFIX_SHARD_MERKLE_PROOF, &mut buffer)
+            .iter()
+            .for_each(|b| bytes.push(*b));
+
+        // Encode leaf index and number of leaves.
+        for value in &[self.index, self.count] {
+            varuint_encode::u32(*value, &mut varuint_encode::u32_buffer())
+                .iter()
+                .for_each(|b| bytes.push(*b));
+        }
+
+        // Encode the Merkle path (length-prefixed).
+        varuint_encode::usize(self.path.len(), &mut varuint_encode::usize_buffer())
+            .iter()
+            .copied()
+            .chain(self.path.iter().flat_map(|hash| hash.to_bytes()))
+            .for_each(|b| bytes.push(b));
+
+        bytes
+    }
+}
+
+// Internal only -- users can't see ShardCommitment.
+impl FromWire for ShardCommitment {
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use crate::v0::wire::{
+            helpers::{multihash, parse_field, take_count},
+            limits::MAX_MERKLE_PATH_LENGTH,
+        };
+        use nom::{combinator::verify, multi::many_m_n};
+        use unsigned_varint::nom as varuint_nom;
+
+        let (input, _) = parse_field(
+            "ShardCommitment",
+            "prefix",
+            verify(varuint_nom::u64, |x| *x == PREFIX_SHARD_MERKLE_PROOF),
+            input,
+        )?;
+        let (input, index) = parse_field("ShardCommitment", "index", varuint_nom::u32, input)?;
+        let (input, count) = parse_field("ShardCommitment", "count", varuint_nom::u32, input)?;
+        let (input, path_length) = parse_field(
+            "ShardCommitment",
+            "path",
+            |input| take_count(input, MAX_MERKLE_PATH_LENGTH),
+            input,
+        )?;
+        let (remain, path) = parse_field(
+            "ShardCommitment",
+            "path",
+            many_m_n(path_length, path_length, multihash),
+            input,
+        )?;
+
+        Ok((ShardCommitment { index, count, path }, remain))
+    }
+}
+
 // Internal only -- users can't see ShardSecret.
 impl ToWire for ShardSecret {
     fn to_wire(&self) -> Vec<u8> {
@@ -114,29 +284,18 @@ impl ToWire for ShardSecret {
     }
 }
 
-type ShardSecretParseResult = (ChaChaPolyKey, Option<Result<SecretKey, SignatureError>>);
-
 // Internal only -- users can't see ShardSecret.
 impl FromWire for ShardSecret {
-    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), String> {
-        use crate::v0::wire::helpers::{take_chachapoly_key, take_ed25519_sec};
-        use nom::{combinator::complete, IResult};
-
-        fn parse(input: &[u8]) -> IResult<&[u8], ShardSecretParseResult> {
-            let (input, doc_key) = take_chachapoly_key(input)?;
-            let (input, private_key) = take_ed25519_sec(input)?;
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use crate::v0::wire::helpers::{parse_field, take_chachapoly_key, take_ed25519_sec};
 
-            Ok((input, (doc_key, private_key)))
-        }
-        let mut parse = complete(parse);
+        let (input, doc_key) = parse_field("ShardSecret", "doc_key", take_chachapoly_key, input)?;
+        let (remain, private_key) =
+            parse_field("ShardSecret", "id_private_key", take_ed25519_sec, input)?;
 
-        let (remain, (doc_key, private_key)) = parse(input).map_err(|err| format!("{:?}", err))?;
-
-        let id_private_key = match private_key {
-            Some(Ok(key)) => Some(key),
-            None => None,
-            Some(Err(err)) => return Err(format!("{:?}", err)),
-        };
+        let id_private_key = private_key
+            .transpose()
+            .map_err(|err| WireError::nom("ShardSecret", err).field("id_private_key"))?;
 
         Ok((
             ShardSecret {
@@ -181,6 +340,25 @@ mod test {
         let identity2 = Identity::from_wire(identity.to_wire()).unwrap();
 
         assert_eq!(identity, identity2);
+        assert_eq!(identity.to_wire().len(), Identity::wire_length());
+    }
+
+    #[quickcheck]
+    fn document_dates_roundtrip(dates: DocumentDates) {
+        let dates2 = DocumentDates::from_wire(dates.to_wire()).unwrap();
+        assert_eq!(dates, dates2);
+    }
+
+    #[quickcheck]
+    fn shard_audit_roundtrip(audit: ShardAudit) {
+        let audit2 = ShardAudit::from_wire(audit.to_wire()).unwrap();
+        assert_eq!(audit, audit2);
+    }
+
+    #[quickcheck]
+    fn shard_commitment_roundtrip(commitment: ShardCommitment) {
+        let commitment2 = ShardCommitment::from_wire(commitment.to_wire()).unwrap();
+        assert_eq!(commitment, commitment2);
     }
 
     #[quickcheck]
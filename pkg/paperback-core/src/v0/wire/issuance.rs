@@ -0,0 +1,75 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{
+    wire::{prefixes::*, FromWire, ToWire, WireError},
+    ShardIssuance,
+};
+
+use unsigned_varint::{encode as varuint_encode, nom as varuint_nom};
+
+impl ToWire for ShardIssuance {
+    fn to_wire(&self) -> Vec<u8> {
+        let mut bytes = vec![];
+
+        // Encode prefix.
+        varuint_encode::u64(PREFIX_SHARD_ISSUANCE, &mut varuint_encode::u64_buffer())
+            .iter()
+            .for_each(|b| bytes.push(*b));
+
+        // Encode generation and serial.
+        for value in &[self.generation, self.serial] {
+            varuint_encode::u32(*value, &mut varuint_encode::u32_buffer())
+                .iter()
+                .for_each(|b| bytes.push(*b));
+        }
+
+        bytes
+    }
+}
+
+impl FromWire for ShardIssuance {
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use crate::v0::wire::helpers::parse_field;
+        use nom::combinator::verify;
+
+        const DOCUMENT: &str = "ShardIssuance";
+
+        let (input, _) = parse_field(
+            DOCUMENT,
+            "prefix",
+            verify(varuint_nom::u64, |x| *x == PREFIX_SHARD_ISSUANCE),
+            input,
+        )?;
+        let (input, generation) = parse_field(DOCUMENT, "generation", varuint_nom::u32, input)?;
+        let (remain, serial) = parse_field(DOCUMENT, "serial", varuint_nom::u32, input)?;
+
+        Ok((ShardIssuance { generation, serial }, remain))
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[quickcheck]
+    fn shard_issuance_roundtrip(issuance: ShardIssuance) {
+        let issuance2 = ShardIssuance::from_wire(issuance.to_wire()).unwrap();
+        assert_eq!(issuance, issuance2);
+    }
+}
@@ -19,13 +19,14 @@
 use crate::{
     shamir::Shard,
     v0::{
-        wire::{prefixes::*, FromWire, ToWire},
-        ChaChaPolyNonce, EncryptedKeyShard, Identity, KeyShard, KeyShardBuilder,
+        wire::{prefixes::*, FromWire, ToWire, WireError},
+        CodewordLanguage, DocumentDates, EncryptedKeyShard, Identity, KeyShard, KeyShardBuilder,
+        ShardAudit, ShardCommitment, ShardIssuance, ShardRevocation, ShardRoster,
         CHACHAPOLY_NONCE_LENGTH, CHECKSUM_ALGORITHM,
     },
+    version,
 };
 
-use multihash::Multihash;
 use unsigned_varint::{encode as varuint_encode, nom as varuint_nom};
 
 // Internal only -- users can't see KeyShardBuilder.
@@ -49,36 +50,223 @@ impl ToWire for KeyShardBuilder {
         // Encode shard data.
         bytes.append(&mut self.shard.to_wire());
 
+        // Encode optional dates.
+        bytes.append(&mut self.dates.to_wire());
+
+        // Encode optional audit key.
+        if let Some(ref audit) = self.audit {
+            bytes.append(&mut audit.to_wire());
+        }
+
+        // Encode optional shard commitment proof.
+        if let Some(ref commitment) = self.commitment {
+            bytes.append(&mut commitment.to_wire());
+        }
+
+        // Encode optional timestamp token (length-prefixed).
+        if let Some(ref token) = self.timestamp_token {
+            varuint_encode::u64(PREFIX_TIMESTAMP_TOKEN, &mut varuint_encode::u64_buffer())
+                .iter()
+                .chain(varuint_encode::usize(
+                    token.len(),
+                    &mut varuint_encode::usize_buffer(),
+                ))
+                .chain(token)
+                .for_each(|b| bytes.push(*b));
+        }
+
+        // Encode optional shard roster.
+        if let Some(ref roster) = self.roster {
+            bytes.append(&mut roster.to_wire());
+        }
+
+        // Encode optional label and holder hint (length-prefixed).
+        encode_strings(
+            &[
+                (PREFIX_SHARD_LABEL, &self.label),
+                (PREFIX_SHARD_HOLDER, &self.holder),
+            ],
+            &mut bytes,
+        );
+
+        // Encode optional issuance record.
+        if let Some(ref issuance) = self.issuance {
+            bytes.append(&mut issuance.to_wire());
+        }
+
+        // Encode optional revocation record.
+        if let Some(ref revocation) = self.revocation {
+            bytes.append(&mut revocation.to_wire());
+        }
+
+        // Encode optional holder contact details and note (length-prefixed).
+        // These come after the other fields, as they were added later.
+        encode_strings(
+            &[
+                (PREFIX_SHARD_CONTACT, &self.contact),
+                (PREFIX_SHARD_NOTE, &self.note),
+            ],
+            &mut bytes,
+        );
+
+        // Encode optional codeword language.
+        encode_language(self.language, &mut bytes);
+
         bytes
     }
 }
 
+/// Append the codeword `language`, if it is set.
+fn encode_language(language: Option<CodewordLanguage>, bytes: &mut Vec<u8>) {
+    if let Some(language) = language {
+        varuint_encode::u64(PREFIX_CODEWORD_LANGUAGE, &mut varuint_encode::u64_buffer())
+            .iter()
+            .chain(varuint_encode::u32(
+                language.id(),
+                &mut varuint_encode::u32_buffer(),
+            ))
+            .for_each(|b| bytes.push(*b));
+    }
+}
+
+/// Append each of the `fields` which are set, as length-prefixed strings.
+fn encode_strings(fields: &[(u64, &Option<String>)], bytes: &mut Vec<u8>) {
+    for (prefix, value) in fields {
+        if let Some(value) = value {
+            varuint_encode::u64(*prefix, &mut varuint_encode::u64_buffer())
+                .iter()
+                .chain(varuint_encode::usize(
+                    value.len(),
+                    &mut varuint_encode::usize_buffer(),
+                ))
+                .chain(value.as_bytes())
+                .for_each(|b| bytes.push(*b));
+        }
+    }
+}
+
 // Internal only -- users can't see KeyShardBuilder.
 #[doc(hidden)]
 impl FromWire for KeyShardBuilder {
-    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), String> {
-        use crate::v0::wire::helpers::multihash;
-        use nom::{combinator::complete, IResult};
-
-        fn parse(input: &[u8]) -> IResult<&[u8], (u32, Multihash)> {
-            let (input, version) = varuint_nom::u32(input)?;
-            let (input, doc_chksum) = multihash(input)?;
-
-            Ok((input, (version, doc_chksum.to_owned())))
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use crate::v0::wire::helpers::{
+            multihash, parse_field, parse_optional, parse_optional_field, take_codeword_language,
+            take_shard_contact, take_shard_holder, take_shard_label, take_shard_note,
+            take_timestamp_token,
+        };
+
+        const DOCUMENT: &str = "KeyShardBuilder";
+
+        fn parse_fields(version: u32, input: &[u8]) -> Result<(KeyShardBuilder, &[u8]), WireError> {
+            let (input, doc_chksum) = parse_field(DOCUMENT, "doc_chksum", multihash, input)?;
+            let (shard, input) =
+                Shard::from_wire_partial(input).map_err(|err| err.within(DOCUMENT, "shard"))?;
+            let (dates, input) = DocumentDates::from_wire_partial(input)
+                .map_err(|err| err.within(DOCUMENT, "dates"))?;
+            let (audit, input) = parse_optional::<ShardAudit>(
+                DOCUMENT,
+                "audit",
+                PREFIX_ED25519_AUDIT_SECRET,
+                input,
+            )?;
+            let (commitment, input) = parse_optional::<ShardCommitment>(
+                DOCUMENT,
+                "commitment",
+                PREFIX_SHARD_MERKLE_PROOF,
+                input,
+            )?;
+            let (input, timestamp_token) = parse_optional_field(
+                DOCUMENT,
+                "timestamp_token",
+                PREFIX_TIMESTAMP_TOKEN,
+                take_timestamp_token,
+                input,
+            )?;
+            let (roster, input) =
+                parse_optional::<ShardRoster>(DOCUMENT, "roster", PREFIX_SHARD_ROSTER, input)?;
+            let (input, label) = parse_optional_field(
+                DOCUMENT,
+                "label",
+                PREFIX_SHARD_LABEL,
+                take_shard_label,
+                input,
+            )?;
+            let (input, holder) = parse_optional_field(
+                DOCUMENT,
+                "holder",
+                PREFIX_SHARD_HOLDER,
+                take_shard_holder,
+                input,
+            )?;
+            let (issuance, input) = parse_optional::<ShardIssuance>(
+                DOCUMENT,
+                "issuance",
+                PREFIX_SHARD_ISSUANCE,
+                input,
+            )?;
+            let (revocation, input) = parse_optional::<ShardRevocation>(
+                DOCUMENT,
+                "revocation",
+                PREFIX_SHARD_REVOCATION,
+                input,
+            )?;
+            let (input, contact) = parse_optional_field(
+                DOCUMENT,
+                "contact",
+                PREFIX_SHARD_CONTACT,
+                take_shard_contact,
+                input,
+            )?;
+            let (input, note) =
+                parse_optional_field(DOCUMENT, "note", PREFIX_SHARD_NOTE, take_shard_note, input)?;
+            let (remain, language) = parse_optional_field(
+                DOCUMENT,
+                "language",
+                PREFIX_CODEWORD_LANGUAGE,
+                take_codeword_language,
+                input,
+            )?;
+
+            let utf8 = |field, bytes: Option<&[u8]>| {
+                bytes
+                    .map(|bytes| {
+                        String::from_utf8(bytes.into())
+                            .map_err(|err| WireError::nom(DOCUMENT, err).field(field))
+                    })
+                    .transpose()
+            };
+
+            Ok((
+                KeyShardBuilder {
+                    version,
+                    doc_chksum,
+                    shard,
+                    dates,
+                    audit,
+                    commitment,
+                    timestamp_token: timestamp_token.map(Vec::from),
+                    roster,
+                    label: utf8("label", label)?,
+                    holder: utf8("holder", holder)?,
+                    issuance,
+                    revocation,
+                    contact: utf8("contact", contact)?,
+                    note: utf8("note", note)?,
+                    language,
+                },
+                remain,
+            ))
         }
-        let mut parse = complete(parse);
 
-        let (input, (version, doc_chksum)) = parse(input).map_err(|err| format!("{:?}", err))?;
-        let (shard, remain) = Shard::from_wire_partial(input)?;
-
-        Ok((
-            KeyShardBuilder {
-                version,
-                doc_chksum,
-                shard,
-            },
-            remain,
-        ))
+        let (input, version) = parse_field(DOCUMENT, "version", varuint_nom::u32, input)?;
+        // Check the version before anything else, so that documents from newer
+        // versions of paperback get a useful error.
+        version::compatible_with(version).map_err(|err| {
+            WireError::new(DOCUMENT, err.to_string())
+                .field("version")
+                .version(version)
+        })?;
+        parse_fields(version, input).map_err(|err| err.version(version))
     }
 }
 
@@ -98,19 +286,27 @@ impl ToWire for KeyShard {
 /// Internal only -- users should use EncryptedKeyShard's FromWire.
 #[doc(hidden)]
 impl FromWire for KeyShard {
-    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), String> {
-        let (inner, input) = KeyShardBuilder::from_wire_partial(input)?;
-        let (identity, input) = Identity::from_wire_partial(input)?;
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        let (inner, input) = KeyShardBuilder::from_wire_partial(input)
+            .map_err(|err| err.within("KeyShard", "inner"))?;
+        let (identity, input) = Identity::from_wire_partial(input)
+            .map_err(|err| err.within("KeyShard", "identity").version(inner.version))?;
 
         if inner.doc_chksum.code() != CHECKSUM_ALGORITHM.into() {
-            return Err("document checksum must be Blake2b-256".to_string());
+            return Err(
+                WireError::new("KeyShard", "document checksum must be Blake2b-256")
+                    .field("inner.doc_chksum")
+                    .version(inner.version),
+            );
         }
 
         if inner.version != 0 {
-            return Err(format!(
-                "key shard version must be '0' not '{}'",
-                inner.version
-            ));
+            return Err(WireError::new(
+                "KeyShard",
+                format!("key shard version must be '0' not '{}'", inner.version),
+            )
+            .field("inner.version")
+            .version(inner.version));
         }
 
         Ok((KeyShard { inner, identity }, input))
@@ -139,29 +335,57 @@ impl ToWire for EncryptedKeyShard {
             .chain(&self.ciphertext)
             .for_each(|b| bytes.push(*b));
 
+        // Encode optional key check value.
+        if let Some(ref key_check) = self.key_check {
+            varuint_encode::u64(PREFIX_KEY_CHECK, &mut buffer)
+                .iter()
+                .chain(key_check)
+                .for_each(|b| bytes.push(*b));
+        }
+
+        // Encode optional codeword language.
+        encode_language(self.language, &mut bytes);
+
         bytes
     }
 }
 
 impl FromWire for EncryptedKeyShard {
-    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), String> {
-        use crate::v0::wire::helpers::{take_chachapoly_ciphertext, take_chachapoly_nonce};
-        use nom::{combinator::complete, IResult};
-
-        fn parse(input: &[u8]) -> IResult<&[u8], (ChaChaPolyNonce, &[u8])> {
-            let (input, nonce) = take_chachapoly_nonce(input)?;
-            let (input, ciphertext) = take_chachapoly_ciphertext(input)?;
-
-            Ok((input, (nonce, ciphertext)))
-        }
-        let mut parse = complete(parse);
-
-        let (remain, (nonce, ciphertext)) = parse(input).map_err(|err| format!("{:?}", err))?;
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use crate::v0::wire::helpers::{
+            parse_field, parse_optional_field, take_chachapoly_ciphertext, take_chachapoly_nonce,
+            take_codeword_language, take_key_check,
+        };
+
+        let (input, nonce) =
+            parse_field("EncryptedKeyShard", "nonce", take_chachapoly_nonce, input)?;
+        let (input, ciphertext) = parse_field(
+            "EncryptedKeyShard",
+            "ciphertext",
+            take_chachapoly_ciphertext,
+            input,
+        )?;
+        let (input, key_check) = parse_optional_field(
+            "EncryptedKeyShard",
+            "key_check",
+            PREFIX_KEY_CHECK,
+            take_key_check,
+            input,
+        )?;
+        let (remain, language) = parse_optional_field(
+            "EncryptedKeyShard",
+            "language",
+            PREFIX_CODEWORD_LANGUAGE,
+            take_codeword_language,
+            input,
+        )?;
 
         Ok((
             EncryptedKeyShard {
                 nonce,
                 ciphertext: ciphertext.into(),
+                key_check,
+                language,
             },
             remain,
         ))
@@ -184,6 +408,65 @@ mod test {
         assert_eq!(shard, shard2);
     }
 
+    #[quickcheck]
+    fn key_shard_truncated_error(shard: KeyShard) {
+        let mut bytes = shard.to_wire();
+        bytes.pop();
+
+        let err = KeyShard::from_wire(bytes).unwrap_err();
+        assert_eq!(err.document(), "KeyShard");
+        assert_eq!(err.path(), "identity.id_signature");
+        assert_eq!(err.schema_version(), Some(0));
+    }
+
+    #[quickcheck]
+    fn key_shard_builder_corrupt_optional_field(mut inner: KeyShardBuilder) {
+        inner.issuance = Some(ShardIssuance {
+            generation: 1,
+            serial: 1,
+        });
+        inner.revocation = None;
+        inner.contact = None;
+        inner.note = None;
+        inner.language = None;
+
+        // The issuance record is encoded last, so this cuts off its serial.
+        let mut bytes = inner.to_wire();
+        bytes.pop();
+
+        let err = KeyShardBuilder::from_wire(bytes).unwrap_err();
+        assert_eq!(err.document(), "KeyShardBuilder");
+        assert_eq!(err.path(), "issuance.serial");
+    }
+
+    #[quickcheck]
+    fn key_shard_builder_corrupt_optional_string(mut inner: KeyShardBuilder) {
+        inner.label = Some("label".into());
+        inner.holder = None;
+        inner.issuance = None;
+        inner.revocation = None;
+        inner.contact = None;
+        inner.note = None;
+        inner.language = None;
+
+        // The label is encoded last, so this cuts off its contents.
+        let mut bytes = inner.to_wire();
+        bytes.pop();
+
+        let err = KeyShardBuilder::from_wire(bytes).unwrap_err();
+        assert_eq!(err.document(), "KeyShardBuilder");
+        assert_eq!(err.path(), "label");
+    }
+
+    #[test]
+    fn key_shard_too_large() {
+        use crate::v0::limits::MAX_WIRE_LENGTH;
+
+        let err = KeyShard::from_wire(vec![0u8; MAX_WIRE_LENGTH + 1]).unwrap_err();
+        assert_eq!(err.document(), "KeyShard");
+        assert_eq!(err.path(), "");
+    }
+
     #[quickcheck]
     fn encrypted_key_shard_roundtrip(shard: EncryptedKeyShard) {
         let shard2 = EncryptedKeyShard::from_wire(shard.to_wire()).unwrap();
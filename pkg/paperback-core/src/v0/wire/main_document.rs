@@ -16,9 +16,13 @@
  * along with this program.  If not, see <https://www.gnu.org/licenses/>.
  */
 
-use crate::v0::{
-    wire::{prefixes::*, FromWire, ToWire},
-    ChaChaPolyNonce, Identity, MainDocument, MainDocumentBuilder, MainDocumentMeta,
+use crate::{
+    v0::{
+        wire::{prefixes::*, FromWire, ToWire, WireError},
+        DocumentDates, EscrowRecipients, Identity, MainDocument, MainDocumentBuilder,
+        MainDocumentMeta,
+    },
+    version,
 };
 
 use unsigned_varint::{encode as varuint_encode, nom as varuint_nom};
@@ -40,6 +44,31 @@ impl ToWire for MainDocumentMeta {
             .iter()
             .for_each(|b| bytes.push(*b));
 
+        // Encode optional dates.
+        bytes.append(&mut self.dates.to_wire());
+
+        // Encode optional shard Merkle root.
+        if let Some(shard_root) = self.shard_root {
+            varuint_encode::u64(PREFIX_SHARD_MERKLE_ROOT, &mut varuint_encode::u64_buffer())
+                .iter()
+                .copied()
+                .chain(shard_root.to_bytes())
+                .for_each(|b| bytes.push(b));
+        }
+
+        // Encode optional compression algorithm.
+        if let Some(compression) = self.compression {
+            varuint_encode::u64(PREFIX_COMPRESSION, &mut varuint_encode::u64_buffer())
+                .iter()
+                .chain(varuint_encode::u32(compression.id(), &mut buffer))
+                .for_each(|b| bytes.push(*b));
+        }
+
+        // Encode optional escrow recipients.
+        if let Some(ref escrow) = self.escrow {
+            bytes.append(&mut escrow.to_wire());
+        }
+
         bytes
     }
 }
@@ -47,24 +76,64 @@ impl ToWire for MainDocumentMeta {
 // Internal only -- users can't see MainDocumentMeta.
 #[doc(hidden)]
 impl FromWire for MainDocumentMeta {
-    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), String> {
-        use nom::{combinator::complete, IResult};
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use crate::v0::wire::helpers::{
+            parse_field, parse_optional, parse_optional_field, take_compression,
+            take_shard_merkle_root,
+        };
 
-        fn parse(input: &[u8]) -> IResult<&[u8], MainDocumentMeta> {
-            let (input, version) = varuint_nom::u32(input)?;
-            let (input, quorum_size) = varuint_nom::u32(input)?;
+        const DOCUMENT: &str = "MainDocumentMeta";
+
+        fn parse_fields(
+            version: u32,
+            input: &[u8],
+        ) -> Result<(MainDocumentMeta, &[u8]), WireError> {
+            let (input, quorum_size) =
+                parse_field(DOCUMENT, "quorum_size", varuint_nom::u32, input)?;
+            let (dates, input) = DocumentDates::from_wire_partial(input)
+                .map_err(|err| err.within(DOCUMENT, "dates"))?;
+            let (input, shard_root) = parse_optional_field(
+                DOCUMENT,
+                "shard_root",
+                PREFIX_SHARD_MERKLE_ROOT,
+                take_shard_merkle_root,
+                input,
+            )?;
+            let (input, compression) = parse_optional_field(
+                DOCUMENT,
+                "compression",
+                PREFIX_COMPRESSION,
+                take_compression,
+                input,
+            )?;
+            let (escrow, remain) = parse_optional::<EscrowRecipients>(
+                DOCUMENT,
+                "escrow",
+                PREFIX_ESCROW_RECIPIENTS,
+                input,
+            )?;
 
             let meta = MainDocumentMeta {
                 version,
                 quorum_size,
+                dates,
+                shard_root,
+                compression,
+                escrow,
             };
 
-            Ok((input, meta))
+            Ok((meta, remain))
         }
-        let mut parse = complete(parse);
 
-        let (remain, meta) = parse(input).map_err(|err| format!("{:?}", err))?;
-        Ok((meta, remain))
+        let (input, version) = parse_field(DOCUMENT, "version", varuint_nom::u32, input)?;
+        // Check the version before anything else, so that documents from newer
+        // versions of paperback get a useful error.
+        version::compatible_with(version).map_err(|err| {
+            WireError::new(DOCUMENT, err.to_string())
+                .field("version")
+                .version(version)
+        })?;
+        parse_fields(version, input).map_err(|err| err.version(version))
     }
 }
 
@@ -101,20 +170,20 @@ impl ToWire for MainDocumentBuilder {
 // Internal only -- users can't see MainDocumentBuilder.
 #[doc(hidden)]
 impl FromWire for MainDocumentBuilder {
-    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), String> {
-        use crate::v0::wire::helpers::{take_chachapoly_ciphertext, take_chachapoly_nonce};
-        use nom::{combinator::complete, IResult};
-
-        fn parse(input: &[u8]) -> IResult<&[u8], (ChaChaPolyNonce, &[u8])> {
-            let (input, nonce) = take_chachapoly_nonce(input)?;
-            let (input, ciphertext) = take_chachapoly_ciphertext(input)?;
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use crate::v0::wire::helpers::{
+            parse_field, take_chachapoly_ciphertext, take_chachapoly_nonce,
+        };
 
-            Ok((input, (nonce, ciphertext)))
-        }
-        let mut parse = complete(parse);
+        const DOCUMENT: &str = "MainDocumentBuilder";
 
-        let (meta, input) = MainDocumentMeta::from_wire_partial(input)?;
-        let (remain, (nonce, ciphertext)) = parse(input).map_err(|err| format!("{:?}", err))?;
+        let (meta, input) = MainDocumentMeta::from_wire_partial(input)
+            .map_err(|err| err.within(DOCUMENT, "meta"))?;
+        let (input, nonce) = parse_field(DOCUMENT, "nonce", take_chachapoly_nonce, input)
+            .map_err(|err| err.version(meta.version))?;
+        let (remain, ciphertext) =
+            parse_field(DOCUMENT, "ciphertext", take_chachapoly_ciphertext, input)
+                .map_err(|err| err.version(meta.version))?;
 
         Ok((
             MainDocumentBuilder {
@@ -139,15 +208,24 @@ impl ToWire for MainDocument {
 }
 
 impl FromWire for MainDocument {
-    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), String> {
-        let (inner, input) = MainDocumentBuilder::from_wire_partial(input)?;
-        let (identity, input) = Identity::from_wire_partial(input)?;
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        let (inner, input) = MainDocumentBuilder::from_wire_partial(input)
+            .map_err(|err| err.within("MainDocument", "inner"))?;
+        let (identity, input) = Identity::from_wire_partial(input).map_err(|err| {
+            err.within("MainDocument", "identity")
+                .version(inner.meta.version)
+        })?;
 
         if inner.meta.version != 0 {
-            return Err(format!(
-                "main document version must be '0' not '{}'",
-                inner.meta.version
-            ));
+            return Err(WireError::new(
+                "MainDocument",
+                format!(
+                    "main document version must be '0' not '{}'",
+                    inner.meta.version
+                ),
+            )
+            .field("inner.meta.version")
+            .version(inner.meta.version));
         }
 
         Ok((MainDocument { inner, identity }, input))
@@ -169,4 +247,14 @@ mod test {
         let meta2 = MainDocumentMeta::from_wire(main.inner.meta.to_wire()).unwrap();
         assert_eq!(main.inner.meta, meta2);
     }
+
+    #[quickcheck]
+    fn main_document_newer_version(mut main: MainDocument) {
+        main.inner.meta.version = crate::version::latest_schema_version() + 1;
+
+        let err = MainDocument::from_wire(main.to_wire()).unwrap_err();
+        assert_eq!(err.path(), "inner.meta.version");
+        assert_eq!(err.schema_version(), Some(main.inner.meta.version));
+        assert!(err.message().contains("upgrade"));
+    }
 }
@@ -16,13 +16,26 @@
  * along with this program.  If not, see <https://www.gnu.org/licenses/>.
  */
 
+mod armor;
+mod audit;
+mod escrow;
+mod frame;
 mod helpers;
 mod internal;
+mod issuance;
 mod key_shard;
 mod main_document;
+mod page;
+mod revocation;
+mod roster;
+mod schema;
 
 use zbase32;
 
+pub use armor::{content_hash, from_armor, to_armor, DualRepresentation};
+pub use frame::{FrameEncoding, FrameHeader, Framed, FRAME_MAGIC};
+pub use schema::{schemas, DocumentKind, DocumentSchema, FieldEncoding, FieldSchema};
+
 pub(crate) mod prefixes {
     // It's easier to read these bytes if they have unconventional groupings.
     #![allow(clippy::unusual_byte_groupings)]
@@ -54,12 +67,188 @@ pub(crate) mod prefixes {
     // NOTE: Entirely our own creation and not remotely upstreamable.
     pub(super) const PREFIX_CHACHA20POLY1305_CIPHERTEXT: u64 = 0xfc_caca20_1305;
 
+    /// Prefix for a document creation timestamp (seconds since UNIX epoch).
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_DATE_CREATED: u64 = 0xfd_da7e_c7ea;
+
+    /// Prefix for a document review-by timestamp (seconds since UNIX epoch).
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_DATE_REVIEW_BY: u64 = 0xfd_da7e_7e71;
+
+    /// Prefix for an ed25519 secret key used to answer shard audit challenges.
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_ED25519_AUDIT_SECRET: u64 = 0xfd_ed25519_a0d1;
+
+    /// Prefix for the Merkle root of the key shards issued with a document.
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_SHARD_MERKLE_ROOT: u64 = 0xfd_3e7c_1e00;
+
+    /// Prefix for the Merkle inclusion proof of a key shard.
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_SHARD_MERKLE_PROOF: u64 = 0xfd_3e7c_1e01;
+
+    /// Prefix for a trusted timestamp token (such as an RFC 3161 token).
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_TIMESTAMP_TOKEN: u64 = 0xfd_da7e_3161;
+
+    /// Prefix for the compression algorithm applied to a document's contents.
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_COMPRESSION: u64 = 0xfd_c0_3e55;
+
+    /// Prefix for the roster of key shards issued with a document.
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_SHARD_ROSTER: u64 = 0xfd_3e7c_1e02;
+
+    /// Prefix for the free-form label of a key shard.
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_SHARD_LABEL: u64 = 0xfd_3e7c_1ab1;
+
+    /// Prefix for the holder hint of a key shard.
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_SHARD_HOLDER: u64 = 0xfd_3e7c_0d1e;
+
+    /// Prefix for a single page of a document split across several pages.
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_DOCUMENT_PAGE: u64 = 0xfd_9a9e_0000;
+
+    /// Prefix for the key check value of an encrypted key shard.
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_KEY_CHECK: u64 = 0xfd_caca20_c4ec;
+
+    /// Prefix for the issuance record of a key shard.
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_SHARD_ISSUANCE: u64 = 0xfd_3e7c_1e03;
+
+    /// Prefix for the revocation record of a re-sharded backup.
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_SHARD_REVOCATION: u64 = 0xfd_3e7c_1e04;
+
+    /// Prefix for the holder contact details of a key shard.
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_SHARD_CONTACT: u64 = 0xfd_3e7c_c047;
+
+    /// Prefix for the free-form note of a key shard.
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_SHARD_NOTE: u64 = 0xfd_3e7c_4073;
+
+    /// Prefix for the wordlist language of a key shard's codewords.
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_CODEWORD_LANGUAGE: u64 = 0xfd_3e7c_1a9e;
+
+    /// Prefix for the list of age recipients a document key was escrowed to.
+    // NOTE: Entirely our own creation and not remotely upstreamable.
+    pub(super) const PREFIX_ESCROW_RECIPIENTS: u64 = 0xfd_e5c7_0000;
+
     /// Multi-base prefix for zbase32.
     // TODO: Switch to <https://docs.rs/multibase>.
     pub(super) const MULTIBASE_PREFIX_ZBASE32: &'static str = "h";
 }
 
-// TODO: Switch the errors from String to a proper thiserror error type.
+/// Limits enforced when decoding documents.
+///
+/// Documents handed to a recoverer may have been constructed maliciously, so
+/// all decoding paths bound the amount of memory and time they will spend on a
+/// document, no matter what lengths or counts it claims to contain.
+pub mod limits {
+    /// Maximum length (in bytes) of the wire representation of a document.
+    pub const MAX_WIRE_LENGTH: usize = 1 << 20;
+
+    /// Maximum length of the zbase32 representation of a document.
+    pub const MAX_ZBASE32_LENGTH: usize = 1 + (MAX_WIRE_LENGTH * 8 + 4) / 5;
+
+    /// Maximum number of entries in a shard roster.
+    pub const MAX_ROSTER_ENTRIES: usize = 1024;
+
+    /// Maximum number of age recipients a document key can be escrowed to.
+    pub const MAX_ESCROW_RECIPIENTS: usize = 64;
+
+    /// Maximum length of a shard Merkle inclusion proof (enough for a tree
+    /// with 2^32 leaves).
+    pub const MAX_MERKLE_PATH_LENGTH: usize = 32;
+
+    /// Maximum length (in bytes) of the secret data after decompression.
+    pub const MAX_DECOMPRESSED_LENGTH: usize = 16 << 20;
+}
+
+/// Error returned when a document fails to decode from its wire format.
+///
+/// In addition to the underlying parser error, it records which document type
+/// was being decoded, the path to the field inside that document which failed
+/// to decode, and (if it was decoded successfully before the failure) the
+/// schema version of the document.
+#[derive(Clone, Debug, Eq, PartialEq, thiserror::Error)]
+#[error(
+    "failed to decode {} (schema version {}) field '{}': {}",
+    .document,
+    .version.map(|v| v.to_string()).unwrap_or_else(|| "unknown".into()),
+    .path.join("."),
+    .message
+)]
+pub struct WireError {
+    document: &'static str,
+    version: Option<u32>,
+    path: Vec<&'static str>,
+    message: String,
+}
+
+impl WireError {
+    pub(crate) fn new<S: Into<String>>(document: &'static str, message: S) -> Self {
+        Self {
+            document,
+            version: None,
+            path: vec![],
+            message: message.into(),
+        }
+    }
+
+    /// Construct a `WireError` from a nom parsing error.
+    pub(crate) fn nom<E: std::fmt::Debug>(document: &'static str, err: E) -> Self {
+        Self::new(document, format!("{:?}", err))
+    }
+
+    /// Prefix the path of the failing field with `field`.
+    pub(crate) fn field(mut self, field: &'static str) -> Self {
+        self.path.insert(0, field);
+        self
+    }
+
+    /// Record that the error occurred while decoding the `field` of an outer
+    /// `document`.
+    pub(crate) fn within(mut self, document: &'static str, field: &'static str) -> Self {
+        self.document = document;
+        self.field(field)
+    }
+
+    /// Record the schema version of the document being decoded (if no version
+    /// has already been recorded by an inner document).
+    pub(crate) fn version(mut self, version: u32) -> Self {
+        self.version.get_or_insert(version);
+        self
+    }
+
+    /// Returns the (outermost) type of document which failed to decode.
+    pub fn document(&self) -> &'static str {
+        self.document
+    }
+
+    /// Returns the schema version of the document which failed to decode, if
+    /// it was decoded before the failure.
+    pub fn schema_version(&self) -> Option<u32> {
+        self.version
+    }
+
+    /// Returns the path to the field which failed to decode, as a
+    /// dot-separated string (such as `inner.shard.ys`). The path is empty if
+    /// the failure was not specific to a field.
+    pub fn path(&self) -> String {
+        self.path.join(".")
+    }
+
+    /// Returns the underlying description of the failure.
+    pub fn message(&self) -> &str {
+        &self.message
+    }
+}
 
 // TODO: Switch to <https://docs.rs/multibase>.
 pub(crate) fn to_multibase_zbase32<D: AsRef<[u8]>>(data: D) -> String {
@@ -79,26 +268,53 @@ pub trait ToWire {
 }
 
 pub trait FromWire: Sized {
-    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), String>;
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError>;
 
-    fn from_wire<B: AsRef<[u8]>>(input: B) -> Result<Self, String> {
-        match Self::from_wire_partial(input.as_ref())? {
+    fn from_wire<B: AsRef<[u8]>>(input: B) -> Result<Self, WireError> {
+        let document = std::any::type_name::<Self>().rsplit("::").next().unwrap();
+        let input = input.as_ref();
+        if input.len() > limits::MAX_WIRE_LENGTH {
+            return Err(WireError::new(
+                document,
+                format!(
+                    "document is too large ({} > {} bytes)",
+                    input.len(),
+                    limits::MAX_WIRE_LENGTH
+                ),
+            ));
+        }
+        match Self::from_wire_partial(input)? {
             (ret, []) => Ok(ret),
-            _ => Err("trailing bytes left after deseralisation".into()),
+            _ => Err(WireError::new(
+                document,
+                "trailing bytes left after deseralisation",
+            )),
         }
     }
 
     /// Parse a zbase32-encoded representation of a `FromWire`-implementing type
     /// as that type.
-    fn from_wire_zbase32<S: AsRef<str>>(input: S) -> Result<Self, String> {
+    fn from_wire_zbase32<S: AsRef<str>>(input: S) -> Result<Self, WireError> {
         // TODO: Switch to <https://docs.rs/multibase>.
+        let document = std::any::type_name::<Self>().rsplit("::").next().unwrap();
         let input = input.as_ref();
+        if input.len() > limits::MAX_ZBASE32_LENGTH {
+            return Err(WireError::new(
+                document,
+                format!(
+                    "zbase32 string is too long ({} > {} characters)",
+                    input.len(),
+                    limits::MAX_ZBASE32_LENGTH
+                ),
+            ));
+        }
         match (input.get(0..1), input.get(1..)) {
             (Some(prefixes::MULTIBASE_PREFIX_ZBASE32), Some(data)) => {
-                let wire_data = zbase32::decode_full_bytes_str(data)?;
+                let wire_data = zbase32::decode_full_bytes_str(data)
+                    .map_err(|err| WireError::new(document, err))?;
                 Self::from_wire(wire_data)
             }
-            _ => Err("invalid zbase32 string".into()),
+            _ => Err(WireError::new(document, "invalid zbase32 string")),
         }
     }
 }
@@ -0,0 +1,106 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{
+    wire::{prefixes::*, FromWire, ToWire, WireError},
+    Page,
+};
+
+use unsigned_varint::{encode as varuint_encode, nom as varuint_nom};
+
+impl ToWire for Page {
+    fn to_wire(&self) -> Vec<u8> {
+        let mut buffer = varuint_encode::u32_buffer();
+        let mut bytes = vec![];
+
+        // Encode prefix.
+        varuint_encode::u64(PREFIX_DOCUMENT_PAGE, &mut varuint_encode::u64_buffer())
+            .iter()
+            .for_each(|b| bytes.push(*b));
+
+        // Encode multihash checksum of the whole document.
+        self.content_chksum
+            .to_bytes()
+            .iter()
+            .for_each(|b| bytes.push(*b));
+
+        // Encode page number and total number of pages.
+        for value in &[self.number, self.total] {
+            varuint_encode::u32(*value, &mut buffer)
+                .iter()
+                .for_each(|b| bytes.push(*b));
+        }
+
+        // Encode multihash checksum of the page.
+        self.page_chksum
+            .to_bytes()
+            .iter()
+            .for_each(|b| bytes.push(*b));
+
+        // Encode page data (length-prefixed).
+        varuint_encode::usize(self.data.len(), &mut varuint_encode::usize_buffer())
+            .iter()
+            .chain(&self.data)
+            .for_each(|b| bytes.push(*b));
+
+        bytes
+    }
+}
+
+impl FromWire for Page {
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use crate::v0::wire::helpers::{multihash, parse_field};
+        use nom::{combinator::verify, multi::length_data};
+
+        const DOCUMENT: &str = "Page";
+
+        let (input, _) = parse_field(
+            DOCUMENT,
+            "prefix",
+            verify(varuint_nom::u64, |x| *x == PREFIX_DOCUMENT_PAGE),
+            input,
+        )?;
+        let (input, content_chksum) = parse_field(DOCUMENT, "content_chksum", multihash, input)?;
+        let (input, number) = parse_field(DOCUMENT, "number", varuint_nom::u32, input)?;
+        let (input, total) = parse_field(DOCUMENT, "total", varuint_nom::u32, input)?;
+        let (input, page_chksum) = parse_field(DOCUMENT, "page_chksum", multihash, input)?;
+        let (remain, data) = parse_field(DOCUMENT, "data", length_data(varuint_nom::usize), input)?;
+
+        Ok((
+            Page {
+                content_chksum,
+                number,
+                total,
+                page_chksum,
+                data: data.into(),
+            },
+            remain,
+        ))
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[quickcheck]
+    fn page_roundtrip(page: Page) {
+        let page2 = Page::from_wire(page.to_wire()).unwrap();
+        assert_eq!(page, page2);
+    }
+}
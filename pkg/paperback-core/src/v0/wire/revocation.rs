@@ -0,0 +1,136 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{
+    wire::{prefixes::*, FromWire, ToWire, WireError},
+    ShardRevocation,
+};
+
+use unsigned_varint::{encode as varuint_encode, nom as varuint_nom};
+
+impl ToWire for ShardRevocation {
+    fn to_wire(&self) -> Vec<u8> {
+        let mut bytes = vec![];
+
+        // Encode prefix.
+        varuint_encode::u64(PREFIX_SHARD_REVOCATION, &mut varuint_encode::u64_buffer())
+            .iter()
+            .for_each(|b| bytes.push(*b));
+
+        // Encode multihash checksum of the replaced document.
+        self.doc_chksum
+            .to_bytes()
+            .iter()
+            .for_each(|b| bytes.push(*b));
+
+        // Encode revoked shard ids (length-prefixed).
+        varuint_encode::usize(self.shard_ids.len(), &mut varuint_encode::usize_buffer())
+            .iter()
+            .for_each(|b| bytes.push(*b));
+        for shard_id in &self.shard_ids {
+            varuint_encode::usize(shard_id.len(), &mut varuint_encode::usize_buffer())
+                .iter()
+                .chain(shard_id.as_bytes())
+                .for_each(|b| bytes.push(*b));
+        }
+
+        bytes
+    }
+}
+
+impl FromWire for ShardRevocation {
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use crate::v0::wire::{
+            helpers::{multihash, parse_field, take_count},
+            limits::MAX_ROSTER_ENTRIES,
+        };
+        use nom::{
+            combinator::verify,
+            multi::{length_data, many_m_n},
+        };
+
+        const DOCUMENT: &str = "ShardRevocation";
+
+        let (input, _) = parse_field(
+            DOCUMENT,
+            "prefix",
+            verify(varuint_nom::u64, |x| *x == PREFIX_SHARD_REVOCATION),
+            input,
+        )?;
+        let (input, doc_chksum) = parse_field(DOCUMENT, "doc_chksum", multihash, input)?;
+        let (input, length) = parse_field(
+            DOCUMENT,
+            "shard_ids",
+            |input| take_count(input, MAX_ROSTER_ENTRIES),
+            input,
+        )?;
+        let (remain, shard_ids) = parse_field(
+            DOCUMENT,
+            "shard_ids",
+            many_m_n(length, length, length_data(varuint_nom::usize)),
+            input,
+        )?;
+
+        let shard_ids = shard_ids
+            .into_iter()
+            .map(|shard_id| {
+                String::from_utf8(shard_id.into())
+                    .map_err(|err| WireError::nom(DOCUMENT, err).field("shard_ids"))
+            })
+            .collect::<Result<Vec<_>, WireError>>()?;
+
+        Ok((
+            ShardRevocation {
+                doc_chksum,
+                shard_ids,
+            },
+            remain,
+        ))
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[quickcheck]
+    fn shard_revocation_roundtrip(revocation: ShardRevocation) {
+        let revocation2 = ShardRevocation::from_wire(revocation.to_wire()).unwrap();
+        assert_eq!(revocation, revocation2);
+    }
+
+    #[test]
+    fn shard_revocation_hostile_length() {
+        use crate::v0::CHECKSUM_ALGORITHM;
+        use multihash::MultihashDigest;
+
+        let mut bytes = vec![];
+        varuint_encode::u64(PREFIX_SHARD_REVOCATION, &mut varuint_encode::u64_buffer())
+            .iter()
+            .chain(&CHECKSUM_ALGORITHM.digest(b"document").to_bytes())
+            .chain(varuint_encode::usize(
+                u32::MAX as usize,
+                &mut varuint_encode::usize_buffer(),
+            ))
+            .chain(&[0u8; 16])
+            .for_each(|b| bytes.push(*b));
+
+        let err = ShardRevocation::from_wire(bytes).unwrap_err();
+        assert_eq!(err.path(), "shard_ids");
+    }
+}
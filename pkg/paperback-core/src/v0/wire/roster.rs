@@ -0,0 +1,138 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{
+    wire::{prefixes::*, FromWire, ToWire, WireError},
+    RosterEntry, ShardRoster,
+};
+
+use unsigned_varint::{encode as varuint_encode, nom as varuint_nom};
+
+fn encode_string(string: &str, bytes: &mut Vec<u8>) {
+    varuint_encode::usize(string.len(), &mut varuint_encode::usize_buffer())
+        .iter()
+        .chain(string.as_bytes())
+        .for_each(|b| bytes.push(*b));
+}
+
+impl ToWire for ShardRoster {
+    fn to_wire(&self) -> Vec<u8> {
+        let mut bytes = vec![];
+
+        // Encode prefix.
+        varuint_encode::u64(PREFIX_SHARD_ROSTER, &mut varuint_encode::u64_buffer())
+            .iter()
+            .for_each(|b| bytes.push(*b));
+
+        // Encode entries (length-prefixed).
+        varuint_encode::usize(self.entries.len(), &mut varuint_encode::usize_buffer())
+            .iter()
+            .for_each(|b| bytes.push(*b));
+        for entry in &self.entries {
+            encode_string(&entry.shard_id, &mut bytes);
+            encode_string(&entry.holder, &mut bytes);
+        }
+
+        bytes
+    }
+}
+
+impl FromWire for ShardRoster {
+    fn from_wire_partial(input: &[u8]) -> Result<(Self, &[u8]), WireError> {
+        use crate::v0::wire::{
+            helpers::{parse_field, take_count},
+            limits::MAX_ROSTER_ENTRIES,
+        };
+        use nom::{
+            combinator::verify,
+            multi::{length_data, many_m_n},
+            sequence::pair,
+        };
+
+        const DOCUMENT: &str = "ShardRoster";
+
+        let (input, _) = parse_field(
+            DOCUMENT,
+            "prefix",
+            verify(varuint_nom::u64, |x| *x == PREFIX_SHARD_ROSTER),
+            input,
+        )?;
+        let (input, length) = parse_field(
+            DOCUMENT,
+            "entries",
+            |input| take_count(input, MAX_ROSTER_ENTRIES),
+            input,
+        )?;
+        let (remain, entries) = parse_field(
+            DOCUMENT,
+            "entries",
+            many_m_n(
+                length,
+                length,
+                pair(
+                    length_data(varuint_nom::usize),
+                    length_data(varuint_nom::usize),
+                ),
+            ),
+            input,
+        )?;
+
+        let utf8 = |field, bytes: &[u8]| {
+            String::from_utf8(bytes.into())
+                .map_err(|err| WireError::nom(DOCUMENT, err).field(field).field("entries"))
+        };
+        let entries = entries
+            .into_iter()
+            .map(|(shard_id, holder)| {
+                Ok(RosterEntry {
+                    shard_id: utf8("shard_id", shard_id)?,
+                    holder: utf8("holder", holder)?,
+                })
+            })
+            .collect::<Result<Vec<_>, WireError>>()?;
+
+        Ok((ShardRoster { entries }, remain))
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[quickcheck]
+    fn shard_roster_roundtrip(roster: ShardRoster) {
+        let roster2 = ShardRoster::from_wire(roster.to_wire()).unwrap();
+        assert_eq!(roster, roster2);
+    }
+
+    #[test]
+    fn shard_roster_hostile_length() {
+        let mut bytes = vec![];
+        varuint_encode::u64(PREFIX_SHARD_ROSTER, &mut varuint_encode::u64_buffer())
+            .iter()
+            .chain(varuint_encode::usize(
+                u32::MAX as usize,
+                &mut varuint_encode::usize_buffer(),
+            ))
+            .chain(&[0u8; 16])
+            .for_each(|b| bytes.push(*b));
+
+        let err = ShardRoster::from_wire(bytes).unwrap_err();
+        assert_eq!(err.path(), "entries");
+    }
+}
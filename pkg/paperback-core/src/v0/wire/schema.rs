@@ -0,0 +1,574 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use crate::v0::{
+    limits::{MAX_ESCROW_RECIPIENTS, MAX_MERKLE_PATH_LENGTH, MAX_ROSTER_ENTRIES},
+    wire::{prefixes::*, WireError},
+    AuditResponse, EncryptedKeyShard, FromWire, KeyShard, MainDocument, Page,
+    CHACHAPOLY_KEY_LENGTH, CHACHAPOLY_NONCE_LENGTH, KEY_CHECK_LENGTH,
+};
+
+use serde::Serialize;
+
+/// How the value of a field is encoded on the wire.
+#[derive(Clone, Debug, Eq, PartialEq, Serialize)]
+#[serde(tag = "type", rename_all = "snake_case")]
+pub enum FieldEncoding {
+    /// An [unsigned-varint][uvarint].
+    ///
+    /// [uvarint]: https://github.com/multiformats/unsigned-varint
+    Varuint,
+    /// A self-describing [multihash][multihash].
+    ///
+    /// [multihash]: https://github.com/multiformats/multihash
+    Multihash,
+    /// A fixed number of raw bytes.
+    FixedBytes { length: usize },
+    /// An unsigned-varint length followed by that many raw bytes.
+    LengthPrefixed,
+    /// A nested document, described by the [`DocumentSchema`] with the given
+    /// name.
+    Document { name: &'static str },
+    /// An unsigned-varint count followed by that many elements, each of which
+    /// is the concatenation of `elements`.
+    Repeated {
+        max: Option<usize>,
+        elements: Vec<FieldEncoding>,
+    },
+}
+
+/// Description of one field in a document.
+#[derive(Clone, Debug, Eq, PartialEq, Serialize)]
+pub struct FieldSchema {
+    name: &'static str,
+    prefixes: Vec<u64>,
+    optional: bool,
+    encoding: FieldEncoding,
+}
+
+impl FieldSchema {
+    fn new(name: &'static str, encoding: FieldEncoding) -> Self {
+        Self {
+            name,
+            prefixes: vec![],
+            optional: false,
+            encoding,
+        }
+    }
+
+    fn prefixed<P: Into<u64>>(mut self, prefix: P) -> Self {
+        self.prefixes.push(prefix.into());
+        self
+    }
+
+    fn optional(mut self) -> Self {
+        self.optional = true;
+        self
+    }
+
+    /// Returns the name of the field.
+    pub fn name(&self) -> &'static str {
+        self.name
+    }
+
+    /// Returns the set of unsigned-varint prefixes which may precede the field
+    /// value. If empty, the field has no prefix.
+    pub fn prefixes(&self) -> &[u64] {
+        &self.prefixes
+    }
+
+    /// Returns whether the field may be omitted. Optional fields are always
+    /// prefixed (or are documents with a prefix), so that decoders can tell
+    /// whether they are present.
+    pub fn is_optional(&self) -> bool {
+        self.optional
+    }
+
+    /// Returns how the field value is encoded.
+    pub fn encoding(&self) -> &FieldEncoding {
+        &self.encoding
+    }
+}
+
+/// Description of the wire format of a document. The wire format of a document
+/// is the (optional) prefix followed by each of the fields in order.
+#[derive(Clone, Debug, Eq, PartialEq, Serialize)]
+pub struct DocumentSchema {
+    name: &'static str,
+    version: u32,
+    prefix: Option<u64>,
+    fields: Vec<FieldSchema>,
+}
+
+impl DocumentSchema {
+    /// Returns the name of the document.
+    pub fn name(&self) -> &'static str {
+        self.name
+    }
+
+    /// Returns the schema version described.
+    pub fn version(&self) -> u32 {
+        self.version
+    }
+
+    /// Returns the unsigned-varint prefix of the document, if it has one.
+    pub fn prefix(&self) -> Option<u64> {
+        self.prefix
+    }
+
+    /// Returns the fields of the document, in wire order.
+    pub fn fields(&self) -> &[FieldSchema] {
+        &self.fields
+    }
+}
+
+fn document(name: &'static str, prefix: Option<u64>, fields: Vec<FieldSchema>) -> DocumentSchema {
+    DocumentSchema {
+        name,
+        version: 0,
+        prefix,
+        fields,
+    }
+}
+
+/// Returns a machine-readable description of every document in the wire
+/// format (including all of the nested documents they refer to).
+///
+/// This is intended to allow third-party implementations to be built (and
+/// tested) against a specification which is guaranteed to match this
+/// implementation. All of the returned types implement `Serialize`, so the
+/// schemas can be exported as JSON.
+pub fn schemas() -> Vec<DocumentSchema> {
+    use FieldEncoding::*;
+
+    let ed25519_pub = || FixedBytes {
+        length: ed25519_dalek::PUBLIC_KEY_LENGTH,
+    };
+    let ed25519_sig = || FixedBytes {
+        length: ed25519_dalek::SIGNATURE_LENGTH,
+    };
+    let ed25519_sec = || FixedBytes {
+        length: ed25519_dalek::SECRET_KEY_LENGTH,
+    };
+    let nonce = || {
+        FieldSchema::new(
+            "nonce",
+            FixedBytes {
+                length: CHACHAPOLY_NONCE_LENGTH,
+            },
+        )
+        .prefixed(PREFIX_CHACHA20POLY1305_NONCE)
+    };
+    let ciphertext = || {
+        FieldSchema::new("ciphertext", LengthPrefixed).prefixed(PREFIX_CHACHA20POLY1305_CIPHERTEXT)
+    };
+
+    vec![
+        document(
+            "MainDocument",
+            None,
+            vec![
+                FieldSchema::new(
+                    "inner",
+                    Document {
+                        name: "MainDocumentBuilder",
+                    },
+                ),
+                FieldSchema::new("identity", Document { name: "Identity" }),
+            ],
+        ),
+        document(
+            "MainDocumentBuilder",
+            None,
+            vec![
+                FieldSchema::new(
+                    "meta",
+                    Document {
+                        name: "MainDocumentMeta",
+                    },
+                ),
+                nonce(),
+                ciphertext(),
+            ],
+        ),
+        document(
+            "MainDocumentMeta",
+            None,
+            vec![
+                FieldSchema::new("version", Varuint),
+                FieldSchema::new("quorum_size", Varuint),
+                FieldSchema::new(
+                    "dates",
+                    Document {
+                        name: "DocumentDates",
+                    },
+                ),
+                FieldSchema::new("shard_root", Multihash)
+                    .prefixed(PREFIX_SHARD_MERKLE_ROOT)
+                    .optional(),
+                FieldSchema::new("compression", Varuint)
+                    .prefixed(PREFIX_COMPRESSION)
+                    .optional(),
+                FieldSchema::new(
+                    "escrow",
+                    Document {
+                        name: "EscrowRecipients",
+                    },
+                )
+                .optional(),
+            ],
+        ),
+        document(
+            "DocumentDates",
+            None,
+            vec![
+                FieldSchema::new("created_at", Varuint)
+                    .prefixed(PREFIX_DATE_CREATED)
+                    .optional(),
+                FieldSchema::new("review_by", Varuint)
+                    .prefixed(PREFIX_DATE_REVIEW_BY)
+                    .optional(),
+            ],
+        ),
+        document(
+            "Identity",
+            None,
+            vec![
+                FieldSchema::new("id_public_key", ed25519_pub()).prefixed(PREFIX_ED25519_PUB),
+                FieldSchema::new("id_signature", ed25519_sig()).prefixed(PREFIX_ED25519_SIG),
+            ],
+        ),
+        document(
+            "EncryptedKeyShard",
+            None,
+            vec![
+                nonce(),
+                ciphertext(),
+                FieldSchema::new(
+                    "key_check",
+                    FixedBytes {
+                        length: KEY_CHECK_LENGTH,
+                    },
+                )
+                .prefixed(PREFIX_KEY_CHECK)
+                .optional(),
+                FieldSchema::new("language", Varuint)
+                    .prefixed(PREFIX_CODEWORD_LANGUAGE)
+                    .optional(),
+            ],
+        ),
+        document(
+            "KeyShard",
+            None,
+            vec![
+                FieldSchema::new(
+                    "inner",
+                    Document {
+                        name: "KeyShardBuilder",
+                    },
+                ),
+                FieldSchema::new("identity", Document { name: "Identity" }),
+            ],
+        ),
+        document(
+            "KeyShardBuilder",
+            None,
+            vec![
+                FieldSchema::new("version", Varuint),
+                FieldSchema::new("doc_chksum", Multihash),
+                FieldSchema::new("shard", Document { name: "Shard" }),
+                FieldSchema::new(
+                    "dates",
+                    Document {
+                        name: "DocumentDates",
+                    },
+                ),
+                FieldSchema::new("audit", Document { name: "ShardAudit" }).optional(),
+                FieldSchema::new(
+                    "commitment",
+                    Document {
+                        name: "ShardCommitment",
+                    },
+                )
+                .optional(),
+                FieldSchema::new("timestamp_token", LengthPrefixed)
+                    .prefixed(PREFIX_TIMESTAMP_TOKEN)
+                    .optional(),
+                FieldSchema::new(
+                    "roster",
+                    Document {
+                        name: "ShardRoster",
+                    },
+                )
+                .optional(),
+                FieldSchema::new("label", LengthPrefixed)
+                    .prefixed(PREFIX_SHARD_LABEL)
+                    .optional(),
+                FieldSchema::new("holder", LengthPrefixed)
+                    .prefixed(PREFIX_SHARD_HOLDER)
+                    .optional(),
+                FieldSchema::new(
+                    "issuance",
+                    Document {
+                        name: "ShardIssuance",
+                    },
+                )
+                .optional(),
+                FieldSchema::new(
+                    "revocation",
+                    Document {
+                        name: "ShardRevocation",
+                    },
+                )
+                .optional(),
+                FieldSchema::new("contact", LengthPrefixed)
+                    .prefixed(PREFIX_SHARD_CONTACT)
+                    .optional(),
+                FieldSchema::new("note", LengthPrefixed)
+                    .prefixed(PREFIX_SHARD_NOTE)
+                    .optional(),
+                FieldSchema::new("language", Varuint)
+                    .prefixed(PREFIX_CODEWORD_LANGUAGE)
+                    .optional(),
+            ],
+        ),
+        document(
+            "Shard",
+            None,
+            vec![
+                FieldSchema::new("x", Varuint),
+                FieldSchema::new(
+                    "ys",
+                    Repeated {
+                        max: None,
+                        elements: vec![Varuint],
+                    },
+                ),
+                FieldSchema::new("threshold", Varuint),
+                FieldSchema::new("secret_len", Varuint),
+            ],
+        ),
+        document(
+            "ShardAudit",
+            None,
+            vec![
+                FieldSchema::new("audit_seed", ed25519_sec()).prefixed(PREFIX_ED25519_AUDIT_SECRET),
+                FieldSchema::new("binding_signature", ed25519_sig()).prefixed(PREFIX_ED25519_SIG),
+            ],
+        ),
+        document(
+            "ShardCommitment",
+            Some(PREFIX_SHARD_MERKLE_PROOF),
+            vec![
+                FieldSchema::new("index", Varuint),
+                FieldSchema::new("count", Varuint),
+                FieldSchema::new(
+                    "path",
+                    Repeated {
+                        max: Some(MAX_MERKLE_PATH_LENGTH),
+                        elements: vec![Multihash],
+                    },
+                ),
+            ],
+        ),
+        document(
+            "ShardRoster",
+            Some(PREFIX_SHARD_ROSTER),
+            vec![FieldSchema::new(
+                "entries",
+                Repeated {
+                    max: Some(MAX_ROSTER_ENTRIES),
+                    elements: vec![LengthPrefixed, LengthPrefixed],
+                },
+            )],
+        ),
+        document(
+            "EscrowRecipients",
+            Some(PREFIX_ESCROW_RECIPIENTS),
+            vec![FieldSchema::new(
+                "recipients",
+                Repeated {
+                    max: Some(MAX_ESCROW_RECIPIENTS),
+                    elements: vec![LengthPrefixed],
+                },
+            )],
+        ),
+        document(
+            "ShardIssuance",
+            Some(PREFIX_SHARD_ISSUANCE),
+            vec![
+                FieldSchema::new("generation", Varuint),
+                FieldSchema::new("serial", Varuint),
+            ],
+        ),
+        document(
+            "ShardRevocation",
+            Some(PREFIX_SHARD_REVOCATION),
+            vec![
+                FieldSchema::new("doc_chksum", Multihash),
+                FieldSchema::new(
+                    "shard_ids",
+                    Repeated {
+                        max: Some(MAX_ROSTER_ENTRIES),
+                        elements: vec![LengthPrefixed],
+                    },
+                ),
+            ],
+        ),
+        document(
+            "ShardSecret",
+            None,
+            vec![
+                FieldSchema::new(
+                    "doc_key",
+                    FixedBytes {
+                        length: CHACHAPOLY_KEY_LENGTH,
+                    },
+                )
+                .prefixed(PREFIX_CHACHA20POLY1305_KEY),
+                // A sealed backup uses an all-zero key with a separate prefix.
+                FieldSchema::new("id_private_key", ed25519_sec())
+                    .prefixed(PREFIX_ED25519_SECRET)
+                    .prefixed(PREFIX_ED25519_SECRET_SEALED),
+            ],
+        ),
+        document(
+            "Page",
+            Some(PREFIX_DOCUMENT_PAGE),
+            vec![
+                FieldSchema::new("content_chksum", Multihash),
+                FieldSchema::new("number", Varuint),
+                FieldSchema::new("total", Varuint),
+                FieldSchema::new("page_chksum", Multihash),
+                FieldSchema::new("data", LengthPrefixed),
+            ],
+        ),
+        document(
+            "AuditResponse",
+            None,
+            vec![
+                FieldSchema::new("doc_chksum", Multihash),
+                FieldSchema::new("shard_id", LengthPrefixed),
+                FieldSchema::new("audit_public_key", ed25519_pub()).prefixed(PREFIX_ED25519_PUB),
+                FieldSchema::new("binding_signature", ed25519_sig()).prefixed(PREFIX_ED25519_SIG),
+                FieldSchema::new("challenge_signature", ed25519_sig()).prefixed(PREFIX_ED25519_SIG),
+            ],
+        ),
+    ]
+}
+
+/// Top-level documents which are exchanged between users (and thus can be
+/// validated by third-party implementations).
+#[derive(Clone, Copy, Debug, Eq, PartialEq, Serialize)]
+pub enum DocumentKind {
+    MainDocument,
+    EncryptedKeyShard,
+    KeyShard,
+    AuditResponse,
+    Page,
+}
+
+impl DocumentKind {
+    /// Returns all document kinds.
+    pub fn all() -> &'static [Self] {
+        &[
+            Self::MainDocument,
+            Self::EncryptedKeyShard,
+            Self::KeyShard,
+            Self::AuditResponse,
+            Self::Page,
+        ]
+    }
+
+    /// Returns the name of the [`DocumentSchema`] describing this kind of
+    /// document.
+    pub fn name(self) -> &'static str {
+        match self {
+            Self::MainDocument => "MainDocument",
+            Self::EncryptedKeyShard => "EncryptedKeyShard",
+            Self::KeyShard => "KeyShard",
+            Self::AuditResponse => "AuditResponse",
+            Self::Page => "Page",
+        }
+    }
+
+    /// Check whether `input` is a valid wire encoding of this kind of document.
+    ///
+    /// This only checks the structure of the document -- no signatures are
+    /// verified and nothing is decrypted.
+    pub fn validate<B: AsRef<[u8]>>(self, input: B) -> Result<(), WireError> {
+        let input = input.as_ref();
+        match self {
+            Self::MainDocument => MainDocument::from_wire(input).map(|_| ()),
+            Self::EncryptedKeyShard => EncryptedKeyShard::from_wire(input).map(|_| ()),
+            Self::KeyShard => KeyShard::from_wire(input).map(|_| ()),
+            Self::AuditResponse => AuditResponse::from_wire(input).map(|_| ()),
+            Self::Page => Page::from_wire(input).map(|_| ()),
+        }
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    use crate::v0::{Backup, ToWire};
+
+    #[test]
+    fn schema_references() {
+        let schemas = schemas();
+        let names = schemas.iter().map(|s| s.name()).collect::<Vec<_>>();
+
+        for kind in DocumentKind::all() {
+            assert!(names.contains(&kind.name()), "missing schema {:?}", kind);
+        }
+        for field in schemas.iter().flat_map(|s| s.fields()) {
+            if let FieldEncoding::Document { name } = field.encoding() {
+                assert!(names.contains(name), "dangling reference to {}", name);
+            }
+            // Optional fields must be distinguishable.
+            if field.is_optional() {
+                assert!(
+                    !field.prefixes().is_empty()
+                        || matches!(field.encoding(), FieldEncoding::Document { .. }),
+                    "optional field {} has no prefix",
+                    field.name()
+                );
+            }
+        }
+    }
+
+    #[test]
+    fn validate_documents() {
+        let backup = Backup::new(2, b"secret data").unwrap();
+        let main_document = backup.main_document().to_wire();
+        let shard = backup.next_shard().unwrap();
+        let (encrypted_shard, _) = shard.encrypt().unwrap();
+
+        DocumentKind::MainDocument.validate(&main_document).unwrap();
+        DocumentKind::KeyShard.validate(shard.to_wire()).unwrap();
+        DocumentKind::EncryptedKeyShard
+            .validate(encrypted_shard.to_wire())
+            .unwrap();
+
+        let err = DocumentKind::MainDocument
+            .validate(&main_document[..main_document.len() - 1])
+            .unwrap_err();
+        assert_eq!(err.document(), "MainDocument");
+    }
+}
@@ -0,0 +1,218 @@
+/*
+ * paperback: paper backup generator suitable for long-term storage
+ * Copyright (C) 2018-2020 Aleksa Sarai <cyphar@cyphar.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+use std::{fmt, str::FromStr};
+
+/// Version of this library.
+pub const LIBRARY_VERSION: &str = env!("CARGO_PKG_VERSION");
+
+/// A `major.minor.patch` version number.
+#[derive(Clone, Copy, Debug, Eq, PartialEq, Ord, PartialOrd, Hash)]
+pub struct Version {
+    major: u32,
+    minor: u32,
+    patch: u32,
+}
+
+impl Version {
+    pub const fn new(major: u32, minor: u32, patch: u32) -> Self {
+        Self {
+            major,
+            minor,
+            patch,
+        }
+    }
+
+    /// Returns the version of this library.
+    pub fn current() -> Self {
+        LIBRARY_VERSION
+            .parse()
+            .expect("library version must be a valid version")
+    }
+
+    pub fn major(&self) -> u32 {
+        self.major
+    }
+
+    pub fn minor(&self) -> u32 {
+        self.minor
+    }
+
+    pub fn patch(&self) -> u32 {
+        self.patch
+    }
+}
+
+impl fmt::Display for Version {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}.{}.{}", self.major, self.minor, self.patch)
+    }
+}
+
+#[derive(Debug, thiserror::Error)]
+#[error("invalid version '{}': {}", .input, .reason)]
+pub struct ParseVersionError {
+    input: String,
+    reason: &'static str,
+}
+
+impl FromStr for Version {
+    type Err = ParseVersionError;
+
+    /// Parse a version of the form `[v]major.minor.patch`. Any pre-release or
+    /// build metadata suffix (such as `-rc1` or `+abc`) is ignored.
+    fn from_str(input: &str) -> Result<Self, Self::Err> {
+        let err = |reason| ParseVersionError {
+            input: input.into(),
+            reason,
+        };
+
+        let version = input.strip_prefix('v').unwrap_or(input);
+        let version = version
+            .split(|c| c == '-' || c == '+')
+            .next()
+            .unwrap_or(version);
+        let parts = version
+            .split('.')
+            .map(|part| part.parse::<u32>())
+            .collect::<Result<Vec<_>, _>>()
+            .map_err(|_| err("components must be non-negative integers"))?;
+        match parts[..] {
+            [major, minor, patch] => Ok(Self::new(major, minor, patch)),
+            _ => Err(err("must have exactly three components")),
+        }
+    }
+}
+
+/// Compatibility matrix between wire format schema versions and the first
+/// library version which can read documents using them.
+const SCHEMA_VERSIONS: &[(u32, Version)] = &[(0, Version::new(0, 0, 0))];
+
+/// Returns the compatibility matrix between wire format schema versions and
+/// the first library version which can read documents using them, in order of
+/// schema version.
+pub fn compatibility_matrix() -> &'static [(u32, Version)] {
+    SCHEMA_VERSIONS
+}
+
+/// Returns the newest wire format schema version supported by this library.
+pub fn latest_schema_version() -> u32 {
+    SCHEMA_VERSIONS
+        .iter()
+        .map(|(schema, _)| *schema)
+        .max()
+        .expect("at least one schema version must be supported")
+}
+
+/// Reason why a document cannot be handled by this library.
+#[derive(Clone, Debug, Eq, PartialEq, thiserror::Error)]
+pub enum Incompatibility {
+    #[error(
+        "document uses schema version {} which requires paperback {} or later (this is paperback {}); upgrade to recover",
+        .schema_version,
+        .required,
+        .current
+    )]
+    RequiresUpgrade {
+        schema_version: u32,
+        required: Version,
+        current: Version,
+    },
+
+    #[error(
+        "document uses schema version {} which was created by a newer version of paperback (this is paperback {}, which supports up to schema version {}); upgrade to recover",
+        .schema_version,
+        .current,
+        .latest
+    )]
+    UnknownSchema {
+        schema_version: u32,
+        latest: u32,
+        current: Version,
+    },
+}
+
+/// Check whether a document using the wire format schema version
+/// `schema_version` can be handled by this library, returning the reason if it
+/// cannot.
+pub fn compatible_with(schema_version: u32) -> Result<(), Incompatibility> {
+    compatible_with_library(Version::current(), schema_version)
+}
+
+fn compatible_with_library(current: Version, schema_version: u32) -> Result<(), Incompatibility> {
+    match SCHEMA_VERSIONS
+        .iter()
+        .find(|(schema, _)| *schema == schema_version)
+    {
+        Some((_, required)) if *required <= current => Ok(()),
+        Some((_, required)) => Err(Incompatibility::RequiresUpgrade {
+            schema_version,
+            required: *required,
+            current,
+        }),
+        None => Err(Incompatibility::UnknownSchema {
+            schema_version,
+            latest: latest_schema_version(),
+            current,
+        }),
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn parse_version() {
+        assert_eq!("1.2.3".parse::<Version>().unwrap(), Version::new(1, 2, 3));
+        assert_eq!("v3.0.1".parse::<Version>().unwrap(), Version::new(3, 0, 1));
+        assert_eq!(
+            "0.1.0-rc1+abc".parse::<Version>().unwrap(),
+            Version::new(0, 1, 0)
+        );
+        "1.2".parse::<Version>().unwrap_err();
+        "1.2.3.4".parse::<Version>().unwrap_err();
+        "1.-2.3".parse::<Version>().unwrap_err();
+        "".parse::<Version>().unwrap_err();
+    }
+
+    #[quickcheck]
+    fn version_display_roundtrip(major: u32, minor: u32, patch: u32) {
+        let version = Version::new(major, minor, patch);
+        assert_eq!(version.to_string().parse::<Version>().unwrap(), version);
+    }
+
+    #[test]
+    fn current_version() {
+        assert_eq!(Version::current().to_string(), LIBRARY_VERSION);
+    }
+
+    #[test]
+    fn schema_compatibility() {
+        for (schema_version, _) in compatibility_matrix() {
+            compatible_with(*schema_version).unwrap();
+        }
+
+        match compatible_with(latest_schema_version() + 1) {
+            Err(Incompatibility::UnknownSchema { latest, .. }) => {
+                assert_eq!(latest, latest_schema_version())
+            }
+            other => panic!("unexpected compatibility result {:?}", other),
+        }
+    }
+}
@@ -16,48 +16,865 @@
  * along with this program.  If not, see <https://www.gnu.org/licenses/>.
  */
 
+extern crate age;
 #[macro_use]
 extern crate anyhow;
 extern crate clap;
+extern crate rand;
+extern crate serde_cbor;
+extern crate serde_json;
 extern crate zbase32;
 
 use std::{
+    env,
     error::Error as StdError,
-    fs::File,
+    fmt,
+    fs::{self, File},
     io,
     io::{prelude::*, BufReader},
+    num::ParseIntError,
+    path::{Path, PathBuf},
+    process::{self, Command, Stdio},
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        OnceLock,
+    },
+    thread,
+    time::{Duration, Instant, SystemTime, UNIX_EPOCH},
 };
 
 use anyhow::{Context, Error};
-use clap::{App, Arg, ArgMatches, SubCommand};
+use clap::{App, AppSettings, Arg, ArgMatches, Shell, SubCommand};
 
 extern crate paperback_core;
 use paperback_core::latest as paperback;
 
+/// Set when --json is given, in which case stdout only contains the JSON
+/// result of the command (or the error) and interactive prompts are written to
+/// stderr instead.
+static JSON_OUTPUT: AtomicBool = AtomicBool::new(false);
+
+fn json_output() -> bool {
+    JSON_OUTPUT.load(Ordering::Relaxed)
+}
+
+/// Like print!, but writes to stderr in --json mode.
+macro_rules! prompt {
+    ($($arg:tt)*) => {
+        if json_output() {
+            eprint!($($arg)*);
+            io::stderr().flush()?;
+        } else {
+            print!($($arg)*);
+            io::stdout().flush()?;
+        }
+    };
+}
+
+/// Like println!, but writes to stderr in --json mode.
+macro_rules! promptln {
+    ($($arg:tt)*) => {
+        if json_output() {
+            eprintln!($($arg)*);
+        } else {
+            println!($($arg)*);
+        }
+    };
+}
+
+/// Causes of failure which are reported with their own exit code, so that
+/// scripts can tell them apart. The exit codes are part of the interface of the
+/// command and must not change (see also [`EXIT_CODES_HELP`]).
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+enum Failure {
+    /// Any other error, or a check (such as "raw verify") which failed.
+    Other = 1,
+    /// Invalid command-line arguments.
+    Usage = 2,
+    /// A file could not be read or written.
+    Io = 3,
+    /// A document is damaged, forged or not a paperback document.
+    CorruptDocument = 4,
+    /// The codewords of a key shard are wrong.
+    WrongCodewords = 5,
+    /// The documents given do not form a complete and consistent quorum.
+    Quorum = 6,
+}
+
+/// Description of the exit codes, shown in --help.
+const EXIT_CODES_HELP: &str = "EXIT CODES:
+    0    Success.
+    1    Any other error, or some of the checks failed (raw verify, selftest) or some of the backups could not be created (raw batch-backup).
+    2    Invalid command-line arguments.
+    3    A file could not be read or written.
+    4    A document is damaged, forged or not a paperback document.
+    5    The codewords of a key shard are wrong.
+    6    The documents given do not form a complete and consistent quorum.
+
+With --json, errors are printed to stdout as {\"error\": {\"kind\": ..., \"exit_code\": ..., \"message\": ..., \"causes\": [...]}}, where kind is one of \"other\", \"usage\", \"io\", \"corrupt-document\", \"wrong-codewords\" or \"quorum\".";
+
+impl Failure {
+    fn exit_code(self) -> i32 {
+        self as i32
+    }
+
+    fn name(self) -> &'static str {
+        match self {
+            Self::Other => "other",
+            Self::Usage => "usage",
+            Self::Io => "io",
+            Self::CorruptDocument => "corrupt-document",
+            Self::WrongCodewords => "wrong-codewords",
+            Self::Quorum => "quorum",
+        }
+    }
+
+    /// Works out the cause of `err`, from the first error in its chain of
+    /// causes which is known.
+    fn of(err: &Error) -> Self {
+        err.chain()
+            .find_map(|cause| {
+                if let Some(Failed(failure, _)) = cause.downcast_ref::<Failed>() {
+                    Some(*failure)
+                } else if let Some(err) = cause.downcast_ref::<paperback::Error>() {
+                    use paperback::Error::*;
+                    match err {
+                        WrongCodewords(_) | Bip39(_) => Some(Self::WrongCodewords),
+                        CorruptedShard(_)
+                        | AeadDecryption(_)
+                        | ShardSecretDecode(_)
+                        | WireDecode(_)
+                        | Decompression(_)
+                        | PageAssembly(_)
+                        | TextDecode(_)
+                        | SignatureVerification(_) => Some(Self::CorruptDocument),
+                        Shamir(_) => Some(Self::Quorum),
+                        _ => Some(Self::Other),
+                    }
+                } else if cause.is::<paperback::WireError>() {
+                    Some(Self::CorruptDocument)
+                } else if cause.is::<io::Error>() {
+                    Some(Self::Io)
+                } else if cause.is::<ParseIntError>() {
+                    // Only ever used for parsing arguments.
+                    Some(Self::Usage)
+                } else {
+                    None
+                }
+            })
+            .unwrap_or(Self::Other)
+    }
+}
+
+/// An error with a known cause, created with [`failure!`].
+#[derive(Debug)]
+struct Failed(Failure, String);
+
+impl fmt::Display for Failed {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(&self.1)
+    }
+}
+
+impl StdError for Failed {}
+
+/// Like anyhow!, but the error is reported as being caused by `$failure`.
+macro_rules! failure {
+    ($failure:expr, $($arg:tt)*) => {
+        Error::new(Failed($failure, format!($($arg)*)))
+    };
+}
+
+/// Keys which can be set in the config file. Each one is the default for the
+/// flag of the same name.
+const CONFIG_KEYS: &[&str] = &["paper_size", "symbology", "output_dir", "language"];
+
+/// Defaults loaded from the config file by [`load_config`].
+static CONFIG: OnceLock<serde_json::Map<String, serde_json::Value>> = OnceLock::new();
+
+/// Returns the path of the default config file, which follows the XDG base
+/// directory specification (`$XDG_CONFIG_HOME/paperback/config.json`).
+fn default_config_path() -> Option<PathBuf> {
+    env::var_os("XDG_CONFIG_HOME")
+        .map(PathBuf::from)
+        // Relative paths are invalid and must be ignored.
+        .filter(|path| path.is_absolute())
+        .or_else(|| env::var_os("HOME").map(|home| Path::new(&home).join(".config")))
+        .map(|config_dir| config_dir.join("paperback").join("config.json"))
+}
+
+/// Loads the config file given with --config (or the default config file, if
+/// there is one), checking that every setting in it is valid.
+///
+/// The config file is a JSON object with any of the keys in [`CONFIG_KEYS`],
+/// such as {"paper_size": "letter", "language": "french"}.
+fn load_config(
+    matches: &ArgMatches<'_>,
+) -> Result<serde_json::Map<String, serde_json::Value>, Error> {
+    use serde_json::Value;
+
+    if global_present(matches, "no_config") {
+        return Ok(Default::default());
+    }
+    let path = match global_value(matches, "config") {
+        Some(path) => PathBuf::from(path),
+        None => match default_config_path() {
+            Some(path) if path.exists() => path,
+            _ => return Ok(Default::default()),
+        },
+    };
+    let config: Value = serde_json::from_str(
+        &fs::read_to_string(&path)
+            .with_context(|| format!("failed to read config file '{}'", path.display()))?,
+    )
+    .with_context(|| format!("failed to parse config file '{}'", path.display()))?;
+    let config = match config {
+        Value::Object(config) => config,
+        _ => {
+            return Err(anyhow!(
+                "config file '{}' must contain a JSON object",
+                path.display()
+            ))
+        }
+    };
+
+    // Check every setting up-front, so that mistakes are reported even if the
+    // setting is not used by this command.
+    for (key, value) in &config {
+        if !CONFIG_KEYS.contains(&key.as_str()) {
+            return Err(anyhow!(
+                "unknown key '{}' in config file '{}'",
+                key,
+                path.display()
+            ));
+        }
+        let value = value.as_str().ok_or_else(|| {
+            anyhow!(
+                "'{}' in config file '{}' must be a string",
+                key,
+                path.display()
+            )
+        })?;
+        match key.as_str() {
+            "paper_size" => parse_paper_size(value).map(drop),
+            "symbology" => parse_symbology(value).map(drop),
+            "language" => parse_language(value).map(drop),
+            _ => Ok(()),
+        }
+        .with_context(|| format!("invalid config file '{}'", path.display()))?;
+    }
+    Ok(config)
+}
+
+/// Returns the default for the flag `name` from the config file, if it is set.
+fn config_value(name: &str) -> Option<&'static str> {
+    CONFIG
+        .get()
+        .and_then(|config| config.get(name))
+        .and_then(|value| value.as_str())
+}
+
+/// Returns the value of the flag `name`, or its default from the config file
+/// if the flag was not given.
+fn setting<'a>(matches: &'a ArgMatches<'_>, name: &str) -> Option<&'a str> {
+    matches.value_of(name).or_else(|| config_value(name))
+}
+
+/// Returns whether the global flag `name` was given at any level of the
+/// command line.
+fn global_present(matches: &ArgMatches<'_>, name: &str) -> bool {
+    matches.is_present(name)
+        || matches
+            .subcommand()
+            .1
+            .map_or(false, |sub_matches| global_present(sub_matches, name))
+}
+
+/// Returns the value of the global flag `name`, at whichever level of the
+/// command line it was given.
+fn global_value<'a>(matches: &'a ArgMatches<'_>, name: &str) -> Option<&'a str> {
+    matches.value_of(name).or_else(|| {
+        matches
+            .subcommand()
+            .1
+            .and_then(|sub_matches| global_value(sub_matches, name))
+    })
+}
+
+/// Progress of a slow operation, drawn on stderr so that it doesn't look like
+/// the program has hung. Nothing is drawn unless stderr is a terminal.
+struct Progress {
+    label: &'static str,
+    total: Option<usize>,
+    done: usize,
+    start: Instant,
+    visible: bool,
+}
+
+impl Progress {
+    const BAR_WIDTH: usize = 30;
+
+    /// Start a progress bar for `total` items.
+    fn new(label: &'static str, total: usize) -> Self {
+        Self::start(label, Some(total))
+    }
+
+    /// Start an operation which can't report how far along it is, which is
+    /// shown as a single step.
+    fn step(label: &'static str) -> Self {
+        Self::start(label, None)
+    }
+
+    fn start(label: &'static str, total: Option<usize>) -> Self {
+        use std::io::IsTerminal;
+
+        let progress = Self {
+            label,
+            total,
+            done: 0,
+            start: Instant::now(),
+            visible: io::stderr().is_terminal(),
+        };
+        progress.draw();
+        progress
+    }
+
+    fn draw(&self) {
+        if !self.visible {
+            return;
+        }
+        match self.total {
+            Some(total) => {
+                let filled = Self::BAR_WIDTH * self.done / total.max(1);
+                eprint!(
+                    "\r\x1b[2K{} [{}{}] {}/{}",
+                    self.label,
+                    "#".repeat(filled),
+                    " ".repeat(Self::BAR_WIDTH - filled),
+                    self.done,
+                    total
+                );
+            }
+            None => eprint!("\r\x1b[2K{}...", self.label),
+        }
+        let _ = io::stderr().flush();
+    }
+
+    /// Mark another item as done.
+    fn inc(&mut self) {
+        self.done += 1;
+        self.draw();
+    }
+
+    /// Finish the operation, leaving how long it took on the terminal.
+    fn finish(mut self) {
+        if let Some(total) = self.total {
+            self.done = total;
+        }
+        self.draw();
+        if self.visible {
+            eprintln!(" done ({:.1}s)", self.start.elapsed().as_secs_f64());
+        }
+    }
+}
+
+/// Runs `f` as a single step of progress (see [`Progress::step`]).
+fn with_progress<T, F: FnOnce() -> T>(label: &'static str, f: F) -> T {
+    let progress = Progress::step(label);
+    let result = f();
+    progress.finish();
+    result
+}
+
+fn print_json(value: &serde_json::Value) -> Result<(), Error> {
+    println!("{}", serde_json::to_string_pretty(value)?);
+    Ok(())
+}
+
+fn main_document_json(main_document: &paperback::MainDocument) -> serde_json::Value {
+    use paperback::ToWire;
+
+    serde_json::json!({
+        "document_id": main_document.id(),
+        "checksum": main_document.checksum_string(),
+        "quorum_size": main_document.quorum_size(),
+        "data": main_document.to_wire_zbase32(),
+    })
+}
+
+fn shard_json(
+    shard: &paperback::EncryptedKeyShard,
+    codewords: &paperback::KeyShardCodewords,
+) -> serde_json::Value {
+    use paperback::ToWire;
+
+    let decrypted_shard = shard.clone().decrypt(codewords).unwrap();
+    serde_json::json!({
+        "document_id": decrypted_shard.document_id(),
+        "shard_id": decrypted_shard.id(),
+        "label": decrypted_shard.label(),
+        "holder": decrypted_shard.holder(),
+        "contact": decrypted_shard.contact(),
+        "note": decrypted_shard.note(),
+        "language": shard.language().name(),
+        "keywords": codewords,
+        "data": shard.to_wire_zbase32(),
+    })
+}
+
+/// Description of the OUTPUT argument of each recovery command.
+const SECRET_OUTPUT_HELP: &str = r#"Path to write the recovered secret data to ("-" to write to stdout). This is always treated as a path, use --output-target to write the secret data somewhere other than a file."#;
+
+/// Description of the targets recovered secret data can be written to with
+/// --output-target, shown in the --help of each recovery command.
+const SECRET_OUTPUT_TARGET_HELP: &str = r#"Write the recovered secret data to a target other than a file (instead of OUTPUT): "fd:N" for an inherited file descriptor, "systemd[:NAME]" for a file descriptor passed by systemd (with LISTEN_FDS), "vault-kv:PATH[#FIELD]" to store it in HashiCorp Vault's KV store (in FIELD, "value" by default), "vault-unseal" to submit it as a Vault unseal key, or "exec:COMMAND" to pipe it into a shell command (such as a cloud KMS import tool). The Vault targets use the vault CLI and its usual environment (VAULT_ADDR, VAULT_TOKEN). Unlike OUTPUT, the targets do not leave the secret data in a file on disk."#;
+
+/// Where the recovered secret data is written to.
+enum SecretOutput<'a> {
+    /// The OUTPUT path ("-" for stdout).
+    Path(&'a str),
+    /// An inherited file descriptor ("fd:N").
+    Fd(i32),
+    /// A file descriptor passed by systemd ("systemd[:NAME]").
+    Systemd(Option<&'a str>),
+    /// A field in HashiCorp Vault's KV store ("vault-kv:PATH[#FIELD]").
+    VaultKv { path: &'a str, field: &'a str },
+    /// A Vault unseal key ("vault-unseal").
+    VaultUnseal,
+    /// The stdin of a shell command ("exec:COMMAND").
+    Exec(&'a str),
+}
+
+/// Returns where a recovery command should write the recovered secret data:
+/// the --output-target if one was given, or the OUTPUT path otherwise. The
+/// target is parsed before anything is recovered, so that a mistyped target is
+/// reported straight away.
+fn secret_output<'a>(matches: &'a ArgMatches<'_>) -> Result<SecretOutput<'a>, Error> {
+    let target = match matches.value_of("output_target") {
+        Some(target) => target,
+        None => {
+            return Ok(SecretOutput::Path(
+                matches
+                    .value_of("OUTPUT")
+                    .expect("required OUTPUT argument not given"),
+            ))
+        }
+    };
+    let (kind, value) = match target.split_once(':') {
+        Some((kind, value)) => (kind, Some(value)),
+        None => (target, None),
+    };
+    match (kind, value) {
+        ("fd", Some(fd)) => fd
+            .parse()
+            .map(SecretOutput::Fd)
+            .map_err(|_| failure!(Failure::Usage, "invalid file descriptor '{}'", fd)),
+        ("systemd", name) => Ok(SecretOutput::Systemd(name)),
+        ("vault-kv", Some(path)) => Ok(match path.split_once('#') {
+            Some((path, field)) => SecretOutput::VaultKv { path, field },
+            None => SecretOutput::VaultKv {
+                path,
+                field: "value",
+            },
+        }),
+        ("vault-unseal", None) => Ok(SecretOutput::VaultUnseal),
+        ("exec", Some(command)) => Ok(SecretOutput::Exec(command)),
+        _ => Err(failure!(
+            Failure::Usage,
+            "unknown --output-target '{}'",
+            target
+        )),
+    }
+}
+
+/// Returns the file descriptor named `name` (or the first one, if no name is
+/// given) which was passed by systemd using the socket activation protocol.
+fn systemd_fd(name: Option<&str>) -> Result<i32, Error> {
+    // The first file descriptor passed by systemd (SD_LISTEN_FDS_START).
+    const LISTEN_FDS_START: i32 = 3;
+
+    let for_us = env::var("LISTEN_PID")
+        .ok()
+        .and_then(|pid| pid.parse::<u32>().ok())
+        == Some(process::id());
+    let count = env::var("LISTEN_FDS")
+        .ok()
+        .and_then(|count| count.parse::<i32>().ok())
+        .filter(|_| for_us)
+        .unwrap_or(0);
+    if count == 0 {
+        return Err(anyhow!("no file descriptors were passed by systemd"));
+    }
+    let idx = match name {
+        None => 0,
+        Some(name) => env::var("LISTEN_FDNAMES")
+            .unwrap_or_default()
+            .split(':')
+            .take(count as usize)
+            .position(|fd_name| fd_name == name)
+            .ok_or_else(|| anyhow!("systemd did not pass a file descriptor named '{}'", name))?
+            as i32,
+    };
+    Ok(LISTEN_FDS_START + idx)
+}
+
+/// Writes `secret` to the inherited file descriptor `fd`.
+#[cfg(unix)]
+fn write_secret_fd(fd: i32, secret: &[u8]) -> Result<(), Error> {
+    use std::{mem::ManuallyDrop, os::unix::io::FromRawFd};
+
+    // SAFETY: The file descriptor was handed to us by our parent, and is not
+    // used anywhere else in this program. It is not closed afterwards, since
+    // we do not own it.
+    let mut file = ManuallyDrop::new(unsafe { File::from_raw_fd(fd) });
+    file.write_all(secret)
+        .with_context(|| format!("write secret data to file descriptor {}", fd))?;
+    file.flush()?;
+    Ok(())
+}
+
+#[cfg(not(unix))]
+fn write_secret_fd(fd: i32, _: &[u8]) -> Result<(), Error> {
+    Err(failure!(
+        Failure::Usage,
+        "writing to file descriptor {} is only supported on Unix",
+        fd
+    ))
+}
+
+/// Pipes `secret` into `command`. Its output is shown as a prompt, so that
+/// stdout only contains the JSON result in --json mode.
+fn write_secret_command(mut command: Command, secret: &[u8]) -> Result<(), Error> {
+    let description = format!("{:?}", command);
+    let mut child = command
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .spawn()
+        .with_context(|| format!("failed to run {}", description))?;
+
+    // Write the data from a separate thread to avoid deadlocking if the
+    // command starts writing output before it has read all of its input.
+    let mut stdin = child.stdin.take().expect("child stdin must be piped");
+    let data = secret.to_vec();
+    let writer = thread::spawn(move || stdin.write_all(&data));
+
+    let output = child
+        .wait_with_output()
+        .with_context(|| format!("wait for {}", description))?;
+    writer
+        .join()
+        .expect("secret output writer thread panicked")
+        .with_context(|| format!("write secret data to {}", description))?;
+    prompt!("{}", String::from_utf8_lossy(&output.stdout));
+
+    if !output.status.success() {
+        return Err(anyhow!("{} failed: {}", description, output.status));
+    }
+    Ok(())
+}
+
+/// Writes the recovered `secret` to `output`. Secret data cannot be written to
+/// stdout in --json mode (since stdout only contains the JSON result).
+fn write_secret_output(output: &SecretOutput<'_>, secret: &[u8]) -> Result<(), Error> {
+    match *output {
+        SecretOutput::Path("-") => {
+            if json_output() {
+                return Err(failure!(
+                    Failure::Usage,
+                    "secret data cannot be written to stdout in --json mode"
+                ));
+            }
+            let mut stdout = io::stdout();
+            stdout
+                .write_all(secret)
+                .context("write secret data to stdout")?;
+            stdout.flush()?;
+            Ok(())
+        }
+        SecretOutput::Path(path) => {
+            File::create(path)
+                .with_context(|| format!("failed to open output file '{}' for writing", path))?
+                .write_all(secret)
+                .context("write secret data to file")?;
+            Ok(())
+        }
+        SecretOutput::Fd(fd) => write_secret_fd(fd, secret),
+        SecretOutput::Systemd(name) => write_secret_fd(systemd_fd(name)?, secret),
+        SecretOutput::VaultKv { path, field } => {
+            let mut command = Command::new("vault");
+            // "FIELD=-" makes vault read the value from stdin.
+            command
+                .args(&["kv", "put", path])
+                .arg(format!("{}=-", field));
+            write_secret_command(command, secret)
+        }
+        SecretOutput::VaultUnseal => {
+            let mut command = Command::new("vault");
+            command.args(&["operator", "unseal", "-"]);
+            write_secret_command(command, secret)
+        }
+        SecretOutput::Exec(shell_command) => {
+            let mut command = Command::new("sh");
+            command.arg("-c").arg(shell_command);
+            write_secret_command(command, secret)
+        }
+    }
+}
+
+/// Remove the codeword checksum (printed as "#xxxx" after the codewords on the
+/// detachable codeword section of key shards) from `words`, if it was entered.
+fn take_codewords_checksum(words: &mut Vec<String>) -> Option<String> {
+    let pos = words.iter().position(|word| word.starts_with('#'))?;
+    Some(words.remove(pos).trim_start_matches('#').to_string())
+}
+
+/// Check `codewords` against the codeword checksum entered with them. The
+/// checksum is optional, as codewords may be copied without it.
+fn codewords_checksum_matches(codewords: &[String], checksum: Option<&str>) -> bool {
+    match checksum {
+        Some(checksum) if checksum != paperback::codewords_checksum(codewords) => {
+            promptln!(
+                "The codewords do not match the codeword checksum (#{}), please enter them again.",
+                checksum
+            );
+            false
+        }
+        _ => true,
+    }
+}
+
+/// Maximum number of completions listed for a partially-typed codeword.
+const MAX_COMPLETIONS: usize = 16;
+
+/// Prompts for the codewords of shard `idx`.
+///
+/// Each codeword is checked against the wordlist as soon as it is entered (and
+/// may be abbreviated to a unique prefix), so that a mistyped word is reported
+/// straight away and only the words from that point onwards need to be entered
+/// again. A word ending in "?" lists the codewords it could be completed to.
+fn prompt_codewords(
+    idx: usize,
+    language: paperback::CodewordLanguage,
+) -> Result<Vec<String>, Error> {
+    use paperback_core::mnemonic::{self, Error as MnemonicError};
+
+    let wordlist = language.words();
+    let language_hint = match language {
+        paperback::CodewordLanguage::English => String::new(),
+        language => format!(" ({})", language.name()),
+    };
+
+    let mut codewords: Vec<String> = vec![];
+    let mut checksum = None;
+    loop {
+        if codewords.is_empty() {
+            prompt!("Shard {} Codeword{}: ", idx, language_hint);
+        } else {
+            prompt!(
+                "Shard {} Codeword{} (from word {}): ",
+                idx,
+                language_hint,
+                codewords.len() + 1
+            );
+        }
+        let mut codeword_input = String::new();
+        if io::stdin().read_line(&mut codeword_input)? == 0 {
+            return Err(anyhow!("unexpected end of input"));
+        }
+
+        let mut words = mnemonic::normalize_phrase(&codeword_input);
+        if let Some(entered) = take_codewords_checksum(&mut words) {
+            checksum = Some(entered);
+        }
+        let query = match words.iter().position(|word| word.ends_with('?')) {
+            Some(pos) => words.drain(pos..).next(),
+            None => None,
+        };
+
+        let index = match mnemonic::expand_words_in(wordlist, &words) {
+            Ok(expanded) => {
+                codewords.extend(expanded.into_iter().map(String::from));
+                match query {
+                    Some(query) => {
+                        let prefix = query.trim_end_matches('?');
+                        let completions = mnemonic::complete_in(wordlist, prefix);
+                        if completions.is_empty() {
+                            promptln!("No codewords start with {:?}.", prefix);
+                        } else {
+                            let more = completions.len().saturating_sub(MAX_COMPLETIONS);
+                            promptln!(
+                                "Codewords starting with {:?}: {}{}",
+                                prefix,
+                                completions[..completions.len() - more].join(" "),
+                                if more > 0 {
+                                    format!(" (and {} more)", more)
+                                } else {
+                                    String::new()
+                                }
+                            );
+                        }
+                        continue;
+                    }
+                    None if codewords.is_empty() => continue,
+                    None if !codewords_checksum_matches(&codewords, checksum.as_deref()) => {
+                        codewords.clear();
+                        checksum = None;
+                        continue;
+                    }
+                    None => return Ok(codewords),
+                }
+            }
+            Err(MnemonicError::UnknownWord { index, word }) => {
+                let suggestions = mnemonic::suggest_words_in(wordlist, &word);
+                if suggestions.is_empty() {
+                    promptln!(
+                        "Word {} ({:?}) is not a valid codeword.",
+                        codewords.len() + index + 1,
+                        word
+                    );
+                } else {
+                    promptln!(
+                        "Word {} ({:?}) is not a valid codeword. Did you mean: {}?",
+                        codewords.len() + index + 1,
+                        word,
+                        suggestions.join(", ")
+                    );
+                }
+                index
+            }
+            Err(MnemonicError::AmbiguousWord { index, word }) => {
+                promptln!(
+                    "Word {} ({:?}) could be several codewords (type \"{}?\" to list them).",
+                    codewords.len() + index + 1,
+                    word,
+                    word
+                );
+                index
+            }
+            Err(err) => return Err(err.into()),
+        };
+
+        // Keep the valid words before the mistyped one.
+        let valid = mnemonic::expand_words_in(wordlist, &words[..index])?;
+        codewords.extend(valid.into_iter().map(String::from));
+    }
+}
+
+/// Obtains trusted timestamps by running a user-provided shell command, which
+/// is given the data to timestamp on stdin and must print the timestamp token
+/// to stdout.
+struct CommandTimestamper<'a>(&'a str);
+
+impl CommandTimestamper<'_> {
+    fn run(&self, data: &[u8]) -> Result<Vec<u8>, Error> {
+        let mut child = Command::new("sh")
+            .arg("-c")
+            .arg(self.0)
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .spawn()
+            .with_context(|| format!("failed to run timestamp command '{}'", self.0))?;
+
+        // Write the data from a separate thread to avoid deadlocking if the
+        // command starts writing output before it has read all of its input.
+        let mut stdin = child.stdin.take().expect("child stdin must be piped");
+        let data = data.to_vec();
+        let writer = thread::spawn(move || stdin.write_all(&data));
+
+        let output = child
+            .wait_with_output()
+            .context("wait for timestamp command")?;
+        writer
+            .join()
+            .expect("timestamp command writer thread panicked")
+            .context("write data to timestamp command")?;
+
+        if !output.status.success() {
+            return Err(anyhow!("timestamp command failed: {}", output.status));
+        }
+        Ok(output.stdout)
+    }
+}
+
+impl paperback::Timestamper for CommandTimestamper<'_> {
+    fn timestamp(&self, data: &[u8]) -> Result<Vec<u8>, paperback::Error> {
+        self.run(data)
+            .map_err(|err| paperback::Error::Other(format!("{:#}", err)))
+    }
+}
+
 fn raw_backup(matches: &ArgMatches<'_>) -> Result<(), Error> {
-    use paperback::{Backup, ToWire};
+    use paperback::{BackupBuilder, Compression, SheetEncoding, Symbology, ToWire};
 
     let sealed: bool = matches
         .value_of("sealed")
         .expect("invalid --sealed argument")
         .parse()
         .context("--sealed argument was not a boolean")?;
-    let quorum_size: u32 = matches
-        .value_of("quorum_size")
-        .expect("required --quorum_size argument not given")
-        .parse()
-        .context("--quorum-size argument was not an unsigned integer")?;
-    let num_shards: u32 = matches
-        .value_of("shards")
-        .expect("required --shards argument not given")
-        .parse()
-        .context("--shards argument was not an unsigned integer")?;
+    let (quorum_size, num_shards) = if matches.is_present("wizard") {
+        threshold_wizard()?
+    } else {
+        let quorum_size: u32 = matches
+            .value_of("quorum_size")
+            .expect("required --quorum_size argument not given")
+            .parse()
+            .context("--quorum-size argument was not an unsigned integer")?;
+        let num_shards: u32 = matches
+            .value_of("shards")
+            .expect("required --shards argument not given")
+            .parse()
+            .context("--shards argument was not an unsigned integer")?;
+        (quorum_size, num_shards)
+    };
     let input_path = matches
         .value_of("INPUT")
         .expect("required INPUT argument not given");
 
     if num_shards < quorum_size {
-        return Err(anyhow!("invalid arguments: number of shards cannot be smaller than quorum size (such a backup is unrecoverable)"));
+        return Err(failure!(Failure::Usage, "invalid arguments: number of shards cannot be smaller than quorum size (such a backup is unrecoverable)"));
+    }
+
+    // At most one of the printable outputs can be written to stdout, in which
+    // case nothing else is printed to stdout.
+    let stdout_outputs = ["pdf", "html", "latex"]
+        .iter()
+        .filter(|name| matches.value_of(name) == Some("-"))
+        .count();
+    if stdout_outputs > 1 {
+        return Err(failure!(
+            Failure::Usage,
+            "invalid arguments: only one of --pdf, --html and --latex can be written to stdout"
+        ));
+    }
+    let printable_to_stdout = stdout_outputs > 0;
+    if printable_to_stdout && json_output() {
+        return Err(failure!(
+            Failure::Usage,
+            "invalid arguments: printable output cannot be written to stdout in --json mode"
+        ));
+    }
+
+    // The main document is printed along with the key shards, written out as
+    // a digital file (to stdout or --output-dir), or both.
+    let output_mode = matches
+        .value_of("output_mode")
+        .expect("invalid --output-mode argument");
+    let main_on_paper = output_mode != "digital";
+    let main_on_disk = output_mode != "paper";
+    let printable = ["pdf", "html", "latex", "svg_dir"]
+        .iter()
+        .any(|name| matches.is_present(name));
+    if !main_on_disk && !printable {
+        return Err(failure!(
+            Failure::Usage,
+            "invalid arguments: --output-mode paper requires printable output (such as --pdf)"
+        ));
+    }
+    if !main_on_paper && printable_to_stdout && setting(matches, "output_dir").is_none() {
+        return Err(failure!(
+            Failure::Usage,
+            "invalid arguments: --output-mode digital requires --output-dir when printable output is written to stdout"
+        ));
     }
 
     let input: Box<dyn Read + 'static> = if input_path == "-" {
@@ -75,21 +892,223 @@ fn raw_backup(matches: &ArgMatches<'_>) -> Result<(), Error> {
         .read_to_end(&mut secret)
         .with_context(|| format!("failed to read secret data from '{}'", input_path))?;
 
-    let backup = if sealed {
-        Backup::new_sealed(quorum_size.into(), &secret)
-    } else {
-        Backup::new(quorum_size.into(), &secret)
-    }?;
+    let mut builder = BackupBuilder::new(quorum_size).sealed(sealed);
+    if matches.is_present("compress") {
+        builder = builder.compression(Compression::Deflate);
+    }
+    let language = codeword_language(matches)?;
+    check_pdf_language(matches, language.unwrap_or_default())?;
+    if let Some(language) = language {
+        builder = builder.language(language);
+    }
+    let escrow_recipients = matches
+        .values_of("escrow_recipient")
+        .into_iter()
+        .flatten()
+        .map(|recipient| {
+            recipient.parse::<age::x25519::Recipient>().map_err(|err| {
+                failure!(
+                    Failure::Usage,
+                    "invalid --escrow-recipient '{}': {}",
+                    recipient,
+                    err
+                )
+            })
+        })
+        .collect::<Result<Vec<_>, Error>>()?;
+    if !escrow_recipients.is_empty() {
+        builder = builder.escrow(escrow_recipients);
+    }
+    let mut backup = with_progress("Splitting secret", || builder.build(&secret))?;
+    // The escrow copy of the key is written straight away, as it is only ever
+    // stored digitally.
+    let escrow_path = matches.value_of("escrow_output");
+    if let Some(escrow_path) = escrow_path {
+        let escrow = backup
+            .escrow()
+            .expect("--escrow-output requires --escrow-recipient");
+        fs::write(escrow_path, escrow)
+            .with_context(|| format!("failed to write escrow key to '{}'", escrow_path))?;
+    }
+    if let Some(command) = matches.value_of("timestamp_command") {
+        backup
+            .timestamp(&CommandTimestamper(command))
+            .context("obtain trusted timestamp for main document")?;
+    }
     let main_document = backup.main_document().clone();
-    let shards = (0..num_shards)
-        .map(|_| backup.next_shard().unwrap())
+    let mut progress = Progress::new("Creating shards", num_shards as usize);
+    let shards = shard_options(matches, num_shards)?
+        .into_iter()
+        .map(|options| backup.next_shard_with(options).unwrap())
         .map(|s| s.encrypt().unwrap())
+        .inspect(|_| progress.inc())
+        .collect::<Vec<_>>();
+    progress.finish();
+
+    let names = output_names(matches.value_of("output_template"), &main_document, &shards)?;
+    let layout = page_layout(matches)?;
+    let encoding = match matches.value_of("text_fallback") {
+        Some("beneath") => SheetEncoding::QrAndText,
+        Some("instead") => SheetEncoding::Text,
+        _ => SheetEncoding::Qr,
+    };
+    let symbology = match setting(matches, "symbology") {
+        Some(name) => parse_symbology(name)?,
+        None => Symbology::default(),
+    };
+    // The sheets are only rendered once, for all of the printable outputs.
+    let mut sheets = if printable {
+        backup_sheets(&main_document, &shards, encoding, symbology)?
+    } else {
+        vec![]
+    };
+    // If the main document is only stored digitally, the key shards carry its
+    // checksum so that the right file can be found when recovering.
+    if !main_on_paper && printable {
+        sheets = sheets
+            .into_iter()
+            .skip(1)
+            .map(|sheet| sheet.document_checksum(main_document.checksum_string()))
+            .collect();
+    }
+    let instructions = if matches.is_present("recovery_instructions") && !sheets.is_empty() {
+        Some(paperback::Sheet::recovery_instructions(
+            &main_document,
+            num_shards,
+            language.unwrap_or_default(),
+        ))
+    } else {
+        None
+    };
+    // The recovery instructions are printed before the documents.
+    if let Some(instructions) = instructions.clone() {
+        sheets.insert(0, instructions);
+    }
+    if let Some(pdf_path) = matches.value_of("pdf") {
+        let created_at = pdf_created_at(matches)?;
+        let pdf = with_progress("Writing PDF", || {
+            paperback::sheets_to_pdf_dated(
+                &format!("paperback {}", main_document.id()),
+                &sheets,
+                &layout,
+                created_at,
+            )
+        })?;
+        write_output_file(pdf_path, pdf, "pdf")?;
+    }
+
+    if let Some(html_path) = matches.value_of("html") {
+        let html = paperback::sheets_to_html(
+            &format!("paperback {}", main_document.id()),
+            &sheets,
+            &layout,
+        );
+        write_output_file(html_path, html, "html")?;
+    }
+
+    if let Some(latex_path) = matches.value_of("latex") {
+        let latex = paperback::sheets_to_latex(
+            &format!("paperback {}", main_document.id()),
+            &sheets,
+            &layout,
+        );
+        write_output_file(latex_path, latex, "latex")?;
+    }
+
+    if let Some(svg_dir) = matches.value_of("svg_dir") {
+        let svg_dir = Path::new(svg_dir);
+        fs::create_dir_all(svg_dir)
+            .with_context(|| format!("failed to create svg directory '{}'", svg_dir.display()))?;
+        if let Some(instructions) = &instructions {
+            let path = svg_dir.join("recovery-instructions.svg");
+            fs::write(&path, paperback::sheet_to_svg(instructions, &layout))
+                .with_context(|| format!("failed to write svg to '{}'", path.display()))?;
+        }
+        let documents = &sheets[instructions.iter().count()..];
+        let names = &names[if main_on_paper { 0 } else { 1 }..];
+        for (sheet, name) in documents.iter().zip(names) {
+            let path = svg_dir.join(format!("{}.svg", name));
+            fs::write(&path, paperback::sheet_to_svg(sheet, &layout))
+                .with_context(|| format!("failed to write svg to '{}'", path.display()))?;
+        }
+    }
+
+    let paths = match setting(matches, "output_dir") {
+        Some(output_dir) => Some(write_backup_files(
+            output_dir,
+            &names,
+            Some(&main_document).filter(|_| main_on_disk),
+            &shards,
+        )?),
+        None => None,
+    };
+    let shard_ids = shards
+        .iter()
+        .map(|(shard, keyword)| shard.clone().decrypt(keyword).unwrap().id())
         .collect::<Vec<_>>();
+    record_distribution(
+        matches,
+        paperback::DistributionEvent::Issued,
+        &main_document.id(),
+        &shard_ids,
+    )?;
+    if printable_to_stdout {
+        return Ok(());
+    }
+
+    if json_output() {
+        let mut main_json = main_document_json(&main_document);
+        if !main_on_disk {
+            main_json["data"] = serde_json::Value::Null;
+        }
+        let mut shards_json = shards
+            .iter()
+            .map(|(shard, keyword)| shard_json(shard, keyword))
+            .collect::<Vec<_>>();
+        if let Some(mut paths) = paths {
+            if main_on_disk {
+                main_json["path"] = paths.remove(0).display().to_string().into();
+            }
+            for (document, path) in shards_json.iter_mut().zip(paths) {
+                document["path"] = path.display().to_string().into();
+            }
+        }
+        return print_json(&serde_json::json!({
+            "main_document": main_json,
+            "shards": shards_json,
+            "output_mode": output_mode,
+            "escrow": escrow_path,
+        }));
+    }
+
+    if let Some(mut paths) = paths {
+        if main_on_disk {
+            println!("Main Document: {}", paths.remove(0).display());
+        } else {
+            println!("Main Document: (printed only)");
+        }
+        println!("  Document-ID: {}", main_document.id());
+        println!("  Checksum: {}", main_document.checksum_string());
+        if let Some(escrow_path) = escrow_path {
+            println!("  Escrow-Key: {}", escrow_path);
+        }
+        for (i, ((shard, keyword), path)) in shards.iter().zip(&paths).enumerate() {
+            let decrypted_shard = shard.clone().decrypt(keyword).unwrap();
+            println!("Shard {} of {}: {}", i + 1, shards.len(), path.display());
+            println!("  Shard-ID: {}", decrypted_shard.id());
+            println!("  Keywords: {}", keyword.join(" "));
+        }
+        return Ok(());
+    }
 
     println!("----- BEGIN MAIN DOCUMENT -----");
     println!("Document-ID: {}", main_document.id());
     println!("Checksum: {}", main_document.checksum_string());
-    println!("\n{}", main_document.to_wire_zbase32());
+    // The main document is left out of the digital output if it is only meant
+    // to be stored on paper.
+    if main_on_disk {
+        println!("\n{}", main_document.to_wire_zbase32());
+    }
     println!("----- END MAIN DOCUMENT -----");
 
     for (i, (shard, keyword)) in shards.iter().enumerate() {
@@ -105,191 +1124,3387 @@ fn raw_backup(matches: &ArgMatches<'_>) -> Result<(), Error> {
     Ok(())
 }
 
-fn read_oneline_file(prompt: &str, path_or_stdin: &str) -> Result<String, Error> {
-    let input: Box<dyn Read + 'static> = if path_or_stdin == "-" {
-        print!("{}: ", prompt);
-        io::stdout().flush()?;
-        Box::new(io::stdin())
-    } else {
-        Box::new(
-            File::open(&path_or_stdin)
-                .with_context(|| format!("failed to open file '{}'", path_or_stdin))?,
-        )
-    };
-    let buffer_input = BufReader::new(input);
-    Ok(buffer_input
-        .lines()
-        .next()
-        .ok_or_else(|| anyhow!("no lines read"))??)
+/// Prompts with `question` until the answer can be parsed by `parse`. An empty
+/// answer is taken to be `default`.
+fn ask<T, F: Fn(&str) -> Result<T, Error>>(
+    question: &str,
+    default: &str,
+    parse: F,
+) -> Result<T, Error> {
+    loop {
+        prompt!("{} [{}]: ", question, default);
+        let mut line = String::new();
+        if io::stdin().read_line(&mut line)? == 0 {
+            return Err(anyhow!("no answer given to '{}'", question));
+        }
+        let answer = match line.trim() {
+            "" => default,
+            answer => answer,
+        };
+        match parse(answer) {
+            Ok(value) => return Ok(value),
+            Err(err) => promptln!("Invalid answer: {:#}", err),
+        }
+    }
 }
 
-fn raw_restore(matches: &ArgMatches<'_>) -> Result<(), Error> {
-    use paperback::{EncryptedKeyShard, FromWire, MainDocument, UntrustedQuorum};
+/// Interactively asks about the shardholders and the threats to the backup,
+/// and returns the quorum size and number of shards the user chose based on
+/// the recommendation from [`paperback::recommend`].
+fn threshold_wizard() -> Result<(u32, u32), Error> {
+    use paperback::HolderRisk;
 
-    let main_document_path = matches
-        .value_of("main_document")
-        .expect("required --main-document argument not given");
-    let shard_paths = matches
-        .values_of("shards")
-        .expect("required --shard arguments not given");
-    let output_path = matches
-        .value_of("OUTPUT")
-        .expect("required OUTPUT argument not given");
+    const TRIALS: u32 = 100_000;
 
-    let main_document = MainDocument::from_wire_zbase32(
-        read_oneline_file("Main Document Data", main_document_path)
-            .context("open main document")?,
-    )
-    .map_err(|err| anyhow!(err)) // TODO: Fix this once FromWire supports non-String errors.
-    .context("decode main document")?;
+    let parse_count =
+        |answer: &str| -> Result<u32, Error> { answer.parse().context("not an unsigned integer") };
 
-    println!("Document ID: {}", main_document.id());
-    println!("Document Checksum: {}", main_document.checksum_string());
+    promptln!("This wizard recommends how many shards to create and how many of them are needed to recover the secret.");
+    let trustees = ask(
+        "How many people (or places) could you give a shard to?",
+        "5",
+        |answer| match parse_count(answer)? {
+            0 => Err(anyhow!("at least one shard is needed")),
+            trustees => Ok(trustees),
+        },
+    )?;
+    let loss = ask(
+        "How likely is one of them to lose their shard (or be unreachable) by the time it is needed?",
+        "5%",
+        |answer| parse_probability("probability", answer),
+    )?;
+    let compromise = ask(
+        "How likely is an attacker to get hold of any one shard (and its keywords)?",
+        "1%",
+        |answer| parse_probability("probability", answer),
+    )?;
+    let max_colluding = ask(
+        "What is the largest number of them who might work together to recover the secret without you?",
+        "1",
+        parse_count,
+    )?;
+    let groups = ask(
+        "Into how many separate groups (such as family, friends and colleagues) do they fall?",
+        "1",
+        |answer| match parse_count(answer)? {
+            0 => Err(anyhow!("there must be at least one group")),
+            groups => Ok(groups),
+        },
+    )?;
 
-    let mut quorum = UntrustedQuorum::new();
-    quorum.main_document(main_document);
+    let holders = vec![HolderRisk::new(loss, compromise)?; trustees as usize];
+    let recommendation = with_progress("Simulating", || {
+        paperback::recommend(
+            &mut rand::thread_rng(),
+            &holders,
+            max_colluding,
+            groups,
+            TRIALS,
+        )
+    })?;
+    match recommendation {
+        Some(recommendation) => {
+            let result = recommendation.result;
+            promptln!(
+                "Recommended: {} shards, any {} of which recover the secret.",
+                result.shards,
+                result.quorum_size
+            );
+            promptln!(
+                "  Chance of the secret being lost: {:.4}%",
+                100.0 * result.loss_probability()
+            );
+            promptln!(
+                "  Chance of an attacker recovering the secret: {:.4}%",
+                100.0 * result.compromise_probability()
+            );
+            if recommendation.groups > 1 {
+                promptln!(
+                    "  Spread the shards evenly across the {} groups (at most {} per group), so that no group can recover the secret on its own.",
+                    recommendation.groups,
+                    recommendation.shards_per_group()
+                );
+            } else {
+                promptln!("  There is no need to spread the shards across groups of shardholders.");
+            }
+            let accept = ask("Use this recommendation?", "y", |answer| {
+                match answer.to_lowercase().as_str() {
+                    "y" | "yes" => Ok(true),
+                    "n" | "no" => Ok(false),
+                    _ => Err(anyhow!("answer yes or no")),
+                }
+            })?;
+            if accept {
+                return Ok((result.quorum_size, result.shards));
+            }
+        }
+        None => promptln!(
+            "No quorum size keeps the secret out of reach of {} colluding shardholders{} with only {} shards.",
+            max_colluding,
+            if groups > 1 { " and of any one group" } else { "" },
+            trustees
+        ),
+    }
+
+    let num_shards = ask(
+        "How many shards should be created?",
+        &trustees.to_string(),
+        parse_count,
+    )?;
+    let quorum_size = ask(
+        "How many shards should be needed to recover the secret?",
+        &num_shards.to_string(),
+        parse_count,
+    )?;
+    Ok((quorum_size, num_shards))
+}
+
+/// Parses a symbology name, as used by --symbology and layout config files.
+fn parse_symbology(name: &str) -> Result<paperback::Symbology, Error> {
+    use paperback::Symbology;
+
+    match name {
+        "qr" => Ok(Symbology::Qr),
+        "datamatrix" => Ok(Symbology::DataMatrix),
+        "aztec" => Ok(Symbology::Aztec),
+        name => Err(failure!(Failure::Usage, "unknown symbology '{}'", name)),
+    }
+}
+
+/// Parses a paper size name, as used by --paper-size and layout config files.
+fn parse_paper_size(name: &str) -> Result<paperback::PaperSize, Error> {
+    use paperback::PaperSize;
+
+    match name {
+        "a4" => Ok(PaperSize::A4),
+        "letter" => Ok(PaperSize::Letter),
+        "a5" => Ok(PaperSize::A5),
+        name => Err(failure!(Failure::Usage, "unknown paper size '{}'", name)),
+    }
+}
+
+/// Returns the page layout for printable output, using the layout config
+/// file (if one was given) with any layout flags taking precedence. The paper
+/// size from the config file is only used if neither of them set it.
+///
+/// The config file is a JSON object with any of the keys "paper_size",
+/// "margin_mm", "qr_size_mm", "duplex" and "hide" (a list of elements to
+/// hide), with the same meanings as the corresponding flags.
+fn page_layout(matches: &ArgMatches<'_>) -> Result<paperback::PageLayout, Error> {
+    use paperback::{PageLayout, PaperSize};
+    use serde_json::Value;
+
+    let config = match matches.value_of("layout_config") {
+        Some(path) => serde_json::from_str(
+            &fs::read_to_string(path)
+                .with_context(|| format!("failed to read layout config file '{}'", path))?,
+        )
+        .with_context(|| format!("failed to parse layout config file '{}'", path))?,
+        None => Value::Object(Default::default()),
+    };
+    let config = config
+        .as_object()
+        .ok_or_else(|| anyhow!("layout config file must contain a JSON object"))?;
+    if let Some(key) = config.keys().find(|key| {
+        !["paper_size", "margin_mm", "qr_size_mm", "duplex", "hide"].contains(&key.as_str())
+    }) {
+        return Err(anyhow!("unknown key '{}' in layout config file", key));
+    }
+    let config_mm = |key: &str| -> Result<Option<f64>, Error> {
+        config
+            .get(key)
+            .map(|value| {
+                value
+                    .as_f64()
+                    .ok_or_else(|| anyhow!("'{}' in layout config file must be a number", key))
+            })
+            .transpose()
+    };
+    let flag_mm = |name: &str| -> Result<Option<f64>, Error> {
+        matches
+            .value_of(name)
+            .map(|value| {
+                value.parse::<f64>().with_context(|| {
+                    format!("--{} argument was not a number", name.replace('_', "-"))
+                })
+            })
+            .transpose()
+    };
+
+    let paper_size = match (matches.value_of("paper_size"), config.get("paper_size")) {
+        (Some(name), _) => parse_paper_size(name)?,
+        (None, Some(Value::String(name))) => parse_paper_size(name)?,
+        (None, Some(_)) => {
+            return Err(anyhow!(
+                "'paper_size' in layout config file must be a string"
+            ))
+        }
+        (None, None) => match config_value("paper_size") {
+            Some(name) => parse_paper_size(name)?,
+            None => PaperSize::default(),
+        },
+    };
+    let mut layout = PageLayout::new(paper_size);
+    if let Some(margin) = flag_mm("margin")?.or(config_mm("margin_mm")?) {
+        layout = layout.margin_mm(margin);
+    }
+    if let Some(qr_size) = flag_mm("qr_size")?.or(config_mm("qr_size_mm")?) {
+        layout = layout.qr_size_mm(qr_size);
+    }
+    let duplex = match config.get("duplex") {
+        Some(Value::Bool(duplex)) => *duplex,
+        Some(_) => return Err(anyhow!("'duplex' in layout config file must be a boolean")),
+        None => false,
+    };
+    layout = layout.duplex(duplex || matches.is_present("duplex"));
+
+    let mut hidden = matches
+        .values_of("hide")
+        .map(|values| values.map(String::from).collect::<Vec<_>>())
+        .unwrap_or_default();
+    match config.get("hide") {
+        Some(Value::Array(values)) => {
+            for value in values {
+                hidden.push(
+                    value
+                        .as_str()
+                        .ok_or_else(|| {
+                            anyhow!("'hide' in layout config file must be a list of strings")
+                        })?
+                        .to_string(),
+                );
+            }
+        }
+        Some(_) => {
+            return Err(anyhow!(
+                "'hide' in layout config file must be a list of strings"
+            ))
+        }
+        None => (),
+    }
+    for element in hidden {
+        layout = match element.as_str() {
+            "details" => layout.show_details(false),
+            "instructions" => layout.show_instructions(false),
+            "codewords" => layout.show_codewords(false),
+            element => return Err(anyhow!("unknown page element '{}'", element)),
+        };
+    }
+
+    layout.validate()?;
+    Ok(layout)
+}
+
+/// Writes `data` to the file at `path` ("-" to write to stdout).
+fn write_output_file<B: AsRef<[u8]>>(path: &str, data: B, what: &str) -> Result<(), Error> {
+    if path == "-" {
+        let mut stdout = io::stdout();
+        stdout
+            .write_all(data.as_ref())
+            .and_then(|_| stdout.flush())
+            .with_context(|| format!("failed to write {} to stdout", what))
+    } else {
+        fs::write(path, data).with_context(|| format!("failed to write {} to '{}'", what, path))
+    }
+}
+
+fn parse_language(name: &str) -> Result<paperback::CodewordLanguage, Error> {
+    paperback::CodewordLanguage::from_name(name)
+        .ok_or_else(|| failure!(Failure::Usage, "unknown codeword language '{}'", name))
+}
+
+/// Returns the codeword language given with --language (or set in the config
+/// file), if any.
+fn codeword_language(
+    matches: &ArgMatches<'_>,
+) -> Result<Option<paperback::CodewordLanguage>, Error> {
+    setting(matches, "language").map(parse_language).transpose()
+}
+
+/// Fails if --pdf was given but the codewords of `language` cannot be printed
+/// in a PDF (which only supports the Latin alphabet).
+fn check_pdf_language(
+    matches: &ArgMatches<'_>,
+    language: paperback::CodewordLanguage,
+) -> Result<(), Error> {
+    if matches.is_present("pdf") && !paperback::pdf_supports_language(language) {
+        return Err(failure!(
+            Failure::Usage,
+            "invalid arguments: --pdf cannot print {} codewords (only the Latin alphabet is supported) -- use --html, --latex or --svg instead",
+            language.name()
+        ));
+    }
+    Ok(())
+}
+
+/// Returns the per-shard metadata for each of `num_shards` new shards, from the
+/// --holder, --contact and --note arguments. Each argument can be given once
+/// per shard, and the values are applied to the shards in order.
+fn shard_options(
+    matches: &ArgMatches<'_>,
+    num_shards: u32,
+) -> Result<Vec<paperback::ShardOptions>, Error> {
+    let mut options = vec![paperback::ShardOptions::new(); num_shards as usize];
+    for name in &["holder", "contact", "note"] {
+        let values = matches.values_of(name).into_iter().flatten();
+        if values.clone().count() > options.len() {
+            return Err(failure!(
+                Failure::Usage,
+                "invalid arguments: --{} given more times than there are new shards",
+                name
+            ));
+        }
+        for (shard_options, value) in options.iter_mut().zip(values) {
+            let current = shard_options.clone();
+            *shard_options = match *name {
+                "holder" => current.holder(value),
+                "contact" => current.contact(value),
+                _ => current.note(value),
+            };
+        }
+    }
+    Ok(options)
+}
+
+/// Returns the printable sheets for the main document and each shard of a
+/// backup.
+fn backup_sheets(
+    main_document: &paperback::MainDocument,
+    shards: &[(paperback::EncryptedKeyShard, paperback::KeyShardCodewords)],
+    encoding: paperback::SheetEncoding,
+    symbology: paperback::Symbology,
+) -> Result<Vec<paperback::Sheet>, Error> {
+    use paperback::{QrErrorCorrection, Sheet};
+
+    let level = QrErrorCorrection::default();
+    let mut progress = Progress::new("Rendering sheets", shards.len() + 1);
+    let mut sheets = vec![Sheet::main_document(main_document, level)?
+        .encoding(encoding)
+        .symbology(symbology)];
+    progress.inc();
+    for (shard, codewords) in shards {
+        sheets.push(
+            Sheet::key_shard(shard, codewords, level)?
+                .encoding(encoding)
+                .symbology(symbology),
+        );
+        progress.inc();
+    }
+    progress.finish();
+    Ok(sheets)
+}
+
+/// Writes the main document and each shard of a backup to separate files in
+/// `output_dir`, in the format read by "raw restore", returning the paths of
+/// the main document followed by each shard. The files are named after
+/// `names` (see [`output_names`]). The shard keywords are not written, so that
+/// they can be stored separately from the shards. If `main_document` is
+/// `None`, only the shards are written (and their paths returned).
+fn write_backup_files<P: AsRef<Path>>(
+    output_dir: P,
+    names: &[String],
+    main_document: Option<&paperback::MainDocument>,
+    shards: &[(paperback::EncryptedKeyShard, paperback::KeyShardCodewords)],
+) -> Result<Vec<PathBuf>, Error> {
+    use paperback::ToWire;
+
+    let output_dir = output_dir.as_ref();
+    fs::create_dir_all(output_dir).with_context(|| {
+        format!(
+            "failed to create output directory '{}'",
+            output_dir.display()
+        )
+    })?;
+    let write_document = |name: &str, data: String| -> Result<PathBuf, Error> {
+        let path = output_dir.join(name);
+        fs::write(&path, data + "\n")
+            .with_context(|| format!("failed to write '{}'", path.display()))?;
+        Ok(path)
+    };
+
+    let documents = std::iter::once(main_document.map(|main| main.to_wire_zbase32())).chain(
+        shards
+            .iter()
+            .map(|(shard, _)| Some(shard.to_wire_zbase32())),
+    );
+    names
+        .iter()
+        .zip(documents)
+        .filter_map(|(name, data)| data.map(|data| (name, data)))
+        .map(|(name, data)| write_document(&format!("{}.txt", name), data))
+        .collect()
+}
+
+/// Returns the file names (without an extension) of the main document and
+/// each shard of a backup. By default these are "main-document" and "shard-N",
+/// but they can be set with a `template` in the syntax of Go's text/template
+/// (limited to {{.Field}} substitutions), such as "{{.DocumentID}}-{{.Index}}".
+fn output_names(
+    template: Option<&str>,
+    main_document: &paperback::MainDocument,
+    shards: &[(paperback::EncryptedKeyShard, paperback::KeyShardCodewords)],
+) -> Result<Vec<String>, Error> {
+    let template = match template {
+        Some(template) => template,
+        None => {
+            return Ok(std::iter::once("main-document".to_string())
+                .chain((1..=shards.len()).map(|idx| format!("shard-{}", idx)))
+                .collect())
+        }
+    };
+
+    let date =
+        format_utc(main_document.created_at().unwrap_or_else(SystemTime::now))[..10].to_string();
+    let main_fields = vec![
+        ("Kind", "main-document".to_string()),
+        ("DocumentID", main_document.id()),
+        ("ShardID", String::new()),
+        ("Index", "0".to_string()),
+        ("Total", shards.len().to_string()),
+        ("Date", date.clone()),
+        ("Label", String::new()),
+        ("Holder", String::new()),
+    ];
+    let mut names = vec![render_template(template, &main_fields)?];
+    for (idx, (shard, codewords)) in shards.iter().enumerate() {
+        let shard = shard.decrypt(codewords)?;
+        let fields = vec![
+            ("Kind", "shard".to_string()),
+            ("DocumentID", shard.document_id()),
+            ("ShardID", shard.id()),
+            ("Index", (idx + 1).to_string()),
+            ("Total", shards.len().to_string()),
+            ("Date", date.clone()),
+            ("Label", shard.label().unwrap_or_default().to_string()),
+            ("Holder", shard.holder().unwrap_or_default().to_string()),
+        ];
+        names.push(render_template(template, &fields)?);
+    }
+
+    for (idx, name) in names.iter().enumerate() {
+        if name.is_empty() || name == "." || name == ".." || name.contains(&['/', '\\'][..]) {
+            return Err(anyhow!(
+                "output template produced an invalid file name '{}'",
+                name
+            ));
+        }
+        if names[..idx].contains(name) {
+            return Err(anyhow!(
+                "output template produced the file name '{}' for more than one document (include a field such as {{{{.Index}}}} or {{{{.ShardID}}}})",
+                name
+            ));
+        }
+    }
+    Ok(names)
+}
+
+/// Substitutes each {{.Field}} in `template` with the value of that field.
+/// Other text/template actions are not supported.
+fn render_template(template: &str, fields: &[(&str, String)]) -> Result<String, Error> {
+    let mut output = String::new();
+    let mut rest = template;
+    while let Some(start) = rest.find("{{") {
+        output.push_str(&rest[..start]);
+        let end = rest[start..]
+            .find("}}")
+            .ok_or_else(|| anyhow!("unterminated action in output template '{}'", template))?;
+        let action = rest[start + 2..start + end].trim();
+        let field = Some(action)
+            .filter(|action| action.starts_with('.'))
+            .map(|action| &action[1..])
+            .ok_or_else(|| {
+                anyhow!(
+                    "unsupported action '{{{{{}}}}}' in output template (only {{{{.Field}}}} is supported)",
+                    action
+                )
+            })?;
+        let value = fields
+            .iter()
+            .find(|(name, _)| *name == field)
+            .map(|(_, value)| value)
+            .ok_or_else(|| {
+                anyhow!(
+                    "unknown field '.{}' in output template (known fields: {})",
+                    field,
+                    fields
+                        .iter()
+                        .map(|(name, _)| format!(".{}", name))
+                        .collect::<Vec<_>>()
+                        .join(", ")
+                )
+            })?;
+        output.push_str(value);
+        rest = &rest[start + end + 2..];
+    }
+    output.push_str(rest);
+    Ok(output)
+}
+
+fn read_oneline_file(prompt: &str, path_or_stdin: &str) -> Result<String, Error> {
+    let mut line = String::new();
+    if path_or_stdin == "-" {
+        prompt!("{}: ", prompt);
+        // Read from the (shared) stdin buffer directly, so that several
+        // documents (and codewords) can be piped through stdin one after
+        // another without a separate buffer swallowing the following lines.
+        io::stdin().read_line(&mut line)?;
+    } else {
+        BufReader::new(
+            File::open(&path_or_stdin)
+                .with_context(|| format!("failed to open file '{}'", path_or_stdin))?,
+        )
+        .read_line(&mut line)?;
+    }
+    if line.is_empty() {
+        return Err(anyhow!("no lines read"));
+    }
+    Ok(line.trim_end_matches(&['\r', '\n'][..]).to_string())
+}
+
+/// Reads the main document at `main_document_path` and the shards at
+/// `shard_paths` (prompting for the codewords of each shard), and returns the
+/// validated quorum along with the main document.
+fn read_quorum<'a, I: Iterator<Item = &'a str>>(
+    main_document_path: &str,
+    shard_paths: I,
+) -> Result<(paperback::MainDocument, paperback::Quorum), Error> {
+    use paperback::{EncryptedKeyShard, FromWire, MainDocument, UntrustedQuorum};
+
+    let main_document = MainDocument::from_wire_zbase32(
+        read_oneline_file("Main Document Data", main_document_path)
+            .context("open main document")?,
+    )
+    .context("decode main document")?;
+
+    promptln!("Document ID: {}", main_document.id());
+    promptln!("Document Checksum: {}", main_document.checksum_string());
+
+    let mut quorum = UntrustedQuorum::new();
+    quorum.main_document(main_document.clone());
     for (idx, shard_path) in shard_paths.enumerate() {
         let encrypted_shard = EncryptedKeyShard::from_wire_zbase32(
             read_oneline_file(&format!("Shard {} Data", idx + 1), shard_path)
                 .with_context(|| format!("read shard {}", idx + 1))?,
         )
-        .map_err(|err| anyhow!(err)) // TODO: Fix this once FromWire supports non-String errors.
         .with_context(|| format!("decode shard {}", idx + 1))?;
 
-        print!("Shard {} Codeword: ", idx + 1);
-        io::stdout().flush()?;
-        let mut codeword_input = String::new();
-        io::stdin().read_line(&mut codeword_input)?;
+        let codewords = prompt_codewords(idx + 1, encrypted_shard.language())?;
+
+        let shard = encrypted_shard
+            .decrypt(&codewords)
+            .with_context(|| format!("decrypting shard {}", idx + 1))?;
+        if quorum.contains_shard(&shard) {
+            promptln!(
+                "Warning: shard {} ({}) is a copy of a shard which was already given (such as a photocopy), and does not count towards the quorum.",
+                idx + 1,
+                shard.id()
+            );
+            continue;
+        }
+        quorum.push_shard(shard);
+    }
+
+    match quorum.validate() {
+        Ok(validated_quorum) => Ok((main_document, validated_quorum)),
+        Err(err) => {
+            // TODO: Make this error much cleaner.
+            Err(failure!(
+                Failure::Quorum,
+                "quorum failed to validate -- possible forgery! groupings: {:?}",
+                err.as_groups()
+            ))
+        }
+    }
+}
+
+fn raw_restore(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    let main_document_path = matches
+        .value_of("main_document")
+        .expect("required --main-document argument not given");
+    let shard_paths = matches
+        .values_of("shards")
+        .expect("required --shard arguments not given");
+    let output = secret_output(matches)?;
+
+    let (main_document, quorum) = read_quorum(main_document_path, shard_paths)?;
+
+    let secret = with_progress("Recovering secret", || quorum.recover_document())
+        .context("recovering secret data")?;
+
+    write_secret_output(&output, &secret)?;
+
+    if json_output() {
+        print_json(&serde_json::json!({
+            "main_document": main_document_json(&main_document),
+            "output": matches.value_of("OUTPUT"),
+            "output_target": matches.value_of("output_target"),
+        }))?;
+    }
+    Ok(())
+}
+
+fn raw_test_restore(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    let main_document_path = matches
+        .value_of("main_document")
+        .expect("required --main-document argument not given");
+    let shard_paths = matches
+        .values_of("shards")
+        .expect("required --shard arguments not given");
+
+    let (main_document, quorum) = read_quorum(main_document_path, shard_paths)?;
+
+    // The secret data is only ever held in memory, and only its checksum is
+    // shown to the user.
+    let checksum = quorum
+        .recovered_checksum()
+        .context("recovering secret data")?
+        .digest()
+        .iter()
+        .map(|b| format!("{:02x}", b))
+        .collect::<String>();
+
+    if json_output() {
+        return print_json(&serde_json::json!({
+            "main_document": main_document_json(&main_document),
+            "recovered": true,
+            "blake2b_256": checksum,
+        }));
+    }
+    println!("Recovery succeeded (the secret data was not written anywhere).");
+    println!("Secret Data BLAKE2b-256: {}", checksum);
+    Ok(())
+}
+
+/// Reads the first age identity (an X25519 secret key such as
+/// AGE-SECRET-KEY-1...) from the identity file at `path`, skipping comments.
+fn read_age_identity(path: &str) -> Result<age::x25519::Identity, Error> {
+    let contents = fs::read_to_string(path)
+        .with_context(|| format!("failed to read identity file '{}'", path))?;
+    let line = contents
+        .lines()
+        .map(str::trim)
+        .find(|line| !line.is_empty() && !line.starts_with('#'))
+        .ok_or_else(|| anyhow!("identity file '{}' does not contain any identities", path))?;
+    line.parse::<age::x25519::Identity>().map_err(|err| {
+        failure!(
+            Failure::Usage,
+            "invalid identity in identity file '{}': {}",
+            path,
+            err
+        )
+    })
+}
+
+fn raw_recover_escrow(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::{FromWire, MainDocument};
+
+    let main_document_path = matches
+        .value_of("main_document")
+        .expect("required --main-document argument not given");
+    let escrow_path = matches
+        .value_of("escrow")
+        .expect("required --escrow argument not given");
+    let identity_path = matches
+        .value_of("identity")
+        .expect("required --identity argument not given");
+    let output = secret_output(matches)?;
+
+    let main_document = MainDocument::from_wire_zbase32(
+        read_oneline_file("Main Document Data", main_document_path)
+            .context("open main document")?,
+    )
+    .context("decode main document")?;
+    promptln!("Document ID: {}", main_document.id());
+    promptln!("Document Checksum: {}", main_document.checksum_string());
+
+    let escrow = fs::read(escrow_path)
+        .with_context(|| format!("failed to read escrow key '{}'", escrow_path))?;
+    let identity = read_age_identity(identity_path)?;
+
+    let secret = with_progress("Recovering secret", || {
+        main_document.recover_with_escrow(&escrow, &identity)
+    })
+    .context("recovering secret data from escrow key")?;
+
+    write_secret_output(&output, &secret)?;
+
+    if json_output() {
+        print_json(&serde_json::json!({
+            "main_document": main_document_json(&main_document),
+            "output": matches.value_of("OUTPUT"),
+            "output_target": matches.value_of("output_target"),
+        }))?;
+    }
+    Ok(())
+}
+
+/// Returns whether `line` looks like one of the numbered plain-text fallback
+/// lines printed on a document ("NN/MM ...").
+fn is_text_line(line: &str) -> bool {
+    line.split_whitespace().next().map_or(false, |prefix| {
+        let parts = prefix.splitn(2, '/').collect::<Vec<_>>();
+        parts.len() == 2 && parts.iter().all(|part| part.parse::<u32>().is_ok())
+    })
+}
+
+/// Parses a document given as armored text, the plain-text fallback lines
+/// printed on a document, or a single line of zbase32 data.
+fn parse_document<T: paperback::Framed>(text: &str) -> Result<T, Error> {
+    use paperback::FromWire;
+
+    let text = text.trim();
+    if text.starts_with("-----BEGIN PAPERBACK") {
+        Ok(paperback::from_armor(text)?)
+    } else if is_text_line(text) {
+        Ok(paperback::parse_text_document(text)?)
+    } else {
+        Ok(T::from_wire_zbase32(text)?)
+    }
+}
+
+/// Prompts the user for a document, which may be given as a path to a file
+/// containing the document, as pasted armored text or zbase32 data, or by
+/// typing in the plain-text fallback lines. The user is prompted again if the
+/// document cannot be read or is invalid.
+fn prompt_document<T: paperback::Framed>(prompt: &str) -> Result<T, Error> {
+    loop {
+        prompt!("{} (path, or paste the document): ", prompt);
+
+        let mut line = String::new();
+        if io::stdin().read_line(&mut line)? == 0 {
+            return Err(anyhow!("unexpected end of input"));
+        }
+        let line = line.trim();
+        if line.is_empty() {
+            continue;
+        }
+
+        let text = if line.starts_with("-----BEGIN PAPERBACK") {
+            // Keep reading the pasted armor until the END line.
+            let mut text = line.to_string() + "\n";
+            loop {
+                let mut line = String::new();
+                if io::stdin().read_line(&mut line)? == 0 {
+                    break;
+                }
+                text.push_str(&line);
+                if line.trim().starts_with("-----END PAPERBACK") {
+                    break;
+                }
+            }
+            text
+        } else if is_text_line(line) {
+            // Keep reading text lines until a blank line.
+            promptln!("Enter the remaining lines, followed by a blank line.");
+            let mut text = line.to_string() + "\n";
+            loop {
+                let mut line = String::new();
+                if io::stdin().read_line(&mut line)? == 0 || line.trim().is_empty() {
+                    break;
+                }
+                text.push_str(&line);
+            }
+            text
+        } else if Path::new(line).is_file() {
+            match fs::read_to_string(line) {
+                Ok(text) => text,
+                Err(err) => {
+                    promptln!("Failed to read '{}': {}", line, err);
+                    continue;
+                }
+            }
+        } else {
+            line.to_string()
+        };
+
+        match parse_document(&text) {
+            Ok(document) => return Ok(document),
+            Err(err) => promptln!("Invalid document: {:#}", err),
+        }
+    }
+}
+
+/// Prompts for a passphrase (twice if `confirm` is set, to catch typos). The
+/// passphrase is read from the terminal without echoing it, so stdin must be a
+/// terminal.
+fn prompt_passphrase(prompt: &str, confirm: bool) -> Result<String, Error> {
+    use std::io::IsTerminal;
+
+    if !io::stdin().is_terminal() {
+        return Err(failure!(
+            Failure::Usage,
+            "the passphrase can only be entered on a terminal (stdin is not a tty)"
+        ));
+    }
+    let read_passphrase = |prompt: &str| -> Result<String, Error> {
+        prompt!("{}: ", prompt);
+        rpassword::read_password().context("read passphrase")
+    };
+    loop {
+        let passphrase = read_passphrase(prompt)?;
+        if passphrase.is_empty() {
+            promptln!("The passphrase must not be empty.");
+            continue;
+        }
+        if confirm && read_passphrase(&format!("{} (again)", prompt))? != passphrase {
+            promptln!("The passphrases do not match.");
+            continue;
+        }
+        return Ok(passphrase);
+    }
+}
+
+/// Opens the recovery session at `path` (or starts a new one, if it does not
+/// exist yet), returning the session and its passphrase.
+fn open_recovery_session(path: &str) -> Result<(paperback::RecoverySession, String), Error> {
+    use paperback::RecoverySession;
+
+    if !Path::new(path).exists() {
+        promptln!(
+            "Starting a new recovery session '{}'. The documents entered will be saved to it (encrypted with the session passphrase), so the recovery can be resumed later by running this command again.",
+            path
+        );
+        let passphrase = prompt_passphrase("New session passphrase", true)?;
+        return Ok((RecoverySession::new(), passphrase));
+    }
+
+    let sealed =
+        fs::read(path).with_context(|| format!("failed to read recovery session '{}'", path))?;
+    let passphrase = prompt_passphrase("Session passphrase", false)?;
+    let session = with_progress("Opening recovery session", || {
+        RecoverySession::open(&sealed, &passphrase)
+    })
+    .with_context(|| {
+        format!(
+            "open recovery session '{}' (is the passphrase correct?)",
+            path
+        )
+    })?;
+    Ok((session, passphrase))
+}
+
+/// Saves `session` to `path`, replacing the previous copy only once the new
+/// one has been completely written.
+fn save_recovery_session(
+    path: &str,
+    session: &paperback::RecoverySession,
+    passphrase: &str,
+) -> Result<(), Error> {
+    let sealed = with_progress("Saving recovery session", || session.seal(passphrase))
+        .context("encrypt recovery session")?;
+    let tmp_path = format!("{}.tmp", path);
+    fs::write(&tmp_path, sealed)
+        .and_then(|_| fs::rename(&tmp_path, path))
+        .with_context(|| format!("failed to save recovery session '{}'", path))
+}
+
+fn raw_recover(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::{EncryptedKeyShard, KeyShard, MainDocument, RecoverySession};
+
+    let output = secret_output(matches)?;
+    let session_path = matches.value_of("session");
+
+    let (mut session, passphrase) = match session_path {
+        Some(path) => open_recovery_session(path)?,
+        None => (RecoverySession::new(), String::new()),
+    };
+    // The session is saved after every document, so that nothing which has
+    // been entered is lost if the recovery is interrupted.
+    let save_session = |session: &RecoverySession| match session_path {
+        Some(path) => save_recovery_session(path, session, &passphrase),
+        None => Ok(()),
+    };
+
+    let main_document = match session.main_document() {
+        Some(main_document) => main_document.clone(),
+        None => {
+            let main_document: MainDocument = prompt_document("Main Document")?;
+            session.set_main_document(main_document.clone());
+            save_session(&session)?;
+            main_document
+        }
+    };
+    let quorum_size = main_document.quorum_size();
+    promptln!("Document ID: {}", main_document.id());
+    promptln!("Document Checksum: {}", main_document.checksum_string());
+    promptln!(
+        "{} shards are needed to recover this document.",
+        quorum_size
+    );
+    if !session.shards().is_empty() {
+        promptln!(
+            "Resuming with {} shard(s) already entered: {}.",
+            session.shards().len(),
+            session
+                .shards()
+                .iter()
+                .map(KeyShard::id)
+                .collect::<Vec<_>>()
+                .join(", ")
+        );
+    }
+
+    while session.shards().len() < quorum_size as usize {
+        let idx = session.shards().len() + 1;
+        let encrypted_shard: EncryptedKeyShard = prompt_document(&format!("Shard {}", idx))?;
+
+        let codewords = prompt_codewords(idx, encrypted_shard.language())?;
+
+        let shard = match encrypted_shard.decrypt(&codewords) {
+            Ok(shard) => shard,
+            Err(err) => {
+                promptln!(
+                    "Failed to decrypt shard (are the codewords correct?): {}",
+                    err
+                );
+                continue;
+            }
+        };
+        if shard.document_id() != main_document.id() {
+            promptln!(
+                "Shard {} belongs to document {}, not this document.",
+                shard.id(),
+                shard.document_id()
+            );
+            continue;
+        }
+        let shard_id = shard.id();
+        if !session.push_shard(shard) {
+            promptln!(
+                "Shard {} has already been entered -- this is a copy of the same shard (such as a photocopy), and does not count towards the quorum.",
+                shard_id
+            );
+            continue;
+        }
+        save_session(&session)?;
+
+        let remaining = quorum_size as usize - session.shards().len();
+        promptln!(
+            "Accepted shard {} ({} of {}). {} more needed.",
+            shard_id,
+            session.shards().len(),
+            quorum_size,
+            remaining
+        );
+    }
+    let shard_ids = session
+        .shards()
+        .iter()
+        .map(KeyShard::id)
+        .collect::<Vec<_>>();
+    let main_json = main_document_json(&main_document);
+
+    let quorum = match session.to_quorum().validate() {
+        Ok(validated_quorum) => validated_quorum,
+        Err(err) => {
+            return Err(failure!(
+                Failure::Quorum,
+                "quorum failed to validate -- possible forgery! groupings: {:?}",
+                err.as_groups()
+            ));
+        }
+    };
+
+    let secret = with_progress("Recovering secret", || quorum.recover_document())
+        .context("recovering secret data")?;
+
+    write_secret_output(&output, &secret)?;
+
+    // The session holds every shard of the quorum, so it must not outlive the
+    // recovery.
+    if let Some(path) = session_path {
+        fs::remove_file(path)
+            .with_context(|| format!("failed to remove recovery session '{}'", path))?;
+        promptln!("Removed recovery session '{}'.", path);
+    }
+
+    if json_output() {
+        print_json(&serde_json::json!({
+            "main_document": main_json,
+            "shard_ids": shard_ids,
+            "output": matches.value_of("OUTPUT"),
+            "output_target": matches.value_of("output_target"),
+        }))?;
+    }
+    Ok(())
+}
+
+fn raw_expand(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::{EncryptedKeyShard, FromWire, ToWire, UntrustedQuorum};
+
+    let shard_paths = matches
+        .values_of("shards")
+        .expect("required --shard arguments not given");
+    let num_new_shards: u32 = matches
+        .value_of("new_shards")
+        .expect("required --new-shards argument not given")
+        .parse()
+        .context("--shards argument was not an unsigned integer")?;
+
+    let mut quorum = UntrustedQuorum::new();
+    for (idx, shard_path) in shard_paths.enumerate() {
+        let encrypted_shard = EncryptedKeyShard::from_wire_zbase32(
+            read_oneline_file(&format!("Shard {} Data", idx + 1), shard_path)
+                .with_context(|| format!("read shard {}", idx + 1))?,
+        )
+        .with_context(|| format!("decode shard {}", idx + 1))?;
+
+        let codewords = prompt_codewords(idx + 1, encrypted_shard.language())?;
+
+        let shard = encrypted_shard
+            .decrypt(&codewords)
+            .with_context(|| format!("decrypting shard {}", idx + 1))?;
+        if quorum.contains_shard(&shard) {
+            promptln!(
+                "Warning: shard {} ({}) is a copy of a shard which was already given (such as a photocopy), and does not count towards the quorum.",
+                idx + 1,
+                shard.id()
+            );
+            continue;
+        }
+        quorum.push_shard(shard);
+    }
+
+    let quorum = match quorum.validate() {
+        Ok(validated_quorum) => validated_quorum,
+        Err(err) => {
+            // TODO: Make this error much cleaner.
+            return Err(failure!(
+                Failure::Quorum,
+                "quorum failed to validate -- possible forgery! groupings: {:?}",
+                err.as_groups()
+            ));
+        }
+    };
+
+    let options = shard_options(matches, num_new_shards)?;
+    let new_shards = with_progress("Creating new shards", || quorum.extend_shards_with(options))
+        .context("minting new shards")?
+        .iter()
+        .map(|s| s.encrypt().unwrap())
+        .collect::<Vec<_>>();
+
+    let roster_total = new_shards.first().and_then(|(shard, keyword)| {
+        let decrypted_shard = shard.clone().decrypt(keyword).unwrap();
+        decrypted_shard.roster().map(|roster| roster.total())
+    });
+
+    let decrypted_shards = new_shards
+        .iter()
+        .map(|(shard, keyword)| shard.clone().decrypt(keyword).unwrap())
+        .collect::<Vec<_>>();
+    if let Some(shard) = decrypted_shards.first() {
+        record_distribution(
+            matches,
+            paperback::DistributionEvent::Expanded,
+            &shard.document_id(),
+            &decrypted_shards
+                .iter()
+                .map(|shard| shard.id())
+                .collect::<Vec<_>>(),
+        )?;
+    }
+
+    if json_output() {
+        return print_json(&serde_json::json!({
+            "shards": new_shards
+                .iter()
+                .map(|(shard, keyword)| shard_json(shard, keyword))
+                .collect::<Vec<_>>(),
+            "roster_total": roster_total,
+        }));
+    }
+
+    for (i, (shard, keyword)) in new_shards.iter().enumerate() {
+        let decrypted_shard = shard.clone().decrypt(keyword).unwrap();
+        println!("----- BEGIN SHARD {} OF {} -----", i, num_new_shards);
+        println!("Document-ID: {}", decrypted_shard.document_id());
+        println!("Shard-ID: {}", decrypted_shard.id());
+        println!("Keywords: {}", keyword.join(" "));
+        println!("\n{}", shard.to_wire_zbase32());
+        println!("----- END SHARD {} OF {} -----", i, num_new_shards);
+    }
+
+    if let Some(roster_total) = roster_total {
+        println!("Shard roster now lists {} shards.", roster_total);
+    }
+
+    Ok(())
+}
+
+/// A single backup created by "raw batch-backup".
+struct BatchEntry {
+    name: String,
+    input: PathBuf,
+    quorum_size: Option<u32>,
+    num_shards: Option<u32>,
+}
+
+/// Returns the backups listed in the --manifest file, or one for each file in
+/// the --input-dir directory.
+fn batch_entries(matches: &ArgMatches<'_>) -> Result<Vec<BatchEntry>, Error> {
+    use serde_json::Value;
+
+    // The default name of a backup is the name of its input file, without
+    // the extension.
+    let default_name = |input: &Path| {
+        input
+            .file_stem()
+            .map(|stem| stem.to_string_lossy().into_owned())
+            .unwrap_or_default()
+    };
+
+    let mut entries = vec![];
+    if let Some(manifest_path) = matches.value_of("manifest") {
+        let manifest: Value = serde_json::from_str(
+            &fs::read_to_string(manifest_path)
+                .with_context(|| format!("failed to read manifest '{}'", manifest_path))?,
+        )
+        .map_err(|err| {
+            failure!(
+                Failure::Usage,
+                "failed to parse manifest '{}': {}",
+                manifest_path,
+                err
+            )
+        })?;
+        let manifest = manifest.as_array().ok_or_else(|| {
+            failure!(
+                Failure::Usage,
+                "manifest must contain a JSON list of backups"
+            )
+        })?;
+        // Input paths are relative to the manifest.
+        let base_dir = Path::new(manifest_path).parent().unwrap_or(Path::new(""));
+        for (idx, entry) in manifest.iter().enumerate() {
+            let entry = entry.as_object().ok_or_else(|| {
+                failure!(
+                    Failure::Usage,
+                    "backup {} in manifest must be a JSON object",
+                    idx + 1
+                )
+            })?;
+            if let Some(key) = entry
+                .keys()
+                .find(|key| !["input", "name", "quorum_size", "shards"].contains(&key.as_str()))
+            {
+                return Err(failure!(
+                    Failure::Usage,
+                    "unknown key '{}' in backup {} in manifest",
+                    key,
+                    idx + 1
+                ));
+            }
+            let input =
+                base_dir.join(entry.get("input").and_then(Value::as_str).ok_or_else(|| {
+                    failure!(
+                        Failure::Usage,
+                        "backup {} in manifest has no 'input' path",
+                        idx + 1
+                    )
+                })?);
+            let name = match entry.get("name") {
+                Some(name) => name
+                    .as_str()
+                    .ok_or_else(|| {
+                        failure!(
+                            Failure::Usage,
+                            "'name' of backup {} in manifest must be a string",
+                            idx + 1
+                        )
+                    })?
+                    .to_string(),
+                None => default_name(&input),
+            };
+            let number = |key: &str| -> Result<Option<u32>, Error> {
+                let value = match entry.get(key) {
+                    Some(value) => value,
+                    None => return Ok(None),
+                };
+                value
+                    .as_u64()
+                    .filter(|value| *value <= u32::MAX as u64)
+                    .map(|value| Some(value as u32))
+                    .ok_or_else(|| {
+                        failure!(
+                            Failure::Usage,
+                            "'{}' of backup {} in manifest must be an unsigned 32-bit integer",
+                            key,
+                            idx + 1
+                        )
+                    })
+            };
+            entries.push(BatchEntry {
+                name,
+                input,
+                quorum_size: number("quorum_size")?,
+                num_shards: number("shards")?,
+            });
+        }
+    } else {
+        let input_dir = matches
+            .value_of("input_dir")
+            .expect("one of --manifest or --input-dir must be given");
+        let mut inputs = vec![];
+        for dir_entry in fs::read_dir(input_dir)
+            .with_context(|| format!("failed to read input directory '{}'", input_dir))?
+        {
+            let dir_entry = dir_entry
+                .with_context(|| format!("failed to read input directory '{}'", input_dir))?;
+            // Skip hidden files and anything which isn't a regular file.
+            if dir_entry.file_name().to_string_lossy().starts_with('.')
+                || !dir_entry.file_type()?.is_file()
+            {
+                continue;
+            }
+            inputs.push(dir_entry.path());
+        }
+        inputs.sort();
+        entries.extend(inputs.into_iter().map(|input| BatchEntry {
+            name: default_name(&input),
+            input,
+            quorum_size: None,
+            num_shards: None,
+        }));
+    }
+
+    // Each backup is written to a directory named after it.
+    for (idx, entry) in entries.iter().enumerate() {
+        if entry.name.is_empty()
+            || entry.name == "."
+            || entry.name == ".."
+            || entry.name.contains(&['/', '\\'][..])
+        {
+            return Err(anyhow!(
+                "invalid backup name '{}' for '{}'",
+                entry.name,
+                entry.input.display()
+            ));
+        }
+        if entries[..idx].iter().any(|other| other.name == entry.name) {
+            return Err(anyhow!(
+                "more than one backup is named '{}' (names must be unique)",
+                entry.name
+            ));
+        }
+    }
+    Ok(entries)
+}
+
+fn raw_batch_backup(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::{BackupBuilder, Compression};
+
+    let sealed: bool = matches
+        .value_of("sealed")
+        .expect("invalid --sealed argument")
+        .parse()
+        .context("--sealed argument was not a boolean")?;
+    let quorum_size: Option<u32> = matches
+        .value_of("quorum_size")
+        .map(str::parse)
+        .transpose()
+        .context("--quorum-size argument was not an unsigned integer")?;
+    let num_shards: Option<u32> = matches
+        .value_of("shards")
+        .map(str::parse)
+        .transpose()
+        .context("--shards argument was not an unsigned integer")?;
+    let output_dir = Path::new(setting(matches, "output_dir").ok_or_else(|| {
+        failure!(
+            Failure::Usage,
+            "--output-dir must be given (or set in the config file) for batch backups"
+        )
+    })?);
+
+    let entries = batch_entries(matches)?;
+    if entries.is_empty() {
+        return Err(anyhow!("no backups to create"));
+    }
+
+    let mut reports = vec![];
+    let mut failed = 0;
+    for entry in &entries {
+        let backup_dir = output_dir.join(&entry.name);
+        let result = (|| -> Result<_, Error> {
+            let quorum_size = entry.quorum_size.or(quorum_size).ok_or_else(|| {
+                anyhow!(
+                    "no quorum size given (use --quorum-size or set 'quorum_size' in the manifest)"
+                )
+            })?;
+            let num_shards = entry.num_shards.or(num_shards).ok_or_else(|| {
+                anyhow!("no number of shards given (use --shards or set 'shards' in the manifest)")
+            })?;
+            if num_shards < quorum_size {
+                return Err(anyhow!("number of shards cannot be smaller than quorum size (such a backup is unrecoverable)"));
+            }
+
+            let secret = fs::read(&entry.input).with_context(|| {
+                format!(
+                    "failed to read secret data from '{}'",
+                    entry.input.display()
+                )
+            })?;
+            let mut builder = BackupBuilder::new(quorum_size).sealed(sealed);
+            if matches.is_present("compress") {
+                builder = builder.compression(Compression::Deflate);
+            }
+            if let Some(language) = codeword_language(matches)? {
+                builder = builder.language(language);
+            }
+            let backup = builder.build(&secret)?;
+            let main_document = backup.main_document().clone();
+            let shards = (0..num_shards)
+                .map(|_| backup.next_shard().unwrap())
+                .map(|s| s.encrypt().unwrap())
+                .collect::<Vec<_>>();
+            let names = output_names(matches.value_of("output_template"), &main_document, &shards)?;
+            let paths = write_backup_files(&backup_dir, &names, Some(&main_document), &shards)?;
+            Ok((main_document, shards, paths))
+        })();
+
+        match result {
+            Ok((main_document, shards, paths)) => {
+                if json_output() {
+                    let mut main_json = main_document_json(&main_document);
+                    main_json["path"] = paths[0].display().to_string().into();
+                    reports.push(serde_json::json!({
+                        "name": entry.name,
+                        "input": entry.input.display().to_string(),
+                        "ok": true,
+                        "main_document": main_json,
+                        "shards": shards
+                            .iter()
+                            .zip(&paths[1..])
+                            .map(|((shard, keyword), path)| {
+                                let mut shard_json = shard_json(shard, keyword);
+                                shard_json["path"] = path.display().to_string().into();
+                                shard_json
+                            })
+                            .collect::<Vec<_>>(),
+                    }));
+                } else {
+                    println!("{} ({}): ok", entry.name, entry.input.display());
+                    println!("  Main Document: {}", paths[0].display());
+                    println!("    Document-ID: {}", main_document.id());
+                    println!("    Checksum: {}", main_document.checksum_string());
+                    for (i, ((shard, keyword), path)) in shards.iter().zip(&paths[1..]).enumerate()
+                    {
+                        let decrypted_shard = shard.clone().decrypt(keyword).unwrap();
+                        println!("  Shard {} of {}: {}", i + 1, shards.len(), path.display());
+                        println!("    Shard-ID: {}", decrypted_shard.id());
+                        println!("    Keywords: {}", keyword.join(" "));
+                    }
+                }
+            }
+            Err(err) => {
+                failed += 1;
+                if json_output() {
+                    reports.push(serde_json::json!({
+                        "name": entry.name,
+                        "input": entry.input.display().to_string(),
+                        "ok": false,
+                        "error": format!("{:#}", err),
+                    }));
+                } else {
+                    println!(
+                        "{} ({}): failed ({:#})",
+                        entry.name,
+                        entry.input.display(),
+                        err
+                    );
+                }
+            }
+        }
+    }
+
+    if json_output() {
+        print_json(&serde_json::json!({
+            "backups": reports,
+            "created": entries.len() - failed,
+            "failed": failed,
+        }))?;
+        if failed > 0 {
+            process::exit(Failure::Other.exit_code());
+        }
+    } else {
+        println!(
+            "{} backup(s) created, {} failed.",
+            entries.len() - failed,
+            failed
+        );
+    }
+    if failed > 0 {
+        return Err(anyhow!("{} backup(s) could not be created", failed));
+    }
+    Ok(())
+}
+
+fn raw_reshard(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::{
+        BackupBuilder, EncryptedKeyShard, FromWire, MainDocument, ToWire, UntrustedQuorum,
+    };
+
+    let main_document_path = matches
+        .value_of("main_document")
+        .expect("required --main-document argument not given");
+    let shard_paths = matches
+        .values_of("shards")
+        .expect("required --shard arguments not given");
+    let sealed: bool = matches
+        .value_of("sealed")
+        .expect("invalid --sealed argument")
+        .parse()
+        .context("--sealed argument was not a boolean")?;
+    let quorum_size: u32 = matches
+        .value_of("quorum_size")
+        .expect("required --quorum_size argument not given")
+        .parse()
+        .context("--quorum-size argument was not an unsigned integer")?;
+    let num_shards: u32 = matches
+        .value_of("new_shards")
+        .expect("required --new-shards argument not given")
+        .parse()
+        .context("--new-shards argument was not an unsigned integer")?;
+
+    if num_shards < quorum_size {
+        return Err(failure!(Failure::Usage, "invalid arguments: number of shards cannot be smaller than quorum size (such a backup is unrecoverable)"));
+    }
+
+    let old_main_document = MainDocument::from_wire_zbase32(
+        read_oneline_file("Main Document Data", main_document_path)
+            .context("open main document")?,
+    )
+    .context("decode main document")?;
+
+    promptln!("Document ID: {}", old_main_document.id());
+    promptln!("Document Checksum: {}", old_main_document.checksum_string());
+
+    // Every shard of the old backup we know of is revoked -- the shards in the
+    // quorum and any others listed in their rosters.
+    let mut revoked_ids = vec![];
+    let mut old_language = None;
+    let mut quorum = UntrustedQuorum::new();
+    quorum.main_document(old_main_document.clone());
+    for (idx, shard_path) in shard_paths.enumerate() {
+        let encrypted_shard = EncryptedKeyShard::from_wire_zbase32(
+            read_oneline_file(&format!("Shard {} Data", idx + 1), shard_path)
+                .with_context(|| format!("read shard {}", idx + 1))?,
+        )
+        .with_context(|| format!("decode shard {}", idx + 1))?;
+
+        let codewords = prompt_codewords(idx + 1, encrypted_shard.language())?;
+
+        let shard = encrypted_shard
+            .decrypt(&codewords)
+            .with_context(|| format!("decrypting shard {}", idx + 1))?;
+        if quorum.contains_shard(&shard) {
+            promptln!(
+                "Warning: shard {} ({}) is a copy of a shard which was already given (such as a photocopy), and does not count towards the quorum.",
+                idx + 1,
+                shard.id()
+            );
+            continue;
+        }
+        let roster_ids = shard
+            .roster()
+            .map(|roster| roster.entries())
+            .unwrap_or_default()
+            .iter()
+            .map(|entry| entry.shard_id().to_string());
+        for shard_id in std::iter::once(shard.id()).chain(roster_ids) {
+            if !revoked_ids.contains(&shard_id) {
+                revoked_ids.push(shard_id);
+            }
+        }
+        old_language = Some(shard.language());
+        quorum.push_shard(shard);
+    }
+
+    let quorum = match quorum.validate() {
+        Ok(validated_quorum) => validated_quorum,
+        Err(err) => {
+            // TODO: Make this error much cleaner.
+            return Err(failure!(
+                Failure::Quorum,
+                "quorum failed to validate -- possible forgery! groupings: {:?}",
+                err.as_groups()
+            ));
+        }
+    };
+
+    let secret = with_progress("Recovering secret", || quorum.recover_document())
+        .context("recovering secret data")?;
+
+    // The new backup has a new identity keypair (and thus document id), so
+    // the old shards cannot be combined with the new main document.
+    let mut builder = BackupBuilder::new(quorum_size)
+        .sealed(sealed)
+        .revokes(&old_main_document, revoked_ids.clone());
+    if let Some(compression) = old_main_document.compression() {
+        builder = builder.compression(compression);
+    }
+    // Unless asked otherwise, keep using the wordlist of the old shards (in
+    // preference to the default from the config file).
+    let language = match old_language {
+        Some(language) if !matches.is_present("language") => Some(language),
+        _ => codeword_language(matches)?,
+    };
+    if let Some(language) = language {
+        builder = builder.language(language);
+    }
+    let backup = with_progress("Splitting secret", || builder.build(&secret))?;
+    let main_document = backup.main_document().clone();
+    let mut progress = Progress::new("Creating shards", num_shards as usize);
+    let shards = (0..num_shards)
+        .map(|_| backup.next_shard().unwrap())
+        .map(|s| s.encrypt().unwrap())
+        .inspect(|_| progress.inc())
+        .collect::<Vec<_>>();
+    progress.finish();
+    let names = output_names(matches.value_of("output_template"), &main_document, &shards)?;
+
+    let paths = match setting(matches, "output_dir") {
+        Some(output_dir) => Some(write_backup_files(
+            output_dir,
+            &names,
+            Some(&main_document),
+            &shards,
+        )?),
+        None => None,
+    };
+
+    record_distribution(
+        matches,
+        paperback::DistributionEvent::Revoked,
+        &old_main_document.id(),
+        &revoked_ids,
+    )?;
+    record_distribution(
+        matches,
+        paperback::DistributionEvent::Issued,
+        &main_document.id(),
+        &shards
+            .iter()
+            .map(|(shard, keyword)| shard.clone().decrypt(keyword).unwrap().id())
+            .collect::<Vec<_>>(),
+    )?;
+
+    if json_output() {
+        let mut main_json = main_document_json(&main_document);
+        let mut shards_json = shards
+            .iter()
+            .map(|(shard, keyword)| shard_json(shard, keyword))
+            .collect::<Vec<_>>();
+        if let Some(paths) = paths {
+            let documents = std::iter::once(&mut main_json).chain(shards_json.iter_mut());
+            for (document, path) in documents.zip(paths) {
+                document["path"] = path.display().to_string().into();
+            }
+        }
+        return print_json(&serde_json::json!({
+            "main_document": main_json,
+            "shards": shards_json,
+            "revoked": {
+                "document_id": old_main_document.id(),
+                "checksum": old_main_document.checksum_string(),
+                "shard_ids": revoked_ids,
+            },
+        }));
+    }
+
+    println!(
+        "REVOKED: document {} (checksum {}) and its shards {}.",
+        old_main_document.id(),
+        old_main_document.checksum_string(),
+        revoked_ids.join(", ")
+    );
+    println!("The old documents can no longer be used with this backup and should be destroyed.");
+
+    if let Some(paths) = paths {
+        println!("Main Document: {}", paths[0].display());
+        println!("  Document-ID: {}", main_document.id());
+        println!("  Checksum: {}", main_document.checksum_string());
+        for (i, ((shard, keyword), path)) in shards.iter().zip(&paths[1..]).enumerate() {
+            let decrypted_shard = shard.clone().decrypt(keyword).unwrap();
+            println!("Shard {} of {}: {}", i + 1, shards.len(), path.display());
+            println!("  Shard-ID: {}", decrypted_shard.id());
+            println!("  Keywords: {}", keyword.join(" "));
+        }
+        return Ok(());
+    }
+
+    println!("----- BEGIN MAIN DOCUMENT -----");
+    println!("Document-ID: {}", main_document.id());
+    println!("Checksum: {}", main_document.checksum_string());
+    println!("\n{}", main_document.to_wire_zbase32());
+    println!("----- END MAIN DOCUMENT -----");
+
+    for (i, (shard, keyword)) in shards.iter().enumerate() {
+        let decrypted_shard = shard.clone().decrypt(keyword).unwrap();
+        println!("----- BEGIN SHARD {} OF {} -----", i, quorum_size);
+        println!("Document-ID: {}", decrypted_shard.document_id());
+        println!("Shard-ID: {}", decrypted_shard.id());
+        println!("Keywords: {}", keyword.join(" "));
+        println!("\n{}", shard.to_wire_zbase32());
+        println!("----- END SHARD {} OF {} -----", i, quorum_size);
+    }
+
+    Ok(())
+}
+
+fn raw_schema(_matches: &ArgMatches<'_>) -> Result<(), Error> {
+    let schemas = paperback::schemas();
+    println!("{}", serde_json::to_string_pretty(&schemas)?);
+
+    Ok(())
+}
+
+fn raw_validate(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::DocumentKind;
+
+    let kind_name = matches
+        .value_of("type")
+        .expect("required --type argument not given");
+    let kind = DocumentKind::all()
+        .iter()
+        .copied()
+        .find(|kind| kind.name() == kind_name)
+        .ok_or_else(|| failure!(Failure::Usage, "unknown document type '{}'", kind_name))?;
+    let input_path = matches
+        .value_of("INPUT")
+        .expect("required INPUT argument not given");
+
+    let data = read_oneline_file("Document Data", input_path).context("open document")?;
+    let wire_data = match (data.get(0..1), data.get(1..)) {
+        (Some("h"), Some(data)) => zbase32::decode_full_bytes_str(data)
+            .map_err(|err| failure!(Failure::CorruptDocument, "invalid zbase32 string: {}", err))?,
+        _ => return Err(failure!(Failure::CorruptDocument, "invalid zbase32 string")),
+    };
+    kind.validate(wire_data)
+        .with_context(|| format!("validate {}", kind.name()))?;
+
+    if json_output() {
+        return print_json(&serde_json::json!({
+            "type": kind.name(),
+            "valid": true,
+        }));
+    }
+    println!("{} is valid.", kind.name());
+    Ok(())
+}
+
+/// Reads the whole contents of a file ("-" to read from stdin).
+fn read_text_file(path_or_stdin: &str) -> Result<String, Error> {
+    let mut text = String::new();
+    if path_or_stdin == "-" {
+        io::stdin().read_to_string(&mut text)?;
+    } else {
+        File::open(&path_or_stdin)
+            .with_context(|| format!("failed to open file '{}'", path_or_stdin))?
+            .read_to_string(&mut text)?;
+    }
+    Ok(text)
+}
+
+fn raw_verify(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::{AnyDocument, CheckResult};
+
+    let input_paths = matches
+        .values_of("INPUT")
+        .expect("required INPUT argument not given");
+    let expected_checksum = matches.value_of("checksum");
+    let expected_spotcheck = matches.value_of("spotcheck");
+    let original = matches
+        .value_of("scan")
+        .map(|path| -> Result<_, Error> {
+            let text = read_text_file(path)?;
+            AnyDocument::from_text(&text)
+                .with_context(|| format!("decode original document '{}'", path))
+        })
+        .transpose()?;
+
+    let mut reports = vec![];
+    let mut failed = 0;
+    for input_path in input_paths {
+        let verification = read_text_file(input_path)
+            .and_then(|text| Ok(AnyDocument::from_text(&text)?))
+            .map(|document| {
+                let verification = document.verify(expected_checksum);
+                let spotcheck = document.spotcheck();
+                (document, verification, spotcheck)
+            });
+        let (kind, spotcheck, checks) = match verification {
+            Ok((ref document, ref verification, ref spotcheck)) => {
+                let mut checks = verification
+                    .checks()
+                    .iter()
+                    .map(|(name, result)| match result {
+                        CheckResult::Passed => (*name, "passed", None),
+                        CheckResult::Failed(reason) => (*name, "failed", Some(reason.clone())),
+                        CheckResult::Skipped(reason) => {
+                            (*name, "skipped", Some(reason.to_string()))
+                        }
+                    })
+                    .collect::<Vec<_>>();
+                if let Some(expected) = expected_spotcheck {
+                    checks.push(if paperback::spotcheck_matches(spotcheck, expected) {
+                        ("spotcheck", "passed", None)
+                    } else {
+                        (
+                            "spotcheck",
+                            "failed",
+                            Some(format!(
+                                "spot-check digits {} do not match expected digits {}",
+                                spotcheck, expected
+                            )),
+                        )
+                    });
+                }
+                if let Some(original) = &original {
+                    checks.push(if original.is_identical(document) {
+                        ("scan-match", "passed", None)
+                    } else {
+                        (
+                            "scan-match",
+                            "failed",
+                            Some(
+                                "scanned document differs from the original -- do not distribute this copy"
+                                    .to_string(),
+                            ),
+                        )
+                    });
+                }
+                (
+                    Some(verification.kind().name()),
+                    Some(spotcheck.clone()),
+                    checks,
+                )
+            }
+            Err(err) => (
+                None,
+                None,
+                vec![("well-formed", "failed", Some(format!("{:#}", err)))],
+            ),
+        };
+        let ok = checks.iter().all(|(_, result, _)| *result != "failed");
+        if !ok {
+            failed += 1;
+        }
+
+        if json_output() {
+            reports.push(serde_json::json!({
+                "path": input_path,
+                "kind": kind,
+                "spotcheck": spotcheck,
+                "ok": ok,
+                "checks": checks
+                    .iter()
+                    .map(|(name, result, reason)| serde_json::json!({
+                        "name": name,
+                        "result": result,
+                        "reason": reason,
+                    }))
+                    .collect::<Vec<_>>(),
+            }));
+        } else {
+            println!("{}: {}", input_path, kind.unwrap_or("unknown document"));
+            if let Some(spotcheck) = spotcheck {
+                println!("  spot-check digits: {}", spotcheck);
+            }
+            for (name, result, reason) in checks {
+                match reason {
+                    Some(reason) => println!("  {}: {} ({})", name, result, reason),
+                    None => println!("  {}: {}", name, result),
+                }
+            }
+        }
+    }
+
+    if json_output() {
+        print_json(&serde_json::json!({ "documents": reports }))?;
+        if failed > 0 {
+            process::exit(Failure::Other.exit_code());
+        }
+    }
+    if failed > 0 {
+        return Err(anyhow!("{} document(s) failed verification", failed));
+    }
+    Ok(())
+}
+
+/// Creation date to record in generated PDFs. Normally this is the current
+/// time, but it can be fixed (with --source-date-epoch or $SOURCE_DATE_EPOCH) so
+/// that the same sheets always produce exactly the same PDF.
+fn pdf_created_at(matches: &ArgMatches<'_>) -> Result<SystemTime, Error> {
+    let epoch = match matches.value_of("source_date_epoch") {
+        Some(epoch) => epoch.to_string(),
+        None => match env::var("SOURCE_DATE_EPOCH") {
+            Ok(epoch) if !epoch.is_empty() => epoch,
+            _ => return Ok(SystemTime::now()),
+        },
+    };
+    let secs = epoch.parse::<u64>().map_err(|err| {
+        failure!(
+            Failure::Usage,
+            "invalid source date epoch '{}': {}",
+            epoch,
+            err
+        )
+    })?;
+    Ok(UNIX_EPOCH + Duration::from_secs(secs))
+}
+
+/// Formats `time` as an ISO 8601 date and time in UTC.
+fn format_utc(time: SystemTime) -> String {
+    let secs = time
+        .duration_since(UNIX_EPOCH)
+        .map(|duration| duration.as_secs())
+        .unwrap_or(0);
+    let (days, secs) = (secs / 86400, secs % 86400);
+
+    // Convert days since the epoch to a civil date, using the algorithm from
+    // <http://howardhinnant.github.io/date_algorithms.html#civil_from_days>.
+    let z = days + 719_468;
+    let era = z / 146_097;
+    let doe = z - era * 146_097;
+    let yoe = (doe - doe / 1460 + doe / 36524 - doe / 146_096) / 365;
+    let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+    let mp = (5 * doy + 2) / 153;
+    let day = doy - (153 * mp + 2) / 5 + 1;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 };
+    let year = yoe + era * 400 + if month <= 2 { 1 } else { 0 };
+
+    format!(
+        "{:04}-{:02}-{:02}T{:02}:{:02}:{:02}Z",
+        year,
+        month,
+        day,
+        secs / 3600,
+        secs / 60 % 60,
+        secs % 60
+    )
+}
+
+fn raw_inspect(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::AnyDocument;
+    use serde_json::Value;
+
+    let input_path = matches
+        .value_of("INPUT")
+        .expect("required INPUT argument not given");
+
+    let document = AnyDocument::from_text(&read_text_file(input_path)?)
+        .with_context(|| format!("decode document '{}'", input_path))?;
+
+    // (human-readable name, json key, value) of each piece of metadata.
+    let mut metadata: Vec<(&str, &str, Value)> =
+        vec![("Type", "type", document.kind().name().into())];
+    let time = |time: Option<SystemTime>| -> Value { time.map(format_utc).into() };
+    let decrypted_shard = match document {
+        AnyDocument::EncryptedKeyShard(ref shard) if matches.is_present("decrypt") => {
+            let codewords = prompt_codewords(1, shard.language())?;
+            Some(shard.decrypt(&codewords).context("decrypting shard")?)
+        }
+        AnyDocument::KeyShard(ref shard) => Some(shard.clone()),
+        _ => None,
+    };
+    match (&document, decrypted_shard) {
+        (AnyDocument::MainDocument(main), _) => {
+            metadata.extend(vec![
+                ("Schema-Version", "version", main.version().into()),
+                ("Document-ID", "document_id", main.id().into()),
+                ("Checksum", "checksum", main.checksum_string().into()),
+                ("Quorum-Size", "quorum_size", main.quorum_size().into()),
+                ("Created", "created_at", time(main.created_at())),
+                ("Review-By", "review_by", time(main.review_by())),
+                (
+                    "Compression",
+                    "compression",
+                    main.compression()
+                        .map(|compression| format!("{:?}", compression))
+                        .into(),
+                ),
+                (
+                    "Escrow-Recipients",
+                    "escrow_recipients",
+                    main.escrow_recipients()
+                        .map(|escrow| escrow.recipients().join(", "))
+                        .into(),
+                ),
+                (
+                    "Key-Fingerprint",
+                    "id_fingerprint",
+                    main.id_fingerprint().into(),
+                ),
+            ]);
+        }
+        (_, Some(shard)) => {
+            metadata.extend(vec![
+                ("Schema-Version", "version", shard.version().into()),
+                ("Document-ID", "document_id", shard.document_id().into()),
+                ("Shard-ID", "shard_id", shard.id().into()),
+                ("Quorum-Size", "quorum_size", shard.quorum_size().into()),
+                (
+                    "Shards",
+                    "shards",
+                    shard.roster().map(|roster| roster.total()).into(),
+                ),
+                ("Label", "label", shard.label().into()),
+                ("Holder", "holder", shard.holder().into()),
+                ("Contact", "contact", shard.contact().into()),
+                ("Note", "note", shard.note().into()),
+                (
+                    "Codeword-Language",
+                    "language",
+                    shard.language().name().into(),
+                ),
+                (
+                    "Revokes-Document",
+                    "revokes_checksum",
+                    shard
+                        .revocation()
+                        .map(|revocation| revocation.document_checksum_string())
+                        .into(),
+                ),
+                (
+                    "Revoked-Shards",
+                    "revoked_shard_ids",
+                    shard
+                        .revocation()
+                        .map(|revocation| revocation.shard_ids().join(", "))
+                        .into(),
+                ),
+                ("Created", "created_at", time(shard.created_at())),
+                ("Review-By", "review_by", time(shard.review_by())),
+                (
+                    "Key-Fingerprint",
+                    "id_fingerprint",
+                    shard.id_fingerprint().into(),
+                ),
+            ]);
+        }
+        (AnyDocument::EncryptedKeyShard(shard), None) => metadata.extend(vec![
+            (
+                "Codeword-Language",
+                "language",
+                shard.language().name().into(),
+            ),
+            (
+                "Note",
+                "note",
+                "the key shard is encrypted (use --decrypt to show its metadata)".into(),
+            ),
+        ]),
+        (AnyDocument::AuditResponse(response), _) => {
+            metadata.push(("Shard-ID", "shard_id", response.shard_id().into()))
+        }
+        (AnyDocument::Page(page), _) => metadata.extend(vec![
+            ("Page", "page", page.number().into()),
+            ("Pages", "pages", page.total().into()),
+            ("Intact", "intact", page.is_intact().into()),
+        ]),
+        (AnyDocument::KeyShard(_), None) => unreachable!("key shards are always inspected"),
+    }
+
+    if json_output() {
+        let object = metadata
+            .into_iter()
+            .map(|(_, key, value)| (key.to_string(), value))
+            .collect::<serde_json::Map<_, _>>();
+        return print_json(&Value::Object(object));
+    }
+    for (name, _, value) in metadata {
+        match value {
+            Value::Null => (),
+            Value::String(value) => println!("{}: {}", name, value),
+            value => println!("{}: {}", name, value),
+        }
+    }
+    Ok(())
+}
+
+/// Prints `rows` as a table with aligned columns under `header`.
+fn print_table(header: &[&str], rows: &[Vec<String>]) {
+    let mut widths = header.iter().map(|name| name.len()).collect::<Vec<_>>();
+    for row in rows {
+        for (width, cell) in widths.iter_mut().zip(row) {
+            *width = (*width).max(cell.chars().count());
+        }
+    }
+    let print_row = |cells: Vec<&str>| {
+        let line = cells
+            .iter()
+            .zip(&widths)
+            .map(|(cell, width)| format!("{:<width$}", cell, width = width))
+            .collect::<Vec<_>>()
+            .join("  ");
+        println!("{}", line.trim_end());
+    };
+    print_row(header.to_vec());
+    for row in rows {
+        print_row(row.iter().map(String::as_str).collect());
+    }
+}
+
+fn raw_group(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::{AnyDocument, Type};
+    use serde_json::Value;
+
+    let input_paths = matches
+        .values_of("INPUT")
+        .expect("required INPUT argument not given");
+
+    struct Input<'a> {
+        path: &'a str,
+        kind: Option<&'static str>,
+        document: Option<Type>,
+        // (status, reason) -- the status of grouped documents is only known
+        // once all of the inputs have been read.
+        status: Option<(&'static str, Option<String>)>,
+    }
+
+    let mut inputs = vec![];
+    for (idx, path) in input_paths.enumerate() {
+        let document = read_text_file(path).and_then(|text| Ok(AnyDocument::from_text(&text)?));
+        let input = match document {
+            Err(err) => Input {
+                path,
+                kind: None,
+                document: None,
+                status: Some(("invalid", Some(format!("{:#}", err)))),
+            },
+            Ok(document) => {
+                let kind = Some(document.kind().name());
+                let (document, status) = match document {
+                    AnyDocument::MainDocument(main) => (Some(Type::from(main)), None),
+                    AnyDocument::KeyShard(shard) => (Some(Type::from(shard)), None),
+                    AnyDocument::EncryptedKeyShard(shard) if matches.is_present("decrypt") => {
+                        promptln!("Decrypting '{}'.", path);
+                        let codewords = prompt_codewords(idx + 1, shard.language())?;
+                        match shard.decrypt(&codewords) {
+                            Ok(shard) => (Some(Type::from(shard)), None),
+                            Err(err) => (None, Some(("invalid", Some(err.to_string())))),
+                        }
+                    }
+                    AnyDocument::EncryptedKeyShard(_) => (
+                        None,
+                        Some((
+                            "encrypted",
+                            Some("use --decrypt to find its backup".to_string()),
+                        )),
+                    ),
+                    _ => (
+                        None,
+                        Some((
+                            "ungrouped",
+                            Some("only main documents and key shards are grouped".to_string()),
+                        )),
+                    ),
+                };
+                Input {
+                    path,
+                    kind,
+                    document,
+                    status,
+                }
+            }
+        };
+        inputs.push(input);
+    }
+
+    let groups = paperback::group_documents(
+        inputs
+            .iter()
+            .filter_map(|input| input.document.clone())
+            .collect::<Vec<_>>(),
+    );
+
+    // (document ID, key fingerprint, shard ID) of a grouped document.
+    let identify = |document: &Type| match document {
+        Type::MainDocument(main) | Type::ForgedMainDocument(main) => {
+            (main.id(), main.id_fingerprint(), None)
+        }
+        Type::KeyShard(shard) | Type::ForgedKeyShard(shard) => (
+            shard.document_id(),
+            shard.id_fingerprint(),
+            Some(shard.id()),
+        ),
+    };
+
+    // Work out which grouped documents are forged or duplicates of an earlier
+    // input.
+    let mut seen: Vec<(_, &str)> = vec![];
+    for input in inputs.iter_mut() {
+        if let Some(ref document) = input.document {
+            let id = identify(document);
+            input.status = Some(match document {
+                Type::ForgedMainDocument(_) | Type::ForgedKeyShard(_) => {
+                    ("forged", Some("signature verification failed".to_string()))
+                }
+                _ => match seen.iter().find(|(other, _)| *other == id) {
+                    Some((_, path)) => ("duplicate", Some(format!("same as '{}'", path))),
+                    None => {
+                        seen.push((id, input.path));
+                        ("valid", None)
+                    }
+                },
+            });
+        }
+    }
+
+    let backup_status = |group: &paperback::DocumentGroup| -> String {
+        let main = if group.has_main_document() {
+            ""
+        } else {
+            ", main document missing"
+        };
+        match group.shards_needed() {
+            0 if group.has_main_document() => "recoverable".to_string(),
+            0 => format!("quorum reached{}", main),
+            needed => format!("needs {} more shard(s){}", needed, main),
+        }
+    };
+
+    if json_output() {
+        return print_json(&serde_json::json!({
+            "inputs": inputs
+                .iter()
+                .map(|input| {
+                    let (document_id, shard_id, label) = match input.document {
+                        Some(Type::MainDocument(ref main))
+                        | Some(Type::ForgedMainDocument(ref main)) => {
+                            (Some(main.id()), None, None)
+                        }
+                        Some(Type::KeyShard(ref shard))
+                        | Some(Type::ForgedKeyShard(ref shard)) => (
+                            Some(shard.document_id()),
+                            Some(shard.id()),
+                            shard.label().map(str::to_string),
+                        ),
+                        None => (None, None, None),
+                    };
+                    let (status, reason) = input.status.clone().expect("every input has a status");
+                    serde_json::json!({
+                        "path": input.path,
+                        "type": input.kind,
+                        "document_id": document_id,
+                        "shard_id": shard_id,
+                        "label": label,
+                        "status": status,
+                        "reason": reason,
+                    })
+                })
+                .collect::<Vec<_>>(),
+            "backups": groups
+                .iter()
+                .map(|group| serde_json::json!({
+                    "document_id": group.document_id(),
+                    "id_fingerprint": group.id_fingerprint(),
+                    "quorum_size": group.quorum_size(),
+                    "main_document": group.has_main_document(),
+                    "shard_ids": group.shard_ids(),
+                    "shards_needed": group.shards_needed(),
+                    "duplicates": group.duplicates(),
+                    "forged": group.forged(),
+                    "recoverable": group.is_recoverable(),
+                }))
+                .collect::<Vec<Value>>(),
+        }));
+    }
+
+    let rows = inputs
+        .iter()
+        .map(|input| {
+            let (document_id, shard) = match input.document {
+                Some(Type::MainDocument(ref main)) | Some(Type::ForgedMainDocument(ref main)) => {
+                    (main.id(), "-".to_string())
+                }
+                Some(Type::KeyShard(ref shard)) | Some(Type::ForgedKeyShard(ref shard)) => (
+                    shard.document_id(),
+                    match shard.label() {
+                        Some(label) => format!("{} ({})", shard.id(), label),
+                        None => shard.id(),
+                    },
+                ),
+                None => ("?".to_string(), "?".to_string()),
+            };
+            let status = match input.status {
+                Some((status, Some(ref reason))) => format!("{} ({})", status, reason),
+                Some((status, None)) => status.to_string(),
+                None => unreachable!("every input has a status"),
+            };
+            vec![
+                input.path.to_string(),
+                input.kind.unwrap_or("unknown").to_string(),
+                document_id,
+                shard,
+                status,
+            ]
+        })
+        .collect::<Vec<_>>();
+    print_table(&["PATH", "TYPE", "DOCUMENT", "SHARD", "STATUS"], &rows);
+
+    if !groups.is_empty() {
+        println!();
+        let rows = groups
+            .iter()
+            .map(|group| {
+                vec![
+                    group.document_id(),
+                    group.id_fingerprint(),
+                    format!("{}/{}", group.shard_ids().len(), group.quorum_size()),
+                    if group.has_main_document() {
+                        "yes"
+                    } else {
+                        "no"
+                    }
+                    .to_string(),
+                    group.duplicates().to_string(),
+                    group.forged().to_string(),
+                    backup_status(group),
+                ]
+            })
+            .collect::<Vec<_>>();
+        print_table(
+            &[
+                "DOCUMENT",
+                "KEY-FINGERPRINT",
+                "SHARDS",
+                "MAIN",
+                "DUPLICATES",
+                "FORGED",
+                "STATUS",
+            ],
+            &rows,
+        );
+    }
+    Ok(())
+}
+
+fn raw_keyword(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::{AnyDocument, QrErrorCorrection, Sheet};
+
+    let input_path = matches
+        .value_of("INPUT")
+        .expect("required INPUT argument not given");
+
+    let stdout_outputs = ["pdf", "html", "latex", "svg"]
+        .iter()
+        .filter(|name| matches.value_of(name) == Some("-"))
+        .count();
+    if stdout_outputs > 1 {
+        return Err(failure!(
+            Failure::Usage,
+            "invalid arguments: only one of --pdf, --html, --latex and --svg can be written to stdout"
+        ));
+    }
+    let printable_to_stdout = stdout_outputs > 0;
+    if printable_to_stdout && json_output() {
+        return Err(failure!(
+            Failure::Usage,
+            "invalid arguments: printable output cannot be written to stdout in --json mode"
+        ));
+    }
+
+    let document = AnyDocument::from_text(&read_text_file(input_path)?)
+        .with_context(|| format!("decode document '{}'", input_path))?;
+    // The codewords of an encrypted key shard cannot be recovered from the
+    // shard, so they have to be known already. A decrypted key shard is
+    // encrypted again instead, with new codewords.
+    let (shard, decrypted_shard, codewords, reencrypted) = match document {
+        AnyDocument::EncryptedKeyShard(shard) => {
+            check_pdf_language(matches, shard.language())?;
+            let codewords = prompt_codewords(1, shard.language())?;
+            let decrypted_shard = shard.decrypt(&codewords).context("decrypting shard")?;
+            (shard, decrypted_shard, codewords, false)
+        }
+        AnyDocument::KeyShard(decrypted_shard) => {
+            check_pdf_language(matches, decrypted_shard.language())?;
+            let (shard, codewords) = decrypted_shard.encrypt().context("re-encrypting shard")?;
+            (shard, decrypted_shard, codewords, true)
+        }
+        document => {
+            return Err(failure!(
+                Failure::Usage,
+                "'{}' is a {}, not a key shard",
+                input_path,
+                document.kind().name()
+            ))
+        }
+    };
+
+    // A re-encrypted shard has to be printed again as well, since the old
+    // encrypted shard cannot be decrypted with the new codewords.
+    let mut sheets = vec![];
+    if reencrypted {
+        sheets.push(Sheet::key_shard(
+            &shard,
+            &codewords,
+            QrErrorCorrection::default(),
+        )?);
+    }
+    sheets.push(Sheet::key_shard_codewords(&shard, &codewords)?);
+    let layout = page_layout(matches)?.show_codewords(true);
+    let title = format!("paperback {}", decrypted_shard.id());
+    if let Some(pdf_path) = matches.value_of("pdf") {
+        let pdf = paperback::sheets_to_pdf(&title, &sheets, &layout)?;
+        write_output_file(pdf_path, pdf, "pdf")?;
+    }
+    if let Some(html_path) = matches.value_of("html") {
+        let html = paperback::sheets_to_html(&title, &sheets, &layout);
+        write_output_file(html_path, html, "html")?;
+    }
+    if let Some(latex_path) = matches.value_of("latex") {
+        let latex = paperback::sheets_to_latex(&title, &sheets, &layout);
+        write_output_file(latex_path, latex, "latex")?;
+    }
+    if let Some(svg_path) = matches.value_of("svg") {
+        let svg = paperback::sheet_to_svg(&sheets[sheets.len() - 1], &layout);
+        write_output_file(svg_path, svg, "svg")?;
+    }
+    let audit_log_head = record_distribution(
+        matches,
+        paperback::DistributionEvent::Reprinted,
+        &decrypted_shard.document_id(),
+        &[decrypted_shard.id()],
+    )?;
+    if printable_to_stdout {
+        return Ok(());
+    }
+
+    if json_output() {
+        let mut shard_json = shard_json(&shard, &codewords);
+        shard_json["codewords_checksum"] = paperback::codewords_checksum(&codewords).into();
+        shard_json["reencrypted"] = reencrypted.into();
+        shard_json["audit_log_head"] = audit_log_head.into();
+        return print_json(&shard_json);
+    }
+
+    println!("Document-ID: {}", decrypted_shard.document_id());
+    println!("Shard-ID: {}", decrypted_shard.id());
+    println!("Keywords: {}", codewords.join(" "));
+    println!(
+        "Codeword-Checksum: #{}",
+        paperback::codewords_checksum(&codewords)
+    );
+    // Writing down the head of the log makes it possible to tell later on
+    // whether entries were removed from the end of the log.
+    if let Some(audit_log_head) = audit_log_head {
+        println!("Audit-Log-Head: {}", audit_log_head);
+    }
+    if reencrypted {
+        println!();
+        println!("The shard was encrypted again with new keywords, so this new encrypted shard");
+        println!("must replace the old one (which cannot be decrypted with the new keywords):");
+        println!("\n{}", shard.to_wire_zbase32());
+    }
+    Ok(())
+}
+
+/// Returns the matches for "raw backup" with `args` (and `input` as the INPUT
+/// argument), as stored in a work package by "raw prepare".
+fn backup_matches_from(args: &[String], input: &str) -> Result<ArgMatches<'static>, Error> {
+    let argv = ["paperback-cli", "raw", "backup"]
+        .iter()
+        .map(|arg| arg.to_string())
+        .chain(args.iter().cloned())
+        .chain(std::iter::once(input.to_string()));
+    let matches = cli()
+        .get_matches_from_safe(argv)
+        .map_err(|err| failure!(Failure::Usage, "invalid backup arguments: {}", err.message))?;
+    Ok(matches
+        .subcommand_matches("raw")
+        .and_then(|raw_matches| raw_matches.subcommand_matches("backup"))
+        .cloned()
+        .expect("parsed arguments must contain the raw backup subcommand"))
+}
+
+fn raw_prepare(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::WorkPackage;
+
+    let package_path = matches
+        .value_of("package")
+        .expect("required --package argument not given");
+    let args = matches
+        .values_of("ARGS")
+        .into_iter()
+        .flatten()
+        .map(String::from)
+        .collect::<Vec<_>>();
+
+    // Check the arguments now, rather than only finding out they are wrong on
+    // the air-gapped machine. The secret data is never read here.
+    let backup_matches = backup_matches_from(&args, "-")?;
+    if backup_matches.is_present("timestamp_command") {
+        return Err(failure!(
+            Failure::Usage,
+            "invalid arguments: --timestamp-command cannot be used on an air-gapped machine"
+        ));
+    }
+    if backup_matches.is_present("audit_log") || backup_matches.is_present("audit_key") {
+        return Err(failure!(
+            Failure::Usage,
+            "invalid arguments: the audit log cannot be carried in a work package"
+        ));
+    }
+
+    let package = WorkPackage::new("backup", args)?;
+    fs::write(package_path, package.to_text())
+        .with_context(|| format!("failed to write work package to '{}'", package_path))?;
+
+    if json_output() {
+        return print_json(&serde_json::json!({
+            "package": package_path,
+            "code": package.code(),
+        }));
+    }
+    println!("Work package written to '{}'.", package_path);
+    println!("Package-Code: {}", package.code());
+    println!("Copy the work package to the air-gapped machine and run \"raw finalize\" there, entering the package code above when asked. Do not copy the code over along with the package -- it is what shows that the package was not modified on the way.");
+    Ok(())
+}
+
+fn raw_finalize(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::WorkPackage;
+
+    let package_path = matches
+        .value_of("package")
+        .expect("required --package argument not given");
+    let input_path = matches
+        .value_of("INPUT")
+        .expect("required INPUT argument not given");
+
+    let text = fs::read_to_string(package_path)
+        .with_context(|| format!("failed to read work package '{}'", package_path))?;
+    let code = match matches.value_of("code") {
+        Some(code) => code.to_string(),
+        None => {
+            prompt!("Package code (as shown by \"raw prepare\"): ");
+            let mut code = String::new();
+            io::stdin().read_line(&mut code)?;
+            code
+        }
+    };
+    let package = WorkPackage::from_text(&text, &code)
+        .with_context(|| format!("open work package '{}'", package_path))?;
+    if package.command() != "backup" {
+        return Err(failure!(
+            Failure::Usage,
+            "unsupported work package command '{}'",
+            package.command()
+        ));
+    }
+    promptln!(
+        "Work package verified: raw backup {}",
+        package.args().join(" ")
+    );
+
+    raw_backup(&backup_matches_from(package.args(), input_path)?)
+}
+
+/// Records `event` for the shards `shard_ids` of the document `document_id`
+/// in the distribution log given with --audit-log (if any), signed with the
+/// key from --audit-key. Returns the new head of the log.
+fn record_distribution(
+    matches: &ArgMatches<'_>,
+    event: paperback::DistributionEvent,
+    document_id: &str,
+    shard_ids: &[String],
+) -> Result<Option<String>, Error> {
+    use paperback::{DistributionLog, DistributionLogKey};
+
+    let log_path = match matches.value_of("audit_log") {
+        Some(log_path) => log_path,
+        None => return Ok(None),
+    };
+    let key_path = matches.value_of("audit_key").ok_or_else(|| {
+        failure!(
+            Failure::Usage,
+            "invalid arguments: --audit-log requires --audit-key"
+        )
+    })?;
+
+    let key = DistributionLogKey::from_zbase32(
+        &fs::read_to_string(key_path)
+            .with_context(|| format!("failed to read audit log key '{}'", key_path))?,
+    )?;
+    let mut log = DistributionLog::from_text(
+        &fs::read_to_string(log_path)
+            .with_context(|| format!("failed to read audit log '{}'", log_path))?,
+    )
+    .with_context(|| format!("decode audit log '{}'", log_path))?;
+    // Never extend a log which has already been tampered with.
+    log.verify()
+        .with_context(|| format!("verify audit log '{}'", log_path))?;
+    log.append(
+        &key,
+        SystemTime::now(),
+        event,
+        document_id,
+        shard_ids,
+        matches.value_of("audit_note"),
+    )?;
+    fs::write(log_path, log.to_text())
+        .with_context(|| format!("failed to write audit log '{}'", log_path))?;
+    Ok(Some(log.head()))
+}
+
+fn raw_audit_log_init(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::{DistributionLog, DistributionLogKey};
+
+    let log_path = matches
+        .value_of("LOG")
+        .expect("required LOG argument not given");
+    let key_path = matches
+        .value_of("key")
+        .expect("required --key argument not given");
+
+    for path in &[log_path, key_path] {
+        if Path::new(path).exists() {
+            return Err(failure!(
+                Failure::Usage,
+                "'{}' already exists and will not be overwritten",
+                path
+            ));
+        }
+    }
+
+    let key = DistributionLogKey::generate();
+    let log = DistributionLog::new(key.public_key());
+    fs::write(key_path, format!("{}\n", key.to_zbase32()))
+        .with_context(|| format!("failed to write audit log key '{}'", key_path))?;
+    fs::write(log_path, log.to_text())
+        .with_context(|| format!("failed to write audit log '{}'", log_path))?;
+
+    if json_output() {
+        return print_json(&serde_json::json!({
+            "log": log_path,
+            "key": key_path,
+            "fingerprint": log.fingerprint(),
+            "head": log.head(),
+        }));
+    }
+    println!("Audit-Log: {}", log_path);
+    println!("Audit-Key: {} (keep this separate from the log)", key_path);
+    println!("Key-Fingerprint: {}", log.fingerprint());
+    Ok(())
+}
+
+fn raw_audit_log_verify(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::DistributionLog;
+
+    let log_path = matches
+        .value_of("LOG")
+        .expect("required LOG argument not given");
+
+    let log = DistributionLog::from_text(&read_text_file(log_path)?)
+        .with_context(|| format!("decode audit log '{}'", log_path))?;
+    let mut failures = vec![];
+    if let Err(err) = log.verify() {
+        failures.push(err.to_string());
+    }
+    if let Some(fingerprint) = matches.value_of("fingerprint") {
+        if fingerprint != log.fingerprint() {
+            failures.push(format!(
+                "log is signed by key {} rather than {} -- the log was replaced",
+                log.fingerprint(),
+                fingerprint
+            ));
+        }
+    }
+    if let Some(head) = matches.value_of("head") {
+        if !log.contains_head(head) {
+            failures.push(format!(
+                "log does not contain head {} -- entries were removed or modified",
+                head
+            ));
+        }
+    }
+
+    if json_output() {
+        print_json(&serde_json::json!({
+            "fingerprint": log.fingerprint(),
+            "entries": log.entries().len(),
+            "head": log.head(),
+            "valid": failures.is_empty(),
+            "failures": failures,
+        }))?;
+        if !failures.is_empty() {
+            process::exit(Failure::Other.exit_code());
+        }
+        return Ok(());
+    }
+    println!("Key-Fingerprint: {}", log.fingerprint());
+    println!("Entries: {}", log.entries().len());
+    println!("Head: {}", log.head());
+    for failure in &failures {
+        println!("FAILED: {}", failure);
+    }
+    if !failures.is_empty() {
+        return Err(anyhow!("audit log '{}' failed to verify", log_path));
+    }
+    println!("Audit log verified.");
+    Ok(())
+}
+
+fn raw_audit_log_show(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::DistributionLog;
+
+    let log_path = matches
+        .value_of("LOG")
+        .expect("required LOG argument not given");
+
+    let log = DistributionLog::from_text(&read_text_file(log_path)?)
+        .with_context(|| format!("decode audit log '{}'", log_path))?;
+    // Showing an unverified history would be misleading.
+    log.verify()
+        .with_context(|| format!("verify audit log '{}'", log_path))?;
+
+    if json_output() {
+        return print_json(&serde_json::json!({
+            "fingerprint": log.fingerprint(),
+            "head": log.head(),
+            "entries": log
+                .entries()
+                .iter()
+                .map(|entry| serde_json::json!({
+                    "seq": entry.seq(),
+                    "time": format_utc(entry.time()),
+                    "event": entry.event().name(),
+                    "document_id": entry.document_id(),
+                    "shard_ids": entry.shard_ids(),
+                    "note": entry.note(),
+                }))
+                .collect::<Vec<_>>(),
+        }));
+    }
+    let rows = log
+        .entries()
+        .iter()
+        .map(|entry| {
+            vec![
+                entry.seq().to_string(),
+                format_utc(entry.time()),
+                entry.event().name().to_string(),
+                entry.document_id().to_string(),
+                entry.shard_ids().join(", "),
+                entry.note().unwrap_or("").to_string(),
+            ]
+        })
+        .collect::<Vec<_>>();
+    print_table(
+        &["SEQ", "TIME", "EVENT", "DOCUMENT", "SHARDS", "NOTE"],
+        &rows,
+    );
+    Ok(())
+}
+
+fn raw_audit_log(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    match matches.subcommand() {
+        ("init", Some(sub_matches)) => raw_audit_log_init(sub_matches),
+        ("verify", Some(sub_matches)) => raw_audit_log_verify(sub_matches),
+        ("show", Some(sub_matches)) => raw_audit_log_show(sub_matches),
+        (subcommand, _) => Err(anyhow!("unknown subcommand 'raw audit-log {}'", subcommand)),
+    }
+}
+
+fn raw(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    match matches.subcommand() {
+        ("backup", Some(sub_matches)) => raw_backup(sub_matches),
+        ("batch-backup", Some(sub_matches)) => raw_batch_backup(sub_matches),
+        ("restore", Some(sub_matches)) => raw_restore(sub_matches),
+        ("test-restore", Some(sub_matches)) => raw_test_restore(sub_matches),
+        ("recover", Some(sub_matches)) => raw_recover(sub_matches),
+        ("recover-escrow", Some(sub_matches)) => raw_recover_escrow(sub_matches),
+        ("expand", Some(sub_matches)) => raw_expand(sub_matches),
+        ("reshard", Some(sub_matches)) => raw_reshard(sub_matches),
+        ("schema", Some(sub_matches)) => raw_schema(sub_matches),
+        ("validate", Some(sub_matches)) => raw_validate(sub_matches),
+        ("verify", Some(sub_matches)) => raw_verify(sub_matches),
+        ("inspect", Some(sub_matches)) => raw_inspect(sub_matches),
+        ("group", Some(sub_matches)) => raw_group(sub_matches),
+        ("keyword", Some(sub_matches)) => raw_keyword(sub_matches),
+        ("audit-log", Some(sub_matches)) => raw_audit_log(sub_matches),
+        ("prepare", Some(sub_matches)) => raw_prepare(sub_matches),
+        ("finalize", Some(sub_matches)) => raw_finalize(sub_matches),
+        (subcommand, _) => Err(anyhow!("unknown subcommand 'raw {}'", subcommand)),
+    }
+}
+
+/// Parses a probability given on the command line (either as a fraction, or as
+/// a percentage such as "5%").
+fn parse_probability(arg: &str, value: &str) -> Result<f64, Error> {
+    let p = match value.strip_suffix('%') {
+        Some(percent) => percent.parse::<f64>().map(|p| p / 100.0),
+        None => value.parse::<f64>(),
+    };
+    p.ok().filter(|p| (0.0..=1.0).contains(p)).ok_or_else(|| {
+        failure!(
+            Failure::Usage,
+            "invalid {} '{}': must be a probability between 0 and 1 (or 0% and 100%)",
+            arg,
+            value
+        )
+    })
+}
+
+fn simulate(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::HolderRisk;
+
+    let holders = match matches.values_of("holder") {
+        Some(holders) => holders
+            .map(|holder| {
+                let (loss, compromise) = holder.split_once(':').ok_or_else(|| {
+                    failure!(
+                        Failure::Usage,
+                        "invalid --holder '{}': must be LOSS:COMPROMISE",
+                        holder
+                    )
+                })?;
+                Ok(HolderRisk::new(
+                    parse_probability("--holder loss probability", loss)?,
+                    parse_probability("--holder compromise probability", compromise)?,
+                )?)
+            })
+            .collect::<Result<Vec<_>, Error>>()?,
+        None => {
+            let max_shards: usize = matches
+                .value_of("max_shards")
+                .expect("invalid --max-shards argument")
+                .parse()
+                .context("--max-shards argument was not an unsigned integer")?;
+            let risk = HolderRisk::new(
+                parse_probability(
+                    "--loss",
+                    matches.value_of("loss").expect("invalid --loss argument"),
+                )?,
+                parse_probability(
+                    "--compromise",
+                    matches
+                        .value_of("compromise")
+                        .expect("invalid --compromise argument"),
+                )?,
+            )?;
+            vec![risk; max_shards]
+        }
+    };
+    let trials: u32 = matches
+        .value_of("trials")
+        .expect("invalid --trials argument")
+        .parse()
+        .context("--trials argument was not an unsigned integer")?;
+    let quorum_size = matches
+        .value_of("quorum_size")
+        .map(|k| k.parse::<u32>())
+        .transpose()
+        .context("--quorum-size argument was not an unsigned integer")?;
+    let shards = matches
+        .value_of("shards")
+        .map(|n| n.parse::<u32>())
+        .transpose()
+        .context("--shards argument was not an unsigned integer")?;
+
+    // Every (k, n) which can be handed out to the holders, unless narrowed
+    // down by --quorum-size and --shards.
+    let candidates = (1..=holders.len() as u32)
+        .filter(|n| shards.map_or(true, |shards| shards == *n))
+        .flat_map(|n| (1..=n).map(move |k| (k, n)))
+        .filter(|(k, _)| quorum_size.map_or(true, |quorum_size| quorum_size == *k))
+        .collect::<Vec<_>>();
+    if candidates.is_empty() {
+        return Err(failure!(
+            Failure::Usage,
+            "invalid arguments: no quorum size and number of shards to simulate for {} holders",
+            holders.len()
+        ));
+    }
+
+    let results = with_progress("Simulating", || {
+        paperback::simulate(&mut rand::thread_rng(), &holders, &candidates, trials)
+    })?;
+
+    if json_output() {
+        return print_json(&serde_json::json!({
+            "trials": trials,
+            "results": results
+                .iter()
+                .map(|result| serde_json::json!({
+                    "quorum_size": result.quorum_size,
+                    "shards": result.shards,
+                    "loss_probability": result.loss_probability(),
+                    "compromise_probability": result.compromise_probability(),
+                }))
+                .collect::<Vec<_>>(),
+        }));
+    }
+    let rows = results
+        .iter()
+        .map(|result| {
+            vec![
+                result.quorum_size.to_string(),
+                result.shards.to_string(),
+                format!("{:.4}%", 100.0 * result.loss_probability()),
+                format!("{:.4}%", 100.0 * result.compromise_probability()),
+            ]
+        })
+        .collect::<Vec<_>>();
+    print_table(&["K", "N", "P(LOST)", "P(ATTACKER QUORUM)"], &rows);
+    println!(
+        "Estimated from {} simulated lifetimes of the backup. A result of 0% only means the event never happened in the simulation.",
+        trials
+    );
+    Ok(())
+}
+
+fn selftest(_: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::CheckResult;
+
+    let checks = with_progress("Running self-test", paperback::selftest);
+    let failed = checks
+        .iter()
+        .filter(|(_, result)| matches!(result, CheckResult::Failed(_)))
+        .count();
+
+    if json_output() {
+        print_json(&serde_json::json!({
+            "ok": failed == 0,
+            "checks": checks
+                .iter()
+                .map(|(name, result)| match result {
+                    CheckResult::Passed => serde_json::json!({
+                        "name": name,
+                        "result": "passed",
+                        "reason": null,
+                    }),
+                    CheckResult::Failed(reason) => serde_json::json!({
+                        "name": name,
+                        "result": "failed",
+                        "reason": reason,
+                    }),
+                    CheckResult::Skipped(reason) => serde_json::json!({
+                        "name": name,
+                        "result": "skipped",
+                        "reason": reason,
+                    }),
+                })
+                .collect::<Vec<_>>(),
+        }))?;
+        if failed > 0 {
+            process::exit(Failure::Other.exit_code());
+        }
+    } else {
+        for (name, result) in &checks {
+            match result {
+                CheckResult::Passed => println!("{}: passed", name),
+                CheckResult::Failed(reason) => println!("{}: failed ({})", name, reason),
+                CheckResult::Skipped(reason) => println!("{}: skipped ({})", name, reason),
+            }
+        }
+    }
+    if failed > 0 {
+        return Err(anyhow!(
+            "{} self-test check(s) failed -- do not trust this binary",
+            failed
+        ));
+    }
+    Ok(())
+}
+
+/// Object read from stdin or written to stdout by the plumbing commands.
+type PlumbingObject = serde_json::Map<String, serde_json::Value>;
+
+/// Reads the input object of a plumbing command from stdin, in the format
+/// given with --format.
+fn read_plumbing_input(matches: &ArgMatches<'_>) -> Result<PlumbingObject, Error> {
+    let stdin = io::stdin();
+    let value: serde_json::Value = match matches.value_of("format") {
+        Some("cbor") => serde_cbor::from_reader(stdin.lock())
+            .map_err(|err| failure!(Failure::Usage, "invalid CBOR input: {}", err))?,
+        _ => serde_json::from_reader(stdin.lock())
+            .map_err(|err| failure!(Failure::Usage, "invalid JSON input: {}", err))?,
+    };
+    match value {
+        serde_json::Value::Object(object) => Ok(object),
+        _ => Err(failure!(Failure::Usage, "input must be a single object")),
+    }
+}
+
+/// Writes the output object of a plumbing command to stdout, in the format
+/// given with --format.
+fn write_plumbing_output(matches: &ArgMatches<'_>, value: serde_json::Value) -> Result<(), Error> {
+    match matches.value_of("format") {
+        Some("cbor") => {
+            let stdout = io::stdout();
+            let mut stdout = stdout.lock();
+            serde_cbor::to_writer(&mut stdout, &value)?;
+            stdout.flush()?;
+            Ok(())
+        }
+        _ => print_json(&value),
+    }
+}
+
+fn plumbing_string<'a>(input: &'a PlumbingObject, field: &str) -> Result<Option<&'a str>, Error> {
+    match input.get(field) {
+        None | Some(serde_json::Value::Null) => Ok(None),
+        Some(serde_json::Value::String(value)) => Ok(Some(value)),
+        Some(_) => Err(failure!(
+            Failure::Usage,
+            "field \"{}\" must be a string",
+            field
+        )),
+    }
+}
+
+fn required_string<'a>(input: &'a PlumbingObject, field: &str) -> Result<&'a str, Error> {
+    plumbing_string(input, field)?
+        .ok_or_else(|| failure!(Failure::Usage, "missing required field \"{}\"", field))
+}
+
+/// Binary data is passed to and from the plumbing commands as zbase32 strings
+/// with a multibase prefix ("h"), the same encoding used for documents.
+fn decode_plumbing_bytes(field: &str, data: &str) -> Result<Vec<u8>, Error> {
+    match (data.get(0..1), data.get(1..)) {
+        (Some("h"), Some(data)) => zbase32::decode_full_bytes_str(data).map_err(|err| {
+            failure!(
+                Failure::Usage,
+                "field \"{}\" is not valid zbase32: {}",
+                field,
+                err
+            )
+        }),
+        _ => Err(failure!(
+            Failure::Usage,
+            "field \"{}\" must be a zbase32 string starting with \"h\"",
+            field
+        )),
+    }
+}
+
+fn encode_plumbing_bytes<B: AsRef<[u8]>>(data: B) -> String {
+    format!("h{}", zbase32::encode_full_bytes(data.as_ref()))
+}
+
+fn plumbing_bytes(input: &PlumbingObject, field: &str) -> Result<Option<Vec<u8>>, Error> {
+    plumbing_string(input, field)?
+        .map(|data| decode_plumbing_bytes(field, data))
+        .transpose()
+}
+
+fn required_bytes(input: &PlumbingObject, field: &str) -> Result<Vec<u8>, Error> {
+    decode_plumbing_bytes(field, required_string(input, field)?)
+}
+
+fn required_u32(input: &PlumbingObject, field: &str) -> Result<u32, Error> {
+    input
+        .get(field)
+        .ok_or_else(|| failure!(Failure::Usage, "missing required field \"{}\"", field))?
+        .as_u64()
+        .filter(|value| *value <= u32::MAX as u64)
+        .map(|value| value as u32)
+        .ok_or_else(|| {
+            failure!(
+                Failure::Usage,
+                "field \"{}\" must be a positive integer",
+                field
+            )
+        })
+}
+
+fn shard_encrypt(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::{FromWire, KeyShard, ToWire};
+
+    let input = read_plumbing_input(matches)?;
+    let shard = KeyShard::from_wire_zbase32(required_string(&input, "shard")?)
+        .context("decode key shard")?;
+    let (encrypted_shard, codewords) = shard.encrypt().context("encrypt key shard")?;
+    write_plumbing_output(
+        matches,
+        serde_json::json!({
+            "shard": encrypted_shard.to_wire_zbase32(),
+            "codewords": codewords,
+        }),
+    )
+}
+
+fn shard_decrypt(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::{EncryptedKeyShard, FromWire, ToWire};
 
-        let codewords = codeword_input
-            .split_whitespace()
-            .map(|s| s.to_owned())
-            .collect::<Vec<_>>();
+    let input = read_plumbing_input(matches)?;
+    let encrypted_shard = EncryptedKeyShard::from_wire_zbase32(required_string(&input, "shard")?)
+        .context("decode encrypted key shard")?;
+    let codewords = input
+        .get("codewords")
+        .and_then(|codewords| codewords.as_array())
+        .and_then(|codewords| {
+            codewords
+                .iter()
+                .map(|word| word.as_str().map(String::from))
+                .collect::<Option<Vec<_>>>()
+        })
+        .ok_or_else(|| {
+            failure!(
+                Failure::Usage,
+                "field \"codewords\" must be a list of strings"
+            )
+        })?;
+    let shard = encrypted_shard
+        .decrypt(&codewords)
+        .context("decrypt key shard")?;
+    write_plumbing_output(
+        matches,
+        serde_json::json!({
+            "shard": shard.to_wire_zbase32(),
+        }),
+    )
+}
 
-        let shard = encrypted_shard
-            .decrypt(&codewords)
-            .map_err(|err| anyhow!(err)) // TODO: Fix this once FromWire supports non-String errors.
-            .with_context(|| format!("decrypting shard {}", idx + 1))?;
-        quorum.push_shard(shard);
+fn shard(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    match matches.subcommand() {
+        ("encrypt", Some(sub_matches)) => shard_encrypt(sub_matches),
+        ("decrypt", Some(sub_matches)) => shard_decrypt(sub_matches),
+        (subcommand, _) => Err(anyhow!("unknown subcommand 'shard {}'", subcommand)),
     }
+}
 
-    let quorum = match quorum.validate() {
-        Ok(validated_quorum) => validated_quorum,
-        Err(err) => {
-            // TODO: Make this error much cleaner.
-            return Err(anyhow!(
-                "quorum failed to validate -- possible forgery! groupings: {:?}",
-                err.as_groups()
-            ));
-        }
-    };
+fn key_split(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    let input = read_plumbing_input(matches)?;
+    let secret = required_bytes(&input, "secret")?;
+    let quorum_size = required_u32(&input, "quorum_size")?;
+    let shards = required_u32(&input, "shards")?;
+    if quorum_size == 0 || quorum_size > shards {
+        return Err(failure!(
+            Failure::Usage,
+            "quorum size {} is invalid for {} shards",
+            quorum_size,
+            shards
+        ));
+    }
+    let shards = paperback::split_secret(quorum_size, shards, &secret)?;
+    write_plumbing_output(
+        matches,
+        serde_json::json!({
+            "shards": shards.iter().map(encode_plumbing_bytes).collect::<Vec<_>>(),
+        }),
+    )
+}
 
-    let secret = quorum
-        .recover_document()
-        .context("recovering secret data")?;
+fn key_combine(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    let input = read_plumbing_input(matches)?;
+    let shards = input
+        .get("shards")
+        .and_then(|shards| shards.as_array())
+        .ok_or_else(|| failure!(Failure::Usage, "field \"shards\" must be a list of strings"))?
+        .iter()
+        .map(|shard| match shard.as_str() {
+            Some(shard) => decode_plumbing_bytes("shards", shard),
+            None => Err(failure!(
+                Failure::Usage,
+                "field \"shards\" must be a list of strings"
+            )),
+        })
+        .collect::<Result<Vec<_>, _>>()?;
+    let secret = paperback::combine_secret(&shards).context("combine shards")?;
+    write_plumbing_output(
+        matches,
+        serde_json::json!({
+            "secret": encode_plumbing_bytes(secret),
+        }),
+    )
+}
 
-    let mut output_file: Box<dyn Write + 'static> =
-        if output_path == "-" {
-            Box::new(io::stdout())
-        } else {
-            Box::new(File::create(output_path).with_context(|| {
-                format!("failed to open output file '{}' for writing", output_path)
-            })?)
-        };
+fn key(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    match matches.subcommand() {
+        ("split", Some(sub_matches)) => key_split(sub_matches),
+        ("combine", Some(sub_matches)) => key_combine(sub_matches),
+        (subcommand, _) => Err(anyhow!("unknown subcommand 'key {}'", subcommand)),
+    }
+}
 
-    output_file
-        .write_all(&secret)
-        .context("write secret data to file")?;
+fn packet_seal(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    let input = read_plumbing_input(matches)?;
+    let key = plumbing_bytes(&input, "key")?.unwrap_or_else(paperback::new_packet_key);
+    let aad = plumbing_bytes(&input, "aad")?.unwrap_or_default();
+    let plaintext = required_bytes(&input, "plaintext")?;
+    let (nonce, ciphertext) =
+        paperback::seal_packet(&key, &aad, &plaintext).context("seal packet")?;
+    write_plumbing_output(
+        matches,
+        serde_json::json!({
+            "key": encode_plumbing_bytes(key),
+            "nonce": encode_plumbing_bytes(nonce),
+            "ciphertext": encode_plumbing_bytes(ciphertext),
+        }),
+    )
+}
 
-    Ok(())
+fn packet_open(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    let input = read_plumbing_input(matches)?;
+    let key = required_bytes(&input, "key")?;
+    let nonce = required_bytes(&input, "nonce")?;
+    let aad = plumbing_bytes(&input, "aad")?.unwrap_or_default();
+    let ciphertext = required_bytes(&input, "ciphertext")?;
+    let plaintext =
+        paperback::open_packet(&key, &nonce, &aad, &ciphertext).context("open packet")?;
+    write_plumbing_output(
+        matches,
+        serde_json::json!({
+            "plaintext": encode_plumbing_bytes(plaintext),
+        }),
+    )
 }
 
-fn raw_expand(matches: &ArgMatches<'_>) -> Result<(), Error> {
-    use paperback::{EncryptedKeyShard, FromWire, ToWire, UntrustedQuorum};
+fn packet(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    match matches.subcommand() {
+        ("seal", Some(sub_matches)) => packet_seal(sub_matches),
+        ("open", Some(sub_matches)) => packet_open(sub_matches),
+        (subcommand, _) => Err(anyhow!("unknown subcommand 'packet {}'", subcommand)),
+    }
+}
 
-    let shard_paths = matches
-        .values_of("shards")
-        .expect("required --shard arguments not given");
-    let num_new_shards: u32 = matches
-        .value_of("new_shards")
-        .expect("required --new-shards argument not given")
-        .parse()
-        .context("--shards argument was not an unsigned integer")?;
+/// Completion of document paths for bash, wrapping the completion function
+/// generated by clap. "@BIN@" is replaced with the name of the binary.
+const BASH_DOCUMENT_COMPLETION: &str = r#"
+_@BIN@_documents() {
+    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"
+    local word subcommand= kind=
+    for word in "${COMP_WORDS[@]:1:COMP_CWORD-1}"; do
+        case "${word}" in
+            backup|batch-backup|restore|test-restore|recover|expand|reshard|verify|inspect|group|keyword)
+                [[ -z "${subcommand}" ]] && subcommand="${word}" ;;
+        esac
+    done
+    case "${subcommand}:${prev}" in
+        restore:-M|restore:--main-document|test-restore:-M|test-restore:--main-document|reshard:-M|reshard:--main-document)
+            kind=MainDocument ;;
+        restore:-s|restore:--shard|test-restore:-s|test-restore:--shard|expand:-s|expand:--shard|reshard:-s|reshard:--shard)
+            kind=EncryptedKeyShard ;;
+        verify:-c|verify:--checksum|verify:--spotcheck|keyword:--pdf|keyword:--html|keyword:--latex|keyword:--svg|*:--config) ;;
+        verify:*|inspect:*|group:*|keyword:*)
+            [[ "${cur}" == -* ]] || kind=any ;;
+    esac
+    if [[ -z "${kind}" ]]; then
+        _@BIN@ "$@"
+        return
+    fi
+    local IFS=$'\n'
+    COMPREPLY=($(@BIN@ complete-documents "${kind}" -- "${cur}" 2>/dev/null))
+    compopt -o filenames 2>/dev/null
+}
+complete -F _@BIN@_documents -o bashdefault -o default @BIN@
+"#;
 
-    let mut quorum = UntrustedQuorum::new();
-    for (idx, shard_path) in shard_paths.enumerate() {
-        let encrypted_shard = EncryptedKeyShard::from_wire_zbase32(
-            read_oneline_file(&format!("Shard {} Data", idx + 1), shard_path)
-                .with_context(|| format!("read shard {}", idx + 1))?,
-        )
-        .map_err(|err| anyhow!(err)) // TODO: Fix this once FromWire supports non-String errors.
-        .with_context(|| format!("decode shard {}", idx + 1))?;
+/// Completion of document paths for zsh, wrapping the completion function
+/// generated by clap. "@BIN@" is replaced with the name of the binary.
+const ZSH_DOCUMENT_COMPLETION: &str = r#"
+_@BIN@_documents() {
+    local word subcommand kind
+    local -a candidates
+    for word in ${words[2,CURRENT-1]}; do
+        case $word in
+            backup|batch-backup|restore|test-restore|recover|expand|reshard|verify|inspect|group|keyword)
+                [[ -z $subcommand ]] && subcommand=$word ;;
+        esac
+    done
+    case "$subcommand:${words[CURRENT-1]}" in
+        restore:-M|restore:--main-document|test-restore:-M|test-restore:--main-document|reshard:-M|reshard:--main-document)
+            kind=MainDocument ;;
+        restore:-s|restore:--shard|test-restore:-s|test-restore:--shard|expand:-s|expand:--shard|reshard:-s|reshard:--shard)
+            kind=EncryptedKeyShard ;;
+        verify:-c|verify:--checksum|verify:--spotcheck|keyword:--pdf|keyword:--html|keyword:--latex|keyword:--svg|*:--config) ;;
+        verify:*|inspect:*|group:*|keyword:*)
+            [[ $PREFIX == -* ]] || kind=any ;;
+    esac
+    if [[ -z $kind ]]; then
+        _@BIN@ "$@"
+        return
+    fi
+    candidates=(${(f)"$(@BIN@ complete-documents $kind -- $PREFIX 2>/dev/null)"})
+    compadd -f -S '' -- ${(M)candidates:#*/}
+    compadd -f -- ${candidates:#*/}
+}
+"#;
 
-        print!("Shard {} Codeword: ", idx + 1);
-        io::stdout().flush()?;
-        let mut codeword_input = String::new();
-        io::stdin().read_line(&mut codeword_input)?;
+/// Completion of document paths for fish, which are added to the completions
+/// generated by clap. "@BIN@" is replaced with the name of the binary.
+const FISH_DOCUMENT_COMPLETION: &str = r#"
+complete -c @BIN@ -n "__fish_seen_subcommand_from restore test-restore reshard" -s M -l main-document -x -a "(@BIN@ complete-documents MainDocument -- (commandline -ct) 2>/dev/null)"
+complete -c @BIN@ -n "__fish_seen_subcommand_from restore test-restore expand reshard" -s s -l shard -x -a "(@BIN@ complete-documents EncryptedKeyShard -- (commandline -ct) 2>/dev/null)"
+complete -c @BIN@ -n "__fish_seen_subcommand_from verify inspect group keyword" -f -a "(@BIN@ complete-documents any -- (commandline -ct) 2>/dev/null)"
+"#;
 
-        let codewords = codeword_input
-            .split_whitespace()
-            .map(|s| s.to_owned())
-            .collect::<Vec<_>>();
+fn completions(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    let shell = matches
+        .value_of("SHELL")
+        .expect("required SHELL argument not given");
+    // Complete whatever name the binary was installed as.
+    let bin_name = env::args_os()
+        .next()
+        .as_ref()
+        .and_then(|arg0| Path::new(arg0).file_name())
+        .and_then(|name| name.to_str())
+        .unwrap_or("paperback")
+        .to_string();
 
-        let shard = encrypted_shard
-            .decrypt(&codewords)
-            .map_err(|err| anyhow!(err)) // TODO: Fix this once FromWire supports non-String errors.
-            .with_context(|| format!("decrypting shard {}", idx + 1))?;
-        quorum.push_shard(shard);
+    let mut script = vec![];
+    let (shell, extra) = match shell {
+        "bash" => (Shell::Bash, BASH_DOCUMENT_COMPLETION),
+        "zsh" => (Shell::Zsh, ZSH_DOCUMENT_COMPLETION),
+        "fish" => (Shell::Fish, FISH_DOCUMENT_COMPLETION),
+        shell => return Err(anyhow!("unsupported shell '{}'", shell)),
+    };
+    cli().gen_completions_to(&bin_name, shell, &mut script);
+    let mut script = String::from_utf8(script).context("generated completion script")?;
+    let extra = extra.replace("@BIN@", &bin_name);
+    match shell {
+        // The zsh script calls the completion function when it is autoloaded,
+        // which must now be the wrapper.
+        Shell::Zsh => {
+            let call = format!("_{} \"$@\"", bin_name);
+            let wrapper_call = format!("_{}_documents \"$@\"", bin_name);
+            match script.rfind(&call) {
+                Some(idx) => script.replace_range(idx..idx + call.len(), &(extra + &wrapper_call)),
+                None => script.push_str(&extra),
+            }
+        }
+        _ => script.push_str(&extra),
     }
 
-    let quorum = match quorum.validate() {
-        Ok(validated_quorum) => validated_quorum,
-        Err(err) => {
-            // TODO: Make this error much cleaner.
-            return Err(anyhow!(
-                "quorum failed to validate -- possible forgery! groupings: {:?}",
-                err.as_groups()
-            ));
-        }
+    io::stdout()
+        .write_all(script.as_bytes())
+        .context("write completion script")
+}
+
+/// Maximum size of a file which is read to check whether it is a document when
+/// completing paths, so that completion stays fast in directories containing
+/// large files.
+const MAX_COMPLETED_DOCUMENT_SIZE: u64 = 1 << 20;
+
+fn complete_documents(matches: &ArgMatches<'_>) -> Result<(), Error> {
+    use paperback::{AnyDocument, DocumentKind};
+
+    let kind = match matches.value_of("KIND") {
+        Some("any") | None => None,
+        Some(kind_name) => Some(
+            DocumentKind::all()
+                .iter()
+                .copied()
+                .find(|kind| kind.name() == kind_name)
+                .ok_or_else(|| failure!(Failure::Usage, "unknown document type '{}'", kind_name))?,
+        ),
+    };
+    let prefix = matches.value_of("PREFIX").unwrap_or("");
+    let (dir, name_prefix) = match prefix.rfind('/') {
+        Some(idx) => prefix.split_at(idx + 1),
+        None => ("", prefix),
     };
 
-    let new_shards = quorum
-        .extend_shards(num_new_shards)
-        .context("minting new shards")?
-        .iter()
-        .map(|s| s.encrypt().unwrap())
+    let is_document = |path: &Path| -> bool {
+        let small = fs::metadata(path)
+            .map(|metadata| metadata.len() <= MAX_COMPLETED_DOCUMENT_SIZE)
+            .unwrap_or(false);
+        small
+            && fs::read_to_string(path)
+                .ok()
+                .and_then(|text| AnyDocument::from_text(&text).ok())
+                .map_or(false, |document| {
+                    kind.map_or(true, |kind| document.kind() == kind)
+                })
+    };
+
+    // Unreadable directories simply have no completions.
+    let entries = match fs::read_dir(if dir.is_empty() { "." } else { dir }) {
+        Ok(entries) => entries,
+        Err(_) => return Ok(()),
+    };
+    let mut candidates = entries
+        .filter_map(|entry| entry.ok())
+        .filter_map(|entry| {
+            let name = entry.file_name().into_string().ok()?;
+            // Like most shells, only complete hidden files if asked to.
+            if !name.starts_with(name_prefix)
+                || (name.starts_with('.') && !name_prefix.starts_with('.'))
+            {
+                return None;
+            }
+            let path = entry.path();
+            if path.is_dir() {
+                Some(format!("{}{}/", dir, name))
+            } else if is_document(&path) {
+                Some(format!("{}{}", dir, name))
+            } else {
+                None
+            }
+        })
         .collect::<Vec<_>>();
+    candidates.sort();
 
-    for (i, (shard, keyword)) in new_shards.iter().enumerate() {
-        let decrypted_shard = shard.clone().decrypt(keyword).unwrap();
-        println!("----- BEGIN SHARD {} OF {} -----", i, num_new_shards);
-        println!("Document-ID: {}", decrypted_shard.document_id());
-        println!("Shard-ID: {}", decrypted_shard.id());
-        println!("Keywords: {}", keyword.join(" "));
-        println!("\n{}", shard.to_wire_zbase32());
-        println!("----- END SHARD {} OF {} -----", i, num_new_shards);
+    for candidate in candidates {
+        println!("{}", candidate);
     }
-
     Ok(())
 }
 
-fn raw(matches: &ArgMatches<'_>) -> Result<(), Error> {
-    match matches.subcommand() {
-        ("backup", Some(sub_matches)) => raw_backup(sub_matches),
-        ("restore", Some(sub_matches)) => raw_restore(sub_matches),
-        ("expand", Some(sub_matches)) => raw_expand(sub_matches),
-        (subcommand, _) => Err(anyhow!("unknown subcommand 'raw {}'", subcommand)),
-    }
+/// Definition of the command-line interface, which is also used to generate
+/// the shell completion scripts.
+/// Shared description of the input and output of the plumbing commands.
+const PLUMBING_HELP: &str = r#"PLUMBING:
+    These are plumbing commands for scripting, which expose one step of making or recovering a backup at a time: each reads one object from stdin and writes one object to stdout (as JSON, or CBOR with --format cbor). Binary data and documents are given as zbase32 strings starting with "h"."#;
+
+fn plumbing_format_arg() -> Arg<'static, 'static> {
+    Arg::with_name("format")
+        .long("format")
+        .value_name("FORMAT")
+        .help("Encoding of the object read from stdin and written to stdout.")
+        .possible_values(&["json", "cbor"])
+        .default_value("json")
 }
 
-fn main() -> Result<(), Box<dyn StdError>> {
-    let matches = App::new("paperback-cli")
+fn cli() -> App<'static, 'static> {
+    App::new("paperback-cli")
         .version("0.0.0")
         .author( "Aleksa Sarai <cyphar@cyphar.com>")
         .about("Operate on a paperback backup using a basic CLI interface.")
+        .after_help(EXIT_CODES_HELP)
+        .arg(Arg::with_name("json")
+            .long("json")
+            .global(true)
+            .help("Print the result of the command (or the error) as JSON on stdout, for use in scripts. Interactive prompts are written to stderr."))
+        .arg(Arg::with_name("config")
+            .long("config")
+            .value_name("PATH")
+            .global(true)
+            .help(r#"JSON config file with defaults for some flags, such as {"paper_size": "letter", "symbology": "aztec", "output_dir": "backups", "language": "french"} (default: $XDG_CONFIG_HOME/paperback/config.json, if it exists). Flags given on the command line always take precedence over the config file, as does --layout-config for the paper size."#)
+            .takes_value(true))
+        .arg(Arg::with_name("no_config")
+            .long("no-config")
+            .global(true)
+            .conflicts_with("config")
+            .help("Do not read the default config file."))
+        .arg(Arg::with_name("audit_log")
+            .long("audit-log")
+            .value_name("LOG PATH")
+            .global(true)
+            .requires("audit_key")
+            .help("Distribution log (created with \"raw audit-log init\") to record the shards issued by backup and reshard, created by expand, revoked by reshard and reprinted by keyword in.")
+            .takes_value(true))
+        .arg(Arg::with_name("audit_key")
+            .long("audit-key")
+            .value_name("KEY PATH")
+            .global(true)
+            .requires("audit_log")
+            .help("Key file to sign the entries added to --audit-log with.")
+            .takes_value(true))
+        .arg(Arg::with_name("audit_note")
+            .long("audit-note")
+            .value_name("NOTE")
+            .global(true)
+            .requires("audit_log")
+            .help("Free-form note to attach to the entry added to --audit-log, such as who the shards were given to.")
+            .takes_value(true))
         .subcommand(SubCommand::with_name("raw")
             .about("Operate using raw text data, rather than on PDF documents. This mode is not recommended for general use, since it might be more complicated for inexperienced users to recover the document.")
-            // paperback-cli raw backup [--sealed] --quorum-size <QUORUM SIZE> --shards <SHARDS> INPUT
+            // paperback-cli raw backup [--sealed] [--output-mode <MODE>] [--output-dir <DIRECTORY>] [--pdf <PDF PATH>] [--svg-dir <DIRECTORY>] [--html <HTML PATH>] [--latex <LATEX PATH>] --quorum-size <QUORUM SIZE> --shards <SHARDS> INPUT
             .subcommand(SubCommand::with_name("backup")
                 .about("Create a new paperback backup.")
                 .arg(Arg::with_name("sealed")
@@ -297,26 +4512,221 @@ fn main() -> Result<(), Box<dyn StdError>> {
                     .help("Create a sealed backup, which cannot be expanded (have new shards be created) after creation.")
                     .possible_values(&["true", "false"])
                     .default_value("false"))
+                .arg(Arg::with_name("compress")
+                    .long("compress")
+                    .help("Compress the secret data before encrypting it."))
+                .arg(Arg::with_name("language")
+                    .long("language")
+                    .value_name("LANGUAGE")
+                    .help("Language of the BIP-39 wordlist used for the shard codewords (default: english). The language is recorded in each shard, so it does not need to be given when recovering.")
+                    .possible_values(&["english", "chinese-simplified", "chinese-traditional", "french", "italian", "japanese", "korean", "spanish"])
+                    .takes_value(true))
+                .arg(Arg::with_name("timestamp_command")
+                    .long("timestamp-command")
+                    .value_name("COMMAND")
+                    .help("Shell command used to obtain a trusted (such as RFC 3161) timestamp token over the main document, which is stored in every shard. The main document is passed on stdin and the token must be written to stdout.")
+                    .takes_value(true))
                 .arg(Arg::with_name("quorum_size")
                     .short("q")
                     .long("quorum-size")
                     .value_name("QUORUM SIZE")
                     .help("Number of shards required to recover the document (must not be larger than --shards).")
                     .takes_value(true)
-                    .required(true))
+                    .required_unless("wizard"))
                 .arg(Arg::with_name("shards")
                     .short("s")
                     .long("shards")
                     .value_name("NUM SHARDS")
                     .help("Number of shards to create (must not be smaller than --quorum-size).")
                     .takes_value(true)
-                    .required(true))
+                    .required_unless("wizard"))
+                .arg(Arg::with_name("wizard")
+                    .long("wizard")
+                    .help("Instead of --quorum-size and --shards, interactively answer questions about the shardholders (how many there are, how reliable they are, and how many might collude or be attacked), and use the recommended quorum size and number of shards. The recommendation is based on the same simulation as \"simulate\".")
+                    .conflicts_with_all(&["quorum_size", "shards"]))
+                .arg(Arg::with_name("pdf")
+                    .long("pdf")
+                    .value_name("PDF PATH")
+                    .help(r#"Also write a printable PDF containing the main document and each shard (one per page) to this path ("-" to write to stdout instead of the text documents). The PDF only supports codeword languages written in the Latin alphabet."#)
+                    .takes_value(true))
+                .arg(Arg::with_name("source_date_epoch")
+                    .long("source-date-epoch")
+                    .value_name("SECONDS")
+                    .help("Record this time (in seconds since the Unix epoch) as the creation date of the PDF instead of the current time, so that the same backup always produces exactly the same PDF. Defaults to $SOURCE_DATE_EPOCH if set.")
+                    .takes_value(true)
+                    .requires("pdf"))
+                .arg(Arg::with_name("svg_dir")
+                    .long("svg-dir")
+                    .value_name("DIRECTORY")
+                    .help("Also write the main document and each shard as separate SVG images in this directory.")
+                    .takes_value(true))
+                .arg(Arg::with_name("html")
+                    .long("html")
+                    .value_name("HTML PATH")
+                    .help(r#"Also write a self-contained printable HTML file containing the main document and each shard (one per page) to this path ("-" to write to stdout instead of the text documents)."#)
+                    .takes_value(true))
+                .arg(Arg::with_name("latex")
+                    .long("latex")
+                    .value_name("LATEX PATH")
+                    .help(r#"Also write LaTeX source (which can be customised and compiled with any LaTeX engine) containing the main document and each shard (one per page) to this path ("-" to write to stdout instead of the text documents)."#)
+                    .takes_value(true))
+                .arg(Arg::with_name("holder")
+                    .long("holder")
+                    .value_name("NAME")
+                    .help("Name of the intended holder of a new shard, which is signed into the shard and printed on it. Can be given once per new shard, in order.")
+                    .takes_value(true)
+                    .multiple(true)
+                    .number_of_values(1))
+                .arg(Arg::with_name("contact")
+                    .long("contact")
+                    .value_name("CONTACT")
+                    .help("Contact details for the holder of a new shard, which are signed into the shard and printed on it. Can be given once per new shard, in order.")
+                    .takes_value(true)
+                    .multiple(true)
+                    .number_of_values(1))
+                .arg(Arg::with_name("note")
+                    .long("note")
+                    .value_name("NOTE")
+                    .help("Free-form note (such as where the shard is to be stored) for a new shard, which is signed into the shard and printed on it. Can be given once per new shard, in order.")
+                    .takes_value(true)
+                    .multiple(true)
+                    .number_of_values(1))
+                .arg(Arg::with_name("text_fallback")
+                    .long("text-fallback")
+                    .value_name("MODE")
+                    .help("Print the documents as numbered and checksummed lines of text (which can be typed in by hand) beneath or instead of the QR codes in printable output.")
+                    .possible_values(&["none", "beneath", "instead"])
+                    .default_value("none"))
+                .arg(Arg::with_name("symbology")
+                    .long("symbology")
+                    .value_name("SYMBOLOGY")
+                    .help("2D barcode symbology used for printable output (default: qr). Data Matrix symbols print denser at small sizes and tolerate different damage patterns to QR codes. Aztec codes have their finder pattern in the centre and need no quiet zone, so they survive scans which crop the edges of (for instance, folded) documents better.")
+                    .possible_values(&["qr", "datamatrix", "aztec"])
+                    .takes_value(true))
+                .arg(Arg::with_name("paper_size")
+                    .long("paper-size")
+                    .value_name("PAPER SIZE")
+                    .help("Paper size used for printable output (default: a4).")
+                    .possible_values(&["a4", "letter", "a5"])
+                    .takes_value(true))
+                .arg(Arg::with_name("margin")
+                    .long("margin")
+                    .value_name("MILLIMETRES")
+                    .help("Margin around the edge of each page of printable output (default: 20).")
+                    .takes_value(true))
+                .arg(Arg::with_name("qr_size")
+                    .long("qr-size")
+                    .value_name("MILLIMETRES")
+                    .help("Size of the QR codes on each page of printable output, shrunk to fit between the margins if necessary (default: 130).")
+                    .takes_value(true))
+                .arg(Arg::with_name("duplex")
+                    .long("duplex")
+                    .help("Lay out printable output for double-sided printing, by following each document with a blank page so that every document is printed on its own piece of paper."))
+                .arg(Arg::with_name("escrow_recipient")
+                    .long("escrow-recipient")
+                    .value_name("RECIPIENT")
+                    .help("Also wrap the key of the main document to this age recipient (an X25519 public key such as age1...), so that a digital escrow copy of the key exists alongside the key shards. Can be given several times. The recipients are listed in the authenticated metadata of the main document.")
+                    .takes_value(true)
+                    .multiple(true)
+                    .number_of_values(1)
+                    .requires("escrow_output"))
+                .arg(Arg::with_name("escrow_output")
+                    .long("escrow-output")
+                    .value_name("PATH")
+                    .help("Path to write the escrow copy of the key to, as an ASCII-armored age file which can be used with \"raw recover-escrow\" (together with the main document) to recover the secret data without any key shards.")
+                    .takes_value(true)
+                    .requires("escrow_recipient"))
+                .arg(Arg::with_name("output_mode")
+                    .long("output-mode")
+                    .value_name("MODE")
+                    .help("Where the main document is stored: printed along with the key shards in printable output (paper), only written out as a digital file to stdout or --output-dir (digital), or both. In digital mode the checksum of the main document (which every key shard records) is also printed on each key shard, so that whoever recovers the backup can check that they found the right file.")
+                    .possible_values(&["paper", "digital", "both"])
+                    .default_value("both"))
+                .arg(Arg::with_name("recovery_instructions")
+                    .long("recovery-instructions")
+                    .help("Also print a standalone page of recovery instructions for whoever recovers the backup (referring to the document ID, quorum size, number of shards and the algorithms used) before the documents in printable output. The instructions are written in the codeword --language if they have been translated into it (french, italian and spanish are available), and in English otherwise."))
+                .arg(Arg::with_name("hide")
+                    .long("hide")
+                    .value_name("ELEMENT")
+                    .help("Leave this element out of printable output. If the codewords are hidden, they must be stored some other way.")
+                    .possible_values(&["details", "instructions", "codewords"])
+                    .takes_value(true)
+                    .multiple(true)
+                    .number_of_values(1))
+                .arg(Arg::with_name("layout_config")
+                    .long("layout-config")
+                    .value_name("PATH")
+                    .help(r#"JSON file with default layout settings for printable output, such as {"paper_size": "a5", "margin_mm": 10, "qr_size_mm": 100, "duplex": true, "hide": ["instructions"]}. Layout flags take precedence over the file."#)
+                    .takes_value(true))
+                .arg(Arg::with_name("output_dir")
+                    .short("o")
+                    .long("output-dir")
+                    .value_name("DIRECTORY")
+                    .help("Write the main document and each shard to separate files in this directory (in the format read by \"raw restore\"), rather than printing them to stdout. The shard keywords are still only printed to stdout.")
+                    .takes_value(true))
+                .arg(Arg::with_name("output_template")
+                    .long("output-template")
+                    .value_name("TEMPLATE")
+                    .help("Template for the names of the files written for each document (without the extension), using Go text/template syntax. The fields .Kind (\"main-document\" or \"shard\"), .DocumentID, .ShardID, .Index (0 for the main document), .Total, .Date (of creation), .Label and .Holder are available, such as \"{{.Date}}-{{.DocumentID}}-{{.Index}}\". Every document must get a different name.")
+                    .takes_value(true))
                 .arg(Arg::with_name("INPUT")
-                    .help(r#"Path to secret data to backup ("-" to write to stdout)."#)
+                    .help(r#"Path to secret data to backup ("-" to read from stdin)."#)
                     .allow_hyphen_values(true)
                     .required(true)
                     .index(1)))
-            // paperback-cli raw restore --main-document <MAIN DOCUMENT> (--shards <SHARD>)... OUTPUT
+            // paperback-cli raw batch-backup [--sealed] [--compress] [--quorum-size <QUORUM SIZE>] [--shards <SHARDS>] (--manifest <MANIFEST> | --input-dir <DIRECTORY>) --output-dir <DIRECTORY>
+            .subcommand(SubCommand::with_name("batch-backup")
+                .about("Create a separate paperback backup of each of several secrets in one run, and print a summary of the backups created. Each backup is written to its own directory (named after the backup) inside --output-dir.")
+                .arg(Arg::with_name("sealed")
+                    .long("sealed")
+                    .help("Create sealed backups, which cannot be expanded (have new shards be created) after creation.")
+                    .possible_values(&["true", "false"])
+                    .default_value("false"))
+                .arg(Arg::with_name("compress")
+                    .long("compress")
+                    .help("Compress the secret data before encrypting it."))
+                .arg(Arg::with_name("language")
+                    .long("language")
+                    .value_name("LANGUAGE")
+                    .help("Language of the BIP-39 wordlist used for the shard codewords (default: english). The language is recorded in each shard, so it does not need to be given when recovering.")
+                    .possible_values(&["english", "chinese-simplified", "chinese-traditional", "french", "italian", "japanese", "korean", "spanish"])
+                    .takes_value(true))
+                .arg(Arg::with_name("quorum_size")
+                    .short("q")
+                    .long("quorum-size")
+                    .value_name("QUORUM SIZE")
+                    .help("Number of shards required to recover each document, unless set in the manifest.")
+                    .takes_value(true))
+                .arg(Arg::with_name("shards")
+                    .short("n")
+                    .long("shards")
+                    .value_name("NUM SHARDS")
+                    .help("Number of shards to create for each document, unless set in the manifest.")
+                    .takes_value(true))
+                .arg(Arg::with_name("manifest")
+                    .long("manifest")
+                    .value_name("PATH")
+                    .help(r#"JSON file listing the backups to create, such as [{"input": "keys/signing.key", "name": "signing", "quorum_size": 2, "shards": 3}]. Only "input" is required, and input paths are relative to the manifest. By default a backup is named after its input file (without the extension)."#)
+                    .takes_value(true)
+                    .required_unless("input_dir")
+                    .conflicts_with("input_dir"))
+                .arg(Arg::with_name("input_dir")
+                    .long("input-dir")
+                    .value_name("DIRECTORY")
+                    .help("Create a backup of each file in this directory (hidden files are skipped), named after the file (without the extension).")
+                    .takes_value(true))
+                .arg(Arg::with_name("output_template")
+                    .long("output-template")
+                    .value_name("TEMPLATE")
+                    .help("Template for the names of the files written for each document, as for \"raw backup\".")
+                    .takes_value(true))
+                .arg(Arg::with_name("output_dir")
+                    .short("o")
+                    .long("output-dir")
+                    .value_name("DIRECTORY")
+                    .help("Directory to write the backups to (required, unless set in the config file). The shard keywords are only printed in the summary.")
+                    .takes_value(true)))
+            // paperback-cli raw restore --main-document <MAIN DOCUMENT> (--shards <SHARD>)... (--output-target <TARGET> | OUTPUT)
             .subcommand(SubCommand::with_name("restore")
                 .about("Restore the secret data from a paperback backup.")
                 .arg(Arg::with_name("main_document")
@@ -335,14 +4745,93 @@ fn main() -> Result<(), Box<dyn StdError>> {
                     .multiple(true)
                     .number_of_values(1)
                     .required(true))
+                .arg(Arg::with_name("output_target")
+                    .long("output-target")
+                    .value_name("TARGET")
+                    .help(SECRET_OUTPUT_TARGET_HELP)
+                    .takes_value(true)
+                    .conflicts_with("OUTPUT"))
                 .arg(Arg::with_name("OUTPUT")
-                    .help(r#"Path to write recovered secret data to ("-" to write to stdout)."#)
+                    .help(SECRET_OUTPUT_HELP)
                     .allow_hyphen_values(true)
-                    .required(true)
+                    .required_unless("output_target")
+                    .index(1)))
+            // paperback-cli raw test-restore --main-document <MAIN DOCUMENT> (--shards <SHARD>)...
+            .subcommand(SubCommand::with_name("test-restore")
+                .about("Rehearse restoring a paperback backup. The secret data is recovered in memory and is never written out -- only its BLAKE2b-256 checksum (the same as \"b2sum -l 256\") is printed, so it can be compared against the original secret data.")
+                .arg(Arg::with_name("main_document")
+                    .short("M")
+                    .long("main-document")
+                    .value_name("MAIN DOCUMENT PATH")
+                    .help(r#"Path to paperback main document ("-" to read from stdin)."#)
+                    .takes_value(true)
+                    .required(true))
+                .arg(Arg::with_name("shards")
+                    .short("s")
+                    .long("shard")
+                    .value_name("SHARD PATH")
+                    .help(r#"Path to each paperback shard ("-" to read from stdin)."#)
+                    .takes_value(true)
+                    .multiple(true)
+                    .number_of_values(1)
+                    .required(true)))
+            // paperback-cli raw recover [--session <SESSION>] (--output-target <TARGET> | OUTPUT)
+            .subcommand(SubCommand::with_name("recover")
+                .about("Interactively restore the secret data from a paperback backup, prompting for the main document and each shard in turn (as a path, pasted armored text, pasted zbase32 data, or the typed-in text lines from a printed document).")
+                .arg(Arg::with_name("session")
+                    .long("session")
+                    .value_name("SESSION")
+                    .help("Path to a recovery session file, encrypted with a passphrase, which records the documents entered so far. If the recovery is interrupted (such as while waiting for shards to arrive by mail), running the command again with the same session resumes where it left off. The session file holds decrypted shards, so it is removed once the secret has been recovered. The session passphrase is read from the terminal (without being echoed).")
+                    .takes_value(true))
+                .arg(Arg::with_name("output_target")
+                    .long("output-target")
+                    .value_name("TARGET")
+                    .help(SECRET_OUTPUT_TARGET_HELP)
+                    .takes_value(true)
+                    .conflicts_with("OUTPUT"))
+                .arg(Arg::with_name("OUTPUT")
+                    .help(SECRET_OUTPUT_HELP)
+                    .allow_hyphen_values(true)
+                    .required_unless("output_target")
+                    .index(1)))
+            // paperback-cli raw recover-escrow --main-document <MAIN DOCUMENT> --escrow <ESCROW> --identity <IDENTITY> (--output-target <TARGET> | OUTPUT)
+            .subcommand(SubCommand::with_name("recover-escrow")
+                .about("Restore the secret data from a paperback main document using the digital escrow copy of its key (created with \"raw backup --escrow-recipient\") instead of a quorum of shards.")
+                .arg(Arg::with_name("main_document")
+                    .short("M")
+                    .long("main-document")
+                    .value_name("MAIN DOCUMENT PATH")
+                    .help(r#"Path to paperback main document ("-" to read from stdin)."#)
+                    .takes_value(true)
+                    .required(true))
+                .arg(Arg::with_name("escrow")
+                    .short("e")
+                    .long("escrow")
+                    .value_name("ESCROW PATH")
+                    .help("Path to the escrow copy of the key (an age file, as written by \"raw backup --escrow-output\").")
+                    .takes_value(true)
+                    .required(true))
+                .arg(Arg::with_name("identity")
+                    .short("i")
+                    .long("identity")
+                    .value_name("IDENTITY PATH")
+                    .help("Path to an age identity file containing the secret key (AGE-SECRET-KEY-1...) of one of the escrow recipients.")
+                    .takes_value(true)
+                    .required(true))
+                .arg(Arg::with_name("output_target")
+                    .long("output-target")
+                    .value_name("TARGET")
+                    .help(SECRET_OUTPUT_TARGET_HELP)
+                    .takes_value(true)
+                    .conflicts_with("OUTPUT"))
+                .arg(Arg::with_name("OUTPUT")
+                    .help(SECRET_OUTPUT_HELP)
+                    .allow_hyphen_values(true)
+                    .required_unless("output_target")
                     .index(1)))
             // paperback-cli raw expand --new-shards <N> (--shards <SHARD>)...
             .subcommand(SubCommand::with_name("expand")
-                .about("Restore the secret data from a paperback backup.")
+                .about("Create new shards for an existing (unsealed) paperback backup. If the backup has a shard roster, the new shards carry a roster which also lists the new shards.")
                 .arg(Arg::with_name("new_shards")
                     .short("n")
                     .long("new-shards")
@@ -350,6 +4839,27 @@ fn main() -> Result<(), Box<dyn StdError>> {
                     .help(r#"Number of new shards to create."#)
                     .takes_value(true)
                     .required(true))
+                .arg(Arg::with_name("holder")
+                    .long("holder")
+                    .value_name("NAME")
+                    .help("Name of the intended holder of a new shard, which is signed into the shard and printed on it. Can be given once per new shard, in order.")
+                    .takes_value(true)
+                    .multiple(true)
+                    .number_of_values(1))
+                .arg(Arg::with_name("contact")
+                    .long("contact")
+                    .value_name("CONTACT")
+                    .help("Contact details for the holder of a new shard, which are signed into the shard and printed on it. Can be given once per new shard, in order.")
+                    .takes_value(true)
+                    .multiple(true)
+                    .number_of_values(1))
+                .arg(Arg::with_name("note")
+                    .long("note")
+                    .value_name("NOTE")
+                    .help("Free-form note (such as where the shard is to be stored) for a new shard, which is signed into the shard and printed on it. Can be given once per new shard, in order.")
+                    .takes_value(true)
+                    .multiple(true)
+                    .number_of_values(1))
                 .arg(Arg::with_name("shards")
                     .short("s")
                     .long("shard")
@@ -359,13 +4869,413 @@ fn main() -> Result<(), Box<dyn StdError>> {
                     .multiple(true)
                     .number_of_values(1)
                     .required(true)))
+            // paperback-cli raw reshard [--sealed] [--output-dir <DIRECTORY>] --main-document <MAIN DOCUMENT> (--shard <SHARD>)... --quorum-size <QUORUM SIZE> --new-shards <SHARDS>
+            .subcommand(SubCommand::with_name("reshard")
+                .about("Change the quorum size or number of shards of a paperback backup. The secret data is recovered using the main document and a quorum of shards, and backed up again with a new identity. Every key shard of the new backup is marked as revoking the old main document and all of the old shards that are known (the shards given and any listed in their rosters). The old documents cannot be combined with the new ones and should be destroyed.")
+                .arg(Arg::with_name("main_document")
+                    .short("M")
+                    .long("main-document")
+                    .value_name("MAIN DOCUMENT PATH")
+                    .help(r#"Path to the old paperback main document ("-" to read from stdin)."#)
+                    .takes_value(true)
+                    .required(true))
+                .arg(Arg::with_name("shards")
+                    .short("s")
+                    .long("shard")
+                    .value_name("SHARD PATH")
+                    .help(r#"Path to each old paperback shard ("-" to read from stdin)."#)
+                    .takes_value(true)
+                    .multiple(true)
+                    .number_of_values(1)
+                    .required(true))
+                .arg(Arg::with_name("sealed")
+                    .long("sealed")
+                    .help("Create a sealed backup, which cannot be expanded (have new shards be created) after creation.")
+                    .possible_values(&["true", "false"])
+                    .default_value("false"))
+                .arg(Arg::with_name("language")
+                    .long("language")
+                    .value_name("LANGUAGE")
+                    .help("Language of the BIP-39 wordlist used for the new shard codewords (default: the language of the old shards).")
+                    .possible_values(&["english", "chinese-simplified", "chinese-traditional", "french", "italian", "japanese", "korean", "spanish"])
+                    .takes_value(true))
+                .arg(Arg::with_name("quorum_size")
+                    .short("q")
+                    .long("quorum-size")
+                    .value_name("QUORUM SIZE")
+                    .help("Number of shards required to recover the new document (must not be larger than --new-shards).")
+                    .takes_value(true)
+                    .required(true))
+                .arg(Arg::with_name("new_shards")
+                    .short("n")
+                    .long("new-shards")
+                    .value_name("NUM SHARDS")
+                    .help("Number of new shards to create (must not be smaller than --quorum-size).")
+                    .takes_value(true)
+                    .required(true))
+                .arg(Arg::with_name("output_dir")
+                    .short("o")
+                    .long("output-dir")
+                    .value_name("DIRECTORY")
+                    .help("Write the new main document and each new shard to separate files in this directory (in the format read by \"raw restore\"), rather than printing them to stdout. The shard keywords are still only printed to stdout.")
+                    .takes_value(true))
+                .arg(Arg::with_name("output_template")
+                    .long("output-template")
+                    .value_name("TEMPLATE")
+                    .help("Template for the names of the files written for each document (without the extension), using Go text/template syntax. The fields .Kind (\"main-document\" or \"shard\"), .DocumentID, .ShardID, .Index (0 for the main document), .Total, .Date (of creation), .Label and .Holder are available, such as \"{{.Date}}-{{.DocumentID}}-{{.Index}}\". Every document must get a different name.")
+                    .takes_value(true)))
+            // paperback-cli raw schema
+            .subcommand(SubCommand::with_name("schema")
+                .about("Print a machine-readable (JSON) description of the paperback wire format."))
+            // paperback-cli raw validate --type <TYPE> INPUT
+            .subcommand(SubCommand::with_name("validate")
+                .about("Check whether a document is a valid encoding of the given document type.")
+                .arg(Arg::with_name("type")
+                    .short("t")
+                    .long("type")
+                    .value_name("TYPE")
+                    .help("Type of document to validate.")
+                    .possible_values(&["MainDocument", "EncryptedKeyShard", "KeyShard", "AuditResponse", "Page"])
+                    .takes_value(true)
+                    .required(true))
+                .arg(Arg::with_name("INPUT")
+                    .help(r#"Path to the zbase32-encoded document ("-" to read from stdin)."#)
+                    .allow_hyphen_values(true)
+                    .required(true)
+                    .index(1)))
+            // paperback-cli raw verify [--checksum <CHECKSUM>] [--spotcheck <DIGITS>] [--scan <ORIGINAL>] INPUT...
+            .subcommand(SubCommand::with_name("verify")
+                .about("Check that documents of any kind are intact (well-formed, with a supported schema version and a valid signature) without needing a quorum or any codewords. Encrypted key shards can only be checked for well-formedness.")
+                .arg(Arg::with_name("checksum")
+                    .short("c")
+                    .long("checksum")
+                    .value_name("CHECKSUM")
+                    .help("Expected checksum of the main document (as printed on the main document), which the documents must belong to.")
+                    .takes_value(true))
+                .arg(Arg::with_name("spotcheck")
+                    .long("spotcheck")
+                    .value_name("DIGITS")
+                    .help("Expected spot-check digits (as printed in the top-right corner of the original document). The digits are recomputed from each document, so scanning a photocopy and comparing its digits confirms that the copy matches the original.")
+                    .takes_value(true))
+                .arg(Arg::with_name("scan")
+                    .long("scan")
+                    .value_name("ORIGINAL")
+                    .help("Path to a document which was just printed, to be run before the printed copy is distributed. Each INPUT is then what was read back from the printed page (such as the output of a barcode scanner reading its QR codes, or its typed-in text lines), and is checked to be identical to ORIGINAL byte for byte. This catches printer driver corruption and barcodes which cannot be read (such as from low toner). paperback cannot read images, so the page has to be scanned with a separate barcode reader.")
+                    .takes_value(true))
+                .arg(Arg::with_name("INPUT")
+                    .help(r#"Path to each document, as armored text, text lines or zbase32 ("-" to read from stdin)."#)
+                    .allow_hyphen_values(true)
+                    .multiple(true)
+                    .required(true)
+                    .index(1)))
+            // paperback-cli raw inspect [--decrypt] INPUT
+            .subcommand(SubCommand::with_name("inspect")
+                .about("Print the non-secret metadata of a document of any kind (such as its document and shard IDs, quorum size, dates, holder and identity key fingerprint).")
+                .arg(Arg::with_name("decrypt")
+                    .long("decrypt")
+                    .help("Prompt for the codewords of an encrypted key shard, so that its metadata can be shown."))
+                .arg(Arg::with_name("INPUT")
+                    .help(r#"Path to the document, as armored text, text lines or zbase32 ("-" to read from stdin)."#)
+                    .allow_hyphen_values(true)
+                    .required(true)
+                    .index(1)))
+            // paperback-cli raw keyword [--pdf <PDF PATH>] [--html <HTML PATH>] [--latex <LATEX PATH>] [--svg <SVG PATH>] INPUT
+            .subcommand(SubCommand::with_name("keyword")
+                .about("Print the keywords (codewords) of a key shard again, such as when the detachable codeword section of the shard was lost. For an encrypted key shard, the keywords are prompted for and checked (so they must still be known, such as from a digital copy). A decrypted key shard is encrypted again with new keywords, and the new encrypted shard (which replaces the old one) is printed as well.")
+                .arg(Arg::with_name("pdf")
+                    .long("pdf")
+                    .value_name("PDF PATH")
+                    .help(r#"Also write a printable PDF of the codeword page (preceded by the new shard, if it was encrypted again) to this path ("-" to write to stdout instead). The PDF only supports codeword languages written in the Latin alphabet."#)
+                    .takes_value(true))
+                .arg(Arg::with_name("html")
+                    .long("html")
+                    .value_name("HTML PATH")
+                    .help(r#"Also write a printable HTML file of the codeword page (preceded by the new shard, if it was encrypted again) to this path ("-" to write to stdout instead)."#)
+                    .takes_value(true))
+                .arg(Arg::with_name("latex")
+                    .long("latex")
+                    .value_name("LATEX PATH")
+                    .help(r#"Also write LaTeX source of the codeword page (preceded by the new shard, if it was encrypted again) to this path ("-" to write to stdout instead)."#)
+                    .takes_value(true))
+                .arg(Arg::with_name("svg")
+                    .long("svg")
+                    .value_name("SVG PATH")
+                    .help(r#"Also write the codeword page as an SVG image to this path ("-" to write to stdout instead)."#)
+                    .takes_value(true))
+                .arg(Arg::with_name("paper_size")
+                    .long("paper-size")
+                    .value_name("PAPER SIZE")
+                    .help("Paper size used for printable output (default: a4).")
+                    .possible_values(&["a4", "letter", "a5"])
+                    .takes_value(true))
+                .arg(Arg::with_name("INPUT")
+                    .help(r#"Path to the encrypted or decrypted key shard, as armored text, text lines or zbase32 ("-" to read from stdin)."#)
+                    .allow_hyphen_values(true)
+                    .required(true)
+                    .index(1)))
+            // paperback-cli raw group [--decrypt] INPUT...
+            .subcommand(SubCommand::with_name("group")
+                .about("Sort a pile of documents from any number of backups by the backup they belong to, without recovering anything. Each document is listed with its backup, shard ID and whether it is valid, forged or a duplicate, followed by whether each backup has reached its quorum.")
+                .arg(Arg::with_name("decrypt")
+                    .long("decrypt")
+                    .help("Prompt for the codewords of each encrypted key shard, which is needed to tell which backup it belongs to."))
+                .arg(Arg::with_name("INPUT")
+                    .help(r#"Path to each document, as armored text, text lines or zbase32 ("-" to read from stdin)."#)
+                    .allow_hyphen_values(true)
+                    .multiple(true)
+                    .required(true)
+                    .index(1)))
+            // paperback-cli raw prepare --package <PACKAGE> -- [BACKUP ARGS]...
+            .subcommand(SubCommand::with_name("prepare")
+                .about("Prepare a backup on a network-connected machine, to be created on an air-gapped machine with \"raw finalize\". The \"raw backup\" arguments (except INPUT) are checked and written to a work package, and a package code is printed which must be entered on the air-gapped machine. No secret data or key material is handled by this command.")
+                .arg(Arg::with_name("package")
+                    .short("p")
+                    .long("package")
+                    .value_name("PACKAGE PATH")
+                    .help("Path to write the work package to.")
+                    .takes_value(true)
+                    .required(true))
+                .arg(Arg::with_name("ARGS")
+                    .help(r#"Arguments for "raw backup" (such as -- --quorum-size 2 --shards 3 --pdf backup.pdf), without the INPUT argument. Paths are relative to the directory "raw finalize" is run in."#)
+                    .allow_hyphen_values(true)
+                    .multiple(true)
+                    .required(true)
+                    .last(true)))
+            // paperback-cli raw finalize --package <PACKAGE> [--code <CODE>] INPUT
+            .subcommand(SubCommand::with_name("finalize")
+                .about("Create a backup on an air-gapped machine from a work package written by \"raw prepare\", after checking the package against the package code shown when it was prepared.")
+                .arg(Arg::with_name("package")
+                    .short("p")
+                    .long("package")
+                    .value_name("PACKAGE PATH")
+                    .help("Path to the work package.")
+                    .takes_value(true)
+                    .required(true))
+                .arg(Arg::with_name("code")
+                    .long("code")
+                    .value_name("CODE")
+                    .help("Package code shown by \"raw prepare\" (prompted for if not given).")
+                    .takes_value(true))
+                .arg(Arg::with_name("INPUT")
+                    .help(r#"Path to read the secret data to back up from ("-" to read from stdin)."#)
+                    .allow_hyphen_values(true)
+                    .required(true)
+                    .index(1)))
+            // paperback-cli raw audit-log (init|verify|show) ...
+            .subcommand(SubCommand::with_name("audit-log")
+                .about("Manage a tamper-evident distribution log, recording when shards were issued, expanded, reprinted or revoked (with --audit-log), so there is a history of who should hold which shards. Each entry is signed and includes the hash of the previous entry.")
+                .setting(AppSettings::SubcommandRequiredElseHelp)
+                // paperback-cli raw audit-log init --key <KEY> LOG
+                .subcommand(SubCommand::with_name("init")
+                    .about("Create a new, empty distribution log and the key used to sign its entries.")
+                    .arg(Arg::with_name("key")
+                        .short("k")
+                        .long("key")
+                        .value_name("KEY PATH")
+                        .help("Path to write the new key file to. The key should be stored separately from the log, since anyone with the key can rewrite the log.")
+                        .takes_value(true)
+                        .required(true))
+                    .arg(Arg::with_name("LOG")
+                        .help("Path to write the new distribution log to.")
+                        .required(true)
+                        .index(1)))
+                // paperback-cli raw audit-log verify [--fingerprint <FINGERPRINT>] [--head <HEAD>] LOG
+                .subcommand(SubCommand::with_name("verify")
+                    .about("Verify the signature of every entry of a distribution log and the hash chain linking them together.")
+                    .arg(Arg::with_name("fingerprint")
+                        .long("fingerprint")
+                        .value_name("FINGERPRINT")
+                        .help("Fingerprint of the key the log must be signed with (as printed by \"raw audit-log init\"), to detect the whole log being replaced.")
+                        .takes_value(true))
+                    .arg(Arg::with_name("head")
+                        .long("head")
+                        .value_name("HEAD")
+                        .help("Head of the log recorded earlier (such as the Audit-Log-Head printed by \"raw keyword\"), to detect entries being removed from the end of the log.")
+                        .takes_value(true))
+                    .arg(Arg::with_name("LOG")
+                        .help(r#"Path to the distribution log ("-" to read from stdin)."#)
+                        .allow_hyphen_values(true)
+                        .required(true)
+                        .index(1)))
+                // paperback-cli raw audit-log show LOG
+                .subcommand(SubCommand::with_name("show")
+                    .about("Verify a distribution log and list its entries.")
+                    .arg(Arg::with_name("LOG")
+                        .help(r#"Path to the distribution log ("-" to read from stdin)."#)
+                        .allow_hyphen_values(true)
+                        .required(true)
+                        .index(1))))
             )
-            .get_matches();
+        // paperback-cli selftest
+        .subcommand(SubCommand::with_name("selftest")
+            .about("Check that this build of paperback works before trusting it with real secrets (such as after copying it to an air-gapped machine), by sanity-checking the random number generators, comparing the built-in wordlists to their known digests, and backing up and recovering random data entirely in memory (including through the payloads of every barcode symbology)."))
+        // paperback-cli simulate [--holder <LOSS:COMPROMISE>]... [--loss <P>] [--compromise <P>] [--max-shards <N>] [--quorum-size <K>] [--shards <N>] [--trials <TRIALS>]
+        .subcommand(SubCommand::with_name("simulate")
+            .about("Help choose the quorum size (K) and number of shards (N) of a backup, by simulating its lifetime many times over and estimating, for each K and N, the probability that too many shards are lost to recover the secret and the probability that an attacker obtains a quorum of shards.")
+            .arg(Arg::with_name("holder")
+                .long("holder")
+                .value_name("LOSS:COMPROMISE")
+                .help("Probabilities (such as 0.05:0.01 or 5%:1%) of one shardholder losing their shard and of an attacker obtaining it, over the lifetime of the backup. Give this once per shardholder, in the order the shards would be handed out. Overrides --loss, --compromise and --max-shards.")
+                .takes_value(true)
+                .multiple(true)
+                .number_of_values(1))
+            .arg(Arg::with_name("loss")
+                .long("loss")
+                .value_name("P")
+                .help("Probability of any shardholder losing their shard, if --holder is not given.")
+                .takes_value(true)
+                .default_value("0.05"))
+            .arg(Arg::with_name("compromise")
+                .long("compromise")
+                .value_name("P")
+                .help("Probability of an attacker obtaining any one shard, if --holder is not given.")
+                .takes_value(true)
+                .default_value("0.01"))
+            .arg(Arg::with_name("max_shards")
+                .long("max-shards")
+                .value_name("N")
+                .help("Number of shardholders, if --holder is not given.")
+                .takes_value(true)
+                .default_value("7"))
+            .arg(Arg::with_name("quorum_size")
+                .short("k")
+                .long("quorum-size")
+                .value_name("QUORUM SIZE")
+                .help("Only simulate backups with this quorum size.")
+                .takes_value(true))
+            .arg(Arg::with_name("shards")
+                .short("n")
+                .long("shards")
+                .value_name("NUM SHARDS")
+                .help("Only simulate backups with this number of shards.")
+                .takes_value(true))
+            .arg(Arg::with_name("trials")
+                .long("trials")
+                .value_name("TRIALS")
+                .help("Number of lifetimes of the backup to simulate.")
+                .takes_value(true)
+                .default_value("100000")))
+        // paperback-cli shard (encrypt|decrypt) [--format <FORMAT>]
+        .subcommand(SubCommand::with_name("shard")
+            .about("Encrypt or decrypt a single key shard.")
+            .after_help(PLUMBING_HELP)
+            .setting(AppSettings::SubcommandRequiredElseHelp)
+            // paperback-cli shard encrypt [--format <FORMAT>]
+            .subcommand(SubCommand::with_name("encrypt")
+                .about(r#"Encrypt a key shard with new codewords. Reads {"shard"} (an unencrypted KeyShard) and writes {"shard", "codewords"}."#)
+                .arg(plumbing_format_arg()))
+            // paperback-cli shard decrypt [--format <FORMAT>]
+            .subcommand(SubCommand::with_name("decrypt")
+                .about(r#"Decrypt a key shard with its codewords. Reads {"shard", "codewords"} and writes {"shard"} (an unencrypted KeyShard)."#)
+                .arg(plumbing_format_arg())))
+        // paperback-cli key (split|combine) [--format <FORMAT>]
+        .subcommand(SubCommand::with_name("key")
+            .about("Split a secret into Shamir shards, or combine them again. These are bare shards, without the signatures or metadata of the shards in a backup.")
+            .after_help(PLUMBING_HELP)
+            .setting(AppSettings::SubcommandRequiredElseHelp)
+            // paperback-cli key split [--format <FORMAT>]
+            .subcommand(SubCommand::with_name("split")
+                .about(r#"Split a secret. Reads {"secret", "quorum_size", "shards"} and writes {"shards"}."#)
+                .arg(plumbing_format_arg()))
+            // paperback-cli key combine [--format <FORMAT>]
+            .subcommand(SubCommand::with_name("combine")
+                .about(r#"Recover a secret from at least a quorum of its shards. Reads {"shards"} and writes {"secret"}."#)
+                .arg(plumbing_format_arg())))
+        // paperback-cli packet (seal|open) [--format <FORMAT>]
+        .subcommand(SubCommand::with_name("packet")
+            .about("Encrypt or decrypt data with ChaCha20-Poly1305, as used for the contents of a main document.")
+            .after_help(PLUMBING_HELP)
+            .setting(AppSettings::SubcommandRequiredElseHelp)
+            // paperback-cli packet seal [--format <FORMAT>]
+            .subcommand(SubCommand::with_name("seal")
+                .about(r#"Encrypt data. Reads {"plaintext"} (with an optional "key", which is generated if not given, and optional "aad" to authenticate) and writes {"key", "nonce", "ciphertext"}."#)
+                .arg(plumbing_format_arg()))
+            // paperback-cli packet open [--format <FORMAT>]
+            .subcommand(SubCommand::with_name("open")
+                .about(r#"Decrypt data. Reads {"key", "nonce", "ciphertext"} (and "aad", if it was given when sealing) and writes {"plaintext"}."#)
+                .arg(plumbing_format_arg())))
+        // paperback-cli completions SHELL
+        .subcommand(SubCommand::with_name("completions")
+            .about("Print a completion script for the given shell. Paths to documents are completed by their contents, so only main documents are offered for --main-document, only shards for --shard, and so on. For example, with bash: source <(paperback completions bash).")
+            .arg(Arg::with_name("SHELL")
+                .help("Shell to generate the completion script for.")
+                .possible_values(&["bash", "zsh", "fish"])
+                .required(true)
+                .index(1)))
+        // paperback-cli complete-documents KIND [PREFIX]
+        .subcommand(SubCommand::with_name("complete-documents")
+            .about("List the paths starting with PREFIX which are directories or documents of the given kind, for use by the completion scripts.")
+            .setting(AppSettings::Hidden)
+            .arg(Arg::with_name("KIND")
+                .help(r#"Kind of document to list ("any" for documents of any kind)."#)
+                .possible_values(&["any", "MainDocument", "EncryptedKeyShard", "KeyShard", "AuditResponse", "Page"])
+                .required(true)
+                .index(1))
+            .arg(Arg::with_name("PREFIX")
+                .help("Partial path to complete.")
+                .allow_hyphen_values(true)
+                .index(2)))
+}
+
+/// Reports `err` (as JSON in --json mode) and exits with the exit code of its
+/// cause.
+fn exit_with_error(err: Error) -> ! {
+    let failure = Failure::of(&err);
+    if json_output() {
+        let report = serde_json::json!({
+            "error": {
+                "kind": failure.name(),
+                "exit_code": failure.exit_code(),
+                "message": format!("{:#}", err),
+                "causes": err.chain().map(|cause| cause.to_string()).collect::<Vec<_>>(),
+            }
+        });
+        // Nothing else can be done if stdout is gone.
+        let _ = print_json(&report);
+    } else {
+        eprintln!("Error: {:?}", err);
+    }
+    process::exit(failure.exit_code());
+}
+
+fn main() {
+    let matches = match cli().get_matches_safe() {
+        Ok(matches) => matches,
+        // --help and --version are also reported as errors by clap.
+        Err(err) if !err.use_stderr() => err.exit(),
+        Err(err) => {
+            // The arguments could not be parsed, so --json has to be found by
+            // hand.
+            if env::args().any(|arg| arg == "--json") {
+                JSON_OUTPUT.store(true, Ordering::Relaxed);
+                exit_with_error(failure!(Failure::Usage, "{}", err.message));
+            }
+            eprintln!("{}", err.message);
+            process::exit(Failure::Usage.exit_code());
+        }
+    };
+
+    JSON_OUTPUT.store(global_present(&matches, "json"), Ordering::Relaxed);
 
-    let ret = match matches.subcommand() {
+    let ret = load_config(&matches).map(|config| {
+        CONFIG
+            .set(config)
+            .expect("config file must only be loaded once")
+    });
+
+    let ret = ret.and_then(|_| match matches.subcommand() {
         ("raw", Some(sub_matches)) => raw(sub_matches),
+        ("selftest", Some(sub_matches)) => selftest(sub_matches),
+        ("simulate", Some(sub_matches)) => simulate(sub_matches),
+        ("shard", Some(sub_matches)) => shard(sub_matches),
+        ("key", Some(sub_matches)) => key(sub_matches),
+        ("packet", Some(sub_matches)) => packet(sub_matches),
+        ("completions", Some(sub_matches)) => completions(sub_matches),
+        ("complete-documents", Some(sub_matches)) => complete_documents(sub_matches),
         (subcommand, _) => Err(anyhow!("unknown subcommand '{}'", subcommand)),
-    }?;
+    });
 
-    Ok(ret)
+    if let Err(err) = ret {
+        exit_with_error(err);
+    }
 }